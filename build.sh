@@ -3,6 +3,6 @@
 # Put installed packages into ./bin
 export GOBIN=$PWD/`dirname $0`/bin
 
-go install -v $PWD/`dirname $0`/cmd/...
+go install -v -tags sqlite_fts5 $PWD/`dirname $0`/cmd/...
 
 GOOS=js GOARCH=wasm go build -o main.wasm ./cmd/dendritejs
@@ -34,6 +34,7 @@ type DendriteMonolith struct {
 	StorageDirectory string
 	listener         net.Listener
 	httpServer       *http.Server
+	stopUserAPI      func()
 	httpListening    atomic.Bool
 	yggListening     atomic.Bool
 }
@@ -92,6 +93,10 @@ func (m *DendriteMonolith) Start() {
 	cfg.Kafka.Topics.OutputClientData = "clientapiOutput"
 	cfg.Kafka.Topics.OutputTypingEvent = "typingServerOutput"
 	cfg.Kafka.Topics.OutputSendToDeviceEvent = "sendToDeviceOutput"
+	cfg.Kafka.Topics.OutputReceiptEvent = "receiptOutput"
+	cfg.Kafka.Topics.OutputPresenceEvent = "presenceOutput"
+	cfg.Kafka.Topics.OutputNotificationData = "notificationDataOutput"
+	cfg.Kafka.Topics.OutputDevicesDeleted = "devicesDeletedOutput"
 	cfg.Database.Account = config.DataSource(fmt.Sprintf("file:%s/dendrite-account.db", m.StorageDirectory))
 	cfg.Database.Device = config.DataSource(fmt.Sprintf("file:%s/dendrite-device.db", m.StorageDirectory))
 	cfg.Database.MediaAPI = config.DataSource(fmt.Sprintf("file:%s/dendrite-mediaapi.db", m.StorageDirectory))
@@ -119,12 +124,15 @@ func (m *DendriteMonolith) Start() {
 	serverKeyAPI := &signing.YggdrasilKeys{}
 	keyRing := serverKeyAPI.KeyRing()
 	keyAPI := keyserver.NewInternalAPI(base.Cfg, federation, base.KafkaProducer)
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, keyAPI)
+	userSyncProducer := userapi.NewSyncProducer(base.Cfg, base.KafkaProducer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, keyAPI, userSyncProducer)
+	m.stopUserAPI = userAPI.Stop
 	keyAPI.SetUserAPI(userAPI)
 
 	rsAPI := roomserver.NewInternalAPI(
 		base, keyRing, federation,
 	)
+	userapi.StartConsumers(base.Cfg, base.KafkaConsumer, accountDB, rsAPI, userSyncProducer)
 
 	eduInputAPI := eduserver.NewInternalAPI(
 		base, cache.New(), userAPI,
@@ -161,7 +169,7 @@ func (m *DendriteMonolith) Start() {
 			ygg, fsAPI, federation,
 		),
 	}
-	monolith.AddAllPublicRoutes(base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.PublicAPIMux, base.SynapseAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.BaseMux,
@@ -207,4 +215,7 @@ func (m *DendriteMonolith) Suspend() {
 	if err := m.httpServer.Close(); err != nil {
 		m.logger.Warn("Error stopping HTTP server:", err)
 	}
+	// No more requests will be served, so write out the last seen
+	// information of devices in case the app is killed while suspended.
+	m.stopUserAPI()
 }
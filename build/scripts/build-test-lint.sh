@@ -8,9 +8,9 @@ set -eu
 # When `go build` is given multiple packages it won't output anything, and just
 # checks that everything builds.
 echo "Checking that it builds..."
-go build ./cmd/...
+go build -tags sqlite_fts5 ./cmd/...
 
 ./build/scripts/find-lint.sh
 
 echo "Testing..."
-go test -v ./...
+go test -v -tags sqlite_fts5 ./...
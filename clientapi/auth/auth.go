@@ -20,6 +20,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
@@ -64,6 +65,8 @@ func VerifyUserFromRequest(
 	err = userAPI.QueryAccessToken(req.Context(), &api.QueryAccessTokenRequest{
 		AccessToken:      token,
 		AppServiceUserID: req.URL.Query().Get("user_id"),
+		IPAddr:           requestIPAddr(req),
+		UserAgent:        req.UserAgent(),
 	}, &res)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccessToken failed")
@@ -78,6 +81,12 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.Expired {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.SoftLogout("Access token has expired"),
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
@@ -87,6 +96,73 @@ func VerifyUserFromRequest(
 	return res.Device, nil
 }
 
+// trustedProxiesContextKey is the context key of the networks of the trusted
+// proxies which a request may have come through.
+type trustedProxiesContextKey struct{}
+
+// WrapHandlerInTrustedProxies lets requests which come through the given
+// trusted proxies be treated as coming from the address of the client which
+// the proxy gave in the X-Forwarded-For or X-Real-IP header.
+func WrapHandlerInTrustedProxies(h http.Handler, proxies []*net.IPNet) http.Handler {
+	if len(proxies) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), trustedProxiesContextKey{}, proxies)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// requestIPAddr returns the IP address which the request came from, without
+// the port. If the request came from a trusted proxy, this is the address of
+// the client which the proxy gave in the X-Forwarded-For or X-Real-IP header.
+func requestIPAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	proxies, _ := req.Context().Value(trustedProxiesContextKey{}).([]*net.IPNet)
+	if !isTrustedProxy(host, proxies) {
+		return host
+	}
+	if forwardedFor := req.Header["X-Forwarded-For"]; len(forwardedFor) > 0 {
+		// Each proxy appends the address which it got the request from, so
+		// the client is the last address which isn't a trusted proxy. Anything
+		// before that could have been made up by the client.
+		addrs := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+			if ip == nil {
+				break
+			}
+			host = ip.String()
+			if !isTrustedProxy(host, proxies) {
+				break
+			}
+		}
+		return host
+	}
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// isTrustedProxy returns true if the IP address is in one of the networks of
+// the trusted proxies.
+func isTrustedProxy(addr string, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateAccessToken creates a new access token. Returns an error if failed to generate
 // random bytes.
 func GenerateAccessToken() (string, error) {
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIPAddrTrustedProxies(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("failed to parse CIDR: %s", err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "203.0.113.1:1234",
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "untrusted proxy",
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "address made up by the client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "invalid forwarded address",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "not an address"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "real IP from trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.2"},
+			want:       "198.51.100.2",
+		},
+	}
+	for _, tt := range tests {
+		var got string
+		handler := WrapHandlerInTrustedProxies(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = requestIPAddr(req)
+		}), []*net.IPNet{proxies})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for header, value := range tt.headers {
+			req.Header.Set(header, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("%s: got IP address %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without any trusted proxies the headers are always ignored.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := requestIPAddr(req); got != "10.0.0.1" {
+		t.Errorf("got IP address %q without trusted proxies, want 10.0.0.1", got)
+	}
+}
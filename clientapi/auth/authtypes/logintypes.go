@@ -9,4 +9,7 @@ const (
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
+	LoginTypeSSO                = "m.login.sso"
+	LoginTypeToken              = "m.login.token"
+	LoginTypeEmail              = "m.login.email.identity"
 )
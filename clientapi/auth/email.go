@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+type EmailRequest struct {
+	Login
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
+}
+
+// LoginTypeEmail implements https://matrix.org/docs/spec/client_server/r0.6.1#email-based-identity-homeserver
+// The user is whoever the validated email address belongs to.
+type LoginTypeEmail struct {
+	UserAPI   api.UserInternalAPI
+	AccountDB accounts.Database
+	Config    *config.Dendrite
+}
+
+func (t *LoginTypeEmail) Name() string {
+	return authtypes.LoginTypeEmail
+}
+
+func (t *LoginTypeEmail) Request() interface{} {
+	return &EmailRequest{}
+}
+
+func (t *LoginTypeEmail) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*EmailRequest)
+	verified, address, medium, err := threepid.CheckCredentials(ctx, r.ThreePIDCreds, t.Config, t.UserAPI)
+	if err == threepid.ErrNotTrusted {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.NotTrusted(r.ThreePIDCreds.IDServer),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("threepid.CheckCredentials failed")
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+	if !verified {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.ThreePIDAuthFailed("The email address has not been verified"),
+		}
+	}
+	localpart, err := t.AccountDB.GetLocalpartForThreePID(ctx, address, medium)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+	if localpart == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.ThreePIDNotFound("The email address does not belong to an account"),
+		}
+	}
+	r.Login.Identifier = LoginIdentifier{
+		Type: "m.id.user",
+		User: localpart,
+	}
+	return &r.Login, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// ldapTimeout is how long to wait for the directory server to respond.
+const ldapTimeout = 10 * time.Second
+
+// ldapConn is the subset of *ldap.Conn which is used to check passwords.
+type ldapConn interface {
+	StartTLS(config *tls.Config) error
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LDAPProvider is a PasswordProvider which checks passwords by binding to an
+// LDAP directory as the user.
+type LDAPProvider struct {
+	cfg  *config.LDAP
+	dial func(uri string) (ldapConn, error)
+}
+
+// NewLDAPProvider creates an LDAPProvider for the given config. A new
+// connection is made to the directory for each password check.
+func NewLDAPProvider(cfg *config.LDAP) *LDAPProvider {
+	return &LDAPProvider{
+		cfg: cfg,
+		dial: func(uri string) (ldapConn, error) {
+			conn, err := ldap.DialURL(uri)
+			if err != nil {
+				return nil, err
+			}
+			conn.SetTimeout(ldapTimeout)
+			return conn, nil
+		},
+	}
+}
+
+// CheckPassword implements PasswordProvider.
+func (p *LDAPProvider) CheckPassword(ctx context.Context, localpart, password string) (*ExternalUser, error) {
+	// Most directories treat a bind with an empty password as an anonymous
+	// bind, which would succeed for any user.
+	if password == "" {
+		return nil, ErrInvalidPassword
+	}
+
+	conn, err := p.dial(p.cfg.URI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	if p.cfg.StartTLS {
+		var u *url.URL
+		if u, err = url.Parse(p.cfg.URI); err != nil {
+			return nil, err
+		}
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if p.cfg.BindDN != "" {
+		if err = conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind as %q: %w", p.cfg.BindDN, err)
+		}
+	}
+
+	filter := fmt.Sprintf("(%s=%s)", p.cfg.UIDAttribute, ldap.EscapeFilter(localpart))
+	if p.cfg.Filter != "" {
+		filter = fmt.Sprintf("(&%s%s)", filter, p.cfg.Filter)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, filter,
+		[]string{p.cfg.DisplayNameAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("failed to search for user: %w", err)
+	}
+	// If more than one entry matches then we can't tell which one the user
+	// is, so don't let them log in at all.
+	if res == nil || len(res.Entries) != 1 {
+		return nil, ErrUnknownUser
+	}
+	entry := res.Entries[0]
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidPassword
+		}
+		return nil, fmt.Errorf("failed to bind as %q: %w", entry.DN, err)
+	}
+	return &ExternalUser{
+		DisplayName: entry.GetAttributeValue(p.cfg.DisplayNameAttribute),
+	}, nil
+}
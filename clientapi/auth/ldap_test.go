@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+type fakeLDAPUser struct {
+	dn       string
+	uid      string
+	cn       string
+	password string
+}
+
+// fakeLDAPDirectory stands in for a directory server with a fixed set of users.
+type fakeLDAPDirectory struct {
+	users   []fakeLDAPUser
+	filters []string
+}
+
+func (d *fakeLDAPDirectory) StartTLS(config *tls.Config) error {
+	return nil
+}
+
+func (d *fakeLDAPDirectory) Bind(username, password string) error {
+	for _, u := range d.users {
+		if u.dn == username && u.password == password {
+			return nil
+		}
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+}
+
+func (d *fakeLDAPDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.filters = append(d.filters, req.Filter)
+	res := &ldap.SearchResult{}
+	for _, u := range d.users {
+		if strings.Contains(req.Filter, "(uid="+u.uid+")") {
+			res.Entries = append(res.Entries, ldap.NewEntry(u.dn, map[string][]string{
+				"uid": {u.uid},
+				"cn":  {u.cn},
+			}))
+		}
+	}
+	return res, nil
+}
+
+func (d *fakeLDAPDirectory) Close() {}
+
+func newTestLDAPProvider(dir *fakeLDAPDirectory) *LDAPProvider {
+	cfg := &config.LDAP{
+		Enabled:              true,
+		URI:                  "ldap://localhost",
+		BaseDN:               "ou=people,dc=example,dc=com",
+		Filter:               "(objectClass=person)",
+		UIDAttribute:         "uid",
+		DisplayNameAttribute: "cn",
+	}
+	p := NewLDAPProvider(cfg)
+	p.dial = func(uri string) (ldapConn, error) {
+		return dir, nil
+	}
+	return p
+}
+
+func TestLDAPCheckPassword(t *testing.T) {
+	dir := &fakeLDAPDirectory{
+		users: []fakeLDAPUser{
+			{"uid=alice,ou=people,dc=example,dc=com", "alice", "Alice Smith", "herpassword"},
+			{"uid=bob,ou=people,dc=example,dc=com", "bob", "Bob Jones", "hispassword"},
+		},
+	}
+	p := newTestLDAPProvider(dir)
+
+	user, err := p.CheckPassword(ctx, "alice", "herpassword")
+	if err != nil {
+		t.Fatalf("CheckPassword failed with correct password: %s", err)
+	}
+	if user.DisplayName != "Alice Smith" {
+		t.Errorf("Expected display name %q, got %q", "Alice Smith", user.DisplayName)
+	}
+	wantFilter := "(&(uid=alice)(objectClass=person))"
+	if dir.filters[0] != wantFilter {
+		t.Errorf("Expected search filter %q, got %q", wantFilter, dir.filters[0])
+	}
+
+	testCases := []struct {
+		localpart string
+		password  string
+		wantErr   error
+	}{
+		{"alice", "hispassword", ErrInvalidPassword},
+		{"alice", "", ErrInvalidPassword},
+		{"charlie", "herpassword", ErrUnknownUser},
+	}
+	for _, tc := range testCases {
+		_, err := p.CheckPassword(ctx, tc.localpart, tc.password)
+		if err != tc.wantErr {
+			t.Errorf("CheckPassword(%q, %q): expected error %v, got %v", tc.localpart, tc.password, tc.wantErr, err)
+		}
+	}
+}
+
+func TestLDAPCheckPasswordEscapesFilter(t *testing.T) {
+	dir := &fakeLDAPDirectory{}
+	p := newTestLDAPProvider(dir)
+
+	if _, err := p.CheckPassword(ctx, "*)(uid=*", "password"); err != ErrUnknownUser {
+		t.Errorf("Expected ErrUnknownUser, got %v", err)
+	}
+	wantFilter := `(&(uid=\2a\29\28uid=\2a)(objectClass=person))`
+	if dir.filters[0] != wantFilter {
+		t.Errorf("Expected search filter %q, got %q", wantFilter, dir.filters[0])
+	}
+}
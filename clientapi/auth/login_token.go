@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// loginTokenLifetime is how long a login token can be exchanged for an access
+// token for. Clients are expected to do this as soon as they receive it.
+const loginTokenLifetime = 2 * time.Minute
+
+type loginTokenInfo struct {
+	userID  string
+	expires time.Time
+}
+
+// LoginTokens stores short-lived, single-use tokens which can be exchanged for
+// an access token with m.login.token, e.g. after completing single sign-on.
+// Tokens are only held in memory, so they must be exchanged on the same
+// client API server that issued them.
+type LoginTokens struct {
+	mu     sync.Mutex
+	tokens map[string]loginTokenInfo
+}
+
+// NewLoginTokens creates an empty LoginTokens.
+func NewLoginTokens() *LoginTokens {
+	return &LoginTokens{
+		tokens: make(map[string]loginTokenInfo),
+	}
+}
+
+// Issue returns a new login token for the given user ID.
+func (t *LoginTokens) Issue(userID string) (string, error) {
+	token, err := GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Tidy up any tokens which were never used.
+	for tok, info := range t.tokens {
+		if now.After(info.expires) {
+			delete(t.tokens, tok)
+		}
+	}
+	t.tokens[token] = loginTokenInfo{
+		userID:  userID,
+		expires: now.Add(loginTokenLifetime),
+	}
+	return token, nil
+}
+
+// Consume returns the user ID that the token was issued for and invalidates
+// the token. Returns false if the token is unknown or has expired.
+func (t *LoginTokens) Consume(token string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.tokens[token]
+	if !ok {
+		return "", false
+	}
+	delete(t.tokens, token)
+	if time.Now().After(info.expires) {
+		return "", false
+	}
+	return info.userID, true
+}
+
+type TokenRequest struct {
+	Login
+	Token string `json:"token"`
+}
+
+// GetAccountByLocalpart returns the account with the given localpart.
+type GetAccountByLocalpart func(ctx context.Context, localpart string) (*api.Account, error)
+
+// LoginTypeToken implements https://matrix.org/docs/spec/client_server/r0.6.1#token-based
+type LoginTypeToken struct {
+	Tokens                *LoginTokens
+	GetAccountByLocalpart GetAccountByLocalpart
+}
+
+func (t *LoginTypeToken) Name() string {
+	return authtypes.LoginTypeToken
+}
+
+func (t *LoginTypeToken) Request() interface{} {
+	return &TokenRequest{}
+}
+
+func (t *LoginTypeToken) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*TokenRequest)
+	if r.Token == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.BadJSON("'token' must be supplied."),
+		}
+	}
+	userID, ok := t.Tokens.Consume(r.Token)
+	if !ok {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token is invalid or has expired"),
+		}
+	}
+	// The account may have been deactivated since the token was issued.
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token is invalid or has expired"),
+		}
+	}
+	acc, err := t.GetAccountByLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if acc.Deactivated {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This account has been deactivated"),
+		}
+	}
+	// The user is whoever the token was issued for, regardless of what the
+	// request says.
+	r.Login.Identifier = LoginIdentifier{
+		Type: "m.id.user",
+		User: userID,
+	}
+	return &r.Login, nil
+}
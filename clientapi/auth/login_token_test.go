@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestLoginTokensSingleUse(t *testing.T) {
+	tokens := NewLoginTokens()
+	token, err := tokens.Issue("@alice:example.com")
+	if err != nil {
+		t.Fatalf("Issue returned error: %s", err)
+	}
+	userID, ok := tokens.Consume(token)
+	if !ok || userID != "@alice:example.com" {
+		t.Fatalf("got (%q, %v) consuming a new token, want (@alice:example.com, true)", userID, ok)
+	}
+	if _, ok = tokens.Consume(token); ok {
+		t.Errorf("a login token could be used twice")
+	}
+	if _, ok = tokens.Consume("unknown"); ok {
+		t.Errorf("an unknown login token was accepted")
+	}
+}
+
+func TestLoginTokensExpire(t *testing.T) {
+	tokens := NewLoginTokens()
+	expired, err := tokens.Issue("@alice:example.com")
+	if err != nil {
+		t.Fatalf("Issue returned error: %s", err)
+	}
+	tokens.tokens[expired] = loginTokenInfo{
+		userID:  "@alice:example.com",
+		expires: time.Now().Add(-time.Second),
+	}
+	if _, ok := tokens.Consume(expired); ok {
+		t.Errorf("an expired login token was accepted")
+	}
+
+	// Issuing tokens tidies up ones which have expired without being used.
+	tokens.tokens["unused"] = loginTokenInfo{
+		userID:  "@bob:example.com",
+		expires: time.Now().Add(-time.Second),
+	}
+	if _, err = tokens.Issue("@alice:example.com"); err != nil {
+		t.Fatalf("Issue returned error: %s", err)
+	}
+	if _, ok := tokens.tokens["unused"]; ok {
+		t.Errorf("an expired login token wasn't tidied up")
+	}
+}
+
+func TestLoginTypeToken(t *testing.T) {
+	accounts := map[string]*api.Account{
+		"alice": {Localpart: "alice"},
+		"bob":   {Localpart: "bob", Deactivated: true},
+	}
+	typ := &LoginTypeToken{
+		Tokens: NewLoginTokens(),
+		GetAccountByLocalpart: func(ctx context.Context, localpart string) (*api.Account, error) {
+			acc, ok := accounts[localpart]
+			if !ok {
+				return nil, sql.ErrNoRows
+			}
+			return acc, nil
+		},
+	}
+	// login returns the status code of the error response, or 0 on success.
+	login := func(body string) (*Login, int) {
+		req := typ.Request()
+		if err := json.Unmarshal([]byte(body), req); err != nil {
+			t.Fatalf("failed to unmarshal %s: %s", body, err)
+		}
+		l, errRes := typ.Login(ctx, req)
+		if errRes != nil {
+			return nil, errRes.Code
+		}
+		return l, 0
+	}
+
+	aliceToken, err := typ.Tokens.Issue("@alice:example.com")
+	if err != nil {
+		t.Fatalf("Issue returned error: %s", err)
+	}
+	// The user logged in as is the one the token was issued for, whatever
+	// the request says, and the rest of the request is kept.
+	l, code := login(`{"type":"m.login.token","token":"` + aliceToken + `","identifier":{"type":"m.id.user","user":"mallory"},"device_id":"PHONE"}`)
+	if code != 0 {
+		t.Fatalf("got status %d logging in with a valid token, want success", code)
+	}
+	if l.Username() != "@alice:example.com" || l.DeviceID == nil || *l.DeviceID != "PHONE" {
+		t.Errorf("got login %+v, want @alice:example.com on device PHONE", l)
+	}
+
+	// Tokens which were issued for accounts that have since been deactivated
+	// are rejected.
+	bobToken, err := typ.Tokens.Issue("@bob:example.com")
+	if err != nil {
+		t.Fatalf("Issue returned error: %s", err)
+	}
+	testCases := []struct {
+		Name     string
+		Body     string
+		WantCode int
+	}{
+		{
+			Name:     "missing token",
+			Body:     `{"type":"m.login.token"}`,
+			WantCode: http.StatusUnauthorized,
+		},
+		{
+			Name:     "reused token",
+			Body:     `{"type":"m.login.token","token":"` + aliceToken + `"}`,
+			WantCode: http.StatusForbidden,
+		},
+		{
+			Name:     "deactivated account",
+			Body:     `{"type":"m.login.token","token":"` + bobToken + `"}`,
+			WantCode: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		if _, code := login(tc.Body); code != tc.WantCode {
+			t.Errorf("%s: got status %d, want %d", tc.Name, code, tc.WantCode)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -63,6 +64,14 @@ func (t *LoginTypePassword) Login(ctx context.Context, req interface{}) (*Login,
 		}
 	}
 	_, err = t.GetAccountByPassword(ctx, localpart, r.Password)
+	if errors.Is(err, ErrPasswordCheckFailed) {
+		// Whether or not the password is right isn't known, so the client
+		// should try again later rather than asking for a new password.
+		return nil, &util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown("Unable to check the password, please try again later"),
+		}
+	}
 	if err != nil {
 		// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
 		// but that would leak the existence of the user.
@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+var (
+	// ErrUnknownUser is returned by a PasswordProvider when the user doesn't
+	// exist in the provider.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrInvalidPassword is returned by a PasswordProvider when the user
+	// exists but the password is wrong.
+	ErrInvalidPassword = errors.New("invalid password")
+	// ErrAccountDeactivated is returned by ExternalPasswordAuth when the
+	// password is right but the user's account has been deactivated.
+	ErrAccountDeactivated = errors.New("account is deactivated")
+	// ErrPasswordCheckFailed is returned by ExternalPasswordAuth when the
+	// password couldn't be checked, e.g. because the provider couldn't be
+	// reached, rather than because it is wrong.
+	ErrPasswordCheckFailed = errors.New("failed to check password")
+)
+
+// ExternalUser is a user who was authenticated by a PasswordProvider.
+type ExternalUser struct {
+	// The display name to give the user when their account is created, if any.
+	DisplayName string
+}
+
+// PasswordProvider checks passwords against somewhere other than the
+// accounts database, e.g. a directory server.
+type PasswordProvider interface {
+	// CheckPassword returns the user if the password is correct for the
+	// localpart, ErrUnknownUser or ErrInvalidPassword if not, or another
+	// error if the provider couldn't be asked.
+	CheckPassword(ctx context.Context, localpart, password string) (*ExternalUser, error)
+}
+
+// ExternalPasswordAuth authenticates users with a PasswordProvider, creating
+// accounts for them on their first successful login. Its GetAccountByPassword
+// method can be used wherever the accounts database's would be.
+type ExternalPasswordAuth struct {
+	Provider  PasswordProvider
+	UserAPI   api.UserInternalAPI
+	AccountDB accounts.Database
+	// If set, users who are unknown to the provider are checked against this
+	// instead.
+	Fallback GetAccountByPassword
+}
+
+// GetAccountByPassword implements GetAccountByPassword.
+func (e *ExternalPasswordAuth) GetAccountByPassword(ctx context.Context, localpart, password string) (*api.Account, error) {
+	var user *ExternalUser
+	var err error
+	if localpart == strings.ToLower(localpart) {
+		user, err = e.Provider.CheckPassword(ctx, localpart, password)
+	} else {
+		// Directories generally match names case-insensitively, but
+		// localparts can't contain upper case letters.
+		err = ErrUnknownUser
+	}
+	if err == ErrUnknownUser && e.Fallback != nil {
+		return e.Fallback(ctx, localpart, password)
+	}
+	if err != nil {
+		if err != ErrUnknownUser && err != ErrInvalidPassword {
+			util.GetLogger(ctx).WithError(err).Error("Failed to check password with provider")
+			return nil, fmt.Errorf("%w: %s", ErrPasswordCheckFailed, err)
+		}
+		return nil, err
+	}
+
+	// The account has no password of its own, so the user can only log in
+	// through the provider. If the account already exists then it is
+	// returned as it is, and deactivated accounts stay deactivated.
+	var res api.PerformAccountCreationResponse
+	err = e.UserAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeUser,
+		Localpart:   localpart,
+		OnConflict:  api.ConflictUpdate,
+	}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to create account for external user")
+		return nil, fmt.Errorf("%w: %s", ErrPasswordCheckFailed, err)
+	}
+	if res.Account.Deactivated {
+		return nil, ErrAccountDeactivated
+	}
+	if res.AccountCreated && user.DisplayName != "" {
+		if err = e.AccountDB.SetDisplayName(ctx, localpart, user.DisplayName); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to set display name of external user")
+			return nil, fmt.Errorf("%w: %s", ErrPasswordCheckFailed, err)
+		}
+	}
+	return res.Account, nil
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+// fakePasswordProvider knows the passwords of a fixed set of users, and fails
+// to check any password if err is set.
+type fakePasswordProvider struct {
+	passwords map[string]string
+	err       error
+}
+
+func (p *fakePasswordProvider) CheckPassword(ctx context.Context, localpart, password string) (*ExternalUser, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	want, ok := p.passwords[localpart]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	if password != want {
+		return nil, ErrInvalidPassword
+	}
+	return &ExternalUser{DisplayName: "External " + localpart}, nil
+}
+
+// externalAccounts holds the accounts of the server and their display names,
+// and panics if anything else is called.
+type externalAccounts struct {
+	api.UserInternalAPI
+	accounts.Database
+	accounts     map[string]*api.Account
+	displayNames map[string]string
+}
+
+func (a *externalAccounts) PerformAccountCreation(
+	ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse,
+) error {
+	if acc, ok := a.accounts[req.Localpart]; ok {
+		res.Account = acc
+		return nil
+	}
+	a.accounts[req.Localpart] = &api.Account{
+		Localpart:   req.Localpart,
+		UserID:      fmt.Sprintf("@%s:%s", req.Localpart, serverName),
+		ServerName:  serverName,
+		AccountType: req.AccountType,
+	}
+	res.AccountCreated = true
+	res.Account = a.accounts[req.Localpart]
+	return nil
+}
+
+func (a *externalAccounts) SetDisplayName(ctx context.Context, localpart, displayName string) error {
+	a.displayNames[localpart] = displayName
+	return nil
+}
+
+func newExternalPasswordAuth(provider PasswordProvider) (*ExternalPasswordAuth, *externalAccounts) {
+	accs := &externalAccounts{
+		accounts:     make(map[string]*api.Account),
+		displayNames: make(map[string]string),
+	}
+	return &ExternalPasswordAuth{
+		Provider:  provider,
+		UserAPI:   accs,
+		AccountDB: accs,
+	}, accs
+}
+
+func TestExternalPasswordAuthProvisionsAccounts(t *testing.T) {
+	e, accs := newExternalPasswordAuth(&fakePasswordProvider{
+		passwords: map[string]string{"alice": "secret", "bob": "secret"},
+	})
+
+	// The first login makes an account with the display name from the
+	// provider.
+	acc, err := e.GetAccountByPassword(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatalf("GetAccountByPassword returned error on first login: %s", err)
+	}
+	if acc.Localpart != "alice" || acc.AccountType != api.AccountTypeUser {
+		t.Errorf("got account %+v, want alice's user account", acc)
+	}
+	if accs.displayNames["alice"] != "External alice" {
+		t.Errorf("got display name %q, want the one from the provider", accs.displayNames["alice"])
+	}
+
+	// Later logins use the same account and leave the display name alone.
+	accs.displayNames["alice"] = "Alice"
+	if acc, err = e.GetAccountByPassword(ctx, "alice", "secret"); err != nil {
+		t.Fatalf("GetAccountByPassword returned error on second login: %s", err)
+	}
+	if acc != accs.accounts["alice"] || accs.displayNames["alice"] != "Alice" {
+		t.Errorf("got account %+v and display name %q, want the existing account unchanged", acc, accs.displayNames["alice"])
+	}
+
+	if _, err = e.GetAccountByPassword(ctx, "alice", "wrong"); err != ErrInvalidPassword {
+		t.Errorf("got error %v with the wrong password, want ErrInvalidPassword", err)
+	}
+
+	// Logging in mustn't bring back deactivated accounts.
+	accs.accounts["bob"] = &api.Account{Localpart: "bob", AccountType: api.AccountTypeUser, Deactivated: true}
+	if _, err = e.GetAccountByPassword(ctx, "bob", "secret"); err != ErrAccountDeactivated {
+		t.Errorf("got error %v logging in to a deactivated account, want ErrAccountDeactivated", err)
+	}
+}
+
+func TestExternalPasswordAuthFallback(t *testing.T) {
+	e, accs := newExternalPasswordAuth(&fakePasswordProvider{
+		passwords: map[string]string{"alice": "secret"},
+	})
+	if _, err := e.GetAccountByPassword(ctx, "carol", "local"); err != ErrUnknownUser {
+		t.Errorf("got error %v for an unknown user without a fallback, want ErrUnknownUser", err)
+	}
+
+	local := &api.Account{Localpart: "carol"}
+	var fallbackCalls []string
+	e.Fallback = func(ctx context.Context, localpart, password string) (*api.Account, error) {
+		fallbackCalls = append(fallbackCalls, localpart)
+		if localpart == "carol" && password == "local" {
+			return local, nil
+		}
+		return nil, errors.New("wrong password")
+	}
+
+	// Users who are unknown to the provider are checked against the local
+	// accounts instead.
+	acc, err := e.GetAccountByPassword(ctx, "carol", "local")
+	if err != nil || acc != local {
+		t.Errorf("got (%+v, %v) for a local user, want the local account", acc, err)
+	}
+	if _, err = e.GetAccountByPassword(ctx, "carol", "wrong"); err == nil {
+		t.Errorf("a local user logged in with the wrong password")
+	}
+	// Users who are known to the provider can't fall back to a local
+	// password, and no account is made for local users.
+	if _, err = e.GetAccountByPassword(ctx, "alice", "local"); err != ErrInvalidPassword {
+		t.Errorf("got error %v for a provider user with the wrong password, want ErrInvalidPassword", err)
+	}
+	if len(fallbackCalls) != 2 {
+		t.Errorf("got fallback calls %v, want only the two for carol", fallbackCalls)
+	}
+	if _, ok := accs.accounts["carol"]; ok {
+		t.Errorf("an account was made for a local user")
+	}
+}
+
+func TestExternalPasswordAuthProviderError(t *testing.T) {
+	provider := &fakePasswordProvider{err: errors.New("connection refused")}
+	e, _ := newExternalPasswordAuth(provider)
+	e.Fallback = func(ctx context.Context, localpart, password string) (*api.Account, error) {
+		t.Errorf("fell back to local accounts when the provider failed")
+		return nil, errors.New("unexpected")
+	}
+	if _, err := e.GetAccountByPassword(ctx, "alice", "secret"); !errors.Is(err, ErrPasswordCheckFailed) {
+		t.Errorf("got error %v when the provider failed, want ErrPasswordCheckFailed", err)
+	}
+
+	// The client is told to try again later rather than that the password
+	// is wrong.
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = serverName
+	typ := &LoginTypePassword{
+		GetAccountByPassword: e.GetAccountByPassword,
+		Config:               cfg,
+	}
+	_, errRes := typ.Login(ctx, &PasswordRequest{
+		Login:    Login{Identifier: LoginIdentifier{Type: "m.id.user", User: "alice"}},
+		Password: "secret",
+	})
+	if errRes == nil || errRes.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %+v logging in when the provider failed, want 503", errRes)
+	}
+}
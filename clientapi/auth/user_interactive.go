@@ -110,23 +110,40 @@ type UserInteractive struct {
 	Sessions map[string][]string
 }
 
-func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.Dendrite) *UserInteractive {
+// NewUserInteractive creates a UserInteractive which accepts passwords, or
+// validated email addresses if emailAuth is not nil.
+func NewUserInteractive(getAccByPass GetAccountByPassword, emailAuth *LoginTypeEmail, cfg *config.Dendrite) *UserInteractive {
 	typePassword := &LoginTypePassword{
 		GetAccountByPassword: getAccByPass,
 		Config:               cfg,
 	}
 	// TODO: Add SSO login
-	return &UserInteractive{
-		Flows: []userInteractiveFlow{
-			{
-				Stages: []string{typePassword.Name()},
-			},
-		},
-		Types: map[string]Type{
-			typePassword.Name(): typePassword,
-		},
+	if emailAuth == nil {
+		return newUserInteractive(typePassword)
+	}
+	return newUserInteractive(typePassword, emailAuth)
+}
+
+// NewEmailUserInteractive creates a UserInteractive which only accepts
+// validated email addresses, for users who don't know their password.
+func NewEmailUserInteractive(emailAuth *LoginTypeEmail) *UserInteractive {
+	return newUserInteractive(emailAuth)
+}
+
+// newUserInteractive creates a UserInteractive with a single stage flow for
+// each of the given types.
+func newUserInteractive(types ...Type) *UserInteractive {
+	u := &UserInteractive{
+		Types:    make(map[string]Type),
 		Sessions: make(map[string][]string),
 	}
+	for _, t := range types {
+		u.Flows = append(u.Flows, userInteractiveFlow{
+			Stages: []string{t.Name()},
+		})
+		u.Types[t.Name()] = t
+	}
+	return u
 }
 
 func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
@@ -35,7 +35,7 @@ func getAccountByPassword(ctx context.Context, localpart, plaintextPassword stri
 func setup() *UserInteractive {
 	cfg := &config.Dendrite{}
 	cfg.Matrix.ServerName = serverName
-	return NewUserInteractive(getAccountByPassword, cfg)
+	return NewUserInteractive(getAccountByPassword, nil, cfg)
 }
 
 func TestUserInteractiveChallenge(t *testing.T) {
@@ -93,6 +93,22 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// SoftLogoutError is an unknown token error which tells the client that it
+// can log in again without losing its device, and so its end-to-end keys.
+type SoftLogoutError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// SoftLogout is an error which is returned when the client uses an access
+// token which has expired.
+func SoftLogout(msg string) *SoftLogoutError {
+	return &SoftLogoutError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
@@ -111,6 +127,24 @@ func UserInUse(msg string) *MatrixError {
 	return &MatrixError{"M_USER_IN_USE", msg}
 }
 
+// ThreePIDInUse is an error returned when the client tries to add a 3PID
+// which already belongs to an account
+func ThreePIDInUse(msg string) *MatrixError {
+	return &MatrixError{"M_THREEPID_IN_USE", msg}
+}
+
+// ThreePIDNotFound is an error returned when the client uses a 3PID which
+// doesn't belong to any account
+func ThreePIDNotFound(msg string) *MatrixError {
+	return &MatrixError{"M_THREEPID_NOT_FOUND", msg}
+}
+
+// ThreePIDAuthFailed is an error returned when the client uses a 3PID session
+// which hasn't been validated
+func ThreePIDAuthFailed(msg string) *MatrixError {
+	return &MatrixError{"M_THREEPID_AUTH_FAILED", msg}
+}
+
 // ASExclusive is an error returned when an application service tries to
 // register an username that is outside of its registered namespace, or if a
 // user attempts to register a username or room alias within an exclusive
@@ -125,6 +159,12 @@ func GuestAccessForbidden(msg string) *MatrixError {
 	return &MatrixError{"M_GUEST_ACCESS_FORBIDDEN", msg}
 }
 
+// InvalidSignature is an error which is returned when a signature in the
+// request couldn't be verified.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
 type IncompatibleRoomVersionError struct {
 	RoomVersion string `json:"room_version"`
 	Error       string `json:"error"`
@@ -161,6 +201,22 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// WrongRoomKeysVersionError is returned when keys are uploaded to a room key
+// backup which isn't the user's current backup.
+type WrongRoomKeysVersionError struct {
+	MatrixError
+	CurrentVersion string `json:"current_version"`
+}
+
+// WrongRoomKeysVersion is an error when the client uploads keys to an old room
+// key backup version.
+func WrongRoomKeysVersion(currentVersion string) *WrongRoomKeysVersionError {
+	return &WrongRoomKeysVersionError{
+		MatrixError:    MatrixError{"M_WRONG_ROOM_KEYS_VERSION", "Wrong backup version."},
+		CurrentVersion: currentVersion,
+	}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
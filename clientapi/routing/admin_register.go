@@ -0,0 +1,192 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+// registrationNonceLifetime is how long a nonce from
+// GET /_synapse/admin/v1/register can be used for.
+const registrationNonceLifetime = time.Minute
+
+// registrationNonces stores the nonces which have been handed out for shared
+// secret registration. Each nonce can only be used once.
+type registrationNonces struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newRegistrationNonces() *registrationNonces {
+	return &registrationNonces{
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// issue returns a new nonce.
+func (n *registrationNonces) issue() (string, error) {
+	nonce, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Tidy up any nonces which were never used.
+	for old, expires := range n.nonces {
+		if now.After(expires) {
+			delete(n.nonces, old)
+		}
+	}
+	n.nonces[nonce] = now.Add(registrationNonceLifetime)
+	return nonce, nil
+}
+
+// consume invalidates the nonce, returning false if it was unknown or has
+// expired.
+func (n *registrationNonces) consume(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	expires, ok := n.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(n.nonces, nonce)
+	return time.Now().Before(expires)
+}
+
+type adminRegisterRequest struct {
+	Nonce       string `json:"nonce"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayname"`
+	Password    string `json:"password"`
+	Admin       bool   `json:"admin"`
+	MAC         string `json:"mac"`
+}
+
+// GetAdminRegisterNonce implements GET /_synapse/admin/v1/register, which
+// returns a nonce to use in POST /_synapse/admin/v1/register.
+func GetAdminRegisterNonce(
+	req *http.Request, cfg *config.Dendrite, nonces *registrationNonces,
+) util.JSONResponse {
+	if cfg.Matrix.RegistrationSharedSecret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Shared secret registration is not enabled"),
+		}
+	}
+	nonce, err := nonces.issue()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("nonces.issue failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Nonce string `json:"nonce"`
+		}{nonce},
+	}
+}
+
+// AdminRegister implements POST /_synapse/admin/v1/register, which creates
+// an account using the registration shared secret, even when registration is
+// disabled. It is compatible with Synapse's register_new_matrix_user script.
+// The mac is the hex-encoded HMAC-SHA1 of the nonce, username, password and
+// "admin" or "notadmin", separated by NUL bytes, keyed with the shared secret.
+func AdminRegister(
+	req *http.Request, cfg *config.Dendrite, nonces *registrationNonces,
+	userAPI userapi.UserInternalAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	if cfg.Matrix.RegistrationSharedSecret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Shared secret registration is not enabled"),
+		}
+	}
+	var r adminRegisterRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !nonces.consume(r.Nonce) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unrecognised nonce"),
+		}
+	}
+	if strings.Contains(r.Username, "\x00") || strings.Contains(r.Password, "\x00") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("username and password must not contain NUL bytes"),
+		}
+	}
+
+	givenMAC, err := hex.DecodeString(r.MAC)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("mac must be hex encoded"),
+		}
+	}
+	expectedMAC, err := sharedSecretMAC(
+		cfg.Matrix.RegistrationSharedSecret, r.Nonce, r.Username, r.Password, adminString(r.Admin),
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sharedSecretMAC failed")
+		return jsonerror.InternalServerError()
+	}
+	if !hmac.Equal(givenMAC, expectedMAC) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("HMAC incorrect"),
+		}
+	}
+
+	// Squash username to all lowercase letters
+	localpart := strings.ToLower(r.Username)
+	if resErr := validateUsername(localpart); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePassword(r.Password); resErr != nil {
+		return *resErr
+	}
+
+	accountType := userapi.AccountTypeUser
+	if r.Admin {
+		accountType = userapi.AccountTypeAdmin
+	}
+	res := completeRegistration(
+		req.Context(), userAPI, cfg, localpart, r.Password, "", accountType, false, false, nil, nil,
+	)
+	if res.Code == http.StatusOK && r.DisplayName != "" {
+		if err = accountDB.SetDisplayName(req.Context(), localpart, r.DisplayName); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetDisplayName failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	return res
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func newSharedSecretTestConfig() *config.Dendrite {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.RegistrationSharedSecret = "shared secret"
+	cfg.Matrix.RegistrationDisabled = true
+	return cfg
+}
+
+// mustSharedSecretMAC returns the hex-encoded MAC of the given fields.
+func mustSharedSecretMAC(t *testing.T, secret string, fields ...string) string {
+	t.Helper()
+	mac, err := sharedSecretMAC(secret, fields...)
+	if err != nil {
+		t.Fatalf("sharedSecretMAC returned error: %s", err)
+	}
+	return hex.EncodeToString(mac)
+}
+
+func TestRegistrationNonces(t *testing.T) {
+	nonces := newRegistrationNonces()
+	nonce, err := nonces.issue()
+	if err != nil {
+		t.Fatalf("issue returned error: %s", err)
+	}
+	if !nonces.consume(nonce) {
+		t.Fatalf("a new nonce was rejected")
+	}
+	if nonces.consume(nonce) {
+		t.Errorf("a nonce could be used twice")
+	}
+	if nonces.consume("unknown") {
+		t.Errorf("an unknown nonce was accepted")
+	}
+
+	expired, err := nonces.issue()
+	if err != nil {
+		t.Fatalf("issue returned error: %s", err)
+	}
+	nonces.nonces[expired] = time.Now().Add(-time.Second)
+	if nonces.consume(expired) {
+		t.Errorf("an expired nonce was accepted")
+	}
+}
+
+func TestAdminRegister(t *testing.T) {
+	cfg := newSharedSecretTestConfig()
+	nonces := newRegistrationNonces()
+	accs := newSSOAccounts()
+
+	// register fetches a new nonce and registers with a MAC made by mac,
+	// returning the status code.
+	register := func(username string, admin bool, mac func(nonce string) string) int {
+		res := GetAdminRegisterNonce(httptest.NewRequest(http.MethodGet, "/", nil), cfg, nonces)
+		if res.Code != http.StatusOK {
+			t.Fatalf("GetAdminRegisterNonce returned %d: %+v", res.Code, res.JSON)
+		}
+		nonce := res.JSON.(struct {
+			Nonce string `json:"nonce"`
+		}).Nonce
+		body, err := json.Marshal(adminRegisterRequest{
+			Nonce:    nonce,
+			Username: username,
+			Password: "password1234",
+			Admin:    admin,
+			MAC:      mac(nonce),
+		})
+		if err != nil {
+			t.Fatalf("json.Marshal returned error: %s", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		return AdminRegister(req, cfg, nonces, accs, accs).Code
+	}
+	macFor := func(username, admin string) func(nonce string) string {
+		return func(nonce string) string {
+			return mustSharedSecretMAC(t, cfg.Matrix.RegistrationSharedSecret, nonce, username, "password1234", admin)
+		}
+	}
+
+	testCases := []struct {
+		Name     string
+		Username string
+		Admin    bool
+		MAC      func(nonce string) string
+		WantCode int
+	}{
+		{
+			Name:     "wrong secret",
+			Username: "mallory",
+			MAC: func(nonce string) string {
+				return mustSharedSecretMAC(t, "wrong secret", nonce, "mallory", "password1234", "notadmin")
+			},
+			WantCode: http.StatusForbidden,
+		},
+		{
+			Name:     "admin flag not covered by the MAC",
+			Username: "mallory",
+			Admin:    true,
+			MAC:      macFor("mallory", "notadmin"),
+			WantCode: http.StatusForbidden,
+		},
+		{
+			Name:     "MAC for another user",
+			Username: "mallory",
+			MAC:      macFor("alice", "notadmin"),
+			WantCode: http.StatusForbidden,
+		},
+		{
+			Name:     "MAC not hex encoded",
+			Username: "mallory",
+			MAC:      func(nonce string) string { return "not hex" },
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "user",
+			Username: "alice",
+			MAC:      macFor("alice", "notadmin"),
+			WantCode: http.StatusOK,
+		},
+		{
+			Name:     "admin",
+			Username: "bob",
+			Admin:    true,
+			MAC:      macFor("bob", "admin"),
+			WantCode: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		if code := register(tc.Username, tc.Admin, tc.MAC); code != tc.WantCode {
+			t.Errorf("%s: got status %d, want %d", tc.Name, code, tc.WantCode)
+		}
+	}
+	if _, ok := accs.accounts["mallory"]; ok {
+		t.Errorf("an account was made with an incorrect MAC")
+	}
+	if acc := accs.accounts["alice"]; acc == nil || acc.AccountType != userapi.AccountTypeUser {
+		t.Errorf("got account %+v for alice, want a user account", acc)
+	}
+	if acc := accs.accounts["bob"]; acc == nil || acc.AccountType != userapi.AccountTypeAdmin {
+		t.Errorf("got account %+v for bob, want an admin account", acc)
+	}
+
+	// Nonces can only be used once, even with a correct MAC.
+	res := GetAdminRegisterNonce(httptest.NewRequest(http.MethodGet, "/", nil), cfg, nonces)
+	nonce := res.JSON.(struct {
+		Nonce string `json:"nonce"`
+	}).Nonce
+	for i, wantCode := range []int{http.StatusOK, http.StatusBadRequest} {
+		body, err := json.Marshal(adminRegisterRequest{
+			Nonce:    nonce,
+			Username: "carol",
+			Password: "password1234",
+			MAC:      mustSharedSecretMAC(t, cfg.Matrix.RegistrationSharedSecret, nonce, "carol", "password1234", "notadmin"),
+		})
+		if err != nil {
+			t.Fatalf("json.Marshal returned error: %s", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		if code := AdminRegister(req, cfg, nonces, accs, accs).Code; code != wantCode {
+			t.Errorf("use %d of a nonce: got status %d, want %d", i+1, code, wantCode)
+		}
+	}
+}
+
+func TestSharedSecretRegistrationFlow(t *testing.T) {
+	cfg := newSharedSecretTestConfig()
+	accs := newSSOAccounts()
+
+	// register registers with the shared secret auth type in a new session,
+	// returning the status code.
+	register := func(username string, admin bool, macAdmin string) int {
+		r := registerRequest{
+			Username: username,
+			Password: "password1234",
+			Admin:    admin,
+			Auth: authDict{
+				Type: authtypes.LoginTypeSharedSecret,
+			},
+		}
+		mac, err := sharedSecretMAC(cfg.Matrix.RegistrationSharedSecret, username, "password1234", macAdmin)
+		if err != nil {
+			t.Fatalf("sharedSecretMAC returned error: %s", err)
+		}
+		r.Auth.Mac = mac
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		return handleRegistrationFlow(req, r, "session-"+username, cfg, accs, accs).Code
+	}
+
+	// Registration is disabled, but a valid MAC is still enough to register.
+	if code := register("alice", false, "notadmin"); code != http.StatusOK {
+		t.Errorf("got status %d registering a user, want 200", code)
+	}
+	if code := register("bob", true, "admin"); code != http.StatusOK {
+		t.Errorf("got status %d registering an admin, want 200", code)
+	}
+	if code := register("mallory", true, "notadmin"); code != http.StatusForbidden {
+		t.Errorf("got status %d when the admin flag isn't covered by the MAC, want 403", code)
+	}
+	if acc := accs.accounts["alice"]; acc == nil || acc.AccountType != userapi.AccountTypeUser {
+		t.Errorf("got account %+v for alice, want a user account", acc)
+	}
+	if acc := accs.accounts["bob"]; acc == nil || acc.AccountType != userapi.AccountTypeAdmin {
+		t.Errorf("got account %+v for bob, want an admin account", acc)
+	}
+	if _, ok := accs.accounts["mallory"]; ok {
+		t.Errorf("an account was made with an incorrect MAC")
+	}
+
+	// A valid MAC isn't remembered by the session, so later requests in it
+	// still have to complete a flow.
+	cfg.Matrix.RegistrationDisabled = false
+	cfg.Derived.Registration.Flows = []authtypes.Flow{
+		{Stages: []authtypes.LoginType{authtypes.LoginTypeSharedSecret, authtypes.LoginTypeDummy}},
+	}
+	r := registerRequest{
+		Username: "mallory",
+		Password: "password1234",
+		Admin:    true,
+		Auth:     authDict{Type: authtypes.LoginTypeDummy},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if code := handleRegistrationFlow(req, r, "session-alice", cfg, accs, accs).Code; code != http.StatusUnauthorized {
+		t.Errorf("got status %d continuing a shared secret session, want 401", code)
+	}
+	if _, ok := accs.accounts["mallory"]; ok {
+		t.Errorf("an account was made by continuing a shared secret session")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type adminWhoisResponse struct {
+	UserID  string                        `json:"user_id"`
+	Devices map[string]deviceInfoResponse `json:"devices"`
+}
+
+type deviceInfoResponse struct {
+	Sessions []sessionInfo `json:"sessions"`
+}
+
+type sessionInfo struct {
+	Connections []connectionInfo `json:"connections"`
+}
+
+type connectionInfo struct {
+	IP        string `json:"ip"`
+	LastSeen  int64  `json:"last_seen"`
+	UserAgent string `json:"user_agent"`
+}
+
+// GetAdminWhois implements GET /admin/whois/{userId}, which returns the
+// devices of the user along with where and when they were last used.
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-admin-whois-userid
+func GetAdminWhois(
+	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
+	userID string,
+) util.JSONResponse {
+	// Only server admins can look up other users.
+	if userID != device.UserID && device.AccountType != api.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		}
+	}
+
+	var queryRes api.QueryDevicesResponse
+	err := userAPI.QueryDevices(req.Context(), &api.QueryDevicesRequest{
+		UserID: userID,
+	}, &queryRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDevices failed")
+		return jsonerror.InternalServerError()
+	}
+
+	devices := make(map[string]deviceInfoResponse)
+	for _, dev := range queryRes.Devices {
+		connInfo := deviceInfoResponse{
+			Sessions: []sessionInfo{
+				{
+					Connections: []connectionInfo{},
+				},
+			},
+		}
+		if dev.LastSeenTS != 0 {
+			connInfo.Sessions[0].Connections = append(connInfo.Sessions[0].Connections, connectionInfo{
+				IP:        dev.LastSeenIP,
+				LastSeen:  int64(dev.LastSeenTS),
+				UserAgent: dev.UserAgent,
+			})
+		}
+		devices[dev.ID] = connInfo
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminWhoisResponse{
+			UserID:  userID,
+			Devices: devices,
+		},
+	}
+}
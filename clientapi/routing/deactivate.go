@@ -0,0 +1,163 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type deactivateRequest struct {
+	IDServer string `json:"id_server"`
+	// Erase is a Synapse extension which also removes the user's profile.
+	Erase bool `json:"erase"`
+}
+
+type deactivateResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// Deactivate implements POST /account/deactivate
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-deactivate
+func Deactivate(
+	req *http.Request,
+	userInteractiveAuth *auth.UserInteractive,
+	userAPI api.UserInternalAPI,
+	accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+	device *api.Device,
+	cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+
+	var r deactivateRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// make sure that the access token being used matches the login creds used for user interactive auth, else
+	// 1 compromised access token could be used to deactivate another user's account.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot deactivate another user's account"),
+		}
+	}
+
+	// The user's 3PID associations are removed from our own database when the
+	// account is deactivated, so look them up first in order to unbind them
+	// from the identity server afterwards.
+	threePIDs, err := accountDB.GetThreePIDsForLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Deactivate the account before doing anything else, so that it can't log
+	// in again or carry on using its devices while it is being cleaned up.
+	var res api.PerformAccountDeactivationResponse
+	if err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart:    localpart,
+		EraseProfile: r.Erase,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Leave all of the rooms that the user is joined to, and reject any
+	// invites, so that other users know that they are gone.
+	for _, membership := range []string{gomatrixserverlib.Join, gomatrixserverlib.Invite} {
+		var roomsRes currentstateAPI.QueryRoomsForUserResponse
+		if err = stateAPI.QueryRoomsForUser(ctx, &currentstateAPI.QueryRoomsForUserRequest{
+			UserID:         device.UserID,
+			WantMembership: membership,
+		}, &roomsRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("stateAPI.QueryRoomsForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		for _, roomID := range roomsRes.RoomIDs {
+			leaveRes := roomserverAPI.PerformLeaveResponse{}
+			if err = rsAPI.PerformLeave(ctx, &roomserverAPI.PerformLeaveRequest{
+				RoomID: roomID,
+				UserID: device.UserID,
+			}, &leaveRes); err != nil {
+				// Carry on so that one broken room doesn't stop the account
+				// from being deactivated.
+				util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("rsAPI.PerformLeave failed")
+			}
+		}
+	}
+
+	// Unbind the user's 3PIDs from the identity server.
+	unbindResult := "success"
+	if len(threePIDs) > 0 {
+		idServer := r.IDServer
+		if idServer == "" && len(cfg.Matrix.TrustedIDServers) > 0 {
+			idServer = cfg.Matrix.TrustedIDServers[0]
+		}
+		for _, threePID := range threePIDs {
+			if idServer == "" {
+				unbindResult = "no-support"
+				break
+			}
+			if err = threepid.Unbind(ctx, threePID, device.UserID, idServer, cfg); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("threepid.Unbind failed")
+				unbindResult = "no-support"
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deactivateResponse{
+			IDServerUnbindResult: unbindResult,
+		},
+	}
+}
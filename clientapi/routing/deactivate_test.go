@@ -0,0 +1,118 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+// deactivateCalls records the order in which the parts of the account are
+// cleaned up.
+type deactivateCalls struct {
+	calls []string
+}
+
+// deactivateUserAPI panics if anything other than deactivation is called.
+type deactivateUserAPI struct {
+	userapi.UserInternalAPI
+	*deactivateCalls
+}
+
+func (u *deactivateUserAPI) PerformAccountDeactivation(
+	ctx context.Context, req *userapi.PerformAccountDeactivationRequest, res *userapi.PerformAccountDeactivationResponse,
+) error {
+	u.calls = append(u.calls, "deactivate "+req.Localpart)
+	res.AccountDeactivated = true
+	return nil
+}
+
+// deactivateAccountDB has no 3PIDs, and panics if anything else is called.
+type deactivateAccountDB struct {
+	accounts.Database
+}
+
+func (d *deactivateAccountDB) GetThreePIDsForLocalpart(ctx context.Context, localpart string) ([]authtypes.ThreePID, error) {
+	return nil, nil
+}
+
+// deactivateRoomserverAPI panics if anything other than leaving is called.
+type deactivateRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	*deactivateCalls
+}
+
+func (r *deactivateRoomserverAPI) PerformLeave(
+	ctx context.Context, req *roomserverAPI.PerformLeaveRequest, res *roomserverAPI.PerformLeaveResponse,
+) error {
+	r.calls = append(r.calls, "leave "+req.RoomID)
+	return nil
+}
+
+// deactivateStateAPI has the user joined to a single room, and panics if
+// anything else is called.
+type deactivateStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+}
+
+func (s *deactivateStateAPI) QueryRoomsForUser(
+	ctx context.Context, req *currentstateAPI.QueryRoomsForUserRequest, res *currentstateAPI.QueryRoomsForUserResponse,
+) error {
+	if req.WantMembership == "join" {
+		res.RoomIDs = []string{"!joined:localhost"}
+	}
+	return nil
+}
+
+func TestDeactivateBeforeLeavingRooms(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	uia := auth.NewUserInteractive(func(ctx context.Context, localpart, password string) (*userapi.Account, error) {
+		if localpart != "alice" || password != "password" {
+			return nil, fmt.Errorf("wrong password")
+		}
+		return &userapi.Account{Localpart: "alice", ServerName: "localhost", UserID: "@alice:localhost"}, nil
+	}, nil, cfg)
+	calls := &deactivateCalls{}
+	device := &userapi.Device{UserID: "@alice:localhost", ID: "device"}
+
+	body := `{"auth":{"type":"m.login.password","identifier":{"type":"m.id.user","user":"alice"},"password":"password"}}`
+	req := httptest.NewRequest(http.MethodPost, "/account/deactivate", strings.NewReader(body))
+	res := Deactivate(
+		req, uia, &deactivateUserAPI{deactivateCalls: calls}, &deactivateAccountDB{},
+		&deactivateRoomserverAPI{deactivateCalls: calls}, &deactivateStateAPI{}, device, cfg,
+	)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %+v", res.Code, res.JSON)
+	}
+	// The account must already be unusable while it is leaving rooms.
+	want := []string{"deactivate alice", "leave !joined:localhost"}
+	if !reflect.DeepEqual(calls.calls, want) {
+		t.Errorf("got calls %v, want %v", calls.calls, want)
+	}
+}
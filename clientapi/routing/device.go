@@ -76,6 +76,8 @@ func GetDeviceByID(
 		JSON: deviceJSON{
 			DeviceID:    dev.ID,
 			DisplayName: dev.DisplayName,
+			LastSeenIP:  dev.LastSeenIP,
+			LastSeenTS:  uint64(dev.LastSeenTS),
 		},
 	}
 }
@@ -104,6 +106,8 @@ func GetDevicesByLocalpart(
 		res.Devices = append(res.Devices, deviceJSON{
 			DeviceID:    dev.ID,
 			DisplayName: dev.DisplayName,
+			LastSeenIP:  dev.LastSeenIP,
+			LastSeenTS:  uint64(dev.LastSeenTS),
 		})
 	}
 
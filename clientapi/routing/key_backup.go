@@ -0,0 +1,308 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type keyBackupVersionRequest struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Version   string          `json:"version"`
+}
+
+type keyBackupVersionResponse struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int64           `json:"count"`
+	ETag      string          `json:"etag"`
+	Version   string          `json:"version"`
+}
+
+type roomKeysResponse struct {
+	ETag  string `json:"etag"`
+	Count int64  `json:"count"`
+}
+
+type keyBackupRoom struct {
+	Sessions map[string]api.KeyBackupSession `json:"sessions"`
+}
+
+type keyBackupRooms struct {
+	Rooms map[string]keyBackupRoom `json:"rooms"`
+}
+
+// CreateKeyBackupVersion implements POST /room_keys/version
+func CreateKeyBackupVersion(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
+	var r keyBackupVersionRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	var performRes api.PerformKeyBackupResponse
+	keyAPI.PerformKeyBackup(req.Context(), &api.PerformKeyBackupRequest{
+		UserID:    device.UserID,
+		Algorithm: r.Algorithm,
+		AuthData:  r.AuthData,
+	}, &performRes)
+	if performRes.Error != nil {
+		return keyBackupErrorResponse(req, performRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"version": performRes.Version,
+		},
+	}
+}
+
+// KeyBackupVersion implements GET /room_keys/version and GET /room_keys/version/{version}
+func KeyBackupVersion(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device, version string) util.JSONResponse {
+	var queryRes api.QueryKeyBackupResponse
+	keyAPI.QueryKeyBackup(req.Context(), &api.QueryKeyBackupRequest{
+		UserID:  device.UserID,
+		Version: version,
+	}, &queryRes)
+	if queryRes.Error != nil {
+		return keyBackupErrorResponse(req, queryRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupVersionResponse{
+			Algorithm: queryRes.Algorithm,
+			AuthData:  queryRes.AuthData,
+			Count:     queryRes.Count,
+			ETag:      queryRes.ETag,
+			Version:   queryRes.Version,
+		},
+	}
+}
+
+// ModifyKeyBackupVersionAuthData implements PUT /room_keys/version/{version}
+func ModifyKeyBackupVersionAuthData(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device, version string) util.JSONResponse {
+	var r keyBackupVersionRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	if r.Version != "" && r.Version != version {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("version in body does not match the version in the path"),
+		}
+	}
+	var performRes api.PerformKeyBackupResponse
+	keyAPI.PerformKeyBackup(req.Context(), &api.PerformKeyBackupRequest{
+		UserID:    device.UserID,
+		Version:   version,
+		Algorithm: r.Algorithm,
+		AuthData:  r.AuthData,
+	}, &performRes)
+	if performRes.Error != nil {
+		return keyBackupErrorResponse(req, performRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// DeleteKeyBackupVersion implements DELETE /room_keys/version/{version}
+func DeleteKeyBackupVersion(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device, version string) util.JSONResponse {
+	var performRes api.PerformKeyBackupResponse
+	keyAPI.PerformKeyBackup(req.Context(), &api.PerformKeyBackupRequest{
+		UserID:       device.UserID,
+		Version:      version,
+		DeleteBackup: true,
+	}, &performRes)
+	if performRes.Error != nil {
+		return keyBackupErrorResponse(req, performRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadBackupKeys implements PUT /room_keys/keys, PUT /room_keys/keys/{roomID} and
+// PUT /room_keys/keys/{roomID}/{sessionID}. The shape of the request body depends on
+// which of roomID and sessionID are given.
+func UploadBackupKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device, roomID, sessionID string) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("version must be specified"),
+		}
+	}
+
+	keys := make(map[string]map[string]api.KeyBackupSession)
+	switch {
+	case roomID == "":
+		var r keyBackupRooms
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		for roomID, room := range r.Rooms {
+			keys[roomID] = room.Sessions
+		}
+	case sessionID == "":
+		var r keyBackupRoom
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		keys[roomID] = r.Sessions
+	default:
+		var r api.KeyBackupSession
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		keys[roomID] = map[string]api.KeyBackupSession{
+			sessionID: r,
+		}
+	}
+
+	var performRes api.PerformUploadRoomKeysResponse
+	keyAPI.PerformUploadRoomKeys(req.Context(), &api.PerformUploadRoomKeysRequest{
+		UserID:  device.UserID,
+		Version: version,
+		Keys:    keys,
+	}, &performRes)
+	if performRes.Error != nil {
+		if performRes.Error.IsWrongVersion {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.WrongRoomKeysVersion(performRes.CurrentVersion),
+			}
+		}
+		return keyBackupErrorResponse(req, performRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomKeysResponse{
+			ETag:  performRes.ETag,
+			Count: performRes.Count,
+		},
+	}
+}
+
+// GetBackupKeys implements GET /room_keys/keys, GET /room_keys/keys/{roomID} and
+// GET /room_keys/keys/{roomID}/{sessionID}
+func GetBackupKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device, roomID, sessionID string) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("version must be specified"),
+		}
+	}
+
+	var queryRes api.QueryKeyBackupResponse
+	keyAPI.QueryKeyBackup(req.Context(), &api.QueryKeyBackupRequest{
+		UserID:     device.UserID,
+		Version:    version,
+		ReturnKeys: true,
+		RoomID:     roomID,
+		SessionID:  sessionID,
+	}, &queryRes)
+	if queryRes.Error != nil {
+		return keyBackupErrorResponse(req, queryRes.Error)
+	}
+
+	switch {
+	case roomID == "":
+		r := keyBackupRooms{
+			Rooms: make(map[string]keyBackupRoom),
+		}
+		for roomID, sessions := range queryRes.Keys {
+			r.Rooms[roomID] = keyBackupRoom{
+				Sessions: sessions,
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: r,
+		}
+	case sessionID == "":
+		sessions := queryRes.Keys[roomID]
+		if sessions == nil {
+			sessions = make(map[string]api.KeyBackupSession)
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: keyBackupRoom{
+				Sessions: sessions,
+			},
+		}
+	default:
+		key, ok := queryRes.Keys[roomID][sessionID]
+		if !ok {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("No room key found for this session"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: key,
+		}
+	}
+}
+
+// DeleteBackupKeys implements DELETE /room_keys/keys, DELETE /room_keys/keys/{roomID} and
+// DELETE /room_keys/keys/{roomID}/{sessionID}
+func DeleteBackupKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device, roomID, sessionID string) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("version must be specified"),
+		}
+	}
+
+	var performRes api.PerformDeleteRoomKeysResponse
+	keyAPI.PerformDeleteRoomKeys(req.Context(), &api.PerformDeleteRoomKeysRequest{
+		UserID:    device.UserID,
+		Version:   version,
+		RoomID:    roomID,
+		SessionID: sessionID,
+	}, &performRes)
+	if performRes.Error != nil {
+		return keyBackupErrorResponse(req, performRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomKeysResponse{
+			ETag:  performRes.ETag,
+			Count: performRes.Count,
+		},
+	}
+}
+
+func keyBackupErrorResponse(req *http.Request, keyErr *api.KeyError) util.JSONResponse {
+	code, matrixErr := keyErrorToMatrixError(req.Context(), keyErr)
+	return util.JSONResponse{
+		Code: code,
+		JSON: matrixErr,
+	}
+}
@@ -15,20 +15,25 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 type uploadKeysRequest struct {
-	DeviceKeys  json.RawMessage            `json:"device_keys"`
-	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+	DeviceKeys   json.RawMessage            `json:"device_keys"`
+	OneTimeKeys  map[string]json.RawMessage `json:"one_time_keys"`
+	FallbackKeys map[string]json.RawMessage `json:"fallback_keys"`
 }
 
 func UploadKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
@@ -57,6 +62,15 @@ func UploadKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.De
 			},
 		}
 	}
+	if r.FallbackKeys != nil {
+		uploadReq.FallbackKeys = []api.OneTimeKeys{
+			{
+				DeviceID: device.ID,
+				UserID:   device.UserID,
+				KeyJSON:  r.FallbackKeys,
+			},
+		}
+	}
 
 	var uploadRes api.PerformUploadKeysResponse
 	keyAPI.PerformUploadKeys(req.Context(), uploadReq, &uploadRes)
@@ -71,10 +85,21 @@ func UploadKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.De
 			JSON: uploadRes.KeyErrors,
 		}
 	}
-	keyCount := make(map[string]int)
-	// we only return key counts when the client uploads OTKs
+	var keyCount map[string]int
 	if len(uploadRes.OneTimeKeyCounts) > 0 {
 		keyCount = uploadRes.OneTimeKeyCounts[0].KeyCount
+	} else {
+		// the client didn't upload any OTKs, but still expects to be told how many it has
+		var queryRes api.QueryOneTimeKeysResponse
+		keyAPI.QueryOneTimeKeys(req.Context(), &api.QueryOneTimeKeysRequest{
+			UserID:   device.UserID,
+			DeviceID: device.ID,
+		}, &queryRes)
+		if queryRes.Error != nil {
+			util.GetLogger(req.Context()).WithError(queryRes.Error).Error("Failed to QueryOneTimeKeys")
+			return jsonerror.InternalServerError()
+		}
+		keyCount = queryRes.Count.KeyCount
 	}
 	return util.JSONResponse{
 		Code: 200,
@@ -97,7 +122,7 @@ func (r *queryKeysRequest) GetTimeout() time.Duration {
 	return time.Duration(r.Timeout) * time.Millisecond
 }
 
-func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
+func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
 	var r queryKeysRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
@@ -105,6 +130,7 @@ func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
 	}
 	queryRes := api.QueryKeysResponse{}
 	keyAPI.QueryKeys(req.Context(), &api.QueryKeysRequest{
+		UserID:        device.UserID,
 		UserToDevices: r.DeviceKeys,
 		Timeout:       r.GetTimeout(),
 		// TODO: Token?
@@ -112,8 +138,11 @@ func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
 	return util.JSONResponse{
 		Code: 200,
 		JSON: map[string]interface{}{
-			"device_keys": queryRes.DeviceKeys,
-			"failures":    queryRes.Failures,
+			"device_keys":       queryRes.DeviceKeys,
+			"master_keys":       queryRes.MasterKeys,
+			"self_signing_keys": queryRes.SelfSigningKeys,
+			"user_signing_keys": queryRes.UserSigningKeys,
+			"failures":          queryRes.Failures,
 		},
 	}
 }
@@ -154,3 +183,132 @@ func ClaimKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
 		},
 	}
 }
+
+type uploadCrossSigningKeysRequest struct {
+	MasterKey      json.RawMessage `json:"master_key"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key"`
+	UserSigningKey json.RawMessage `json:"user_signing_key"`
+}
+
+// UploadCrossSigningKeys handles POST /keys/device_signing/upload
+func UploadCrossSigningKeys(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, keyAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+
+	// users who haven't set up cross-signing yet can upload their first keys without authenticating again, as
+	// there are no keys to take over. Replacing existing keys needs user interactive auth.
+	var queryRes api.QueryKeysResponse
+	keyAPI.QueryKeys(ctx, &api.QueryKeysRequest{
+		UserID:        device.UserID,
+		UserToDevices: map[string][]string{device.UserID: {}},
+	}, &queryRes)
+	if queryRes.Error != nil {
+		util.GetLogger(ctx).WithError(queryRes.Error).Error("keyAPI.QueryKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	if _, ok := queryRes.MasterKeys[device.UserID]; ok {
+		login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+		if errRes != nil {
+			return *errRes
+		}
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		// make sure that the access token being used matches the login creds used for user interactive auth, else
+		// 1 compromised access token could be used to replace the user's cross-signing keys.
+		if login.Username() != localpart && login.Username() != device.UserID {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Cannot upload another user's cross-signing keys"),
+			}
+		}
+	}
+
+	var r uploadCrossSigningKeysRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	var uploadRes api.PerformUploadDeviceKeysResponse
+	keyAPI.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         device.UserID,
+		MasterKey:      r.MasterKey,
+		SelfSigningKey: r.SelfSigningKey,
+		UserSigningKey: r.UserSigningKey,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		code, matrixErr := keyErrorToMatrixError(ctx, uploadRes.Error)
+		return util.JSONResponse{
+			Code: code,
+			JSON: matrixErr,
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadCrossSigningSignatures handles POST /keys/signatures/upload
+func UploadCrossSigningSignatures(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
+	// Map of user_id to key ID to the signed key JSON
+	var r map[string]map[string]json.RawMessage
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var uploadRes api.PerformUploadDeviceSignaturesResponse
+	keyAPI.PerformUploadDeviceSignatures(req.Context(), &api.PerformUploadDeviceSignaturesRequest{
+		UserID:     device.UserID,
+		Signatures: r,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		util.GetLogger(req.Context()).WithError(uploadRes.Error).Error("Failed to PerformUploadDeviceSignatures")
+		return jsonerror.InternalServerError()
+	}
+	failures := make(map[string]map[string]*jsonerror.MatrixError)
+	for userID, forUser := range uploadRes.Failures {
+		failures[userID] = make(map[string]*jsonerror.MatrixError)
+		for keyID, keyErr := range forUser {
+			_, failures[userID][keyID] = keyErrorToMatrixError(req.Context(), keyErr)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"failures": failures,
+		},
+	}
+}
+
+// keyErrorToMatrixError returns the HTTP status code and Matrix error for a key server error.
+func keyErrorToMatrixError(ctx context.Context, keyErr *api.KeyError) (int, *jsonerror.MatrixError) {
+	switch {
+	case keyErr.IsInvalidSignature:
+		return http.StatusBadRequest, jsonerror.InvalidSignature(keyErr.Err)
+	case keyErr.IsMissingParam:
+		return http.StatusBadRequest, jsonerror.MissingArgument(keyErr.Err)
+	case keyErr.IsInvalidParam:
+		return http.StatusBadRequest, jsonerror.InvalidArgumentValue(keyErr.Err)
+	case keyErr.IsNotFound:
+		return http.StatusNotFound, jsonerror.NotFound(keyErr.Err)
+	default:
+		util.GetLogger(ctx).WithError(keyErr).Error("Key server failed to process request")
+		return http.StatusInternalServerError, jsonerror.Unknown("Internal Server Error")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// crossSigningKeyAPI holds the master keys of users, and panics if anything
+// other than querying and uploading cross-signing keys is called.
+type crossSigningKeyAPI struct {
+	api.KeyInternalAPI
+	masterKeys map[string]json.RawMessage
+}
+
+func (k *crossSigningKeyAPI) QueryKeys(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
+	res.MasterKeys = make(map[string]json.RawMessage)
+	for userID := range req.UserToDevices {
+		if key, ok := k.masterKeys[userID]; ok {
+			res.MasterKeys[userID] = key
+		}
+	}
+}
+
+func (k *crossSigningKeyAPI) PerformUploadDeviceKeys(
+	ctx context.Context, req *api.PerformUploadDeviceKeysRequest, res *api.PerformUploadDeviceKeysResponse,
+) {
+	k.masterKeys[req.UserID] = req.MasterKey
+}
+
+func TestUploadCrossSigningKeysAuth(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	userInteractiveAuth := auth.NewUserInteractive(
+		func(ctx context.Context, localpart, password string) (*userapi.Account, error) {
+			if localpart != "alice" || password != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return &userapi.Account{Localpart: "alice", UserID: "@alice:localhost"}, nil
+		}, nil, cfg,
+	)
+	keyAPI := &crossSigningKeyAPI{masterKeys: make(map[string]json.RawMessage)}
+	device := &userapi.Device{UserID: "@alice:localhost", ID: "DEVICE"}
+	upload := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/keys/device_signing/upload", strings.NewReader(body))
+		return UploadCrossSigningKeys(req, userInteractiveAuth, keyAPI, device).Code
+	}
+
+	// users can set up cross-signing without authenticating again
+	if code := upload(`{"master_key":{"user_id":"@alice:localhost","usage":["master"],"keys":{"ed25519:first":"first"}}}`); code != http.StatusOK {
+		t.Fatalf("got status %d uploading the first master key, want 200", code)
+	}
+
+	// replacing their keys needs user interactive auth
+	replacement := `{"master_key":{"user_id":"@alice:localhost","usage":["master"],"keys":{"ed25519:second":"second"}}`
+	if code := upload(replacement + `}`); code != http.StatusUnauthorized {
+		t.Errorf("got status %d replacing the master key without auth, want 401", code)
+	}
+	if string(keyAPI.masterKeys[device.UserID]) != `{"user_id":"@alice:localhost","usage":["master"],"keys":{"ed25519:first":"first"}}` {
+		t.Errorf("the master key was replaced without auth: %s", string(keyAPI.masterKeys[device.UserID]))
+	}
+	authJSON := `,"auth":{"type":"m.login.password","identifier":{"type":"m.id.user","user":"alice"},"password":"secret"}}`
+	if code := upload(replacement + authJSON); code != http.StatusOK {
+		t.Errorf("got status %d replacing the master key with auth, want 200", code)
+	}
+}
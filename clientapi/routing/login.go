@@ -16,24 +16,28 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
-	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 type loginResponse struct {
-	UserID      string                       `json:"user_id"`
-	AccessToken string                       `json:"access_token"`
-	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
-	DeviceID    string                       `json:"device_id"`
+	UserID       string                       `json:"user_id"`
+	AccessToken  string                       `json:"access_token"`
+	HomeServer   gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID     string                       `json:"device_id"`
+	RefreshToken string                       `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64                        `json:"expires_in_ms,omitempty"`
 }
 
 type flows struct {
@@ -45,43 +49,70 @@ type flow struct {
 	Stages []string `json:"stages"`
 }
 
-func passwordLogin() flows {
+func loginFlows(cfg *config.Dendrite) flows {
 	f := flows{}
-	s := flow{
-		Type:   "m.login.password",
-		Stages: []string{"m.login.password"},
+	types := []string{"m.login.password"}
+	if cfg.SSO.Enabled {
+		types = append(types, authtypes.LoginTypeSSO, authtypes.LoginTypeToken)
+	}
+	for _, t := range types {
+		f.Flows = append(f.Flows, flow{
+			Type:   t,
+			Stages: []string{t},
+		})
 	}
-	f.Flows = append(f.Flows, s)
 	return f
 }
 
 // Login implements GET and POST /login
 func Login(
-	req *http.Request, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
-	cfg *config.Dendrite,
+	req *http.Request, getAccountByPassword auth.GetAccountByPassword,
+	getAccountByLocalpart auth.GetAccountByLocalpart,
+	userAPI userapi.UserInternalAPI, cfg *config.Dendrite, loginTokens *auth.LoginTokens,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(cfg),
 		}
 	} else if req.Method == http.MethodPost {
-		typePassword := auth.LoginTypePassword{
-			GetAccountByPassword: accountDB.GetAccountByPassword,
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+			}
+		}
+		var typ auth.Type = &auth.LoginTypePassword{
+			GetAccountByPassword: getAccountByPassword,
 			Config:               cfg,
 		}
-		r := typePassword.Request()
-		resErr := httputil.UnmarshalJSONRequest(req, r)
-		if resErr != nil {
-			return *resErr
+		switch gjson.GetBytes(body, "type").Str {
+		case authtypes.LoginTypeToken:
+			if !cfg.SSO.Enabled {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.Unknown("Token login is not enabled on this server"),
+				}
+			}
+			typ = &auth.LoginTypeToken{
+				Tokens:                loginTokens,
+				GetAccountByLocalpart: getAccountByLocalpart,
+			}
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		r := typ.Request()
+		if err = json.Unmarshal(body, r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+		login, authErr := typ.Login(req.Context(), r)
 		if authErr != nil {
 			return *authErr
 		}
 		// make a device/access token
-		return completeAuth(req.Context(), cfg.Matrix.ServerName, userAPI, login)
+		return completeAuth(req.Context(), cfg, userAPI, login)
 	}
 	return util.JSONResponse{
 		Code: http.StatusMethodNotAllowed,
@@ -90,13 +121,19 @@ func Login(
 }
 
 func completeAuth(
-	ctx context.Context, serverName gomatrixserverlib.ServerName, userAPI userapi.UserInternalAPI, login *auth.Login,
+	ctx context.Context, cfg *config.Dendrite, userAPI userapi.UserInternalAPI, login *auth.Login,
 ) util.JSONResponse {
+	serverName := cfg.Matrix.ServerName
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("auth.GenerateAccessToken failed")
 		return jsonerror.InternalServerError()
 	}
+	refreshToken, err := generateRefreshToken(cfg)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("generateRefreshToken failed")
+		return jsonerror.InternalServerError()
+	}
 
 	localpart, err := userutil.ParseUsernameParam(login.Username(), &serverName)
 	if err != nil {
@@ -106,12 +143,20 @@ func completeAuth(
 
 	var performRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
-		DeviceDisplayName: login.InitialDisplayName,
-		DeviceID:          login.DeviceID,
-		AccessToken:       token,
-		Localpart:         localpart,
+		DeviceDisplayName:     login.InitialDisplayName,
+		DeviceID:              login.DeviceID,
+		AccessToken:           token,
+		Localpart:             localpart,
+		RefreshToken:          refreshToken,
+		AccessTokenLifetimeMS: cfg.Matrix.AccessTokenLifetime.Milliseconds(),
 	}, &performRes)
 	if err != nil {
+		if _, ok := err.(*userapi.ErrorForbidden); ok { // the account is deactivated
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("This account has been deactivated"),
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
@@ -121,10 +166,12 @@ func completeAuth(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			HomeServer:  serverName,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			HomeServer:   serverName,
+			DeviceID:     performRes.Device.ID,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  cfg.Matrix.AccessTokenLifetime.Milliseconds(),
 		},
 	}
 }
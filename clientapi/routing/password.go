@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type newPasswordRequest struct {
+	NewPassword   string `json:"new_password"`
+	LogoutDevices bool   `json:"logout_devices"`
+}
+
+// Password implements POST /account/password
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-password
+// If device is nil then the user isn't logged in, e.g. because they have
+// forgotten their password, so userInteractiveAuth must only accept ways of
+// authenticating which identify the user.
+func Password(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, userAPI api.UserInternalAPI, device *api.Device,
+	cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+
+	// "logout_devices" defaults to true if it is missing.
+	r := newPasswordRequest{
+		LogoutDevices: true,
+	}
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	var localpart, deviceID string
+	if device == nil {
+		// The user is whoever they authenticated as.
+		localpart = login.Username()
+	} else {
+		localpart, _, err = gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+
+		// make sure that the access token being used matches the login creds used for user interactive auth, else
+		// 1 compromised access token could be used to change the password of another user.
+		if login.Username() != localpart && login.Username() != device.UserID {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Cannot change another user's password"),
+			}
+		}
+		deviceID = device.ID
+	}
+
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing new_password"),
+		}
+	}
+	if resErr := validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	var res api.PerformPasswordUpdateResponse
+	if err = userAPI.PerformPasswordUpdate(ctx, &api.PerformPasswordUpdateRequest{
+		Localpart:     localpart,
+		Password:      r.NewPassword,
+		LogoutDevices: r.LogoutDevices,
+		DeviceID:      deviceID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// If the user authenticated with their email address then the session
+	// can't be used again, e.g. to reset the password a second time.
+	var emailAuth struct {
+		Auth auth.EmailRequest `json:"auth"`
+	}
+	if err = json.Unmarshal(bodyBytes, &emailAuth); err == nil && emailAuth.Auth.Type == authtypes.LoginTypeEmail {
+		if err = threepid.ConsumeCredentials(ctx, emailAuth.Auth.ThreePIDCreds, cfg, userAPI); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("threepid.ConsumeCredentials failed")
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// pushGatewayNotifyPath is the path which the URL of every HTTP pusher must
+// point at, as defined by the push gateway API.
+const pushGatewayNotifyPath = "/_matrix/push/v1/notify"
+
+type pusherJSON struct {
+	PushKey           string                 `json:"pushkey"`
+	Kind              *string                `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+	Append            bool                   `json:"append"`
+}
+
+// GetPushers handles GET /pushers
+func GetPushers(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var queryRes userapi.QueryPushersResponse
+	if err = userAPI.QueryPushers(req.Context(), &userapi.QueryPushersRequest{
+		Localpart: localpart,
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Pushers == nil {
+		queryRes.Pushers = []userapi.Pusher{}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// SetPusher handles POST /pushers/set
+// creates, updates or removes a pusher of the user
+func SetPusher(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var r pusherJSON
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePusher(&r); resErr != nil {
+		return *resErr
+	}
+
+	// A null kind removes the pusher.
+	if r.Kind == nil {
+		if err = userAPI.PerformPusherDeletion(req.Context(), &userapi.PerformPusherDeletionRequest{
+			Localpart: localpart,
+			AppID:     r.AppID,
+			PushKey:   r.PushKey,
+		}, &userapi.PerformPusherDeletionResponse{}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	if err = userAPI.PerformPusherSet(req.Context(), &userapi.PerformPusherSetRequest{
+		Localpart: localpart,
+		Append:    r.Append,
+		Pusher: userapi.Pusher{
+			PushKey:           r.PushKey,
+			PushKeyTS:         gomatrixserverlib.AsTimestamp(time.Now()),
+			Kind:              userapi.PusherKind(*r.Kind),
+			AppID:             r.AppID,
+			AppDisplayName:    r.AppDisplayName,
+			DeviceDisplayName: r.DeviceDisplayName,
+			ProfileTag:        r.ProfileTag,
+			Language:          r.Language,
+			Data:              r.Data,
+		},
+	}, &userapi.PerformPusherSetResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherSet failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func validatePusher(r *pusherJSON) *util.JSONResponse {
+	missing := func(field string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument(fmt.Sprintf("Missing '%s'", field)),
+		}
+	}
+	invalid := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(msg),
+		}
+	}
+
+	switch {
+	case r.PushKey == "":
+		return missing("pushkey")
+	case r.AppID == "":
+		return missing("app_id")
+	case len(r.PushKey) > 512:
+		return invalid("pushkey must be at most 512 bytes")
+	case len(r.AppID) > 64:
+		return invalid("app_id must be at most 64 characters")
+	case r.Kind == nil:
+		// Only the pushkey and app ID are needed to remove a pusher.
+		return nil
+	case r.AppDisplayName == "":
+		return missing("app_display_name")
+	case r.DeviceDisplayName == "":
+		return missing("device_display_name")
+	case r.Language == "":
+		return missing("lang")
+	case r.Data == nil:
+		return missing("data")
+	}
+
+	if userapi.PusherKind(*r.Kind) != userapi.HTTPKind {
+		return invalid(fmt.Sprintf("Unsupported pusher kind '%s'", *r.Kind))
+	}
+	rawURL, ok := r.Data["url"].(string)
+	if !ok || rawURL == "" {
+		return missing("data.url")
+	}
+	pushURL, err := url.Parse(rawURL)
+	if err != nil || (pushURL.Scheme != "http" && pushURL.Scheme != "https") || pushURL.Host == "" {
+		return invalid("data.url must be an absolute HTTP URL")
+	}
+	if pushURL.Path != pushGatewayNotifyPath {
+		return invalid(fmt.Sprintf("data.url must have the path '%s'", pushGatewayNotifyPath))
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type pushRuleJSON struct {
+	Actions    []*pushrules.Action    `json:"actions"`
+	Conditions []*pushrules.Condition `json:"conditions"`
+	Pattern    string                 `json:"pattern"`
+}
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	scope string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	ruleSet, resErr := pushRuleSetOfScope(ruleSets, scope)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSet,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	scope, kind string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesOfKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: *rules,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}
+func GetPushRuleByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesOfKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rules)[i],
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}
+func PutPushRuleByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	var r pushRuleJSON
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	beforeRuleID := req.URL.Query().Get("before")
+	afterRuleID := req.URL.Query().Get("after")
+
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesOfKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	if i := pushRuleIndex(*rules, ruleID); i >= 0 && (*rules)[i].Default {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Cannot modify a server default push rule"),
+		}
+	}
+
+	rule := &pushrules.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: r.Actions,
+	}
+	switch pushrules.Kind(kind) {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		rule.Conditions = r.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []*pushrules.Condition{}
+		}
+	case pushrules.ContentKind:
+		rule.Pattern = r.Pattern
+	}
+	if errs := pushrules.ValidateRule(pushrules.Kind(kind), rule); len(errs) > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(errs[0].Error()),
+		}
+	}
+
+	if i := pushRuleIndex(*rules, ruleID); i >= 0 {
+		if beforeRuleID == "" && afterRuleID == "" {
+			// Updating an existing rule keeps its position and whether or
+			// not it is enabled.
+			rule.Enabled = (*rules)[i].Enabled
+			(*rules)[i] = rule
+			return savePushRules(req, device.UserID, ruleSets, userAPI, syncProducer)
+		}
+		*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	}
+
+	// User-defined rules can't be positioned relative to the server default
+	// rules, which always keep their place at the start or end of the kind.
+	var insertAt int
+	switch {
+	case beforeRuleID != "":
+		if insertAt = pushRuleIndex(*rules, beforeRuleID); insertAt < 0 {
+			return pushRuleNotFound(beforeRuleID)
+		}
+		if (*rules)[insertAt].Default {
+			return pushRuleRelativeToDefault("before")
+		}
+	case afterRuleID != "":
+		if insertAt = pushRuleIndex(*rules, afterRuleID); insertAt < 0 {
+			return pushRuleNotFound(afterRuleID)
+		}
+		if (*rules)[insertAt].Default {
+			return pushRuleRelativeToDefault("after")
+		}
+		insertAt++
+	default:
+		// New rules are the highest priority user-defined rule of their
+		// kind, which only the master rule overrides.
+		if len(*rules) > 0 && (*rules)[0].RuleID == pushrules.MRuleMaster {
+			insertAt = 1
+		}
+	}
+	*rules = append(*rules, nil)
+	copy((*rules)[insertAt+1:], (*rules)[insertAt:])
+	(*rules)[insertAt] = rule
+
+	return savePushRules(req, device.UserID, ruleSets, userAPI, syncProducer)
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleID}
+func DeletePushRuleByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesOfKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	if (*rules)[i].Default {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot delete a server default push rule"),
+		}
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	return savePushRules(req, device.UserID, ruleSets, userAPI, syncProducer)
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func GetPushRuleAttrByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesOfKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	switch attr {
+	case "enabled":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]bool{"enabled": (*rules)[i].Enabled},
+		}
+	case "actions":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string][]*pushrules.Action{"actions": (*rules)[i].Actions},
+		}
+	default:
+		return pushRuleUnknownAttr(attr)
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func PutPushRuleAttrByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	var r struct {
+		Enabled *bool               `json:"enabled"`
+		Actions []*pushrules.Action `json:"actions"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesOfKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	switch attr {
+	case "enabled":
+		if r.Enabled == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing 'enabled'"),
+			}
+		}
+		(*rules)[i].Enabled = *r.Enabled
+	case "actions":
+		if r.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing 'actions'"),
+			}
+		}
+		(*rules)[i].Actions = r.Actions
+	default:
+		return pushRuleUnknownAttr(attr)
+	}
+	return savePushRules(req, device.UserID, ruleSets, userAPI, syncProducer)
+}
+
+// queryPushRules returns the push rules of the user, falling back to the
+// server defaults if the user doesn't have any stored yet.
+func queryPushRules(
+	ctx context.Context, userID string, userAPI userapi.UserInternalAPI,
+) (*pushrules.AccountRuleSets, error) {
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: pushrules.AccountDataType,
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err := userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+		return nil, fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	data, ok := dataRes.GlobalAccountData[pushrules.AccountDataType]
+	if !ok {
+		localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.SplitID: %w", err)
+		}
+		return pushrules.DefaultAccountRuleSets(localpart, serverName), nil
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if err := json.Unmarshal(data, &ruleSets); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	// Make sure that kinds without any rules are returned as empty lists.
+	for _, kind := range pushrules.Kinds() {
+		if rules := ruleSets.Global.RulesOfKind(kind); *rules == nil {
+			*rules = []*pushrules.Rule{}
+		}
+	}
+	return &ruleSets, nil
+}
+
+// savePushRules stores the push rules of the user and notifies the sync
+// API that they have changed.
+func savePushRules(
+	req *http.Request, userID string, ruleSets *pushrules.AccountRuleSets,
+	userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	data, err := json.Marshal(ruleSets)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	dataReq := userapi.InputAccountDataRequest{
+		UserID:      userID,
+		DataType:    pushrules.AccountDataType,
+		AccountData: data,
+	}
+	dataRes := userapi.InputAccountDataResponse{}
+	if err = userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = syncProducer.SendData(userID, "", pushrules.AccountDataType); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func pushRuleSetOfScope(
+	ruleSets *pushrules.AccountRuleSets, scope string,
+) (*pushrules.RuleSet, *util.JSONResponse) {
+	if scope != pushrules.GlobalScope {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule scope '%s'", scope)),
+		}
+	}
+	return &ruleSets.Global, nil
+}
+
+func pushRulesOfKind(
+	ruleSets *pushrules.AccountRuleSets, scope, kind string,
+) (*[]*pushrules.Rule, *util.JSONResponse) {
+	ruleSet, resErr := pushRuleSetOfScope(ruleSets, scope)
+	if resErr != nil {
+		return nil, resErr
+	}
+	rules := ruleSet.RulesOfKind(pushrules.Kind(kind))
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule kind '%s'", kind)),
+		}
+	}
+	return rules, nil
+}
+
+func pushRuleIndex(rules []*pushrules.Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+func pushRuleNotFound(ruleID string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound(fmt.Sprintf("Push rule '%s' not found", ruleID)),
+	}
+}
+
+func pushRuleRelativeToDefault(param string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("'%s' cannot refer to a server default push rule", param)),
+	}
+}
+
+func pushRuleUnknownAttr(attr string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule attribute '%s'", attr)),
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// pushRulesUserAPI stores the global account data of a single user, and
+// panics if anything else is called.
+type pushRulesUserAPI struct {
+	userapi.UserInternalAPI
+	data map[string]json.RawMessage
+}
+
+func (u *pushRulesUserAPI) QueryAccountData(
+	ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse,
+) error {
+	res.GlobalAccountData = make(map[string]json.RawMessage)
+	if data, ok := u.data[req.DataType]; ok {
+		res.GlobalAccountData[req.DataType] = data
+	}
+	return nil
+}
+
+func (u *pushRulesUserAPI) InputAccountData(
+	ctx context.Context, req *userapi.InputAccountDataRequest, res *userapi.InputAccountDataResponse,
+) error {
+	u.data[req.DataType] = req.AccountData
+	return nil
+}
+
+func TestPutPushRuleByRuleID(t *testing.T) {
+	device := &userapi.Device{UserID: "@alice:localhost", ID: "device"}
+	userAPI := &pushRulesUserAPI{data: make(map[string]json.RawMessage)}
+	syncProducer := mocks.NewSyncProducer(t, nil)
+	defer syncProducer.Close() // nolint: errcheck
+	producer := &producers.SyncAPIProducer{Producer: syncProducer}
+
+	putRule := func(kind, ruleID, query, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/pushrules/global/"+kind+"/"+ruleID+query, strings.NewReader(body))
+		res := PutPushRuleByRuleID(req, device, userAPI, producer, pushrules.GlobalScope, kind, ruleID)
+		return res.Code
+	}
+	overrideRuleIDs := func() []string {
+		ruleSets, err := queryPushRules(context.Background(), device.UserID, userAPI)
+		if err != nil {
+			t.Fatalf("queryPushRules failed: %s", err)
+		}
+		var ruleIDs []string
+		for _, rule := range ruleSets.Global.Override {
+			ruleIDs = append(ruleIDs, rule.RuleID)
+		}
+		return ruleIDs
+	}
+	overrideBody := `{"actions":["notify"],"conditions":[]}`
+
+	testCases := []struct {
+		Name     string
+		Kind     string
+		RuleID   string
+		Query    string
+		Body     string
+		WantCode int
+	}{
+		{
+			Name:     "overwrite default override rule",
+			Kind:     "override",
+			RuleID:   pushrules.MRuleMaster,
+			Body:     overrideBody,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "overwrite default content rule",
+			Kind:     "content",
+			RuleID:   pushrules.MRuleContainsUserName,
+			Body:     `{"actions":["notify"],"pattern":"alice"}`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "new rule with reserved rule ID",
+			Kind:     "override",
+			RuleID:   ".m.rule.mine",
+			Body:     overrideBody,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "before default rule",
+			Kind:     "override",
+			RuleID:   "mine",
+			Query:    "?before=" + pushrules.MRuleMaster,
+			Body:     overrideBody,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "after default rule",
+			Kind:     "override",
+			RuleID:   "mine",
+			Query:    "?after=" + pushrules.MRuleSuppressNotices,
+			Body:     overrideBody,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "before unknown rule",
+			Kind:     "override",
+			RuleID:   "mine",
+			Query:    "?before=unknown",
+			Body:     overrideBody,
+			WantCode: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		if code := putRule(tc.Kind, tc.RuleID, tc.Query, tc.Body); code != tc.WantCode {
+			t.Errorf("%s: got status %d, want %d", tc.Name, code, tc.WantCode)
+		}
+	}
+	if len(userAPI.data) != 0 {
+		t.Fatalf("push rules were saved by rejected requests")
+	}
+
+	// New rules go after the master rule, and can be placed relative to
+	// other user-defined rules.
+	syncProducer.ExpectSendMessageAndSucceed()
+	if code := putRule("override", "first", "", overrideBody); code != http.StatusOK {
+		t.Fatalf("got status %d adding rule, want 200", code)
+	}
+	syncProducer.ExpectSendMessageAndSucceed()
+	if code := putRule("override", "second", "?after=first", overrideBody); code != http.StatusOK {
+		t.Fatalf("got status %d adding rule after another, want 200", code)
+	}
+	ruleIDs := overrideRuleIDs()
+	if len(ruleIDs) < 3 || ruleIDs[0] != pushrules.MRuleMaster || ruleIDs[1] != "first" || ruleIDs[2] != "second" {
+		t.Errorf("got override rules %v, want [%s first second ...]", ruleIDs, pushrules.MRuleMaster)
+	}
+}
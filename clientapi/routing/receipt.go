@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// SetReceipt handles POST /rooms/{roomID}/receipt/{receiptType}/{eventID}
+// sends the receipt to the EDU server.
+func SetReceipt(
+	req *http.Request, userAPI userapi.UserInternalAPI, eduAPI api.EDUServerInputAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, device *userapi.Device, roomID, receiptType, eventID string,
+) util.JSONResponse {
+	timestamp := gomatrixserverlib.AsTimestamp(time.Now())
+	logrus.WithFields(logrus.Fields{
+		"roomID":      roomID,
+		"receiptType": receiptType,
+		"eventID":     eventID,
+		"userId":      device.UserID,
+		"timestamp":   timestamp,
+	}).Debug("Setting receipt")
+
+	// currently only m.read is accepted
+	if receiptType != "m.read" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(fmt.Sprintf("Receipt type must be m.read not '%s'", receiptType)),
+		}
+	}
+
+	// only users who are joined to the room may send receipts in it
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(req.Context(), &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You must be joined to the room to send receipts"),
+		}
+	}
+
+	if err := api.SendReceipt(req.Context(), eduAPI, device.UserID, roomID, eventID, receiptType, timestamp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eduAPI.SendReceipt failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The user has read the room, so they no longer have any unread
+	// notifications in it.
+	if resErr := markNotificationsRead(req, userAPI, device, roomID); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// markNotificationsRead resets the unread notification counts of the user
+// in the room.
+func markNotificationsRead(
+	req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, roomID string,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if err = userAPI.PerformNotificationsRead(req.Context(), &userapi.PerformNotificationsReadRequest{
+		Localpart: localpart,
+		RoomID:    roomID,
+	}, &userapi.PerformNotificationsReadResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformNotificationsRead failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
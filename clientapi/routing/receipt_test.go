@@ -0,0 +1,97 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// receiptRoomserverAPI has only the given users joined to rooms, and panics
+// if anything else is called.
+type receiptRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	joined map[string]bool
+}
+
+func (r *receiptRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse,
+) error {
+	res.IsInRoom = r.joined[req.UserID]
+	res.HasBeenInRoom = res.IsInRoom
+	return nil
+}
+
+// receiptEDUAPI records the receipts sent to it, and panics if anything else
+// is called.
+type receiptEDUAPI struct {
+	eduAPI.EDUServerInputAPI
+	receipts []eduAPI.InputReceiptEvent
+}
+
+func (e *receiptEDUAPI) InputReceiptEvent(
+	ctx context.Context, req *eduAPI.InputReceiptEventRequest, res *eduAPI.InputReceiptEventResponse,
+) error {
+	e.receipts = append(e.receipts, req.InputReceiptEvent)
+	return nil
+}
+
+// receiptUserAPI records the rooms marked as read, and panics if anything
+// else is called.
+type receiptUserAPI struct {
+	userapi.UserInternalAPI
+	read []string
+}
+
+func (u *receiptUserAPI) PerformNotificationsRead(
+	ctx context.Context, req *userapi.PerformNotificationsReadRequest, res *userapi.PerformNotificationsReadResponse,
+) error {
+	u.read = append(u.read, req.RoomID)
+	return nil
+}
+
+func TestSetReceiptRequiresMembership(t *testing.T) {
+	rsAPI := &receiptRoomserverAPI{joined: map[string]bool{"@alice:localhost": true}}
+	edus := &receiptEDUAPI{}
+	userAPI := &receiptUserAPI{}
+	req := httptest.NewRequest(http.MethodPost, "/rooms/!room:localhost/receipt/m.read/$event:localhost", nil)
+
+	bob := &userapi.Device{UserID: "@bob:localhost", ID: "device"}
+	res := SetReceipt(req, userAPI, edus, rsAPI, bob, "!room:localhost", "m.read", "$event:localhost")
+	if res.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a user who isn't joined, want 403", res.Code)
+	}
+	if len(edus.receipts) != 0 || len(userAPI.read) != 0 {
+		t.Errorf("got receipts %+v and read rooms %v for a user who isn't joined, want none", edus.receipts, userAPI.read)
+	}
+
+	alice := &userapi.Device{UserID: "@alice:localhost", ID: "device"}
+	res = SetReceipt(req, userAPI, edus, rsAPI, alice, "!room:localhost", "m.read", "$event:localhost")
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d for a joined user, want 200", res.Code)
+	}
+	if len(edus.receipts) != 1 || edus.receipts[0].UserID != "@alice:localhost" || edus.receipts[0].EventID != "$event:localhost" {
+		t.Errorf("got receipts %+v, want one from @alice:localhost for $event:localhost", edus.receipts)
+	}
+	if len(userAPI.read) != 1 || userAPI.read[0] != "!room:localhost" {
+		t.Errorf("got read rooms %v, want [!room:localhost]", userAPI.read)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// Refresh implements POST /refresh, which replaces the access token and the
+// refresh token of a device, e.g. once the access token has expired.
+// https://github.com/matrix-org/matrix-doc/pull/2918
+func Refresh(
+	req *http.Request, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing refresh_token"),
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var res userapi.PerformTokenRefreshResponse
+	if err = userAPI.PerformTokenRefresh(req.Context(), &userapi.PerformTokenRefreshRequest{
+		RefreshToken:          r.RefreshToken,
+		NewAccessToken:        accessToken,
+		NewRefreshToken:       refreshToken,
+		AccessTokenLifetimeMS: cfg.Matrix.AccessTokenLifetime.Milliseconds(),
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTokenRefresh failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Device == nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown refresh token"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  res.Device.AccessToken,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  cfg.Matrix.AccessTokenLifetime.Milliseconds(),
+		},
+	}
+}
+
+// generateRefreshToken returns a new refresh token for a device, or an empty
+// string if access tokens don't expire and so don't need to be refreshed.
+func generateRefreshToken(cfg *config.Dendrite) (string, error) {
+	if cfg.Matrix.AccessTokenLifetime == 0 {
+		return "", nil
+	}
+	return auth.GenerateAccessToken()
+}
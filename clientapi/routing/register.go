@@ -39,6 +39,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -76,6 +77,15 @@ func init() {
 type sessionsDict struct {
 	sync.Mutex
 	sessions map[string][]authtypes.LoginType
+	// The verified 3PIDs to add to the account once it is registered.
+	threePIDs map[string]sessionThreePID
+}
+
+// sessionThreePID is a 3PID that a registration session has verified, along
+// with the credentials of the 3PID session that verified it.
+type sessionThreePID struct {
+	threePID authtypes.ThreePID
+	creds    threepid.Credentials
 }
 
 // GetCompletedStages returns the completed stages for a session.
@@ -92,10 +102,28 @@ func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginTyp
 
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
+		sessions:  make(map[string][]authtypes.LoginType),
+		threePIDs: make(map[string]sessionThreePID),
 	}
 }
 
+// SetThreePID records the 3PID that a session has verified, and the
+// credentials of the 3PID session that verified it.
+func (d *sessionsDict) SetThreePID(sessionID string, threePID authtypes.ThreePID, creds threepid.Credentials) {
+	d.Lock()
+	defer d.Unlock()
+	d.threePIDs[sessionID] = sessionThreePID{threePID, creds}
+}
+
+// GetThreePID returns the 3PID that a session has verified and the
+// credentials of the 3PID session that verified it, if any.
+func (d *sessionsDict) GetThreePID(sessionID string) (authtypes.ThreePID, threepid.Credentials, bool) {
+	d.Lock()
+	defer d.Unlock()
+	t, ok := d.threePIDs[sessionID]
+	return t.threePID, t.creds, ok
+}
+
 // AddCompletedSessionStage records that a session has completed an auth stage.
 func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
 	sessions.Lock()
@@ -141,6 +169,10 @@ type registerRequest struct {
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
+
+	// The access token of a guest account which should be upgraded to a full
+	// account, rather than a new account being registered.
+	GuestAccessToken string `json:"guest_access_token"`
 }
 
 type authDict struct {
@@ -150,6 +182,8 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Email
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -184,10 +218,12 @@ func newUserInteractiveResponse(
 
 // http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#post-matrix-client-unstable-register
 type registerResponse struct {
-	UserID      string                       `json:"user_id"`
-	AccessToken string                       `json:"access_token,omitempty"`
-	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
-	DeviceID    string                       `json:"device_id,omitempty"`
+	UserID       string                       `json:"user_id"`
+	AccessToken  string                       `json:"access_token,omitempty"`
+	HomeServer   gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID     string                       `json:"device_id,omitempty"`
+	RefreshToken string                       `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64                        `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -460,8 +496,13 @@ func Register(
 		sessionID = util.RandomString(sessionIDLength)
 	}
 
-	// Don't allow numeric usernames less than MAX_INT64.
-	if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
+	if r.GuestAccessToken != "" {
+		// The guest's localpart is numeric, so this skips the check below.
+		if resErr = validateGuestUpgrade(req, &r, userAPI); resErr != nil {
+			return *resErr
+		}
+	} else if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
+		// Don't allow numeric usernames less than MAX_INT64.
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.InvalidUsername("Numeric user IDs are reserved"),
@@ -506,7 +547,46 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accountDB)
+}
+
+// validateGuestUpgrade checks that the guest access token of the request
+// belongs to a guest account, and that the request doesn't try to register a
+// different username than the guest's. The username of the request is set to
+// the guest's localpart so that the guest account is the one upgraded.
+func validateGuestUpgrade(
+	req *http.Request,
+	r *registerRequest,
+	userAPI userapi.UserInternalAPI,
+) *util.JSONResponse {
+	var res userapi.QueryAccessTokenResponse
+	if err := userAPI.QueryAccessToken(req.Context(), &userapi.QueryAccessTokenRequest{
+		AccessToken: r.GuestAccessToken,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccessToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.Device == nil || res.Device.AccountType != userapi.AccountTypeGuest {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Invalid guest access token"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', res.Device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if r.Username != "" && strings.ToLower(r.Username) != localpart {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot register taken user ID without valid guest credentials for that user"),
+		}
+	}
+	r.Username = localpart
+	return nil
 }
 
 func handleGuestRegistration(
@@ -537,12 +617,21 @@ func handleGuestRegistration(
 			JSON: jsonerror.Unknown("Failed to generate access token"),
 		}
 	}
+	refreshToken, err := generateRefreshToken(cfg)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to generate refresh token"),
+		}
+	}
 	//we don't allow guests to specify their own device_id
 	var devRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(req.Context(), &userapi.PerformDeviceCreationRequest{
-		Localpart:         res.Account.Localpart,
-		DeviceDisplayName: r.InitialDisplayName,
-		AccessToken:       token,
+		Localpart:             res.Account.Localpart,
+		DeviceDisplayName:     r.InitialDisplayName,
+		AccessToken:           token,
+		RefreshToken:          refreshToken,
+		AccessTokenLifetimeMS: cfg.Matrix.AccessTokenLifetime.Milliseconds(),
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -553,10 +642,12 @@ func handleGuestRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  res.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			HomeServer:   res.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  cfg.Matrix.AccessTokenLifetime.Milliseconds(),
 		},
 	}
 }
@@ -570,15 +661,14 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.Dendrite,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 ) util.JSONResponse {
-	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
-	// TODO: Guest account upgrading
 
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
+	// TODO: msisdn auth type.
 
 	if cfg.Matrix.RegistrationDisabled && r.Auth.Type != authtypes.LoginTypeSharedSecret {
 		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
@@ -595,7 +685,23 @@ func handleRegistrationFlow(
 		// Add Recaptcha to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
+	case authtypes.LoginTypeEmail:
+		// Check that the user has verified an email address which isn't in
+		// use, which is added to the account once it is registered
+		threePID, resErr := validateRegistrationThreePID(req, r.Auth.ThreePIDCreds, cfg, userAPI, accountDB)
+		if resErr != nil {
+			return *resErr
+		}
+		sessions.SetThreePID(sessionID, *threePID, r.Auth.ThreePIDCreds)
+
+		// Add Email to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
 	case authtypes.LoginTypeSharedSecret:
+		if cfg.Matrix.RegistrationSharedSecret == "" {
+			return util.MessageResponse(http.StatusBadRequest, "Shared secret registration is disabled")
+		}
+
 		// Check shared secret against config
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Auth.Mac)
 
@@ -606,8 +712,16 @@ func handleRegistrationFlow(
 			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
 		}
 
-		// Add SharedSecret to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeSharedSecret)
+		// The MAC covers the username, password and admin flag of this
+		// request, so it is enough to register on its own, and the account
+		// is made an admin if that was asked for. This isn't recorded in the
+		// session, so later requests can't use it to skip the other stages
+		// or to become admins.
+		accountType := userapi.AccountTypeUser
+		if r.Admin {
+			accountType = userapi.AccountTypeAdmin
+		}
+		return completeFlow(req, r, sessionID, cfg, userAPI, accountDB, accountType)
 
 	case "":
 		// Extract the access token from the request, if there's one to extract
@@ -650,7 +764,49 @@ func handleRegistrationFlow(
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, accountDB)
+}
+
+// validateRegistrationThreePID checks that the 3PID session has been
+// validated and that its 3PID doesn't already belong to an account, returning
+// the 3PID if so.
+func validateRegistrationThreePID(
+	req *http.Request,
+	creds threepid.Credentials,
+	cfg *config.Dendrite,
+	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+) (*authtypes.ThreePID, *util.JSONResponse) {
+	verified, address, medium, err := threepid.CheckCredentials(req.Context(), creds, cfg, userAPI)
+	if err == threepid.ErrNotTrusted {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.NotTrusted(creds.IDServer),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckCredentials failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if !verified {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.ThreePIDAuthFailed("The email address has not been verified"),
+		}
+	}
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), address, medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if localpart != "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ThreePIDInUse(accounts.Err3PIDInUse.Error()),
+		}
+	}
+	return &authtypes.ThreePID{Address: address, Medium: medium}, nil
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -691,7 +847,7 @@ func handleApplicationServiceRegistration(
 	// Don't need to worry about appending to registration stages as
 	// application service registration is entirely separate.
 	return completeRegistration(
-		req.Context(), userAPI, r.Username, "", appserviceID,
+		req.Context(), userAPI, cfg, r.Username, "", appserviceID, userapi.AccountTypeUser, false,
 		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 	)
 }
@@ -706,13 +862,11 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.Dendrite,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
-			req.Context(), userAPI, r.Username, r.Password, "",
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
-		)
+		return completeFlow(req, r, sessionID, cfg, userAPI, accountDB, userapi.AccountTypeUser)
 	}
 
 	// There are still more stages to complete.
@@ -724,6 +878,35 @@ func checkAndCompleteFlow(
 	}
 }
 
+// completeFlow registers the account of a session which has completed its
+// registration flow, with the given account type, and adds any 3PID that the
+// session verified to it.
+func completeFlow(
+	req *http.Request,
+	r registerRequest,
+	sessionID string,
+	cfg *config.Dendrite,
+	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	accountType userapi.AccountType,
+) util.JSONResponse {
+	res := completeRegistration(
+		req.Context(), userAPI, cfg, r.Username, r.Password, "", accountType, r.GuestAccessToken != "",
+		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+	)
+	if threePID, creds, ok := sessions.GetThreePID(sessionID); ok && res.Code == http.StatusOK {
+		// The account has been created by now, so don't fail the request
+		// if the 3PID was added to another account in the meantime.
+		if err := accountDB.SaveThreePIDAssociation(req.Context(), threePID.Address, r.Username, threePID.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+		}
+		if err := threepid.ConsumeCredentials(req.Context(), creds, cfg, userAPI); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("threepid.ConsumeCredentials failed")
+		}
+	}
+	return res
+}
+
 // LegacyRegister process register requests from the legacy v1 API
 func LegacyRegister(
 	req *http.Request,
@@ -762,10 +945,14 @@ func LegacyRegister(
 			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
 		}
 
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", false, nil, nil)
+		accountType := userapi.AccountTypeUser
+		if r.Admin {
+			accountType = userapi.AccountTypeAdmin
+		}
+		return completeRegistration(req.Context(), userAPI, cfg, r.Username, r.Password, "", accountType, false, false, nil, nil)
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req.Context(), userAPI, cfg, r.Username, r.Password, "", userapi.AccountTypeUser, false, false, nil, nil)
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -812,7 +999,10 @@ func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *u
 func completeRegistration(
 	ctx context.Context,
 	userAPI userapi.UserInternalAPI,
+	cfg *config.Dendrite,
 	username, password, appserviceID string,
+	accountType userapi.AccountType,
+	upgradeGuest bool,
 	inhibitLogin eventutil.WeakBoolean,
 	displayName, deviceID *string,
 ) util.JSONResponse {
@@ -835,8 +1025,9 @@ func completeRegistration(
 		AppServiceID: appserviceID,
 		Localpart:    username,
 		Password:     password,
-		AccountType:  userapi.AccountTypeUser,
+		AccountType:  accountType,
 		OnConflict:   userapi.ConflictAbort,
+		UpgradeGuest: upgradeGuest,
 	}, &accRes)
 	if err != nil {
 		if _, ok := err.(*userapi.ErrorConflict); ok { // user already exists
@@ -845,6 +1036,12 @@ func completeRegistration(
 				JSON: jsonerror.UserInUse("Desired user ID is already taken."),
 			}
 		}
+		if _, ok := err.(*userapi.ErrorForbidden); ok { // guest was already upgraded
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(err.Error()),
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: jsonerror.Unknown("failed to create account: " + err.Error()),
@@ -873,13 +1070,22 @@ func completeRegistration(
 			JSON: jsonerror.Unknown("Failed to generate access token"),
 		}
 	}
+	refreshToken, err := generateRefreshToken(cfg)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to generate refresh token"),
+		}
+	}
 
 	var devRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
-		Localpart:         username,
-		AccessToken:       token,
-		DeviceDisplayName: displayName,
-		DeviceID:          deviceID,
+		Localpart:             username,
+		AccessToken:           token,
+		DeviceDisplayName:     displayName,
+		DeviceID:              deviceID,
+		RefreshToken:          refreshToken,
+		AccessTokenLifetimeMS: cfg.Matrix.AccessTokenLifetime.Milliseconds(),
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -891,10 +1097,12 @@ func completeRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  accRes.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			HomeServer:   accRes.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  cfg.Matrix.AccessTokenLifetime.Milliseconds(),
 		},
 	}
 }
@@ -926,22 +1134,33 @@ func isValidMacLogin(
 		return false, errors.New("Shared secret registration is disabled")
 	}
 
-	adminString := "notadmin"
-	if isAdmin {
-		adminString = "admin"
-	}
-	joined := strings.Join([]string{username, password, adminString}, "\x00")
-
-	mac := hmac.New(sha1.New, []byte(sharedSecret))
-	_, err := mac.Write([]byte(joined))
+	expectedMAC, err := sharedSecretMAC(sharedSecret, username, password, adminString(isAdmin))
 	if err != nil {
 		return false, err
 	}
-	expectedMAC := mac.Sum(nil)
 
 	return hmac.Equal(givenMac, expectedMAC), nil
 }
 
+// adminString returns how the isAdmin flag is represented in the HMAC of a
+// shared secret registration.
+func adminString(isAdmin bool) string {
+	if isAdmin {
+		return "admin"
+	}
+	return "notadmin"
+}
+
+// sharedSecretMAC returns the HMAC-SHA1 of the given fields, separated by
+// NUL bytes, using the registration shared secret as the key.
+func sharedSecretMAC(sharedSecret string, fields ...string) ([]byte, error) {
+	mac := hmac.New(sha1.New, []byte(sharedSecret))
+	if _, err := mac.Write([]byte(strings.Join(fields, "\x00"))); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
 // checkFlows checks a single completed flow against another required one. If
 // one contains at least all of the stages that the other does, checkFlows
 // returns true.
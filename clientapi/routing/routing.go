@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
@@ -38,6 +39,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 const pathPrefixV1 = "/client/api/v1"
@@ -51,7 +53,7 @@ const pathPrefixUnstable = "/client/unstable"
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router, cfg *config.Dendrite,
+	publicAPIMux, synapseAdminRouter *mux.Router, cfg *config.Dendrite,
 	eduAPI eduServerAPI.EDUServerInputAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
@@ -66,7 +68,39 @@ func Setup(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 ) {
-	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg)
+	getAccountByPassword := auth.GetAccountByPassword(accountDB.GetAccountByPassword)
+	if cfg.Matrix.LDAP.Enabled {
+		externalAuth := &auth.ExternalPasswordAuth{
+			Provider:  auth.NewLDAPProvider(&cfg.Matrix.LDAP),
+			UserAPI:   userAPI,
+			AccountDB: accountDB,
+		}
+		if cfg.Matrix.LDAP.AllowLocalAccounts {
+			externalAuth.Fallback = accountDB.GetAccountByPassword
+		}
+		getAccountByPassword = externalAuth.GetAccountByPassword
+	}
+	// If this server sends verification emails itself then users can also
+	// authenticate with the email addresses on their accounts, e.g. to reset
+	// a forgotten password.
+	var mailer *threepid.Mailer
+	var emailAuth *auth.LoginTypeEmail
+	var passwordResetAuth *auth.UserInteractive
+	if cfg.Email.Enabled {
+		var err error
+		if mailer, err = threepid.NewMailer(cfg); err != nil {
+			logrus.WithError(err).Panic("failed to create mailer")
+		}
+		emailAuth = &auth.LoginTypeEmail{
+			UserAPI:   userAPI,
+			AccountDB: accountDB,
+			Config:    cfg,
+		}
+		passwordResetAuth = auth.NewEmailUserInteractive(emailAuth)
+	}
+	userInteractiveAuth := auth.NewUserInteractive(getAccountByPassword, emailAuth, cfg)
+	loginTokens := auth.NewLoginTokens()
+	requestTokenThrottles := newRequestTokenThrottles()
 
 	publicAPIMux.Handle("/client/versions",
 		httputil.MakeExternalAPI("versions", func(req *http.Request) util.JSONResponse {
@@ -84,6 +118,16 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	registrationNonces := newRegistrationNonces()
+	synapseAdminRouter.Handle("/admin/v1/register",
+		httputil.MakeExternalAPI("admin_register", func(req *http.Request) util.JSONResponse {
+			if req.Method == http.MethodGet {
+				return GetAdminRegisterNonce(req, cfg, registrationNonces)
+			}
+			return AdminRegister(req, cfg, registrationNonces, userAPI, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
 	r0mux := publicAPIMux.PathPrefix(pathPrefixR0).Subrouter()
 	v1mux := publicAPIMux.PathPrefix(pathPrefixV1).Subrouter()
 	unstableMux := publicAPIMux.PathPrefix(pathPrefixUnstable).Subrouter()
@@ -102,12 +146,12 @@ func Setup(
 			return JoinRoomByIDOrAlias(
 				req, device, rsAPI, accountDB, vars["roomIDOrAlias"],
 			)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, stateAPI)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/join",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -118,7 +162,7 @@ func Setup(
 			return JoinRoomByIDOrAlias(
 				req, device, rsAPI, accountDB, vars["roomID"],
 			)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/leave",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -129,7 +173,7 @@ func Setup(
 			return LeaveRoomByID(
 				req, device, rsAPI, vars["roomID"],
 			)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/ban",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -185,7 +229,7 @@ func Setup(
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
 				nil, cfg, rsAPI, transactionsCache)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
 		httputil.MakeAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -193,8 +237,8 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, federation)
-		}),
+			return GetEvent(req, device, vars["roomID"], vars["eventID"], rsAPI)
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -203,7 +247,7 @@ func Setup(
 			return util.ErrorResponse(err)
 		}
 		return OnIncomingStateRequest(req.Context(), rsAPI, vars["roomID"])
-	})).Methods(http.MethodGet, http.MethodOptions)
+	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{type:[^/]+/?}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -217,7 +261,7 @@ func Setup(
 		}
 		eventFormat := req.URL.Query().Get("format") == "event"
 		return OnIncomingStateTypeRequest(req.Context(), device, rsAPI, vars["roomID"], eventType, "", eventFormat)
-	})).Methods(http.MethodGet, http.MethodOptions)
+	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -226,7 +270,7 @@ func Setup(
 		}
 		eventFormat := req.URL.Query().Get("format") == "event"
 		return OnIncomingStateTypeRequest(req.Context(), device, rsAPI, vars["roomID"], vars["type"], vars["stateKey"], eventFormat)
-	})).Methods(http.MethodGet, http.MethodOptions)
+	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -323,14 +367,14 @@ func Setup(
 
 	r0mux.Handle("/logout",
 		httputil.MakeAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Logout(req, deviceDB, device)
-		}),
+			return Logout(req, userAPI, device)
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/logout/all",
 		httputil.MakeAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return LogoutAll(req, deviceDB, device)
-		}),
+			return LogoutAll(req, userAPI, device)
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
@@ -340,8 +384,17 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SendTyping(req, device, vars["roomID"], vars["userID"], accountDB, eduAPI, stateAPI)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/receipt/{receiptType}/{eventID}",
+		httputil.MakeAuthAPI("receipt", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SetReceipt(req, userAPI, eduAPI, rsAPI, device, vars["roomID"], vars["receiptType"], vars["eventID"])
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -360,7 +413,7 @@ func Setup(
 			}
 			txnID := vars["txnID"]
 			return SendToDevice(req, device, eduAPI, transactionsCache, vars["eventType"], &txnID)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	// This is only here because sytest refers to /unstable for this endpoint
@@ -374,23 +427,71 @@ func Setup(
 			}
 			txnID := vars["txnID"]
 			return SendToDevice(req, device, eduAPI, transactionsCache, vars["eventType"], &txnID)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/account/whoami",
 		httputil.MakeAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return Whoami(req, device)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/account/password",
+		httputil.MakeExternalAPI("password", func(req *http.Request) util.JSONResponse {
+			// Users who aren't logged in can reset their password by
+			// verifying their email address.
+			if _, err := auth.ExtractAccessToken(req); err != nil && passwordResetAuth != nil {
+				return Password(req, passwordResetAuth, userAPI, nil, cfg)
+			}
+			device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+			if resErr != nil {
+				return *resErr
+			}
+			if device.AccountType == userapi.AccountTypeGuest {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.GuestAccessForbidden("Guest access not allowed"),
+				}
+			}
+			return Password(req, userInteractiveAuth, userAPI, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/deactivate",
+		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Deactivate(req, userInteractiveAuth, userAPI, accountDB, rsAPI, stateAPI, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// Stub endpoints required by Riot
 
 	r0mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			return Login(req, accountDB, userAPI, cfg)
+			return Login(req, getAccountByPassword, accountDB.GetAccountByLocalpart, userAPI, cfg, loginTokens)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	if cfg.SSO.Enabled {
+		ssoProvider := NewSSOProvider(cfg)
+		r0mux.Handle("/login/sso/redirect",
+			httputil.MakeHTMLAPI("login_sso_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return SSORedirect(w, req, ssoProvider)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+
+		r0mux.Handle("/login/sso/callback",
+			httputil.MakeHTMLAPI("login_sso_callback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return SSOCallback(w, req, ssoProvider, accountDB, userAPI, loginTokens)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	r0mux.Handle("/refresh",
+		httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			return Refresh(req, userAPI, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
@@ -398,25 +499,94 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/pushers",
+		httputil.MakeAuthAPI("get_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetPushers(req, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		httputil.MakeAuthAPI("set_pusher", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SetPusher(req, device, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/pushrules/",
-		httputil.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAllPushRules(req, device, userAPI)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/",
+		httputil.MakeAuthAPI("push_rules_scope", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return GetPushRulesByScope(req, device, userAPI, vars["scope"])
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/",
+		httputil.MakeAuthAPI("push_rules_kind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByKind(req, device, userAPI, vars["scope"], vars["kind"])
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("get_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleByRuleID(req, device, userAPI, vars["scope"], vars["kind"], vars["ruleID"])
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("put_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleByRuleID(req, device, userAPI, syncProducer, vars["scope"], vars["kind"], vars["ruleID"])
 		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("delete_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByRuleID(req, device, userAPI, syncProducer, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("get_push_rule_attr", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleAttrByRuleID(req, device, userAPI, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("put_push_rule_attr", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttrByRuleID(req, device, userAPI, syncProducer, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
 	// Riot user settings
 
 	r0mux.Handle("/profile/{userID}",
@@ -468,7 +638,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SetDisplayName(req, accountDB, stateAPI, device, vars["userID"], cfg, rsAPI)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
 	// PUT requests, so we need to allow this method
@@ -481,7 +651,7 @@ func Setup(
 
 	r0mux.Handle("/account/3pid",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CheckAndSave3PIDAssociation(req, accountDB, device, cfg)
+			return CheckAndSave3PIDAssociation(req, accountDB, userAPI, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -491,27 +661,58 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
+	r0mux.Handle("/account/3pid/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, accountDB, cfg)
+			return RequestEmailToken(req, accountDB, userAPI, mailer, threepid.VerifyAddThreePID, requestTokenThrottles, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	// Riot logs get flooded unless this is handled
+	r0mux.Handle("/register/email/requestToken",
+		httputil.MakeExternalAPI("register_request_token", func(req *http.Request) util.JSONResponse {
+			return RequestEmailToken(req, accountDB, userAPI, mailer, threepid.VerifyRegistration, requestTokenThrottles, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/password/email/requestToken",
+		httputil.MakeExternalAPI("password_request_token", func(req *http.Request) util.JSONResponse {
+			return RequestEmailToken(req, accountDB, userAPI, mailer, threepid.VerifyPasswordReset, requestTokenThrottles, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	if cfg.Email.Enabled {
+		r0mux.Handle("/account/3pid/add",
+			httputil.MakeAuthAPI("account_3pid_add", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return Add3PID(req, userInteractiveAuth, accountDB, userAPI, device, cfg)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+
+		// This is threepid.SubmitTokenPath, which verification emails link to.
+		unstableMux.Handle("/email/submit_token",
+			httputil.MakeHTMLAPI("email_submit_token", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return SubmitEmailTokenHTML(w, req, userAPI)
+			}),
+		).Methods(http.MethodGet)
+		unstableMux.Handle("/email/submit_token",
+			httputil.MakeExternalAPI("email_submit_token", func(req *http.Request) util.JSONResponse {
+				return SubmitEmailToken(req, userAPI)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	r0mux.Handle("/presence/{userID}/status",
-		httputil.MakeExternalAPI("presence", func(req *http.Request) util.JSONResponse {
-			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct{}{},
+		httputil.MakeAuthAPI("set_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return SetPresence(req, device, vars["userID"], eduAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return RequestTurnServer(req, device, cfg)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/thirdparty/protocols",
@@ -524,16 +725,6 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/initialSync",
-		httputil.MakeExternalAPI("rooms_initial_sync", func(req *http.Request) util.JSONResponse {
-			// TODO: Allow people to peek into rooms.
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: jsonerror.GuestAccessForbidden("Guest access not implemented"),
-			}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/user/{userID}/account_data/{type}",
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -541,7 +732,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SaveAccountData(req, userAPI, device, vars["userID"], "", vars["type"], syncProducer)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
@@ -551,7 +742,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SaveAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/account_data/{type}",
@@ -561,7 +752,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return GetAccountData(req, userAPI, device, vars["userID"], "", vars["type"])
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet)
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
@@ -571,7 +762,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return GetAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"])
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet)
 
 	r0mux.Handle("/user_directory/search",
@@ -602,7 +793,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return GetMemberships(req, device, vars["roomID"], false, cfg, rsAPI)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/joined_members",
@@ -612,19 +803,38 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return GetMemberships(req, device, vars["roomID"], true, cfg, rsAPI)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/read_markers",
-		httputil.MakeExternalAPI("rooms_read_markers", func(req *http.Request) util.JSONResponse {
-			// TODO: return the read_markers.
-			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
-		}),
+		httputil.MakeAuthAPI("rooms_read_markers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SaveReadMarker(req, userAPI, eduAPI, rsAPI, syncProducer, device, vars["roomID"])
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/notifications",
+		httputil.MakeAuthAPI("get_notifications", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetNotifications(req, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/devices",
 		httputil.MakeAuthAPI("get_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetDevicesByLocalpart(req, deviceDB, device)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/admin/whois/{userID}",
+		httputil.MakeAuthAPI("admin_whois", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetAdminWhois(req, userAPI, device, vars["userID"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -635,7 +845,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return GetDeviceByID(req, deviceDB, device, vars["deviceID"])
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/devices/{deviceID}",
@@ -645,7 +855,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return UpdateDeviceByID(req, userAPI, device, vars["deviceID"])
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/devices/{deviceID}",
@@ -665,16 +875,6 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	// Stub implementations for sytest
-	r0mux.Handle("/events",
-		httputil.MakeExternalAPI("events", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
-				"chunk": []interface{}{},
-				"start": "",
-				"end":   "",
-			}}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/initialSync",
 		httputil.MakeExternalAPI("initial_sync", func(req *http.Request) util.JSONResponse {
 			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
@@ -716,28 +916,156 @@ func Setup(
 	r0mux.Handle("/capabilities",
 		httputil.MakeAuthAPI("capabilities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetCapabilities(req, rsAPI)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet)
 
 	// Supplying a device ID is deprecated.
 	r0mux.Handle("/keys/upload/{deviceID}",
 		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return UploadKeys(req, keyAPI, device)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/upload",
 		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return UploadKeys(req, keyAPI, device)
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/query",
 		httputil.MakeAuthAPI("keys_query", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return QueryKeys(req, keyAPI)
-		}),
+			return QueryKeys(req, keyAPI, device)
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/claim",
 		httputil.MakeAuthAPI("keys_claim", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return ClaimKeys(req, keyAPI)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/keys/device_signing/upload",
+		httputil.MakeAuthAPI("keys_device_signing_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningKeys(req, userInteractiveAuth, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/keys/signatures/upload",
+		httputil.MakeAuthAPI("keys_signatures_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningSignatures(req, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/keys/device_signing/upload",
+		httputil.MakeAuthAPI("keys_device_signing_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningKeys(req, userInteractiveAuth, keyAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/keys/signatures/upload",
+		httputil.MakeAuthAPI("keys_signatures_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningSignatures(req, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// Room key backups
+	r0mux.Handle("/room_keys/version",
+		httputil.MakeAuthAPI("create_room_keys_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return CreateKeyBackupVersion(req, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/room_keys/version",
+		httputil.MakeAuthAPI("get_room_keys_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return KeyBackupVersion(req, keyAPI, device, "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("get_room_keys_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KeyBackupVersion(req, keyAPI, device, vars["version"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("put_room_keys_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ModifyKeyBackupVersionAuthData(req, keyAPI, device, vars["version"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("delete_room_keys_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteKeyBackupVersion(req, keyAPI, device, vars["version"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys",
+		httputil.MakeAuthAPI("put_room_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadBackupKeys(req, keyAPI, device, "", "")
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys/{roomID}",
+		httputil.MakeAuthAPI("put_room_keys_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UploadBackupKeys(req, keyAPI, device, vars["roomID"], "")
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys/{roomID}/{sessionID}",
+		httputil.MakeAuthAPI("put_room_keys_room_session", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UploadBackupKeys(req, keyAPI, device, vars["roomID"], vars["sessionID"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys",
+		httputil.MakeAuthAPI("get_room_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetBackupKeys(req, keyAPI, device, "", "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys/{roomID}",
+		httputil.MakeAuthAPI("get_room_keys_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetBackupKeys(req, keyAPI, device, vars["roomID"], "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys/{roomID}/{sessionID}",
+		httputil.MakeAuthAPI("get_room_keys_room_session", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetBackupKeys(req, keyAPI, device, vars["roomID"], vars["sessionID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys",
+		httputil.MakeAuthAPI("delete_room_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return DeleteBackupKeys(req, keyAPI, device, "", "")
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys/{roomID}",
+		httputil.MakeAuthAPI("delete_room_keys_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteBackupKeys(req, keyAPI, device, vars["roomID"], "")
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+	r0mux.Handle("/room_keys/keys/{roomID}/{sessionID}",
+		httputil.MakeAuthAPI("delete_room_keys_room_session", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteBackupKeys(req, keyAPI, device, vars["roomID"], vars["sessionID"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
 }
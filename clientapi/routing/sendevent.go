@@ -47,6 +47,14 @@ func SendEvent(
 	rsAPI api.RoomserverInternalAPI,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
+	// Guests are only allowed to send messages.
+	if device.AccountType == userapi.AccountTypeGuest && eventType != "m.room.message" {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests can only send m.room.message events"),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -0,0 +1,42 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestSendEventGuestRestrictions(t *testing.T) {
+	device := &userapi.Device{UserID: "@1:localhost", ID: "device", AccountType: userapi.AccountTypeGuest}
+	emptyStateKey := ""
+	for _, eventType := range []string{"m.room.name", "m.room.power_levels", "m.reaction"} {
+		req := httptest.NewRequest(http.MethodPut, "/rooms/!room:localhost/state/"+eventType, strings.NewReader(`{}`))
+		// Guests are refused before the roomserver is asked anything.
+		res := SendEvent(req, device, "!room:localhost", eventType, nil, &emptyStateKey, nil, nil, nil)
+		if res.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want 403", eventType, res.Code)
+			continue
+		}
+		if errcode := res.JSON.(*jsonerror.MatrixError).ErrCode; errcode != "M_GUEST_ACCESS_FORBIDDEN" {
+			t.Errorf("%s: got errcode %s, want M_GUEST_ACCESS_FORBIDDEN", eventType, errcode)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+// ssoStateLifetime is how long the user has to log in at the provider before
+// the callback is rejected.
+const ssoStateLifetime = 10 * time.Minute
+
+// ssoStateCookie is the name of the cookie which ties a login to the browser
+// that started it. It holds a hash of the state parameter.
+const ssoStateCookie = "dendrite_sso_state"
+
+// ssoConfirmTemplate is an HTML template which asks the user whether they want
+// to log in to a client which isn't in sso.allowed_redirect_urls.
+const ssoConfirmTemplate = `
+<html>
+<head>
+<title>Continue to your client</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>You are about to log in to {{.host}}.</p>
+        <p>Only continue if you trust {{.host}} and you started logging in to it.</p>
+        <p><a href="{{.url}}">Continue</a></p>
+    </div>
+</body>
+</html>
+`
+
+// oidcConfiguration is the subset of the provider's discovery document that
+// is needed for the authorization code flow.
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcConfiguration struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+type ssoState struct {
+	redirectURL string
+	expires     time.Time
+}
+
+// SSOProvider talks to the OpenID Connect provider configured in sso.* and
+// remembers the logins which are in progress. The state of in-progress logins
+// is only held in memory, so the callback must arrive at the same client API
+// server that the login was started on.
+type SSOProvider struct {
+	cfg        *config.Dendrite
+	httpClient *http.Client
+	mu         sync.Mutex
+	discovered *oidcConfiguration
+	states     map[string]ssoState
+}
+
+// NewSSOProvider creates an SSOProvider for the given config. The provider's
+// endpoints are discovered when the first login is started.
+func NewSSOProvider(cfg *config.Dendrite) *SSOProvider {
+	return &SSOProvider{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		states:     make(map[string]ssoState),
+	}
+}
+
+// SSORedirect implements GET /login/sso/redirect, which sends the user to
+// the provider to log in. The provider sends them back to SSOCallback.
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-login-sso-redirect
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, provider *SSOProvider,
+) *util.JSONResponse {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing redirectUrl"),
+		}
+	}
+	if resErr := provider.checkRedirectURL(redirectURL); resErr != nil {
+		return resErr
+	}
+
+	oidc, err := provider.configuration(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.configuration failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	state, err := provider.newState(redirectURL)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.newState failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	authURL, err := url.Parse(oidc.AuthorizationEndpoint)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("url.Parse failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.cfg.SSO.ClientID)
+	query.Set("redirect_uri", provider.cfg.SSO.CallbackURL)
+	query.Set("scope", strings.Join(provider.cfg.SSO.Scopes, " "))
+	query.Set("state", state)
+	authURL.RawQuery = query.Encode()
+
+	// Otherwise someone could start a login themselves and get another user
+	// to complete it, logging that user in to the attacker's account.
+	http.SetCookie(w, provider.stateCookie(hashSSOState(state), int(ssoStateLifetime/time.Second)))
+	http.Redirect(w, req, authURL.String(), http.StatusFound)
+	return nil
+}
+
+// SSOCallback implements GET /login/sso/callback, which the provider sends
+// the user back to once they have logged in. An account is created for the
+// user if this is their first login, and the user is sent back to the client
+// with a login token that it can exchange for an access token with
+// m.login.token.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request, provider *SSOProvider,
+	accountDB accounts.Database, userAPI userapi.UserInternalAPI, loginTokens *auth.LoginTokens,
+) *util.JSONResponse {
+	query := req.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Single sign-on failed: " + errCode),
+		}
+	}
+	state := query.Get("state")
+	cookie, err := req.Cookie(ssoStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashSSOState(state))) != 1 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Single sign-on session was started in another browser"),
+		}
+	}
+	http.SetCookie(w, provider.stateCookie("", -1))
+	redirectURL, ok := provider.consumeState(state)
+	if !ok {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unknown or expired single sign-on session"),
+		}
+	}
+	code := query.Get("code")
+	if code == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing code"),
+		}
+	}
+
+	claims, err := provider.userinfo(req.Context(), code)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.userinfo failed")
+		return &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to get the user's details from the identity provider"),
+		}
+	}
+	localpart, resErr := ssoLocalpart(req.Context(), provider, accountDB, userAPI, claims)
+	if resErr != nil {
+		return resErr
+	}
+
+	loginToken, err := loginTokens.Issue(userutil.MakeUserID(localpart, provider.cfg.Matrix.ServerName))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("loginTokens.Issue failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	// The redirect URL was checked when the login was started.
+	clientURL, _ := url.Parse(redirectURL)
+	clientQuery := clientURL.Query()
+	clientQuery.Set("loginToken", loginToken)
+	clientURL.RawQuery = clientQuery.Encode()
+
+	if provider.redirectAllowed(clientURL) {
+		http.Redirect(w, req, clientURL.String(), http.StatusFound)
+		return nil
+	}
+	// Otherwise anyone could get a login token for the user sent to them by
+	// getting the user to follow a link, so the user has to confirm that
+	// they trust the client.
+	serveTemplate(w, ssoConfirmTemplate, map[string]string{
+		"host": clientURL.Host,
+		"url":  clientURL.String(),
+	})
+	return nil
+}
+
+// ssoLocalpart returns the localpart of the account that the user with the
+// given claims logs in as, creating an account for them if this is their first
+// login. Users are identified by the provider's "sub" claim, so they keep their
+// account even if the claim that the localpart came from changes.
+func ssoLocalpart(
+	ctx context.Context, provider *SSOProvider, accountDB accounts.Database,
+	userAPI userapi.UserInternalAPI, claims map[string]interface{},
+) (string, *util.JSONResponse) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		util.GetLogger(ctx).Warn("Identity provider didn't return a subject")
+		return "", &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("The identity provider didn't identify the user"),
+		}
+	}
+	issuer := provider.cfg.SSO.Issuer
+	localpart, err := accountDB.GetLocalpartForSSOID(ctx, issuer, subject)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForSSOID failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if localpart != "" {
+		return localpart, nil
+	}
+
+	claim, _ := claims[provider.cfg.SSO.LocalpartClaim].(string)
+	localpart = strings.ToLower(claim)
+	if resErr := validateUsername(localpart); resErr != nil {
+		util.GetLogger(ctx).WithField("claim", claim).Warn("Identity provider returned an invalid localpart")
+		return "", resErr
+	}
+	// Accounts which already exist are never logged into, as the provider
+	// doesn't prove that the user owns them.
+	var accRes userapi.PerformAccountCreationResponse
+	err = userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+		AccountType: userapi.AccountTypeUser,
+		Localpart:   localpart,
+		OnConflict:  userapi.ConflictAbort,
+	}, &accRes)
+	if err != nil {
+		if _, ok := err.(*userapi.ErrorConflict); ok {
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UserInUse("The username " + localpart + " is already taken by another account"),
+			}
+		}
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountCreation failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if err = accountDB.SaveSSOAssociation(ctx, issuer, subject, localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SaveSSOAssociation failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	return localpart, nil
+}
+
+// configuration returns the provider's endpoints, fetching its discovery
+// document if that hasn't been done yet.
+func (p *SSOProvider) configuration(ctx context.Context) (*oidcConfiguration, error) {
+	p.mu.Lock()
+	discovered := p.discovered
+	p.mu.Unlock()
+	if discovered != nil {
+		return discovered, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.cfg.SSO.Issuer, "/") + "/.well-known/openid-configuration"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var oidc oidcConfiguration
+	if err = p.doJSON(httpReq, &oidc); err != nil {
+		return nil, fmt.Errorf("failed to discover provider: %w", err)
+	}
+	if oidc.AuthorizationEndpoint == "" || oidc.TokenEndpoint == "" || oidc.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("provider at %q is missing required endpoints", p.cfg.SSO.Issuer)
+	}
+
+	p.mu.Lock()
+	p.discovered = &oidc
+	p.mu.Unlock()
+	return &oidc, nil
+}
+
+// userinfo exchanges the authorization code for an access token and uses it
+// to fetch the claims about the user. The claims come straight from the
+// provider over TLS, so the ID token doesn't need to be verified.
+func (p *SSOProvider) userinfo(ctx context.Context, code string) (map[string]interface{}, error) {
+	oidc, err := p.configuration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.SSO.CallbackURL)
+	form.Set("client_id", p.cfg.SSO.ClientID)
+	form.Set("client_secret", p.cfg.SSO.ClientSecret)
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPost, oidc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tokenRes oidcTokenResponse
+	if err = p.doJSON(tokenReq, &tokenRes); err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	if tokenRes.AccessToken == "" {
+		return nil, fmt.Errorf("provider didn't return an access token")
+	}
+
+	userinfoReq, err := http.NewRequestWithContext(ctx, http.MethodGet, oidc.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	userinfoReq.Header.Set("Authorization", "Bearer "+tokenRes.AccessToken)
+	claims := make(map[string]interface{})
+	if err = p.doJSON(userinfoReq, &claims); err != nil {
+		return nil, fmt.Errorf("failed to fetch userinfo: %w", err)
+	}
+	return claims, nil
+}
+
+// doJSON performs the request and decodes the JSON response into res.
+func (p *SSOProvider) doJSON(httpReq *http.Request, res interface{}) error {
+	httpReq.Header.Set("Accept", "application/json")
+	httpRes, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close() // nolint: errcheck
+	if httpRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned HTTP %d", httpReq.Method, httpReq.URL, httpRes.StatusCode)
+	}
+	return json.NewDecoder(httpRes.Body).Decode(res)
+}
+
+// checkRedirectURL returns an error response if users can't be sent back to
+// the given client URL after logging in.
+func (p *SSOProvider) checkRedirectURL(redirectURL string) *util.JSONResponse {
+	u, err := url.Parse(redirectURL)
+	if err != nil || !u.IsAbs() {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl must be an absolute URL"),
+		}
+	}
+	// Users are asked to confirm before being sent to web clients which
+	// aren't allowed, but that page can't link to other schemes safely.
+	if !p.redirectAllowed(u) && u.Scheme != "http" && u.Scheme != "https" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl is not an allowed client"),
+		}
+	}
+	return nil
+}
+
+// redirectAllowed returns whether users can be sent straight back to the
+// given client URL after logging in, i.e. whether it matches one of
+// sso.allowed_redirect_urls.
+func (p *SSOProvider) redirectAllowed(u *url.URL) bool {
+	for _, allowed := range p.cfg.SSO.AllowedRedirectURLs {
+		a, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(a.Scheme, u.Scheme) || !strings.EqualFold(a.Host, u.Host) {
+			continue
+		}
+		// Allowing /app mustn't allow /application.
+		if u.Path == a.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(a.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// stateCookie returns the cookie which holds the hash of the state parameter,
+// scoped to the callback. A negative maxAge deletes the cookie.
+func (p *SSOProvider) stateCookie(value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		// Lax still sends the cookie when the provider redirects the user
+		// back to the callback.
+		SameSite: http.SameSiteLaxMode,
+	}
+	if callbackURL, err := url.Parse(p.cfg.SSO.CallbackURL); err == nil {
+		if callbackURL.Path != "" {
+			cookie.Path = callbackURL.Path
+		}
+		cookie.Secure = callbackURL.Scheme == "https"
+	}
+	return cookie
+}
+
+// hashSSOState returns the hash of the state parameter which is kept in the
+// user's browser.
+func hashSSOState(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// newState returns a new state parameter for a login which will send the
+// user back to redirectURL once it is complete.
+func (p *SSOProvider) newState(redirectURL string) (string, error) {
+	state, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Tidy up any logins which were never completed.
+	for s, info := range p.states {
+		if now.After(info.expires) {
+			delete(p.states, s)
+		}
+	}
+	p.states[state] = ssoState{
+		redirectURL: redirectURL,
+		expires:     now.Add(ssoStateLifetime),
+	}
+	return state, nil
+}
+
+// consumeState returns the redirect URL of the login with the given state
+// parameter, or false if there is no such login or it has expired.
+func (p *SSOProvider) consumeState(state string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.states[state]
+	if !ok {
+		return "", false
+	}
+	delete(p.states, state)
+	if time.Now().After(info.expires) {
+		return "", false
+	}
+	return info.redirectURL, true
+}
@@ -0,0 +1,358 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+// ssoAccounts holds the accounts and single sign-on associations of the
+// server, and panics if anything else is called.
+type ssoAccounts struct {
+	accounts.Database
+	userapi.UserInternalAPI
+	accounts map[string]*userapi.Account
+	ssoIDs   map[string]string
+}
+
+func newSSOAccounts() *ssoAccounts {
+	return &ssoAccounts{
+		accounts: make(map[string]*userapi.Account),
+		ssoIDs:   make(map[string]string),
+	}
+}
+
+func (a *ssoAccounts) GetLocalpartForSSOID(ctx context.Context, issuer, subject string) (string, error) {
+	return a.ssoIDs[issuer+" "+subject], nil
+}
+
+func (a *ssoAccounts) SaveSSOAssociation(ctx context.Context, issuer, subject, localpart string) error {
+	if _, ok := a.ssoIDs[issuer+" "+subject]; ok {
+		return fmt.Errorf("%s is already associated with an account", subject)
+	}
+	a.ssoIDs[issuer+" "+subject] = localpart
+	return nil
+}
+
+func (a *ssoAccounts) GetAccountByLocalpart(ctx context.Context, localpart string) (*userapi.Account, error) {
+	acc, ok := a.accounts[localpart]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return acc, nil
+}
+
+func (a *ssoAccounts) PerformAccountCreation(
+	ctx context.Context, req *userapi.PerformAccountCreationRequest, res *userapi.PerformAccountCreationResponse,
+) error {
+	if _, ok := a.accounts[req.Localpart]; ok {
+		if req.OnConflict == userapi.ConflictAbort {
+			return &userapi.ErrorConflict{Message: "account exists"}
+		}
+		res.Account = a.accounts[req.Localpart]
+		return nil
+	}
+	a.accounts[req.Localpart] = &userapi.Account{
+		Localpart:   req.Localpart,
+		UserID:      "@" + req.Localpart + ":localhost",
+		AccountType: req.AccountType,
+	}
+	res.AccountCreated = true
+	res.Account = a.accounts[req.Localpart]
+	return nil
+}
+
+func (a *ssoAccounts) PerformDeviceCreation(
+	ctx context.Context, req *userapi.PerformDeviceCreationRequest, res *userapi.PerformDeviceCreationResponse,
+) error {
+	acc, ok := a.accounts[req.Localpart]
+	if !ok || acc.Deactivated {
+		return &userapi.ErrorForbidden{Message: "account is deactivated"}
+	}
+	res.DeviceCreated = true
+	res.Device = &userapi.Device{
+		ID:          "device",
+		UserID:      acc.UserID,
+		AccessToken: req.AccessToken,
+	}
+	return nil
+}
+
+// newFakeOIDCProvider starts an OpenID Connect provider which hands out the
+// given claims for each authorization code.
+func newFakeOIDCProvider(claims map[string]map[string]interface{}) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcConfiguration{
+			AuthorizationEndpoint: srv.URL + "/authorize",
+			TokenEndpoint:         srv.URL + "/token",
+			UserinfoEndpoint:      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		code := req.PostFormValue("code")
+		if _, ok := claims[code]; !ok || req.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(oidcTokenResponse{AccessToken: code, TokenType: "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		c, ok := claims[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(c)
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func newSSOTestConfig(issuer string) *config.Dendrite {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.SSO.Enabled = true
+	cfg.SSO.Issuer = issuer
+	cfg.SSO.ClientID = "dendrite"
+	cfg.SSO.ClientSecret = "secret"
+	cfg.SSO.Scopes = []string{"openid"}
+	cfg.SSO.LocalpartClaim = "preferred_username"
+	cfg.SSO.CallbackURL = "https://localhost/_matrix/client/r0/login/sso/callback"
+	cfg.SSO.AllowedRedirectURLs = []string{"https://app.example.com/web"}
+	return cfg
+}
+
+// startSSOLogin starts logging in with the given redirect URL, returning the
+// state parameter and the cookies that were set in the user's browser.
+func startSSOLogin(t *testing.T, provider *SSOProvider, redirectURL string) (string, []*http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/login/sso/redirect?redirectUrl="+url.QueryEscape(redirectURL), nil)
+	if resErr := SSORedirect(w, req, provider); resErr != nil {
+		t.Fatalf("SSORedirect returned %d: %+v", resErr.Code, resErr.JSON)
+	}
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("SSORedirect sent the user to an invalid URL: %s", err)
+	}
+	return authURL.Query().Get("state"), w.Result().Cookies()
+}
+
+// finishSSOLogin completes logging in from a browser with the given cookies,
+// returning the response to the callback.
+func finishSSOLogin(
+	provider *SSOProvider, accs *ssoAccounts, loginTokens *auth.LoginTokens,
+	state string, cookies []*http.Cookie, code string,
+) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/login/sso/callback?state="+state+"&code="+code, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if resErr := SSOCallback(w, req, provider, accs, accs, loginTokens); resErr != nil {
+		w.Code = resErr.Code
+		_ = json.NewEncoder(w.Body).Encode(resErr.JSON)
+	}
+	return w
+}
+
+// ssoLogin starts logging in with the given redirect URL and completes it with
+// the given authorization code, returning the response to the callback.
+func ssoLogin(
+	t *testing.T, provider *SSOProvider, accs *ssoAccounts, loginTokens *auth.LoginTokens,
+	redirectURL, code string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	state, cookies := startSSOLogin(t, provider, redirectURL)
+	return finishSSOLogin(provider, accs, loginTokens, state, cookies, code)
+}
+
+func TestSSOCallbackCreatesAccount(t *testing.T) {
+	srv := newFakeOIDCProvider(map[string]map[string]interface{}{
+		"first":  {"sub": "123", "preferred_username": "Alice"},
+		"second": {"sub": "123", "preferred_username": "alice_renamed"},
+	})
+	defer srv.Close()
+	cfg := newSSOTestConfig(srv.URL)
+	provider := NewSSOProvider(cfg)
+	accs := newSSOAccounts()
+	loginTokens := auth.NewLoginTokens()
+
+	w := ssoLogin(t, provider, accs, loginTokens, "https://app.example.com/web/", "first")
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d on first login, want 302: %s", w.Code, w.Body.String())
+	}
+	if _, ok := accs.accounts["alice"]; !ok {
+		t.Fatalf("no account was made on first login")
+	}
+	if localpart := accs.ssoIDs[srv.URL+" 123"]; localpart != "alice" {
+		t.Errorf("got SSO user associated with %q, want alice", localpart)
+	}
+	clientURL, _ := url.Parse(w.Header().Get("Location"))
+	loginToken := clientURL.Query().Get("loginToken")
+	if clientURL.Host != "app.example.com" || loginToken == "" {
+		t.Fatalf("got redirect to %s, want app.example.com with a login token", clientURL)
+	}
+
+	// The login token can be exchanged for an access token.
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"type":"m.login.token","token":"`+loginToken+`"}`))
+	res := Login(req, nil, accs.GetAccountByLocalpart, accs, cfg, loginTokens)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d logging in with the login token, want 200: %+v", res.Code, res.JSON)
+	}
+	if userID := res.JSON.(loginResponse).UserID; userID != "@alice:localhost" {
+		t.Errorf("logged in as %s, want @alice:localhost", userID)
+	}
+
+	// Later logins use the same account even if the claim that the localpart
+	// came from has changed.
+	w = ssoLogin(t, provider, accs, loginTokens, "https://app.example.com/web/", "second")
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d on second login, want 302: %s", w.Code, w.Body.String())
+	}
+	if len(accs.accounts) != 1 {
+		t.Errorf("got %d accounts after logging in again, want 1", len(accs.accounts))
+	}
+	clientURL, _ = url.Parse(w.Header().Get("Location"))
+	if userID, _ := loginTokens.Consume(clientURL.Query().Get("loginToken")); userID != "@alice:localhost" {
+		t.Errorf("got login token for %q, want @alice:localhost", userID)
+	}
+}
+
+func TestSSOCallbackDoesNotTakeOverAccounts(t *testing.T) {
+	srv := newFakeOIDCProvider(map[string]map[string]interface{}{
+		"code": {"sub": "456", "preferred_username": "bob"},
+	})
+	defer srv.Close()
+	provider := NewSSOProvider(newSSOTestConfig(srv.URL))
+	accs := newSSOAccounts()
+	accs.accounts["bob"] = &userapi.Account{Localpart: "bob", UserID: "@bob:localhost"}
+	loginTokens := auth.NewLoginTokens()
+
+	// Someone who can choose their username at the provider mustn't be able
+	// to log in to an existing account with the same name.
+	w := ssoLogin(t, provider, accs, loginTokens, "https://app.example.com/web/", "code")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d logging in as an existing user, want 400", w.Code)
+	}
+	var resErr jsonerror.MatrixError
+	if err := json.Unmarshal(w.Body.Bytes(), &resErr); err != nil || resErr.ErrCode != "M_USER_IN_USE" {
+		t.Errorf("got error %s, want M_USER_IN_USE", w.Body.String())
+	}
+	if w.Header().Get("Location") != "" {
+		t.Errorf("user was sent back to the client with %s", w.Header().Get("Location"))
+	}
+	if len(accs.ssoIDs) != 0 {
+		t.Errorf("SSO user was associated with an existing account: %v", accs.ssoIDs)
+	}
+}
+
+func TestSSORedirectURLs(t *testing.T) {
+	srv := newFakeOIDCProvider(map[string]map[string]interface{}{
+		"code": {"sub": "123", "preferred_username": "alice"},
+	})
+	defer srv.Close()
+	provider := NewSSOProvider(newSSOTestConfig(srv.URL))
+
+	// Clients which aren't allowed can't be used unless they're web clients.
+	for _, redirectURL := range []string{"/web", "evil://callback", "javascript:alert(1)"} {
+		req := httptest.NewRequest(http.MethodGet, "/login/sso/redirect?redirectUrl="+url.QueryEscape(redirectURL), nil)
+		if resErr := SSORedirect(httptest.NewRecorder(), req, provider); resErr == nil || resErr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %+v, want 400", redirectURL, resErr)
+		}
+	}
+
+	testCases := []struct {
+		RedirectURL string
+		WantAllowed bool
+	}{
+		{"https://app.example.com/web", true},
+		{"https://APP.example.com/web/#/home", true},
+		{"https://app.example.com/webapp", false},
+		{"https://app.example.com.evil.com/web", false},
+		{"http://app.example.com/web", false},
+		{"https://evil.com/web", false},
+	}
+	for _, tc := range testCases {
+		w := ssoLogin(t, provider, newSSOAccounts(), auth.NewLoginTokens(), tc.RedirectURL, "code")
+		if tc.WantAllowed {
+			if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), "loginToken=") {
+				t.Errorf("%s: got status %d redirecting to %q, want a redirect to the client", tc.RedirectURL, w.Code, w.Header().Get("Location"))
+			}
+			continue
+		}
+		// The user must confirm before being sent to the client.
+		if w.Header().Get("Location") != "" {
+			t.Errorf("%s: user was sent straight to %s", tc.RedirectURL, w.Header().Get("Location"))
+		}
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "loginToken=") {
+			t.Errorf("%s: got status %d and body %s, want a confirmation page", tc.RedirectURL, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSSOCallbackChecksBrowser(t *testing.T) {
+	srv := newFakeOIDCProvider(map[string]map[string]interface{}{
+		"attacker": {"sub": "666", "preferred_username": "mallory"},
+		"victim":   {"sub": "123", "preferred_username": "alice"},
+	})
+	defer srv.Close()
+	provider := NewSSOProvider(newSSOTestConfig(srv.URL))
+	accs := newSSOAccounts()
+	loginTokens := auth.NewLoginTokens()
+
+	attackerState, attackerCookies := startSSOLogin(t, provider, "https://app.example.com/web/")
+	if len(attackerCookies) != 1 || !attackerCookies[0].HttpOnly || attackerCookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("got cookies %+v, want one HttpOnly SameSite=Lax cookie", attackerCookies)
+	}
+	_, victimCookies := startSSOLogin(t, provider, "https://app.example.com/web/")
+
+	// The attacker's login can't be completed by a victim whose browser
+	// didn't start it, whether or not they have started a login of their own.
+	for _, cookies := range [][]*http.Cookie{nil, victimCookies} {
+		w := finishSSOLogin(provider, accs, loginTokens, attackerState, cookies, "attacker")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d completing a login started in another browser, want 400", w.Code)
+		}
+		if w.Header().Get("Location") != "" {
+			t.Errorf("user was sent to %s with a login started in another browser", w.Header().Get("Location"))
+		}
+	}
+	if len(accs.accounts) != 0 {
+		t.Errorf("got accounts %v, want none", accs.accounts)
+	}
+
+	// The browser which started the login can still complete it.
+	w := finishSSOLogin(provider, accs, loginTokens, attackerState, attackerCookies, "attacker")
+	if w.Code != http.StatusFound {
+		t.Errorf("got status %d completing a login in the browser which started it, want 302: %s", w.Code, w.Body.String())
+	}
+}
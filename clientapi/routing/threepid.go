@@ -15,8 +15,19 @@
 package routing
 
 import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -30,21 +41,130 @@ import (
 )
 
 type reqTokenResponse struct {
-	SID string `json:"sid"`
+	SID       string `json:"sid"`
+	SubmitURL string `json:"submit_url,omitempty"`
 }
 
 type threePIDsResponse struct {
 	ThreePIDs []authtypes.ThreePID `json:"threepids"`
 }
 
+type submitTokenRequest struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+// requestTokenWindow is the period over which requests to the requestToken
+// endpoints are counted for throttling.
+const requestTokenWindow = time.Hour
+
+// The number of requests to the requestToken endpoints which are allowed in
+// each requestTokenWindow, for each email address and each client IP.
+const (
+	requestTokenLimitPerAddress = 5
+	requestTokenLimitPerIP      = 20
+)
+
+// requestTokenThrottle limits how often something can request tokens, so that
+// the requestToken endpoints can't be used to flood an address with emails or
+// to find out which addresses belong to accounts.
+type requestTokenThrottle struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	requests map[string][]time.Time
+}
+
+func newRequestTokenThrottle(limit int, window time.Duration) *requestTokenThrottle {
+	return &requestTokenThrottle{
+		limit:    limit,
+		window:   window,
+		requests: make(map[string][]time.Time),
+	}
+}
+
+// allow records a request for the key, returning false and how long until
+// another request will be allowed if the key has reached its limit.
+func (t *requestTokenThrottle) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Tidy up the requests which have left the window.
+	for k, times := range t.requests {
+		i := 0
+		for i < len(times) && !now.Before(times[i].Add(t.window)) {
+			i++
+		}
+		if i == len(times) {
+			delete(t.requests, k)
+		} else {
+			t.requests[k] = times[i:]
+		}
+	}
+	times := t.requests[key]
+	if len(times) >= t.limit {
+		return false, times[0].Add(t.window).Sub(now)
+	}
+	t.requests[key] = append(times, now)
+	return true, 0
+}
+
+// requestTokenThrottles limits the requestToken endpoints for each email
+// address and each client IP.
+type requestTokenThrottles struct {
+	perAddress *requestTokenThrottle
+	perIP      *requestTokenThrottle
+}
+
+func newRequestTokenThrottles() *requestTokenThrottles {
+	return &requestTokenThrottles{
+		perAddress: newRequestTokenThrottle(requestTokenLimitPerAddress, requestTokenWindow),
+		perIP:      newRequestTokenThrottle(requestTokenLimitPerIP, requestTokenWindow),
+	}
+}
+
+// allow returns an error response if the request has to wait before asking
+// for another token to be sent to the address.
+func (t *requestTokenThrottles) allow(req *http.Request, address string) *util.JSONResponse {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	ok, retryAfter := t.perIP.allow(ip)
+	if ok {
+		ok, retryAfter = t.perAddress.allow(strings.ToLower(address))
+	}
+	if ok {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: jsonerror.LimitExceeded("Too many requests for tokens, please try again later", retryAfter.Milliseconds()),
+	}
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-register-email-requesttoken
+var validClientSecretRegex = regexp.MustCompile(`^[0-9a-zA-Z.=_-]{1,255}$`)
+
 // RequestEmailToken implements:
 //     POST /account/3pid/email/requestToken
 //     POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *config.Dendrite) util.JSONResponse {
+//     POST /account/password/email/requestToken
+// If mailer is nil then the identity server in the request sends the email,
+// otherwise this server sends it.
+func RequestEmailToken(
+	req *http.Request, accountDB accounts.Database, userAPI api.UserInternalAPI,
+	mailer *threepid.Mailer, kind threepid.VerificationKind, throttles *requestTokenThrottles,
+	cfg *config.Dendrite,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
+	if resErr := throttles.allow(req, body.Email); resErr != nil {
+		return *resErr
+	}
 
 	var resp reqTokenResponse
 	var err error
@@ -56,16 +176,26 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 		return jsonerror.InternalServerError()
 	}
 
-	if len(localpart) > 0 {
+	if kind == threepid.VerifyPasswordReset {
+		// The password can only be reset for an account that the 3PID
+		// belongs to.
+		if localpart == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.ThreePIDNotFound("Email address not found"),
+			}
+		}
+	} else if len(localpart) > 0 {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.MatrixError{
-				ErrCode: "M_THREEPID_IN_USE",
-				Err:     accounts.Err3PIDInUse.Error(),
-			},
+			JSON: jsonerror.ThreePIDInUse(accounts.Err3PIDInUse.Error()),
 		}
 	}
 
+	if mailer != nil {
+		return sendEmailToken(req, userAPI, mailer, kind, body, cfg)
+	}
+
 	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
@@ -83,35 +213,163 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 	}
 }
 
+// sendEmailToken creates a 3PID session for the email address in the request
+// and sends its token to the address, unless the client is retrying a request
+// that has already been sent.
+func sendEmailToken(
+	req *http.Request, userAPI api.UserInternalAPI, mailer *threepid.Mailer,
+	kind threepid.VerificationKind, body threepid.EmailAssociationRequest, cfg *config.Dendrite,
+) util.JSONResponse {
+	if !validClientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("client_secret must match " + validClientSecretRegex.String()),
+		}
+	}
+	// Only accept bare addresses, so that nothing can be smuggled into the
+	// headers of the email.
+	if addr, err := mail.ParseAddress(body.Email); err != nil || addr.Address != body.Email {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid email address"),
+		}
+	}
+	if body.NextLink != "" {
+		if u, err := url.Parse(body.NextLink); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("next_link must be an http or https URL"),
+			}
+		}
+	}
+
+	var res api.PerformThreePIDSessionCreationResponse
+	err := userAPI.PerformThreePIDSessionCreation(req.Context(), &api.PerformThreePIDSessionCreationRequest{
+		ClientSecret: body.Secret,
+		Medium:       "email",
+		Address:      body.Email,
+		NextLink:     body.NextLink,
+		SendAttempt:  body.SendAttempt,
+		LifetimeMS:   cfg.Email.TokenLifetime.Milliseconds(),
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformThreePIDSessionCreation failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Token != "" {
+		if err = mailer.SendVerification(kind, body.Email, res.SID, body.Secret, res.Token); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("mailer.SendVerification failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{
+			SID:       res.SID,
+			SubmitURL: mailer.SubmitURL(),
+		},
+	}
+}
+
+// SubmitEmailToken implements POST /_matrix/client/unstable/email/submit_token,
+// which is the submit_url returned by the requestToken endpoints.
+func SubmitEmailToken(req *http.Request, userAPI api.UserInternalAPI) util.JSONResponse {
+	var body submitTokenRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	var res api.PerformThreePIDSessionValidationResponse
+	if err := userAPI.PerformThreePIDSessionValidation(req.Context(), &api.PerformThreePIDSessionValidationRequest{
+		SID:          body.SID,
+		ClientSecret: body.ClientSecret,
+		Token:        body.Token,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformThreePIDSessionValidation failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Success bool `json:"success"`
+		}{res.Session != nil},
+	}
+}
+
+var submitTokenPage = template.Must(template.New("submit_token").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.}}</title></head>
+<body><p>{{.}}</p></body>
+</html>
+`))
+
+// SubmitEmailTokenHTML implements GET /_matrix/client/unstable/email/submit_token,
+// which is the link in verification emails. The user is sent on to the
+// session's next_link if it has one.
+func SubmitEmailTokenHTML(w http.ResponseWriter, req *http.Request, userAPI api.UserInternalAPI) *util.JSONResponse {
+	query := req.URL.Query()
+	var res api.PerformThreePIDSessionValidationResponse
+	if err := userAPI.PerformThreePIDSessionValidation(req.Context(), &api.PerformThreePIDSessionValidationRequest{
+		SID:          query.Get("sid"),
+		ClientSecret: query.Get("client_secret"),
+		Token:        query.Get("token"),
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformThreePIDSessionValidation failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	message := "Your email address has been verified. You can now return to your client."
+	code := http.StatusOK
+	if res.Session == nil {
+		message = "This link is invalid or has expired. Please ask your client to send a new one."
+		code = http.StatusBadRequest
+	} else if res.Session.NextLink != "" {
+		http.Redirect(w, req, res.Session.NextLink, http.StatusFound)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := submitTokenPage.Execute(w, message); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("submitTokenPage.Execute failed")
+	}
+	return nil
+}
+
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
-	req *http.Request, accountDB accounts.Database, device *api.Device,
+	req *http.Request, accountDB accounts.Database, userAPI api.UserInternalAPI, device *api.Device,
 	cfg *config.Dendrite,
 ) util.JSONResponse {
 	var body threepid.EmailAssociationCheckRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
+	if body.Bind && cfg.Email.Enabled {
+		// The session was validated by this server, so the identity server
+		// doesn't know about it.
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Binding to an identity server is not supported when this server verifies email addresses itself"),
+		}
+	}
 
 	// Check if the association has been validated
-	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
+	verified, address, medium, err := threepid.CheckCredentials(req.Context(), body.Creds, cfg, userAPI)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.NotTrusted(body.Creds.IDServer),
 		}
 	} else if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckAssociation failed")
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckCredentials failed")
 		return jsonerror.InternalServerError()
 	}
 
 	if !verified {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.MatrixError{
-				ErrCode: "M_THREEPID_AUTH_FAILED",
-				Err:     "Failed to auth 3pid",
-			},
+			JSON: jsonerror.ThreePIDAuthFailed("Failed to auth 3pid"),
 		}
 	}
 
@@ -140,6 +398,91 @@ func CheckAndSave3PIDAssociation(
 		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.SaveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
+	// The 3PID has been added, so the session can't be used again.
+	if err = threepid.ConsumeCredentials(req.Context(), body.Creds, cfg, userAPI); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.ConsumeCredentials failed")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+type add3PIDRequest struct {
+	ClientSecret string `json:"client_secret"`
+	SID          string `json:"sid"`
+}
+
+// Add3PID implements POST /account/3pid/add, which adds a 3PID that was
+// verified by this server to the user's account.
+func Add3PID(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, accountDB accounts.Database,
+	userAPI api.UserInternalAPI, device *api.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	var body add3PIDRequest
+	if err = json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot add a 3PID to another user's account"),
+		}
+	}
+
+	creds := threepid.Credentials{
+		SID:    body.SID,
+		Secret: body.ClientSecret,
+	}
+	verified, address, medium, err := threepid.CheckCredentials(ctx, creds, cfg, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("threepid.CheckCredentials failed")
+		return jsonerror.InternalServerError()
+	}
+	if !verified {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ThreePIDAuthFailed("Failed to auth 3pid"),
+		}
+	}
+
+	err = accountDB.SaveThreePIDAssociation(ctx, address, localpart, medium)
+	if err == accounts.Err3PIDInUse {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ThreePIDInUse(err.Error()),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+		return jsonerror.InternalServerError()
+	}
+	// The 3PID has been added, so the session can't be used again.
+	if err = threepid.ConsumeCredentials(ctx, creds, cfg, userAPI); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("threepid.ConsumeCredentials failed")
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -0,0 +1,88 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTokenThrottle(t *testing.T) {
+	throttle := newRequestTokenThrottle(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := throttle.allow("alice@example.com"); !ok {
+			t.Fatalf("request %d was throttled, want it allowed", i+1)
+		}
+	}
+	ok, retryAfter := throttle.allow("alice@example.com")
+	if ok {
+		t.Fatalf("a request over the limit was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Hour {
+		t.Errorf("got retry after %s, want it within the window", retryAfter)
+	}
+	if ok, _ = throttle.allow("bob@example.com"); !ok {
+		t.Errorf("a request for another key was throttled")
+	}
+
+	// Requests which have left the window no longer count.
+	throttle.requests["alice@example.com"] = []time.Time{
+		time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Minute),
+	}
+	if ok, _ = throttle.allow("alice@example.com"); !ok {
+		t.Errorf("a request was throttled by one that has left the window")
+	}
+}
+
+func TestRequestTokenThrottles(t *testing.T) {
+	throttles := newRequestTokenThrottles()
+	// request returns the status code of the error response, or 0 if the
+	// request is allowed.
+	request := func(remoteAddr, address string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if resErr := throttles.allow(req, address); resErr != nil {
+			return resErr.Code
+		}
+		return 0
+	}
+
+	// Each address can only be sent so many tokens, whichever clients ask
+	// for them and however the address is written.
+	for i := 0; i < requestTokenLimitPerAddress; i++ {
+		if code := request("10.0.0.1:1234", "alice@example.com"); code != 0 {
+			t.Fatalf("request %d for an address got status %d, want it allowed", i+1, code)
+		}
+	}
+	if code := request("10.0.0.2:1234", "Alice@Example.com"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d asking for too many tokens for an address, want 429", code)
+	}
+
+	// Each client can only ask for so many tokens, whichever addresses they
+	// are for.
+	for i := 0; i < requestTokenLimitPerIP; i++ {
+		if code := request("10.0.0.3:1234", time.Duration(i).String()+"@example.com"); code != 0 {
+			t.Fatalf("request %d from a client got status %d, want it allowed", i+1, code)
+		}
+	}
+	if code := request("10.0.0.3:5678", "carol@example.com"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d asking for too many tokens from a client, want 429", code)
+	}
+	if code := request("10.0.0.4:1234", "carol@example.com"); code != 0 {
+		t.Errorf("got status %d from another client, want it allowed", code)
+	}
+}
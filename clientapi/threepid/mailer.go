@@ -0,0 +1,182 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// SubmitTokenPath is the path of the endpoint which validates 3PID sessions
+// with the token that was sent to the address.
+const SubmitTokenPath = "/_matrix/client/unstable/email/submit_token"
+
+// VerificationKind is what a verification email is sent for, which decides
+// the template that is used.
+type VerificationKind string
+
+const (
+	// VerifyRegistration emails are sent to users who register with an email
+	// address.
+	VerifyRegistration VerificationKind = "registration"
+	// VerifyPasswordReset emails are sent to users who want to reset their
+	// password.
+	VerifyPasswordReset VerificationKind = "password_reset"
+	// VerifyAddThreePID emails are sent to users who want to add an email
+	// address to their account.
+	VerifyAddThreePID VerificationKind = "add_threepid"
+)
+
+// verificationEmail is the data that the templates are executed with.
+type verificationEmail struct {
+	ServerName gomatrixserverlib.ServerName
+	Address    string
+	Link       string
+	Token      string
+}
+
+// Mailer sends emails which verify that users own email addresses.
+type Mailer struct {
+	cfg        *config.Email
+	serverName gomatrixserverlib.ServerName
+	from       *mail.Address
+	templates  map[VerificationKind]*template.Template
+}
+
+// NewMailer creates a Mailer for the email config, loading any templates in
+// email.templates_path. Returns an error if the from address or a template
+// is invalid.
+func NewMailer(cfg *config.Dendrite) (*Mailer, error) {
+	from, err := mail.ParseAddress(cfg.Email.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email.from: %w", err)
+	}
+	m := &Mailer{
+		cfg:        &cfg.Email,
+		serverName: cfg.Matrix.ServerName,
+		from:       from,
+		templates:  make(map[VerificationKind]*template.Template),
+	}
+	for kind, text := range defaultTemplates {
+		if cfg.Email.TemplatesPath != "" {
+			path := filepath.Join(string(cfg.Email.TemplatesPath), string(kind)+".txt")
+			custom, readErr := ioutil.ReadFile(path)
+			if readErr == nil {
+				text = string(custom)
+			} else if !os.IsNotExist(readErr) {
+				return nil, readErr
+			}
+		}
+		if m.templates[kind], err = template.New(string(kind)).Parse(text); err != nil {
+			return nil, fmt.Errorf("invalid %s email template: %w", kind, err)
+		}
+	}
+	return m, nil
+}
+
+// SubmitURL returns the URL that clients can submit tokens to.
+func (m *Mailer) SubmitURL() string {
+	return strings.TrimSuffix(m.cfg.PublicBaseURL, "/") + SubmitTokenPath
+}
+
+// SendVerification sends an email to the address with a link that validates
+// the 3PID session when it is opened.
+func (m *Mailer) SendVerification(kind VerificationKind, address, sid, clientSecret, token string) error {
+	to, err := mail.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+	tmpl, ok := m.templates[kind]
+	if !ok {
+		return fmt.Errorf("unknown verification kind %q", kind)
+	}
+	query := url.Values{}
+	query.Set("sid", sid)
+	query.Set("client_secret", clientSecret)
+	query.Set("token", token)
+	data := verificationEmail{
+		ServerName: m.serverName,
+		Address:    to.Address,
+		Link:       m.SubmitURL() + "?" + query.Encode(),
+		Token:      token,
+	}
+
+	var subject, body bytes.Buffer
+	if err = tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err = tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+	msg, err := m.message(to, subject.String(), body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.cfg.SMTPUsername != "" {
+		host, _, splitErr := net.SplitHostPort(m.cfg.SMTPAddress)
+		if splitErr != nil {
+			return splitErr
+		}
+		auth = smtp.PlainAuth("", m.cfg.SMTPUsername, m.cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(m.cfg.SMTPAddress, auth, m.from.Address, []string{to.Address}, msg)
+}
+
+// message builds a plain text email with the given subject and body.
+func (m *Mailer) message(to *mail.Address, subject string, body []byte) ([]byte, error) {
+	messageID := make([]byte, 16)
+	if _, err := rand.Read(messageID); err != nil {
+		return nil, err
+	}
+	// Newlines in the subject would start a new header.
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(messageID), m.serverName)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&msg)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,173 @@
+package threepid
+
+import (
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+type sunkEmail struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// startSMTPSink starts an SMTP server which accepts a single email and sends
+// it to the returned channel.
+func startSMTPSink(t *testing.T) (string, <-chan sunkEmail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	emails := make(chan sunkEmail, 1)
+	go func() {
+		defer l.Close() // nolint: errcheck
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := textproto.NewConn(c)
+		defer conn.Close() // nolint: errcheck
+		var email sunkEmail
+		_ = conn.PrintfLine("220 localhost SMTP sink")
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "MAIL":
+				email.from = strings.TrimPrefix(line, "MAIL FROM:")
+				_ = conn.PrintfLine("250 OK")
+			case "RCPT":
+				email.to = append(email.to, strings.TrimPrefix(line, "RCPT TO:"))
+				_ = conn.PrintfLine("250 OK")
+			case "DATA":
+				_ = conn.PrintfLine("354 Go ahead")
+				if email.data, err = conn.ReadDotBytes(); err != nil {
+					return
+				}
+				_ = conn.PrintfLine("250 OK")
+				emails <- email
+			case "QUIT":
+				_ = conn.PrintfLine("221 Bye")
+				return
+			default:
+				_ = conn.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), emails
+}
+
+func newTestMailer(t *testing.T, smtpAddress string, templatesPath string) *Mailer {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "example.com"
+	cfg.Email = config.Email{
+		Enabled:       true,
+		SMTPAddress:   smtpAddress,
+		From:          "Dendrite <noreply@example.com>",
+		PublicBaseURL: "https://matrix.example.com/",
+		TemplatesPath: config.Path(templatesPath),
+	}
+	m, err := NewMailer(cfg)
+	if err != nil {
+		t.Fatalf("NewMailer failed: %s", err)
+	}
+	return m
+}
+
+func TestSendVerification(t *testing.T) {
+	addr, emails := startSMTPSink(t)
+	m := newTestMailer(t, addr, "")
+
+	if err := m.SendVerification(VerifyRegistration, "alice@example.org", "sid1", "secret+1", "token1"); err != nil {
+		t.Fatalf("SendVerification failed: %s", err)
+	}
+	email := <-emails
+	if email.from != "<noreply@example.com>" {
+		t.Errorf("Expected envelope sender %q, got %q", "<noreply@example.com>", email.from)
+	}
+	if len(email.to) != 1 || email.to[0] != "<alice@example.org>" {
+		t.Errorf("Expected envelope recipient %q, got %v", "<alice@example.org>", email.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(email.data)))
+	if err != nil {
+		t.Fatalf("Failed to parse email: %s", err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Verify your email address for example.com" {
+		t.Errorf("Unexpected subject %q", got)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("Failed to decode body: %s", err)
+	}
+	var link string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "https://") {
+			link = strings.TrimSpace(line)
+		}
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("Failed to parse link %q: %s", link, err)
+	}
+	if u.Host != "matrix.example.com" || u.Path != SubmitTokenPath {
+		t.Errorf("Unexpected link %q", link)
+	}
+	query := u.Query()
+	if query.Get("sid") != "sid1" || query.Get("client_secret") != "secret+1" || query.Get("token") != "token1" {
+		t.Errorf("Unexpected link query %v", query)
+	}
+}
+
+func TestSendVerificationCustomTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-templates")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	tmpl := `{{define "subject"}}Password reset
+for {{.Address}}{{end}}{{define "body"}}Your token is {{.Token}}{{end}}`
+	if err = ioutil.WriteFile(filepath.Join(dir, "password_reset.txt"), []byte(tmpl), 0600); err != nil {
+		t.Fatalf("Failed to write template: %s", err)
+	}
+
+	addr, emails := startSMTPSink(t)
+	m := newTestMailer(t, addr, dir)
+	if err = m.SendVerification(VerifyPasswordReset, "Bob <bob@example.org>", "sid1", "secret", "token1"); err != nil {
+		t.Fatalf("SendVerification failed: %s", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string((<-emails).data)))
+	if err != nil {
+		t.Fatalf("Failed to parse email: %s", err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Password reset for bob@example.org" {
+		t.Errorf("Unexpected subject %q", got)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("Failed to decode body: %s", err)
+	}
+	if strings.TrimSpace(string(body)) != "Your token is token1" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestSendVerificationRejectsBadAddress(t *testing.T) {
+	m := newTestMailer(t, "127.0.0.1:0", "")
+	if err := m.SendVerification(VerifyAddThreePID, "alice@example.org\r\nBcc: eve@example.org", "sid1", "secret", "token1"); err == nil {
+		t.Errorf("Expected an error for an address containing a header")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+// The default templates for verification emails. Each template must define
+// a "subject" and a "body" template, which are both executed with a
+// verificationEmail. They can be replaced by putting a file named after the
+// kind of email, e.g. registration.txt, in the directory set by
+// email.templates_path.
+var defaultTemplates = map[VerificationKind]string{
+	VerifyRegistration: `{{define "subject"}}Verify your email address for {{.ServerName}}{{end}}
+{{define "body"}}Hello,
+
+Someone used this email address to register an account on {{.ServerName}}.
+To continue registering, open the link below:
+
+{{.Link}}
+
+If this wasn't you, you can ignore this email.
+{{end}}`,
+
+	VerifyPasswordReset: `{{define "subject"}}Reset your password on {{.ServerName}}{{end}}
+{{define "body"}}Hello,
+
+Someone asked to reset the password of the account on {{.ServerName}} which
+this email address belongs to. To allow the password to be reset, open the
+link below:
+
+{{.Link}}
+
+If this wasn't you, you can ignore this email and your password will stay
+the same.
+{{end}}`,
+
+	VerifyAddThreePID: `{{define "subject"}}Verify your email address for {{.ServerName}}{{end}}
+{{define "body"}}Hello,
+
+Someone asked to add this email address to their account on {{.ServerName}}.
+To allow it to be added, open the link below:
+
+{{.Link}}
+
+If this wasn't you, you can ignore this email.
+{{end}}`,
+}
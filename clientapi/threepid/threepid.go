@@ -24,7 +24,10 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // EmailAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register-email-requesttoken
@@ -33,6 +36,7 @@ type EmailAssociationRequest struct {
 	Secret      string `json:"client_secret"`
 	Email       string `json:"email"`
 	SendAttempt int    `json:"send_attempt"`
+	NextLink    string `json:"next_link"`
 }
 
 // EmailAssociationCheckRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-3pid
@@ -138,6 +142,44 @@ func CheckAssociation(
 	return true, respBody.Address, respBody.Medium, nil
 }
 
+// CheckCredentials checks whether the 3PID session has been validated. If
+// this server sends verification emails itself then the session is looked up
+// in the user API, otherwise it is checked with CheckAssociation.
+// Returns the same values as CheckAssociation.
+func CheckCredentials(
+	ctx context.Context, creds Credentials, cfg *config.Dendrite, userAPI userapi.UserInternalAPI,
+) (bool, string, string, error) {
+	if !cfg.Email.Enabled {
+		return CheckAssociation(ctx, creds, cfg)
+	}
+	var res userapi.QueryThreePIDSessionResponse
+	if err := userAPI.QueryThreePIDSession(ctx, &userapi.QueryThreePIDSessionRequest{
+		SID:          creds.SID,
+		ClientSecret: creds.Secret,
+	}, &res); err != nil {
+		return false, "", "", err
+	}
+	if res.Session == nil || !res.Session.Validated() {
+		return false, "", "", nil
+	}
+	return true, res.Session.Address, res.Session.Medium, nil
+}
+
+// ConsumeCredentials removes the 3PID session once it has been used, e.g. to
+// reset a password or to add the 3PID to an account, so that it can't be used
+// again. Sessions on identity servers are left for them to expire.
+func ConsumeCredentials(
+	ctx context.Context, creds Credentials, cfg *config.Dendrite, userAPI userapi.UserInternalAPI,
+) error {
+	if !cfg.Email.Enabled {
+		return nil
+	}
+	return userAPI.PerformThreePIDSessionDeletion(ctx, &userapi.PerformThreePIDSessionDeletionRequest{
+		SID:          creds.SID,
+		ClientSecret: creds.Secret,
+	}, &userapi.PerformThreePIDSessionDeletionResponse{})
+}
+
 // PublishAssociation publishes a validated association between a third-party
 // identifier and a Matrix ID.
 // Returns an error if there was a problem sending the request or decoding the
@@ -174,6 +216,51 @@ func PublishAssociation(creds Credentials, userID string, cfg *config.Dendrite)
 	return nil
 }
 
+// Unbind removes the association between a third-party identifier and a Matrix
+// ID from an identity server. The request is signed with the server's key, so
+// that the identity server can check that it comes from the user's homeserver.
+// Returns an error if there was a problem sending the request, or if the
+// identity server responded with a non-OK status.
+func Unbind(
+	ctx context.Context, threePID authtypes.ThreePID, userID, idServer string, cfg *config.Dendrite,
+) error {
+	if err := isTrusted(idServer, cfg); err != nil {
+		return err
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, gomatrixserverlib.ServerName(idServer), "/_matrix/identity/api/v1/3pid/unbind",
+	)
+	if err := fedReq.SetContent(map[string]interface{}{
+		"mxid":     userID,
+		"threepid": threePID,
+	}); err != nil {
+		return err
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	request, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	// Identity servers are contacted directly rather than with server discovery.
+	request.URL.Scheme = "https"
+
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	// Error if the status isn't OK
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not unbind the association on the server %s", idServer)
+	}
+
+	return nil
+}
+
 // isTrusted checks if a given identity server is part of the list of trusted
 // identity servers in the configuration file.
 // Returns an error if the server isn't trusted.
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -39,6 +40,7 @@ var (
 	password      = flag.String("password", "", "Optional. The password to register with. If not specified, this account will be password-less.")
 	serverNameStr = flag.String("servername", "localhost", "The Matrix server domain which will form the domain part of the user ID.")
 	accessToken   = flag.String("token", "", "Optional. The desired access_token to have. If not specified, a random access_token will be made.")
+	isAdmin       = flag.Bool("admin", false, "Optional. Whether the account should be a server admin.")
 )
 
 func main() {
@@ -69,7 +71,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	_, err = accountDB.CreateAccount(context.Background(), *username, *password, "")
+	accountType := api.AccountTypeUser
+	if *isAdmin {
+		accountType = api.AccountTypeAdmin
+	}
+	_, err = accountDB.CreateAccount(context.Background(), *username, *password, "", accountType)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -87,7 +93,7 @@ func main() {
 	}
 
 	device, err := deviceDB.CreateDevice(
-		context.Background(), *username, nil, *accessToken, nil,
+		context.Background(), *username, nil, *accessToken, nil, "", 0, api.AccountTypeUser,
 	)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -142,7 +142,9 @@ func main() {
 	deviceDB := base.Base.CreateDeviceDB()
 	federation := createFederationClient(base)
 	keyAPI := keyserver.NewInternalAPI(base.Base.Cfg, federation, base.Base.KafkaProducer)
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil, keyAPI)
+	userSyncProducer := userapi.NewSyncProducer(base.Base.Cfg, base.Base.KafkaProducer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil, keyAPI, userSyncProducer)
+	base.Base.OnShutdown(userAPI.Stop)
 	keyAPI.SetUserAPI(userAPI)
 
 	serverKeyAPI := serverkeyapi.NewInternalAPI(
@@ -157,6 +159,7 @@ func main() {
 	rsAPI := roomserver.NewInternalAPI(
 		&base.Base, keyRing, federation,
 	)
+	userapi.StartConsumers(base.Base.Cfg, base.Base.KafkaConsumer, accountDB, rsAPI, userSyncProducer)
 	eduInputAPI := eduserver.NewInternalAPI(
 		&base.Base, cache.New(), userAPI,
 	)
@@ -191,7 +194,7 @@ func main() {
 		KeyAPI:                 keyAPI,
 		ExtPublicRoomsProvider: provider,
 	}
-	monolith.AddAllPublicRoutes(base.Base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.Base.PublicAPIMux, base.Base.SynapseAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.Base.BaseMux,
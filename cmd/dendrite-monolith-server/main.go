@@ -77,7 +77,9 @@ func main() {
 	}
 	keyRing := serverKeyAPI.KeyRing()
 	keyAPI := keyserver.NewInternalAPI(base.Cfg, federation, base.KafkaProducer)
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, keyAPI)
+	userSyncProducer := userapi.NewSyncProducer(base.Cfg, base.KafkaProducer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, keyAPI, userSyncProducer)
+	base.OnShutdown(userAPI.Stop)
 	keyAPI.SetUserAPI(userAPI)
 
 	rsImpl := roomserver.NewInternalAPI(
@@ -94,6 +96,7 @@ func main() {
 			Impl: rsAPI,
 		}
 	}
+	userapi.StartConsumers(base.Cfg, base.KafkaConsumer, accountDB, rsAPI, userSyncProducer)
 
 	eduInputAPI := eduserver.NewInternalAPI(
 		base, cache.New(), userAPI,
@@ -141,7 +144,7 @@ func main() {
 		UserAPI:             userAPI,
 		KeyAPI:              keyAPI,
 	}
-	monolith.AddAllPublicRoutes(base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.PublicAPIMux, base.SynapseAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.BaseMux,
@@ -27,9 +27,13 @@ func main() {
 	accountDB := base.CreateAccountsDB()
 	deviceDB := base.CreateDeviceDB()
 
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, base.KeyServerHTTPClient())
+	userSyncProducer := userapi.NewSyncProducer(base.Cfg, base.KafkaProducer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, base.KeyServerHTTPClient(), userSyncProducer)
+	base.OnShutdown(userAPI.Stop)
 
 	userapi.AddInternalRoutes(base.InternalAPIMux, userAPI)
 
+	userapi.StartConsumers(base.Cfg, base.KafkaConsumer, accountDB, base.RoomserverHTTPClient(), userSyncProducer)
+
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.UserAPI), string(base.Cfg.Listen.UserAPI))
 }
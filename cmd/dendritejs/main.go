@@ -176,6 +176,10 @@ func main() {
 	cfg.Database.E2EKey = "file:/idb/dendritejs_e2ekey.db"
 	cfg.Kafka.Topics.OutputTypingEvent = "output_typing_event"
 	cfg.Kafka.Topics.OutputSendToDeviceEvent = "output_send_to_device_event"
+	cfg.Kafka.Topics.OutputReceiptEvent = "output_receipt_event"
+	cfg.Kafka.Topics.OutputPresenceEvent = "output_presence_event"
+	cfg.Kafka.Topics.OutputNotificationData = "output_notification_data"
+	cfg.Kafka.Topics.OutputDevicesDeleted = "output_devices_deleted"
 	cfg.Kafka.Topics.OutputClientData = "output_client_data"
 	cfg.Kafka.Topics.OutputRoomEvent = "output_room_event"
 	cfg.Matrix.TrustedIDServers = []string{
@@ -197,7 +201,9 @@ func main() {
 	deviceDB := base.CreateDeviceDB()
 	federation := createFederationClient(cfg, node)
 	keyAPI := keyserver.NewInternalAPI(base.Cfg, federation, base.KafkaProducer)
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil, keyAPI)
+	userSyncProducer := userapi.NewSyncProducer(base.Cfg, base.KafkaProducer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil, keyAPI, userSyncProducer)
+	base.OnShutdown(userAPI.Stop)
 	keyAPI.SetUserAPI(userAPI)
 
 	fetcher := &libp2pKeyFetcher{}
@@ -210,6 +216,7 @@ func main() {
 
 	stateAPI := currentstateserver.NewInternalAPI(base.Cfg, base.KafkaConsumer)
 	rsAPI := roomserver.NewInternalAPI(base, keyRing, federation)
+	userapi.StartConsumers(base.Cfg, base.KafkaConsumer, accountDB, rsAPI, userSyncProducer)
 	eduInputAPI := eduserver.NewInternalAPI(base, cache.New(), userAPI)
 	asQuery := appservice.NewInternalAPI(
 		base, userAPI, rsAPI,
@@ -238,7 +245,7 @@ func main() {
 		//ServerKeyAPI:        serverKeyAPI,
 		ExtPublicRoomsProvider: p2pPublicRoomProvider,
 	}
-	monolith.AddAllPublicRoutes(base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.PublicAPIMux, base.SynapseAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.BaseMux,
@@ -37,6 +37,34 @@ type InputTypingEvent struct {
 	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
 }
 
+// InputReceiptEvent is an event for notifying the EDU server about a read receipt.
+type InputReceiptEvent struct {
+	// UserID of the user who sent the receipt.
+	UserID string `json:"user_id"`
+	// RoomID of the room that the receipt applies to.
+	RoomID string `json:"room_id"`
+	// EventID of the event that the receipt points at.
+	EventID string `json:"event_id"`
+	// Type of the receipt, e.g. "m.read".
+	Type string `json:"type"`
+	// Timestamp of when the receipt was sent.
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// InputPresenceEvent is an event for notifying the EDU server about a
+// change in the presence of a user.
+type InputPresenceEvent struct {
+	// UserID of the user whose presence has changed.
+	UserID string `json:"user_id"`
+	// Presence is one of "online", "unavailable" or "offline".
+	Presence string `json:"presence"`
+	// StatusMsg is the status message of the user. If nil then the
+	// existing status message, if any, is left unchanged.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// LastActiveTS is when the user was last active.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+}
+
 type InputSendToDeviceEvent struct {
 	UserID   string `json:"user_id"`
 	DeviceID string `json:"device_id"`
@@ -59,6 +87,22 @@ type InputSendToDeviceEventRequest struct {
 // InputSendToDeviceEventResponse is a response to InputSendToDeviceEventRequest
 type InputSendToDeviceEventResponse struct{}
 
+// InputReceiptEventRequest is a request to EDUServerInputAPI
+type InputReceiptEventRequest struct {
+	InputReceiptEvent InputReceiptEvent `json:"input_receipt_event"`
+}
+
+// InputReceiptEventResponse is a response to InputReceiptEventRequest
+type InputReceiptEventResponse struct{}
+
+// InputPresenceEventRequest is a request to EDUServerInputAPI
+type InputPresenceEventRequest struct {
+	InputPresenceEvent InputPresenceEvent `json:"input_presence_event"`
+}
+
+// InputPresenceEventResponse is a response to InputPresenceEventRequest
+type InputPresenceEventResponse struct{}
+
 // EDUServerInputAPI is used to write events to the typing server.
 type EDUServerInputAPI interface {
 	InputTypingEvent(
@@ -72,4 +116,16 @@ type EDUServerInputAPI interface {
 		request *InputSendToDeviceEventRequest,
 		response *InputSendToDeviceEventResponse,
 	) error
+
+	InputReceiptEvent(
+		ctx context.Context,
+		request *InputReceiptEventRequest,
+		response *InputReceiptEventResponse,
+	) error
+
+	InputPresenceEvent(
+		ctx context.Context,
+		request *InputPresenceEventRequest,
+		response *InputPresenceEventResponse,
+	) error
 }
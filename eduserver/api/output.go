@@ -49,3 +49,95 @@ type OutputSendToDeviceEvent struct {
 	DeviceID string `json:"device_id"`
 	gomatrixserverlib.SendToDeviceEvent
 }
+
+// OutputReceiptEvent is an entry in the receipt output kafka log.
+// This contains the user, room and event that the receipt relates to,
+// along with the type of the receipt and when it was sent.
+type OutputReceiptEvent struct {
+	UserID    string                      `json:"user_id"`
+	RoomID    string                      `json:"room_id"`
+	EventID   string                      `json:"event_id"`
+	Type      string                      `json:"type"`
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// ReceiptMRead is the content of an "m.read" receipt for a single event,
+// keyed by the user ID of each user that has read up to that event, as
+// sent to clients in the m.receipt event.
+type ReceiptMRead struct {
+	User map[string]ReceiptTS `json:"m.read"`
+}
+
+// ReceiptTS is the timestamp of a receipt sent to clients.
+type ReceiptTS struct {
+	TS gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+// FederationReceiptMRead is the content of the "m.read" receipts for a single
+// room, as sent over federation in the m.receipt EDU.
+type FederationReceiptMRead struct {
+	User map[string]FederationReceiptData `json:"m.read"`
+}
+
+// FederationReceiptData contains the event IDs and timestamp for a single
+// user's receipt in the m.receipt EDU.
+type FederationReceiptData struct {
+	Data     ReceiptTS `json:"data"`
+	EventIDs []string  `json:"event_ids"`
+}
+
+// The possible presence states of a user.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// OutputPresenceEvent is an entry in the presence output kafka log.
+// This contains the new presence state of a user.
+type OutputPresenceEvent struct {
+	UserID       string                      `json:"user_id"`
+	Presence     string                      `json:"presence"`
+	StatusMsg    *string                     `json:"status_msg,omitempty"`
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+}
+
+// PresenceContent is the content of an m.presence event, as sent to
+// clients in /sync and returned from the presence status API.
+type PresenceContent struct {
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+// FederationPresenceData is the content of the m.presence EDU.
+type FederationPresenceData struct {
+	Push []FederationPresenceUpdate `json:"push"`
+}
+
+// FederationPresenceUpdate is a single presence update in the m.presence EDU.
+type FederationPresenceUpdate struct {
+	UserID string `json:"user_id"`
+	PresenceContent
+}
+
+// ToPresenceContent converts the presence update into the content of an
+// m.presence event, working out how long ago the user was last active.
+func (e *OutputPresenceEvent) ToPresenceContent() PresenceContent {
+	content := PresenceContent{
+		Presence:        e.Presence,
+		CurrentlyActive: e.Presence == PresenceOnline,
+	}
+	if e.StatusMsg != nil && *e.StatusMsg != "" {
+		content.StatusMsg = e.StatusMsg
+	}
+	if e.LastActiveTS != 0 {
+		lastActiveAgo := time.Since(e.LastActiveTS.Time()).Milliseconds()
+		if lastActiveAgo < 0 {
+			lastActiveAgo = 0
+		}
+		content.LastActiveAgo = lastActiveAgo
+	}
+	return content
+}
@@ -43,6 +43,43 @@ func SendTyping(
 	return err
 }
 
+// SendReceipt sends a receipt event to EDU server
+func SendReceipt(
+	ctx context.Context,
+	eduAPI EDUServerInputAPI, userID, roomID, eventID, receiptType string,
+	timestamp gomatrixserverlib.Timestamp,
+) error {
+	request := InputReceiptEventRequest{
+		InputReceiptEvent: InputReceiptEvent{
+			UserID:    userID,
+			RoomID:    roomID,
+			EventID:   eventID,
+			Type:      receiptType,
+			Timestamp: timestamp,
+		},
+	}
+	response := InputReceiptEventResponse{}
+	return eduAPI.InputReceiptEvent(ctx, &request, &response)
+}
+
+// SetPresence sends a presence event to EDU server
+func SetPresence(
+	ctx context.Context,
+	eduAPI EDUServerInputAPI, userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) error {
+	request := InputPresenceEventRequest{
+		InputPresenceEvent: InputPresenceEvent{
+			UserID:       userID,
+			Presence:     presence,
+			StatusMsg:    statusMsg,
+			LastActiveTS: lastActiveTS,
+		},
+	}
+	response := InputPresenceEventResponse{}
+	return eduAPI.InputPresenceEvent(ctx, &request, &response)
+}
+
 // SendToDevice sends a typing event to EDU server
 func SendToDevice(
 	ctx context.Context, eduAPI EDUServerInputAPI, sender, userID, deviceID, eventType string,
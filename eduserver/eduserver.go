@@ -45,6 +45,8 @@ func NewInternalAPI(
 		Producer:                     base.KafkaProducer,
 		OutputTypingEventTopic:       string(base.Cfg.Kafka.Topics.OutputTypingEvent),
 		OutputSendToDeviceEventTopic: string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		OutputReceiptEventTopic:      string(base.Cfg.Kafka.Topics.OutputReceiptEvent),
+		OutputPresenceEventTopic:     string(base.Cfg.Kafka.Topics.OutputPresenceEvent),
 		ServerName:                   base.Cfg.Matrix.ServerName,
 	}
 }
@@ -37,6 +37,10 @@ type EDUServerInputAPI struct {
 	OutputTypingEventTopic string
 	// The kafka topic to output new send to device events to.
 	OutputSendToDeviceEventTopic string
+	// The kafka topic to output new receipt events to.
+	OutputReceiptEventTopic string
+	// The kafka topic to output new presence events to.
+	OutputPresenceEventTopic string
 	// kafka producer
 	Producer sarama.SyncProducer
 	// Internal user query API
@@ -65,7 +69,7 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	return t.sendTypingEvent(ite)
 }
 
-// InputTypingEvent implements api.EDUServerInputAPI
+// InputSendToDeviceEvent implements api.EDUServerInputAPI
 func (t *EDUServerInputAPI) InputSendToDeviceEvent(
 	ctx context.Context,
 	request *api.InputSendToDeviceEventRequest,
@@ -75,6 +79,71 @@ func (t *EDUServerInputAPI) InputSendToDeviceEvent(
 	return t.sendToDeviceEvent(ise)
 }
 
+// InputReceiptEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputReceiptEvent(
+	ctx context.Context,
+	request *api.InputReceiptEventRequest,
+	response *api.InputReceiptEventResponse,
+) error {
+	ire := &request.InputReceiptEvent
+	output := &api.OutputReceiptEvent{
+		UserID:    ire.UserID,
+		RoomID:    ire.RoomID,
+		EventID:   ire.EventID,
+		Type:      ire.Type,
+		Timestamp: ire.Timestamp,
+	}
+	js, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":  ire.RoomID,
+		"user_id":  ire.UserID,
+		"event_id": ire.EventID,
+		"type":     ire.Type,
+	}).Infof("Producing to topic '%s'", t.OutputReceiptEventTopic)
+
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputReceiptEventTopic,
+		Key:   sarama.StringEncoder(ire.RoomID),
+		Value: sarama.ByteEncoder(js),
+	}
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
+// InputPresenceEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	ipe := &request.InputPresenceEvent
+	output := &api.OutputPresenceEvent{
+		UserID:       ipe.UserID,
+		Presence:     ipe.Presence,
+		StatusMsg:    ipe.StatusMsg,
+		LastActiveTS: ipe.LastActiveTS,
+	}
+	js, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id":  ipe.UserID,
+		"presence": ipe.Presence,
+	}).Infof("Producing to topic '%s'", t.OutputPresenceEventTopic)
+
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputPresenceEventTopic,
+		Key:   sarama.StringEncoder(ipe.UserID),
+		Value: sarama.ByteEncoder(js),
+	}
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
 func (t *EDUServerInputAPI) sendTypingEvent(ite *api.InputTypingEvent) error {
 	ev := &api.TypingEvent{
 		Type:   gomatrixserverlib.MTyping,
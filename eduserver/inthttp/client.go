@@ -14,6 +14,8 @@ import (
 const (
 	EDUServerInputTypingEventPath       = "/eduserver/input"
 	EDUServerInputSendToDeviceEventPath = "/eduserver/sendToDevice"
+	EDUServerInputReceiptEventPath      = "/eduserver/receipt"
+	EDUServerInputPresenceEventPath     = "/eduserver/presence"
 )
 
 // NewEDUServerClient creates a EDUServerInputAPI implemented by talking to a HTTP POST API.
@@ -54,3 +56,29 @@ func (h *httpEDUServerInputAPI) InputSendToDeviceEvent(
 	apiURL := h.eduServerURL + EDUServerInputSendToDeviceEventPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// InputReceiptEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputReceiptEvent(
+	ctx context.Context,
+	request *api.InputReceiptEventRequest,
+	response *api.InputReceiptEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputReceiptEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputReceiptEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputPresenceEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputPresenceEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputPresenceEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
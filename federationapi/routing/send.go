@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
@@ -314,12 +315,107 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 			}
 		case gomatrixserverlib.MDeviceListUpdate:
 			t.processDeviceListUpdate(e)
+		case keyapi.MSigningKeyUpdate:
+			t.processSigningKeyUpdate(e)
+		case "m.receipt":
+			// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
+			payload := map[string]eduserverAPI.FederationReceiptMRead{}
+			if err := json.Unmarshal(e.Content, &payload); err != nil {
+				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal receipt event")
+				continue
+			}
+			for roomID, receipt := range payload {
+				for userID, mread := range receipt.User {
+					_, domain, err := gomatrixserverlib.SplitID('@', userID)
+					if err != nil {
+						util.GetLogger(t.context).WithError(err).Error("Failed to split domain from receipt event sender")
+						continue
+					}
+					if t.Origin != domain {
+						util.GetLogger(t.context).Warnf("Dropping receipt event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
+						continue
+					}
+					var membershipRes api.QueryMembershipForUserResponse
+					if err := t.rsAPI.QueryMembershipForUser(t.context, &api.QueryMembershipForUserRequest{
+						RoomID: roomID,
+						UserID: userID,
+					}, &membershipRes); err != nil {
+						util.GetLogger(t.context).WithError(err).Error("Failed to query membership of receipt event sender")
+						continue
+					}
+					if !membershipRes.IsInRoom {
+						util.GetLogger(t.context).Warnf("Dropping receipt event from %q who isn't joined to room %q", userID, roomID)
+						continue
+					}
+					if err := t.processReceiptEvent(userID, roomID, "m.read", mread.Data.TS, mread.EventIDs); err != nil {
+						util.GetLogger(t.context).WithError(err).WithFields(logrus.Fields{
+							"sender":  t.Origin,
+							"user_id": userID,
+							"room_id": roomID,
+						}).Error("Failed to send receipt event to edu server")
+						continue
+					}
+				}
+			}
+		case "m.presence":
+			// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+			var payload eduserverAPI.FederationPresenceData
+			if err := json.Unmarshal(e.Content, &payload); err != nil {
+				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal presence event")
+				continue
+			}
+			for _, update := range payload.Push {
+				if err := t.processPresenceUpdate(update); err != nil {
+					util.GetLogger(t.context).WithError(err).WithFields(logrus.Fields{
+						"sender":  t.Origin,
+						"user_id": update.UserID,
+					}).Error("Failed to send presence event to edu server")
+				}
+			}
 		default:
 			util.GetLogger(t.context).WithField("type", e.Type).Warn("unhandled edu")
 		}
 	}
 }
 
+// processReceiptEvent sends a receipt to the EDU server for each of the given event IDs.
+func (t *txnReq) processReceiptEvent(
+	userID, roomID, receiptType string,
+	timestamp gomatrixserverlib.Timestamp,
+	eventIDs []string,
+) error {
+	// store every event
+	for _, eventID := range eventIDs {
+		if err := eduserverAPI.SendReceipt(t.context, t.eduAPI, userID, roomID, eventID, receiptType, timestamp); err != nil {
+			return fmt.Errorf("unable to set receipt event: %w", err)
+		}
+	}
+	return nil
+}
+
+// processPresenceUpdate sends a presence update to the EDU server, as long as
+// the user belongs to the server that sent it.
+func (t *txnReq) processPresenceUpdate(update eduserverAPI.FederationPresenceUpdate) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', update.UserID)
+	if err != nil {
+		return fmt.Errorf("unable to split domain from presence event sender: %w", err)
+	}
+	if t.Origin != domain {
+		util.GetLogger(t.context).Warnf("Dropping presence event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
+		return nil
+	}
+	switch update.Presence {
+	case eduserverAPI.PresenceOnline, eduserverAPI.PresenceUnavailable, eduserverAPI.PresenceOffline:
+	default:
+		return fmt.Errorf("unknown presence %q", update.Presence)
+	}
+	lastActive := time.Now().Add(-time.Duration(update.LastActiveAgo) * time.Millisecond)
+	return eduserverAPI.SetPresence(
+		t.context, t.eduAPI, update.UserID, update.Presence, update.StatusMsg,
+		gomatrixserverlib.AsTimestamp(lastActive),
+	)
+}
+
 func (t *txnReq) processDeviceListUpdate(e gomatrixserverlib.EDU) {
 	var payload gomatrixserverlib.DeviceListUpdateEvent
 	if err := json.Unmarshal(e.Content, &payload); err != nil {
@@ -335,6 +431,32 @@ func (t *txnReq) processDeviceListUpdate(e gomatrixserverlib.EDU) {
 	}
 }
 
+func (t *txnReq) processSigningKeyUpdate(e gomatrixserverlib.EDU) {
+	var payload keyapi.CrossSigningKeyUpdate
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal signing key update event")
+		return
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', payload.UserID)
+	if err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to split domain from signing key update event")
+		return
+	}
+	if t.Origin != domain {
+		util.GetLogger(t.context).Warnf("Dropping signing key update event where user domain (%q) doesn't match origin (%q)", domain, t.Origin)
+		return
+	}
+	var uploadRes keyapi.PerformUploadDeviceKeysResponse
+	t.keyAPI.PerformUploadDeviceKeys(context.Background(), &keyapi.PerformUploadDeviceKeysRequest{
+		UserID:         payload.UserID,
+		MasterKey:      payload.MasterKey,
+		SelfSigningKey: payload.SelfSigningKey,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		util.GetLogger(t.context).WithError(uploadRes.Error).WithField("user_id", payload.UserID).Error("failed to PerformUploadDeviceKeys")
+	}
+}
+
 func (t *txnReq) processEvent(e gomatrixserverlib.Event, isInboundTxn bool) error {
 	prevEventIDs := e.PrevEventIDs()
 
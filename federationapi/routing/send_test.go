@@ -11,6 +11,7 @@ import (
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -57,6 +58,8 @@ func init() {
 type testEDUProducer struct {
 	// this producer keeps track of calls to InputTypingEvent
 	invocations []eduAPI.InputTypingEventRequest
+	// and to InputReceiptEvent
+	receipts []eduAPI.InputReceiptEventRequest
 }
 
 func (p *testEDUProducer) InputTypingEvent(
@@ -76,11 +79,43 @@ func (p *testEDUProducer) InputSendToDeviceEvent(
 	return nil
 }
 
+func (p *testEDUProducer) InputReceiptEvent(
+	ctx context.Context,
+	request *eduAPI.InputReceiptEventRequest,
+	response *eduAPI.InputReceiptEventResponse,
+) error {
+	p.receipts = append(p.receipts, *request)
+	return nil
+}
+
+func (p *testEDUProducer) InputPresenceEvent(
+	ctx context.Context,
+	request *eduAPI.InputPresenceEventRequest,
+	response *eduAPI.InputPresenceEventResponse,
+) error {
+	return nil
+}
+
+// testKeyAPI keeps track of calls to PerformUploadDeviceKeys, and panics if anything else is called.
+type testKeyAPI struct {
+	keyAPI.KeyInternalAPI
+	uploads []keyAPI.PerformUploadDeviceKeysRequest
+}
+
+func (k *testKeyAPI) PerformUploadDeviceKeys(
+	ctx context.Context,
+	request *keyAPI.PerformUploadDeviceKeysRequest,
+	response *keyAPI.PerformUploadDeviceKeysResponse,
+) {
+	k.uploads = append(k.uploads, *request)
+}
+
 type testRoomserverAPI struct {
 	inputRoomEvents           []api.InputRoomEvent
 	queryStateAfterEvents     func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
 	queryEventsByID           func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse
 	queryLatestEventsAndState func(*api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse
+	queryMembershipForUser    func(*api.QueryMembershipForUserRequest) api.QueryMembershipForUserResponse
 }
 
 func (t *testRoomserverAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSenderInternalAPI) {}
@@ -172,7 +207,11 @@ func (t *testRoomserverAPI) QueryMembershipForUser(
 	request *api.QueryMembershipForUserRequest,
 	response *api.QueryMembershipForUserResponse,
 ) error {
-	return fmt.Errorf("not implemented")
+	if t.queryMembershipForUser == nil {
+		return fmt.Errorf("not implemented")
+	}
+	*response = t.queryMembershipForUser(request)
+	return nil
 }
 
 func (t *testRoomserverAPI) QueryPublishedRooms(
@@ -201,6 +240,15 @@ func (t *testRoomserverAPI) QueryServerAllowedToSeeEvent(
 	return fmt.Errorf("not implemented")
 }
 
+// Query whether a local user is allowed to see each of a list of events
+func (t *testRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query missing events for a room from roomserver
 func (t *testRoomserverAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -678,3 +726,98 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	mustProcessTransaction(t, txn, nil)
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
+
+func TestTransactionSigningKeyUpdate(t *testing.T) {
+	masterKey := json.RawMessage(`{"user_id":"@alice:kaer.morhen","usage":["master"],"keys":{"ed25519:base64+master+public+key":"base64+master+public+key"}}`)
+	selfSigningKey := json.RawMessage(`{"user_id":"@alice:kaer.morhen","usage":["self_signing"],"keys":{"ed25519:base64+self+signing+public+key":"base64+self+signing+public+key"}}`)
+	mustMarshal := func(update keyAPI.CrossSigningKeyUpdate) []byte {
+		content, err := json.Marshal(update)
+		if err != nil {
+			t.Fatalf("failed to marshal signing key update: %s", err)
+		}
+		return content
+	}
+
+	keys := &testKeyAPI{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.keyAPI = keys
+	txn.EDUs = []gomatrixserverlib.EDU{
+		{
+			Type: keyAPI.MSigningKeyUpdate,
+			Content: mustMarshal(keyAPI.CrossSigningKeyUpdate{
+				UserID:         "@alice:kaer.morhen",
+				MasterKey:      masterKey,
+				SelfSigningKey: selfSigningKey,
+			}),
+		},
+		// servers can't update the keys of other servers' users
+		{
+			Type: keyAPI.MSigningKeyUpdate,
+			Content: mustMarshal(keyAPI.CrossSigningKeyUpdate{
+				UserID:    "@bob:white.orchard",
+				MasterKey: masterKey,
+			}),
+		},
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	want := []keyAPI.PerformUploadDeviceKeysRequest{
+		{
+			UserID:         "@alice:kaer.morhen",
+			MasterKey:      masterKey,
+			SelfSigningKey: selfSigningKey,
+		},
+	}
+	if !reflect.DeepEqual(keys.uploads, want) {
+		t.Errorf("got key uploads %+v, want %+v", keys.uploads, want)
+	}
+}
+
+func TestTransactionReceipts(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMembershipForUser: func(req *api.QueryMembershipForUserRequest) api.QueryMembershipForUserResponse {
+			return api.QueryMembershipForUserResponse{
+				IsInRoom: req.UserID == "@alice:kaer.morhen",
+			}
+		},
+	}
+	receipt := eduAPI.FederationReceiptData{
+		Data:     eduAPI.ReceiptTS{TS: 1234},
+		EventIDs: []string{"$event:kaer.morhen"},
+	}
+	content, err := json.Marshal(map[string]eduAPI.FederationReceiptMRead{
+		"!roomid:kaer.morhen": {
+			User: map[string]eduAPI.FederationReceiptData{
+				"@alice:kaer.morhen": receipt,
+				// bob isn't joined to the room
+				"@bob:kaer.morhen": receipt,
+				// servers can't send receipts for other servers' users
+				"@charlie:white.orchard": receipt,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal receipts: %s", err)
+	}
+
+	edus := &testEDUProducer{}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+	txn.eduAPI = edus
+	txn.EDUs = []gomatrixserverlib.EDU{{Type: "m.receipt", Content: content}}
+	mustProcessTransaction(t, txn, nil)
+
+	want := []eduAPI.InputReceiptEventRequest{
+		{
+			InputReceiptEvent: eduAPI.InputReceiptEvent{
+				UserID:    "@alice:kaer.morhen",
+				RoomID:    "!roomid:kaer.morhen",
+				EventID:   "$event:kaer.morhen",
+				Type:      "m.read",
+				Timestamp: 1234,
+			},
+		},
+	}
+	if !reflect.DeepEqual(edus.receipts, want) {
+		t.Errorf("got receipts %+v, want %+v", edus.receipts, want)
+	}
+}
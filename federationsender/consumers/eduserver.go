@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/Shopify/sarama"
+	stateapi "github.com/matrix-org/dendrite/currentstateserver/api"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
@@ -34,11 +35,16 @@ import (
 type OutputEDUConsumer struct {
 	typingConsumer       *internal.ContinualConsumer
 	sendToDeviceConsumer *internal.ContinualConsumer
+	receiptConsumer      *internal.ContinualConsumer
+	presenceConsumer     *internal.ContinualConsumer
 	db                   storage.Database
 	queues               *queue.OutgoingQueues
+	stateAPI             stateapi.CurrentStateInternalAPI
 	ServerName           gomatrixserverlib.ServerName
 	TypingTopic          string
 	SendToDeviceTopic    string
+	ReceiptTopic         string
+	PresenceTopic        string
 }
 
 // NewOutputEDUConsumer creates a new OutputEDUConsumer. Call Start() to begin consuming from EDU servers.
@@ -47,6 +53,7 @@ func NewOutputEDUConsumer(
 	kafkaConsumer sarama.Consumer,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	stateAPI stateapi.CurrentStateInternalAPI,
 ) *OutputEDUConsumer {
 	c := &OutputEDUConsumer{
 		typingConsumer: &internal.ContinualConsumer{
@@ -59,14 +66,29 @@ func NewOutputEDUConsumer(
 			Consumer:       kafkaConsumer,
 			PartitionStore: store,
 		},
+		receiptConsumer: &internal.ContinualConsumer{
+			Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: store,
+		},
+		presenceConsumer: &internal.ContinualConsumer{
+			Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: store,
+		},
 		queues:            queues,
+		stateAPI:          stateAPI,
 		db:                store,
 		ServerName:        cfg.Matrix.ServerName,
 		TypingTopic:       string(cfg.Kafka.Topics.OutputTypingEvent),
 		SendToDeviceTopic: string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		ReceiptTopic:      string(cfg.Kafka.Topics.OutputReceiptEvent),
+		PresenceTopic:     string(cfg.Kafka.Topics.OutputPresenceEvent),
 	}
 	c.typingConsumer.ProcessMessage = c.onTypingEvent
 	c.sendToDeviceConsumer.ProcessMessage = c.onSendToDeviceEvent
+	c.receiptConsumer.ProcessMessage = c.onReceiptEvent
+	c.presenceConsumer.ProcessMessage = c.onPresenceEvent
 
 	return c
 }
@@ -79,6 +101,12 @@ func (t *OutputEDUConsumer) Start() error {
 	if err := t.sendToDeviceConsumer.Start(); err != nil {
 		return fmt.Errorf("t.sendToDeviceConsumer.Start: %w", err)
 	}
+	if err := t.receiptConsumer.Start(); err != nil {
+		return fmt.Errorf("t.receiptConsumer.Start: %w", err)
+	}
+	if err := t.presenceConsumer.Start(); err != nil {
+		return fmt.Errorf("t.presenceConsumer.Start: %w", err)
+	}
 	return nil
 }
 
@@ -175,3 +203,123 @@ func (t *OutputEDUConsumer) onTypingEvent(msg *sarama.ConsumerMessage) error {
 
 	return t.queues.SendEDU(edu, t.ServerName, names)
 }
+
+// onReceiptEvent is called in response to a message received on the receipt
+// events topic from the EDU server.
+func (t *OutputEDUConsumer) onReceiptEvent(msg *sarama.ConsumerMessage) error {
+	// Extract the receipt event from msg.
+	var receipt api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &receipt); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected receipt)")
+		return nil
+	}
+
+	// only send receipt events which originated from us
+	_, receiptServerName, err := gomatrixserverlib.SplitID('@', receipt.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", receipt.UserID).Error("Failed to extract domain from receipt sender")
+		return nil
+	}
+	if receiptServerName != t.ServerName {
+		log.WithField("other_server", receiptServerName).Info("Suppressing receipt notif: originated elsewhere")
+		return nil
+	}
+
+	joined, err := t.db.GetJoinedHosts(context.TODO(), receipt.RoomID)
+	if err != nil {
+		return err
+	}
+
+	names := make([]gomatrixserverlib.ServerName, len(joined))
+	for i := range joined {
+		names[i] = joined[i].ServerName
+	}
+
+	content := map[string]api.FederationReceiptMRead{}
+	content[receipt.RoomID] = api.FederationReceiptMRead{
+		User: map[string]api.FederationReceiptData{
+			receipt.UserID: {
+				Data: api.ReceiptTS{
+					TS: receipt.Timestamp,
+				},
+				EventIDs: []string{receipt.EventID},
+			},
+		},
+	}
+
+	edu := &gomatrixserverlib.EDU{
+		Type:   "m.receipt",
+		Origin: string(t.ServerName),
+	}
+	if edu.Content, err = json.Marshal(content); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
+
+// onPresenceEvent is called in response to a message received on the presence
+// events topic from the EDU server.
+func (t *OutputEDUConsumer) onPresenceEvent(msg *sarama.ConsumerMessage) error {
+	// Extract the presence event from msg.
+	var presence api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &presence); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected presence)")
+		return nil
+	}
+
+	// only send presence events which originated from us
+	_, presenceServerName, err := gomatrixserverlib.SplitID('@', presence.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", presence.UserID).Error("Failed to extract domain from presence sender")
+		return nil
+	}
+	if presenceServerName != t.ServerName {
+		return nil
+	}
+
+	// only send presence to the servers of users who share a room with this user
+	var queryRes stateapi.QuerySharedUsersResponse
+	err = t.stateAPI.QuerySharedUsers(context.TODO(), &stateapi.QuerySharedUsersRequest{
+		UserID: presence.UserID,
+	}, &queryRes)
+	if err != nil {
+		log.WithError(err).WithField("user_id", presence.UserID).Error("Failed to QuerySharedUsers for presence")
+		return nil
+	}
+	destinations := map[gomatrixserverlib.ServerName]struct{}{}
+	for userID := range queryRes.UserIDsToCount {
+		_, serverName, serr := gomatrixserverlib.SplitID('@', userID)
+		if serr != nil || serverName == t.ServerName {
+			continue
+		}
+		destinations[serverName] = struct{}{}
+	}
+	if len(destinations) == 0 {
+		return nil
+	}
+	names := make([]gomatrixserverlib.ServerName, 0, len(destinations))
+	for serverName := range destinations {
+		names = append(names, serverName)
+	}
+
+	edu := &gomatrixserverlib.EDU{
+		Type:   "m.presence",
+		Origin: string(t.ServerName),
+	}
+	content := api.FederationPresenceData{
+		Push: []api.FederationPresenceUpdate{
+			{
+				UserID:          presence.UserID,
+				PresenceContent: presence.ToPresenceContent(),
+			},
+		},
+	}
+	if edu.Content, err = json.Marshal(content); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
@@ -90,6 +90,9 @@ func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 	if originServerName != t.serverName {
 		return nil
 	}
+	if m.Type == api.TypeCrossSigningUpdate && m.CrossSigningKeyUpdate == nil {
+		return nil // only the user's own devices need to know about this change
+	}
 
 	var queryRes stateapi.QueryRoomsForUserResponse
 	err = t.stateAPI.QueryRoomsForUser(context.Background(), &stateapi.QueryRoomsForUserRequest{
@@ -112,20 +115,26 @@ func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		Type:   gomatrixserverlib.MDeviceListUpdate,
 		Origin: string(t.serverName),
 	}
-	event := gomatrixserverlib.DeviceListUpdateEvent{
-		UserID:            m.UserID,
-		DeviceID:          m.DeviceID,
-		DeviceDisplayName: m.DisplayName,
-		StreamID:          m.StreamID,
-		PrevID:            prevID(m.StreamID),
-		Deleted:           len(m.KeyJSON) == 0,
-		Keys:              m.KeyJSON,
+	switch m.Type {
+	case api.TypeCrossSigningUpdate:
+		edu.Type = api.MSigningKeyUpdate
+		edu.Content, err = json.Marshal(m.CrossSigningKeyUpdate)
+	default:
+		edu.Content, err = json.Marshal(gomatrixserverlib.DeviceListUpdateEvent{
+			UserID:            m.UserID,
+			DeviceID:          m.DeviceID,
+			DeviceDisplayName: m.DisplayName,
+			StreamID:          m.StreamID,
+			PrevID:            prevID(m.StreamID),
+			Deleted:           len(m.KeyJSON) == 0,
+			Keys:              m.KeyJSON,
+		})
 	}
-	if edu.Content, err = json.Marshal(event); err != nil {
+	if err != nil {
 		return err
 	}
 
-	log.Infof("Sending device list update message to %q", destinations)
+	log.Infof("Sending %s message to %q", edu.Type, destinations)
 	return t.queues.SendEDU(edu, t.serverName, destinations)
 }
 
@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -99,6 +101,19 @@ type Dendrite struct {
 		// If set disables new users from registering (except via shared
 		// secrets)
 		RegistrationDisabled bool `yaml:"registration_disabled"`
+		// How long access tokens are valid for before the client has to use
+		// its refresh token to get a new one. If not set, or set to 0, access
+		// tokens never expire and no refresh tokens are issued.
+		AccessTokenLifetime time.Duration `yaml:"access_token_lifetime"`
+		// The IP addresses or CIDR ranges of the reverse proxies in front of
+		// the client API. The address of a client whose request comes through
+		// one of these proxies is taken from the X-Forwarded-For or X-Real-IP
+		// header set by the proxy. Those headers are ignored on requests from
+		// any other address, as they could be set by anyone.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// Check passwords against an LDAP directory rather than the accounts
+		// database
+		LDAP LDAP `yaml:"ldap"`
 		// Perspective keyservers, to use as a backup when direct key fetch
 		// requests don't succeed
 		KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
@@ -161,6 +176,14 @@ type Dendrite struct {
 			OutputSendToDeviceEvent Topic `yaml:"output_send_to_device_event"`
 			// Topic for keyserver when new device keys are added.
 			OutputKeyChangeEvent Topic `yaml:"output_key_change_event"`
+			// Topic for eduserver/api.OutputReceiptEvent events.
+			OutputReceiptEvent Topic `yaml:"output_receipt_event"`
+			// Topic for eduserver/api.OutputPresenceEvent events.
+			OutputPresenceEvent Topic `yaml:"output_presence_event"`
+			// Topic for userapi/api.OutputNotificationData events.
+			OutputNotificationData Topic `yaml:"output_notification_data"`
+			// Topic for userapi/api.OutputDevicesDeleted events.
+			OutputDevicesDeleted Topic `yaml:"output_devices_deleted"`
 		}
 	} `yaml:"kafka"`
 
@@ -226,6 +249,37 @@ type Dendrite struct {
 		Password string `yaml:"turn_password"`
 	} `yaml:"turn"`
 
+	// Single sign-on via an OpenID Connect provider
+	SSO struct {
+		// Whether or not users can log in with m.login.sso and m.login.token
+		Enabled bool `yaml:"enabled"`
+		// The URL of the OpenID Connect provider, which is used to discover
+		// its endpoints at {issuer}/.well-known/openid-configuration
+		Issuer string `yaml:"issuer"`
+		// The client ID and secret that this server is registered with at
+		// the provider
+		ClientID     string `yaml:"client_id"`
+		ClientSecret string `yaml:"client_secret"`
+		// The scopes to request from the provider.
+		// Defaults to ["openid", "profile"].
+		Scopes []string `yaml:"scopes"`
+		// The userinfo claim that is used as the localpart of the user.
+		// Defaults to "preferred_username".
+		LocalpartClaim string `yaml:"localpart_claim"`
+		// The public URL of /_matrix/client/r0/login/sso/callback on this
+		// server, which must be registered with the provider as a redirect URI
+		CallbackURL string `yaml:"callback_url"`
+		// The client URLs which users are sent back to straight after logging
+		// in. A redirectUrl matches if it has the same scheme and host as one
+		// of these, and its path is the same as or under the path of it.
+		// Users are asked to confirm before being sent to any other http or
+		// https URL, and other URLs are rejected.
+		AllowedRedirectURLs []string `yaml:"allowed_redirect_urls"`
+	} `yaml:"sso"`
+
+	// Sending emails to verify third party identifiers
+	Email Email `yaml:"email"`
+
 	// The internal addresses the components will listen on.
 	// These should not be exposed externally as they expose metrics and debugging APIs.
 	// Falls back to addresses listed in Listen if not specified
@@ -317,6 +371,9 @@ type Dendrite struct {
 		ExclusiveApplicationServicesAliasRegexp *regexp.Regexp
 		// Note: An Exclusive Regex for room ID isn't necessary as we aren't blocking
 		// servers from creating RoomIDs in exclusive application service namespaces
+
+		// The networks of the trusted proxies given in matrix.trusted_proxies
+		TrustedProxies []*net.IPNet
 	} `yaml:"-"`
 }
 
@@ -335,6 +392,58 @@ type KeyPerspectives []struct {
 	} `yaml:"keys"`
 }
 
+// LDAP is used to configure checking passwords against an LDAP directory.
+// Users are looked up with a search for uid_attribute=localpart under base_dn
+// and are then authenticated by binding as the entry that was found.
+type LDAP struct {
+	// Whether or not passwords are checked against the directory
+	Enabled bool `yaml:"enabled"`
+	// The URI of the directory server, e.g. ldaps://ldap.example.com:636
+	URI string `yaml:"uri"`
+	// Whether to upgrade a plain ldap:// connection with StartTLS
+	StartTLS bool `yaml:"start_tls"`
+	// The DN and password to bind as when searching for users. If empty,
+	// the search is done anonymously.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	// The DN to search for users under
+	BaseDN string `yaml:"base_dn"`
+	// An optional extra filter that users must match, e.g. (objectClass=person)
+	Filter string `yaml:"filter"`
+	// The attribute which holds the localpart of the user. Defaults to "uid".
+	UIDAttribute string `yaml:"uid_attribute"`
+	// The attribute which is used as the display name of the user when their
+	// account is created on their first login. Defaults to "cn".
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+	// Whether users who aren't in the directory can log in with a password
+	// from the accounts database instead, e.g. for bots.
+	AllowLocalAccounts bool `yaml:"allow_local_accounts"`
+}
+
+// Email is used to configure sending emails to verify that users own the
+// email addresses which they add to their accounts, rather than asking an
+// identity server to do so.
+type Email struct {
+	// Whether or not this server sends verification emails itself
+	Enabled bool `yaml:"enabled"`
+	// The host:port of the SMTP server to send emails through
+	SMTPAddress string `yaml:"smtp_address"`
+	// The username and password to authenticate to the SMTP server with.
+	// If empty, no authentication is done.
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address emails are sent from, e.g. "Dendrite <noreply@example.com>"
+	From string `yaml:"from"`
+	// The public URL of this server, which is used in the links in emails,
+	// e.g. "https://matrix.example.com"
+	PublicBaseURL string `yaml:"public_base_url"`
+	// An optional directory containing templates which replace the default
+	// ones. See clientapi/threepid/templates.go for the available templates.
+	TemplatesPath Path `yaml:"templates_path"`
+	// How long verification links are valid for. Defaults to 24h.
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
 // A Path on the filesystem.
 type Path string
 
@@ -456,7 +565,6 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
 	if config.Matrix.RecaptchaEnabled {
@@ -468,6 +576,26 @@ func (config *Dendrite) Derive() error {
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
 
+	// Users can also register by verifying an email address, which is then
+	// added to their account.
+	if config.Email.Enabled {
+		stages := []authtypes.LoginType{authtypes.LoginTypeEmail}
+		if config.Matrix.RecaptchaEnabled {
+			stages = []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeEmail}
+		}
+		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+			authtypes.Flow{Stages: stages})
+	}
+
+	// Parse the trusted proxies once rather than for every request
+	for _, proxy := range config.Matrix.TrustedProxies {
+		network, err := parseIPNet(proxy)
+		if err != nil {
+			return err
+		}
+		config.Derived.TrustedProxies = append(config.Derived.TrustedProxies, network)
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(config); err != nil {
 		return err
@@ -490,6 +618,26 @@ func (config *Dendrite) SetDefaults() {
 		config.Matrix.FederationMaxRetries = 16
 	}
 
+	if config.Matrix.LDAP.UIDAttribute == "" {
+		config.Matrix.LDAP.UIDAttribute = "uid"
+	}
+
+	if config.Matrix.LDAP.DisplayNameAttribute == "" {
+		config.Matrix.LDAP.DisplayNameAttribute = "cn"
+	}
+
+	if len(config.SSO.Scopes) == 0 {
+		config.SSO.Scopes = []string{"openid", "profile"}
+	}
+
+	if config.SSO.LocalpartClaim == "" {
+		config.SSO.LocalpartClaim = "preferred_username"
+	}
+
+	if config.Email.TokenLifetime == 0 {
+		config.Email.TokenLifetime = 24 * time.Hour
+	}
+
 	if config.Media.MaxThumbnailGenerators == 0 {
 		config.Media.MaxThumbnailGenerators = 10
 	}
@@ -563,11 +711,47 @@ func (config *Dendrite) checkTurn(configErrs *configErrors) {
 	}
 }
 
+// checkSSO verifies the parameters sso.* are valid.
+func (config *Dendrite) checkSSO(configErrs *configErrors) {
+	if !config.SSO.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "sso.issuer", config.SSO.Issuer)
+	checkNotEmpty(configErrs, "sso.client_id", config.SSO.ClientID)
+	checkNotEmpty(configErrs, "sso.callback_url", config.SSO.CallbackURL)
+	for _, allowed := range config.SSO.AllowedRedirectURLs {
+		if u, err := url.Parse(allowed); err != nil || !u.IsAbs() {
+			configErrs.Add(fmt.Sprintf("invalid URL for config key %q: %s", "sso.allowed_redirect_urls", allowed))
+		}
+	}
+}
+
+// checkEmail verifies the parameters email.* are valid.
+func (config *Dendrite) checkEmail(configErrs *configErrors) {
+	if !config.Email.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "email.smtp_address", config.Email.SMTPAddress)
+	checkNotEmpty(configErrs, "email.from", config.Email.From)
+	checkNotEmpty(configErrs, "email.public_base_url", config.Email.PublicBaseURL)
+	checkPositive(configErrs, "email.token_lifetime", int64(config.Email.TokenLifetime))
+}
+
 // checkMatrix verifies the parameters matrix.* are valid.
 func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "matrix.server_name", string(config.Matrix.ServerName))
 	checkNotEmpty(configErrs, "matrix.private_key", string(config.Matrix.PrivateKeyPath))
 	checkNotZero(configErrs, "matrix.federation_certificates", int64(len(config.Matrix.FederationCertificatePaths)))
+	checkPositive(configErrs, "matrix.access_token_lifetime", int64(config.Matrix.AccessTokenLifetime))
+	for _, proxy := range config.Matrix.TrustedProxies {
+		if _, err := parseIPNet(proxy); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid IP address or CIDR range for config key %q: %s", "matrix.trusted_proxies", proxy))
+		}
+	}
+	if config.Matrix.LDAP.Enabled {
+		checkNotEmpty(configErrs, "matrix.ldap.uri", config.Matrix.LDAP.URI)
+		checkNotEmpty(configErrs, "matrix.ldap.base_dn", config.Matrix.LDAP.BaseDN)
+	}
 	if config.Matrix.RecaptchaEnabled {
 		checkNotEmpty(configErrs, "matrix.recaptcha_public_key", string(config.Matrix.RecaptchaPublicKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
@@ -607,6 +791,10 @@ func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
 	checkNotEmpty(configErrs, "kafka.topics.output_typing_event", string(config.Kafka.Topics.OutputTypingEvent))
 	checkNotEmpty(configErrs, "kafka.topics.output_send_to_device_event", string(config.Kafka.Topics.OutputSendToDeviceEvent))
 	checkNotEmpty(configErrs, "kafka.topics.output_key_change_event", string(config.Kafka.Topics.OutputKeyChangeEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_receipt_event", string(config.Kafka.Topics.OutputReceiptEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_presence_event", string(config.Kafka.Topics.OutputPresenceEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_notification_data", string(config.Kafka.Topics.OutputNotificationData))
+	checkNotEmpty(configErrs, "kafka.topics.output_devices_deleted", string(config.Kafka.Topics.OutputDevicesDeleted))
 }
 
 // checkDatabase verifies the parameters database.* are valid.
@@ -658,6 +846,8 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkMatrix(&configErrs)
 	config.checkMedia(&configErrs)
 	config.checkTurn(&configErrs)
+	config.checkSSO(&configErrs)
+	config.checkEmail(&configErrs)
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
 	config.checkLogging(&configErrs)
@@ -679,6 +869,23 @@ func (config *Dendrite) check(monolithic bool) error {
 }
 
 // absPath returns the absolute path for a given relative or absolute path.
+// parseIPNet parses an IP address or a CIDR range into the network which it
+// covers. A single address is a network of just that address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
 func absPath(dir string, path Path) string {
 	if filepath.IsAbs(string(path)) {
 		// filepath.Join cleans the path so we should clean the absolute paths as well for consistency.
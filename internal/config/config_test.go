@@ -48,6 +48,10 @@ kafka:
     output_typing_event: output.typing
     output_send_to_device_event: output.std
     output_key_change_event: output.key_change
+    output_receipt_event: output.receipt
+    output_presence_event: output.presence
+    output_notification_data: output.notification_data
+    output_devices_deleted: output.devices_deleted
     user_updates: output.user
 database:
   media_api: "postgresql:///media_api"
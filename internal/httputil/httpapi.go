@@ -27,6 +27,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationsenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -46,16 +47,43 @@ type BasicAuth struct {
 	Password string `yaml:"password"`
 }
 
+// AuthAPIOption is an option to MakeAuthAPI which changes which devices are
+// allowed to use the API.
+type AuthAPIOption func(*authAPIOptions)
+
+type authAPIOptions struct {
+	allowGuests bool
+}
+
+// WithAllowGuests allows guest devices to use the API. Guests are refused
+// with M_GUEST_ACCESS_FORBIDDEN otherwise.
+func WithAllowGuests() AuthAPIOption {
+	return func(opts *authAPIOptions) {
+		opts.allowGuests = true
+	}
+}
+
 // MakeAuthAPI turns a util.JSONRequestHandler function into an http.Handler which authenticates the request.
 func MakeAuthAPI(
 	metricsName string, userAPI userapi.UserInternalAPI,
 	f func(*http.Request, *userapi.Device) util.JSONResponse,
+	checks ...AuthAPIOption,
 ) http.Handler {
+	var opts authAPIOptions
+	for _, check := range checks {
+		check(&opts)
+	}
 	h := func(req *http.Request) util.JSONResponse {
 		device, err := auth.VerifyUserFromRequest(req, userAPI)
 		if err != nil {
 			return *err
 		}
+		if device.AccountType == userapi.AccountTypeGuest && !opts.allowGuests {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guest access not allowed"),
+			}
+		}
 		// add the user ID to the logger
 		logger := util.GetLogger((req.Context()))
 		logger = logger.WithField("user_id", device.UserID)
@@ -241,7 +269,9 @@ func SetupHTTPAPI(servMux, publicApiMux, internalApiMux *mux.Router, cfg *config
 	if enableHTTPAPIs {
 		servMux.Handle(InternalPathPrefix, internalApiMux)
 	}
-	servMux.Handle(PublicPathPrefix, WrapHandlerInCORS(publicApiMux))
+	servMux.Handle(PublicPathPrefix, WrapHandlerInCORS(
+		auth.WrapHandlerInTrustedProxies(publicApiMux, cfg.Derived.TrustedProxies),
+	))
 }
 
 // WrapHandlerInBasicAuth adds basic auth to a handler. Only used for /metrics
@@ -15,9 +15,14 @@
 package httputil
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +112,91 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+// guestUserAPI treats every access token as belonging to a guest, and panics
+// if anything else is called.
+type guestUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *guestUserAPI) QueryAccessToken(
+	ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse,
+) error {
+	res.Device = &userapi.Device{
+		UserID:      "@1:localhost",
+		ID:          "device",
+		AccessToken: req.AccessToken,
+		AccountType: userapi.AccountTypeGuest,
+	}
+	return nil
+}
+
+func TestMakeAuthAPIGuests(t *testing.T) {
+	handler := func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+	tests := []struct {
+		name string
+		h    http.Handler
+		want int
+	}{
+		{
+			name: "guests not allowed",
+			h:    MakeAuthAPI("guests_not_allowed", &guestUserAPI{}, handler),
+			want: http.StatusForbidden,
+		},
+		{
+			name: "guests allowed",
+			h:    MakeAuthAPI("guests_allowed", &guestUserAPI{}, handler, WithAllowGuests()),
+			want: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer guest_token")
+		w := httptest.NewRecorder()
+		tt.h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+// expiredUserAPI treats every access token as expired, and panics if anything
+// else is called.
+type expiredUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *expiredUserAPI) QueryAccessToken(
+	ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse,
+) error {
+	res.Expired = true
+	return nil
+}
+
+func TestMakeAuthAPIExpiredToken(t *testing.T) {
+	h := MakeAuthAPI("expired", &expiredUserAPI{}, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		t.Errorf("handler was called with an expired access token")
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer expired_token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want 401", w.Code)
+	}
+	// The client is soft logged out, so it can refresh its access token or log
+	// in again to the same device.
+	var body struct {
+		ErrCode    string `json:"errcode"`
+		SoftLogout bool   `json:"soft_logout"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if body.ErrCode != "M_UNKNOWN_TOKEN" || !body.SoftLogout {
+		t.Errorf("got error %+v, want M_UNKNOWN_TOKEN with soft_logout", body)
+	}
+}
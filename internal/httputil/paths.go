@@ -15,6 +15,7 @@
 package httputil
 
 const (
-	PublicPathPrefix   = "/_matrix/"
-	InternalPathPrefix = "/api/"
+	PublicPathPrefix       = "/_matrix/"
+	InternalPathPrefix     = "/api/"
+	SynapseAdminPathPrefix = "/_synapse/"
 )
@@ -0,0 +1,83 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+type httpClient struct {
+	hc *http.Client
+}
+
+// NewHTTPClient creates a new push gateway client that sends notifications
+// over HTTP.
+func NewHTTPClient(timeout time.Duration) Client {
+	return &httpClient{
+		hc: &http.Client{Timeout: timeout},
+	}
+}
+
+func (h *httpClient) Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Notify")
+	defer span.Finish()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	hreq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hresp, err := h.hc.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close() // nolint: errcheck
+
+	if hresp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: hresp.StatusCode}
+	}
+	if err = json.NewDecoder(hresp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("json.Decode: %w", err)
+	}
+	return nil
+}
+
+// StatusError is returned when the push gateway responds with a status
+// code other than 200 OK.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("push gateway returned HTTP %d", e.StatusCode)
+}
+
+// Temporary returns whether the request might succeed if it is retried.
+// Client errors other than rate limiting are permanent.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	var got NotifyRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			t.Errorf("got method %s, want POST", req.Method)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode request: %s", err)
+		}
+		_, _ = w.Write([]byte(`{"rejected":["badkey"]}`))
+	}))
+	defer srv.Close()
+
+	req := NotifyRequest{
+		Notification: Notification{
+			EventID: "$event:test",
+			RoomID:  "!room:test",
+			Prio:    HighPrio,
+			Devices: []*Device{
+				{AppID: "com.example.app", PushKey: "badkey"},
+			},
+		},
+	}
+	var resp NotifyResponse
+	client := NewHTTPClient(time.Second)
+	if err := client.Notify(context.Background(), srv.URL+"/_matrix/push/v1/notify", &req, &resp); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+	if got.Notification.EventID != "$event:test" || len(got.Notification.Devices) != 1 {
+		t.Errorf("gateway received unexpected notification: %+v", got.Notification)
+	}
+	if len(resp.Rejected) != 1 || resp.Rejected[0] != "badkey" {
+		t.Errorf("got rejected %v, want [badkey]", resp.Rejected)
+	}
+}
+
+func TestNotifyStatusError(t *testing.T) {
+	tcs := []struct {
+		status    int
+		temporary bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadRequest, false},
+	}
+	for _, tc := range tcs {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		var resp NotifyResponse
+		err := NewHTTPClient(time.Second).Notify(context.Background(), srv.URL, &NotifyRequest{}, &resp)
+		srv.Close()
+		statusErr, ok := err.(*StatusError)
+		if !ok {
+			t.Fatalf("HTTP %d: got error %v, want *StatusError", tc.status, err)
+		}
+		if statusErr.Temporary() != tc.temporary {
+			t.Errorf("HTTP %d: got Temporary() %v, want %v", tc.status, statusErr.Temporary(), tc.temporary)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushgateway implements a client for the push gateway API described
+// in https://matrix.org/docs/spec/push_gateway/r0.1.1
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A Client is used to interact with a push gateway.
+type Client interface {
+	// Notify sends a notification to the push gateway at the given URL.
+	Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error
+}
+
+// NotifyRequest is the request body of /_matrix/push/v1/notify.
+type NotifyRequest struct {
+	Notification Notification `json:"notification"`
+}
+
+// NotifyResponse is the response body of /_matrix/push/v1/notify.
+type NotifyResponse struct {
+	// Rejected contains the pushkeys that the push gateway no longer
+	// accepts. The pushers for these pushkeys should be removed.
+	Rejected []string `json:"rejected"`
+}
+
+// Notification is the information about an event that is sent to the
+// push gateway.
+type Notification struct {
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []*Device       `json:"devices"`
+	EventID           string          `json:"event_id,omitempty"`
+	ID                string          `json:"id,omitempty"`
+	Membership        string          `json:"membership,omitempty"`
+	Prio              Prio            `json:"prio,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+}
+
+// Counts contains the unread counts of the user who is being notified.
+type Counts struct {
+	MissedCalls int `json:"missed_calls,omitempty"`
+	Unread      int `json:"unread"`
+}
+
+// Device is a device of the user who is being notified, as identified by
+// one of their pushers.
+type Device struct {
+	AppID     string                      `json:"app_id"`
+	Data      map[string]interface{}      `json:"data,omitempty"`
+	PushKey   string                      `json:"pushkey"`
+	PushKeyTS gomatrixserverlib.Timestamp `json:"pushkey_ts,omitempty"`
+	Tweaks    map[string]interface{}      `json:"tweaks,omitempty"`
+}
+
+// Prio is the priority of a notification.
+type Prio string
+
+const (
+	HighPrio Prio = "high"
+	LowPrio  Prio = "low"
+)
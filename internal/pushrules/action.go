@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ActionKind is the kind of an action.
+type ActionKind string
+
+const (
+	UnknownAction ActionKind = ""
+
+	// NotifyAction causes each matching event to generate a notification.
+	NotifyAction ActionKind = "notify"
+
+	// DontNotifyAction prevents each matching event from generating a
+	// notification.
+	DontNotifyAction ActionKind = "dont_notify"
+
+	// CoalesceAction causes multiple matching events to be joined together
+	// into a single notification. Currently treated the same as notify.
+	CoalesceAction ActionKind = "coalesce"
+
+	// SetTweakAction sets an entry in the tweaks dictionary of the
+	// notification.
+	SetTweakAction ActionKind = "set_tweak"
+)
+
+// TweakKey is the key of a tweak set by a set_tweak action.
+type TweakKey string
+
+const (
+	UnknownTweak TweakKey = ""
+
+	// SoundTweak is the sound to be played when the notification arrives.
+	SoundTweak TweakKey = "sound"
+
+	// HighlightTweak is whether the event should be highlighted in the UI.
+	HighlightTweak TweakKey = "highlight"
+)
+
+// Action is a single action of a push rule. Actions are encoded in JSON
+// either as a bare string for simple actions, or as an object for
+// set_tweak actions.
+type Action struct {
+	// Kind is the type of the action.
+	Kind ActionKind
+	// Tweak is the key of the tweak to set, for set_tweak actions.
+	Tweak TweakKey
+	// Value is the value of the tweak, for set_tweak actions. If nil,
+	// the tweak takes its default value.
+	Value interface{}
+}
+
+func (a *Action) MarshalJSON() ([]byte, error) {
+	if a.Tweak == UnknownTweak && a.Value == nil {
+		return json.Marshal(a.Kind)
+	}
+	if a.Kind != SetTweakAction {
+		return nil, fmt.Errorf("only set_tweak actions may have a value, but got kind %q", a.Kind)
+	}
+	m := map[string]interface{}{
+		string(a.Kind): a.Tweak,
+	}
+	if a.Value != nil {
+		m["value"] = a.Value
+	}
+	return json.Marshal(m)
+}
+
+func (a *Action) UnmarshalJSON(bs []byte) error {
+	if len(bs) > 0 && bs[0] == '"' {
+		return json.Unmarshal(bs, &a.Kind)
+	}
+	var raw struct {
+		SetTweak TweakKey    `json:"set_tweak"`
+		Value    interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return err
+	}
+	if raw.SetTweak == UnknownTweak {
+		return fmt.Errorf("got unknown action JSON: %s", string(bs))
+	}
+	a.Kind = SetTweakAction
+	a.Tweak = raw.SetTweak
+	a.Value = raw.Value
+	return nil
+}
+
+// ActionsToTweaks returns whether the actions should cause a notification,
+// along with the tweaks that they set.
+func ActionsToTweaks(actions []*Action) (notify bool, tweaks map[string]interface{}) {
+	tweaks = map[string]interface{}{}
+	for _, a := range actions {
+		switch a.Kind {
+		case NotifyAction, CoalesceAction:
+			notify = true
+		case DontNotifyAction:
+			notify = false
+		case SetTweakAction:
+			v := a.Value
+			if v == nil && a.Tweak == HighlightTweak {
+				// The highlight tweak defaults to true if no value is given.
+				v = true
+			}
+			tweaks[string(a.Tweak)] = v
+		}
+	}
+	return notify, tweaks
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+// ConditionKind is the kind of a condition of a push rule.
+type ConditionKind string
+
+const (
+	UnknownCondition ConditionKind = ""
+
+	// EventMatchCondition matches a glob pattern against a field of the
+	// event, identified by a dot-separated key such as "content.body".
+	EventMatchCondition ConditionKind = "event_match"
+
+	// ContainsDisplayNameCondition matches events whose body contains the
+	// user's current display name in the room.
+	ContainsDisplayNameCondition ConditionKind = "contains_display_name"
+
+	// RoomMemberCountCondition compares the number of members in the room
+	// against the value in Is, e.g. "2", "==2", "<2", ">=2".
+	RoomMemberCountCondition ConditionKind = "room_member_count"
+
+	// SenderNotificationPermissionCondition matches events whose sender has
+	// the power level required to send the notification type given in Key,
+	// e.g. "room" for @room notifications.
+	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+)
+
+// Condition is a single condition of an override or underride push rule.
+type Condition struct {
+	// Kind is the type of the condition.
+	Kind ConditionKind `json:"kind"`
+	// Key is the dot-separated path of the event field for event_match
+	// conditions, and the notification type for
+	// sender_notification_permission conditions.
+	Key string `json:"key,omitempty"`
+	// Pattern is the glob pattern for event_match conditions.
+	Pattern string `json:"pattern,omitempty"`
+	// Is is the member count comparison for room_member_count conditions.
+	Is string `json:"is,omitempty"`
+}
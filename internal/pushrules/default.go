@@ -0,0 +1,225 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets returns the server default push rules for the
+// given local user.
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName) *AccountRuleSets {
+	return &AccountRuleSets{
+		Global: *DefaultGlobalRuleSet(localpart, serverName),
+	}
+}
+
+// DefaultGlobalRuleSet returns the server default global push rules for
+// the given local user.
+func DefaultGlobalRuleSet(localpart string, serverName gomatrixserverlib.ServerName) *RuleSet {
+	return &RuleSet{
+		Override:  defaultOverrideRules("@" + localpart + ":" + string(serverName)),
+		Content:   defaultContentRules(localpart),
+		Room:      []*Rule{},
+		Sender:    []*Rule{},
+		Underride: defaultUnderrideRules(),
+	}
+}
+
+const (
+	MRuleMaster                = ".m.rule.master"
+	MRuleSuppressNotices       = ".m.rule.suppress_notices"
+	MRuleInviteForMe           = ".m.rule.invite_for_me"
+	MRuleMemberEvent           = ".m.rule.member_event"
+	MRuleContainsDisplayName   = ".m.rule.contains_display_name"
+	MRuleTombstone             = ".m.rule.tombstone"
+	MRuleRoomNotif             = ".m.rule.roomnotif"
+	MRuleContainsUserName      = ".m.rule.contains_user_name"
+	MRuleCall                  = ".m.rule.call"
+	MRuleEncryptedRoomOneToOne = ".m.rule.encrypted_room_one_to_one"
+	MRuleRoomOneToOne          = ".m.rule.room_one_to_one"
+	MRuleMessage               = ".m.rule.message"
+	MRuleEncrypted             = ".m.rule.encrypted"
+)
+
+func defaultOverrideRules(userID string) []*Rule {
+	return []*Rule{
+		{
+			RuleID:     MRuleMaster,
+			Default:    true,
+			Enabled:    false,
+			Conditions: []*Condition{},
+			Actions:    []*Action{{Kind: DontNotifyAction}},
+		},
+		{
+			RuleID:  MRuleSuppressNotices,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "content.msgtype", Pattern: "m.notice"},
+			},
+			Actions: []*Action{{Kind: DontNotifyAction}},
+		},
+		{
+			RuleID:  MRuleInviteForMe,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"},
+				{Kind: EventMatchCondition, Key: "content.membership", Pattern: "invite"},
+				{Kind: EventMatchCondition, Key: "state_key", Pattern: userID},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+				{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+			},
+		},
+		{
+			RuleID:  MRuleMemberEvent,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"},
+			},
+			Actions: []*Action{{Kind: DontNotifyAction}},
+		},
+		{
+			RuleID:  MRuleContainsDisplayName,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: ContainsDisplayNameCondition},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+				{Kind: SetTweakAction, Tweak: HighlightTweak},
+			},
+		},
+		{
+			RuleID:  MRuleTombstone,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.tombstone"},
+				{Kind: EventMatchCondition, Key: "state_key", Pattern: ""},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: HighlightTweak},
+			},
+		},
+		{
+			RuleID:  MRuleRoomNotif,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "content.body", Pattern: "@room"},
+				{Kind: SenderNotificationPermissionCondition, Key: "room"},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: HighlightTweak},
+			},
+		},
+	}
+}
+
+func defaultContentRules(localpart string) []*Rule {
+	return []*Rule{
+		{
+			RuleID:  MRuleContainsUserName,
+			Default: true,
+			Enabled: true,
+			Pattern: localpart,
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+				{Kind: SetTweakAction, Tweak: HighlightTweak},
+			},
+		},
+	}
+}
+
+func defaultUnderrideRules() []*Rule {
+	return []*Rule{
+		{
+			RuleID:  MRuleCall,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.call.invite"},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: SoundTweak, Value: "ring"},
+				{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+			},
+		},
+		{
+			RuleID:  MRuleEncryptedRoomOneToOne,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: RoomMemberCountCondition, Is: "2"},
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.encrypted"},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+				{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+			},
+		},
+		{
+			RuleID:  MRuleRoomOneToOne,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: RoomMemberCountCondition, Is: "2"},
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+				{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+			},
+		},
+		{
+			RuleID:  MRuleMessage,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+			},
+		},
+		{
+			RuleID:  MRuleEncrypted,
+			Default: true,
+			Enabled: true,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.encrypted"},
+			},
+			Actions: []*Action{
+				{Kind: NotifyAction},
+				{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EvaluationContext gives a RuleSetEvaluator access to the
+// information about the user and room that some conditions need.
+type EvaluationContext interface {
+	// UserDisplayName returns the current display name of the user in
+	// the room that the event was sent to.
+	UserDisplayName() string
+
+	// RoomMemberCount returns the number of joined members in the room
+	// that the event was sent to.
+	RoomMemberCount() (int, error)
+
+	// HasPowerLevel returns whether the user has a power level at least
+	// as high as that required for the given notification type, e.g.
+	// "room", in the room that the event was sent to.
+	HasPowerLevel(userID, levelKey string) (bool, error)
+}
+
+// A RuleSetEvaluator matches events against a rule set.
+type RuleSetEvaluator struct {
+	ec      EvaluationContext
+	ruleSet *RuleSet
+}
+
+// NewRuleSetEvaluator creates a new evaluator for the given rule set.
+func NewRuleSetEvaluator(ec EvaluationContext, ruleSet *RuleSet) *RuleSetEvaluator {
+	return &RuleSetEvaluator{
+		ec:      ec,
+		ruleSet: ruleSet,
+	}
+}
+
+// MatchEvent returns the first enabled rule that matches the event, checking
+// the rules of each kind in priority order. Returns nil if no rule matches.
+func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule, error) {
+	var content map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &content); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for _, kind := range Kinds() {
+		for _, rule := range *rse.ruleSet.RulesOfKind(kind) {
+			if !rule.Enabled {
+				continue
+			}
+			ok, err := rse.ruleMatches(kind, rule, event, content)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.RuleID, err)
+			}
+			if ok {
+				return rule, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (rse *RuleSetEvaluator) ruleMatches(
+	kind Kind, rule *Rule, event *gomatrixserverlib.Event, eventJSON map[string]interface{},
+) (bool, error) {
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range rule.Conditions {
+			ok, err := rse.conditionMatches(cond, event, eventJSON)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case ContentKind:
+		// Content rules match the pattern against the body of the event.
+		body, ok := lookupKey(eventJSON, "content.body")
+		if !ok {
+			return false, nil
+		}
+		return patternMatches(rule.Pattern, body, true)
+
+	case RoomKind:
+		return rule.RuleID == event.RoomID(), nil
+
+	case SenderKind:
+		return rule.RuleID == event.Sender(), nil
+
+	default:
+		return false, nil
+	}
+}
+
+func (rse *RuleSetEvaluator) conditionMatches(
+	cond *Condition, event *gomatrixserverlib.Event, eventJSON map[string]interface{},
+) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		value, ok := lookupKey(eventJSON, cond.Key)
+		if !ok {
+			return false, nil
+		}
+		// The body of the event is matched on word boundaries, whereas
+		// every other field must match the pattern entirely.
+		return patternMatches(cond.Pattern, value, cond.Key == "content.body")
+
+	case ContainsDisplayNameCondition:
+		displayName := rse.ec.UserDisplayName()
+		if displayName == "" {
+			return false, nil
+		}
+		body, ok := lookupKey(eventJSON, "content.body")
+		if !ok {
+			return false, nil
+		}
+		return containsWord(body, displayName), nil
+
+	case RoomMemberCountCondition:
+		count, err := rse.ec.RoomMemberCount()
+		if err != nil {
+			return false, err
+		}
+		return memberCountMatches(cond.Is, count)
+
+	case SenderNotificationPermissionCondition:
+		return rse.ec.HasPowerLevel(event.Sender(), cond.Key)
+
+	default:
+		// Unknown conditions never match, as per the spec.
+		return false, nil
+	}
+}
+
+// lookupKey returns the string value at the dot-separated key in the event
+// JSON. Returns false if the key doesn't exist or isn't a string.
+func lookupKey(eventJSON map[string]interface{}, key string) (string, bool) {
+	parts := strings.Split(key, ".")
+	var current interface{} = eventJSON
+	for _, part := range parts {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if current, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+	s, ok := current.(string)
+	return s, ok
+}
+
+// memberCountMatches returns whether the count satisfies the comparison in
+// is, which is a number optionally prefixed with one of ==, <, >, >= or <=.
+func memberCountMatches(is string, count int) (bool, error) {
+	op := strings.TrimRight(is, "0123456789")
+	n, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false, fmt.Errorf("invalid room_member_count %q: %w", is, err)
+	}
+	switch op {
+	case "", "==":
+		return count == n, nil
+	case "<":
+		return count < n, nil
+	case ">":
+		return count > n, nil
+	case ">=":
+		return count >= n, nil
+	case "<=":
+		return count <= n, nil
+	default:
+		return false, fmt.Errorf("invalid room_member_count operator %q", op)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeEvaluationContext struct {
+	displayName string
+	memberCount int
+	powerLevel  bool
+}
+
+func (ec *fakeEvaluationContext) UserDisplayName() string       { return ec.displayName }
+func (ec *fakeEvaluationContext) RoomMemberCount() (int, error) { return ec.memberCount, nil }
+func (ec *fakeEvaluationContext) HasPowerLevel(string, string) (bool, error) {
+	return ec.powerLevel, nil
+}
+
+func mustParseEvent(t *testing.T, eventJSON string) *gomatrixserverlib.Event {
+	t.Helper()
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %s", err)
+	}
+	return &event
+}
+
+func TestMatchEventDefaultRules(t *testing.T) {
+	tcs := []struct {
+		name      string
+		eventJSON string
+		ec        *fakeEvaluationContext
+		want      string
+	}{
+		{
+			name:      "one to one message",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 2},
+			want:      MRuleRoomOneToOne,
+		},
+		{
+			name:      "group message",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 5},
+			want:      MRuleMessage,
+		},
+		{
+			name:      "contains user name",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.text","body":"hi Alice!"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 5},
+			want:      MRuleContainsUserName,
+		},
+		{
+			name:      "contains display name",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.text","body":"hi Wonderland Al, how are you?"}}`,
+			ec:        &fakeEvaluationContext{displayName: "Wonderland Al", memberCount: 5},
+			want:      MRuleContainsDisplayName,
+		},
+		{
+			name:      "room notification with permission",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.text","body":"@room hello"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 5, powerLevel: true},
+			want:      MRuleRoomNotif,
+		},
+		{
+			name:      "room notification without permission",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.text","body":"@room hello"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 5},
+			want:      MRuleMessage,
+		},
+		{
+			name:      "notice",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.notice","body":"beep"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 2},
+			want:      MRuleSuppressNotices,
+		},
+		{
+			name:      "invite for user",
+			eventJSON: `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.member","state_key":"@alice:test","content":{"membership":"invite"}}`,
+			ec:        &fakeEvaluationContext{memberCount: 5},
+			want:      MRuleInviteForMe,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ruleSets := DefaultAccountRuleSets("alice", "test")
+			rse := NewRuleSetEvaluator(tc.ec, &ruleSets.Global)
+			rule, err := rse.MatchEvent(mustParseEvent(t, tc.eventJSON))
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %s", err)
+			}
+			if rule == nil {
+				t.Fatalf("MatchEvent: got no rule, want %q", tc.want)
+			}
+			if rule.RuleID != tc.want {
+				t.Errorf("MatchEvent: got rule %q, want %q", rule.RuleID, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchEventSkipsDisabledRules(t *testing.T) {
+	ruleSet := &RuleSet{
+		Room: []*Rule{
+			{RuleID: "!r:b", Enabled: false, Actions: []*Action{{Kind: DontNotifyAction}}},
+		},
+		Sender: []*Rule{
+			{RuleID: "@bob:b", Enabled: true, Actions: []*Action{{Kind: NotifyAction}}},
+		},
+	}
+	rse := NewRuleSetEvaluator(&fakeEvaluationContext{}, ruleSet)
+	event := mustParseEvent(t, `{"event_id":"$a:b","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"hi"}}`)
+	rule, err := rse.MatchEvent(event)
+	if err != nil {
+		t.Fatalf("MatchEvent failed: %s", err)
+	}
+	if rule == nil || rule.RuleID != "@bob:b" {
+		t.Errorf("MatchEvent: got %+v, want sender rule", rule)
+	}
+}
+
+func TestPatternMatches(t *testing.T) {
+	tcs := []struct {
+		pattern      string
+		value        string
+		wordBoundary bool
+		want         bool
+	}{
+		{"m.room.message", "m.room.message", false, true},
+		{"m.room.*", "m.room.message", false, true},
+		{"m.room.*", "m.call.invite", false, false},
+		{"m.?oom.message", "M.ROOM.MESSAGE", false, true},
+		{"cake", "I like cake!", true, true},
+		{"cake", "I like cakes", true, false},
+		{"cake*", "I like cakes", true, true},
+		{"cake", "I like cake", false, false},
+	}
+	for _, tc := range tcs {
+		got, err := patternMatches(tc.pattern, tc.value, tc.wordBoundary)
+		if err != nil {
+			t.Fatalf("patternMatches(%q, %q) failed: %s", tc.pattern, tc.value, err)
+		}
+		if got != tc.want {
+			t.Errorf("patternMatches(%q, %q, %v): got %v, want %v", tc.pattern, tc.value, tc.wordBoundary, got, tc.want)
+		}
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	tcs := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"==2", 3, false},
+		{"<10", 5, true},
+		{">10", 5, false},
+		{">=5", 5, true},
+		{"<=4", 5, false},
+	}
+	for _, tc := range tcs {
+		got, err := memberCountMatches(tc.is, tc.count)
+		if err != nil {
+			t.Fatalf("memberCountMatches(%q) failed: %s", tc.is, err)
+		}
+		if got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d): got %v, want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+	if _, err := memberCountMatches("!=2", 2); err == nil {
+		t.Errorf("memberCountMatches(\"!=2\"): expected an error")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// globToRegexp converts a push rule glob pattern into a regular expression.
+// Only the "*" and "?" wildcards are supported. If wordBoundary is true then
+// the pattern matches anywhere in the value as long as it is surrounded by
+// word boundaries, as required when matching against the body of an event.
+// Otherwise the pattern must match the whole value.
+func globToRegexp(pattern string, wordBoundary bool) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*?")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr := sb.String()
+	if wordBoundary {
+		expr = `(^|\W)` + expr + `(\W|$)`
+	} else {
+		expr = `^` + expr + `$`
+	}
+	re, err := regexp.Compile(`(?is)` + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+// patternMatches returns whether the glob pattern matches the value. Patterns
+// are matched case-insensitively.
+func patternMatches(pattern, value string, wordBoundary bool) (bool, error) {
+	re, err := globToRegexp(pattern, wordBoundary)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
+
+// containsWord returns whether value contains word, surrounded by word
+// boundaries. The word is matched literally and case-insensitively.
+func containsWord(value, word string) bool {
+	re := regexp.MustCompile(`(?is)(^|\W)` + regexp.QuoteMeta(word) + `(\W|$)`)
+	return re.MatchString(value)
+}
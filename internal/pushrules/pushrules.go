@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules implements the push rules described in
+// https://matrix.org/docs/spec/client_server/r0.6.1#push-rules
+package pushrules
+
+// AccountDataType is the type of the account data that push rules are
+// stored in.
+const AccountDataType = "m.push_rules"
+
+// GlobalScope is the only scope of push rules that is currently defined.
+const GlobalScope = "global"
+
+// AccountRuleSets is the complete set of push rules for an account, as
+// stored in the m.push_rules account data.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"`
+}
+
+// RuleSet contains all the push rules of each kind for a single scope.
+type RuleSet struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// Kind is the kind of a push rule, which determines the order in which it
+// is evaluated and how it matches events.
+type Kind string
+
+const (
+	OverrideKind  Kind = "override"
+	ContentKind   Kind = "content"
+	RoomKind      Kind = "room"
+	SenderKind    Kind = "sender"
+	UnderrideKind Kind = "underride"
+)
+
+// Kinds returns all of the rule kinds in the order in which they are
+// evaluated.
+func Kinds() []Kind {
+	return []Kind{OverrideKind, ContentKind, RoomKind, SenderKind, UnderrideKind}
+}
+
+// RulesOfKind returns a pointer to the list of rules of the given kind, or
+// nil if the kind is unknown. The list can be modified through the pointer.
+func (rs *RuleSet) RulesOfKind(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override
+	case ContentKind:
+		return &rs.Content
+	case RoomKind:
+		return &rs.Room
+	case SenderKind:
+		return &rs.Sender
+	case UnderrideKind:
+		return &rs.Underride
+	default:
+		return nil
+	}
+}
+
+// Rule is a single push rule.
+type Rule struct {
+	// RuleID is the identifier of the rule. For room rules this is the
+	// room ID, and for sender rules this is the user ID of the sender.
+	RuleID string `json:"rule_id"`
+	// Default is true if this is one of the server default rules.
+	Default bool `json:"default"`
+	// Enabled is false if the rule should be skipped during evaluation.
+	Enabled bool `json:"enabled"`
+	// Actions to perform when this rule matches.
+	Actions []*Action `json:"actions"`
+	// Conditions that must all hold for an override or underride rule to match.
+	Conditions []*Condition `json:"conditions,omitempty"`
+	// Pattern is the glob pattern that content rules match against the body
+	// of the event.
+	Pattern string `json:"pattern,omitempty"`
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateRule checks that a rule of the given kind, as supplied by a
+// client, is well formed. It returns all of the problems that were found.
+func ValidateRule(kind Kind, rule *Rule) []error {
+	var errs []error
+
+	if rule.RuleID == "" {
+		errs = append(errs, fmt.Errorf("rule_id must not be empty"))
+	} else if strings.HasPrefix(rule.RuleID, ".") {
+		errs = append(errs, fmt.Errorf("rule_id %q is reserved for server default rules", rule.RuleID))
+	}
+
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range rule.Conditions {
+			errs = append(errs, validateCondition(cond)...)
+		}
+	case ContentKind:
+		if rule.Pattern == "" {
+			errs = append(errs, fmt.Errorf("content rules must have a pattern"))
+		}
+	case RoomKind:
+		if !strings.HasPrefix(rule.RuleID, "!") {
+			errs = append(errs, fmt.Errorf("room rule_id %q must be a room ID", rule.RuleID))
+		}
+	case SenderKind:
+		if !strings.HasPrefix(rule.RuleID, "@") {
+			errs = append(errs, fmt.Errorf("sender rule_id %q must be a user ID", rule.RuleID))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown rule kind %q", kind))
+	}
+
+	for _, action := range rule.Actions {
+		errs = append(errs, validateAction(action)...)
+	}
+
+	return errs
+}
+
+func validateAction(action *Action) []error {
+	switch action.Kind {
+	case NotifyAction, DontNotifyAction, CoalesceAction:
+		return nil
+	case SetTweakAction:
+		if action.Tweak == UnknownTweak {
+			return []error{fmt.Errorf("set_tweak action must have a tweak")}
+		}
+		return nil
+	default:
+		return []error{fmt.Errorf("unknown action kind %q", action.Kind)}
+	}
+}
+
+func validateCondition(cond *Condition) []error {
+	switch cond.Kind {
+	case EventMatchCondition:
+		if cond.Key == "" {
+			return []error{fmt.Errorf("event_match condition must have a key")}
+		}
+		if _, err := globToRegexp(cond.Pattern, false); err != nil {
+			return []error{err}
+		}
+	case RoomMemberCountCondition:
+		if _, err := memberCountMatches(cond.Is, 0); err != nil {
+			return []error{err}
+		}
+	case SenderNotificationPermissionCondition:
+		if cond.Key == "" {
+			return []error{fmt.Errorf("sender_notification_permission condition must have a key")}
+		}
+	}
+	// Unknown conditions are allowed, but never match.
+	return nil
+}
@@ -20,6 +20,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
@@ -67,15 +71,26 @@ type BaseDendrite struct {
 	tracerCloser  io.Closer
 
 	// PublicAPIMux should be used to register new public matrix api endpoints
-	PublicAPIMux   *mux.Router
-	InternalAPIMux *mux.Router
-	BaseMux        *mux.Router // base router which created public/internal subrouters
-	UseHTTPAPIs    bool
-	httpClient     *http.Client
-	Cfg            *config.Dendrite
-	Caches         *caching.Caches
-	KafkaConsumer  sarama.Consumer
-	KafkaProducer  sarama.SyncProducer
+	PublicAPIMux *mux.Router
+	// SynapseAdminMux should be used to register Synapse-compatible admin
+	// endpoints under /_synapse/
+	SynapseAdminMux *mux.Router
+	InternalAPIMux  *mux.Router
+	BaseMux         *mux.Router // base router which created public/internal subrouters
+	UseHTTPAPIs     bool
+	httpClient      *http.Client
+	Cfg             *config.Dendrite
+	Caches          *caching.Caches
+	KafkaConsumer   sarama.Consumer
+	KafkaProducer   sarama.SyncProducer
+	shutdown        *shutdownHooks
+}
+
+// shutdownHooks holds the functions to run when the process is asked to stop.
+type shutdownHooks struct {
+	mu    sync.Mutex
+	once  sync.Once
+	hooks []func()
 }
 
 const HTTPServerTimeout = time.Minute * 5
@@ -129,17 +144,19 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 	httpmux := mux.NewRouter().SkipClean(true)
 
 	return &BaseDendrite{
-		componentName:  componentName,
-		UseHTTPAPIs:    useHTTPAPIs,
-		tracerCloser:   closer,
-		Cfg:            cfg,
-		Caches:         cache,
-		BaseMux:        httpmux,
-		PublicAPIMux:   httpmux.PathPrefix(httputil.PublicPathPrefix).Subrouter().UseEncodedPath(),
-		InternalAPIMux: httpmux.PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
-		httpClient:     &client,
-		KafkaConsumer:  kafkaConsumer,
-		KafkaProducer:  kafkaProducer,
+		componentName:   componentName,
+		UseHTTPAPIs:     useHTTPAPIs,
+		tracerCloser:    closer,
+		Cfg:             cfg,
+		Caches:          cache,
+		BaseMux:         httpmux,
+		PublicAPIMux:    httpmux.PathPrefix(httputil.PublicPathPrefix).Subrouter().UseEncodedPath(),
+		SynapseAdminMux: httpmux.PathPrefix(httputil.SynapseAdminPathPrefix).Subrouter().UseEncodedPath(),
+		InternalAPIMux:  httpmux.PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
+		httpClient:      &client,
+		KafkaConsumer:   kafkaConsumer,
+		KafkaProducer:   kafkaProducer,
+		shutdown:        &shutdownHooks{},
 	}
 }
 
@@ -148,6 +165,37 @@ func (b *BaseDendrite) Close() error {
 	return b.tracerCloser.Close()
 }
 
+// OnShutdown registers a function to be run when the process receives SIGINT
+// or SIGTERM, so that components can write out any state which they hold in
+// memory before exiting. Functions are run in the reverse order to which they
+// were registered.
+func (b *BaseDendrite) OnShutdown(f func()) {
+	b.shutdown.mu.Lock()
+	b.shutdown.hooks = append(b.shutdown.hooks, f)
+	b.shutdown.mu.Unlock()
+	b.shutdown.once.Do(func() {
+		go b.waitForShutdown()
+	})
+}
+
+func (b *BaseDendrite) waitForShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	logrus.Infof("Received %s, shutting down %s", sig, b.componentName)
+
+	b.shutdown.mu.Lock()
+	hooks := b.shutdown.hooks
+	b.shutdown.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+	if err := b.Close(); err != nil {
+		logrus.WithError(err).Warn("Failed to close tracer")
+	}
+	os.Exit(0)
+}
+
 // AppserviceHTTPClient returns the AppServiceQueryAPI for hitting the appservice component over HTTP.
 func (b *BaseDendrite) AppserviceHTTPClient() appserviceAPI.AppServiceQueryAPI {
 	a, err := asinthttp.NewAppserviceClient(b.Cfg.AppServiceURL(), b.httpClient)
@@ -63,9 +63,9 @@ type Monolith struct {
 }
 
 // AddAllPublicRoutes attaches all public paths to the given router
-func (m *Monolith) AddAllPublicRoutes(publicMux *mux.Router) {
+func (m *Monolith) AddAllPublicRoutes(publicMux, synapseAdminMux *mux.Router) {
 	clientapi.AddPublicRoutes(
-		publicMux, m.Config, m.KafkaProducer, m.DeviceDB, m.AccountDB,
+		publicMux, synapseAdminMux, m.Config, m.KafkaProducer, m.DeviceDB, m.AccountDB,
 		m.FedClient, m.RoomserverAPI,
 		m.EDUInternalAPI, m.AppserviceAPI, m.StateAPI, transactions.New(),
 		m.FederationSenderAPI, m.UserAPI, m.KeyAPI, m.ExtPublicRoomsProvider,
@@ -78,6 +78,6 @@ func (m *Monolith) AddAllPublicRoutes(publicMux *mux.Router) {
 	mediaapi.AddPublicRoutes(publicMux, m.Config, m.UserAPI, m.Client)
 	syncapi.AddPublicRoutes(
 		publicMux, m.KafkaConsumer, m.UserAPI, m.RoomserverAPI,
-		m.KeyAPI, m.StateAPI, m.FedClient, m.Config,
+		m.KeyAPI, m.StateAPI, m.EDUInternalAPI, m.FedClient, m.Config,
 	)
 }
@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package sqlutil
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestSQLiteAddColumnIfNotExists(t *testing.T) {
+	db, err := sql.Open(SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	// Every connection gets its own in-memory database.
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec("CREATE TABLE old_table (id TEXT NOT NULL); INSERT INTO old_table (id) VALUES ('a');"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	// Adding the column twice must not fail, as this happens every time the
+	// server starts.
+	for i := 0; i < 2; i++ {
+		if err = SQLiteAddColumnIfNotExists(db, "old_table", "is_new", "BOOLEAN DEFAULT FALSE"); err != nil {
+			t.Fatalf("SQLiteAddColumnIfNotExists returned error: %s", err)
+		}
+	}
+	var isNew bool
+	if err = db.QueryRow("SELECT is_new FROM old_table WHERE id = 'a'").Scan(&isNew); err != nil {
+		t.Fatalf("failed to select new column: %s", err)
+	}
+	if isNew {
+		t.Errorf("existing row didn't get the default value of the new column")
+	}
+}
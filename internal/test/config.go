@@ -84,6 +84,10 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Kafka.Topics.OutputRoomEvent = "test.room.output"
 	cfg.Kafka.Topics.OutputClientData = "test.clientapi.output"
 	cfg.Kafka.Topics.OutputTypingEvent = "test.typing.output"
+	cfg.Kafka.Topics.OutputReceiptEvent = "test.receipt.output"
+	cfg.Kafka.Topics.OutputPresenceEvent = "test.presence.output"
+	cfg.Kafka.Topics.OutputNotificationData = "test.notificationdata.output"
+	cfg.Kafka.Topics.OutputDevicesDeleted = "test.devicesdeleted.output"
 
 	// TODO: Use different databases for the different schemas.
 	// Using the same database for every schema currently works because
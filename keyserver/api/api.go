@@ -30,28 +30,97 @@ type KeyInternalAPI interface {
 	// InputDeviceListUpdate from a federated server EDU
 	InputDeviceListUpdate(ctx context.Context, req *InputDeviceListUpdateRequest, res *InputDeviceListUpdateResponse)
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse)
+	// PerformUploadDeviceKeys replaces the cross-signing keys of a user, either from one of our clients or from
+	// an m.signing_key_update EDU
+	PerformUploadDeviceKeys(ctx context.Context, req *PerformUploadDeviceKeysRequest, res *PerformUploadDeviceKeysResponse)
+	// PerformUploadDeviceSignatures stores signatures of devices and cross-signing keys made by a user
+	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse)
 	// PerformClaimKeys claims one-time keys for use in pre-key messages
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse)
+	// PerformKeyBackup creates, updates or deletes a version of a user's room key backup
+	PerformKeyBackup(ctx context.Context, req *PerformKeyBackupRequest, res *PerformKeyBackupResponse)
+	// PerformUploadRoomKeys adds room keys to the user's current room key backup
+	PerformUploadRoomKeys(ctx context.Context, req *PerformUploadRoomKeysRequest, res *PerformUploadRoomKeysResponse)
+	// PerformDeleteRoomKeys removes room keys from a room key backup
+	PerformDeleteRoomKeys(ctx context.Context, req *PerformDeleteRoomKeysRequest, res *PerformDeleteRoomKeysResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse)
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse)
 	QueryDeviceMessages(ctx context.Context, req *QueryDeviceMessagesRequest, res *QueryDeviceMessagesResponse)
+	// QueryKeyBackup returns a version of a room key backup, and optionally the keys in it
+	QueryKeyBackup(ctx context.Context, req *QueryKeyBackupRequest, res *QueryKeyBackupResponse)
 }
 
 // KeyError is returned if there was a problem performing/querying the server
 type KeyError struct {
 	Err string
+	// Set if the request was rejected because of a bad signature, a missing
+	// parameter, an invalid parameter, a room key backup which doesn't exist or
+	// a room key backup which isn't the current one respectively
+	IsInvalidSignature bool
+	IsMissingParam     bool
+	IsInvalidParam     bool
+	IsNotFound         bool
+	IsWrongVersion     bool
 }
 
 func (k *KeyError) Error() string {
 	return k.Err
 }
 
+// DeviceMessageType is the kind of key change in a DeviceMessage.
+type DeviceMessageType int
+
+const (
+	// TypeDeviceKeyUpdate means that a device's keys changed.
+	TypeDeviceKeyUpdate DeviceMessageType = iota
+	// TypeCrossSigningUpdate means that the user's cross-signing keys, or
+	// signatures made with them, changed.
+	TypeCrossSigningUpdate
+)
+
 // DeviceMessage represents the message produced into Kafka by the key server.
 type DeviceMessage struct {
+	Type DeviceMessageType
 	DeviceKeys
 	// A monotonically increasing number which represents device changes for this user.
 	StreamID int
+	// The new cross-signing keys of the user for TypeCrossSigningUpdate messages. This is
+	// nil if other servers don't need to be told about the change.
+	CrossSigningKeyUpdate *CrossSigningKeyUpdate
+}
+
+// MSigningKeyUpdate is the type of the EDU which servers send when one of their users
+// changes their cross-signing keys.
+const MSigningKeyUpdate = "m.signing_key_update"
+
+// CrossSigningKeyUpdate is the content of an m.signing_key_update EDU. User-signing
+// keys are never sent to other servers.
+type CrossSigningKeyUpdate struct {
+	UserID         string          `json:"user_id"`
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+}
+
+// CrossSigningKeyPurpose is the purpose of a cross-signing key, as given in its usage.
+type CrossSigningKeyPurpose string
+
+const (
+	// CrossSigningKeyPurposeMaster keys sign the user's other cross-signing keys.
+	CrossSigningKeyPurposeMaster CrossSigningKeyPurpose = "master"
+	// CrossSigningKeyPurposeSelfSigning keys sign the user's own devices.
+	CrossSigningKeyPurposeSelfSigning CrossSigningKeyPurpose = "self_signing"
+	// CrossSigningKeyPurposeUserSigning keys sign the master keys of other users.
+	CrossSigningKeyPurposeUserSigning CrossSigningKeyPurpose = "user_signing"
+)
+
+// CrossSigningKey is a cross-signing key, as uploaded to /keys/device_signing/upload
+// https://github.com/matrix-org/matrix-doc/pull/1756
+type CrossSigningKey struct {
+	UserID     string                                                               `json:"user_id"`
+	Usage      []CrossSigningKeyPurpose                                             `json:"usage"`
+	Keys       map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes            `json:"keys"`
+	Signatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"signatures,omitempty"`
 }
 
 // DeviceKeys represents a set of device keys for a single device
@@ -110,6 +179,9 @@ type OneTimeKeysCount struct {
 type PerformUploadKeysRequest struct {
 	DeviceKeys  []DeviceKeys
 	OneTimeKeys []OneTimeKeys
+	// Fallback keys have the same form as one-time keys, but a device has at
+	// most one per algorithm and uploading a new one replaces the old one.
+	FallbackKeys []OneTimeKeys
 }
 
 // PerformUploadKeysResponse is the response to PerformUploadKeys
@@ -129,6 +201,45 @@ func (r *PerformUploadKeysResponse) KeyError(userID, deviceID string, err *KeyEr
 	r.KeyErrors[userID][deviceID] = err
 }
 
+// PerformUploadDeviceKeysRequest is the request to PerformUploadDeviceKeys. Keys which are
+// not given are left as they are. The raw JSON of each key is kept, as it is signed.
+type PerformUploadDeviceKeysRequest struct {
+	UserID         string
+	MasterKey      json.RawMessage
+	SelfSigningKey json.RawMessage
+	UserSigningKey json.RawMessage
+}
+
+// PerformUploadDeviceKeysResponse is the response to PerformUploadDeviceKeys
+type PerformUploadDeviceKeysResponse struct {
+	Error *KeyError
+}
+
+// PerformUploadDeviceSignaturesRequest is the request to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesRequest struct {
+	// The user who made the signatures
+	UserID string
+	// A map of user_id -> key ID -> signed key JSON, where the key ID is either a
+	// device ID or the public key of a master key
+	Signatures map[string]map[string]json.RawMessage
+}
+
+// PerformUploadDeviceSignaturesResponse is the response to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesResponse struct {
+	// A fatal error when processing e.g database failures
+	Error *KeyError
+	// A map of user_id -> key ID -> Error for signatures which weren't stored
+	Failures map[string]map[string]*KeyError
+}
+
+// Failure sets a failure for a signature in Failures
+func (r *PerformUploadDeviceSignaturesResponse) Failure(userID, keyID string, err *KeyError) {
+	if r.Failures[userID] == nil {
+		r.Failures[userID] = make(map[string]*KeyError)
+	}
+	r.Failures[userID][keyID] = err
+}
+
 type PerformClaimKeysRequest struct {
 	// Map of user_id to device_id to algorithm name
 	OneTimeKeys map[string]map[string]string
@@ -145,6 +256,9 @@ type PerformClaimKeysResponse struct {
 }
 
 type QueryKeysRequest struct {
+	// The user making the query, who can see their own user-signing key and the
+	// signatures they have made with it. Empty for queries from other servers.
+	UserID string
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
@@ -155,6 +269,10 @@ type QueryKeysResponse struct {
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross-signing key
+	MasterKeys      map[string]json.RawMessage
+	SelfSigningKeys map[string]json.RawMessage
+	UserSigningKeys map[string]json.RawMessage
 	// Set if there was a fatal error processing this query
 	Error *KeyError
 }
@@ -190,7 +308,9 @@ type QueryOneTimeKeysRequest struct {
 type QueryOneTimeKeysResponse struct {
 	// OTK key counts, in the extended /sync form described by https://matrix.org/docs/spec/client_server/r0.6.1#id84
 	Count OneTimeKeysCount
-	Error *KeyError
+	// The algorithms of the device's fallback keys which haven't been claimed yet
+	UnusedFallbackAlgorithms []string
+	Error                    *KeyError
 }
 
 type QueryDeviceMessagesRequest struct {
@@ -211,3 +331,102 @@ type InputDeviceListUpdateRequest struct {
 type InputDeviceListUpdateResponse struct {
 	Error *KeyError
 }
+
+// KeyBackupSession is a room key in a room key backup, as described in
+// https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-room-keys-keys-roomid-sessionid
+type KeyBackupSession struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// ShouldReplace returns true if the key is better than the existing key for
+// the same session, and so should replace it in the backup. Verified keys are
+// better than unverified keys, then keys which can decrypt more messages, then
+// keys which have been forwarded fewer times.
+func (k *KeyBackupSession) ShouldReplace(existing *KeyBackupSession) bool {
+	if k.IsVerified != existing.IsVerified {
+		return k.IsVerified
+	}
+	if k.FirstMessageIndex != existing.FirstMessageIndex {
+		return k.FirstMessageIndex < existing.FirstMessageIndex
+	}
+	return k.ForwardedCount < existing.ForwardedCount
+}
+
+// KeyBackupVersion is the metadata of a version of a room key backup
+type KeyBackupVersion struct {
+	Version   string
+	Algorithm string
+	AuthData  json.RawMessage
+	// Changes whenever keys are added to or removed from the backup
+	ETag string
+	// The number of keys in the backup
+	Count int64
+}
+
+type PerformKeyBackupRequest struct {
+	UserID string
+	// The version to update or delete. If empty, a new version is created and
+	// becomes the user's current backup.
+	Version      string
+	Algorithm    string
+	AuthData     json.RawMessage
+	DeleteBackup bool
+}
+
+type PerformKeyBackupResponse struct {
+	// The version which was created, updated or deleted
+	Version string
+	Error   *KeyError
+}
+
+type PerformUploadRoomKeysRequest struct {
+	UserID string
+	// Must be the user's current backup version
+	Version string
+	// Map of room ID to session ID to key
+	Keys map[string]map[string]KeyBackupSession
+}
+
+type PerformUploadRoomKeysResponse struct {
+	ETag  string
+	Count int64
+	// The user's current backup version, set if Error.IsWrongVersion
+	CurrentVersion string
+	Error          *KeyError
+}
+
+type PerformDeleteRoomKeysRequest struct {
+	UserID  string
+	Version string
+	// If set, only delete keys for this room, and if SessionID is also set,
+	// only the key for this session
+	RoomID    string
+	SessionID string
+}
+
+type PerformDeleteRoomKeysResponse struct {
+	ETag  string
+	Count int64
+	Error *KeyError
+}
+
+type QueryKeyBackupRequest struct {
+	UserID string
+	// The version to query. If empty, the user's current backup is queried.
+	Version string
+	// If set, the keys in the backup are returned, filtered by RoomID and
+	// SessionID if they are set.
+	ReturnKeys bool
+	RoomID     string
+	SessionID  string
+}
+
+type QueryKeyBackupResponse struct {
+	KeyBackupVersion
+	// Map of room ID to session ID to key, set if ReturnKeys was set
+	Keys  map[string]map[string]KeyBackupSession
+	Error *KeyError
+}
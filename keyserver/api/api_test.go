@@ -0,0 +1,74 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import "testing"
+
+func TestKeyBackupSessionShouldReplace(t *testing.T) {
+	testCases := []struct {
+		name     string
+		key      KeyBackupSession
+		existing KeyBackupSession
+		want     bool
+	}{
+		{
+			name:     "verified replaces unverified",
+			key:      KeyBackupSession{IsVerified: true, FirstMessageIndex: 10, ForwardedCount: 5},
+			existing: KeyBackupSession{IsVerified: false, FirstMessageIndex: 0, ForwardedCount: 0},
+			want:     true,
+		},
+		{
+			name:     "unverified doesn't replace verified",
+			key:      KeyBackupSession{IsVerified: false, FirstMessageIndex: 0, ForwardedCount: 0},
+			existing: KeyBackupSession{IsVerified: true, FirstMessageIndex: 10, ForwardedCount: 5},
+			want:     false,
+		},
+		{
+			name:     "lower first message index replaces higher",
+			key:      KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 5},
+			existing: KeyBackupSession{IsVerified: true, FirstMessageIndex: 2, ForwardedCount: 0},
+			want:     true,
+		},
+		{
+			name:     "higher first message index doesn't replace lower",
+			key:      KeyBackupSession{IsVerified: true, FirstMessageIndex: 2, ForwardedCount: 0},
+			existing: KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 5},
+			want:     false,
+		},
+		{
+			name:     "lower forwarded count replaces higher",
+			key:      KeyBackupSession{IsVerified: false, FirstMessageIndex: 1, ForwardedCount: 0},
+			existing: KeyBackupSession{IsVerified: false, FirstMessageIndex: 1, ForwardedCount: 1},
+			want:     true,
+		},
+		{
+			name:     "higher forwarded count doesn't replace lower",
+			key:      KeyBackupSession{IsVerified: false, FirstMessageIndex: 1, ForwardedCount: 1},
+			existing: KeyBackupSession{IsVerified: false, FirstMessageIndex: 1, ForwardedCount: 0},
+			want:     false,
+		},
+		{
+			name:     "equal keys don't replace each other",
+			key:      KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 1, SessionData: []byte(`{"new":true}`)},
+			existing: KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 1, SessionData: []byte(`{"new":false}`)},
+			want:     false,
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.key.ShouldReplace(&tc.existing); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,621 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.PerformUploadDeviceKeysRequest, res *api.PerformUploadDeviceKeysResponse) {
+	_, serverName, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err:            fmt.Sprintf("invalid user ID %q", req.UserID),
+			IsInvalidParam: true,
+		}
+		return
+	}
+	isLocal := serverName == a.ThisServer
+
+	keysToStore := make(map[api.CrossSigningKeyPurpose]json.RawMessage)
+	if len(req.MasterKey) > 0 {
+		keysToStore[api.CrossSigningKeyPurposeMaster] = req.MasterKey
+	}
+	if len(req.SelfSigningKey) > 0 {
+		keysToStore[api.CrossSigningKeyPurposeSelfSigning] = req.SelfSigningKey
+	}
+	if len(req.UserSigningKey) > 0 {
+		if !isLocal {
+			res.Error = &api.KeyError{
+				Err:            "user-signing keys are never shared with other servers",
+				IsInvalidParam: true,
+			}
+			return
+		}
+		keysToStore[api.CrossSigningKeyPurposeUserSigning] = req.UserSigningKey
+	}
+	if len(keysToStore) == 0 {
+		res.Error = &api.KeyError{
+			Err:            "no cross-signing keys were given",
+			IsMissingParam: true,
+		}
+		return
+	}
+
+	if res.Error = a.storeCrossSigningKeys(ctx, req.UserID, keysToStore); res.Error != nil {
+		return
+	}
+
+	// only tell other servers about our own users' keys, and only about the keys they can see
+	_, hasMasterKey := keysToStore[api.CrossSigningKeyPurposeMaster]
+	_, hasSelfSigningKey := keysToStore[api.CrossSigningKeyPurposeSelfSigning]
+	if err = a.emitCrossSigningKeyUpdate(ctx, req.UserID, isLocal && (hasMasterKey || hasSelfSigningKey)); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to emit cross-signing key update")
+	}
+}
+
+// storeCrossSigningKeys checks that the keys are valid and signed by the user's master key, which is either one of
+// the keys or was stored before, and then stores them.
+func (a *KeyInternalAPI) storeCrossSigningKeys(
+	ctx context.Context, userID string, keysToStore map[api.CrossSigningKeyPurpose]json.RawMessage,
+) *api.KeyError {
+	existingKeys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+		}
+	}
+
+	// the other keys must be signed by the master key, which is either being uploaded now or was uploaded before
+	masterKeyJSON, ok := keysToStore[api.CrossSigningKeyPurposeMaster]
+	if !ok {
+		masterKeyJSON, ok = existingKeys[api.CrossSigningKeyPurposeMaster]
+	}
+	if !ok {
+		return &api.KeyError{
+			Err:            "no master key was given and the user doesn't have one",
+			IsMissingParam: true,
+		}
+	}
+	masterKeyID, masterPublicKey, keyErr := parseCrossSigningKey(masterKeyJSON, userID, api.CrossSigningKeyPurposeMaster)
+	if keyErr != nil {
+		return keyErr
+	}
+	for purpose, keyJSON := range keysToStore {
+		if purpose == api.CrossSigningKeyPurposeMaster {
+			continue
+		}
+		if _, _, keyErr = parseCrossSigningKey(keyJSON, userID, purpose); keyErr != nil {
+			return keyErr
+		}
+		if err = gomatrixserverlib.VerifyJSON(userID, masterKeyID, masterPublicKey, keyJSON); err != nil {
+			return &api.KeyError{
+				Err:                fmt.Sprintf("%s key isn't signed by the master key: %s", purpose, err),
+				IsInvalidSignature: true,
+			}
+		}
+	}
+
+	// a new master key invalidates the keys it signed before, so those are removed rather than left alongside it
+	store := a.DB.StoreCrossSigningKeysForUser
+	if _, ok = keysToStore[api.CrossSigningKeyPurposeMaster]; ok && isNewMasterKey(existingKeys, userID, masterKeyID) {
+		store = a.DB.ReplaceCrossSigningKeysForUser
+	}
+	if err = store(ctx, userID, keysToStore); err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+	}
+	return nil
+}
+
+// isNewMasterKey returns true if the user doesn't already have a master key with the given key ID.
+func isNewMasterKey(existingKeys map[api.CrossSigningKeyPurpose]json.RawMessage, userID string, masterKeyID gomatrixserverlib.KeyID) bool {
+	existingJSON, ok := existingKeys[api.CrossSigningKeyPurposeMaster]
+	if !ok {
+		return true
+	}
+	existingKeyID, _, keyErr := parseCrossSigningKey(existingJSON, userID, api.CrossSigningKeyPurposeMaster)
+	return keyErr != nil || existingKeyID != masterKeyID
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceSignatures(
+	ctx context.Context, req *api.PerformUploadDeviceSignaturesRequest, res *api.PerformUploadDeviceSignaturesResponse,
+) {
+	res.Failures = make(map[string]map[string]*api.KeyError)
+	ownKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+		}
+		return
+	}
+	for targetUserID, forTargetUser := range req.Signatures {
+		for targetKeyID, keyJSON := range forTargetUser {
+			var keyErr *api.KeyError
+			if targetUserID == req.UserID {
+				keyErr = a.uploadOwnSignature(ctx, req.UserID, ownKeys, targetKeyID, keyJSON)
+			} else {
+				keyErr = a.uploadUserSigningSignature(ctx, req.UserID, ownKeys, targetUserID, targetKeyID, keyJSON)
+			}
+			if keyErr != nil {
+				res.Failure(targetUserID, targetKeyID, keyErr)
+			}
+		}
+	}
+}
+
+// uploadOwnSignature stores a signature that the user has made of one of their own devices with their self-signing key,
+// or of their own master key with one of their devices. The signature is added to the stored key JSON, so it is sent to
+// everyone who can see the key.
+func (a *KeyInternalAPI) uploadOwnSignature(
+	ctx context.Context, userID string, ownKeys map[api.CrossSigningKeyPurpose]json.RawMessage, targetKeyID string, keyJSON json.RawMessage,
+) *api.KeyError {
+	var signed api.CrossSigningKey
+	if err := json.Unmarshal(keyJSON, &signed); err != nil {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("malformed key JSON: %s", err),
+			IsInvalidParam: true,
+		}
+	}
+	if masterKeyJSON, ok := ownKeys[api.CrossSigningKeyPurposeMaster]; ok {
+		masterKeyID, _, keyErr := parseCrossSigningKey(masterKeyJSON, userID, api.CrossSigningKeyPurposeMaster)
+		if keyErr == nil && masterKeyID == gomatrixserverlib.KeyID("ed25519:"+targetKeyID) {
+			return a.signOwnMasterKey(ctx, userID, masterKeyJSON, masterKeyID, signed.Signatures[userID])
+		}
+	}
+
+	// otherwise the target is one of the user's devices, which must be signed by the self-signing key
+	selfSigningKeyJSON, ok := ownKeys[api.CrossSigningKeyPurposeSelfSigning]
+	if !ok {
+		return &api.KeyError{
+			Err:            "the user doesn't have a self-signing key",
+			IsMissingParam: true,
+		}
+	}
+	selfSigningKeyID, selfSigningPublicKey, keyErr := parseCrossSigningKey(selfSigningKeyJSON, userID, api.CrossSigningKeyPurposeSelfSigning)
+	if keyErr != nil {
+		return keyErr
+	}
+	signature, ok := signed.Signatures[userID][selfSigningKeyID]
+	if !ok {
+		return &api.KeyError{
+			Err:                "the device isn't signed by the self-signing key",
+			IsInvalidSignature: true,
+		}
+	}
+	existingKeys, err := a.DB.DeviceKeysForUser(ctx, userID, []string{targetKeyID})
+	if err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to query device keys: %s", err),
+		}
+	}
+	if len(existingKeys) == 0 || len(existingKeys[0].KeyJSON) == 0 {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("unknown device %q", targetKeyID),
+			IsInvalidParam: true,
+		}
+	}
+	// check the signature against the keys we have rather than the keys in the request
+	signedDeviceKeys, err := addSignature(existingKeys[0].KeyJSON, userID, selfSigningKeyID, signature)
+	if err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to add signature to device keys: %s", err),
+		}
+	}
+	if err = gomatrixserverlib.VerifyJSON(userID, selfSigningKeyID, selfSigningPublicKey, signedDeviceKeys); err != nil {
+		return &api.KeyError{
+			Err:                fmt.Sprintf("invalid signature of device: %s", err),
+			IsInvalidSignature: true,
+		}
+	}
+
+	keysToStore := []api.DeviceMessage{
+		{
+			DeviceKeys: api.DeviceKeys{
+				UserID:   userID,
+				DeviceID: targetKeyID,
+				KeyJSON:  signedDeviceKeys,
+			},
+		},
+	}
+	if err = a.DB.StoreLocalDeviceKeys(ctx, keysToStore); err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to store device keys: %s", err),
+		}
+	}
+	if err = a.emitDeviceKeyChanges(existingKeys, keysToStore); err != nil {
+		util.GetLogger(ctx).Errorf("Failed to emitDeviceKeyChanges: %s", err)
+	}
+	return nil
+}
+
+// signOwnMasterKey adds signatures of the user's master key made by the user's devices.
+func (a *KeyInternalAPI) signOwnMasterKey(
+	ctx context.Context, userID string, masterKeyJSON json.RawMessage, masterKeyID gomatrixserverlib.KeyID,
+	signatures map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes,
+) *api.KeyError {
+	signedMasterKey := masterKeyJSON
+	added := 0
+	for keyID, signature := range signatures {
+		if keyID == masterKeyID || !strings.HasPrefix(string(keyID), "ed25519:") {
+			continue
+		}
+		deviceID := strings.TrimPrefix(string(keyID), "ed25519:")
+		devicePublicKey, err := a.devicePublicKey(ctx, userID, deviceID)
+		if err != nil {
+			return &api.KeyError{
+				Err: fmt.Sprintf("failed to query device keys: %s", err),
+			}
+		}
+		if devicePublicKey == nil {
+			continue
+		}
+		// check the signature against the key we have rather than the key in the request
+		candidate, err := addSignature(signedMasterKey, userID, keyID, signature)
+		if err != nil {
+			return &api.KeyError{
+				Err: fmt.Sprintf("failed to add signature to master key: %s", err),
+			}
+		}
+		if err = gomatrixserverlib.VerifyJSON(userID, keyID, devicePublicKey, candidate); err != nil {
+			return &api.KeyError{
+				Err:                fmt.Sprintf("invalid signature of master key by device %q: %s", deviceID, err),
+				IsInvalidSignature: true,
+			}
+		}
+		signedMasterKey = candidate
+		added++
+	}
+	if added == 0 {
+		return &api.KeyError{
+			Err:                "the master key isn't signed by any of the user's devices",
+			IsInvalidSignature: true,
+		}
+	}
+
+	err := a.DB.StoreCrossSigningKeysForUser(ctx, userID, map[api.CrossSigningKeyPurpose]json.RawMessage{
+		api.CrossSigningKeyPurposeMaster: signedMasterKey,
+	})
+	if err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to store master key: %s", err),
+		}
+	}
+	if err = a.emitCrossSigningKeyUpdate(ctx, userID, true); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to emit cross-signing key update")
+	}
+	return nil
+}
+
+// uploadUserSigningSignature stores a signature that the user has made of another user's master key with their
+// user-signing key. These signatures are only visible to the user who made them.
+func (a *KeyInternalAPI) uploadUserSigningSignature(
+	ctx context.Context, userID string, ownKeys map[api.CrossSigningKeyPurpose]json.RawMessage,
+	targetUserID, targetKeyID string, keyJSON json.RawMessage,
+) *api.KeyError {
+	userSigningKeyJSON, ok := ownKeys[api.CrossSigningKeyPurposeUserSigning]
+	if !ok {
+		return &api.KeyError{
+			Err:            "the user doesn't have a user-signing key",
+			IsMissingParam: true,
+		}
+	}
+	userSigningKeyID, userSigningPublicKey, keyErr := parseCrossSigningKey(userSigningKeyJSON, userID, api.CrossSigningKeyPurposeUserSigning)
+	if keyErr != nil {
+		return keyErr
+	}
+	var signed api.CrossSigningKey
+	if err := json.Unmarshal(keyJSON, &signed); err != nil {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("malformed key JSON: %s", err),
+			IsInvalidParam: true,
+		}
+	}
+	signature, ok := signed.Signatures[userID][userSigningKeyID]
+	if !ok {
+		return &api.KeyError{
+			Err:                "the key isn't signed by the user-signing key",
+			IsInvalidSignature: true,
+		}
+	}
+
+	// only master keys can be signed with user-signing keys. We can only check the signature against the key we
+	// have for our own users, as we don't keep the keys of remote users.
+	targetKeyJSON := keyJSON
+	_, serverName, err := gomatrixserverlib.SplitID('@', targetUserID)
+	if err != nil {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("invalid user ID %q", targetUserID),
+			IsInvalidParam: true,
+		}
+	}
+	if serverName == a.ThisServer {
+		targetKeys, queryErr := a.DB.CrossSigningKeysForUser(ctx, targetUserID)
+		if queryErr != nil {
+			return &api.KeyError{
+				Err: fmt.Sprintf("failed to query cross-signing keys: %s", queryErr),
+			}
+		}
+		if targetKeyJSON, ok = targetKeys[api.CrossSigningKeyPurposeMaster]; !ok {
+			return &api.KeyError{
+				Err:            fmt.Sprintf("%s doesn't have a master key", targetUserID),
+				IsInvalidParam: true,
+			}
+		}
+		if targetKeyJSON, err = addSignature(targetKeyJSON, userID, userSigningKeyID, signature); err != nil {
+			return &api.KeyError{
+				Err: fmt.Sprintf("failed to add signature to master key: %s", err),
+			}
+		}
+	}
+	targetMasterKeyID, _, keyErr := parseCrossSigningKey(targetKeyJSON, targetUserID, api.CrossSigningKeyPurposeMaster)
+	if keyErr != nil {
+		return keyErr
+	}
+	if targetMasterKeyID != gomatrixserverlib.KeyID("ed25519:"+targetKeyID) {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("%q isn't the master key of %s", targetKeyID, targetUserID),
+			IsInvalidParam: true,
+		}
+	}
+	if err = gomatrixserverlib.VerifyJSON(userID, userSigningKeyID, userSigningPublicKey, targetKeyJSON); err != nil {
+		return &api.KeyError{
+			Err:                fmt.Sprintf("invalid signature of master key: %s", err),
+			IsInvalidSignature: true,
+		}
+	}
+
+	if err = a.DB.StoreCrossSigningSigsForTarget(ctx, userID, userSigningKeyID, targetUserID, targetKeyID, signature); err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to store signature: %s", err),
+		}
+	}
+	// nothing changes for other servers, but the user's devices need to fetch the target's keys again
+	if err = a.emitCrossSigningKeyUpdate(ctx, targetUserID, false); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to emit cross-signing key update")
+	}
+	return nil
+}
+
+// crossSigningKeysForQuery adds the cross-signing keys of the local user to the response. User-signing keys are only
+// visible to the user who owns them.
+func (a *KeyInternalAPI) crossSigningKeysForQuery(ctx context.Context, userID, requestingUserID string, res *api.QueryKeysResponse) error {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if keyJSON, ok := keys[api.CrossSigningKeyPurposeMaster]; ok {
+		res.MasterKeys[userID] = keyJSON
+	}
+	if keyJSON, ok := keys[api.CrossSigningKeyPurposeSelfSigning]; ok {
+		res.SelfSigningKeys[userID] = keyJSON
+	}
+	if keyJSON, ok := keys[api.CrossSigningKeyPurposeUserSigning]; ok && userID == requestingUserID {
+		res.UserSigningKeys[userID] = keyJSON
+	}
+	return nil
+}
+
+// remoteCrossSigningKeysForQuery adds the stored cross-signing keys of a remote user to the response. The stored keys
+// are kept up to date by m.signing_key_update EDUs, and are replaced by any valid keys which the user's server returned
+// in the response, so that they can still be served when the server can't be reached.
+func (a *KeyInternalAPI) remoteCrossSigningKeysForQuery(ctx context.Context, userID string, res *api.QueryKeysResponse) error {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	fetched := make(map[api.CrossSigningKeyPurpose]json.RawMessage)
+	if keyJSON, ok := res.MasterKeys[userID]; ok && !bytes.Equal(keyJSON, keys[api.CrossSigningKeyPurposeMaster]) {
+		fetched[api.CrossSigningKeyPurposeMaster] = keyJSON
+	}
+	if keyJSON, ok := res.SelfSigningKeys[userID]; ok && !bytes.Equal(keyJSON, keys[api.CrossSigningKeyPurposeSelfSigning]) {
+		fetched[api.CrossSigningKeyPurposeSelfSigning] = keyJSON
+	}
+	if len(fetched) > 0 {
+		if keyErr := a.storeCrossSigningKeys(ctx, userID, fetched); keyErr != nil {
+			util.GetLogger(ctx).WithField("user_id", userID).Warnf("Ignoring invalid cross-signing keys from remote server: %s", keyErr)
+		} else {
+			// tell our users about keys which changed without us being sent an EDU
+			if len(keys) > 0 {
+				if err = a.emitCrossSigningKeyUpdate(ctx, userID, false); err != nil {
+					util.GetLogger(ctx).WithError(err).Error("Failed to emit cross-signing key update")
+				}
+			}
+			if keys, err = a.DB.CrossSigningKeysForUser(ctx, userID); err != nil {
+				return err
+			}
+		}
+	}
+	delete(res.MasterKeys, userID)
+	delete(res.SelfSigningKeys, userID)
+	if keyJSON, ok := keys[api.CrossSigningKeyPurposeMaster]; ok {
+		res.MasterKeys[userID] = keyJSON
+	}
+	if keyJSON, ok := keys[api.CrossSigningKeyPurposeSelfSigning]; ok {
+		res.SelfSigningKeys[userID] = keyJSON
+	}
+	return nil
+}
+
+// addUserSigningSignatures adds the signatures that the requesting user has made of other users' master keys to the
+// master keys in the response. Only signatures made with the requesting user's current user-signing key are added, as
+// the others can no longer be verified.
+func (a *KeyInternalAPI) addUserSigningSignatures(ctx context.Context, requestingUserID string, res *api.QueryKeysResponse) error {
+	if requestingUserID == "" {
+		return nil
+	}
+	ownKeys, err := a.DB.CrossSigningKeysForUser(ctx, requestingUserID)
+	if err != nil {
+		return err
+	}
+	userSigningKeyJSON, ok := ownKeys[api.CrossSigningKeyPurposeUserSigning]
+	if !ok {
+		return nil
+	}
+	userSigningKeyID, _, keyErr := parseCrossSigningKey(userSigningKeyJSON, requestingUserID, api.CrossSigningKeyPurposeUserSigning)
+	if keyErr != nil {
+		return nil
+	}
+	for userID, keyJSON := range res.MasterKeys {
+		if userID == requestingUserID {
+			continue
+		}
+		masterKeyID, _, keyErr := parseCrossSigningKey(keyJSON, userID, api.CrossSigningKeyPurposeMaster)
+		if keyErr != nil {
+			continue
+		}
+		targetKeyID := strings.TrimPrefix(string(masterKeyID), "ed25519:")
+		signatures, err := a.DB.CrossSigningSigsForTarget(ctx, requestingUserID, userID, targetKeyID)
+		if err != nil {
+			return err
+		}
+		signature, ok := signatures[userSigningKeyID]
+		if !ok {
+			continue
+		}
+		if keyJSON, err = addSignature(keyJSON, requestingUserID, userSigningKeyID, signature); err != nil {
+			return err
+		}
+		res.MasterKeys[userID] = keyJSON
+	}
+	return nil
+}
+
+// emitCrossSigningKeyUpdate tells the sync API, and other servers if federate is true, that the cross-signing keys of
+// the user have changed.
+func (a *KeyInternalAPI) emitCrossSigningKeyUpdate(ctx context.Context, userID string, federate bool) error {
+	message := api.DeviceMessage{
+		Type: api.TypeCrossSigningUpdate,
+		DeviceKeys: api.DeviceKeys{
+			UserID: userID,
+		},
+	}
+	if federate {
+		keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+		message.CrossSigningKeyUpdate = &api.CrossSigningKeyUpdate{
+			UserID:         userID,
+			MasterKey:      keys[api.CrossSigningKeyPurposeMaster],
+			SelfSigningKey: keys[api.CrossSigningKeyPurposeSelfSigning],
+		}
+	}
+	return a.Producer.ProduceKeyChanges([]api.DeviceMessage{message})
+}
+
+// devicePublicKey returns the ed25519 key of the user's device, or nil if the device doesn't have one.
+func (a *KeyInternalAPI) devicePublicKey(ctx context.Context, userID, deviceID string) (ed25519.PublicKey, error) {
+	deviceKeys, err := a.DB.DeviceKeysForUser(ctx, userID, []string{deviceID})
+	if err != nil {
+		return nil, err
+	}
+	if len(deviceKeys) == 0 || len(deviceKeys[0].KeyJSON) == 0 {
+		return nil, nil
+	}
+	var keys struct {
+		Keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+	}
+	if err = json.Unmarshal(deviceKeys[0].KeyJSON, &keys); err != nil {
+		return nil, nil
+	}
+	publicKey := keys.Keys[gomatrixserverlib.KeyID("ed25519:"+deviceID)]
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, nil
+	}
+	return ed25519.PublicKey(publicKey), nil
+}
+
+// parseCrossSigningKey checks that the key JSON is a cross-signing key of the user for the purpose, returning its key
+// ID and public key.
+func parseCrossSigningKey(
+	keyJSON json.RawMessage, userID string, purpose api.CrossSigningKeyPurpose,
+) (gomatrixserverlib.KeyID, ed25519.PublicKey, *api.KeyError) {
+	var key api.CrossSigningKey
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return "", nil, &api.KeyError{
+			Err:            fmt.Sprintf("malformed %s key: %s", purpose, err),
+			IsInvalidParam: true,
+		}
+	}
+	if key.UserID != userID {
+		return "", nil, &api.KeyError{
+			Err:            fmt.Sprintf("%s key is for the wrong user %q", purpose, key.UserID),
+			IsInvalidParam: true,
+		}
+	}
+	hasPurpose := false
+	for _, usage := range key.Usage {
+		hasPurpose = hasPurpose || usage == purpose
+	}
+	if !hasPurpose {
+		return "", nil, &api.KeyError{
+			Err:            fmt.Sprintf("%s key doesn't have the %q usage", purpose, purpose),
+			IsInvalidParam: true,
+		}
+	}
+	if len(key.Keys) != 1 {
+		return "", nil, &api.KeyError{
+			Err:            fmt.Sprintf("%s key must have exactly one public key", purpose),
+			IsInvalidParam: true,
+		}
+	}
+	for keyID, publicKey := range key.Keys {
+		if keyID != gomatrixserverlib.KeyID("ed25519:"+publicKey.Encode()) || len(publicKey) != ed25519.PublicKeySize {
+			return "", nil, &api.KeyError{
+				Err:            fmt.Sprintf("%s key has an invalid ed25519 key %q", purpose, keyID),
+				IsInvalidParam: true,
+			}
+		}
+		return keyID, ed25519.PublicKey(publicKey), nil
+	}
+	return "", nil, nil // unreachable
+}
+
+// addSignature adds the signature to the signed key JSON, leaving the rest of the JSON as it was.
+func addSignature(
+	keyJSON json.RawMessage, userID string, keyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes,
+) (json.RawMessage, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(keyJSON, &object); err != nil {
+		return nil, err
+	}
+	signatures := make(map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+	if rawSignatures, ok := object["signatures"]; ok {
+		if err := json.Unmarshal(rawSignatures, &signatures); err != nil {
+			return nil, err
+		}
+	}
+	if signatures[userID] == nil {
+		signatures[userID] = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+	}
+	signatures[userID][keyID] = signature
+	rawSignatures, err := json.Marshal(signatures)
+	if err != nil {
+		return nil, err
+	}
+	object["signatures"] = rawSignatures
+	return json.Marshal(object)
+}
@@ -0,0 +1,651 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// keyChangeSyncProducer records the key change messages sent to it.
+type keyChangeSyncProducer struct {
+	mu       sync.Mutex
+	offset   int64
+	messages []api.DeviceMessage
+}
+
+func (p *keyChangeSyncProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	var message api.DeviceMessage
+	if err = json.Unmarshal(value, &message); err != nil {
+		return 0, 0, err
+	}
+	p.messages = append(p.messages, message)
+	p.offset++
+	return 0, p.offset, nil
+}
+
+func (p *keyChangeSyncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *keyChangeSyncProducer) Close() error {
+	return nil
+}
+
+// lastMessage returns the last key change message which was sent.
+func (p *keyChangeSyncProducer) lastMessage(t *testing.T) api.DeviceMessage {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.messages) == 0 {
+		t.Fatalf("no key change messages were sent")
+	}
+	return p.messages[len(p.messages)-1]
+}
+
+func mustCreateKeyInternalAPI(t *testing.T) (*KeyInternalAPI, *keyChangeSyncProducer, func()) {
+	tmpfile, err := ioutil.TempFile("", "keyserver_internal_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	db, err := storage.NewDatabase(fmt.Sprintf("file://%s", tmpfile.Name()), nil)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	producer := &keyChangeSyncProducer{}
+	a := &KeyInternalAPI{
+		DB:         db,
+		ThisServer: "localhost",
+		Producer: &producers.KeyChange{
+			Topic:    "keychange",
+			Producer: producer,
+			DB:       db,
+		},
+	}
+	return a, producer, func() {
+		os.Remove(tmpfile.Name()) // nolint:errcheck
+	}
+}
+
+// queryKeysRoundTripper answers federation key queries with the response body
+// set for each server, and fails the queries to any other server.
+type queryKeysRoundTripper struct {
+	responses map[string]string
+}
+
+func (q *queryKeysRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := q.responses[req.Host]
+	if !ok || req.URL.Path != "/_matrix/federation/v1/user/keys/query" {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+// noDeviceInfosUserAPI knows no device display names, and panics if anything
+// else is called.
+type noDeviceInfosUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *noDeviceInfosUserAPI) QueryDeviceInfos(
+	ctx context.Context, req *userapi.QueryDeviceInfosRequest, res *userapi.QueryDeviceInfosResponse,
+) error {
+	return nil
+}
+
+// setRemoteKeyResponses makes the API query the keys of remote users from the given responses.
+func setRemoteKeyResponses(t *testing.T, a *KeyInternalAPI, responses map[string]string) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	transport := &http.Transport{}
+	transport.RegisterProtocol("matrix", &queryKeysRoundTripper{responses})
+	a.UserAPI = &noDeviceInfosUserAPI{}
+	a.FedKeyClient = &FederationKeyClient{
+		fedClient:  gomatrixserverlib.NewFederationClientWithTransport(a.ThisServer, "ed25519:auto", privateKey, transport),
+		serverName: a.ThisServer,
+		keyID:      "ed25519:auto",
+		privateKey: privateKey,
+	}
+}
+
+// crossSigningKey is a cross-signing key along with its private key, for signing things with it in tests.
+type crossSigningKey struct {
+	keyID      gomatrixserverlib.KeyID
+	privateKey ed25519.PrivateKey
+	keyJSON    json.RawMessage
+}
+
+// mustMakeCrossSigningKey makes a new cross-signing key for the user, signed by the signer if one is given.
+func mustMakeCrossSigningKey(t *testing.T, userID string, purpose api.CrossSigningKeyPurpose, signer *crossSigningKey) *crossSigningKey {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	encoded := gomatrixserverlib.Base64Bytes(publicKey).Encode()
+	key := &crossSigningKey{
+		keyID:      gomatrixserverlib.KeyID("ed25519:" + encoded),
+		privateKey: privateKey,
+	}
+	key.keyJSON, err = json.Marshal(api.CrossSigningKey{
+		UserID: userID,
+		Usage:  []api.CrossSigningKeyPurpose{purpose},
+		Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			key.keyID: gomatrixserverlib.Base64Bytes(publicKey),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	if signer != nil {
+		key.keyJSON = signer.mustSign(t, userID, key.keyJSON)
+	}
+	return key
+}
+
+func (k *crossSigningKey) mustSign(t *testing.T, userID string, keyJSON json.RawMessage) json.RawMessage {
+	t.Helper()
+	signed, err := gomatrixserverlib.SignJSON(userID, k.keyID, k.privateKey, keyJSON)
+	if err != nil {
+		t.Fatalf("failed to sign JSON: %s", err)
+	}
+	return signed
+}
+
+func TestParseCrossSigningKey(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	encoded := gomatrixserverlib.Base64Bytes(publicKey).Encode()
+	userID := "@alice:localhost"
+	testCases := []struct {
+		name    string
+		keyJSON string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			keyJSON: `{"user_id":"` + userID + `","usage":["master"],"keys":{"ed25519:` + encoded + `":"` + encoded + `"}}`,
+		},
+		{
+			name:    "wrong user",
+			keyJSON: `{"user_id":"@bob:localhost","usage":["master"],"keys":{"ed25519:` + encoded + `":"` + encoded + `"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong usage",
+			keyJSON: `{"user_id":"` + userID + `","usage":["self_signing"],"keys":{"ed25519:` + encoded + `":"` + encoded + `"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "key ID doesn't match key",
+			keyJSON: `{"user_id":"` + userID + `","usage":["master"],"keys":{"ed25519:foo":"` + encoded + `"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "no keys",
+			keyJSON: `{"user_id":"` + userID + `","usage":["master"],"keys":{}}`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		keyID, gotPublicKey, keyErr := parseCrossSigningKey(json.RawMessage(tc.keyJSON), userID, api.CrossSigningKeyPurposeMaster)
+		if tc.wantErr {
+			if keyErr == nil || !keyErr.IsInvalidParam {
+				t.Errorf("%s: expected an invalid param error, got %v", tc.name, keyErr)
+			}
+			continue
+		}
+		if keyErr != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, keyErr)
+			continue
+		}
+		if keyID != gomatrixserverlib.KeyID("ed25519:"+encoded) || !bytes.Equal(publicKey, gotPublicKey) {
+			t.Errorf("%s: got key %s %v, want %s", tc.name, keyID, gotPublicKey, encoded)
+		}
+	}
+}
+
+func TestAddSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	userID := "@alice:localhost"
+	keyJSON := []byte(`{"user_id":"@alice:localhost","device_id":"DEVICE","signatures":{"@alice:localhost":{"ed25519:DEVICE":"c2lnbmF0dXJl"}}}`)
+	signed, err := gomatrixserverlib.SignJSON(userID, "ed25519:other", privateKey, keyJSON)
+	if err != nil {
+		t.Fatalf("failed to sign JSON: %s", err)
+	}
+	var object struct {
+		Signatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"signatures"`
+	}
+	if err = json.Unmarshal(signed, &object); err != nil {
+		t.Fatalf("failed to unmarshal signed JSON: %s", err)
+	}
+
+	got, err := addSignature(keyJSON, userID, "ed25519:other", object.Signatures[userID]["ed25519:other"])
+	if err != nil {
+		t.Fatalf("addSignature returned an error: %s", err)
+	}
+	if err = gomatrixserverlib.VerifyJSON(userID, "ed25519:other", publicKey, got); err != nil {
+		t.Errorf("added signature doesn't verify: %s", err)
+	}
+	if err = json.Unmarshal(got, &object); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %s", err)
+	}
+	if string(object.Signatures[userID]["ed25519:DEVICE"]) != "signature" {
+		t.Errorf("existing signature was lost: %s", string(got))
+	}
+}
+
+func TestPerformUploadDeviceKeysReplacesKeys(t *testing.T) {
+	a, producer, clean := mustCreateKeyInternalAPI(t)
+	defer clean()
+	userID := "@alice:localhost"
+	master := mustMakeCrossSigningKey(t, userID, api.CrossSigningKeyPurposeMaster, nil)
+	selfSigning := mustMakeCrossSigningKey(t, userID, api.CrossSigningKeyPurposeSelfSigning, master)
+	userSigning := mustMakeCrossSigningKey(t, userID, api.CrossSigningKeyPurposeUserSigning, master)
+
+	var res api.PerformUploadDeviceKeysResponse
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         userID,
+		MasterKey:      master.keyJSON,
+		SelfSigningKey: selfSigning.keyJSON,
+		UserSigningKey: userSigning.keyJSON,
+	}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys returned error: %s", res.Error)
+	}
+	// other servers are told about the master and self-signing keys, but not the user-signing key
+	message := producer.lastMessage(t)
+	if message.Type != api.TypeCrossSigningUpdate || message.CrossSigningKeyUpdate == nil {
+		t.Fatalf("got key change message %+v, want a cross-signing update for other servers", message)
+	}
+	if !bytes.Equal(message.CrossSigningKeyUpdate.MasterKey, master.keyJSON) ||
+		!bytes.Equal(message.CrossSigningKeyUpdate.SelfSigningKey, selfSigning.keyJSON) {
+		t.Errorf("got cross-signing key update %+v, want the uploaded master and self-signing keys", message.CrossSigningKeyUpdate)
+	}
+
+	// uploading the same master key again with a new self-signing key keeps the user-signing key
+	newSelfSigning := mustMakeCrossSigningKey(t, userID, api.CrossSigningKeyPurposeSelfSigning, master)
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         userID,
+		MasterKey:      master.keyJSON,
+		SelfSigningKey: newSelfSigning.keyJSON,
+	}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys returned error: %s", res.Error)
+	}
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		t.Fatalf("CrossSigningKeysForUser returned error: %s", err)
+	}
+	if !bytes.Equal(keys[api.CrossSigningKeyPurposeSelfSigning], newSelfSigning.keyJSON) ||
+		!bytes.Equal(keys[api.CrossSigningKeyPurposeUserSigning], userSigning.keyJSON) {
+		t.Errorf("got keys %v, want the new self-signing key and the old user-signing key", keys)
+	}
+
+	// a new master key removes the keys signed by the old one
+	newMaster := mustMakeCrossSigningKey(t, userID, api.CrossSigningKeyPurposeMaster, nil)
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:    userID,
+		MasterKey: newMaster.keyJSON,
+	}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys returned error: %s", res.Error)
+	}
+	if keys, err = a.DB.CrossSigningKeysForUser(ctx, userID); err != nil {
+		t.Fatalf("CrossSigningKeysForUser returned error: %s", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[api.CrossSigningKeyPurposeMaster], newMaster.keyJSON) {
+		t.Errorf("got keys %v, want only the new master key", keys)
+	}
+
+	// keys signed by the old master key are rejected from then on
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         userID,
+		SelfSigningKey: selfSigning.keyJSON,
+	}, &res)
+	if res.Error == nil || !res.Error.IsInvalidSignature {
+		t.Errorf("got error %v uploading a key signed by the old master key, want an invalid signature error", res.Error)
+	}
+}
+
+func TestPerformUploadDeviceSignatures(t *testing.T) {
+	a, producer, clean := mustCreateKeyInternalAPI(t)
+	defer clean()
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	aliceMaster := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeMaster, nil)
+	aliceSelfSigning := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeSelfSigning, aliceMaster)
+	aliceUserSigning := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeUserSigning, aliceMaster)
+	bobMaster := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeMaster, nil)
+	for userID, req := range map[string]*api.PerformUploadDeviceKeysRequest{
+		alice: {MasterKey: aliceMaster.keyJSON, SelfSigningKey: aliceSelfSigning.keyJSON, UserSigningKey: aliceUserSigning.keyJSON},
+		bob:   {MasterKey: bobMaster.keyJSON},
+	} {
+		req.UserID = userID
+		var res api.PerformUploadDeviceKeysResponse
+		a.PerformUploadDeviceKeys(ctx, req, &res)
+		if res.Error != nil {
+			t.Fatalf("PerformUploadDeviceKeys returned error: %s", res.Error)
+		}
+	}
+
+	// alice has a device with its own key, which is used to sign the master key
+	devicePublicKey, devicePrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	device := &crossSigningKey{keyID: "ed25519:DEVICE", privateKey: devicePrivateKey}
+	deviceKeyJSON := json.RawMessage(`{"user_id":"` + alice + `","device_id":"DEVICE","algorithms":["m.megolm.v1.aes-sha2"],"keys":{"ed25519:DEVICE":"` +
+		gomatrixserverlib.Base64Bytes(devicePublicKey).Encode() + `"}}`)
+	deviceKeyJSON = device.mustSign(t, alice, deviceKeyJSON)
+	err = a.DB.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{UserID: alice, DeviceID: "DEVICE", KeyJSON: deviceKeyJSON}},
+	})
+	if err != nil {
+		t.Fatalf("StoreLocalDeviceKeys returned error: %s", err)
+	}
+	impostor := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeSelfSigning, nil)
+	// signWithKeyID signs the JSON with the impostor key, but claims that the signature was made with the given key.
+	signWithKeyID := func(userID string, keyJSON json.RawMessage, keyID gomatrixserverlib.KeyID) json.RawMessage {
+		var signed api.CrossSigningKey
+		if err := json.Unmarshal(impostor.mustSign(t, userID, keyJSON), &signed); err != nil {
+			t.Fatalf("failed to unmarshal signed JSON: %s", err)
+		}
+		signature := signed.Signatures[userID][impostor.keyID]
+		result, err := addSignature(keyJSON, userID, keyID, signature)
+		if err != nil {
+			t.Fatalf("addSignature returned error: %s", err)
+		}
+		return result
+	}
+	aliceMasterKeyID := string(aliceMaster.keyID[len("ed25519:"):])
+	bobMasterKeyID := string(bobMaster.keyID[len("ed25519:"):])
+
+	testCases := []struct {
+		name         string
+		targetUserID string
+		targetKeyID  string
+		keyJSON      json.RawMessage
+		wantErr      bool
+	}{
+		{
+			name:         "device signed with the wrong key",
+			targetUserID: alice,
+			targetKeyID:  "DEVICE",
+			keyJSON:      signWithKeyID(alice, deviceKeyJSON, aliceSelfSigning.keyID),
+			wantErr:      true,
+		},
+		{
+			name:         "device signed with the self-signing key",
+			targetUserID: alice,
+			targetKeyID:  "DEVICE",
+			keyJSON:      aliceSelfSigning.mustSign(t, alice, deviceKeyJSON),
+		},
+		{
+			name:         "master key signed with the wrong key",
+			targetUserID: alice,
+			targetKeyID:  aliceMasterKeyID,
+			keyJSON:      signWithKeyID(alice, aliceMaster.keyJSON, device.keyID),
+			wantErr:      true,
+		},
+		{
+			name:         "master key signed by a device",
+			targetUserID: alice,
+			targetKeyID:  aliceMasterKeyID,
+			keyJSON:      device.mustSign(t, alice, aliceMaster.keyJSON),
+		},
+		{
+			name:         "other user's master key signed with the wrong key",
+			targetUserID: bob,
+			targetKeyID:  bobMasterKeyID,
+			keyJSON:      signWithKeyID(alice, bobMaster.keyJSON, aliceUserSigning.keyID),
+			wantErr:      true,
+		},
+		{
+			name:         "other user's master key signed with the user-signing key",
+			targetUserID: bob,
+			targetKeyID:  bobMasterKeyID,
+			keyJSON:      aliceUserSigning.mustSign(t, alice, bobMaster.keyJSON),
+		},
+	}
+	for _, tc := range testCases {
+		var res api.PerformUploadDeviceSignaturesResponse
+		a.PerformUploadDeviceSignatures(ctx, &api.PerformUploadDeviceSignaturesRequest{
+			UserID: alice,
+			Signatures: map[string]map[string]json.RawMessage{
+				tc.targetUserID: {tc.targetKeyID: tc.keyJSON},
+			},
+		}, &res)
+		if res.Error != nil {
+			t.Fatalf("%s: PerformUploadDeviceSignatures returned error: %s", tc.name, res.Error)
+		}
+		keyErr := res.Failures[tc.targetUserID][tc.targetKeyID]
+		if tc.wantErr {
+			if keyErr == nil || !keyErr.IsInvalidSignature {
+				t.Errorf("%s: got error %v, want an invalid signature error", tc.name, keyErr)
+			}
+			continue
+		}
+		if keyErr != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, keyErr)
+			continue
+		}
+		if message := producer.lastMessage(t); message.UserID != tc.targetUserID {
+			t.Errorf("%s: got key change message for %s, want %s", tc.name, message.UserID, tc.targetUserID)
+		}
+	}
+
+	// the signatures are stored alongside the keys they sign
+	deviceKeys, err := a.DB.DeviceKeysForUser(ctx, alice, []string{"DEVICE"})
+	if err != nil || len(deviceKeys) != 1 {
+		t.Fatalf("DeviceKeysForUser returned (%v, %v)", deviceKeys, err)
+	}
+	selfSigningPublicKey := aliceSelfSigning.privateKey.Public().(ed25519.PublicKey)
+	if err = gomatrixserverlib.VerifyJSON(alice, aliceSelfSigning.keyID, selfSigningPublicKey, deviceKeys[0].KeyJSON); err != nil {
+		t.Errorf("stored device keys aren't signed by the self-signing key: %s", err)
+	}
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, alice)
+	if err != nil {
+		t.Fatalf("CrossSigningKeysForUser returned error: %s", err)
+	}
+	if err = gomatrixserverlib.VerifyJSON(alice, device.keyID, devicePublicKey, keys[api.CrossSigningKeyPurposeMaster]); err != nil {
+		t.Errorf("stored master key isn't signed by the device: %s", err)
+	}
+
+	// alice sees her signature of bob's master key, until she replaces her user-signing key
+	res := &api.QueryKeysResponse{MasterKeys: map[string]json.RawMessage{bob: bobMaster.keyJSON}}
+	if err = a.addUserSigningSignatures(ctx, alice, res); err != nil {
+		t.Fatalf("addUserSigningSignatures returned error: %s", err)
+	}
+	userSigningPublicKey := aliceUserSigning.privateKey.Public().(ed25519.PublicKey)
+	if err = gomatrixserverlib.VerifyJSON(alice, aliceUserSigning.keyID, userSigningPublicKey, res.MasterKeys[bob]); err != nil {
+		t.Errorf("bob's master key isn't signed by alice's user-signing key: %s", err)
+	}
+	newMaster := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeMaster, nil)
+	var uploadRes api.PerformUploadDeviceKeysResponse
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         alice,
+		MasterKey:      newMaster.keyJSON,
+		UserSigningKey: mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeUserSigning, newMaster).keyJSON,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys returned error: %s", uploadRes.Error)
+	}
+	res = &api.QueryKeysResponse{MasterKeys: map[string]json.RawMessage{bob: bobMaster.keyJSON}}
+	if err = a.addUserSigningSignatures(ctx, alice, res); err != nil {
+		t.Fatalf("addUserSigningSignatures returned error: %s", err)
+	}
+	if !bytes.Equal(res.MasterKeys[bob], bobMaster.keyJSON) {
+		t.Errorf("got bob's master key %s, want it without the signature by the old user-signing key", string(res.MasterKeys[bob]))
+	}
+}
+
+func TestQueryKeysIgnoresOtherServersUsers(t *testing.T) {
+	a, _, cleanup := mustCreateKeyInternalAPI(t)
+	defer cleanup()
+	alice := "@alice:localhost"
+	bob := "@bob:other.com"
+	eve := "@eve:evil.com"
+	aliceMaster := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeMaster, nil)
+	bobMaster := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeMaster, nil)
+	eveMaster := mustMakeCrossSigningKey(t, eve, api.CrossSigningKeyPurposeMaster, nil)
+	fakeAlice := mustMakeCrossSigningKey(t, alice, api.CrossSigningKeyPurposeMaster, nil)
+	fakeBob := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeMaster, nil)
+
+	var uploadRes api.PerformUploadDeviceKeysResponse
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:    alice,
+		MasterKey: aliceMaster.keyJSON,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys returned an error: %s", uploadRes.Error)
+	}
+	// evil.com answers for its own user, and also tries to replace the keys of users on other servers
+	setRemoteKeyResponses(t, a, map[string]string{
+		"evil.com": fmt.Sprintf(
+			`{"device_keys":{"%s":{"FAKE":{}}},"master_keys":{"%s":%s,"%s":%s,"%s":%s},"self_signing_keys":{"%s":%s}}`,
+			bob, eve, eveMaster.keyJSON, alice, fakeAlice.keyJSON, bob, fakeBob.keyJSON, bob, fakeBob.keyJSON,
+		),
+		"other.com": fmt.Sprintf(`{"master_keys":{"%s":%s}}`, bob, bobMaster.keyJSON),
+	})
+
+	var queryRes api.QueryKeysResponse
+	a.QueryKeys(ctx, &api.QueryKeysRequest{
+		UserToDevices: map[string][]string{alice: {}, bob: {}, eve: {}},
+	}, &queryRes)
+	if queryRes.Error != nil {
+		t.Fatalf("QueryKeys returned an error: %s", queryRes.Error)
+	}
+	for userID, want := range map[string]*crossSigningKey{alice: aliceMaster, bob: bobMaster, eve: eveMaster} {
+		if !bytes.Equal(queryRes.MasterKeys[userID], want.keyJSON) {
+			t.Errorf("got master key %s for %s, want %s", queryRes.MasterKeys[userID], userID, want.keyJSON)
+		}
+	}
+	if _, ok := queryRes.SelfSigningKeys[bob]; ok {
+		t.Errorf("got a self-signing key for %s from another server", bob)
+	}
+	if _, ok := queryRes.DeviceKeys[bob]["FAKE"]; ok {
+		t.Errorf("got a device key for %s from another server", bob)
+	}
+}
+
+func TestQueryKeysStoredRemoteKeys(t *testing.T) {
+	a, producer, cleanup := mustCreateKeyInternalAPI(t)
+	defer cleanup()
+	bob := "@bob:other.com"
+	masterKey := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeMaster, nil)
+	selfSigningKey := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeSelfSigning, masterKey)
+	queryKeys := func() api.QueryKeysResponse {
+		t.Helper()
+		var queryRes api.QueryKeysResponse
+		a.QueryKeys(ctx, &api.QueryKeysRequest{
+			UserToDevices: map[string][]string{bob: {}},
+		}, &queryRes)
+		if queryRes.Error != nil {
+			t.Fatalf("QueryKeys returned an error: %s", queryRes.Error)
+		}
+		return queryRes
+	}
+
+	// the keys were sent to us in an m.signing_key_update EDU, and are served when other.com can't be reached
+	var uploadRes api.PerformUploadDeviceKeysResponse
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         bob,
+		MasterKey:      masterKey.keyJSON,
+		SelfSigningKey: selfSigningKey.keyJSON,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys returned an error: %s", uploadRes.Error)
+	}
+	setRemoteKeyResponses(t, a, nil)
+	queryRes := queryKeys()
+	if _, ok := queryRes.Failures["other.com"]; !ok {
+		t.Errorf("other.com wasn't reported as failing")
+	}
+	if !bytes.Equal(queryRes.MasterKeys[bob], masterKey.keyJSON) || !bytes.Equal(queryRes.SelfSigningKeys[bob], selfSigningKey.keyJSON) {
+		t.Errorf("got keys %s and %s, want the stored keys", queryRes.MasterKeys[bob], queryRes.SelfSigningKeys[bob])
+	}
+
+	// keys which don't verify are ignored
+	badSelfSigningKey := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeSelfSigning, nil)
+	setRemoteKeyResponses(t, a, map[string]string{
+		"other.com": fmt.Sprintf(`{"self_signing_keys":{"%s":%s}}`, bob, badSelfSigningKey.keyJSON),
+	})
+	queryRes = queryKeys()
+	if !bytes.Equal(queryRes.SelfSigningKeys[bob], selfSigningKey.keyJSON) {
+		t.Errorf("got self-signing key %s, want the stored key", queryRes.SelfSigningKeys[bob])
+	}
+
+	// a new master key from other.com replaces the stored keys, and our users are told about it
+	newMasterKey := mustMakeCrossSigningKey(t, bob, api.CrossSigningKeyPurposeMaster, nil)
+	sent := len(producer.messages)
+	setRemoteKeyResponses(t, a, map[string]string{
+		"other.com": fmt.Sprintf(`{"master_keys":{"%s":%s}}`, bob, newMasterKey.keyJSON),
+	})
+	queryRes = queryKeys()
+	if !bytes.Equal(queryRes.MasterKeys[bob], newMasterKey.keyJSON) {
+		t.Errorf("got master key %s, want the new key", queryRes.MasterKeys[bob])
+	}
+	if _, ok := queryRes.SelfSigningKeys[bob]; ok {
+		t.Errorf("the self-signing key signed by the old master key is still served")
+	}
+	if msg := producer.lastMessage(t); len(producer.messages) == sent || msg.Type != api.TypeCrossSigningUpdate || msg.UserID != bob {
+		t.Errorf("got key change %+v, want a cross-signing update for %s", msg, bob)
+	}
+	setRemoteKeyResponses(t, a, nil)
+	if queryRes = queryKeys(); !bytes.Equal(queryRes.MasterKeys[bob], newMasterKey.keyJSON) {
+		t.Errorf("got master key %s when other.com failed, want the new key", queryRes.MasterKeys[bob])
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// How long to wait for a remote server to return a device list.
+	deviceListRequestTimeout = 30 * time.Second
+	// How long to wait before retrying a server which failed to return a
+	// device list. This doubles on each failure, up to the maximum.
+	deviceListMinBackoff = 10 * time.Second
+	deviceListMaxBackoff = time.Hour
+)
+
+// DeviceListUpdater handles device list updates from remote servers.
+//
+// If we have all of the prev_ids of an update then it is stored and a key
+// change is emitted straight away. If any are missing then we have missed
+// an update, so the user's device list is marked as stale and a worker is
+// asked to fetch the whole list again with /user/devices. Stale lists are
+// persisted, so they are fetched again if the server restarts.
+//
+// Each remote server is handled by one of a fixed number of workers, which
+// bounds the number of requests made at once and means that only one request
+// is made to each server at a time. Servers which fail are retried with
+// exponential backoff.
+type DeviceListUpdater struct {
+	// A map from user_id to a mutex. Used when we are missing prev IDs so we don't make more than 1
+	// request to the remote server and race.
+	// TODO: Put in an LRU cache to bound growth
+	userIDToMutex map[string]*sync.Mutex
+	mu            *sync.Mutex // protects userIDToMutex
+
+	db          DeviceListUpdaterDatabase
+	producer    KeyChangeProducer
+	fedClient   DeviceListUpdaterFederation
+	workerChans []chan gomatrixserverlib.ServerName
+
+	backoffMu sync.Mutex // protects backoffs
+	backoffs  map[gomatrixserverlib.ServerName]*serverBackoff
+}
+
+// serverBackoff records how long to wait before asking a server for device
+// lists again.
+type serverBackoff struct {
+	attempts int
+	until    time.Time
+}
+
+// DeviceListUpdaterDatabase is the subset of functionality from storage.Database required for the updater.
+// Useful for testing.
+type DeviceListUpdaterDatabase interface {
+	// StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
+	// If no domains are given, all user IDs with stale device lists are returned.
+	StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+
+	// MarkDeviceListStale sets the stale bit for this user to isStale.
+	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// StoreRemoteDeviceKeys persists the given keys. Keys with the same user ID and device ID will be replaced. An empty KeyJSON removes the key
+	// for this (user, device). Does not modify the stream ID for keys. All existing keys for the users in clearUserIDs are deleted first.
+	StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage, clearUserIDs []string) error
+
+	// PrevIDsExists returns true if all prev IDs exist for this user.
+	PrevIDsExists(ctx context.Context, userID string, prevIDs []int) (bool, error)
+}
+
+// KeyChangeProducer is the interface for producers.KeyChange useful for testing.
+type KeyChangeProducer interface {
+	ProduceKeyChanges(keys []api.DeviceMessage) error
+}
+
+// DeviceListUpdaterFederation fetches the device lists of remote users.
+type DeviceListUpdaterFederation interface {
+	GetUserDevices(ctx context.Context, s gomatrixserverlib.ServerName, userID string) (gomatrixserverlib.RespUserDevices, error)
+}
+
+// NewDeviceListUpdater creates a new updater which fetches fresh device lists when they go stale.
+func NewDeviceListUpdater(
+	db DeviceListUpdaterDatabase, producer KeyChangeProducer, fedClient DeviceListUpdaterFederation,
+	numWorkers int,
+) *DeviceListUpdater {
+	return &DeviceListUpdater{
+		userIDToMutex: make(map[string]*sync.Mutex),
+		mu:            &sync.Mutex{},
+		db:            db,
+		producer:      producer,
+		fedClient:     fedClient,
+		workerChans:   make([]chan gomatrixserverlib.ServerName, numWorkers),
+		backoffs:      make(map[gomatrixserverlib.ServerName]*serverBackoff),
+	}
+}
+
+// Start the device list updater, which will try to refresh any stale device lists.
+func (u *DeviceListUpdater) Start() error {
+	for i := 0; i < len(u.workerChans); i++ {
+		// Allocate a small buffer per channel.
+		// If the buffer limit is reached, backpressure will cause the processing of EDUs
+		// to stop (in this transaction) until key requests can be made.
+		ch := make(chan gomatrixserverlib.ServerName, 10)
+		u.workerChans[i] = ch
+		go u.worker(ch)
+	}
+
+	staleLists, err := u.db.StaleDeviceLists(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	servers := make(map[gomatrixserverlib.ServerName]bool)
+	for _, userID := range staleLists {
+		_, serverName, splitErr := gomatrixserverlib.SplitID('@', userID)
+		if splitErr != nil {
+			continue
+		}
+		servers[serverName] = true
+	}
+	for serverName := range servers {
+		u.notifyWorkers(serverName)
+	}
+	return nil
+}
+
+func (u *DeviceListUpdater) mutex(userID string) *sync.Mutex {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.userIDToMutex[userID] == nil {
+		u.userIDToMutex[userID] = &sync.Mutex{}
+	}
+	return u.userIDToMutex[userID]
+}
+
+// Update stores the device list update from a remote server. If the update
+// can't be applied because we have missed an earlier one, the user's whole
+// device list is fetched again in the background.
+func (u *DeviceListUpdater) Update(ctx context.Context, event gomatrixserverlib.DeviceListUpdateEvent) error {
+	isDeviceListStale, err := u.update(ctx, event)
+	if err != nil {
+		return err
+	}
+	if !isDeviceListStale {
+		return nil
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', event.UserID)
+	if err != nil {
+		return err
+	}
+	u.notifyWorkers(serverName)
+	return nil
+}
+
+func (u *DeviceListUpdater) update(ctx context.Context, event gomatrixserverlib.DeviceListUpdateEvent) (bool, error) {
+	mu := u.mutex(event.UserID)
+	mu.Lock()
+	defer mu.Unlock()
+	// check if we have the prev IDs
+	exists, err := u.db.PrevIDsExists(ctx, event.UserID, event.PrevID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if prev ids exist: %w", err)
+	}
+
+	// if we're missing an ID go and fetch it from the remote HS
+	if !exists {
+		if err = u.db.MarkDeviceListStale(ctx, event.UserID, true); err != nil {
+			return false, fmt.Errorf("failed to mark device list as stale: %w", err)
+		}
+		return true, nil
+	}
+
+	// if we haven't missed anything update the database and notify users
+	key := api.DeviceMessage{
+		DeviceKeys: api.DeviceKeys{
+			DeviceID:    event.DeviceID,
+			DisplayName: event.DeviceDisplayName,
+			UserID:      event.UserID,
+		},
+		StreamID: event.StreamID,
+	}
+	if !event.Deleted {
+		key.KeyJSON = event.Keys
+	}
+	keys := []api.DeviceMessage{key}
+	if err = u.db.StoreRemoteDeviceKeys(ctx, keys, nil); err != nil {
+		return false, fmt.Errorf("failed to store remote device keys: %w", err)
+	}
+	// ALWAYS emit key changes when we've been poked over federation just in case
+	// this poke is important for something.
+	if err = u.producer.ProduceKeyChanges(keys); err != nil {
+		return false, fmt.Errorf("failed to emit remote device key changes: %w", err)
+	}
+	return false, nil
+}
+
+// notifyWorkers asks the worker for the server to fetch its stale device lists.
+func (u *DeviceListUpdater) notifyWorkers(serverName gomatrixserverlib.ServerName) {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(serverName))
+	index := int(hash.Sum32() % uint32(len(u.workerChans)))
+	u.workerChans[index] <- serverName
+}
+
+func (u *DeviceListUpdater) worker(ch chan gomatrixserverlib.ServerName) {
+	for serverName := range ch {
+		// A retry is already scheduled for servers we are backing off from.
+		if u.backingOff(serverName) {
+			continue
+		}
+		u.processServer(serverName)
+	}
+}
+
+// processServer fetches all of the stale device lists for users on the
+// server, stopping at the first failure.
+func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerName) {
+	ctx := context.Background()
+	logger := util.GetLogger(ctx).WithField("server_name", serverName)
+	userIDs, err := u.db.StaleDeviceLists(ctx, []gomatrixserverlib.ServerName{serverName})
+	if err != nil {
+		logger.WithError(err).Error("failed to load stale device lists")
+		return
+	}
+	for _, userID := range userIDs {
+		if err = u.processUser(ctx, serverName, userID); err != nil {
+			logger.WithError(err).WithField("user_id", userID).Warn("failed to update stale device list")
+			u.backoff(serverName)
+			return
+		}
+	}
+	u.backoffMu.Lock()
+	delete(u.backoffs, serverName)
+	u.backoffMu.Unlock()
+}
+
+// processUser replaces the user's device list with the one from their server.
+func (u *DeviceListUpdater) processUser(ctx context.Context, serverName gomatrixserverlib.ServerName, userID string) error {
+	mu := u.mutex(userID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	fedCtx, cancel := context.WithTimeout(ctx, deviceListRequestTimeout)
+	defer cancel()
+	res, err := u.fedClient.GetUserDevices(fedCtx, serverName, userID)
+	if err != nil {
+		return fmt.Errorf("failed to query device list: %w", err)
+	}
+	if res.UserID != userID {
+		return fmt.Errorf("device list is for the wrong user %q", res.UserID)
+	}
+
+	keys := make([]api.DeviceMessage, 0, len(res.Devices))
+	for _, device := range res.Devices {
+		// don't let servers give us keys for other users or devices
+		if device.Keys.UserID != userID || device.Keys.DeviceID != device.DeviceID {
+			continue
+		}
+		keyJSON, jsonErr := json.Marshal(device.Keys)
+		if jsonErr != nil {
+			continue
+		}
+		keys = append(keys, api.DeviceMessage{
+			DeviceKeys: api.DeviceKeys{
+				DeviceID:    device.DeviceID,
+				DisplayName: device.DisplayName,
+				UserID:      userID,
+				KeyJSON:     keyJSON,
+			},
+			StreamID: res.StreamID,
+		})
+	}
+	if err = u.db.StoreRemoteDeviceKeys(ctx, keys, []string{userID}); err != nil {
+		return fmt.Errorf("failed to store remote device keys: %w", err)
+	}
+	if err = u.db.MarkDeviceListStale(ctx, userID, false); err != nil {
+		return fmt.Errorf("failed to mark device list as fresh: %w", err)
+	}
+
+	// We don't know what changed while the list was stale, so always emit a
+	// change, even if the user has no devices left.
+	changes := keys
+	if len(changes) == 0 {
+		changes = []api.DeviceMessage{{DeviceKeys: api.DeviceKeys{UserID: userID}, StreamID: res.StreamID}}
+	}
+	if err = u.producer.ProduceKeyChanges(changes); err != nil {
+		return fmt.Errorf("failed to emit remote device key changes: %w", err)
+	}
+	return nil
+}
+
+func (u *DeviceListUpdater) backingOff(serverName gomatrixserverlib.ServerName) bool {
+	u.backoffMu.Lock()
+	defer u.backoffMu.Unlock()
+	b := u.backoffs[serverName]
+	return b != nil && time.Now().Before(b.until)
+}
+
+// backoff stops the server from being asked for device lists for a while,
+// then schedules a retry.
+func (u *DeviceListUpdater) backoff(serverName gomatrixserverlib.ServerName) {
+	u.backoffMu.Lock()
+	b := u.backoffs[serverName]
+	if b == nil {
+		b = &serverBackoff{}
+		u.backoffs[serverName] = b
+	}
+	b.attempts++
+	delay := deviceListMinBackoff
+	for i := 1; i < b.attempts && delay < deviceListMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > deviceListMaxBackoff {
+		delay = deviceListMaxBackoff
+	}
+	b.until = time.Now().Add(delay)
+	u.backoffMu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		u.notifyWorkers(serverName)
+	})
+}
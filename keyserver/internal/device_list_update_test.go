@@ -0,0 +1,290 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var ctx = context.Background()
+
+type mockKeyChangeProducer struct {
+	events chan []api.DeviceMessage
+}
+
+func (p *mockKeyChangeProducer) ProduceKeyChanges(keys []api.DeviceMessage) error {
+	p.events <- keys
+	return nil
+}
+
+type mockDeviceListUpdaterDatabase struct {
+	mu           sync.Mutex
+	staleUsers   map[string]bool
+	prevIDsExist bool
+	storedKeys   []api.DeviceMessage
+	clearedUsers []string
+}
+
+func (d *mockDeviceListUpdaterDatabase) StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []string
+	for userID, isStale := range d.staleUsers {
+		if !isStale {
+			continue
+		}
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(domains) == 0 || serverName == domains[0] {
+			result = append(result, userID)
+		}
+	}
+	return result, nil
+}
+
+func (d *mockDeviceListUpdaterDatabase) MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.staleUsers[userID] = isStale
+	return nil
+}
+
+func (d *mockDeviceListUpdaterDatabase) isStale(userID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.staleUsers[userID]
+}
+
+func (d *mockDeviceListUpdaterDatabase) StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage, clearUserIDs []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.storedKeys = append(d.storedKeys, keys...)
+	d.clearedUsers = append(d.clearedUsers, clearUserIDs...)
+	return nil
+}
+
+func (d *mockDeviceListUpdaterDatabase) PrevIDsExists(ctx context.Context, userID string, prevIDs []int) (bool, error) {
+	return d.prevIDsExist, nil
+}
+
+type mockDeviceListUpdaterFederation struct {
+	getUserDevices func(s gomatrixserverlib.ServerName, userID string) (gomatrixserverlib.RespUserDevices, error)
+}
+
+func (f *mockDeviceListUpdaterFederation) GetUserDevices(
+	ctx context.Context, s gomatrixserverlib.ServerName, userID string,
+) (gomatrixserverlib.RespUserDevices, error) {
+	return f.getUserDevices(s, userID)
+}
+
+func newTestUpdater(
+	t *testing.T, db *mockDeviceListUpdaterDatabase, fed *mockDeviceListUpdaterFederation,
+) (*DeviceListUpdater, *mockKeyChangeProducer) {
+	producer := &mockKeyChangeProducer{
+		events: make(chan []api.DeviceMessage, 10),
+	}
+	updater := NewDeviceListUpdater(db, producer, fed, 1)
+	if err := updater.Start(); err != nil {
+		t.Fatalf("failed to start updater: %s", err)
+	}
+	return updater, producer
+}
+
+func waitForKeyChanges(t *testing.T, producer *mockKeyChangeProducer) []api.DeviceMessage {
+	t.Helper()
+	select {
+	case keys := <-producer.events:
+		return keys
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for key changes")
+		return nil
+	}
+}
+
+func TestUpdateHavePrevID(t *testing.T) {
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers:   make(map[string]bool),
+		prevIDsExist: true,
+	}
+	fed := &mockDeviceListUpdaterFederation{
+		getUserDevices: func(s gomatrixserverlib.ServerName, userID string) (gomatrixserverlib.RespUserDevices, error) {
+			return gomatrixserverlib.RespUserDevices{}, fmt.Errorf("shouldn't be called")
+		},
+	}
+	updater, producer := newTestUpdater(t, db, fed)
+	event := gomatrixserverlib.DeviceListUpdateEvent{
+		DeviceDisplayName: "Foo Bar",
+		Deleted:           false,
+		DeviceID:          "FOO",
+		Keys:              []byte(`{"key":"value"}`),
+		PrevID:            []int{0},
+		StreamID:          1,
+		UserID:            "@alice:localhost",
+	}
+	if err := updater.Update(ctx, event); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+	want := api.DeviceMessage{
+		StreamID: event.StreamID,
+		DeviceKeys: api.DeviceKeys{
+			DeviceID:    event.DeviceID,
+			DisplayName: event.DeviceDisplayName,
+			KeyJSON:     event.Keys,
+			UserID:      event.UserID,
+		},
+	}
+	if !reflect.DeepEqual(db.storedKeys, []api.DeviceMessage{want}) {
+		t.Errorf("Update didn't store correct keys, got %v want %v", db.storedKeys, want)
+	}
+	if keys := waitForKeyChanges(t, producer); !reflect.DeepEqual(keys, []api.DeviceMessage{want}) {
+		t.Errorf("Update didn't emit correct key changes, got %v want %v", keys, want)
+	}
+	if db.isStale(event.UserID) {
+		t.Errorf("%s was marked as stale", event.UserID)
+	}
+}
+
+func TestUpdateNoPrevID(t *testing.T) {
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers:   make(map[string]bool),
+		prevIDsExist: false,
+	}
+	remoteUserID := "@alice:example.somewhere"
+	keyJSON := `{"user_id":"` + remoteUserID + `","device_id":"JLAFKJWSCS","algorithms":["m.olm.v1.curve25519-aes-sha2"],"keys":{"ed25519:JLAFKJWSCS":"lEuiRJBit0IG6nUf5pUzWTUEsRVVe/HJkoKuEww9ULI"},"signatures":{}}`
+	fed := &mockDeviceListUpdaterFederation{
+		getUserDevices: func(s gomatrixserverlib.ServerName, userID string) (gomatrixserverlib.RespUserDevices, error) {
+			if s != "example.somewhere" || userID != remoteUserID {
+				return gomatrixserverlib.RespUserDevices{}, fmt.Errorf("unexpected request for %s from %s", userID, s)
+			}
+			var keys gomatrixserverlib.RespUserDeviceKeys
+			if err := json.Unmarshal([]byte(keyJSON), &keys); err != nil {
+				return gomatrixserverlib.RespUserDevices{}, err
+			}
+			return gomatrixserverlib.RespUserDevices{
+				UserID:   remoteUserID,
+				StreamID: 5,
+				Devices: []gomatrixserverlib.RespUserDevice{
+					{DeviceID: "JLAFKJWSCS", DisplayName: "Mobile Phone", Keys: keys},
+					// keys for another user should be ignored
+					{DeviceID: "OTHER", Keys: gomatrixserverlib.RespUserDeviceKeys{UserID: "@bob:localhost", DeviceID: "OTHER"}},
+				},
+			}, nil
+		},
+	}
+	updater, producer := newTestUpdater(t, db, fed)
+	event := gomatrixserverlib.DeviceListUpdateEvent{
+		DeviceDisplayName: "Mobile Phone",
+		Deleted:           false,
+		DeviceID:          "another_device_id",
+		Keys:              []byte(`{"key":"value"}`),
+		PrevID:            []int{3},
+		StreamID:          4,
+		UserID:            remoteUserID,
+	}
+	if err := updater.Update(ctx, event); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+
+	keys := waitForKeyChanges(t, producer)
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key change, got %d: %v", len(keys), keys)
+	}
+	if keys[0].UserID != remoteUserID || keys[0].DeviceID != "JLAFKJWSCS" || keys[0].StreamID != 5 {
+		t.Errorf("wrong key change emitted: %+v", keys[0])
+	}
+	var gotKeys gomatrixserverlib.RespUserDeviceKeys
+	if err := json.Unmarshal(keys[0].KeyJSON, &gotKeys); err != nil {
+		t.Fatalf("emitted key JSON is malformed: %s", err)
+	}
+	if gotKeys.Keys["ed25519:JLAFKJWSCS"] != "lEuiRJBit0IG6nUf5pUzWTUEsRVVe/HJkoKuEww9ULI" {
+		t.Errorf("emitted key JSON is wrong: %s", string(keys[0].KeyJSON))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !reflect.DeepEqual(db.storedKeys, keys) {
+		t.Errorf("stored keys %v don't match emitted keys %v", db.storedKeys, keys)
+	}
+	if !reflect.DeepEqual(db.clearedUsers, []string{remoteUserID}) {
+		t.Errorf("expected old keys for %s to be cleared, cleared %v", remoteUserID, db.clearedUsers)
+	}
+	if db.staleUsers[remoteUserID] {
+		t.Errorf("%s is still marked as stale", remoteUserID)
+	}
+}
+
+func TestUpdateBacksOffFailingServer(t *testing.T) {
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers:   make(map[string]bool),
+		prevIDsExist: false,
+	}
+	requests := make(chan string, 10)
+	fed := &mockDeviceListUpdaterFederation{
+		getUserDevices: func(s gomatrixserverlib.ServerName, userID string) (gomatrixserverlib.RespUserDevices, error) {
+			requests <- userID
+			return gomatrixserverlib.RespUserDevices{}, fmt.Errorf("server is down")
+		},
+	}
+	updater, _ := newTestUpdater(t, db, fed)
+	remoteUserID := "@alice:example.somewhere"
+	event := gomatrixserverlib.DeviceListUpdateEvent{
+		DeviceID: "FOO",
+		PrevID:   []int{3},
+		StreamID: 4,
+		UserID:   remoteUserID,
+	}
+	if err := updater.Update(ctx, event); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for device list request")
+	}
+
+	// Wait for the worker to finish with the failed request.
+	deadline := time.Now().Add(5 * time.Second)
+	for !updater.backingOff("example.somewhere") {
+		if time.Now().After(deadline) {
+			t.Fatalf("server wasn't backed off after failing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !db.isStale(remoteUserID) {
+		t.Errorf("%s should still be marked as stale", remoteUserID)
+	}
+
+	// Further updates shouldn't cause more requests to the server until the
+	// backoff has expired.
+	if err := updater.Update(ctx, event); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+	select {
+	case <-requests:
+		t.Errorf("server was asked for device lists while backing off")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
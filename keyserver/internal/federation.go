@@ -0,0 +1,93 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// RespQueryKeys is the response to /user/keys/query. Unlike
+// gomatrixserverlib.RespQueryKeys it includes cross-signing keys, and it
+// keeps the raw JSON of each key so that signatures can still be checked.
+type RespQueryKeys struct {
+	DeviceKeys      map[string]map[string]json.RawMessage `json:"device_keys"`
+	MasterKeys      map[string]json.RawMessage            `json:"master_keys"`
+	SelfSigningKeys map[string]json.RawMessage            `json:"self_signing_keys"`
+}
+
+// FederationKeyClient makes the key requests to other servers which the
+// federation client doesn't have methods for.
+type FederationKeyClient struct {
+	fedClient  *gomatrixserverlib.FederationClient
+	serverName gomatrixserverlib.ServerName
+	keyID      gomatrixserverlib.KeyID
+	privateKey ed25519.PrivateKey
+}
+
+// NewFederationKeyClient returns a FederationKeyClient which makes requests
+// with the given federation client, signed with this server's key.
+func NewFederationKeyClient(
+	cfg *config.Dendrite, fedClient *gomatrixserverlib.FederationClient,
+) *FederationKeyClient {
+	return &FederationKeyClient{
+		fedClient:  fedClient,
+		serverName: cfg.Matrix.ServerName,
+		keyID:      cfg.Matrix.KeyID,
+		privateKey: cfg.Matrix.PrivateKey,
+	}
+}
+
+// GetUserDevices implements DeviceListUpdaterFederation with
+// GET /_matrix/federation/v1/user/devices/{userID}.
+func (c *FederationKeyClient) GetUserDevices(
+	ctx context.Context, s gomatrixserverlib.ServerName, userID string,
+) (res gomatrixserverlib.RespUserDevices, err error) {
+	path := "/_matrix/federation/v1/user/devices/" + url.PathEscape(userID)
+	err = c.doRequest(ctx, gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path), &res)
+	return
+}
+
+// QueryKeys queries the device and cross-signing keys of users on a server
+// with POST /_matrix/federation/v1/user/keys/query.
+func (c *FederationKeyClient) QueryKeys(
+	ctx context.Context, s gomatrixserverlib.ServerName, keys map[string][]string,
+) (res RespQueryKeys, err error) {
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPost, s, "/_matrix/federation/v1/user/keys/query")
+	if err = fedReq.SetContent(map[string]interface{}{
+		"device_keys": keys,
+	}); err != nil {
+		return
+	}
+	err = c.doRequest(ctx, fedReq, &res)
+	return
+}
+
+func (c *FederationKeyClient) doRequest(ctx context.Context, fedReq gomatrixserverlib.FederationRequest, res interface{}) error {
+	if err := fedReq.Sign(c.serverName, c.keyID, c.privateKey); err != nil {
+		return err
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return c.fedClient.DoRequestAndParseResponse(ctx, req, res)
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,79 +34,28 @@ import (
 )
 
 type KeyInternalAPI struct {
-	DB         storage.Database
-	ThisServer gomatrixserverlib.ServerName
-	FedClient  *gomatrixserverlib.FederationClient
-	UserAPI    userapi.UserInternalAPI
-	Producer   *producers.KeyChange
-	// A map from user_id to a mutex. Used when we are missing prev IDs so we don't make more than 1
-	// request to the remote server and race.
-	// TODO: Put in an LRU cache to bound growth
-	UserIDToMutex map[string]*sync.Mutex
-	Mutex         *sync.Mutex // protects UserIDToMutex
+	DB           storage.Database
+	ThisServer   gomatrixserverlib.ServerName
+	FedClient    *gomatrixserverlib.FederationClient
+	FedKeyClient *FederationKeyClient
+	UserAPI      userapi.UserInternalAPI
+	Producer     *producers.KeyChange
+	Updater      *DeviceListUpdater
 }
 
 func (a *KeyInternalAPI) SetUserAPI(i userapi.UserInternalAPI) {
 	a.UserAPI = i
 }
 
-func (a *KeyInternalAPI) mutex(userID string) *sync.Mutex {
-	a.Mutex.Lock()
-	defer a.Mutex.Unlock()
-	if a.UserIDToMutex[userID] == nil {
-		a.UserIDToMutex[userID] = &sync.Mutex{}
-	}
-	return a.UserIDToMutex[userID]
-}
-
 func (a *KeyInternalAPI) InputDeviceListUpdate(
 	ctx context.Context, req *api.InputDeviceListUpdateRequest, res *api.InputDeviceListUpdateResponse,
 ) {
-	mu := a.mutex(req.Event.UserID)
-	mu.Lock()
-	defer mu.Unlock()
-	// check if we have the prev IDs
-	exists, err := a.DB.PrevIDsExists(ctx, req.Event.UserID, req.Event.PrevID)
+	err := a.Updater.Update(ctx, req.Event)
 	if err != nil {
 		res.Error = &api.KeyError{
-			Err: fmt.Sprintf("failed to check if prev ids exist: %s", err),
-		}
-		return
-	}
-
-	// if we haven't missed anything update the database and notify users
-	if exists {
-		keys := []api.DeviceMessage{
-			{
-				DeviceKeys: api.DeviceKeys{
-					DeviceID:    req.Event.DeviceID,
-					DisplayName: req.Event.DeviceDisplayName,
-					KeyJSON:     req.Event.Keys,
-					UserID:      req.Event.UserID,
-				},
-				StreamID: req.Event.StreamID,
-			},
-		}
-		err = a.DB.StoreRemoteDeviceKeys(ctx, keys)
-		if err != nil {
-			res.Error = &api.KeyError{
-				Err: fmt.Sprintf("failed to store remote device keys: %s", err),
-			}
-			return
+			Err: fmt.Sprintf("failed to update device list: %s", err),
 		}
-		// ALWAYS emit key changes when we've been poked over federation just in case
-		// this poke is important for something.
-		err = a.Producer.ProduceKeyChanges(keys)
-		if err != nil {
-			res.Error = &api.KeyError{
-				Err: fmt.Sprintf("failed to emit remote device key changes: %s", err),
-			}
-		}
-		return
 	}
-
-	// if we're missing an ID go and fetch it from the remote HS
-
 }
 
 func (a *KeyInternalAPI) QueryKeyChanges(ctx context.Context, req *api.QueryKeyChangesRequest, res *api.QueryKeyChangesResponse) {
@@ -127,6 +77,7 @@ func (a *KeyInternalAPI) PerformUploadKeys(ctx context.Context, req *api.Perform
 	res.KeyErrors = make(map[string]map[string]*api.KeyError)
 	a.uploadLocalDeviceKeys(ctx, req, res)
 	a.uploadOneTimeKeys(ctx, req, res)
+	a.uploadFallbackKeys(ctx, req, res)
 }
 
 func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformClaimKeysRequest, res *api.PerformClaimKeysResponse) {
@@ -240,7 +191,14 @@ func (a *KeyInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOne
 		}
 		return
 	}
+	withSignedCurve25519Count(count)
 	res.Count = *count
+	res.UnusedFallbackAlgorithms, err = a.DB.UnusedFallbackKeyAlgorithms(ctx, req.UserID, req.DeviceID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("Failed to query unused fallback keys: %s", err),
+		}
+	}
 }
 
 func (a *KeyInternalAPI) QueryDeviceMessages(ctx context.Context, req *api.QueryDeviceMessagesRequest, res *api.QueryDeviceMessagesResponse) {
@@ -263,6 +221,9 @@ func (a *KeyInternalAPI) QueryDeviceMessages(ctx context.Context, req *api.Query
 
 func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
 	res.DeviceKeys = make(map[string]map[string]json.RawMessage)
+	res.MasterKeys = make(map[string]json.RawMessage)
+	res.SelfSigningKeys = make(map[string]json.RawMessage)
+	res.UserSigningKeys = make(map[string]json.RawMessage)
 	res.Failures = make(map[string]interface{})
 	// make a map from domain to device keys
 	domainToDeviceKeys := make(map[string]map[string][]string)
@@ -308,8 +269,17 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 				}{queryRes.DeviceInfo[dk.DeviceID].DisplayName})
 				res.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
 			}
+
+			if err = a.crossSigningKeysForQuery(ctx, userID, req.UserID, res); err != nil {
+				res.Error = &api.KeyError{
+					Err: fmt.Sprintf("failed to query local cross-signing keys: %s", err),
+				}
+				return
+			}
 		} else {
-			domainToDeviceKeys[domain] = make(map[string][]string)
+			if domainToDeviceKeys[domain] == nil {
+				domainToDeviceKeys[domain] = make(map[string][]string)
+			}
 			domainToDeviceKeys[domain][userID] = append(domainToDeviceKeys[domain][userID], deviceIDs...)
 		}
 	}
@@ -317,12 +287,36 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 
 	// perform key queries for remote devices
 	a.queryRemoteKeys(ctx, req.Timeout, res, domainToDeviceKeys)
+
+	// serve remote users' cross-signing keys from storage, so that they are known even when their servers fail
+	for _, userToDevices := range domainToDeviceKeys {
+		for userID := range userToDevices {
+			if err := a.remoteCrossSigningKeysForQuery(ctx, userID, res); err != nil {
+				res.Error = &api.KeyError{
+					Err: fmt.Sprintf("failed to query remote cross-signing keys: %s", err),
+				}
+				return
+			}
+		}
+	}
+
+	// show the requesting user which master keys they have signed
+	if err := a.addUserSigningSignatures(ctx, req.UserID, res); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing signatures: %s", err),
+		}
+	}
 }
 
 func (a *KeyInternalAPI) queryRemoteKeys(
 	ctx context.Context, timeout time.Duration, res *api.QueryKeysResponse, domainToDeviceKeys map[string]map[string][]string,
 ) {
-	resultCh := make(chan *gomatrixserverlib.RespQueryKeys, len(domainToDeviceKeys))
+	// each result is kept with the users it was asked for, as a server can only answer for its own users
+	type queryResult struct {
+		resp    *RespQueryKeys
+		devKeys map[string][]string
+	}
+	resultCh := make(chan queryResult, len(domainToDeviceKeys))
 	// allows us to wait until all federation servers have been poked
 	var wg sync.WaitGroup
 	wg.Add(len(domainToDeviceKeys))
@@ -335,7 +329,7 @@ func (a *KeyInternalAPI) queryRemoteKeys(
 			defer wg.Done()
 			fedCtx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
-			queryKeysResp, err := a.FedClient.QueryKeys(fedCtx, gomatrixserverlib.ServerName(serverName), devKeys)
+			queryKeysResp, err := a.FedKeyClient.QueryKeys(fedCtx, gomatrixserverlib.ServerName(serverName), devKeys)
 			if err != nil {
 				failMu.Lock()
 				res.Failures[serverName] = map[string]interface{}{
@@ -344,7 +338,7 @@ func (a *KeyInternalAPI) queryRemoteKeys(
 				failMu.Unlock()
 				return
 			}
-			resultCh <- &queryKeysResp
+			resultCh <- queryResult{&queryKeysResp, devKeys}
 		}(domain, deviceKeys)
 	}
 
@@ -355,16 +349,26 @@ func (a *KeyInternalAPI) queryRemoteKeys(
 	}()
 
 	for result := range resultCh {
-		for userID, nest := range result.DeviceKeys {
+		// drop keys for users who weren't asked for, so that a server can't replace the keys of other servers' users
+		for userID, nest := range result.resp.DeviceKeys {
+			if _, ok := result.devKeys[userID]; !ok {
+				continue
+			}
 			res.DeviceKeys[userID] = make(map[string]json.RawMessage)
-			for deviceID, deviceKey := range nest {
-				keyJSON, err := json.Marshal(deviceKey)
-				if err != nil {
-					continue
-				}
+			for deviceID, keyJSON := range nest {
 				res.DeviceKeys[userID][deviceID] = keyJSON
 			}
 		}
+		for userID, keyJSON := range result.resp.MasterKeys {
+			if _, ok := result.devKeys[userID]; ok {
+				res.MasterKeys[userID] = keyJSON
+			}
+		}
+		for userID, keyJSON := range result.resp.SelfSigningKeys {
+			if _, ok := result.devKeys[userID]; ok {
+				res.SelfSigningKeys[userID] = keyJSON
+			}
+		}
 	}
 }
 
@@ -462,11 +466,56 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 			continue
 		}
 		// collect counts
+		withSignedCurve25519Count(counts)
 		res.OneTimeKeyCounts = append(res.OneTimeKeyCounts, *counts)
 	}
 
 }
 
+func (a *KeyInternalAPI) uploadFallbackKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
+	for _, key := range req.FallbackKeys {
+		algorithms := make(map[string]bool, len(key.KeyJSON))
+		valid := true
+		for keyIDWithAlgo := range key.KeyJSON {
+			if !strings.Contains(keyIDWithAlgo, ":") {
+				res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+					Err:            fmt.Sprintf("%s device %s: fallback key ID %s is not of the form algorithm:key_id", key.UserID, key.DeviceID, keyIDWithAlgo),
+					IsInvalidParam: true,
+				})
+				valid = false
+				break
+			}
+			algo, _ := key.Split(keyIDWithAlgo)
+			if algorithms[algo] {
+				res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+					Err:            fmt.Sprintf("%s device %s: more than one fallback key for algorithm %s", key.UserID, key.DeviceID, algo),
+					IsInvalidParam: true,
+				})
+				valid = false
+				break
+			}
+			algorithms[algo] = true
+		}
+		if !valid {
+			continue
+		}
+		if err := a.DB.StoreFallbackKeys(ctx, key); err != nil {
+			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+				Err: fmt.Sprintf("%s device %s : failed to store fallback keys: %s", key.UserID, key.DeviceID, err.Error()),
+			})
+		}
+	}
+}
+
+// withSignedCurve25519Count makes sure that the counts include signed_curve25519, which is
+// the algorithm clients upload one-time keys for, so that clients see a count of 0 rather
+// than no count at all once all of their keys have been claimed.
+func withSignedCurve25519Count(counts *api.OneTimeKeysCount) {
+	if _, ok := counts.KeyCount["signed_curve25519"]; !ok {
+		counts.KeyCount["signed_curve25519"] = 0
+	}
+}
+
 func (a *KeyInternalAPI) emitDeviceKeyChanges(existing, new []api.DeviceMessage) error {
 	// find keys in new that are not in existing
 	var keysAdded []api.DeviceMessage
@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+)
+
+func TestUploadFallbackKeys(t *testing.T) {
+	a, _, clean := mustCreateKeyInternalAPI(t)
+	defer clean()
+	alice := "@alice:localhost"
+	testCases := []struct {
+		name     string
+		deviceID string
+		keyJSON  map[string]json.RawMessage
+		wantErr  bool
+	}{
+		{
+			name:     "key ID without an algorithm",
+			deviceID: "BADID",
+			keyJSON:  map[string]json.RawMessage{"fallback": []byte(`{"key":"fallback"}`)},
+			wantErr:  true,
+		},
+		{
+			name:     "two keys for one algorithm",
+			deviceID: "TWOKEYS",
+			keyJSON: map[string]json.RawMessage{
+				"signed_curve25519:fallback1": []byte(`{"key":"fallback1"}`),
+				"signed_curve25519:fallback2": []byte(`{"key":"fallback2"}`),
+			},
+			wantErr: true,
+		},
+		{
+			name:     "valid key",
+			deviceID: "DEVICE",
+			keyJSON:  map[string]json.RawMessage{"signed_curve25519:fallback": []byte(`{"key":"fallback"}`)},
+		},
+	}
+	for _, tc := range testCases {
+		var res api.PerformUploadKeysResponse
+		a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+			FallbackKeys: []api.OneTimeKeys{
+				{UserID: alice, DeviceID: tc.deviceID, KeyJSON: tc.keyJSON},
+			},
+		}, &res)
+		if res.Error != nil {
+			t.Fatalf("%s: PerformUploadKeys returned error: %s", tc.name, res.Error)
+		}
+		keyErr := res.KeyErrors[alice][tc.deviceID]
+		if tc.wantErr != (keyErr != nil) {
+			t.Errorf("%s: got error %v, want error=%v", tc.name, keyErr, tc.wantErr)
+		}
+
+		// rejected keys aren't stored at all, and the counts always include signed_curve25519
+		var queryRes api.QueryOneTimeKeysResponse
+		a.QueryOneTimeKeys(ctx, &api.QueryOneTimeKeysRequest{UserID: alice, DeviceID: tc.deviceID}, &queryRes)
+		if queryRes.Error != nil {
+			t.Fatalf("%s: QueryOneTimeKeys returned error: %s", tc.name, queryRes.Error)
+		}
+		wantUnused := []string{}
+		if !tc.wantErr {
+			wantUnused = []string{"signed_curve25519"}
+		}
+		if len(queryRes.UnusedFallbackAlgorithms) != len(wantUnused) ||
+			(len(wantUnused) > 0 && !reflect.DeepEqual(queryRes.UnusedFallbackAlgorithms, wantUnused)) {
+			t.Errorf("%s: got unused fallback algorithms %v, want %v", tc.name, queryRes.UnusedFallbackAlgorithms, wantUnused)
+		}
+		if count, ok := queryRes.Count.KeyCount["signed_curve25519"]; !ok || count != 0 {
+			t.Errorf("%s: got key counts %v, want signed_curve25519 to be 0", tc.name, queryRes.Count.KeyCount)
+		}
+	}
+}
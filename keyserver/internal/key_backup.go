@@ -0,0 +1,178 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+)
+
+func (a *KeyInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) {
+	if req.Version == "" {
+		if req.Algorithm == "" || len(req.AuthData) == 0 {
+			res.Error = &api.KeyError{
+				Err:            "algorithm and auth_data are required to create a backup",
+				IsMissingParam: true,
+			}
+			return
+		}
+		version, err := a.DB.CreateKeyBackup(ctx, req.UserID, req.Algorithm, req.AuthData)
+		if err != nil {
+			res.Error = &api.KeyError{
+				Err: fmt.Sprintf("failed to create backup: %s", err),
+			}
+			return
+		}
+		res.Version = version
+		return
+	}
+
+	backup, err := a.DB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to get backup: %s", err),
+		}
+		return
+	}
+	if backup == nil {
+		res.Error = &api.KeyError{
+			Err:        fmt.Sprintf("unknown backup version %q", req.Version),
+			IsNotFound: true,
+		}
+		return
+	}
+	res.Version = backup.Version
+
+	if req.DeleteBackup {
+		if _, err = a.DB.DeleteKeyBackup(ctx, req.UserID, backup.Version); err != nil {
+			res.Error = &api.KeyError{
+				Err: fmt.Sprintf("failed to delete backup: %s", err),
+			}
+		}
+		return
+	}
+
+	if req.Algorithm != backup.Algorithm {
+		res.Error = &api.KeyError{
+			Err:            "Algorithm does not match",
+			IsInvalidParam: true,
+		}
+		return
+	}
+	if len(req.AuthData) == 0 {
+		res.Error = &api.KeyError{
+			Err:            "auth_data is required to update a backup",
+			IsMissingParam: true,
+		}
+		return
+	}
+	if err = a.DB.UpdateKeyBackupAuthData(ctx, req.UserID, backup.Version, req.AuthData); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to update backup: %s", err),
+		}
+	}
+}
+
+func (a *KeyInternalAPI) PerformUploadRoomKeys(ctx context.Context, req *api.PerformUploadRoomKeysRequest, res *api.PerformUploadRoomKeysResponse) {
+	// keys can only be uploaded to the current backup, so that clients which
+	// haven't noticed a new backup being created don't keep using the old one
+	current, err := a.DB.GetKeyBackup(ctx, req.UserID, "")
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to get current backup: %s", err),
+		}
+		return
+	}
+	if current == nil {
+		res.Error = &api.KeyError{
+			Err:        fmt.Sprintf("unknown backup version %q", req.Version),
+			IsNotFound: true,
+		}
+		return
+	}
+	if current.Version != req.Version {
+		res.CurrentVersion = current.Version
+		res.Error = &api.KeyError{
+			Err:            fmt.Sprintf("backup version %q is not the current version %q", req.Version, current.Version),
+			IsWrongVersion: true,
+		}
+		return
+	}
+	res.Count, res.ETag, err = a.DB.UpsertBackupKeys(ctx, req.UserID, current.Version, req.Keys)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to upload keys: %s", err),
+		}
+	}
+}
+
+func (a *KeyInternalAPI) PerformDeleteRoomKeys(ctx context.Context, req *api.PerformDeleteRoomKeysRequest, res *api.PerformDeleteRoomKeysResponse) {
+	backup, err := a.DB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to get backup: %s", err),
+		}
+		return
+	}
+	if backup == nil {
+		res.Error = &api.KeyError{
+			Err:        fmt.Sprintf("unknown backup version %q", req.Version),
+			IsNotFound: true,
+		}
+		return
+	}
+	res.Count, res.ETag, err = a.DB.DeleteBackupKeys(ctx, req.UserID, backup.Version, req.RoomID, req.SessionID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to delete keys: %s", err),
+		}
+	}
+}
+
+func (a *KeyInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest, res *api.QueryKeyBackupResponse) {
+	backup, err := a.DB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to get backup: %s", err),
+		}
+		return
+	}
+	if backup == nil {
+		if req.Version == "" {
+			res.Error = &api.KeyError{
+				Err:        "no current backup",
+				IsNotFound: true,
+			}
+		} else {
+			res.Error = &api.KeyError{
+				Err:        fmt.Sprintf("unknown backup version %q", req.Version),
+				IsNotFound: true,
+			}
+		}
+		return
+	}
+	res.KeyBackupVersion = *backup
+	if !req.ReturnKeys {
+		return
+	}
+	res.Keys, err = a.DB.GetBackupKeys(ctx, req.UserID, backup.Version, req.RoomID, req.SessionID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to get keys: %s", err),
+		}
+	}
+}
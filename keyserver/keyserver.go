@@ -15,8 +15,6 @@
 package keyserver
 
 import (
-	"sync"
-
 	"github.com/Shopify/sarama"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -29,6 +27,10 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// deviceListUpdaterWorkers is the number of remote servers which can be
+// asked for device lists at once.
+const deviceListUpdaterWorkers = 8
+
 // AddInternalRoutes registers HTTP handlers for the internal API. Invokes functions
 // on the given input API.
 func AddInternalRoutes(router *mux.Router, intAPI api.KeyInternalAPI) {
@@ -52,12 +54,17 @@ func NewInternalAPI(
 		Producer: producer,
 		DB:       db,
 	}
+	fedKeyClient := internal.NewFederationKeyClient(cfg, fedClient)
+	updater := internal.NewDeviceListUpdater(db, keyChangeProducer, fedKeyClient, deviceListUpdaterWorkers)
+	if err = updater.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start device list updater")
+	}
 	return &internal.KeyInternalAPI{
-		DB:            db,
-		ThisServer:    cfg.Matrix.ServerName,
-		FedClient:     fedClient,
-		Producer:      keyChangeProducer,
-		Mutex:         &sync.Mutex{},
-		UserIDToMutex: make(map[string]*sync.Mutex),
+		DB:           db,
+		ThisServer:   cfg.Matrix.ServerName,
+		FedClient:    fedClient,
+		FedKeyClient: fedKeyClient,
+		Producer:     keyChangeProducer,
+		Updater:      updater,
 	}
 }
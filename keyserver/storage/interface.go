@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
@@ -32,18 +33,25 @@ type Database interface {
 	// OneTimeKeysCount returns a count of all OTKs for this device.
 	OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error)
 
+	// StoreFallbackKeys persists the given fallback keys, replacing the existing fallback key for each algorithm.
+	StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error
+
+	// UnusedFallbackKeyAlgorithms returns the algorithms of this device's fallback keys which haven't been claimed.
+	UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+
 	// DeviceKeysJSON populates the KeyJSON for the given keys. If any proided `keys` have a `KeyJSON` or `StreamID` already then it will be replaced.
 	DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 
 	// StoreLocalDeviceKeys persists the given keys. Keys with the same user ID and device ID will be replaced. An empty KeyJSON removes the key
-	// for this (user, device).
+	// and all of the one-time and fallback keys for this (user, device).
 	// The `StreamID` for each message is set on successful insertion. In the event the key already exists, the existing StreamID is set.
 	// Returns an error if there was a problem storing the keys.
 	StoreLocalDeviceKeys(ctx context.Context, keys []api.DeviceMessage) error
 
 	// StoreRemoteDeviceKeys persists the given keys. Keys with the same user ID and device ID will be replaced. An empty KeyJSON removes the key
-	// for this (user, device). Does not modify the stream ID for keys.
-	StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage) error
+	// for this (user, device). Does not modify the stream ID for keys. All existing keys for the users in clearUserIDs are deleted first, in the
+	// same transaction, so that their device lists can be replaced atomically.
+	StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage, clearUserIDs []string) error
 
 	// PrevIDsExists returns true if all prev IDs exist for this user.
 	PrevIDsExists(ctx context.Context, userID string, prevIDs []int) (bool, error)
@@ -52,8 +60,9 @@ type Database interface {
 	// If there are some missing keys, they are omitted from the returned slice. There is no ordering on the returned slice.
 	DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error)
 
-	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. Returns no error if a key
-	// cannot be claimed or if none exist for this (user, device, algorithm), instead it is omitted from the returned slice.
+	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. If no one-time keys exist
+	// for this (user, device, algorithm) the fallback key is claimed instead. Returns no error if a key cannot be claimed or if none
+	// exist, instead it is omitted from the returned slice.
 	ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error)
 
 	// StoreKeyChange stores key change metadata after the change has been sent to Kafka. `userID` is the the user who has changed
@@ -64,4 +73,58 @@ type Database interface {
 	// A to offset of sarama.OffsetNewest means no upper limit.
 	// Returns the offset of the latest key change.
 	KeyChanges(ctx context.Context, partition int32, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error)
+
+	// StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
+	// If no domains are given, all user IDs with stale device lists are returned.
+	StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+
+	// MarkDeviceListStale sets the stale bit for this user to isStale.
+	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// CrossSigningKeysForUser returns the key JSON of each of the user's cross-signing keys. Keys which the user doesn't
+	// have are omitted from the map.
+	CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]json.RawMessage, error)
+
+	// StoreCrossSigningKeysForUser persists the given cross-signing keys, replacing any existing keys with the same purposes.
+	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]json.RawMessage) error
+
+	// ReplaceCrossSigningKeysForUser persists the given cross-signing keys, removing all of the user's existing keys,
+	// including those with purposes that aren't given.
+	ReplaceCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]json.RawMessage) error
+
+	// CrossSigningSigsForTarget returns the signatures that the origin user has made of the target key, as key ID => signature.
+	CrossSigningSigsForTarget(ctx context.Context, originUserID, targetUserID, targetKeyID string) (map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error)
+
+	// StoreCrossSigningSigsForTarget persists a signature that the origin user has made of the target key, replacing any
+	// existing signature of the key by the same origin key.
+	StoreCrossSigningSigsForTarget(
+		ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID,
+		targetUserID, targetKeyID string, signature gomatrixserverlib.Base64Bytes,
+	) error
+
+	// CreateKeyBackup creates a new version of the user's room key backup, which becomes their current backup.
+	// Returns the new version.
+	CreateKeyBackup(ctx context.Context, userID, algorithm string, authData json.RawMessage) (version string, err error)
+
+	// UpdateKeyBackupAuthData replaces the auth data of the backup.
+	UpdateKeyBackupAuthData(ctx context.Context, userID, version string, authData json.RawMessage) error
+
+	// DeleteKeyBackup deletes the backup and the keys in it. Returns false if the backup doesn't exist.
+	DeleteKeyBackup(ctx context.Context, userID, version string) (exists bool, err error)
+
+	// GetKeyBackup returns the backup with the given version, or the user's current backup if the version is empty.
+	// Returns nil if there is no such backup.
+	GetKeyBackup(ctx context.Context, userID, version string) (*api.KeyBackupVersion, error)
+
+	// UpsertBackupKeys adds the keys, as room ID => session ID => key, to the backup. Existing keys are only replaced
+	// by better keys. Returns the number of keys in the backup and its etag.
+	UpsertBackupKeys(ctx context.Context, userID, version string, keys map[string]map[string]api.KeyBackupSession) (count int64, etag string, err error)
+
+	// GetBackupKeys returns the keys in the backup as room ID => session ID => key. If roomID is given only keys for
+	// the room are returned, and if sessionID is also given only the key for the session.
+	GetBackupKeys(ctx context.Context, userID, version, roomID, sessionID string) (map[string]map[string]api.KeyBackupSession, error)
+
+	// DeleteBackupKeys removes keys from the backup, filtered like GetBackupKeys. Returns the number of keys left in
+	// the backup and its etag.
+	DeleteBackupKeys(ctx context.Context, userID, version, roomID, sessionID string) (count int64, etag string, err error)
 }
@@ -0,0 +1,111 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var crossSigningKeysSchema = `
+-- Stores the cross-signing keys of users, both local and remote.
+CREATE TABLE IF NOT EXISTS keyserver_cross_signing_keys (
+	user_id TEXT NOT NULL,
+	-- One of "master", "self_signing" or "user_signing"
+	key_type TEXT NOT NULL,
+	-- The key JSON, including any signatures of the key
+	key_json TEXT NOT NULL,
+	PRIMARY KEY (user_id, key_type)
+);
+`
+
+const selectCrossSigningKeysForUserSQL = "" +
+	"SELECT key_type, key_json FROM keyserver_cross_signing_keys" +
+	" WHERE user_id = $1"
+
+const upsertCrossSigningKeysForUserSQL = "" +
+	"INSERT INTO keyserver_cross_signing_keys (user_id, key_type, key_json)" +
+	" VALUES($1, $2, $3)" +
+	" ON CONFLICT (user_id, key_type) DO UPDATE SET key_json = $3"
+
+const deleteCrossSigningKeysForUserSQL = "" +
+	"DELETE FROM keyserver_cross_signing_keys WHERE user_id = $1"
+
+type crossSigningKeysStatements struct {
+	db                                *sql.DB
+	selectCrossSigningKeysForUserStmt *sql.Stmt
+	upsertCrossSigningKeysForUserStmt *sql.Stmt
+	deleteCrossSigningKeysForUserStmt *sql.Stmt
+}
+
+func NewPostgresCrossSigningKeysTable(db *sql.DB) (tables.CrossSigningKeys, error) {
+	s := &crossSigningKeysStatements{
+		db: db,
+	}
+	_, err := db.Exec(crossSigningKeysSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.selectCrossSigningKeysForUserStmt, err = db.Prepare(selectCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.upsertCrossSigningKeysForUserStmt, err = db.Prepare(upsertCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteCrossSigningKeysForUserStmt, err = db.Prepare(deleteCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *crossSigningKeysStatements) SelectCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[api.CrossSigningKeyPurpose]json.RawMessage, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectCrossSigningKeysForUserStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectCrossSigningKeysForUserStmt: rows.close() failed")
+	result := make(map[api.CrossSigningKeyPurpose]json.RawMessage)
+	for rows.Next() {
+		var keyType string
+		var keyJSON string
+		if err := rows.Scan(&keyType, &keyJSON); err != nil {
+			return nil, err
+		}
+		result[api.CrossSigningKeyPurpose(keyType)] = json.RawMessage(keyJSON)
+	}
+	return result, rows.Err()
+}
+
+func (s *crossSigningKeysStatements) UpsertCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string, purpose api.CrossSigningKeyPurpose, keyJSON json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertCrossSigningKeysForUserStmt).ExecContext(ctx, userID, string(purpose), string(keyJSON))
+	return err
+}
+
+func (s *crossSigningKeysStatements) DeleteCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteCrossSigningKeysForUserStmt).ExecContext(ctx, userID)
+	return err
+}
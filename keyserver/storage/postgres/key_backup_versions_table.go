@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var keyBackupVersionsSchema = `
+-- Stores the versions of users' room key backups. Versions are never reused,
+-- so deleted versions are kept but marked as deleted.
+CREATE TABLE IF NOT EXISTS keyserver_key_backup_versions (
+    user_id TEXT NOT NULL,
+	version BIGSERIAL PRIMARY KEY,
+	algorithm TEXT NOT NULL,
+	auth_data TEXT NOT NULL,
+	-- Incremented whenever keys are added to or removed from the backup
+	etag BIGINT NOT NULL DEFAULT 0,
+	deleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS keyserver_key_backup_versions_user_id_idx ON keyserver_key_backup_versions (user_id);
+`
+
+const insertKeyBackupSQL = "" +
+	"INSERT INTO keyserver_key_backup_versions (user_id, algorithm, auth_data) VALUES ($1, $2, $3)" +
+	" RETURNING version"
+
+const updateKeyBackupAuthDataSQL = "" +
+	"UPDATE keyserver_key_backup_versions SET auth_data = $1 WHERE user_id = $2 AND version = $3"
+
+const updateKeyBackupETagSQL = "" +
+	"UPDATE keyserver_key_backup_versions SET etag = etag + 1 WHERE user_id = $1 AND version = $2"
+
+const deleteKeyBackupSQL = "" +
+	"UPDATE keyserver_key_backup_versions SET deleted = TRUE WHERE user_id = $1 AND version = $2 AND deleted = FALSE"
+
+const selectKeyBackupSQL = "" +
+	"SELECT algorithm, auth_data, etag FROM keyserver_key_backup_versions" +
+	" WHERE user_id = $1 AND version = $2 AND deleted = FALSE"
+
+const selectLatestKeyBackupVersionSQL = "" +
+	"SELECT MAX(version) FROM keyserver_key_backup_versions WHERE user_id = $1 AND deleted = FALSE"
+
+type keyBackupVersionsStatements struct {
+	db                               *sql.DB
+	insertKeyBackupStmt              *sql.Stmt
+	updateKeyBackupAuthDataStmt      *sql.Stmt
+	updateKeyBackupETagStmt          *sql.Stmt
+	deleteKeyBackupStmt              *sql.Stmt
+	selectKeyBackupStmt              *sql.Stmt
+	selectLatestKeyBackupVersionStmt *sql.Stmt
+}
+
+func NewPostgresKeyBackupVersionsTable(db *sql.DB) (tables.KeyBackupVersions, error) {
+	s := &keyBackupVersionsStatements{
+		db: db,
+	}
+	_, err := db.Exec(keyBackupVersionsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertKeyBackupStmt, err = db.Prepare(insertKeyBackupSQL); err != nil {
+		return nil, err
+	}
+	if s.updateKeyBackupAuthDataStmt, err = db.Prepare(updateKeyBackupAuthDataSQL); err != nil {
+		return nil, err
+	}
+	if s.updateKeyBackupETagStmt, err = db.Prepare(updateKeyBackupETagSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteKeyBackupStmt, err = db.Prepare(deleteKeyBackupSQL); err != nil {
+		return nil, err
+	}
+	if s.selectKeyBackupStmt, err = db.Prepare(selectKeyBackupSQL); err != nil {
+		return nil, err
+	}
+	if s.selectLatestKeyBackupVersionStmt, err = db.Prepare(selectLatestKeyBackupVersionSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *keyBackupVersionsStatements) InsertKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID, algorithm string, authData json.RawMessage,
+) (version int64, err error) {
+	err = sqlutil.TxStmt(txn, s.insertKeyBackupStmt).QueryRowContext(ctx, userID, algorithm, string(authData)).Scan(&version)
+	return
+}
+
+func (s *keyBackupVersionsStatements) UpdateKeyBackupAuthData(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, authData json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateKeyBackupAuthDataStmt).ExecContext(ctx, string(authData), userID, version)
+	return err
+}
+
+func (s *keyBackupVersionsStatements) UpdateKeyBackupETag(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateKeyBackupETagStmt).ExecContext(ctx, userID, version)
+	return err
+}
+
+func (s *keyBackupVersionsStatements) DeleteKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (bool, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeyBackupStmt).ExecContext(ctx, userID, version)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *keyBackupVersionsStatements) SelectKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (algorithm string, authData json.RawMessage, etag int64, err error) {
+	var authDataStr string
+	err = sqlutil.TxStmt(txn, s.selectKeyBackupStmt).QueryRowContext(ctx, userID, version).Scan(&algorithm, &authDataStr, &etag)
+	authData = json.RawMessage(authDataStr)
+	return
+}
+
+func (s *keyBackupVersionsStatements) SelectLatestKeyBackupVersion(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (int64, error) {
+	var version sql.NullInt64
+	err := sqlutil.TxStmt(txn, s.selectLatestKeyBackupVersionStmt).QueryRowContext(ctx, userID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if !version.Valid {
+		return 0, sql.ErrNoRows
+	}
+	return version.Int64, nil
+}
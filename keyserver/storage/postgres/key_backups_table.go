@@ -0,0 +1,213 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var keyBackupsSchema = `
+-- Stores the room keys in users' room key backups
+CREATE TABLE IF NOT EXISTS keyserver_key_backups (
+    user_id TEXT NOT NULL,
+	version BIGINT NOT NULL,
+	room_id TEXT NOT NULL,
+	session_id TEXT NOT NULL,
+	first_message_index INTEGER NOT NULL,
+	forwarded_count INTEGER NOT NULL,
+	is_verified BOOLEAN NOT NULL,
+	-- The encrypted key, which only the user's clients can read
+	session_data TEXT NOT NULL,
+	UNIQUE (user_id, version, room_id, session_id)
+);
+`
+
+const countKeysSQL = "" +
+	"SELECT COUNT(*) FROM keyserver_key_backups WHERE user_id = $1 AND version = $2"
+
+const upsertBackupKeySQL = "" +
+	"INSERT INTO keyserver_key_backups (user_id, version, room_id, session_id, first_message_index, forwarded_count, is_verified, session_data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (user_id, version, room_id, session_id)" +
+	" DO UPDATE SET first_message_index = $5, forwarded_count = $6, is_verified = $7, session_data = $8"
+
+const selectBackupKeysSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM keyserver_key_backups" +
+	" WHERE user_id = $1 AND version = $2"
+
+const selectKeysByRoomIDSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM keyserver_key_backups" +
+	" WHERE user_id = $1 AND version = $2 AND room_id = $3"
+
+const selectKeysByRoomIDAndSessionIDSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM keyserver_key_backups" +
+	" WHERE user_id = $1 AND version = $2 AND room_id = $3 AND session_id = $4"
+
+const deleteKeysSQL = "" +
+	"DELETE FROM keyserver_key_backups WHERE user_id = $1 AND version = $2"
+
+const deleteKeysByRoomIDSQL = "" +
+	"DELETE FROM keyserver_key_backups WHERE user_id = $1 AND version = $2 AND room_id = $3"
+
+const deleteKeysByRoomIDAndSessionIDSQL = "" +
+	"DELETE FROM keyserver_key_backups WHERE user_id = $1 AND version = $2 AND room_id = $3 AND session_id = $4"
+
+type keyBackupsStatements struct {
+	db                                 *sql.DB
+	countKeysStmt                      *sql.Stmt
+	upsertBackupKeyStmt                *sql.Stmt
+	selectKeysStmt                     *sql.Stmt
+	selectKeysByRoomIDStmt             *sql.Stmt
+	selectKeysByRoomIDAndSessionIDStmt *sql.Stmt
+	deleteKeysStmt                     *sql.Stmt
+	deleteKeysByRoomIDStmt             *sql.Stmt
+	deleteKeysByRoomIDAndSessionIDStmt *sql.Stmt
+}
+
+func NewPostgresKeyBackupsTable(db *sql.DB) (tables.KeyBackups, error) {
+	s := &keyBackupsStatements{
+		db: db,
+	}
+	_, err := db.Exec(keyBackupsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.countKeysStmt, err = db.Prepare(countKeysSQL); err != nil {
+		return nil, err
+	}
+	if s.upsertBackupKeyStmt, err = db.Prepare(upsertBackupKeySQL); err != nil {
+		return nil, err
+	}
+	if s.selectKeysStmt, err = db.Prepare(selectBackupKeysSQL); err != nil {
+		return nil, err
+	}
+	if s.selectKeysByRoomIDStmt, err = db.Prepare(selectKeysByRoomIDSQL); err != nil {
+		return nil, err
+	}
+	if s.selectKeysByRoomIDAndSessionIDStmt, err = db.Prepare(selectKeysByRoomIDAndSessionIDSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteKeysStmt, err = db.Prepare(deleteKeysSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteKeysByRoomIDStmt, err = db.Prepare(deleteKeysByRoomIDSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteKeysByRoomIDAndSessionIDStmt, err = db.Prepare(deleteKeysByRoomIDAndSessionIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *keyBackupsStatements) CountKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (count int64, err error) {
+	err = sqlutil.TxStmt(txn, s.countKeysStmt).QueryRowContext(ctx, userID, version).Scan(&count)
+	return
+}
+
+func (s *keyBackupsStatements) UpsertBackupKey(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string, key api.KeyBackupSession,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertBackupKeyStmt).ExecContext(
+		ctx, userID, version, roomID, sessionID, key.FirstMessageIndex, key.ForwardedCount, key.IsVerified, string(key.SessionData),
+	)
+	return err
+}
+
+func (s *keyBackupsStatements) SelectKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectKeysStmt).QueryContext(ctx, userID, version)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToBackupKeys(ctx, rows)
+}
+
+func (s *keyBackupsStatements) SelectKeysByRoomID(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectKeysByRoomIDStmt).QueryContext(ctx, userID, version, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToBackupKeys(ctx, rows)
+}
+
+func (s *keyBackupsStatements) SelectKeysByRoomIDAndSessionID(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectKeysByRoomIDAndSessionIDStmt).QueryContext(ctx, userID, version, roomID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToBackupKeys(ctx, rows)
+}
+
+func (s *keyBackupsStatements) DeleteKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (int64, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeysStmt).ExecContext(ctx, userID, version)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *keyBackupsStatements) DeleteKeysByRoomID(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID string,
+) (int64, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeysByRoomIDStmt).ExecContext(ctx, userID, version, roomID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *keyBackupsStatements) DeleteKeysByRoomIDAndSessionID(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+) (int64, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeysByRoomIDAndSessionIDStmt).ExecContext(ctx, userID, version, roomID, sessionID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func rowsToBackupKeys(ctx context.Context, rows *sql.Rows) (map[string]map[string]api.KeyBackupSession, error) {
+	defer internal.CloseAndLogIfError(ctx, rows, "rowsToBackupKeys: rows.close() failed")
+	result := make(map[string]map[string]api.KeyBackupSession)
+	for rows.Next() {
+		var roomID, sessionID, sessionData string
+		var key api.KeyBackupSession
+		if err := rows.Scan(&roomID, &sessionID, &key.FirstMessageIndex, &key.ForwardedCount, &key.IsVerified, &sessionData); err != nil {
+			return nil, err
+		}
+		key.SessionData = json.RawMessage(sessionData)
+		if result[roomID] == nil {
+			result[roomID] = make(map[string]api.KeyBackupSession)
+		}
+		result[roomID][sessionID] = key
+	}
+	return result, rows.Err()
+}
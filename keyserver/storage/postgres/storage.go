@@ -30,6 +30,10 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*s
 	if err != nil {
 		return nil, err
 	}
+	fk, err := NewPostgresFallbackKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
 	dk, err := NewPostgresDeviceKeysTable(db)
 	if err != nil {
 		return nil, err
@@ -38,10 +42,36 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*s
 	if err != nil {
 		return nil, err
 	}
+	sdl, err := NewPostgresStaleDeviceListsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	csk, err := NewPostgresCrossSigningKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
+	css, err := NewPostgresCrossSigningSigsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	kbv, err := NewPostgresKeyBackupVersionsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := NewPostgresKeyBackupsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
-		DB:               db,
-		OneTimeKeysTable: otk,
-		DeviceKeysTable:  dk,
-		KeyChangesTable:  kc,
+		DB:                     db,
+		OneTimeKeysTable:       otk,
+		FallbackKeysTable:      fk,
+		DeviceKeysTable:        dk,
+		KeyChangesTable:        kc,
+		StaleDeviceListsTable:  sdl,
+		CrossSigningKeysTable:  csk,
+		CrossSigningSigsTable:  css,
+		KeyBackupVersionsTable: kbv,
+		KeyBackupsTable:        kb,
 	}, nil
 }
@@ -18,17 +18,26 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"strconv"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database struct {
-	DB               *sql.DB
-	OneTimeKeysTable tables.OneTimeKeys
-	DeviceKeysTable  tables.DeviceKeys
-	KeyChangesTable  tables.KeyChanges
+	DB                     *sql.DB
+	OneTimeKeysTable       tables.OneTimeKeys
+	FallbackKeysTable      tables.FallbackKeys
+	DeviceKeysTable        tables.DeviceKeys
+	KeyChangesTable        tables.KeyChanges
+	StaleDeviceListsTable  tables.StaleDeviceLists
+	CrossSigningKeysTable  tables.CrossSigningKeys
+	CrossSigningSigsTable  tables.CrossSigningSigs
+	KeyBackupVersionsTable tables.KeyBackupVersions
+	KeyBackupsTable        tables.KeyBackups
 }
 
 func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -43,6 +52,22 @@ func (d *Database) OneTimeKeysCount(ctx context.Context, userID, deviceID string
 	return d.OneTimeKeysTable.CountOneTimeKeys(ctx, userID, deviceID)
 }
 
+func (d *Database) StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error {
+	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for keyIDWithAlgo, keyJSON := range keys.KeyJSON {
+			algo, keyID := keys.Split(keyIDWithAlgo)
+			if err := d.FallbackKeysTable.UpsertFallbackKey(ctx, txn, keys.UserID, keys.DeviceID, algo, keyID, keyJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error) {
+	return d.FallbackKeysTable.SelectUnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+}
+
 func (d *Database) DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error {
 	return d.DeviceKeysTable.SelectDeviceKeysJSON(ctx, keys)
 }
@@ -59,8 +84,13 @@ func (d *Database) PrevIDsExists(ctx context.Context, userID string, prevIDs []i
 	return count == len(prevIDs), nil
 }
 
-func (d *Database) StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage) error {
+func (d *Database) StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage, clearUserIDs []string) error {
 	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for _, userID := range clearUserIDs {
+			if err := d.DeviceKeysTable.DeleteAllDeviceKeys(ctx, txn, userID); err != nil {
+				return err
+			}
+		}
 		return d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, keys)
 	})
 }
@@ -85,6 +115,15 @@ func (d *Database) StoreLocalDeviceKeys(ctx context.Context, keys []api.DeviceMe
 			userIDToStreamID[k.UserID]++ // start stream from 1
 			k.StreamID = userIDToStreamID[k.UserID]
 			keys[i] = k
+			// the device has been deleted, so its one-time keys can never be claimed
+			if len(k.KeyJSON) == 0 {
+				if err := d.OneTimeKeysTable.DeleteOneTimeKeys(ctx, txn, k.UserID, k.DeviceID); err != nil {
+					return err
+				}
+				if err := d.FallbackKeysTable.DeleteFallbackKeys(ctx, txn, k.UserID, k.DeviceID); err != nil {
+					return err
+				}
+			}
 		}
 		return d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, keys)
 	})
@@ -103,6 +142,14 @@ func (d *Database) ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[st
 				if err != nil {
 					return err
 				}
+				if keyJSON == nil {
+					// the device has run out of one-time keys, so hand out its fallback key
+					// instead, which stays around until the device replaces it
+					keyJSON, err = d.FallbackKeysTable.SelectAndMarkFallbackKeyUsed(ctx, txn, userID, deviceID, algo)
+					if err != nil {
+						return err
+					}
+				}
 				if keyJSON != nil {
 					result = append(result, api.OneTimeKeys{
 						UserID:   userID,
@@ -124,3 +171,217 @@ func (d *Database) StoreKeyChange(ctx context.Context, partition int32, offset i
 func (d *Database) KeyChanges(ctx context.Context, partition int32, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error) {
 	return d.KeyChangesTable.SelectKeyChanges(ctx, partition, fromOffset, toOffset)
 }
+
+func (d *Database) StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
+	return d.StaleDeviceListsTable.SelectUserIDsWithStaleDeviceLists(ctx, domains)
+}
+
+func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error {
+	return d.StaleDeviceListsTable.InsertStaleDeviceList(ctx, userID, isStale)
+}
+
+func (d *Database) CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]json.RawMessage, error) {
+	return d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, nil, userID)
+}
+
+func (d *Database) StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]json.RawMessage) error {
+	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for purpose, keyJSON := range keys {
+			if err := d.CrossSigningKeysTable.UpsertCrossSigningKeysForUser(ctx, txn, userID, purpose, keyJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) ReplaceCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]json.RawMessage) error {
+	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if err := d.CrossSigningKeysTable.DeleteCrossSigningKeysForUser(ctx, txn, userID); err != nil {
+			return err
+		}
+		for purpose, keyJSON := range keys {
+			if err := d.CrossSigningKeysTable.UpsertCrossSigningKeysForUser(ctx, txn, userID, purpose, keyJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) CrossSigningSigsForTarget(
+	ctx context.Context, originUserID, targetUserID, targetKeyID string,
+) (map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error) {
+	return d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, nil, originUserID, targetUserID, targetKeyID)
+}
+
+func (d *Database) StoreCrossSigningSigsForTarget(
+	ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID,
+	targetUserID, targetKeyID string, signature gomatrixserverlib.Base64Bytes,
+) error {
+	return d.CrossSigningSigsTable.UpsertCrossSigningSigsForTarget(ctx, nil, originUserID, originKeyID, targetUserID, targetKeyID, signature)
+}
+
+func (d *Database) CreateKeyBackup(ctx context.Context, userID, algorithm string, authData json.RawMessage) (string, error) {
+	version, err := d.KeyBackupVersionsTable.InsertKeyBackup(ctx, nil, userID, algorithm, authData)
+	return strconv.FormatInt(version, 10), err
+}
+
+func (d *Database) UpdateKeyBackupAuthData(ctx context.Context, userID, version string, authData json.RawMessage) error {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid backup version %q", version)
+	}
+	return d.KeyBackupVersionsTable.UpdateKeyBackupAuthData(ctx, nil, userID, v, authData)
+}
+
+func (d *Database) DeleteKeyBackup(ctx context.Context, userID, version string) (exists bool, err error) {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return false, nil // versions are always numbers, so there's no such backup
+	}
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if exists, err = d.KeyBackupVersionsTable.DeleteKeyBackup(ctx, txn, userID, v); err != nil {
+			return err
+		}
+		_, err = d.KeyBackupsTable.DeleteKeys(ctx, txn, userID, v)
+		return err
+	})
+	return
+}
+
+func (d *Database) GetKeyBackup(ctx context.Context, userID, version string) (*api.KeyBackupVersion, error) {
+	var backup *api.KeyBackupVersion
+	err := sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		var v int64
+		var err error
+		if version == "" {
+			v, err = d.KeyBackupVersionsTable.SelectLatestKeyBackupVersion(ctx, txn, userID)
+		} else {
+			v, err = strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				return nil // versions are always numbers, so there's no such backup
+			}
+		}
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		algorithm, authData, etag, err := d.KeyBackupVersionsTable.SelectKeyBackup(ctx, txn, userID, v)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		count, err := d.KeyBackupsTable.CountKeys(ctx, txn, userID, v)
+		if err != nil {
+			return err
+		}
+		backup = &api.KeyBackupVersion{
+			Version:   strconv.FormatInt(v, 10),
+			Algorithm: algorithm,
+			AuthData:  authData,
+			ETag:      strconv.FormatInt(etag, 10),
+			Count:     count,
+		}
+		return nil
+	})
+	return backup, err
+}
+
+func (d *Database) UpsertBackupKeys(
+	ctx context.Context, userID, version string, keys map[string]map[string]api.KeyBackupSession,
+) (count int64, etag string, err error) {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid backup version %q", version)
+	}
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		changed := false
+		for roomID, sessions := range keys {
+			existing, err := d.KeyBackupsTable.SelectKeysByRoomID(ctx, txn, userID, v, roomID)
+			if err != nil {
+				return err
+			}
+			for sessionID, key := range sessions {
+				if existingKey, ok := existing[roomID][sessionID]; ok && !key.ShouldReplace(&existingKey) {
+					continue
+				}
+				if err = d.KeyBackupsTable.UpsertBackupKey(ctx, txn, userID, v, roomID, sessionID, key); err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+		if changed {
+			if err := d.KeyBackupVersionsTable.UpdateKeyBackupETag(ctx, txn, userID, v); err != nil {
+				return err
+			}
+		}
+		count, etag, err = d.keyBackupCountAndETag(ctx, txn, userID, v)
+		return err
+	})
+	return
+}
+
+func (d *Database) GetBackupKeys(
+	ctx context.Context, userID, version, roomID, sessionID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup version %q", version)
+	}
+	switch {
+	case roomID == "":
+		return d.KeyBackupsTable.SelectKeys(ctx, nil, userID, v)
+	case sessionID == "":
+		return d.KeyBackupsTable.SelectKeysByRoomID(ctx, nil, userID, v, roomID)
+	default:
+		return d.KeyBackupsTable.SelectKeysByRoomIDAndSessionID(ctx, nil, userID, v, roomID, sessionID)
+	}
+}
+
+func (d *Database) DeleteBackupKeys(
+	ctx context.Context, userID, version, roomID, sessionID string,
+) (count int64, etag string, err error) {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid backup version %q", version)
+	}
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		var deleted int64
+		var err error
+		switch {
+		case roomID == "":
+			deleted, err = d.KeyBackupsTable.DeleteKeys(ctx, txn, userID, v)
+		case sessionID == "":
+			deleted, err = d.KeyBackupsTable.DeleteKeysByRoomID(ctx, txn, userID, v, roomID)
+		default:
+			deleted, err = d.KeyBackupsTable.DeleteKeysByRoomIDAndSessionID(ctx, txn, userID, v, roomID, sessionID)
+		}
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			if err = d.KeyBackupVersionsTable.UpdateKeyBackupETag(ctx, txn, userID, v); err != nil {
+				return err
+			}
+		}
+		count, etag, err = d.keyBackupCountAndETag(ctx, txn, userID, v)
+		return err
+	})
+	return
+}
+
+func (d *Database) keyBackupCountAndETag(ctx context.Context, txn *sql.Tx, userID string, version int64) (int64, string, error) {
+	count, err := d.KeyBackupsTable.CountKeys(ctx, txn, userID, version)
+	if err != nil {
+		return 0, "", err
+	}
+	_, _, etag, err := d.KeyBackupVersionsTable.SelectKeyBackup(ctx, txn, userID, version)
+	if err != nil {
+		return 0, "", err
+	}
+	return count, strconv.FormatInt(etag, 10), nil
+}
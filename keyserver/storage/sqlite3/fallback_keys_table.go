@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var fallbackKeysSchema = `
+-- Stores fallback keys for devices, which are handed out when a device has no
+-- one-time keys left
+CREATE TABLE IF NOT EXISTS keyserver_fallback_keys (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	key_id TEXT NOT NULL,
+	key_json TEXT NOT NULL,
+	-- Whether the key has been claimed since it was uploaded
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	-- A device has at most one fallback key per algorithm
+	UNIQUE (user_id, device_id, algorithm)
+);
+`
+
+// Re-uploading the current key must not mark it as unused, as it may already
+// have been handed out.
+const upsertFallbackKeySQL = "" +
+	"INSERT INTO keyserver_fallback_keys (user_id, device_id, algorithm, key_id, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id, algorithm)" +
+	" DO UPDATE SET key_id = $4, key_json = $5," +
+	" used = keyserver_fallback_keys.used AND keyserver_fallback_keys.key_id = $4"
+
+const selectFallbackKeyByAlgorithmSQL = "" +
+	"SELECT key_id, key_json FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3"
+
+const markFallbackKeyUsedSQL = "" +
+	"UPDATE keyserver_fallback_keys SET used = TRUE WHERE user_id = $1 AND device_id = $2 AND algorithm = $3"
+
+const selectUnusedFallbackKeyAlgorithmsSQL = "" +
+	"SELECT algorithm FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2 AND used = FALSE"
+
+const deleteFallbackKeysSQL = "" +
+	"DELETE FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2"
+
+type fallbackKeysStatements struct {
+	db                                    *sql.DB
+	writer                                *sqlutil.TransactionWriter
+	upsertFallbackKeyStmt                 *sql.Stmt
+	selectFallbackKeyByAlgorithmStmt      *sql.Stmt
+	markFallbackKeyUsedStmt               *sql.Stmt
+	selectUnusedFallbackKeyAlgorithmsStmt *sql.Stmt
+	deleteFallbackKeysStmt                *sql.Stmt
+}
+
+func NewSqliteFallbackKeysTable(db *sql.DB) (tables.FallbackKeys, error) {
+	s := &fallbackKeysStatements{
+		db:     db,
+		writer: sqlutil.NewTransactionWriter(),
+	}
+	_, err := db.Exec(fallbackKeysSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertFallbackKeyStmt, err = db.Prepare(upsertFallbackKeySQL); err != nil {
+		return nil, err
+	}
+	if s.selectFallbackKeyByAlgorithmStmt, err = db.Prepare(selectFallbackKeyByAlgorithmSQL); err != nil {
+		return nil, err
+	}
+	if s.markFallbackKeyUsedStmt, err = db.Prepare(markFallbackKeyUsedSQL); err != nil {
+		return nil, err
+	}
+	if s.selectUnusedFallbackKeyAlgorithmsStmt, err = db.Prepare(selectUnusedFallbackKeyAlgorithmsSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteFallbackKeysStmt, err = db.Prepare(deleteFallbackKeysSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fallbackKeysStatements) UpsertFallbackKey(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm, keyID string, keyJSON json.RawMessage,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		_, err := sqlutil.TxStmt(txn, s.upsertFallbackKeyStmt).ExecContext(ctx, userID, deviceID, algorithm, keyID, string(keyJSON))
+		return err
+	})
+}
+
+func (s *fallbackKeysStatements) SelectAndMarkFallbackKeyUsed(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string,
+) (map[string]json.RawMessage, error) {
+	var keyID string
+	var keyJSON string
+	err := s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		err := sqlutil.TxStmt(txn, s.selectFallbackKeyByAlgorithmStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
+		if err != nil {
+			return err
+		}
+		_, err = sqlutil.TxStmt(txn, s.markFallbackKeyUsedStmt).ExecContext(ctx, userID, deviceID, algorithm)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return map[string]json.RawMessage{
+		algorithm + ":" + keyID: json.RawMessage(keyJSON),
+	}, nil
+}
+
+func (s *fallbackKeysStatements) SelectUnusedFallbackKeyAlgorithms(
+	ctx context.Context, userID, deviceID string,
+) ([]string, error) {
+	rows, err := s.selectUnusedFallbackKeyAlgorithmsStmt.QueryContext(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUnusedFallbackKeyAlgorithmsStmt: rows.close() failed")
+	algorithms := []string{}
+	for rows.Next() {
+		var algorithm string
+		if err = rows.Scan(&algorithm); err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, rows.Err()
+}
+
+func (s *fallbackKeysStatements) DeleteFallbackKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		_, err := sqlutil.TxStmt(txn, s.deleteFallbackKeysStmt).ExecContext(ctx, userID, deviceID)
+		return err
+	})
+}
@@ -33,6 +33,10 @@ func NewDatabase(dataSourceName string) (*shared.Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	fk, err := NewSqliteFallbackKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
 	dk, err := NewSqliteDeviceKeysTable(db)
 	if err != nil {
 		return nil, err
@@ -41,10 +45,36 @@ func NewDatabase(dataSourceName string) (*shared.Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	sdl, err := NewSqliteStaleDeviceListsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	csk, err := NewSqliteCrossSigningKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
+	css, err := NewSqliteCrossSigningSigsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	kbv, err := NewSqliteKeyBackupVersionsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := NewSqliteKeyBackupsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
-		DB:               db,
-		OneTimeKeysTable: otk,
-		DeviceKeysTable:  dk,
-		KeyChangesTable:  kc,
+		DB:                     db,
+		OneTimeKeysTable:       otk,
+		FallbackKeysTable:      fk,
+		DeviceKeysTable:        dk,
+		KeyChangesTable:        kc,
+		StaleDeviceListsTable:  sdl,
+		CrossSigningKeysTable:  csk,
+		CrossSigningSigsTable:  css,
+		KeyBackupVersionsTable: kbv,
+		KeyBackupsTable:        kb,
 	}, nil
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -171,3 +172,136 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyBackupETagAndCount(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:localhost"
+	version, err := db.CreateKeyBackup(ctx, alice, "m.megolm_backup.v1.curve25519-aes-sha2", []byte(`{}`))
+	MustNotError(t, err)
+	backup, err := db.GetKeyBackup(ctx, alice, version)
+	MustNotError(t, err)
+	if backup == nil || backup.Count != 0 {
+		t.Fatalf("GetKeyBackup returned %+v, want an empty backup", backup)
+	}
+	etag := backup.ETag
+
+	// mustUpsert adds the key to the backup, checking the count and whether the etag changed
+	mustUpsert := func(name, roomID, sessionID string, key api.KeyBackupSession, wantCount int64, wantChanged bool) {
+		t.Helper()
+		count, newETag, err := db.UpsertBackupKeys(ctx, alice, version, map[string]map[string]api.KeyBackupSession{
+			roomID: {sessionID: key},
+		})
+		MustNotError(t, err)
+		if count != wantCount {
+			t.Errorf("%s: got count %d, want %d", name, count, wantCount)
+		}
+		if changed := newETag != etag; changed != wantChanged {
+			t.Errorf("%s: etag went from %q to %q, want changed=%v", name, etag, newETag, wantChanged)
+		}
+		etag = newETag
+	}
+	unverified := api.KeyBackupSession{FirstMessageIndex: 1, ForwardedCount: 1, SessionData: []byte(`{"key":"unverified"}`)}
+	verified := api.KeyBackupSession{IsVerified: true, FirstMessageIndex: 1, ForwardedCount: 1, SessionData: []byte(`{"key":"verified"}`)}
+	mustUpsert("new key", "!room:localhost", "session1", unverified, 1, true)
+	mustUpsert("another new key", "!room:localhost", "session2", unverified, 2, true)
+	mustUpsert("better key", "!room:localhost", "session1", verified, 2, true)
+	mustUpsert("worse key", "!room:localhost", "session1", unverified, 2, false)
+
+	keys, err := db.GetBackupKeys(ctx, alice, version, "!room:localhost", "session1")
+	MustNotError(t, err)
+	if got := keys["!room:localhost"]["session1"]; !reflect.DeepEqual(got, verified) {
+		t.Errorf("got key %+v, want the verified key to have been kept", got)
+	}
+	if backup, err = db.GetKeyBackup(ctx, alice, version); err != nil || backup.Count != 2 || backup.ETag != etag {
+		t.Errorf("GetKeyBackup returned (%+v, %v), want count 2 and etag %q", backup, err, etag)
+	}
+
+	// deleting keys changes the etag, unless nothing was deleted
+	count, newETag, err := db.DeleteBackupKeys(ctx, alice, version, "!room:localhost", "session2")
+	MustNotError(t, err)
+	if count != 1 || newETag == etag {
+		t.Errorf("deleting a key: got count %d and etag %q, want count 1 and a new etag", count, newETag)
+	}
+	etag = newETag
+	count, newETag, err = db.DeleteBackupKeys(ctx, alice, version, "!other:localhost", "")
+	MustNotError(t, err)
+	if count != 1 || newETag != etag {
+		t.Errorf("deleting nothing: got count %d and etag %q, want count 1 and etag %q", count, newETag, etag)
+	}
+}
+
+func TestFallbackKeys(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:localhost"
+	claim := map[string]map[string]string{alice: {"DEVICE": "signed_curve25519"}}
+	// mustClaim claims a key for the device, checking that the wanted key is returned
+	mustClaim := func(name, wantKeyID string) {
+		t.Helper()
+		claimed, err := db.ClaimKeys(ctx, claim)
+		MustNotError(t, err)
+		if len(claimed) != 1 {
+			t.Fatalf("%s: got %d claimed keys, want 1", name, len(claimed))
+		}
+		if _, ok := claimed[0].KeyJSON[wantKeyID]; !ok {
+			t.Errorf("%s: got claimed keys %v, want %s", name, claimed[0].KeyJSON, wantKeyID)
+		}
+	}
+	// mustHaveUnused checks the algorithms of the device's unused fallback keys
+	mustHaveUnused := func(name string, want []string) {
+		t.Helper()
+		unused, err := db.UnusedFallbackKeyAlgorithms(ctx, alice, "DEVICE")
+		MustNotError(t, err)
+		if len(unused) != len(want) || (len(want) > 0 && !reflect.DeepEqual(unused, want)) {
+			t.Errorf("%s: got unused fallback key algorithms %v, want %v", name, unused, want)
+		}
+	}
+
+	// devices without any keys have nothing to claim
+	claimed, err := db.ClaimKeys(ctx, claim)
+	MustNotError(t, err)
+	if len(claimed) != 0 {
+		t.Errorf("got claimed keys %v for a device without any keys, want none", claimed)
+	}
+
+	_, err = db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON:  map[string]json.RawMessage{"signed_curve25519:otk": []byte(`{"key":"otk"}`)},
+	})
+	MustNotError(t, err)
+	fallback := api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON:  map[string]json.RawMessage{"signed_curve25519:fallback1": []byte(`{"key":"fallback1","fallback":true}`)},
+	}
+	MustNotError(t, db.StoreFallbackKeys(ctx, fallback))
+	mustHaveUnused("after upload", []string{"signed_curve25519"})
+
+	// one-time keys are handed out first, then the fallback key, which can be handed out again
+	mustClaim("first claim", "signed_curve25519:otk")
+	mustHaveUnused("after claiming a one-time key", []string{"signed_curve25519"})
+	mustClaim("claim when one-time keys are exhausted", "signed_curve25519:fallback1")
+	mustHaveUnused("after claiming the fallback key", nil)
+	mustClaim("claim after the fallback key was used", "signed_curve25519:fallback1")
+
+	// uploading the same fallback key again doesn't mark it as unused, but a new one is unused
+	MustNotError(t, db.StoreFallbackKeys(ctx, fallback))
+	mustHaveUnused("after uploading the same key again", nil)
+	MustNotError(t, db.StoreFallbackKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON:  map[string]json.RawMessage{"signed_curve25519:fallback2": []byte(`{"key":"fallback2","fallback":true}`)},
+	}))
+	mustHaveUnused("after uploading a new key", []string{"signed_curve25519"})
+	mustClaim("claim after a new fallback key", "signed_curve25519:fallback2")
+
+	// deleting the device's keys deletes its fallback keys too
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{UserID: alice, DeviceID: "DEVICE"}},
+	}))
+	if claimed, err = db.ClaimKeys(ctx, claim); err != nil || len(claimed) != 0 {
+		t.Errorf("got claimed keys (%v, %v) after the device's keys were deleted, want none", claimed, err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type OneTimeKeys interface {
@@ -27,8 +28,23 @@ type OneTimeKeys interface {
 	CountOneTimeKeys(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error)
 	InsertOneTimeKeys(ctx context.Context, keys api.OneTimeKeys) (*api.OneTimeKeysCount, error)
 	// SelectAndDeleteOneTimeKey selects a single one time key matching the user/device/algorithm specified and returns the algo:key_id => JSON.
-	// Returns an empty map if the key does not exist.
+	// Returns nil if the key does not exist.
 	SelectAndDeleteOneTimeKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// DeleteOneTimeKeys deletes all of the one-time keys of the device.
+	DeleteOneTimeKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+}
+
+type FallbackKeys interface {
+	// UpsertFallbackKey stores the fallback key for the algorithm, replacing any existing one. The key is marked unused
+	// unless it is the same key as the existing one.
+	UpsertFallbackKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm, keyID string, keyJSON json.RawMessage) error
+	// SelectAndMarkFallbackKeyUsed selects the fallback key matching the user/device/algorithm specified, marks it as used and
+	// returns the algo:key_id => JSON. The key is returned even if it has already been used. Returns nil if the key does not exist.
+	SelectAndMarkFallbackKeyUsed(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// SelectUnusedFallbackKeyAlgorithms returns the algorithms of the device's fallback keys which haven't been used.
+	SelectUnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+	// DeleteFallbackKeys deletes all of the fallback keys of the device.
+	DeleteFallbackKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
 }
 
 type DeviceKeys interface {
@@ -37,6 +53,8 @@ type DeviceKeys interface {
 	SelectMaxStreamIDForUser(ctx context.Context, txn *sql.Tx, userID string) (streamID int32, err error)
 	CountStreamIDsForUser(ctx context.Context, userID string, streamIDs []int64) (int, error)
 	SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error)
+	// DeleteAllDeviceKeys deletes all of the device keys of the user.
+	DeleteAllDeviceKeys(ctx context.Context, txn *sql.Tx, userID string) error
 }
 
 type KeyChanges interface {
@@ -45,3 +63,55 @@ type KeyChanges interface {
 	// Results are exclusive of fromOffset and inclusive of toOffset. A toOffset of sarama.OffsetNewest means no upper offset.
 	SelectKeyChanges(ctx context.Context, partition int32, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error)
 }
+
+type StaleDeviceLists interface {
+	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
+	// SelectUserIDsWithStaleDeviceLists returns the users on the given servers whose device lists are stale.
+	// If no servers are given then stale users on all servers are returned.
+	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+}
+
+type CrossSigningKeys interface {
+	// SelectCrossSigningKeysForUser returns the key JSON of each of the user's cross-signing keys.
+	SelectCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[api.CrossSigningKeyPurpose]json.RawMessage, error)
+	UpsertCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string, purpose api.CrossSigningKeyPurpose, keyJSON json.RawMessage) error
+	DeleteCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) error
+}
+
+type CrossSigningSigs interface {
+	// SelectCrossSigningSigsForTarget returns the signatures made by the origin user of the target key, as key ID => signature.
+	SelectCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, originUserID, targetUserID, targetKeyID string) (map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error)
+	UpsertCrossSigningSigsForTarget(
+		ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID,
+		targetUserID, targetKeyID string, signature gomatrixserverlib.Base64Bytes,
+	) error
+}
+
+type KeyBackupVersions interface {
+	// InsertKeyBackup creates a new version of the user's room key backup, returning the version.
+	InsertKeyBackup(ctx context.Context, txn *sql.Tx, userID, algorithm string, authData json.RawMessage) (version int64, err error)
+	UpdateKeyBackupAuthData(ctx context.Context, txn *sql.Tx, userID string, version int64, authData json.RawMessage) error
+	// UpdateKeyBackupETag changes the etag of the backup, which should be done whenever its keys change.
+	UpdateKeyBackupETag(ctx context.Context, txn *sql.Tx, userID string, version int64) error
+	// DeleteKeyBackup marks the backup as deleted, returning false if it didn't exist or was already deleted.
+	DeleteKeyBackup(ctx context.Context, txn *sql.Tx, userID string, version int64) (bool, error)
+	// SelectKeyBackup returns the backup, or sql.ErrNoRows if it doesn't exist or was deleted.
+	SelectKeyBackup(ctx context.Context, txn *sql.Tx, userID string, version int64) (algorithm string, authData json.RawMessage, etag int64, err error)
+	// SelectLatestKeyBackupVersion returns the user's newest backup which hasn't been deleted, or sql.ErrNoRows if there isn't one.
+	SelectLatestKeyBackupVersion(ctx context.Context, txn *sql.Tx, userID string) (int64, error)
+}
+
+type KeyBackups interface {
+	CountKeys(ctx context.Context, txn *sql.Tx, userID string, version int64) (int64, error)
+	UpsertBackupKey(ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string, key api.KeyBackupSession) error
+	// SelectKeys returns the keys in the backup as room ID => session ID => key.
+	SelectKeys(ctx context.Context, txn *sql.Tx, userID string, version int64) (map[string]map[string]api.KeyBackupSession, error)
+	SelectKeysByRoomID(ctx context.Context, txn *sql.Tx, userID string, version int64, roomID string) (map[string]map[string]api.KeyBackupSession, error)
+	SelectKeysByRoomIDAndSessionID(
+		ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+	) (map[string]map[string]api.KeyBackupSession, error)
+	// DeleteKeys removes the keys in the backup, returning the number of keys removed.
+	DeleteKeys(ctx context.Context, txn *sql.Tx, userID string, version int64) (int64, error)
+	DeleteKeysByRoomID(ctx context.Context, txn *sql.Tx, userID string, version int64, roomID string) (int64, error)
+	DeleteKeysByRoomIDAndSessionID(ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string) (int64, error)
+}
@@ -90,6 +90,13 @@ type RoomserverInternalAPI interface {
 		response *QueryServerAllowedToSeeEventResponse,
 	) error
 
+	// Query whether a local user is allowed to see each of a list of events
+	QueryUserAllowedToSeeEvents(
+		ctx context.Context,
+		request *QueryUserAllowedToSeeEventsRequest,
+		response *QueryUserAllowedToSeeEventsResponse,
+	) error
+
 	// Query missing events for a room from roomserver
 	QueryMissingEvents(
 		ctx context.Context,
@@ -136,6 +136,16 @@ func (t *RoomserverInternalAPITrace) QueryServerAllowedToSeeEvent(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	req *QueryUserAllowedToSeeEventsRequest,
+	res *QueryUserAllowedToSeeEventsResponse,
+) error {
+	err := t.Impl.QueryUserAllowedToSeeEvents(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryUserAllowedToSeeEvents req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryMissingEvents(
 	ctx context.Context,
 	req *QueryMissingEventsRequest,
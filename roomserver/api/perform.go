@@ -79,6 +79,8 @@ type PerformJoinRequest struct {
 	UserID        string                         `json:"user_id"`
 	Content       map[string]interface{}         `json:"content"`
 	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+	// Whether the user is a guest, in which case the room must allow guest access.
+	IsGuest bool `json:"is_guest"`
 }
 
 type PerformJoinResponse struct {
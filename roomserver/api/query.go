@@ -149,6 +149,21 @@ type QueryServerAllowedToSeeEventResponse struct {
 	AllowedToSeeEvent bool `json:"can_see_event"`
 }
 
+// QueryUserAllowedToSeeEventsRequest is a request to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsRequest struct {
+	// The local user who wants to see the events
+	UserID string `json:"user_id"`
+	// The event IDs to check
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryUserAllowedToSeeEventsResponse is a response to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsResponse struct {
+	// Whether the user is allowed to see each of the events, keyed by event ID.
+	// Events which don't exist are not allowed to be seen.
+	AllowedToSeeEvents map[string]bool `json:"allowed_to_see_events"`
+}
+
 // QueryMissingEventsRequest is a request to QueryMissingEvents
 type QueryMissingEventsRequest struct {
 	// Events which are known previous to the gap in the timeline.
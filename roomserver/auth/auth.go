@@ -52,6 +52,60 @@ func IsServerAllowed(
 	return false
 }
 
+// IsUserAllowed returns true if the local user is allowed to see the event,
+// given the state before the event. Only the history visibility and the user's
+// own membership are needed from the state. This function implements
+// https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func IsUserAllowed(
+	userID string,
+	userCurrentlyJoined bool,
+	event *gomatrixserverlib.Event,
+	stateBeforeEvent []gomatrixserverlib.Event,
+) bool {
+	// Users can always see their own membership events, otherwise they
+	// wouldn't find out that they had left a room or rejected an invite.
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKeyEquals(userID) {
+		return true
+	}
+
+	historyVisibility := HistoryVisibilityForRoom(stateBeforeEvent)
+
+	// 1. If the history_visibility was set to world_readable, allow.
+	if historyVisibility == "world_readable" {
+		return true
+	}
+	membership := MembershipForUser(userID, stateBeforeEvent)
+	// 2. If the user's membership was join, allow.
+	if membership == gomatrixserverlib.Join {
+		return true
+	}
+	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+	if historyVisibility == "shared" && userCurrentlyJoined {
+		return true
+	}
+	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
+	if membership == gomatrixserverlib.Invite && historyVisibility == "invited" {
+		return true
+	}
+
+	// 5. Otherwise, deny.
+	return false
+}
+
+// MembershipForUser returns the membership of the user in the given state, or
+// "leave" if the user has no membership event.
+func MembershipForUser(userID string, stateEvents []gomatrixserverlib.Event) string {
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || !ev.StateKeyEquals(userID) {
+			continue
+		}
+		if membership, err := ev.Membership(); err == nil {
+			return membership
+		}
+	}
+	return gomatrixserverlib.Leave
+}
+
 func HistoryVisibilityForRoom(authEvents []gomatrixserverlib.Event) string {
 	// https://matrix.org/docs/spec/client_server/r0.6.0#id87
 	// By default if no history_visibility is set, or if the value is not understood, the visibility is assumed to be shared.
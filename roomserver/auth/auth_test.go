@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testRoomID = "!room:localhost"
+	alice      = "@alice:localhost"
+	bob        = "@bob:localhost"
+)
+
+func mustCreateEvent(t *testing.T, eventType string, stateKey *string, content string) gomatrixserverlib.Event {
+	t.Helper()
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":"$event:localhost","room_id":%q,"sender":%q,"type":%q,%s"content":%s,"depth":1,"origin_server_ts":1,"prev_events":[],"auth_events":[]}`,
+		testRoomID, bob, eventType, stateKeyJSON, content,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %s", err)
+	}
+	return ev
+}
+
+func TestIsUserAllowed(t *testing.T) {
+	emptyStateKey := ""
+	aliceStateKey := alice
+	bobStateKey := bob
+	historyVisibility := func(visibility string) gomatrixserverlib.Event {
+		return mustCreateEvent(t, gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, fmt.Sprintf(`{"history_visibility":%q}`, visibility))
+	}
+	membership := func(membership string) gomatrixserverlib.Event {
+		return mustCreateEvent(t, gomatrixserverlib.MRoomMember, &aliceStateKey, fmt.Sprintf(`{"membership":%q}`, membership))
+	}
+	message := mustCreateEvent(t, "m.room.message", nil, `{"body":"hello"}`)
+	ownLeave := membership("leave")
+	bobJoin := mustCreateEvent(t, gomatrixserverlib.MRoomMember, &bobStateKey, `{"membership":"join"}`)
+
+	testCases := []struct {
+		Name            string
+		Visibility      string
+		Membership      string
+		CurrentlyJoined bool
+		Event           *gomatrixserverlib.Event
+		WantAllowed     bool
+	}{
+		{Name: "world_readable, never joined", Visibility: "world_readable", WantAllowed: true},
+		{Name: "shared, joined at the event", Visibility: "shared", Membership: "join", WantAllowed: true},
+		{Name: "shared, joined later", Visibility: "shared", CurrentlyJoined: true, WantAllowed: true},
+		{Name: "shared, never joined", Visibility: "shared", WantAllowed: false},
+		{Name: "shared, left", Visibility: "shared", Membership: "leave", WantAllowed: false},
+		{Name: "no visibility defaults to shared", CurrentlyJoined: true, WantAllowed: true},
+		{Name: "unknown visibility defaults to shared", Visibility: "unknown", CurrentlyJoined: true, WantAllowed: true},
+		{Name: "invited, invited at the event", Visibility: "invited", Membership: "invite", WantAllowed: true},
+		{Name: "invited, joined at the event", Visibility: "invited", Membership: "join", WantAllowed: true},
+		{Name: "invited, joined later", Visibility: "invited", CurrentlyJoined: true, WantAllowed: false},
+		{Name: "invited, left", Visibility: "invited", Membership: "leave", WantAllowed: false},
+		{Name: "joined, joined at the event", Visibility: "joined", Membership: "join", WantAllowed: true},
+		{Name: "joined, invited at the event", Visibility: "joined", Membership: "invite", WantAllowed: false},
+		{Name: "joined, joined later", Visibility: "joined", CurrentlyJoined: true, WantAllowed: false},
+		{Name: "joined, left", Visibility: "joined", Membership: "leave", WantAllowed: false},
+		{
+			Name:        "joined, own membership event",
+			Visibility:  "joined",
+			Membership:  "leave",
+			Event:       &ownLeave,
+			WantAllowed: true,
+		},
+		{
+			Name:        "joined, other user's membership event",
+			Visibility:  "joined",
+			Membership:  "leave",
+			Event:       &bobJoin,
+			WantAllowed: false,
+		},
+	}
+	for _, tc := range testCases {
+		var stateBeforeEvent []gomatrixserverlib.Event
+		if tc.Visibility != "" {
+			stateBeforeEvent = append(stateBeforeEvent, historyVisibility(tc.Visibility))
+		}
+		if tc.Membership != "" {
+			stateBeforeEvent = append(stateBeforeEvent, membership(tc.Membership))
+		}
+		event := tc.Event
+		if event == nil {
+			event = &message
+		}
+		if allowed := IsUserAllowed(alice, tc.CurrentlyJoined, event, stateBeforeEvent); allowed != tc.WantAllowed {
+			t.Errorf("%s: got allowed %v, want %v", tc.Name, allowed, tc.WantAllowed)
+		}
+	}
+}
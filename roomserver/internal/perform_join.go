@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -215,6 +216,20 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 		// If we haven't already joined the room then send an event
 		// into the room changing our membership status.
 		if !alreadyJoined {
+			// Guests can only join rooms which allow guest access.
+			if req.IsGuest {
+				allowed, gerr := r.isGuestAccessAllowed(ctx, req.RoomIDOrAlias)
+				if gerr != nil {
+					return "", fmt.Errorf("r.isGuestAccessAllowed: %w", gerr)
+				}
+				if !allowed {
+					return "", &api.PerformError{
+						Code: api.PerformErrorNotAllowed,
+						Msg:  "Guest access is forbidden in this room",
+					}
+				}
+			}
+
 			inputReq := api.InputRoomEventsRequest{
 				InputRoomEvents: []api.InputRoomEvent{
 					{
@@ -269,6 +284,30 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 	return req.RoomIDOrAlias, nil
 }
 
+// isGuestAccessAllowed returns true if the current m.room.guest_access event
+// of the room allows guests to join it.
+func (r *RoomserverInternalAPI) isGuestAccessAllowed(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	res := api.QueryLatestEventsAndStateResponse{}
+	if err := r.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.guest_access", StateKey: ""},
+		},
+	}, &res); err != nil {
+		return false, err
+	}
+	for _, ev := range res.StateEvents {
+		var content eventutil.GuestAccessContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			return false, nil
+		}
+		return content.GuestAccess == "can_join", nil
+	}
+	return false, nil
+}
+
 func (r *RoomserverInternalAPI) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
@@ -399,6 +399,91 @@ func (r *RoomserverInternalAPI) checkServerAllowedToSeeEvent(
 	return auth.IsServerAllowed(serverName, isServerInRoom, stateAtEvent), nil
 }
 
+// QueryUserAllowedToSeeEvents implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	response.AllowedToSeeEvents = make(map[string]bool, len(request.EventIDs))
+	events, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
+	if err != nil {
+		return err
+	}
+	// The user won't have a state key NID if they have never been in any room,
+	// in which case there is no membership state to look for.
+	stateKeyNIDs, err := r.DB.EventStateKeyNIDs(ctx, []string{request.UserID})
+	if err != nil {
+		return err
+	}
+	userNID, hasUserNID := stateKeyNIDs[request.UserID]
+
+	// Events which follow each other without any state changes in between
+	// share the same state snapshot, so look up the snapshot of each event
+	// and only load the state of each snapshot once.
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, eventIDs)
+	if err != nil {
+		return err
+	}
+	snapshotNIDs := make(map[types.EventNID]types.StateSnapshotNID, len(stateAtEvents))
+	for _, stateAtEvent := range stateAtEvents {
+		snapshotNIDs[stateAtEvent.EventNID] = stateAtEvent.BeforeStateSnapshotNID
+	}
+
+	roomState := state.NewStateResolution(r.DB)
+	// room ID -> whether the user is currently joined
+	isJoined := make(map[string]bool)
+	// snapshot NID -> the history visibility and user's membership in the snapshot
+	stateAtSnapshot := make(map[types.StateSnapshotNID][]gomatrixserverlib.Event)
+	for i := range events {
+		event := &events[i].Event
+		roomID := event.RoomID()
+		joined, ok := isJoined[roomID]
+		if !ok {
+			if joined, err = r.isUserCurrentlyJoined(ctx, request.UserID, roomID); err != nil {
+				return err
+			}
+			isJoined[roomID] = joined
+		}
+
+		snapshotNID := snapshotNIDs[events[i].EventNID]
+		if snapshotNID == 0 {
+			return fmt.Errorf("no state snapshot for event %s, was this event stored?", event.EventID())
+		}
+		stateBeforeEvent, ok := stateAtSnapshot[snapshotNID]
+		if !ok {
+			stateEntries, err := roomState.LoadStateAtSnapshot(ctx, snapshotNID)
+			if err != nil {
+				return err
+			}
+			// Only the history visibility and the user's membership are needed, so
+			// avoid loading the rest of the state.
+			var eventNIDs []types.EventNID
+			for _, entry := range stateEntries {
+				switch {
+				case entry.EventTypeNID == types.MRoomHistoryVisibilityNID && entry.EventStateKeyNID == types.EmptyStateKeyNID:
+					eventNIDs = append(eventNIDs, entry.EventNID)
+				case hasUserNID && entry.EventTypeNID == types.MRoomMemberNID && entry.EventStateKeyNID == userNID:
+					eventNIDs = append(eventNIDs, entry.EventNID)
+				}
+			}
+			if stateBeforeEvent, err = r.loadEvents(ctx, eventNIDs); err != nil {
+				return err
+			}
+			stateAtSnapshot[snapshotNID] = stateBeforeEvent
+		}
+
+		response.AllowedToSeeEvents[event.EventID()] = auth.IsUserAllowed(
+			request.UserID, joined, event, stateBeforeEvent,
+		)
+	}
+	return nil
+}
+
 // QueryMissingEvents implements api.RoomserverInternalAPI
 func (r *RoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -554,6 +639,15 @@ func (r *RoomserverInternalAPI) backfillViaFederation(ctx context.Context, req *
 	return nil
 }
 
+func (r *RoomserverInternalAPI) isUserCurrentlyJoined(ctx context.Context, userID, roomID string) (bool, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	_, stillInRoom, err := r.DB.GetMembership(ctx, roomNID, userID)
+	return stillInRoom, err
+}
+
 func (r *RoomserverInternalAPI) isServerCurrentlyInRoom(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID string) (bool, error) {
 	roomNID, err := r.DB.RoomNID(ctx, roomID)
 	if err != nil {
@@ -17,9 +17,12 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -155,3 +158,143 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+// visibilityDB holds the events of a single room, each stored in its own
+// state block with the same NID as the snapshot, and panics if anything else
+// is called.
+type visibilityDB struct {
+	storage.Database
+	events         []types.Event
+	snapshotNIDs   map[types.EventNID]types.StateSnapshotNID
+	snapshots      map[types.StateSnapshotNID][]types.StateEntry
+	snapshotLoads  int
+	userStateKeyID types.EventStateKeyNID
+}
+
+func (db *visibilityDB) EventsFromIDs(ctx context.Context, eventIDs []string) (res []types.Event, err error) {
+	for _, eventID := range eventIDs {
+		for _, ev := range db.events {
+			if ev.EventID() == eventID {
+				res = append(res, ev)
+			}
+		}
+	}
+	return
+}
+
+func (db *visibilityDB) Events(ctx context.Context, eventNIDs []types.EventNID) (res []types.Event, err error) {
+	for _, eventNID := range eventNIDs {
+		for _, ev := range db.events {
+			if ev.EventNID == eventNID {
+				res = append(res, ev)
+			}
+		}
+	}
+	return
+}
+
+func (db *visibilityDB) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return map[string]types.EventStateKeyNID{eventStateKeys[0]: db.userStateKeyID}, nil
+}
+
+func (db *visibilityDB) StateAtEventIDs(ctx context.Context, eventIDs []string) (res []types.StateAtEvent, err error) {
+	events, _ := db.EventsFromIDs(ctx, eventIDs)
+	for _, ev := range events {
+		res = append(res, types.StateAtEvent{
+			BeforeStateSnapshotNID: db.snapshotNIDs[ev.EventNID],
+			StateEntry:             types.StateEntry{EventNID: ev.EventNID},
+		})
+	}
+	return
+}
+
+func (db *visibilityDB) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) (res []types.StateBlockNIDList, err error) {
+	db.snapshotLoads++
+	for _, stateNID := range stateNIDs {
+		res = append(res, types.StateBlockNIDList{
+			StateSnapshotNID: stateNID,
+			StateBlockNIDs:   []types.StateBlockNID{types.StateBlockNID(stateNID)},
+		})
+	}
+	return
+}
+
+func (db *visibilityDB) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) (res []types.StateEntryList, err error) {
+	for _, stateBlockNID := range stateBlockNIDs {
+		res = append(res, types.StateEntryList{
+			StateBlockNID: stateBlockNID,
+			StateEntries:  db.snapshots[types.StateSnapshotNID(stateBlockNID)],
+		})
+	}
+	return
+}
+
+func (db *visibilityDB) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
+	return 1, nil
+}
+
+func (db *visibilityDB) GetMembership(ctx context.Context, roomNID types.RoomNID, userID string) (types.EventNID, bool, error) {
+	return 0, false, nil
+}
+
+func mustCreateVisibilityEvent(t *testing.T, eventNID types.EventNID, eventType, stateKey, content string) types.Event {
+	t.Helper()
+	eventJSON := fmt.Sprintf(
+		`{"event_id":"$%d:localhost","room_id":"!room:localhost","sender":"@alice:localhost","type":%q,%s"content":%s,"depth":1,"origin_server_ts":1,"prev_events":[],"auth_events":[]}`,
+		eventNID, eventType, stateKey, content,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %s", err)
+	}
+	return types.Event{EventNID: eventNID, Event: ev}
+}
+
+func TestQueryUserAllowedToSeeEventsLoadsSnapshotsOnce(t *testing.T) {
+	alice := "@alice:localhost"
+	aliceNID := types.EventStateKeyNID(10)
+	aliceStateKey := fmt.Sprintf(`"state_key":%q,`, alice)
+	db := &visibilityDB{
+		userStateKeyID: aliceNID,
+		events: []types.Event{
+			mustCreateVisibilityEvent(t, 1, "m.room.history_visibility", `"state_key":"",`, `{"history_visibility":"joined"}`),
+			mustCreateVisibilityEvent(t, 2, "m.room.member", aliceStateKey, `{"membership":"join"}`),
+			mustCreateVisibilityEvent(t, 3, "m.room.message", "", `{"body":"first"}`),
+			mustCreateVisibilityEvent(t, 4, "m.room.message", "", `{"body":"second"}`),
+			mustCreateVisibilityEvent(t, 5, "m.room.member", aliceStateKey, `{"membership":"leave"}`),
+			mustCreateVisibilityEvent(t, 6, "m.room.message", "", `{"body":"third"}`),
+		},
+		// Both of the first messages were sent while alice was joined, and the
+		// third after she left.
+		snapshotNIDs: map[types.EventNID]types.StateSnapshotNID{3: 1, 4: 1, 6: 2},
+		snapshots: map[types.StateSnapshotNID][]types.StateEntry{
+			1: {
+				{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomMemberNID, EventStateKeyNID: aliceNID}, EventNID: 2},
+				{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomHistoryVisibilityNID, EventStateKeyNID: types.EmptyStateKeyNID}, EventNID: 1},
+			},
+			2: {
+				{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomMemberNID, EventStateKeyNID: aliceNID}, EventNID: 5},
+				{StateKeyTuple: types.StateKeyTuple{EventTypeNID: types.MRoomHistoryVisibilityNID, EventStateKeyNID: types.EmptyStateKeyNID}, EventNID: 1},
+			},
+		},
+	}
+	r := &RoomserverInternalAPI{DB: db}
+
+	req := api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   alice,
+		EventIDs: []string{"$3:localhost", "$4:localhost", "$6:localhost"},
+	}
+	var res api.QueryUserAllowedToSeeEventsResponse
+	if err := r.QueryUserAllowedToSeeEvents(context.Background(), &req, &res); err != nil {
+		t.Fatalf("QueryUserAllowedToSeeEvents returned error: %s", err)
+	}
+	want := map[string]bool{"$3:localhost": true, "$4:localhost": true, "$6:localhost": false}
+	for eventID, wantAllowed := range want {
+		if allowed := res.AllowedToSeeEvents[eventID]; allowed != wantAllowed {
+			t.Errorf("got allowed %v for %s, want %v", allowed, eventID, wantAllowed)
+		}
+	}
+	if db.snapshotLoads != 2 {
+		t.Errorf("loaded state snapshots %d times, want 2", db.snapshotLoads)
+	}
+}
@@ -38,6 +38,7 @@ const (
 	RoomserverQueryMembershipForUserPath       = "/roomserver/queryMembershipForUser"
 	RoomserverQueryMembershipsForRoomPath      = "/roomserver/queryMembershipsForRoom"
 	RoomserverQueryServerAllowedToSeeEventPath = "/roomserver/queryServerAllowedToSeeEvent"
+	RoomserverQueryUserAllowedToSeeEventsPath  = "/roomserver/queryUserAllowedToSeeEvents"
 	RoomserverQueryMissingEventsPath           = "/roomserver/queryMissingEvents"
 	RoomserverQueryStateAndAuthChainPath       = "/roomserver/queryStateAndAuthChain"
 	RoomserverQueryRoomVersionCapabilitiesPath = "/roomserver/queryRoomVersionCapabilities"
@@ -303,6 +304,19 @@ func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryUserAllowedToSeeEvents implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryUserAllowedToSeeEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryUserAllowedToSeeEventsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMissingEvents implements RoomServerQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
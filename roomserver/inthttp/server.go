@@ -170,6 +170,20 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		RoomserverQueryUserAllowedToSeeEventsPath,
+		httputil.MakeInternalAPI("queryUserAllowedToSeeEvents", func(req *http.Request) util.JSONResponse {
+			var request api.QueryUserAllowedToSeeEventsRequest
+			var response api.QueryUserAllowedToSeeEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryUserAllowedToSeeEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryMissingEventsPath,
 		httputil.MakeInternalAPI("queryMissingEvents", func(req *http.Request) util.JSONResponse {
@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputPresenceEventConsumer consumes presence updates that originated in the EDU server.
+type OutputPresenceEventConsumer struct {
+	presenceConsumer *internal.ContinualConsumer
+	db               storage.Database
+	notifier         *sync.Notifier
+	currentStateAPI  currentstateAPI.CurrentStateInternalAPI
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+	currentStateAPI currentstateAPI.CurrentStateInternalAPI,
+) *OutputPresenceEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputPresenceEventConsumer{
+		presenceConsumer: &consumer,
+		db:               store,
+		notifier:         n,
+		currentStateAPI:  currentStateAPI,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":  output.UserID,
+		"presence": output.Presence,
+	}).Debug("received presence from EDU server")
+
+	streamPos, err := s.db.SetPresence(
+		context.TODO(),
+		output.UserID,
+		output.Presence,
+		output.StatusMsg,
+		output.LastActiveTS,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Wake up the user and everyone who shares a room with them.
+	var queryRes currentstateAPI.QuerySharedUsersResponse
+	err = s.currentStateAPI.QuerySharedUsers(context.TODO(), &currentstateAPI.QuerySharedUsersRequest{
+		UserID: output.UserID,
+	}, &queryRes)
+	if err != nil {
+		log.WithError(err).Error("syncapi: failed to QuerySharedUsers for presence event from EDU server")
+		return err
+	}
+	userIDs := []string{output.UserID}
+	for userID := range queryRes.UserIDsToCount {
+		if userID != output.UserID {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	s.notifier.OnNewEvent(nil, "", userIDs, types.NewStreamToken(streamPos, 0, nil))
+	return nil
+}
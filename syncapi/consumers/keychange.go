@@ -17,6 +17,7 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"sync"
 
 	"github.com/Shopify/sarama"
@@ -126,30 +127,57 @@ func (s *OutputKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) er
 	return nil
 }
 
-func (s *OutputKeyChangeEventConsumer) OnJoinEvent(ev *gomatrixserverlib.HeaderedEvent) {
-	// work out who we are now sharing rooms with which we previously were not and notify them about the joining
-	// users keys:
-	changed, _, err := syncinternal.TrackChangedUsers(context.Background(), s.currentStateAPI, *ev.StateKey(), []string{ev.RoomID()}, nil)
-	if err != nil {
-		log.WithError(err).Error("OnJoinEvent: failed to work out changed users")
-		return
+// OnJoinEvent stores that the local users in the room who didn't share any other rooms with the joining user should
+// now track their device list, and wakes up their /sync streams so that the joining user is sent down in
+// device_lists.changed.
+func (s *OutputKeyChangeEventConsumer) OnJoinEvent(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) {
+	if err := s.trackMembershipChange(ctx, ev, true); err != nil {
+		log.WithError(err).Error("OnJoinEvent: failed to track device list changes")
 	}
-	// TODO: f.e changed, wake up stream
-	for _, userID := range changed {
-		log.Infof("OnJoinEvent:Notify %s that %s should have device lists tracked", userID, *ev.StateKey())
+}
+
+// OnLeaveEvent stores that the local users in the room who don't share any other rooms with the leaving user should
+// stop tracking their device list, and wakes up their /sync streams so that the leaving user is sent down in
+// device_lists.left.
+func (s *OutputKeyChangeEventConsumer) OnLeaveEvent(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) {
+	if err := s.trackMembershipChange(ctx, ev, false); err != nil {
+		log.WithError(err).Error("OnLeaveEvent: failed to track device list changes")
 	}
 }
 
-func (s *OutputKeyChangeEventConsumer) OnLeaveEvent(ev *gomatrixserverlib.HeaderedEvent) {
-	// work out who we are no longer sharing any rooms with and notify them about the leaving user
-	_, left, err := syncinternal.TrackChangedUsers(context.Background(), s.currentStateAPI, *ev.StateKey(), nil, []string{ev.RoomID()})
+// trackMembershipChange must be called after the membership event has been written to the database, so that the
+// joined users of the room are up to date.
+func (s *OutputKeyChangeEventConsumer) trackMembershipChange(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, joined bool,
+) error {
+	targetUserID := *ev.StateKey()
+	joinedUsers, err := s.db.JoinedUsersInRoom(ctx, ev.RoomID())
 	if err != nil {
-		log.WithError(err).Error("OnLeaveEvent: failed to work out left users")
-		return
+		return fmt.Errorf("s.db.JoinedUsersInRoom: %w", err)
 	}
-	// TODO: f.e left, wake up stream
-	for _, userID := range left {
-		log.Infof("OnLeaveEvent:Notify %s that %s should no longer track device lists", userID, *ev.StateKey())
+	// only local users sync with us, so only they need to be told
+	var localUsers []string
+	for _, userID := range joinedUsers {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != s.serverName {
+			continue
+		}
+		localUsers = append(localUsers, userID)
 	}
-
+	if len(localUsers) == 0 {
+		return nil
+	}
+	userIDs, err := syncinternal.TrackMembershipChanges(ctx, s.currentStateAPI, targetUserID, ev.RoomID(), localUsers)
+	if err != nil {
+		return fmt.Errorf("syncinternal.TrackMembershipChanges: %w", err)
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	pos, err := s.db.StoreDeviceListChanges(ctx, userIDs, targetUserID, joined)
+	if err != nil {
+		return fmt.Errorf("s.db.StoreDeviceListChanges: %w", err)
+	}
+	s.notifier.OnNewEvent(nil, "", userIDs, types.NewStreamToken(pos, 0, nil))
+	return nil
 }
@@ -163,12 +163,12 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	}
 	s.notifier.OnNewEvent(&ev, "", nil, types.NewStreamToken(pduPos, 0, nil))
 
-	s.notifyKeyChanges(&ev)
+	s.notifyKeyChanges(ctx, &ev)
 
 	return nil
 }
 
-func (s *OutputRoomEventConsumer) notifyKeyChanges(ev *gomatrixserverlib.HeaderedEvent) {
+func (s *OutputRoomEventConsumer) notifyKeyChanges(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) {
 	if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
 		return
 	}
@@ -178,11 +178,11 @@ func (s *OutputRoomEventConsumer) notifyKeyChanges(ev *gomatrixserverlib.Headere
 	}
 	switch membership {
 	case gomatrixserverlib.Join:
-		s.keyChanges.OnJoinEvent(ev)
+		s.keyChanges.OnJoinEvent(ctx, ev)
 	case gomatrixserverlib.Ban:
 		fallthrough
 	case gomatrixserverlib.Leave:
-		s.keyChanges.OnLeaveEvent(ev)
+		s.keyChanges.OnLeaveEvent(ctx, ev)
 	}
 }
 
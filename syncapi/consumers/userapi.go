@@ -0,0 +1,150 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/userapi/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputNotificationDataConsumer consumes changes to unread notification
+// counts that originated in the user API server.
+type OutputNotificationDataConsumer struct {
+	notificationConsumer *internal.ContinualConsumer
+	db                   storage.Database
+	notifier             *sync.Notifier
+}
+
+// NewOutputNotificationDataConsumer creates a new OutputNotificationDataConsumer.
+// Call Start() to begin consuming from the user API server.
+func NewOutputNotificationDataConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputNotificationDataConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputNotificationData),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputNotificationDataConsumer{
+		notificationConsumer: &consumer,
+		db:                   store,
+		notifier:             n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from user api
+func (s *OutputNotificationDataConsumer) Start() error {
+	return s.notificationConsumer.Start()
+}
+
+func (s *OutputNotificationDataConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputNotificationData
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("user API output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id": output.UserID,
+		"room_id": output.RoomID,
+	}).Debug("received notification data from user API")
+
+	streamPos, err := s.db.UpsertRoomUnreadNotificationCounts(context.TODO(), output.UserID, output.RoomID)
+	if err != nil {
+		return err
+	}
+
+	s.notifier.OnNewEvent(nil, "", []string{output.UserID}, types.NewStreamToken(streamPos, 0, nil))
+	return nil
+}
+
+// OutputDevicesDeletedConsumer consumes the devices which were logged out in
+// the user API server.
+type OutputDevicesDeletedConsumer struct {
+	devicesDeletedConsumer *internal.ContinualConsumer
+	db                     storage.Database
+	notifier               *sync.Notifier
+}
+
+// NewOutputDevicesDeletedConsumer creates a new OutputDevicesDeletedConsumer.
+// Call Start() to begin consuming from the user API server.
+func NewOutputDevicesDeletedConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputDevicesDeletedConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputDevicesDeleted),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputDevicesDeletedConsumer{
+		devicesDeletedConsumer: &consumer,
+		db:                     store,
+		notifier:               n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from user api
+func (s *OutputDevicesDeletedConsumer) Start() error {
+	return s.devicesDeletedConsumer.Start()
+}
+
+func (s *OutputDevicesDeletedConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputDevicesDeleted
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("user API output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":    output.UserID,
+		"device_ids": output.DeviceIDs,
+	}).Debug("received deleted devices from user API")
+
+	// The devices can no longer sync, so they stop peeking into rooms.
+	if err := s.db.DeletePeeksForDevices(context.TODO(), output.UserID, output.DeviceIDs); err != nil {
+		return err
+	}
+	s.notifier.OnDeletedDevices(output.UserID, output.DeviceIDs)
+	return nil
+}
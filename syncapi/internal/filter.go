@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import "strings"
+
+// EventMatchesFilter returns true if an event with the given sender and type
+// is allowed by the senders, not_senders, types and not_types lists of a
+// filter. Empty senders and types lists allow everything.
+func EventMatchesFilter(sender, evType string, senders, notSenders, types, notTypes []string) bool {
+	if len(senders) > 0 && !stringInSlice(sender, senders) {
+		return false
+	}
+	if stringInSlice(sender, notSenders) {
+		return false
+	}
+	if len(types) > 0 && !typeMatchesAny(evType, types) {
+		return false
+	}
+	return !typeMatchesAny(evType, notTypes)
+}
+
+// RoomIncluded returns true if the room is allowed by the rooms and not_rooms
+// lists of a filter. An empty rooms list allows every room.
+func RoomIncluded(roomID string, rooms, notRooms []string) bool {
+	if len(rooms) > 0 && !stringInSlice(roomID, rooms) {
+		return false
+	}
+	return !stringInSlice(roomID, notRooms)
+}
+
+// typeMatchesAny returns true if the event type matches any of the given
+// filter types. A "*" at the end of a filter type matches any suffix.
+func typeMatchesAny(evType string, filterTypes []string) bool {
+	for _, filterType := range filterTypes {
+		if strings.HasSuffix(filterType, "*") {
+			if strings.HasPrefix(evType, strings.TrimSuffix(filterType, "*")) {
+				return true
+			}
+		} else if evType == filterType {
+			return true
+		}
+	}
+	return false
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
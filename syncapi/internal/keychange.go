@@ -16,7 +16,6 @@ package internal
 
 import (
 	"context"
-	"strings"
 
 	"github.com/Shopify/sarama"
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
@@ -29,7 +28,16 @@ import (
 
 const DeviceListLogName = "dl"
 
-// DeviceOTKCounts adds one-time key counts to the /sync response
+// DeviceListChangesDatabase is the part of the sync API database which
+// DeviceListCatchup needs, to read the device list changes which were stored
+// when other users joined or left rooms.
+type DeviceListChangesDatabase interface {
+	// GetDeviceListChangesInRange returns the users who the user started sharing a room with (changed) and stopped
+	// sharing any rooms with (left) between two given positions.
+	GetDeviceListChangesInRange(ctx context.Context, userID string, r types.Range) (changed, left []string, err error)
+}
+
+// DeviceOTKCounts adds one-time key counts and unused fallback key types to the /sync response
 func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID, deviceID string, res *types.Response) error {
 	var queryRes api.QueryOneTimeKeysResponse
 	keyAPI.QueryOneTimeKeys(ctx, &api.QueryOneTimeKeysRequest{
@@ -40,6 +48,9 @@ func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID,
 		return queryRes.Error
 	}
 	res.DeviceListsOTKCount = queryRes.Count.KeyCount
+	if queryRes.UnusedFallbackAlgorithms != nil {
+		res.DeviceUnusedFallbackKeyTypes = queryRes.UnusedFallbackAlgorithms
+	}
 	return nil
 }
 
@@ -47,7 +58,7 @@ func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID,
 // was filled in, else false if there are no new device list changes because there is nothing to catch up on. The response MUST
 // be already filled in with join/leave information.
 func DeviceListCatchup(
-	ctx context.Context, keyAPI keyapi.KeyInternalAPI, stateAPI currentstateAPI.CurrentStateInternalAPI,
+	ctx context.Context, db DeviceListChangesDatabase, keyAPI keyapi.KeyInternalAPI, stateAPI currentstateAPI.CurrentStateInternalAPI,
 	userID string, res *types.Response, from, to types.StreamingToken,
 ) (hasNew bool, err error) {
 
@@ -64,6 +75,39 @@ func DeviceListCatchup(
 		hasNew = len(changed) > 0 || len(left) > 0
 	}
 
+	// Track users who joined or left rooms which we were already in. These are stored by the roomserver
+	// consumer as the membership events arrive, at the same stream positions as the events.
+	joinedUsers, leftUsers, err := db.GetDeviceListChangesInRange(ctx, userID, types.Range{
+		From: from.PDUPosition(),
+		To:   to.PDUPosition(),
+	})
+	if err != nil {
+		// don't fail the catchup because we may have got useful information by tracking our own membership
+		util.GetLogger(ctx).WithError(err).Error("GetDeviceListChangesInRange failed")
+	}
+	userSet := make(map[string]bool)
+	for _, userID := range res.DeviceLists.Changed {
+		userSet[userID] = true
+	}
+	for _, userID := range joinedUsers {
+		if !userSet[userID] {
+			res.DeviceLists.Changed = append(res.DeviceLists.Changed, userID)
+			hasNew = true
+			userSet[userID] = true
+		}
+	}
+	leftSet := make(map[string]bool)
+	for _, userID := range res.DeviceLists.Left {
+		leftSet[userID] = true
+	}
+	for _, userID := range leftUsers {
+		if !leftSet[userID] {
+			res.DeviceLists.Left = append(res.DeviceLists.Left, userID)
+			hasNew = true
+			leftSet[userID] = true
+		}
+	}
+
 	// now also track users who we already share rooms with but who have updated their devices between the two tokens
 
 	var partition int32
@@ -96,27 +140,43 @@ func DeviceListCatchup(
 		util.GetLogger(ctx).WithError(queryRes.Error).Error("QueryKeyChanges failed")
 		return hasNew, nil
 	}
-	userSet := make(map[string]bool)
-	for _, userID := range res.DeviceLists.Changed {
-		userSet[userID] = true
-	}
 	for _, userID := range queryRes.UserIDs {
-		if !userSet[userID] {
+		// users we no longer share any rooms with are only reported in `left`
+		if !userSet[userID] && !leftSet[userID] {
 			res.DeviceLists.Changed = append(res.DeviceLists.Changed, userID)
 			hasNew = true
 			userSet[userID] = true
 		}
 	}
-	// if the response has any join/leave events, add them now.
-	// TODO: This is sub-optimal because we will add users to `changed` even if we already shared a room with them.
-	for _, userID := range membershipEvents(res) {
-		if !userSet[userID] {
-			res.DeviceLists.Changed = append(res.DeviceLists.Changed, userID)
-			hasNew = true
-			userSet[userID] = true
+	return hasNew, nil
+}
+
+// TrackMembershipChanges works out which of the given users, who are joined to the room, start or stop sharing rooms
+// with the target user because the target user joined or left the room. These are the users who don't share any other
+// rooms with the target user, and need to be told about the target user via device_lists.changed|left in /sync. Our
+// own joins and leaves are handled by TrackChangedUsers when we sync instead.
+func TrackMembershipChanges(
+	ctx context.Context, stateAPI currentstateAPI.CurrentStateInternalAPI, targetUserID, roomID string, userIDs []string,
+) (affected []string, err error) {
+	// The room is excluded whether the target user joined or left it, as the current state server may not have
+	// processed the membership event yet.
+	var queryRes currentstateAPI.QuerySharedUsersResponse
+	err = stateAPI.QuerySharedUsers(ctx, &currentstateAPI.QuerySharedUsersRequest{
+		UserID:         targetUserID,
+		ExcludeRoomIDs: []string{roomID},
+	}, &queryRes)
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range userIDs {
+		if userID == targetUserID {
+			continue
+		}
+		if _, ok := queryRes.UserIDsToCount[userID]; !ok {
+			affected = append(affected, userID)
 		}
 	}
-	return hasNew, nil
+	return affected, nil
 }
 
 // TrackChangedUsers calculates the values of device_lists.changed|left in the /sync response.
@@ -245,25 +305,3 @@ func membershipEventPresent(events []gomatrixserverlib.ClientEvent, userID strin
 	}
 	return false
 }
-
-// returns the user IDs of anyone joining or leaving a room in this response. These users will be added to
-// the 'changed' property because of https://matrix.org/docs/spec/client_server/r0.6.1#id84
-// "For optimal performance, Alice should be added to changed in Bob's sync only when she adds a new device,
-// or when Alice and Bob now share a room but didn't share any room previously. However, for the sake of simpler
-// logic, a server may add Alice to changed when Alice and Bob share a new room, even if they previously already shared a room."
-func membershipEvents(res *types.Response) (userIDs []string) {
-	for _, room := range res.Rooms.Join {
-		for _, ev := range room.Timeline.Events {
-			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
-				if strings.Contains(string(ev.Content), `"join"`) {
-					userIDs = append(userIDs, *ev.StateKey)
-				} else if strings.Contains(string(ev.Content), `"leave"`) {
-					userIDs = append(userIDs, *ev.StateKey)
-				} else if strings.Contains(string(ev.Content), `"ban"`) {
-					userIDs = append(userIDs, *ev.StateKey)
-				}
-			}
-		}
-	}
-	return
-}
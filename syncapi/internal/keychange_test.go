@@ -35,6 +35,18 @@ func (k *mockKeyAPI) SetUserAPI(i userapi.UserInternalAPI) {}
 // PerformClaimKeys claims one-time keys for use in pre-key messages
 func (k *mockKeyAPI) PerformClaimKeys(ctx context.Context, req *keyapi.PerformClaimKeysRequest, res *keyapi.PerformClaimKeysResponse) {
 }
+func (k *mockKeyAPI) PerformUploadDeviceKeys(ctx context.Context, req *keyapi.PerformUploadDeviceKeysRequest, res *keyapi.PerformUploadDeviceKeysResponse) {
+}
+func (k *mockKeyAPI) PerformUploadDeviceSignatures(ctx context.Context, req *keyapi.PerformUploadDeviceSignaturesRequest, res *keyapi.PerformUploadDeviceSignaturesResponse) {
+}
+func (k *mockKeyAPI) PerformKeyBackup(ctx context.Context, req *keyapi.PerformKeyBackupRequest, res *keyapi.PerformKeyBackupResponse) {
+}
+func (k *mockKeyAPI) PerformUploadRoomKeys(ctx context.Context, req *keyapi.PerformUploadRoomKeysRequest, res *keyapi.PerformUploadRoomKeysResponse) {
+}
+func (k *mockKeyAPI) PerformDeleteRoomKeys(ctx context.Context, req *keyapi.PerformDeleteRoomKeysRequest, res *keyapi.PerformDeleteRoomKeysResponse) {
+}
+func (k *mockKeyAPI) QueryKeyBackup(ctx context.Context, req *keyapi.QueryKeyBackupRequest, res *keyapi.QueryKeyBackupResponse) {
+}
 func (k *mockKeyAPI) QueryKeys(ctx context.Context, req *keyapi.QueryKeysRequest, res *keyapi.QueryKeysResponse) {
 }
 func (k *mockKeyAPI) QueryKeyChanges(ctx context.Context, req *keyapi.QueryKeyChangesRequest, res *keyapi.QueryKeyChangesResponse) {
@@ -114,6 +126,19 @@ func (s *mockCurrentStateAPI) QuerySharedUsers(ctx context.Context, req *api.Que
 	return nil
 }
 
+// mockDeviceListChangesDB returns the same stored device list changes for any
+// user, and records the range they were asked for.
+type mockDeviceListChangesDB struct {
+	changed []string
+	left    []string
+	r       types.Range
+}
+
+func (d *mockDeviceListChangesDB) GetDeviceListChangesInRange(ctx context.Context, userID string, r types.Range) (changed, left []string, err error) {
+	d.r = r
+	return d.changed, d.left, nil
+}
+
 type wantCatchup struct {
 	hasNew  bool
 	changed []string
@@ -181,7 +206,7 @@ func TestKeyChangeCatchupOnJoinShareNewUser(t *testing.T) {
 	syncResponse := types.NewResponse()
 	syncResponse = joinResponseWithRooms(syncResponse, syncingUser, []string{newlyJoinedRoom})
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			newlyJoinedRoom: {syncingUser, newShareUser},
 			"!another:room": {syncingUser},
@@ -203,7 +228,7 @@ func TestKeyChangeCatchupOnLeaveShareLeftUser(t *testing.T) {
 	syncResponse := types.NewResponse()
 	syncResponse = leaveResponseWithRooms(syncResponse, syncingUser, []string{newlyLeftRoom})
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			newlyLeftRoom:   {removeUser},
 			"!another:room": {syncingUser},
@@ -225,7 +250,7 @@ func TestKeyChangeCatchupOnJoinShareNoNewUsers(t *testing.T) {
 	syncResponse := types.NewResponse()
 	syncResponse = joinResponseWithRooms(syncResponse, syncingUser, []string{newlyJoinedRoom})
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			newlyJoinedRoom: {syncingUser, existingUser},
 			"!another:room": {syncingUser, existingUser},
@@ -246,7 +271,7 @@ func TestKeyChangeCatchupOnLeaveShareNoUsers(t *testing.T) {
 	syncResponse := types.NewResponse()
 	syncResponse = leaveResponseWithRooms(syncResponse, syncingUser, []string{newlyLeftRoom})
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			newlyLeftRoom:   {existingUser},
 			"!another:room": {syncingUser, existingUser},
@@ -305,7 +330,7 @@ func TestKeyChangeCatchupNoNewJoinsButMessages(t *testing.T) {
 	jr.Timeline.Events = roomTimelineEvents
 	syncResponse.Rooms.Join[roomID] = jr
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			roomID: {syncingUser, existingUser},
 		},
@@ -330,7 +355,7 @@ func TestKeyChangeCatchupChangeAndLeft(t *testing.T) {
 	syncResponse = joinResponseWithRooms(syncResponse, syncingUser, []string{newlyJoinedRoom})
 	syncResponse = leaveResponseWithRooms(syncResponse, syncingUser, []string{newlyLeftRoom})
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			newlyJoinedRoom: {syncingUser, newShareUser, newShareUser2},
 			newlyLeftRoom:   {newlyLeftUser, newlyLeftUser2},
@@ -415,7 +440,7 @@ func TestKeyChangeCatchupChangeAndLeftSameRoom(t *testing.T) {
 	lr.Timeline.Events = roomEvents
 	syncResponse.Rooms.Leave[roomID] = lr
 
-	hasNew, err := DeviceListCatchup(context.Background(), &mockKeyAPI{}, &mockCurrentStateAPI{
+	hasNew, err := DeviceListCatchup(context.Background(), &mockDeviceListChangesDB{}, &mockKeyAPI{}, &mockCurrentStateAPI{
 		roomIDToJoinedMembers: map[string][]string{
 			roomID:          {newShareUser, newShareUser2},
 			"!another:room": {syncingUser},
@@ -429,3 +454,81 @@ func TestKeyChangeCatchupChangeAndLeftSameRoom(t *testing.T) {
 		left:   []string{newShareUser, newShareUser2},
 	})
 }
+
+// tests that the device list changes stored when other users joined or left rooms are included, without duplicating
+// the users found by tracking our own membership.
+func TestKeyChangeCatchupStoredMembershipChanges(t *testing.T) {
+	newShareUser := "@bill:localhost"
+	otherJoinUser := "@bob:localhost"
+	otherLeaveUser := "@charlie:localhost"
+	newlyJoinedRoom := "!TestKeyChangeCatchupStoredMembershipChanges:bar"
+	syncResponse := types.NewResponse()
+	syncResponse = joinResponseWithRooms(syncResponse, syncingUser, []string{newlyJoinedRoom})
+	db := &mockDeviceListChangesDB{
+		changed: []string{newShareUser, otherJoinUser},
+		left:    []string{otherLeaveUser},
+	}
+
+	from := types.NewStreamToken(5, 0, nil)
+	to := types.NewStreamToken(10, 0, map[string]*types.LogPosition{
+		DeviceListLogName: &types.LogPosition{
+			Offset:    sarama.OffsetNewest,
+			Partition: 0,
+		},
+	})
+	hasNew, err := DeviceListCatchup(context.Background(), db, &mockKeyAPI{}, &mockCurrentStateAPI{
+		roomIDToJoinedMembers: map[string][]string{
+			newlyJoinedRoom: {syncingUser, newShareUser},
+			"!another:room": {syncingUser},
+		},
+	}, syncingUser, syncResponse, from, to)
+	if err != nil {
+		t.Fatalf("DeviceListCatchup returned an error: %s", err)
+	}
+	assertCatchup(t, hasNew, syncResponse, wantCatchup{
+		hasNew:  true,
+		changed: []string{newShareUser, otherJoinUser},
+		left:    []string{otherLeaveUser},
+	})
+	if db.r.Low() != 5 || db.r.High() != 10 {
+		t.Errorf("got device list changes in range (%d, %d], want (5, 10]", db.r.Low(), db.r.High())
+	}
+}
+
+// tests that only the users who don't share any other rooms with a user who joins or leaves a room are affected.
+func TestTrackMembershipChanges(t *testing.T) {
+	targetUser := "@bill:localhost"
+	existingUser := "@bob:localhost"
+	newShareUser := "@charlie:localhost"
+	roomID := "!TestTrackMembershipChanges:bar"
+	stateAPI := &mockCurrentStateAPI{
+		roomIDToJoinedMembers: map[string][]string{
+			roomID:          {syncingUser, targetUser, existingUser, newShareUser},
+			"!another:room": {targetUser, existingUser},
+		},
+	}
+
+	affected, err := TrackMembershipChanges(context.Background(), stateAPI, targetUser, roomID, []string{
+		syncingUser, targetUser, existingUser, newShareUser,
+	})
+	if err != nil {
+		t.Fatalf("TrackMembershipChanges returned an error: %s", err)
+	}
+	sort.Strings(affected)
+	if want := []string{syncingUser, newShareUser}; !reflect.DeepEqual(affected, want) {
+		t.Errorf("got affected users %v, want %v", affected, want)
+	}
+
+	// The result is the same once the current state knows that the target user left the room.
+	stateAPI.roomIDToJoinedMembers[roomID] = []string{syncingUser, existingUser, newShareUser}
+	affected, err = TrackMembershipChanges(context.Background(), stateAPI, targetUser, roomID, []string{
+		syncingUser, existingUser, newShareUser,
+	})
+	if err != nil {
+		t.Fatalf("TrackMembershipChanges returned an error: %s", err)
+	}
+	sort.Strings(affected)
+	if want := []string{syncingUser, newShareUser}; !reflect.DeepEqual(affected, want) {
+		t.Errorf("got affected users %v after leaving, want %v", affected, want)
+	}
+}
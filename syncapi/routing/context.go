@@ -0,0 +1,269 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultContextLimit = 10
+	maxContextLimit     = 100
+)
+
+type contextResp struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+// OnIncomingContextRequest implements the /context endpoint from the
+// client-server API.
+// See: https://matrix.org/docs/spec/client_server/latest#get-matrix-client-r0-rooms-roomid-context-eventid
+func OnIncomingContextRequest(
+	req *http.Request, device *userapi.Device, syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI, roomID, eventID string,
+) util.JSONResponse {
+	ctx := req.Context()
+
+	// Maximum number of events to return, split between the events before
+	// and after the requested event; defaults to 10.
+	limit := defaultContextLimit
+	if s := req.URL.Query().Get("limit"); len(s) > 0 {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit could not be parsed into a non-negative integer"),
+			}
+		}
+		if limit > maxContextLimit {
+			limit = maxContextLimit
+		}
+	}
+
+	var filter gomatrixserverlib.RoomEventFilter
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err := json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The filter could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+
+	membershipRes := api.QueryMembershipForUserResponse{}
+	err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
+		}
+	}
+
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The event was not found in this room."),
+		}
+	}
+	ev := &events[0]
+
+	visibility := newHistoryVisibility(rsAPI, device.UserID)
+	visible, err := visibility.canSee(ctx, ev)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("visibility.canSee failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The event was not found in this room."),
+		}
+	}
+
+	beforeLimit := limit / 2
+	afterLimit := limit - beforeLimit
+	before, after, start, end, err := eventsAroundEvent(ctx, syncDB, visibility, ev, beforeLimit, afterLimit, &filter)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("eventsAroundEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	state, err := stateAtEvent(ctx, rsAPI, ev)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateAtEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	state = filterRoomEvents(state, &filter)
+	if filter.LazyLoadMembers {
+		// Only include the membership events of the users who sent the
+		// events that we're returning.
+		senders := map[string]bool{ev.Sender(): true}
+		for _, e := range append(before, after...) {
+			senders[e.Sender()] = true
+		}
+		state = lazyLoadMembers(state, senders)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: contextResp{
+			Start:        start.String(),
+			End:          end.String(),
+			Event:        gomatrixserverlib.HeaderedToClientEvent(*ev, gomatrixserverlib.FormatAll),
+			EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+			EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+			State:        gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll),
+		},
+	}
+}
+
+// stateAtEvent returns the state of the room after the given event, rather
+// than the current state, as clients use it to display the events around it.
+func stateAtEvent(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, ev *gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	var res api.QueryStateAndAuthChainResponse
+	err := rsAPI.QueryStateAndAuthChain(ctx, &api.QueryStateAndAuthChainRequest{
+		RoomID:       ev.RoomID(),
+		PrevEventIDs: []string{ev.EventID()},
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	if !res.RoomExists || !res.PrevEventsExist {
+		// The roomserver doesn't know the state at the event, e.g. because
+		// it was received over federation without its state.
+		return []gomatrixserverlib.HeaderedEvent{}, nil
+	}
+	return res.StateEvents, nil
+}
+
+// eventsAroundEvent returns up to beforeLimit events before the given event,
+// most recent first, and up to afterLimit events after it, in chronological
+// order. Only events which are visible to the user and which match the filter,
+// if one is given, are returned. The start and end topology tokens can be used
+// with /messages to continue paginating backwards and forwards respectively.
+func eventsAroundEvent(
+	ctx context.Context, syncDB storage.Database, visibility *historyVisibility,
+	ev *gomatrixserverlib.HeaderedEvent, beforeLimit, afterLimit int,
+	filter *gomatrixserverlib.RoomEventFilter,
+) (before, after []gomatrixserverlib.HeaderedEvent, start, end types.TopologyToken, err error) {
+	pos, err := syncDB.EventPositionInTopology(ctx, ev.EventID())
+	if err != nil {
+		return
+	}
+	start, end = pos, pos
+
+	if beforeLimit > 0 {
+		earliest := types.NewTopologyToken(0, 0)
+		var streamEvents []types.StreamEvent
+		streamEvents, err = syncDB.GetEventsInTopologicalRange(ctx, &pos, &earliest, ev.RoomID(), beforeLimit, true)
+		if err != nil {
+			return
+		}
+		if len(streamEvents) > 0 {
+			// Paginating backwards from the earliest event that we looked at
+			// won't return it again, even if it was filtered out here.
+			if start, err = syncDB.EventPositionInTopology(ctx, streamEvents[len(streamEvents)-1].EventID()); err != nil {
+				return
+			}
+		}
+		if before, err = visibility.filter(ctx, filterRoomEvents(syncDB.StreamEventsToEvents(nil, streamEvents), filter)); err != nil {
+			return
+		}
+	}
+	if afterLimit > 0 {
+		var latest types.TopologyToken
+		if latest, err = syncDB.MaxTopologicalPosition(ctx, ev.RoomID()); err != nil {
+			return
+		}
+		var streamEvents []types.StreamEvent
+		streamEvents, err = syncDB.GetEventsInTopologicalRange(ctx, &pos, &latest, ev.RoomID(), afterLimit, false)
+		if err != nil {
+			return
+		}
+		if len(streamEvents) > 0 {
+			if end, err = syncDB.EventPositionInTopology(ctx, streamEvents[len(streamEvents)-1].EventID()); err != nil {
+				return
+			}
+		}
+		if after, err = visibility.filter(ctx, filterRoomEvents(syncDB.StreamEventsToEvents(nil, streamEvents), filter)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// filterRoomEvents returns the events which match the senders and types of
+// the given filter. Returns all of the events if the filter is nil.
+func filterRoomEvents(
+	events []gomatrixserverlib.HeaderedEvent, filter *gomatrixserverlib.RoomEventFilter,
+) []gomatrixserverlib.HeaderedEvent {
+	if filter == nil {
+		return events
+	}
+	filtered := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if internal.EventMatchesFilter(ev.Sender(), ev.Type(), filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
+// lazyLoadMembers removes the membership events from the given state, except
+// for those of the given users.
+func lazyLoadMembers(
+	state []gomatrixserverlib.HeaderedEvent, userIDs map[string]bool,
+) []gomatrixserverlib.HeaderedEvent {
+	filtered := make([]gomatrixserverlib.HeaderedEvent, 0, len(state))
+	for _, ev := range state {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil && !userIDs[*ev.StateKey()] {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
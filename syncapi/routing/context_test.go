@@ -0,0 +1,239 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testRoomID = "!room:localhost"
+	testUserID = "@alice:localhost"
+)
+
+// contextDatabase holds a single room whose events are at depths 1, 2, 3...
+// in the order given, and panics if anything else is called.
+type contextDatabase struct {
+	storage.Database
+	events []gomatrixserverlib.HeaderedEvent
+}
+
+func (d *contextDatabase) Events(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.HeaderedEvent, error) {
+	var res []gomatrixserverlib.HeaderedEvent
+	for _, ev := range d.events {
+		for _, eventID := range eventIDs {
+			if ev.EventID() == eventID {
+				res = append(res, ev)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (d *contextDatabase) EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error) {
+	for i, ev := range d.events {
+		if ev.EventID() == eventID {
+			return types.NewTopologyToken(types.StreamPosition(i+1), types.StreamPosition(i+1)), nil
+		}
+	}
+	return types.TopologyToken{}, fmt.Errorf("unknown event %s", eventID)
+}
+
+func (d *contextDatabase) GetEventsInTopologicalRange(
+	ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	var res []types.StreamEvent
+	depth := int(from.Depth())
+	if backwardOrdering {
+		for i := depth - 1; i >= 1 && len(res) < limit; i-- {
+			res = append(res, types.StreamEvent{HeaderedEvent: d.events[i-1]})
+		}
+	} else {
+		for i := depth + 1; i <= len(d.events) && len(res) < limit; i++ {
+			res = append(res, types.StreamEvent{HeaderedEvent: d.events[i-1]})
+		}
+	}
+	return res, nil
+}
+
+func (d *contextDatabase) MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error) {
+	return types.NewTopologyToken(types.StreamPosition(len(d.events)), types.StreamPosition(len(d.events))), nil
+}
+
+func (d *contextDatabase) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent {
+	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		out[i] = in[i].HeaderedEvent
+	}
+	return out
+}
+
+// contextRoomserverAPI lets the user see every event, returns the given state
+// for any event, and panics if anything else is called.
+type contextRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	state         []gomatrixserverlib.HeaderedEvent
+	stateQueryIDs []string
+}
+
+func (r *contextRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse,
+) error {
+	res.HasBeenInRoom = true
+	res.IsInRoom = true
+	return nil
+}
+
+func (r *contextRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context, req *api.QueryUserAllowedToSeeEventsRequest, res *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedToSeeEvents = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.AllowedToSeeEvents[eventID] = true
+	}
+	return nil
+}
+
+func (r *contextRoomserverAPI) QueryStateAndAuthChain(
+	ctx context.Context, req *api.QueryStateAndAuthChainRequest, res *api.QueryStateAndAuthChainResponse,
+) error {
+	r.stateQueryIDs = req.PrevEventIDs
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.StateEvents = r.state
+	return nil
+}
+
+func mustCreateEvent(t *testing.T, eventID, eventType string, stateKey *string, content string) gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":%q,"room_id":%q,"sender":%q,"type":%q,%s"content":%s,"depth":1,"origin_server_ts":1,"prev_events":[],"auth_events":[]}`,
+		eventID, testRoomID, testUserID, eventType, stateKeyJSON, content,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func newContextTestRoom(t *testing.T) (*contextDatabase, *contextRoomserverAPI) {
+	db := &contextDatabase{}
+	for i := 1; i <= 5; i++ {
+		db.events = append(db.events, mustCreateEvent(
+			t, fmt.Sprintf("$event%d:localhost", i), "m.room.message", nil, fmt.Sprintf(`{"body":"%d"}`, i),
+		))
+	}
+	emptyStateKey := ""
+	rsAPI := &contextRoomserverAPI{
+		state: []gomatrixserverlib.HeaderedEvent{
+			mustCreateEvent(t, "$name:localhost", gomatrixserverlib.MRoomName, &emptyStateKey, `{"name":"Name at the event"}`),
+		},
+	}
+	return db, rsAPI
+}
+
+func TestContextReturnsStateAtEvent(t *testing.T) {
+	db, rsAPI := newContextTestRoom(t)
+	device := &userapi.Device{UserID: testUserID}
+	eventID := db.events[2].EventID()
+
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/context/"+eventID+"?limit=2", nil)
+	res := OnIncomingContextRequest(req, device, db, rsAPI, testRoomID, eventID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %+v", res.Code, res.JSON)
+	}
+	resp := res.JSON.(contextResp)
+	if resp.Event.EventID != eventID {
+		t.Errorf("got event %s, want %s", resp.Event.EventID, eventID)
+	}
+	if len(resp.EventsBefore) != 1 || resp.EventsBefore[0].EventID != db.events[1].EventID() {
+		t.Errorf("got events before %+v, want only %s", resp.EventsBefore, db.events[1].EventID())
+	}
+	if len(resp.EventsAfter) != 1 || resp.EventsAfter[0].EventID != db.events[3].EventID() {
+		t.Errorf("got events after %+v, want only %s", resp.EventsAfter, db.events[3].EventID())
+	}
+
+	// The state must be looked up at the requested event, not taken from the
+	// current state of the room.
+	if len(rsAPI.stateQueryIDs) != 1 || rsAPI.stateQueryIDs[0] != eventID {
+		t.Errorf("got state queried at %v, want [%s]", rsAPI.stateQueryIDs, eventID)
+	}
+	if len(resp.State) != 1 || resp.State[0].EventID != "$name:localhost" {
+		t.Errorf("got state %+v, want only the name event", resp.State)
+	}
+}
+
+func TestContextFiltersState(t *testing.T) {
+	db, rsAPI := newContextTestRoom(t)
+	device := &userapi.Device{UserID: testUserID}
+	eventID := db.events[2].EventID()
+
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/context/"+eventID+`?filter={"types":["m.room.message"]}`, nil)
+	res := OnIncomingContextRequest(req, device, db, rsAPI, testRoomID, eventID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %+v", res.Code, res.JSON)
+	}
+	if state := res.JSON.(contextResp).State; len(state) != 0 {
+		t.Errorf("got state %+v, want none as it doesn't match the filter", state)
+	}
+}
+
+func TestContextInvalidLimit(t *testing.T) {
+	db, rsAPI := newContextTestRoom(t)
+	device := &userapi.Device{UserID: testUserID}
+	eventID := db.events[2].EventID()
+
+	for _, limit := range []string{"-1", "ten"} {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/context/"+eventID+"?limit="+limit, nil)
+		res := OnIncomingContextRequest(req, device, db, rsAPI, testRoomID, eventID)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("limit %s: got status %d, want 400", limit, res.Code)
+		}
+	}
+}
+
+func TestSearchContextNegativeLimit(t *testing.T) {
+	db, rsAPI := newContextTestRoom(t)
+	visibility := newHistoryVisibility(rsAPI, testUserID)
+	ev := db.events[2]
+
+	// Negative limits are treated as the maximum limit rather than as zero.
+	negative := -1
+	res, err := searchContextForEvent(context.Background(), db, visibility, &ev, &searchEventContext{
+		BeforeLimit: &negative,
+		AfterLimit:  &negative,
+	})
+	if err != nil {
+		t.Fatalf("searchContextForEvent returned error: %s", err)
+	}
+	if len(res.EventsBefore) != 2 || len(res.EventsAfter) != 2 {
+		t.Errorf("got %d events before and %d after, want 2 and 2", len(res.EventsBefore), len(res.EventsAfter))
+	}
+}
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -26,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
@@ -36,6 +38,7 @@ type messagesReq struct {
 	db               storage.Database
 	rsAPI            api.RoomserverInternalAPI
 	federation       *gomatrixserverlib.FederationClient
+	device           *userapi.Device
 	cfg              *config.Dendrite
 	roomID           string
 	from             *types.TopologyToken
@@ -50,6 +53,7 @@ type messagesResp struct {
 	Start string                          `json:"start"`
 	End   string                          `json:"end"`
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	State []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -58,7 +62,7 @@ const defaultMessagesLimit = 10
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
 func OnIncomingMessagesRequest(
-	req *http.Request, db storage.Database, roomID string,
+	req *http.Request, device *userapi.Device, db storage.Database, roomID string,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.Dendrite,
@@ -128,7 +132,17 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
+
+	// TODO: Implement the rest of filtering (#587)
+	var filter gomatrixserverlib.RoomEventFilter
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err = json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The filter could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -143,6 +157,7 @@ func OnIncomingMessagesRequest(
 		db:               db,
 		rsAPI:            rsAPI,
 		federation:       federation,
+		device:           device,
 		cfg:              cfg,
 		roomID:           roomID,
 		from:             &from,
@@ -168,15 +183,48 @@ func OnIncomingMessagesRequest(
 		"return_end":   end.String(),
 	}).Info("Responding")
 
+	res := messagesResp{
+		Chunk: clientEvents,
+		Start: start.String(),
+		End:   end.String(),
+	}
+	if filter.LazyLoadMembers {
+		// Include the membership events of the senders of the returned events.
+		res.State, err = membersForSenders(req.Context(), db, roomID, clientEvents)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("membersForSenders failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	// Respond with the events.
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: messagesResp{
-			Chunk: clientEvents,
-			Start: start.String(),
-			End:   end.String(),
-		},
+		JSON: res,
+	}
+}
+
+// membersForSenders returns the current membership events of the senders of
+// the given events.
+func membersForSenders(
+	ctx context.Context, db storage.Database, roomID string, events []gomatrixserverlib.ClientEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	seen := make(map[string]bool, len(events))
+	var members []gomatrixserverlib.ClientEvent
+	for _, ev := range events {
+		if seen[ev.Sender] {
+			continue
+		}
+		seen[ev.Sender] = true
+		member, err := db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, ev.Sender)
+		if err != nil {
+			return nil, err
+		}
+		if member != nil {
+			members = append(members, gomatrixserverlib.HeaderedToClientEvent(*member, gomatrixserverlib.FormatAll))
+		}
 	}
+	return members, nil
 }
 
 // retrieveEvents retrieve events from the local database for a request on
@@ -239,17 +287,28 @@ func (r *messagesReq) retrieveEvents() (
 		events = reversed(events)
 	}
 
-	// Convert all of the events into client events.
-	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
 	// Get the position of the first and the last event in the room's topology.
 	// This position is currently determined by the event's depth, so we could
 	// also use it instead of retrieving from the database. However, if we ever
 	// change the way topological positions are defined (as depth isn't the most
 	// reliable way to define it), it would be easier and less troublesome to
 	// only have to change it in one place, i.e. the database.
-	start, end, err = r.getStartEnd(events)
+	if start, end, err = r.getStartEnd(events); err != nil {
+		return
+	}
+
+	// Remove the events which the user isn't allowed to see. This is done after
+	// working out the tokens, so that the next page starts after the events
+	// which were hidden rather than returning them again.
+	if events, err = newHistoryVisibility(r.rsAPI, r.device.UserID).filter(r.ctx, events); err != nil {
+		err = fmt.Errorf("historyVisibility.filter: %w", err)
+		return
+	}
+
+	// Convert all of the events into client events.
+	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
 
-	return clientEvents, start, end, err
+	return clientEvents, start, end, nil
 }
 
 func (r *messagesReq) getStartEnd(events []gomatrixserverlib.HeaderedEvent) (start, end types.TopologyToken, err error) {
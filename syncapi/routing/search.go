@@ -0,0 +1,387 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+)
+
+// searchKeys are the event keys which are indexed for searching.
+var searchKeys = []string{"content.body", "content.name", "content.topic"}
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *searchEventContext               `json:"event_context"`
+	IncludeState bool                              `json:"include_state"`
+	Groupings    struct {
+		GroupBy []struct {
+			Key string `json:"key"`
+		} `json:"group_by"`
+	} `json:"groupings"`
+}
+
+type searchEventContext struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents roomEventsResults `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	Count      int                                        `json:"count"`
+	Highlights []string                                   `json:"highlights"`
+	Results    []searchResult                             `json:"results"`
+	State      map[string][]gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+	Groups     map[string]map[string]*searchGroup         `json:"groups,omitempty"`
+	NextBatch  string                                     `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchResultContext          `json:"context,omitempty"`
+}
+
+type searchResultContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]searchProfile        `json:"profile_info,omitempty"`
+}
+
+type searchProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type searchGroup struct {
+	Results   []string `json:"results"`
+	Order     int      `json:"order"`
+	NextBatch string   `json:"next_batch,omitempty"`
+}
+
+// Search implements POST /search
+func Search(
+	req *http.Request, device *userapi.Device, syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+
+	var r searchRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	criteria := r.SearchCategories.RoomEvents
+	if criteria == nil {
+		// room_events is the only category, so there is nothing to search.
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				SearchCategories struct{} `json:"search_categories"`
+			}{},
+		}
+	}
+	if strings.TrimSpace(criteria.SearchTerm) == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("search_term must be supplied"),
+		}
+	}
+
+	keys := criteria.Keys
+	if len(keys) == 0 {
+		keys = searchKeys
+	}
+	for _, key := range keys {
+		if !stringInSlice(key, searchKeys) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unsupported search key: " + key),
+			}
+		}
+	}
+
+	var orderByRank bool
+	switch criteria.OrderBy {
+	case "", "rank":
+		orderByRank = true
+	case "recent":
+		orderByRank = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order_by must be either 'rank' or 'recent'"),
+		}
+	}
+
+	groupBy := map[string]bool{}
+	for _, g := range criteria.Groupings.GroupBy {
+		if g.Key != "room_id" && g.Key != "sender" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unsupported group_by key: " + g.Key),
+			}
+		}
+		groupBy[g.Key] = true
+	}
+
+	// The next_batch token is the offset into the result set.
+	var offset int
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		offset, err = strconv.Atoi(nextBatch)
+		if err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch token"),
+			}
+		}
+	}
+
+	limit := criteria.Filter.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	} else if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	// Only search rooms that the user is currently joined to.
+	roomIDs, err := syncDB.RoomIDsWithMembership(ctx, device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.RoomIDsWithMembership failed")
+		return jsonerror.InternalServerError()
+	}
+	roomIDs = filterSearchRooms(roomIDs, criteria.Filter.Rooms, criteria.Filter.NotRooms)
+
+	matches, count, err := syncDB.SearchEvents(
+		ctx, criteria.SearchTerm, roomIDs, keys,
+		criteria.Filter.Senders, criteria.Filter.NotSenders,
+		orderByRank, limit, offset,
+	)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.SearchEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	eventIDs := make([]string, len(matches))
+	for i, match := range matches {
+		eventIDs[i] = match.EventID
+	}
+	events, err := syncDB.Events(ctx, eventIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for i := range events {
+		eventsByID[events[i].EventID()] = &events[i]
+	}
+
+	var res searchResponse
+	results := &res.SearchCategories.RoomEvents
+	results.Count = count
+	results.Highlights = strings.Fields(strings.ToLower(criteria.SearchTerm))
+	results.Results = []searchResult{}
+	if offset+len(matches) < count {
+		results.NextBatch = strconv.Itoa(offset + len(matches))
+	}
+
+	visibility := newHistoryVisibility(rsAPI, device.UserID)
+	matchIDs := make([]string, len(matches))
+	for i := range matches {
+		matchIDs[i] = matches[i].EventID
+	}
+	// Check all of the results at once, rather than one at a time in the loop.
+	if err = visibility.check(ctx, matchIDs); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("visibility.check failed")
+		return jsonerror.InternalServerError()
+	}
+	resultRooms := map[string]bool{}
+	for _, match := range matches {
+		ev, ok := eventsByID[match.EventID]
+		if !ok {
+			continue
+		}
+		var visible bool
+		visible, err = visibility.canSee(ctx, ev)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("visibility.canSee failed")
+			return jsonerror.InternalServerError()
+		}
+		if !visible {
+			continue
+		}
+
+		result := searchResult{
+			Rank:   match.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(*ev, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			result.Context, err = searchContextForEvent(ctx, syncDB, visibility, ev, criteria.EventContext)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("searchContextForEvent failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		results.Results = append(results.Results, result)
+		resultRooms[ev.RoomID()] = true
+
+		if len(groupBy) > 0 {
+			if results.Groups == nil {
+				results.Groups = map[string]map[string]*searchGroup{}
+			}
+			for key := range groupBy {
+				value := ev.RoomID()
+				if key == "sender" {
+					value = ev.Sender()
+				}
+				if results.Groups[key] == nil {
+					results.Groups[key] = map[string]*searchGroup{}
+				}
+				group, ok := results.Groups[key][value]
+				if !ok {
+					group = &searchGroup{
+						Order:     len(results.Groups[key]) + 1,
+						NextBatch: results.NextBatch,
+					}
+					results.Groups[key][value] = group
+				}
+				group.Results = append(group.Results, ev.EventID())
+			}
+		}
+	}
+
+	if criteria.IncludeState {
+		results.State = map[string][]gomatrixserverlib.ClientEvent{}
+		for roomID := range resultRooms {
+			stateFilter := gomatrixserverlib.DefaultStateFilter()
+			var stateEvents []gomatrixserverlib.HeaderedEvent
+			stateEvents, err = syncDB.GetStateEventsForRoom(ctx, roomID, &stateFilter)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("syncDB.GetStateEventsForRoom failed")
+				return jsonerror.InternalServerError()
+			}
+			results.State[roomID] = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// filterSearchRooms restricts the given rooms to those included by the rooms
+// and notRooms parts of a search filter.
+func filterSearchRooms(roomIDs, rooms, notRooms []string) []string {
+	filtered := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if internal.RoomIncluded(roomID, rooms, notRooms) {
+			filtered = append(filtered, roomID)
+		}
+	}
+	return filtered
+}
+
+// searchContextForEvent returns the events surrounding the given search
+// result, which are included in the response if the client asked for them.
+func searchContextForEvent(
+	ctx context.Context, syncDB storage.Database, visibility *historyVisibility,
+	ev *gomatrixserverlib.HeaderedEvent, eventContext *searchEventContext,
+) (*searchResultContext, error) {
+	beforeLimit, afterLimit := 5, 5
+	if eventContext.BeforeLimit != nil {
+		beforeLimit = *eventContext.BeforeLimit
+	}
+	if eventContext.AfterLimit != nil {
+		afterLimit = *eventContext.AfterLimit
+	}
+	if beforeLimit < 0 || beforeLimit > maxContextLimit {
+		beforeLimit = maxContextLimit
+	}
+	if afterLimit < 0 || afterLimit > maxContextLimit {
+		afterLimit = maxContextLimit
+	}
+
+	before, after, start, end, err := eventsAroundEvent(ctx, syncDB, visibility, ev, beforeLimit, afterLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &searchResultContext{
+		Start:        start.String(),
+		End:          end.String(),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+	}
+
+	if eventContext.IncludeProfile {
+		res.ProfileInfo = map[string]searchProfile{}
+		senders := []string{ev.Sender()}
+		for _, e := range append(before, after...) {
+			senders = append(senders, e.Sender())
+		}
+		for _, sender := range senders {
+			if _, ok := res.ProfileInfo[sender]; ok {
+				continue
+			}
+			var member *gomatrixserverlib.HeaderedEvent
+			member, err = syncDB.GetStateEvent(ctx, ev.RoomID(), gomatrixserverlib.MRoomMember, sender)
+			if err != nil {
+				return nil, err
+			}
+			var profile searchProfile
+			if member != nil {
+				profile.DisplayName = gjson.GetBytes(member.Content(), "displayname").Str
+				profile.AvatarURL = gjson.GetBytes(member.Content(), "avatar_url").Str
+			}
+			res.ProfileInfo[sender] = profile
+		}
+	}
+
+	return res, nil
+}
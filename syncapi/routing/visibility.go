@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// historyVisibility decides whether a user can see events, by asking the
+// roomserver to check the history visibility of the rooms and the user's
+// membership at each event. Results are cached for the lifetime of the
+// request.
+type historyVisibility struct {
+	rsAPI  api.RoomserverInternalAPI
+	userID string
+	// allowed maps an event ID to whether the user can see the event
+	allowed map[string]bool
+}
+
+func newHistoryVisibility(rsAPI api.RoomserverInternalAPI, userID string) *historyVisibility {
+	return &historyVisibility{
+		rsAPI:   rsAPI,
+		userID:  userID,
+		allowed: map[string]bool{},
+	}
+}
+
+func (v *historyVisibility) canSee(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) (bool, error) {
+	if err := v.check(ctx, []string{ev.EventID()}); err != nil {
+		return false, err
+	}
+	return v.allowed[ev.EventID()], nil
+}
+
+func (v *historyVisibility) filter(ctx context.Context, events []gomatrixserverlib.HeaderedEvent) ([]gomatrixserverlib.HeaderedEvent, error) {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	if err := v.check(ctx, eventIDs); err != nil {
+		return nil, err
+	}
+	filtered := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for i := range events {
+		if v.allowed[events[i].EventID()] {
+			filtered = append(filtered, events[i])
+		}
+	}
+	return filtered, nil
+}
+
+// check asks the roomserver whether the user can see the given events, for
+// those which aren't already cached.
+func (v *historyVisibility) check(ctx context.Context, eventIDs []string) error {
+	var unknown []string
+	for _, eventID := range eventIDs {
+		if _, ok := v.allowed[eventID]; !ok {
+			unknown = append(unknown, eventID)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	var res api.QueryUserAllowedToSeeEventsResponse
+	err := v.rsAPI.QueryUserAllowedToSeeEvents(ctx, &api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   v.userID,
+		EventIDs: unknown,
+	}, &res)
+	if err != nil {
+		return err
+	}
+	for _, eventID := range unknown {
+		v.allowed[eventID] = res.AllowedToSeeEvents[eventID]
+	}
+	return nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"time"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -30,6 +31,8 @@ type Database interface {
 	internal.PartitionStorer
 	// AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
+	// JoinedUsersInRoom returns the IDs of the users who are joined to the room.
+	JoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error)
 	// Events lookups a list of event by their event ID.
 	// Returns a list of events matching the requested IDs found in the database.
 	// If an event is not found in the database then it will be omitted from the list.
@@ -55,12 +58,13 @@ type Database interface {
 	// sync response for the given user. Events returned will include any client
 	// transaction IDs associated with the given device. These transaction IDs come
 	// from when the device sent the event via an API that included a transaction
-	// ID. A response object must be provided for IncrementaSync to populate - it
-	// will not create one.
-	IncrementalSync(ctx context.Context, res *types.Response, device userapi.Device, fromPos, toPos types.StreamingToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
-	// CompleteSync returns a complete /sync API response for the given user. A response object
-	// must be provided for CompleteSync to populate - it will not create one.
-	CompleteSync(ctx context.Context, res *types.Response, device userapi.Device, numRecentEventsPerRoom int) (*types.Response, error)
+	// ID. Only the rooms and events which match the filter are returned. A response object must
+	// be provided for IncrementaSync to populate - it will not create one.
+	IncrementalSync(ctx context.Context, res *types.Response, device userapi.Device, fromPos, toPos types.StreamingToken, filter *gomatrixserverlib.Filter, wantFullState bool) (*types.Response, error)
+	// CompleteSync returns a complete /sync API response for the given user, containing only the
+	// rooms and events which match the filter. A response object must be provided for CompleteSync
+	// to populate - it will not create one.
+	CompleteSync(ctx context.Context, res *types.Response, device userapi.Device, filter *gomatrixserverlib.Filter) (*types.Response, error)
 	// GetAccountDataInRange returns all account data for a given user inserted or
 	// updated between two given positions
 	// Returns a map following the format data[roomID] = []dataTypes
@@ -74,6 +78,36 @@ type Database interface {
 	// creates a new row, else update the existing one
 	// Returns an error if there was an issue with the upsert
 	UpsertAccountData(ctx context.Context, userID, roomID, dataType string) (types.StreamPosition, error)
+	// StoreReceipt stores the latest receipt of the given type for a user in a room.
+	// Returns the stream position that the receipt was stored at.
+	StoreReceipt(ctx context.Context, roomID, receiptType, userID, eventID string, timestamp gomatrixserverlib.Timestamp) (types.StreamPosition, error)
+	// SetPresence stores the latest presence of a user. If statusMsg is nil then
+	// any existing status message is left unchanged.
+	// Returns the stream position that the presence was stored at.
+	SetPresence(ctx context.Context, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (types.StreamPosition, error)
+	// UpsertRoomUnreadNotificationCounts records that the unread notification counts of the user in the room have changed.
+	// Returns the stream position that the change was stored at.
+	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string) (types.StreamPosition, error)
+	// GetUserUnreadNotificationCountsInRange returns the rooms in which the unread notification counts of the user changed between two given positions.
+	GetUserUnreadNotificationCountsInRange(ctx context.Context, userID string, r types.Range) ([]string, error)
+	// StoreDeviceListChanges records that each of the users started (tracked) or stopped sharing rooms with the target user.
+	// Returns the stream position that the last change was stored at.
+	StoreDeviceListChanges(ctx context.Context, userIDs []string, targetUserID string, tracked bool) (types.StreamPosition, error)
+	// GetDeviceListChangesInRange returns the users who the user started sharing a room with (changed) and stopped sharing any rooms with (left) between two given positions.
+	GetDeviceListChangesInRange(ctx context.Context, userID string, r types.Range) (changed, left []string, err error)
+	// AddPeek starts the device peeking into the room, so that the room is sent down /sync without the user being joined to it.
+	// Returns the stream position that the peek was stored at.
+	AddPeek(ctx context.Context, roomID, userID, deviceID string) (types.StreamPosition, error)
+	// AllPeekingDevicesInRooms returns a map of room ID to the devices which are peeking into the room.
+	AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error)
+	// DeletePeek stops the device peeking into the room.
+	DeletePeek(ctx context.Context, roomID, userID, deviceID string) error
+	// DeletePeeksForDevices stops the given devices of the user peeking into any room, e.g. when they are logged out.
+	DeletePeeksForDevices(ctx context.Context, userID string, deviceIDs []string) error
+	// GetPresence returns the latest presence of a user, or nil if no presence is known for the user.
+	GetPresence(ctx context.Context, userID string) (*eduAPI.OutputPresenceEvent, error)
+	// GetPresenceInRange returns the presence of the given users which was updated between two given positions.
+	GetPresenceInRange(ctx context.Context, userIDs []string, r types.Range) ([]eduAPI.OutputPresenceEvent, error)
 	// AddInviteEvent stores a new invite event for a user.
 	// If the invite was successfully stored this returns the stream ID it was stored at.
 	// Returns an error if there was a problem communicating with the database.
@@ -138,4 +172,11 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
+	// RoomIDsWithMembership returns the IDs of the rooms in which the given user currently has the given membership.
+	RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// SearchEvents returns the events in the given rooms which match the full-text search term on any of the given
+	// keys, along with the total number of matching events. If senders is not empty then only events from those
+	// senders are returned, and events from notSenders are never returned. Results are ordered by rank if
+	// orderByRank is true, or most recent first otherwise.
+	SearchEvents(ctx context.Context, term string, roomIDs, keys, senders, notSenders []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
 }
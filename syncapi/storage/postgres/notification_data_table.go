@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationDataSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores when the unread notification counts of each user in each room last changed.
+CREATE TABLE IF NOT EXISTS syncapi_notification_data (
+	-- An incrementing ID which denotes the position in the log that the counts changed at.
+	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+	-- The user whose counts changed.
+	user_id TEXT NOT NULL,
+	-- The room that the counts are for.
+	room_id TEXT NOT NULL,
+	CONSTRAINT syncapi_notification_data_unique UNIQUE (user_id, room_id)
+);
+`
+
+const upsertRoomUnreadCountsSQL = "" +
+	"INSERT INTO syncapi_notification_data" +
+	" (user_id, room_id)" +
+	" VALUES ($1, $2)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_notification_data_unique" +
+	" DO UPDATE SET id = EXCLUDED.id" +
+	" RETURNING id"
+
+const selectUserUnreadCountsInRangeSQL = "" +
+	"SELECT room_id FROM syncapi_notification_data" +
+	" WHERE user_id = $1 AND id > $2 AND id <= $3"
+
+const selectMaxNotificationDataIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_notification_data"
+
+type notificationDataStatements struct {
+	upsertRoomUnreadCountsStmt        *sql.Stmt
+	selectUserUnreadCountsInRangeStmt *sql.Stmt
+	selectMaxNotificationDataIDStmt   *sql.Stmt
+}
+
+func NewPostgresNotificationDataTable(db *sql.DB) (tables.NotificationData, error) {
+	_, err := db.Exec(notificationDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &notificationDataStatements{}
+	if s.upsertRoomUnreadCountsStmt, err = db.Prepare(upsertRoomUnreadCountsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertRoomUnreadCounts statement: %w", err)
+	}
+	if s.selectUserUnreadCountsInRangeStmt, err = db.Prepare(selectUserUnreadCountsInRangeSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectUserUnreadCountsInRange statement: %w", err)
+	}
+	if s.selectMaxNotificationDataIDStmt, err = db.Prepare(selectMaxNotificationDataIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxNotificationDataID statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *notificationDataStatements) UpsertRoomUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertRoomUnreadCountsStmt)
+	err = stmt.QueryRowContext(ctx, userID, roomID).Scan(&pos)
+	return
+}
+
+func (s *notificationDataStatements) SelectUserUnreadCountsInRange(
+	ctx context.Context, txn *sql.Tx, userID string, r types.Range,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectUserUnreadCountsInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, userID, r.Low(), r.High())
+	if err != nil {
+		return nil, fmt.Errorf("unable to query notification data: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserUnreadCountsInRange: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *notificationDataStatements) SelectMaxNotificationDataID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxNotificationDataIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const peeksSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores the rooms which devices are peeking into without being joined to them.
+CREATE TABLE IF NOT EXISTS syncapi_peeks (
+	-- An incrementing ID which denotes the position in the log that this peek was made at.
+	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+	-- The room being peeked into.
+	room_id TEXT NOT NULL,
+	-- The user and device which are peeking.
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	CONSTRAINT syncapi_peeks_unique UNIQUE (room_id, user_id, device_id)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_peeks_user_id_device_id_idx ON syncapi_peeks(user_id, device_id);
+`
+
+const upsertPeekSQL = "" +
+	"INSERT INTO syncapi_peeks (room_id, user_id, device_id)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_peeks_unique" +
+	" DO UPDATE SET id = syncapi_peeks.id" +
+	" RETURNING id"
+
+const selectPeeksForDeviceSQL = "" +
+	"SELECT room_id, id FROM syncapi_peeks WHERE user_id = $1 AND device_id = $2"
+
+const selectPeekingDevicesSQL = "" +
+	"SELECT room_id, user_id, device_id FROM syncapi_peeks"
+
+const deletePeekSQL = "" +
+	"DELETE FROM syncapi_peeks WHERE room_id = $1 AND user_id = $2 AND device_id = $3"
+
+const deletePeeksForUserSQL = "" +
+	"DELETE FROM syncapi_peeks WHERE room_id = $1 AND user_id = $2"
+
+const deletePeeksForDeviceSQL = "" +
+	"DELETE FROM syncapi_peeks WHERE user_id = $1 AND device_id = $2"
+
+const selectMaxPeekIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_peeks"
+
+type peekStatements struct {
+	upsertPeekStmt           *sql.Stmt
+	selectPeeksForDeviceStmt *sql.Stmt
+	selectPeekingDevicesStmt *sql.Stmt
+	deletePeekStmt           *sql.Stmt
+	deletePeeksForUserStmt   *sql.Stmt
+	deletePeeksForDeviceStmt *sql.Stmt
+	selectMaxPeekIDStmt      *sql.Stmt
+}
+
+func NewPostgresPeeksTable(db *sql.DB) (tables.Peeks, error) {
+	_, err := db.Exec(peeksSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &peekStatements{}
+	if s.upsertPeekStmt, err = db.Prepare(upsertPeekSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertPeek statement: %w", err)
+	}
+	if s.selectPeeksForDeviceStmt, err = db.Prepare(selectPeeksForDeviceSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPeeksForDevice statement: %w", err)
+	}
+	if s.selectPeekingDevicesStmt, err = db.Prepare(selectPeekingDevicesSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPeekingDevices statement: %w", err)
+	}
+	if s.deletePeekStmt, err = db.Prepare(deletePeekSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deletePeek statement: %w", err)
+	}
+	if s.deletePeeksForUserStmt, err = db.Prepare(deletePeeksForUserSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deletePeeksForUser statement: %w", err)
+	}
+	if s.deletePeeksForDeviceStmt, err = db.Prepare(deletePeeksForDeviceSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deletePeeksForDevice statement: %w", err)
+	}
+	if s.selectMaxPeekIDStmt, err = db.Prepare(selectMaxPeekIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxPeekID statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *peekStatements) UpsertPeek(
+	ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertPeekStmt)
+	err = stmt.QueryRowContext(ctx, roomID, userID, deviceID).Scan(&pos)
+	return
+}
+
+func (s *peekStatements) SelectPeeksForDevice(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) ([]types.Peek, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPeeksForDeviceStmt)
+	rows, err := stmt.QueryContext(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPeeksForDevice: rows.close() failed")
+	var peeks []types.Peek
+	for rows.Next() {
+		var peek types.Peek
+		if err = rows.Scan(&peek.RoomID, &peek.StreamPosition); err != nil {
+			return nil, err
+		}
+		peeks = append(peeks, peek)
+	}
+	return peeks, rows.Err()
+}
+
+func (s *peekStatements) SelectPeekingDevices(
+	ctx context.Context,
+) (map[string][]types.PeekingDevice, error) {
+	rows, err := s.selectPeekingDevicesStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPeekingDevices: rows.close() failed")
+	result := make(map[string][]types.PeekingDevice)
+	for rows.Next() {
+		var roomID string
+		var device types.PeekingDevice
+		if err = rows.Scan(&roomID, &device.UserID, &device.DeviceID); err != nil {
+			return nil, err
+		}
+		result[roomID] = append(result[roomID], device)
+	}
+	return result, rows.Err()
+}
+
+func (s *peekStatements) DeletePeek(
+	ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePeekStmt).ExecContext(ctx, roomID, userID, deviceID)
+	return err
+}
+
+func (s *peekStatements) DeletePeeksForUser(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePeeksForUserStmt).ExecContext(ctx, roomID, userID)
+	return err
+}
+
+func (s *peekStatements) DeletePeeksForDevice(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePeeksForDeviceStmt).ExecContext(ctx, userID, deviceID)
+	return err
+}
+
+func (s *peekStatements) SelectMaxPeekID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxPeekIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores the latest presence state of each user.
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+	-- An incrementing ID which denotes the position in the log that this presence update resides at.
+	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+	-- The user whose presence this is.
+	user_id TEXT NOT NULL,
+	-- The presence state of the user: online, unavailable or offline.
+	presence TEXT NOT NULL,
+	-- The status message of the user, if any.
+	status_msg TEXT,
+	-- When the user was last active, in milliseconds since the epoch.
+	last_active_ts BIGINT NOT NULL,
+	CONSTRAINT syncapi_presence_unique UNIQUE (user_id)
+);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence" +
+	" (user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_presence_unique" +
+	" DO UPDATE SET id = EXCLUDED.id, presence = $2," +
+	" status_msg = COALESCE($3, syncapi_presence.status_msg), last_active_ts = $4" +
+	" RETURNING id"
+
+const selectPresenceForUserSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE user_id = $1"
+
+const selectPresenceInRangeSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE user_id = ANY($1) AND id > $2 AND id <= $3"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	upsertPresenceStmt        *sql.Stmt
+	selectPresenceForUserStmt *sql.Stmt
+	selectPresenceInRangeStmt *sql.Stmt
+	selectMaxPresenceIDStmt   *sql.Stmt
+}
+
+func NewPostgresPresenceTable(db *sql.DB) (tables.Presence, error) {
+	_, err := db.Exec(presenceSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &presenceStatements{}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertPresence statement: %w", err)
+	}
+	if s.selectPresenceForUserStmt, err = db.Prepare(selectPresenceForUserSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPresenceForUser statement: %w", err)
+	}
+	if s.selectPresenceInRangeStmt, err = db.Prepare(selectPresenceInRangeSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPresenceInRange statement: %w", err)
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxPresenceID statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *presenceStatements) UpsertPresence(
+	ctx context.Context, txn *sql.Tx,
+	userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertPresenceStmt)
+	err = stmt.QueryRowContext(ctx, userID, presence, statusMsg, lastActiveTS).Scan(&pos)
+	return
+}
+
+func (s *presenceStatements) SelectPresenceForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (*api.OutputPresenceEvent, error) {
+	var presence api.OutputPresenceEvent
+	stmt := sqlutil.TxStmt(txn, s.selectPresenceForUserStmt)
+	err := stmt.QueryRowContext(ctx, userID).Scan(
+		&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &presence, nil
+}
+
+func (s *presenceStatements) SelectPresenceInRange(
+	ctx context.Context, txn *sql.Tx,
+	userIDs []string, r types.Range,
+) ([]api.OutputPresenceEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPresenceInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(userIDs), r.Low(), r.High())
+	if err != nil {
+		return nil, fmt.Errorf("unable to query presence: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPresenceInRange: rows.close() failed")
+	var res []api.OutputPresenceEvent
+	for rows.Next() {
+		var presence api.OutputPresenceEvent
+		err = rows.Scan(&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, presence)
+	}
+	return res, rows.Err()
+}
+
+func (s *presenceStatements) SelectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
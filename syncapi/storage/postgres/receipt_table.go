@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const receiptsSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores the latest receipt of each type for each user in each room.
+CREATE TABLE IF NOT EXISTS syncapi_receipts (
+	-- An incrementing ID which denotes the position in the log that this receipt resides at.
+	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+	-- The room that the receipt applies to.
+	room_id TEXT NOT NULL,
+	-- The type of the receipt, e.g. m.read.
+	receipt_type TEXT NOT NULL,
+	-- The user who sent the receipt.
+	user_id TEXT NOT NULL,
+	-- The event that the receipt points at.
+	event_id TEXT NOT NULL,
+	-- When the receipt was sent, in milliseconds since the epoch.
+	receipt_ts BIGINT NOT NULL,
+	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+);
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id ON syncapi_receipts(room_id);
+`
+
+const upsertReceipt = "" +
+	"INSERT INTO syncapi_receipts" +
+	" (room_id, receipt_type, user_id, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_receipts_unique" +
+	" DO UPDATE SET id = EXCLUDED.id, event_id = $4, receipt_ts = $5" +
+	" RETURNING id"
+
+const selectRoomReceipts = "" +
+	"SELECT room_id, receipt_type, user_id, event_id, receipt_ts" +
+	" FROM syncapi_receipts" +
+	" WHERE room_id = ANY($1) AND id > $2 AND id <= $3"
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_receipts"
+
+type receiptStatements struct {
+	upsertReceipt      *sql.Stmt
+	selectRoomReceipts *sql.Stmt
+	selectMaxReceiptID *sql.Stmt
+}
+
+func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
+	_, err := db.Exec(receiptsSchema)
+	if err != nil {
+		return nil, err
+	}
+	r := &receiptStatements{}
+	if r.upsertReceipt, err = db.Prepare(upsertReceipt); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertReceipt statement: %w", err)
+	}
+	if r.selectRoomReceipts, err = db.Prepare(selectRoomReceipts); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRoomReceipts statement: %w", err)
+	}
+	if r.selectMaxReceiptID, err = db.Prepare(selectMaxReceiptIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxReceiptID statement: %w", err)
+	}
+	return r, nil
+}
+
+func (r *receiptStatements) UpsertReceipt(
+	ctx context.Context, txn *sql.Tx,
+	roomID, receiptType, userID, eventID string,
+	timestamp gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
+	err = stmt.QueryRowContext(ctx, roomID, receiptType, userID, eventID, timestamp).Scan(&pos)
+	return
+}
+
+func (r *receiptStatements) SelectRoomReceiptsInRange(
+	ctx context.Context, txn *sql.Tx,
+	roomIDs []string, rng types.Range,
+) ([]api.OutputReceiptEvent, error) {
+	stmt := sqlutil.TxStmt(txn, r.selectRoomReceipts)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(roomIDs), rng.Low(), rng.High())
+	if err != nil {
+		return nil, fmt.Errorf("unable to query room receipts: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomReceiptsInRange: rows.close() failed")
+	var res []api.OutputReceiptEvent
+	for rows.Next() {
+		var receipt api.OutputReceiptEvent
+		err = rows.Scan(&receipt.RoomID, &receipt.Type, &receipt.UserID, &receipt.EventID, &receipt.Timestamp)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, receipt)
+	}
+	return res, rows.Err()
+}
+
+func (r *receiptStatements) SelectMaxReceiptID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, r.selectMaxReceiptID)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
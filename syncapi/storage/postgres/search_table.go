@@ -0,0 +1,174 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchSchema = `
+-- Stores a full-text index of the searchable parts of room events.
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	-- The event that was indexed.
+	event_id TEXT NOT NULL PRIMARY KEY,
+	-- The room that the event was sent in.
+	room_id TEXT NOT NULL,
+	-- The sender of the event.
+	sender TEXT NOT NULL,
+	-- The key that was indexed, e.g. content.body.
+	key TEXT NOT NULL,
+	-- The indexed text of the key.
+	vector TSVECTOR NOT NULL,
+	-- The stream position of the event, used to order results by recency.
+	stream_pos BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_vector_idx ON syncapi_search_events USING GIN(vector);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id_idx ON syncapi_search_events(room_id);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (event_id, room_id, sender, key, vector, stream_pos)" +
+	" VALUES ($1, $2, $3, $4, to_tsvector('english', $5), $6)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+const searchConditionsSQL = "" +
+	" FROM syncapi_search_events, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" AND ( $4::text[] IS NULL OR sender = ANY($4) )" +
+	" AND ( $5::text[] IS NULL OR NOT(sender = ANY($5)) )"
+
+const selectSearchByRankSQL = "" +
+	"SELECT event_id, room_id, ts_rank_cd(vector, query) AS rank" +
+	searchConditionsSQL +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $6 OFFSET $7"
+
+const selectSearchByRecentSQL = "" +
+	"SELECT event_id, room_id, ts_rank_cd(vector, query) AS rank" +
+	searchConditionsSQL +
+	" ORDER BY stream_pos DESC LIMIT $6 OFFSET $7"
+
+const selectSearchCountSQL = "" +
+	"SELECT COUNT(*)" + searchConditionsSQL
+
+type searchStatements struct {
+	insertSearchEventStmt    *sql.Stmt
+	deleteSearchEventStmt    *sql.Stmt
+	selectSearchByRankStmt   *sql.Stmt
+	selectSearchByRecentStmt *sql.Stmt
+	selectSearchCountStmt    *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &searchStatements{}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchEvent statement: %w", err)
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEvent statement: %w", err)
+	}
+	if s.selectSearchByRankStmt, err = db.Prepare(selectSearchByRankSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchByRank statement: %w", err)
+	}
+	if s.selectSearchByRecentStmt, err = db.Prepare(selectSearchByRecentSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchByRecent statement: %w", err)
+	}
+	if s.selectSearchCountStmt, err = db.Prepare(selectSearchCountSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchCount statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx,
+	event *gomatrixserverlib.HeaderedEvent, key, value string,
+	pos types.StreamPosition,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, event.EventID(), event.RoomID(), event.Sender(), key, value, pos)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, txn *sql.Tx,
+	term string, roomIDs, keys, senders, notSenders []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	var count int
+	stmt := sqlutil.TxStmt(txn, s.selectSearchCountStmt)
+	err := stmt.QueryRowContext(
+		ctx, term, pq.StringArray(roomIDs), pq.StringArray(keys),
+		nullableStringArray(senders), nullableStringArray(notSenders),
+	).Scan(&count)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to count search results: %w", err)
+	}
+
+	if orderByRank {
+		stmt = sqlutil.TxStmt(txn, s.selectSearchByRankStmt)
+	} else {
+		stmt = sqlutil.TxStmt(txn, s.selectSearchByRecentStmt)
+	}
+	rows, err := stmt.QueryContext(
+		ctx, term, pq.StringArray(roomIDs), pq.StringArray(keys),
+		nullableStringArray(senders), nullableStringArray(notSenders),
+		limit, offset,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to query search results: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearchResults: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// nullableStringArray returns a NULL array parameter if the given slice is
+// empty, so that it can be used with "$1::text[] IS NULL" conditions.
+func nullableStringArray(in []string) interface{} {
+	if len(in) == 0 {
+		return nil
+	}
+	return pq.StringArray(in)
+}
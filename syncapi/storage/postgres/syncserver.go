@@ -75,6 +75,30 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*S
 	if err != nil {
 		return nil, err
 	}
+	receipts, err := NewPostgresReceiptsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	presence, err := NewPostgresPresenceTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	notificationData, err := NewPostgresNotificationDataTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	search, err := NewPostgresSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	deviceListChanges, err := NewPostgresDeviceListChangesTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	peeks, err := NewPostgresPeeksTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -85,6 +109,12 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*S
 		BackwardExtremities: backwardExtremities,
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
+		Receipts:            receipts,
+		Presence:            presence,
+		NotificationData:    notificationData,
+		Search:              search,
+		Peeks:               peeks,
+		DeviceListChanges:   deviceListChanges,
 		SendToDeviceWriter:  sqlutil.NewTransactionWriter(),
 		EDUCache:            cache.New(),
 	}
@@ -23,14 +23,17 @@ import (
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -45,6 +48,12 @@ type Database struct {
 	BackwardExtremities tables.BackwardsExtremities
 	SendToDevice        tables.SendToDevice
 	Filter              tables.Filter
+	Receipts            tables.Receipts
+	Presence            tables.Presence
+	NotificationData    tables.NotificationData
+	Search              tables.Search
+	Peeks               tables.Peeks
+	DeviceListChanges   tables.DeviceListChanges
 	SendToDeviceWriter  *sqlutil.TransactionWriter
 	EDUCache            *cache.EDUCache
 }
@@ -81,7 +90,7 @@ func (d *Database) GetEventsInStreamingRange(
 	if backwardOrdering {
 		// When using backward ordering, we want the most recent events first.
 		if events, _, err = d.OutputEvents.SelectRecentEvents(
-			ctx, nil, roomID, r, limit, false, false,
+			ctx, nil, roomID, r, &gomatrixserverlib.RoomEventFilter{Limit: limit}, false, false,
 		); err != nil {
 			return
 		}
@@ -120,6 +129,11 @@ func (d *Database) AllJoinedUsersInRooms(ctx context.Context) (map[string][]stri
 	return d.CurrentRoomState.SelectJoinedUsers(ctx)
 }
 
+// JoinedUsersInRoom returns the IDs of the users who are joined to the room.
+func (d *Database) JoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error) {
+	return d.CurrentRoomState.SelectJoinedUsersInRoom(ctx, nil, roomID)
+}
+
 func (d *Database) GetStateEvent(
 	ctx context.Context, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
@@ -160,6 +174,46 @@ func (d *Database) SyncStreamPosition(ctx context.Context) (types.StreamPosition
 		if maxInviteID > maxID {
 			maxID = maxInviteID
 		}
+		var maxReceiptID int64
+		maxReceiptID, err = d.Receipts.SelectMaxReceiptID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxReceiptID > maxID {
+			maxID = maxReceiptID
+		}
+		var maxPresenceID int64
+		maxPresenceID, err = d.Presence.SelectMaxPresenceID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxPresenceID > maxID {
+			maxID = maxPresenceID
+		}
+		var maxNotificationDataID int64
+		maxNotificationDataID, err = d.NotificationData.SelectMaxNotificationDataID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxNotificationDataID > maxID {
+			maxID = maxNotificationDataID
+		}
+		var maxPeekID int64
+		maxPeekID, err = d.Peeks.SelectMaxPeekID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxPeekID > maxID {
+			maxID = maxPeekID
+		}
+		var maxDeviceListChangeID int64
+		maxDeviceListChangeID, err = d.DeviceListChanges.SelectMaxDeviceListChangeID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxDeviceListChangeID > maxID {
+			maxID = maxDeviceListChangeID
+		}
 		return nil
 	})
 	return types.StreamPosition(maxID), err
@@ -198,6 +252,142 @@ func (d *Database) GetAccountDataInRange(
 	return d.AccountData.SelectAccountDataInRange(ctx, userID, r, accountDataFilterPart)
 }
 
+// StoreReceipt stores the latest receipt of the given type for a user in a room.
+// Returns the stream position that the receipt was stored at.
+func (d *Database) StoreReceipt(
+	ctx context.Context,
+	roomID, receiptType, userID, eventID string,
+	timestamp gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomID, receiptType, userID, eventID, timestamp)
+		return err
+	})
+	return
+}
+
+// SetPresence stores the latest presence of a user. If statusMsg is nil then
+// any existing status message is left unchanged.
+// Returns the stream position that the presence was stored at.
+func (d *Database) SetPresence(
+	ctx context.Context,
+	userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		pos, err = d.Presence.UpsertPresence(ctx, txn, userID, presence, statusMsg, lastActiveTS)
+		return err
+	})
+	return
+}
+
+// UpsertRoomUnreadNotificationCounts records that the unread notification
+// counts of the user in the room have changed.
+// Returns the stream position that the change was stored at.
+func (d *Database) UpsertRoomUnreadNotificationCounts(
+	ctx context.Context, userID, roomID string,
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, txn, userID, roomID)
+		return err
+	})
+	return
+}
+
+// GetUserUnreadNotificationCountsInRange returns the rooms in which the unread
+// notification counts of the user changed between two given positions.
+func (d *Database) GetUserUnreadNotificationCountsInRange(
+	ctx context.Context, userID string, r types.Range,
+) ([]string, error) {
+	return d.NotificationData.SelectUserUnreadCountsInRange(ctx, nil, userID, r)
+}
+
+// StoreDeviceListChanges records that each of the users started (tracked) or
+// stopped sharing rooms with the target user.
+// Returns the stream position that the last change was stored at.
+func (d *Database) StoreDeviceListChanges(
+	ctx context.Context, userIDs []string, targetUserID string, tracked bool,
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for _, userID := range userIDs {
+			pos, err = d.DeviceListChanges.UpsertDeviceListChange(ctx, txn, userID, targetUserID, tracked)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// GetDeviceListChangesInRange returns the users who the user started sharing a
+// room with (changed) and stopped sharing any rooms with (left) between two
+// given positions.
+func (d *Database) GetDeviceListChangesInRange(
+	ctx context.Context, userID string, r types.Range,
+) (changed, left []string, err error) {
+	return d.DeviceListChanges.SelectDeviceListChangesInRange(ctx, nil, userID, r)
+}
+
+// AddPeek starts the device peeking into the room, so that the room is sent
+// down /sync without the user being joined to it.
+// Returns the stream position that the peek was stored at.
+func (d *Database) AddPeek(
+	ctx context.Context, roomID, userID, deviceID string,
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		pos, err = d.Peeks.UpsertPeek(ctx, txn, roomID, userID, deviceID)
+		return err
+	})
+	return
+}
+
+// AllPeekingDevicesInRooms returns a map of room ID to the devices which are
+// peeking into the room.
+func (d *Database) AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error) {
+	return d.Peeks.SelectPeekingDevices(ctx)
+}
+
+// DeletePeek stops the device peeking into the room.
+func (d *Database) DeletePeek(
+	ctx context.Context, roomID, userID, deviceID string,
+) error {
+	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.Peeks.DeletePeek(ctx, txn, roomID, userID, deviceID)
+	})
+}
+
+// DeletePeeksForDevices stops the given devices of the user peeking into any
+// room, e.g. when they are logged out.
+func (d *Database) DeletePeeksForDevices(
+	ctx context.Context, userID string, deviceIDs []string,
+) error {
+	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for _, deviceID := range deviceIDs {
+			if err := d.Peeks.DeletePeeksForDevice(ctx, txn, userID, deviceID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetPresence returns the latest presence of a user, or nil if no presence
+// is known for the user.
+func (d *Database) GetPresence(
+	ctx context.Context, userID string,
+) (*eduAPI.OutputPresenceEvent, error) {
+	return d.Presence.SelectPresenceForUser(ctx, nil, userID)
+}
+
+// GetPresenceInRange returns the presence of the given users which was
+// updated between two given positions.
+func (d *Database) GetPresenceInRange(
+	ctx context.Context, userIDs []string, r types.Range,
+) ([]eduAPI.OutputPresenceEvent, error) {
+	return d.Presence.SelectPresenceInRange(ctx, nil, userIDs, r)
+}
+
 // UpsertAccountData keeps track of new or updated account data, by saving the type
 // of the new/updated data, and the user ID and room ID the data is related to (empty)
 // room ID means the data isn't specific to any room)
@@ -293,6 +483,21 @@ func (d *Database) WriteEvent(
 			return fmt.Errorf("d.handleBackwardExtremities: %w", err)
 		}
 
+		if key, value := searchableContent(ev); value != "" {
+			if err = d.Search.InsertSearchEvent(ctx, txn, ev, key, value, pos); err != nil {
+				return fmt.Errorf("d.Search.InsertSearchEvent: %w", err)
+			}
+		}
+
+		// Devices stop peeking into a room once the user has joined it.
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			if membership, merr := ev.Membership(); merr == nil && membership == gomatrixserverlib.Join {
+				if err = d.Peeks.DeletePeeksForUser(ctx, txn, ev.RoomID(), *ev.StateKey()); err != nil {
+					return fmt.Errorf("d.Peeks.DeletePeeksForUser: %w", err)
+				}
+			}
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -434,6 +639,41 @@ func (d *Database) syncPositionTx(
 	if maxInviteID > maxEventID {
 		maxEventID = maxInviteID
 	}
+	maxReceiptID, err := d.Receipts.SelectMaxReceiptID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxReceiptID > maxEventID {
+		maxEventID = maxReceiptID
+	}
+	maxPresenceID, err := d.Presence.SelectMaxPresenceID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxPresenceID > maxEventID {
+		maxEventID = maxPresenceID
+	}
+	maxNotificationDataID, err := d.NotificationData.SelectMaxNotificationDataID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxNotificationDataID > maxEventID {
+		maxEventID = maxNotificationDataID
+	}
+	maxPeekID, err := d.Peeks.SelectMaxPeekID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxPeekID > maxEventID {
+		maxEventID = maxPeekID
+	}
+	maxDeviceListChangeID, err := d.DeviceListChanges.SelectMaxDeviceListChangeID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxDeviceListChangeID > maxEventID {
+		maxEventID = maxDeviceListChangeID
+	}
 	sp = types.NewStreamToken(types.StreamPosition(maxEventID), types.StreamPosition(d.EDUCache.GetLatestSyncPosition()), nil)
 	return
 }
@@ -444,7 +684,7 @@ func (d *Database) addPDUDeltaToResponse(
 	ctx context.Context,
 	device userapi.Device,
 	r types.Range,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	wantFullState bool,
 	res *types.Response,
 ) (joinedRoomIDs []string, err error) {
@@ -460,7 +700,9 @@ func (d *Database) addPDUDeltaToResponse(
 		}
 	}()
 
-	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+	// The state filter from the request is applied to each room's state once the deltas
+	// have been worked out, as the membership events of the user are needed to do so.
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
 
 	// Work out which rooms to return in the response. This is done by getting not only the currently
 	// joined rooms, but also which rooms have membership transitions for this user between the 2 PDU stream positions.
@@ -481,11 +723,21 @@ func (d *Database) addPDUDeltaToResponse(
 	}
 
 	for _, delta := range deltas {
-		err = d.addRoomDeltaToResponse(ctx, &device, txn, r, delta, numRecentEventsPerRoom, res)
+		if !internal.RoomIncluded(delta.roomID, filter.Room.Rooms, filter.Room.NotRooms) {
+			continue
+		}
+		// Rooms which the user left before this sync began are only sent down
+		// an initial sync if the filter asks for them.
+		if r.From == 0 && !filter.Room.IncludeLeave &&
+			(delta.membership == gomatrixserverlib.Leave || delta.membership == gomatrixserverlib.Ban) {
+			continue
+		}
+		err = d.addRoomDeltaToResponse(ctx, &device, txn, r, delta, filter, res)
 		if err != nil {
 			return nil, err
 		}
 	}
+	joinedRoomIDs = filterRoomIDs(joinedRoomIDs, &filter.Room)
 
 	// TODO: This should be done in getStateDeltas
 	if err = d.addInvitesToResponse(ctx, txn, device.UserID, r, res); err != nil {
@@ -530,6 +782,61 @@ func (d *Database) addTypingDeltaToResponse(
 	return nil
 }
 
+// addReceiptDeltaToResponse adds all receipts for the given joined rooms which
+// were updated in the given range to a sync response.
+func (d *Database) addReceiptDeltaToResponse(
+	ctx context.Context,
+	r types.Range,
+	joinedRoomIDs []string,
+	res *types.Response,
+) error {
+	receipts, err := d.Receipts.SelectRoomReceiptsInRange(ctx, nil, joinedRoomIDs, r)
+	if err != nil {
+		return fmt.Errorf("d.Receipts.SelectRoomReceiptsInRange: %w", err)
+	}
+
+	// Group the receipts by room and then by event, so that we only send
+	// one m.receipt event per room.
+	contentByRoom := make(map[string]map[string]eduAPI.ReceiptMRead)
+	for _, receipt := range receipts {
+		if receipt.Type != "m.read" {
+			continue
+		}
+		content, ok := contentByRoom[receipt.RoomID]
+		if !ok {
+			content = make(map[string]eduAPI.ReceiptMRead)
+			contentByRoom[receipt.RoomID] = content
+		}
+		read, ok := content[receipt.EventID]
+		if !ok {
+			read = eduAPI.ReceiptMRead{
+				User: make(map[string]eduAPI.ReceiptTS),
+			}
+			content[receipt.EventID] = read
+		}
+		read.User[receipt.UserID] = eduAPI.ReceiptTS{TS: receipt.Timestamp}
+	}
+
+	var jr types.JoinResponse
+	var ok bool
+	for roomID, content := range contentByRoom {
+		ev := gomatrixserverlib.ClientEvent{
+			Type: "m.receipt",
+		}
+		ev.Content, err = json.Marshal(content)
+		if err != nil {
+			return err
+		}
+
+		if jr, ok = res.Rooms.Join[roomID]; !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, ev)
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
 // the positions of that type are not equal in fromPos and toPos.
 func (d *Database) addEDUDeltaToResponse(
@@ -563,7 +870,7 @@ func (d *Database) IncrementalSync(
 	ctx context.Context, res *types.Response,
 	device userapi.Device,
 	fromPos, toPos types.StreamingToken,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	wantFullState bool,
 ) (*types.Response, error) {
 	nextBatchPos := fromPos.WithUpdates(toPos)
@@ -577,17 +884,30 @@ func (d *Database) IncrementalSync(
 			To:   toPos.PDUPosition(),
 		}
 		joinedRoomIDs, err = d.addPDUDeltaToResponse(
-			ctx, device, r, numRecentEventsPerRoom, wantFullState, res,
+			ctx, device, r, filter, wantFullState, res,
 		)
 	} else {
 		joinedRoomIDs, err = d.CurrentRoomState.SelectRoomIDsWithMembership(
 			ctx, nil, device.UserID, gomatrixserverlib.Join,
 		)
+		joinedRoomIDs = filterRoomIDs(joinedRoomIDs, &filter.Room)
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	// Receipts share the PDU stream position, so only look for new ones if
+	// that position has moved.
+	if fromPos.PDUPosition() != toPos.PDUPosition() {
+		r := types.Range{
+			From: fromPos.PDUPosition(),
+			To:   toPos.PDUPosition(),
+		}
+		if err = d.addReceiptDeltaToResponse(ctx, r, joinedRoomIDs, res); err != nil {
+			return nil, err
+		}
+	}
+
 	err = d.addEDUDeltaToResponse(
 		fromPos, toPos, joinedRoomIDs, res,
 	)
@@ -615,7 +935,46 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 	}
 
 	newEvent := ev.Headered(redactedBecause.RoomVersion)
-	return d.OutputEvents.UpdateEventJSON(ctx, &newEvent)
+	if err = d.OutputEvents.UpdateEventJSON(ctx, &newEvent); err != nil {
+		return err
+	}
+	// The redacted event no longer has any searchable content.
+	return d.Search.DeleteSearchEvent(ctx, nil, redactedEventID)
+}
+
+// searchableContent returns the key and text of the given event which should
+// be included in the search index. Returns an empty value if the event isn't
+// searchable.
+func searchableContent(ev *gomatrixserverlib.HeaderedEvent) (key, value string) {
+	switch ev.Type() {
+	case "m.room.message":
+		key = "content.body"
+	case gomatrixserverlib.MRoomName:
+		key = "content.name"
+	case "m.room.topic":
+		key = "content.topic"
+	default:
+		return "", ""
+	}
+	// this returns the empty string if this is not a string type
+	return key, gjson.GetBytes(ev.JSON(), key).Str
+}
+
+// RoomIDsWithMembership returns the IDs of the rooms in which the given user
+// currently has the given membership.
+func (d *Database) RoomIDsWithMembership(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
+}
+
+// SearchEvents returns the events in the given rooms which match the search
+// term on any of the given keys, along with the total number of matches.
+func (d *Database) SearchEvents(
+	ctx context.Context, term string, roomIDs, keys, senders, notSenders []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	return d.Search.SelectSearchResults(ctx, nil, term, roomIDs, keys, senders, notSenders, orderByRank, limit, offset)
 }
 
 // getResponseWithPDUsForCompleteSync creates a response and adds all PDUs needed
@@ -623,8 +982,8 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 // nolint:nakedret
 func (d *Database) getResponseWithPDUsForCompleteSync(
 	ctx context.Context, res *types.Response,
-	userID string,
-	numRecentEventsPerRoom int,
+	userID, deviceID string,
+	filter *gomatrixserverlib.Filter,
 ) (
 	toPos types.StreamingToken,
 	joinedRoomIDs []string,
@@ -659,55 +1018,44 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 	res.NextBatch = toPos.String()
 
 	// Extract room state and recent events for all rooms the user is joined to.
-	joinedRoomIDs, err = d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, txn, userID, gomatrixserverlib.Join)
+	allJoinedRoomIDs, err := d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, txn, userID, gomatrixserverlib.Join)
 	if err != nil {
 		return
 	}
-
-	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+	joinedRoomIDs = filterRoomIDs(allJoinedRoomIDs, &filter.Room)
 
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
-		var stateEvents []gomatrixserverlib.HeaderedEvent
-		stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &stateFilter)
+		var jr *types.JoinResponse
+		jr, err = d.getJoinResponseForCompleteSync(ctx, txn, roomID, r, filter)
 		if err != nil {
 			return
 		}
-		// TODO: When filters are added, we may need to call this multiple times to get enough events.
-		//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-		var recentStreamEvents []types.StreamEvent
-		var limited bool
-		recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
-			ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
-		)
+		res.Rooms.Join[roomID] = *jr
+	}
+
+	// Add the rooms which the device is peeking into in the same way.
+	var peeks []types.Peek
+	peeks, err = d.selectPeeks(ctx, txn, userID, deviceID, allJoinedRoomIDs)
+	if err != nil {
+		return
+	}
+	for _, peek := range peeks {
+		if !internal.RoomIncluded(peek.RoomID, filter.Room.Rooms, filter.Room.NotRooms) {
+			continue
+		}
+		var jr *types.JoinResponse
+		jr, err = d.getJoinResponseForCompleteSync(ctx, txn, peek.RoomID, r, filter)
 		if err != nil {
 			return
 		}
+		res.Rooms.Peek[peek.RoomID] = *jr
+	}
 
-		// Retrieve the backward topology position, i.e. the position of the
-		// oldest event in the room's topology.
-		var prevBatchStr string
-		if len(recentStreamEvents) > 0 {
-			var backwardTopologyPos, backwardStreamPos types.StreamPosition
-			backwardTopologyPos, backwardStreamPos, err = d.Topology.SelectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
-			if err != nil {
-				return
-			}
-			prevBatch := types.NewTopologyToken(backwardTopologyPos, backwardStreamPos)
-			prevBatch.Decrement()
-			prevBatchStr = prevBatch.String()
+	if filter.Room.IncludeLeave {
+		if err = d.addLeftRoomsToResponse(ctx, txn, userID, r, filter, res); err != nil {
+			return
 		}
-
-		// We don't include a device here as we don't need to send down
-		// transaction IDs for complete syncs
-		recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
-		stateEvents = removeDuplicates(stateEvents, recentEvents)
-		jr := types.NewJoinResponse()
-		jr.Timeline.PrevBatch = prevBatchStr
-		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = limited
-		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
-		res.Rooms.Join[roomID] = *jr
 	}
 
 	if err = d.addInvitesToResponse(ctx, txn, userID, r, res); err != nil {
@@ -718,17 +1066,159 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 	return //res, toPos, joinedRoomIDs, err
 }
 
+// getJoinResponseForCompleteSync returns the current state and the recent
+// events of a room for a complete sync.
+func (d *Database) getJoinResponseForCompleteSync(
+	ctx context.Context, txn *sql.Tx,
+	roomID string, r types.Range,
+	filter *gomatrixserverlib.Filter,
+) (*types.JoinResponse, error) {
+	stateEvents, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &filter.Room.State)
+	if err != nil {
+		return nil, err
+	}
+	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
+		ctx, txn, roomID, r, &filter.Room.Timeline, true, true,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve the backward topology position, i.e. the position of the
+	// oldest event in the room's topology.
+	var prevBatchStr string
+	if len(recentStreamEvents) > 0 {
+		var backwardTopologyPos, backwardStreamPos types.StreamPosition
+		backwardTopologyPos, backwardStreamPos, err = d.Topology.SelectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
+		if err != nil {
+			return nil, err
+		}
+		prevBatch := types.NewTopologyToken(backwardTopologyPos, backwardStreamPos)
+		prevBatch.Decrement()
+		prevBatchStr = prevBatch.String()
+	}
+
+	// We don't include a device here as we don't need to send down
+	// transaction IDs for complete syncs
+	recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
+	stateEvents = removeDuplicates(stateEvents, recentEvents)
+	jr := types.NewJoinResponse()
+	jr.Timeline.PrevBatch = prevBatchStr
+	jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+	jr.Timeline.Limited = limited
+	jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+	return jr, nil
+}
+
+// selectPeeks returns the rooms which the device is peeking into, leaving out
+// the rooms which the user has since joined and the rooms which are no longer
+// world readable.
+func (d *Database) selectPeeks(
+	ctx context.Context, txn *sql.Tx,
+	userID, deviceID string, joinedRoomIDs []string,
+) ([]types.Peek, error) {
+	peeks, err := d.Peeks.SelectPeeksForDevice(ctx, txn, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	joined := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joined[roomID] = true
+	}
+	result := make([]types.Peek, 0, len(peeks))
+	for _, peek := range peeks {
+		if joined[peek.RoomID] {
+			continue
+		}
+		ev, err := d.CurrentRoomState.SelectStateEvent(ctx, peek.RoomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+		if err != nil {
+			return nil, err
+		}
+		if ev == nil {
+			continue
+		}
+		var content eventutil.HistoryVisibilityContent
+		if err = json.Unmarshal(ev.Content(), &content); err != nil || content.HistoryVisibility != "world_readable" {
+			continue
+		}
+		result = append(result, peek)
+	}
+	return result, nil
+}
+
+// addLeftRoomsToResponse adds the rooms which the user has left or been banned
+// from to a complete sync response. The timeline of each room stops at the
+// user's membership event so that later events aren't leaked. The sync API
+// only keeps the current state of rooms, so the state of the rooms when the
+// user left them is added by the caller.
+func (d *Database) addLeftRoomsToResponse(
+	ctx context.Context, txn *sql.Tx,
+	userID string, r types.Range,
+	filter *gomatrixserverlib.Filter,
+	res *types.Response,
+) error {
+	for _, membership := range []string{gomatrixserverlib.Leave, gomatrixserverlib.Ban} {
+		roomIDs, err := d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, txn, userID, membership)
+		if err != nil {
+			return err
+		}
+		for _, roomID := range filterRoomIDs(roomIDs, &filter.Room) {
+			membershipEvent, err := d.CurrentRoomState.SelectStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+			if err != nil {
+				return err
+			}
+			if membershipEvent == nil {
+				continue
+			}
+			streamEvents, err := d.OutputEvents.SelectEvents(ctx, txn, []string{membershipEvent.EventID()})
+			if err != nil {
+				return err
+			}
+			if len(streamEvents) == 0 {
+				continue
+			}
+			roomRange := r
+			roomRange.To = streamEvents[0].StreamPosition
+			recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
+				ctx, txn, roomID, roomRange, &filter.Room.Timeline, true, true,
+			)
+			if err != nil {
+				return err
+			}
+			prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+			if err != nil {
+				return err
+			}
+			lr := types.NewLeaveResponse()
+			lr.Timeline.PrevBatch = prevBatch.String()
+			lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(d.StreamEventsToEvents(nil, recentStreamEvents), gomatrixserverlib.FormatSync)
+			lr.Timeline.Limited = limited
+			res.Rooms.Leave[roomID] = *lr
+		}
+	}
+	return nil
+}
+
 func (d *Database) CompleteSync(
 	ctx context.Context, res *types.Response,
-	device userapi.Device, numRecentEventsPerRoom int,
+	device userapi.Device, filter *gomatrixserverlib.Filter,
 ) (*types.Response, error) {
 	toPos, joinedRoomIDs, err := d.getResponseWithPDUsForCompleteSync(
-		ctx, res, device.UserID, numRecentEventsPerRoom,
+		ctx, res, device.UserID, device.ID, filter,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	// Add the latest receipts for all of the joined rooms.
+	r := types.Range{
+		From: 0,
+		To:   toPos.PDUPosition(),
+	}
+	if err = d.addReceiptDeltaToResponse(ctx, r, joinedRoomIDs, res); err != nil {
+		return nil, err
+	}
+
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
 		types.NewStreamToken(0, 0, nil), toPos, joinedRoomIDs, res,
@@ -799,26 +1289,27 @@ func (d *Database) addRoomDeltaToResponse(
 	txn *sql.Tx,
 	r types.Range,
 	delta stateDelta,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	res *types.Response,
 ) error {
 	if delta.membershipPos > 0 && delta.membership == gomatrixserverlib.Leave {
 		// make sure we don't leak recent events after the leave event.
-		// TODO: History visibility makes this somewhat complex to handle correctly. For example:
-		// TODO: This doesn't work for join -> leave in a single /sync request (see events prior to join).
+		// The history visibility of the events up to the leave event is checked
+		// against the roomserver once the response has been built, which hides
+		// e.g. the events before the join in join -> leave in a single /sync.
 		// TODO: This will fail on join -> leave -> sensitive msg -> join -> leave
 		//       in a single /sync request
-		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		r.To = delta.membershipPos
 	}
 	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
 		ctx, txn, delta.roomID, r,
-		numRecentEventsPerRoom, true, true,
+		&filter.Room.Timeline, true, true,
 	)
 	if err != nil {
 		return err
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
+	delta.stateEvents = filterStateEvents(delta.stateEvents, &filter.Room.State)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
 	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
 	if err != nil {
@@ -834,6 +1325,13 @@ func (d *Database) addRoomDeltaToResponse(
 		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[delta.roomID] = *jr
+	case peekMembership:
+		jr := types.NewJoinResponse()
+		jr.Timeline.PrevBatch = prevBatch.String()
+		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+		jr.Timeline.Limited = limited
+		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
+		res.Rooms.Peek[delta.roomID] = *jr
 	case gomatrixserverlib.Leave:
 		fallthrough // transitions to leave are the same as ban
 	case gomatrixserverlib.Ban:
@@ -842,7 +1340,7 @@ func (d *Database) addRoomDeltaToResponse(
 		lr := types.NewLeaveResponse()
 		lr.Timeline.PrevBatch = prevBatch.String()
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
@@ -1008,9 +1506,47 @@ func (d *Database) getStateDeltas(
 		})
 	}
 
+	peekDeltas, err := d.getPeekDeltas(ctx, device, txn, r, joinedRoomIDs, state, false, stateFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+	deltas = append(deltas, peekDeltas...)
+
 	return deltas, joinedRoomIDs, nil
 }
 
+// getPeekDeltas returns the state deltas for the rooms which the device is
+// peeking into. Rooms which the device started peeking into during the range,
+// or all rooms if fullState is true, get their full current state like newly
+// joined rooms. Other rooms get the state events from the range in state.
+func (d *Database) getPeekDeltas(
+	ctx context.Context, device *userapi.Device, txn *sql.Tx,
+	r types.Range, joinedRoomIDs []string,
+	state map[string][]types.StreamEvent, fullState bool,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]stateDelta, error) {
+	peeks, err := d.selectPeeks(ctx, txn, device.UserID, device.ID, joinedRoomIDs)
+	if err != nil {
+		return nil, err
+	}
+	deltas := make([]stateDelta, 0, len(peeks))
+	for _, peek := range peeks {
+		stateEvents := state[peek.RoomID]
+		if fullState || peek.StreamPosition > r.Low() {
+			stateEvents, err = d.currentStateStreamEventsForRoom(ctx, txn, peek.RoomID, stateFilter)
+			if err != nil {
+				return nil, err
+			}
+		}
+		deltas = append(deltas, stateDelta{
+			membership:  peekMembership,
+			stateEvents: d.StreamEventsToEvents(device, stateEvents),
+			roomID:      peek.RoomID,
+		})
+	}
+	return deltas, nil
+}
+
 // getStateDeltasForFullStateSync is a variant of getStateDeltas used for /sync
 // requests with full_state=true.
 // Fetches full state for all joined rooms and uses selectStateInRange to get
@@ -1068,6 +1604,12 @@ func (d *Database) getStateDeltasForFullStateSync(
 		}
 	}
 
+	peekDeltas, err := d.getPeekDeltas(ctx, device, txn, r, joinedRoomIDs, state, true, stateFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+	deltas = append(deltas, peekDeltas...)
+
 	return deltas, joinedRoomIDs, nil
 }
 
@@ -1233,6 +1775,10 @@ func getMembershipFromEvent(ev *gomatrixserverlib.Event, userID string) string {
 	return ""
 }
 
+// peekMembership is the membership of the state deltas for rooms which the
+// device is peeking into, which go in the peek section of the response.
+const peekMembership = "peek"
+
 type stateDelta struct {
 	roomID      string
 	stateEvents []gomatrixserverlib.HeaderedEvent
@@ -1241,3 +1787,38 @@ type stateDelta struct {
 	// Can be 0 if there is no membership event in this delta.
 	membershipPos types.StreamPosition
 }
+
+// filterRoomIDs returns the room IDs which are included by the rooms and
+// not_rooms lists of the filter.
+func filterRoomIDs(roomIDs []string, filter *gomatrixserverlib.RoomFilter) []string {
+	if len(filter.Rooms) == 0 && len(filter.NotRooms) == 0 {
+		return roomIDs
+	}
+	filtered := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if internal.RoomIncluded(roomID, filter.Rooms, filter.NotRooms) {
+			filtered = append(filtered, roomID)
+		}
+	}
+	return filtered
+}
+
+// filterStateEvents returns the state events which match the senders, types
+// and contains_url parts of the filter. The database does this when selecting
+// the current state, but the state deltas are built up from events which were
+// selected without a filter.
+func filterStateEvents(
+	events []gomatrixserverlib.HeaderedEvent, filter *gomatrixserverlib.StateFilter,
+) []gomatrixserverlib.HeaderedEvent {
+	filtered := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if !internal.EventMatchesFilter(ev.Sender(), ev.Type(), filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes) {
+			continue
+		}
+		if filter.ContainsURL != nil && gjson.GetBytes(ev.Content(), "url").Exists() != *filter.ContainsURL {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const deviceListChangesSchema = `
+-- Stores when each user last started or stopped sharing a room with another user.
+CREATE TABLE IF NOT EXISTS syncapi_device_list_changes (
+	id BIGINT,
+	user_id TEXT NOT NULL,
+	target_user_id TEXT NOT NULL,
+	tracked BOOLEAN NOT NULL,
+	CONSTRAINT syncapi_device_list_changes_unique UNIQUE (user_id, target_user_id),
+	PRIMARY KEY(id)
+);
+`
+
+const upsertDeviceListChangeSQL = "" +
+	"INSERT INTO syncapi_device_list_changes" +
+	" (id, user_id, target_user_id, tracked)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (user_id, target_user_id)" +
+	" DO UPDATE SET id = EXCLUDED.id, tracked = EXCLUDED.tracked"
+
+const selectDeviceListChangesInRangeSQL = "" +
+	"SELECT target_user_id, tracked FROM syncapi_device_list_changes" +
+	" WHERE user_id = $1 AND id > $2 AND id <= $3"
+
+const selectMaxDeviceListChangeIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_device_list_changes"
+
+type deviceListChangesStatements struct {
+	db                                 *sql.DB
+	writer                             *sqlutil.TransactionWriter
+	streamIDStatements                 *streamIDStatements
+	upsertDeviceListChangeStmt         *sql.Stmt
+	selectDeviceListChangesInRangeStmt *sql.Stmt
+	selectMaxDeviceListChangeIDStmt    *sql.Stmt
+}
+
+func NewSqliteDeviceListChangesTable(db *sql.DB, streamID *streamIDStatements) (tables.DeviceListChanges, error) {
+	_, err := db.Exec(deviceListChangesSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &deviceListChangesStatements{
+		db:                 db,
+		writer:             sqlutil.NewTransactionWriter(),
+		streamIDStatements: streamID,
+	}
+	if s.upsertDeviceListChangeStmt, err = db.Prepare(upsertDeviceListChangeSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertDeviceListChange statement: %w", err)
+	}
+	if s.selectDeviceListChangesInRangeStmt, err = db.Prepare(selectDeviceListChangesInRangeSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectDeviceListChangesInRange statement: %w", err)
+	}
+	if s.selectMaxDeviceListChangeIDStmt, err = db.Prepare(selectMaxDeviceListChangeIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxDeviceListChangeID statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *deviceListChangesStatements) UpsertDeviceListChange(
+	ctx context.Context, txn *sql.Tx, userID, targetUserID string, tracked bool,
+) (pos types.StreamPosition, err error) {
+	err = s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		stmt := sqlutil.TxStmt(txn, s.upsertDeviceListChangeStmt)
+		_, err = stmt.ExecContext(ctx, pos, userID, targetUserID, tracked)
+		return err
+	})
+	return
+}
+
+func (s *deviceListChangesStatements) SelectDeviceListChangesInRange(
+	ctx context.Context, txn *sql.Tx, userID string, r types.Range,
+) (changed, left []string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceListChangesInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, userID, r.Low(), r.High())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to query device list changes: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDeviceListChangesInRange: rows.close() failed")
+	for rows.Next() {
+		var targetUserID string
+		var tracked bool
+		if err = rows.Scan(&targetUserID, &tracked); err != nil {
+			return nil, nil, err
+		}
+		if tracked {
+			changed = append(changed, targetUserID)
+		} else {
+			left = append(left, targetUserID)
+		}
+	}
+	return changed, left, rows.Err()
+}
+
+func (s *deviceListChangesStatements) SelectMaxDeviceListChangeID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxDeviceListChangeIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
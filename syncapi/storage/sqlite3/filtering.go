@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type filterOrder int
+
+const (
+	filterOrderNone filterOrder = iota
+	filterOrderAsc
+	filterOrderDesc
+)
+
+// SQLite doesn't support array parameters, so the filter conditions which
+// Postgres expresses with "= ANY($n)" are instead appended to the query here
+// with one parameter per value. Conditions are only added for the parts of the
+// filter which are set. The query must end in a WHERE clause, which the
+// conditions are ANDed onto, and the given params must already contain the
+// parameters used by the query.
+func prepareWithFilters(
+	query string, params []interface{},
+	senders, notSenders, types, notTypes []string,
+	containsURL *bool, limit int, order filterOrder,
+) (string, []interface{}) {
+	if len(senders) > 0 {
+		query += " AND sender IN " + variadicParams(&params, senders)
+	}
+	if len(notSenders) > 0 {
+		query += " AND sender NOT IN " + variadicParams(&params, notSenders)
+	}
+	if len(types) > 0 {
+		query += " AND " + typeLikeParams(&params, types)
+	}
+	if len(notTypes) > 0 {
+		query += " AND NOT " + typeLikeParams(&params, notTypes)
+	}
+	if containsURL != nil {
+		params = append(params, *containsURL)
+		query += fmt.Sprintf(" AND contains_url = $%d", len(params))
+	}
+	switch order {
+	case filterOrderAsc:
+		query += " ORDER BY id ASC"
+	case filterOrderDesc:
+		query += " ORDER BY id DESC"
+	}
+	params = append(params, limit)
+	query += fmt.Sprintf(" LIMIT $%d", len(params))
+	return query, params
+}
+
+// variadicParams appends the values to the params and returns a list of
+// placeholders for them, e.g. "($3, $4)".
+func variadicParams(params *[]interface{}, values []string) string {
+	placeholders := make([]string, len(values))
+	for i, v := range values {
+		*params = append(*params, v)
+		placeholders[i] = fmt.Sprintf("$%d", len(*params))
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")"
+}
+
+// typeLikeParams appends the event types to the params and returns a condition
+// which matches any of them, converting "*" wildcards as defined in
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-user-userid-filter
+// to SQL wildcards.
+func typeLikeParams(params *[]interface{}, types []string) string {
+	conditions := make([]string, len(types))
+	for i, t := range types {
+		*params = append(*params, strings.Replace(t, "*", "%", -1))
+		conditions[i] = fmt.Sprintf("type LIKE $%d", len(*params))
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// queryWithFilters runs a query built by prepareWithFilters, using the
+// transaction if one is given.
+func queryWithFilters(
+	ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params []interface{},
+) (*sql.Rows, error) {
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return db.QueryContext(ctx, query, params...)
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+-- Stores the latest presence state of each user.
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+	id BIGINT,
+	user_id TEXT NOT NULL,
+	presence TEXT NOT NULL,
+	status_msg TEXT,
+	last_active_ts BIGINT NOT NULL,
+	CONSTRAINT syncapi_presence_unique UNIQUE (user_id),
+	PRIMARY KEY(id)
+);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence" +
+	" (id, user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET id = EXCLUDED.id, presence = EXCLUDED.presence," +
+	" status_msg = COALESCE(EXCLUDED.status_msg, syncapi_presence.status_msg)," +
+	" last_active_ts = EXCLUDED.last_active_ts"
+
+const selectPresenceForUserSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE user_id = $1"
+
+const selectPresenceInRangeSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE id > $1 AND id <= $2 AND user_id IN ($3)"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	db                        *sql.DB
+	writer                    *sqlutil.TransactionWriter
+	streamIDStatements        *streamIDStatements
+	upsertPresenceStmt        *sql.Stmt
+	selectPresenceForUserStmt *sql.Stmt
+	selectMaxPresenceIDStmt   *sql.Stmt
+}
+
+func NewSqlitePresenceTable(db *sql.DB, streamID *streamIDStatements) (tables.Presence, error) {
+	_, err := db.Exec(presenceSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &presenceStatements{
+		db:                 db,
+		writer:             sqlutil.NewTransactionWriter(),
+		streamIDStatements: streamID,
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertPresence statement: %w", err)
+	}
+	if s.selectPresenceForUserStmt, err = db.Prepare(selectPresenceForUserSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPresenceForUser statement: %w", err)
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxPresenceID statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *presenceStatements) UpsertPresence(
+	ctx context.Context, txn *sql.Tx,
+	userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	err = s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		stmt := sqlutil.TxStmt(txn, s.upsertPresenceStmt)
+		_, err = stmt.ExecContext(ctx, pos, userID, presence, statusMsg, lastActiveTS)
+		return err
+	})
+	return
+}
+
+func (s *presenceStatements) SelectPresenceForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (*api.OutputPresenceEvent, error) {
+	var presence api.OutputPresenceEvent
+	stmt := sqlutil.TxStmt(txn, s.selectPresenceForUserStmt)
+	err := stmt.QueryRowContext(ctx, userID).Scan(
+		&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &presence, nil
+}
+
+func (s *presenceStatements) SelectPresenceInRange(
+	ctx context.Context, txn *sql.Tx,
+	userIDs []string, r types.Range,
+) ([]api.OutputPresenceEvent, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	selectSQL := strings.Replace(selectPresenceInRangeSQL, "($3)", sqlutil.QueryVariadicOffset(len(userIDs), 2), 1)
+	params := make([]interface{}, len(userIDs)+2)
+	params[0] = r.Low()
+	params[1] = r.High()
+	for k, v := range userIDs {
+		params[k+2] = v
+	}
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, selectSQL, params...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, selectSQL, params...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query presence: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPresenceInRange: rows.close() failed")
+	var res []api.OutputPresenceEvent
+	for rows.Next() {
+		var presence api.OutputPresenceEvent
+		err = rows.Scan(&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, presence)
+	}
+	return res, rows.Err()
+}
+
+func (s *presenceStatements) SelectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
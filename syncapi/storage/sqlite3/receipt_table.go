@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const receiptsSchema = `
+-- Stores the latest receipt of each type for each user in each room.
+CREATE TABLE IF NOT EXISTS syncapi_receipts (
+	id BIGINT,
+	room_id TEXT NOT NULL,
+	receipt_type TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	receipt_ts BIGINT NOT NULL,
+	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id),
+	PRIMARY KEY(id)
+);
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id_idx ON syncapi_receipts(room_id);
+`
+
+const upsertReceipt = "" +
+	"INSERT INTO syncapi_receipts" +
+	" (id, room_id, receipt_type, user_id, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (room_id, receipt_type, user_id)" +
+	" DO UPDATE SET id = EXCLUDED.id, event_id = EXCLUDED.event_id, receipt_ts = EXCLUDED.receipt_ts"
+
+const selectRoomReceipts = "" +
+	"SELECT room_id, receipt_type, user_id, event_id, receipt_ts" +
+	" FROM syncapi_receipts" +
+	" WHERE id > $1 AND id <= $2 AND room_id IN ($3)"
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_receipts"
+
+type receiptStatements struct {
+	db                 *sql.DB
+	writer             *sqlutil.TransactionWriter
+	streamIDStatements *streamIDStatements
+	upsertReceipt      *sql.Stmt
+	selectRoomReceipts *sql.Stmt
+	selectMaxReceiptID *sql.Stmt
+}
+
+func NewSqliteReceiptsTable(db *sql.DB, streamID *streamIDStatements) (tables.Receipts, error) {
+	_, err := db.Exec(receiptsSchema)
+	if err != nil {
+		return nil, err
+	}
+	r := &receiptStatements{
+		db:                 db,
+		writer:             sqlutil.NewTransactionWriter(),
+		streamIDStatements: streamID,
+	}
+	if r.upsertReceipt, err = db.Prepare(upsertReceipt); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertReceipt statement: %w", err)
+	}
+	if r.selectRoomReceipts, err = db.Prepare(selectRoomReceipts); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRoomReceipts statement: %w", err)
+	}
+	if r.selectMaxReceiptID, err = db.Prepare(selectMaxReceiptIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxReceiptID statement: %w", err)
+	}
+	return r, nil
+}
+
+// UpsertReceipt creates new user receipts
+func (r *receiptStatements) UpsertReceipt(
+	ctx context.Context, txn *sql.Tx,
+	roomID, receiptType, userID, eventID string,
+	timestamp gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	err = r.writer.Do(r.db, txn, func(txn *sql.Tx) error {
+		pos, err = r.streamIDStatements.nextStreamID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
+		_, err = stmt.ExecContext(ctx, pos, roomID, receiptType, userID, eventID, timestamp)
+		return err
+	})
+	return
+}
+
+// SelectRoomReceiptsInRange returns the receipts for the given rooms which
+// were updated between the two stream positions.
+func (r *receiptStatements) SelectRoomReceiptsInRange(
+	ctx context.Context, txn *sql.Tx,
+	roomIDs []string, rng types.Range,
+) ([]api.OutputReceiptEvent, error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	selectSQL := strings.Replace(selectRoomReceipts, "($3)", sqlutil.QueryVariadicOffset(len(roomIDs), 2), 1)
+	params := make([]interface{}, len(roomIDs)+2)
+	params[0] = rng.Low()
+	params[1] = rng.High()
+	for k, v := range roomIDs {
+		params[k+2] = v
+	}
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, selectSQL, params...)
+	} else {
+		rows, err = r.db.QueryContext(ctx, selectSQL, params...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query room receipts: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomReceiptsInRange: rows.close() failed")
+	var res []api.OutputReceiptEvent
+	for rows.Next() {
+		var receipt api.OutputReceiptEvent
+		err = rows.Scan(&receipt.RoomID, &receipt.Type, &receipt.UserID, &receipt.EventID, &receipt.Timestamp)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, receipt)
+	}
+	return res, rows.Err()
+}
+
+func (r *receiptStatements) SelectMaxReceiptID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, r.selectMaxReceiptID)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
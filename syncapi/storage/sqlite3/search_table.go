@@ -0,0 +1,258 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// The search index uses the SQLite FTS5 extension, which is enabled at build
+// time with the "sqlite_fts5" build tag. If it isn't available then events are
+// stored in a plain table instead, and searched with LIKE.
+const searchSchema = `
+-- Stores a full-text index of the searchable parts of room events.
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_events USING fts5(
+	event_id UNINDEXED,
+	room_id UNINDEXED,
+	sender UNINDEXED,
+	key UNINDEXED,
+	value,
+	stream_pos UNINDEXED
+);
+`
+
+const searchFallbackSchema = `
+-- Stores the searchable parts of room events, for when FTS5 isn't available.
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	event_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	stream_pos BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_event_id ON syncapi_search_events(event_id);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id ON syncapi_search_events(room_id);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (event_id, room_id, sender, key, value, stream_pos)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+// The room ID and key lists are replaced with variadic parameters at query
+// time, and any sender conditions are appended.
+const searchConditionsSQL = "" +
+	" FROM syncapi_search_events" +
+	" WHERE syncapi_search_events MATCH $1 AND room_id IN ($2) AND key IN ($3)"
+
+// Without FTS5 there is no match parameter, but the room ID and key lists are
+// replaced in the same way, and a LIKE condition is appended for each word.
+const searchFallbackConditionsSQL = "" +
+	" FROM syncapi_search_events" +
+	" WHERE room_id IN ($2) AND key IN ($3)"
+
+// bm25() returns more negative values for better matches, so it is negated to
+// give a rank where higher is better.
+const selectSearchSQL = "" +
+	"SELECT event_id, room_id, -bm25(syncapi_search_events) AS rank"
+
+// Without FTS5 there is no rank, so results are ordered by recency only.
+const selectSearchFallbackSQL = "" +
+	"SELECT event_id, room_id, 0 AS rank"
+
+const selectSearchCountSQL = "" +
+	"SELECT COUNT(*)"
+
+type searchStatements struct {
+	db                    *sql.DB
+	writer                *sqlutil.TransactionWriter
+	fts                   bool
+	insertSearchEventStmt *sql.Stmt
+	deleteSearchEventStmt *sql.Stmt
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{
+		db:     db,
+		writer: sqlutil.NewTransactionWriter(),
+		fts:    true,
+	}
+	_, err := db.Exec(searchSchema)
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		logrus.Warn("SQLite was built without FTS5, so search results will not be ranked (build with the sqlite_fts5 tag to enable it)")
+		s.fts = false
+		_, err = db.Exec(searchFallbackSchema)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create search table: %w", err)
+	}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchEvent statement: %w", err)
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEvent statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx,
+	event *gomatrixserverlib.HeaderedEvent, key, value string,
+	pos types.StreamPosition,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		// FTS5 tables can't have unique constraints, so remove any existing
+		// entry first in case the event is being indexed again.
+		if _, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, event.EventID()); err != nil {
+			return err
+		}
+		stmt := sqlutil.TxStmt(txn, s.insertSearchEventStmt)
+		_, err := stmt.ExecContext(ctx, event.EventID(), event.RoomID(), event.Sender(), key, value, pos)
+		return err
+	})
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deleteSearchEventStmt)
+		_, err := stmt.ExecContext(ctx, eventID)
+		return err
+	})
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, txn *sql.Tx,
+	term string, roomIDs, keys, senders, notSenders []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	if len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, 0, nil
+	}
+	words := strings.Fields(term)
+	if len(words) == 0 {
+		return nil, 0, nil
+	}
+
+	var params []interface{}
+	selectSQL, conditions := selectSearchSQL, searchConditionsSQL
+	if s.fts {
+		params = append(params, ftsMatchExpression(words))
+	} else {
+		selectSQL, conditions = selectSearchFallbackSQL, searchFallbackConditionsSQL
+	}
+	conditions = strings.Replace(conditions, "($2)", sqlutil.QueryVariadicOffset(len(roomIDs), len(params)), 1)
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	conditions = strings.Replace(conditions, "($3)", sqlutil.QueryVariadicOffset(len(keys), len(params)), 1)
+	for _, key := range keys {
+		params = append(params, key)
+	}
+	if !s.fts {
+		for _, word := range words {
+			conditions += fmt.Sprintf(` AND value LIKE $%d ESCAPE '\'`, len(params)+1)
+			params = append(params, likePattern(word))
+		}
+	}
+	if len(senders) > 0 {
+		conditions += " AND sender IN " + sqlutil.QueryVariadicOffset(len(senders), len(params))
+		for _, sender := range senders {
+			params = append(params, sender)
+		}
+	}
+	if len(notSenders) > 0 {
+		conditions += " AND sender NOT IN " + sqlutil.QueryVariadicOffset(len(notSenders), len(params))
+		for _, sender := range notSenders {
+			params = append(params, sender)
+		}
+	}
+
+	var count int
+	countSQL := selectSearchCountSQL + conditions
+	var err error
+	if txn != nil {
+		err = txn.QueryRowContext(ctx, countSQL, params...).Scan(&count)
+	} else {
+		err = s.db.QueryRowContext(ctx, countSQL, params...).Scan(&count)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to count search results: %w", err)
+	}
+
+	selectSQL += conditions
+	if orderByRank {
+		selectSQL += " ORDER BY rank DESC, stream_pos DESC"
+	} else {
+		selectSQL += " ORDER BY stream_pos DESC"
+	}
+	selectSQL += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
+	params = append(params, limit, offset)
+
+	var rows *sql.Rows
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, selectSQL, params...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, selectSQL, params...)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to query search results: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearchResults: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// ftsMatchExpression converts the words of a search term into an FTS5 query
+// which matches events containing all of them, in the same way as
+// plainto_tsquery does on Postgres. Each word is quoted so that FTS5 query
+// syntax in the search term is treated as literal text.
+func ftsMatchExpression(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// likePattern returns a LIKE pattern which matches values containing the word,
+// escaping any wildcards in it with a backslash.
+func likePattern(word string) string {
+	word = strings.ReplaceAll(word, `\`, `\\`)
+	word = strings.ReplaceAll(word, "%", `\%`)
+	word = strings.ReplaceAll(word, "_", `\_`)
+	return "%" + word + "%"
+}
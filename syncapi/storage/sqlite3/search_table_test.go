@@ -0,0 +1,53 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"testing"
+)
+
+func TestFTSMatchExpression(t *testing.T) {
+	tcs := []struct {
+		Words []string
+		Want  string
+	}{
+		{Words: []string{"hello"}, Want: `"hello"`},
+		{Words: []string{"hello", "world"}, Want: `"hello" "world"`},
+		{Words: []string{`say "hi"`}, Want: `"say ""hi"""`},
+		{Words: []string{"NOT", "a*"}, Want: `"NOT" "a*"`},
+	}
+	for _, tc := range tcs {
+		if got := ftsMatchExpression(tc.Words); got != tc.Want {
+			t.Errorf("ftsMatchExpression(%q): got %s, want %s", tc.Words, got, tc.Want)
+		}
+	}
+}
+
+func TestLikePattern(t *testing.T) {
+	tcs := []struct {
+		Word string
+		Want string
+	}{
+		{Word: "hello", Want: `%hello%`},
+		{Word: "100%", Want: `%100\%%`},
+		{Word: "snake_case", Want: `%snake\_case%`},
+		{Word: `back\slash`, Want: `%back\\slash%`},
+	}
+	for _, tc := range tcs {
+		if got := likePattern(tc.Word); got != tc.Want {
+			t.Errorf("likePattern(%q): got %s, want %s", tc.Word, got, tc.Want)
+		}
+	}
+}
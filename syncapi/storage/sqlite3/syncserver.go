@@ -91,6 +91,30 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	receipts, err := NewSqliteReceiptsTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	presence, err := NewSqlitePresenceTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	notificationData, err := NewSqliteNotificationDataTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	deviceListChanges, err := NewSqliteDeviceListChangesTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	peeks, err := NewSqlitePeeksTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -101,6 +125,12 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		Topology:            topology,
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
+		Receipts:            receipts,
+		Presence:            presence,
+		NotificationData:    notificationData,
+		Search:              search,
+		Peeks:               peeks,
+		DeviceListChanges:   deviceListChanges,
 		SendToDeviceWriter:  sqlutil.NewTransactionWriter(),
 		EDUCache:            cache.New(),
 	}
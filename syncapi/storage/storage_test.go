@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -166,7 +168,7 @@ func TestSyncResponse(t *testing.T) {
 					positions[len(positions)-2], types.StreamPosition(0), nil,
 				)
 				res := types.NewResponse()
-				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, filterWithTimelineLimit(5), false)
 			},
 			WantTimeline: events[len(events)-1:],
 		},
@@ -180,19 +182,19 @@ func TestSyncResponse(t *testing.T) {
 				)
 				res := types.NewResponse()
 				// limit is set to 5
-				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, filterWithTimelineLimit(5), false)
 			},
 			// want the last 5 events, NOT the last 10.
 			WantTimeline: events[len(events)-5:],
 		},
 		// The purpose of this test is to check that CompleteSync returns all the current state as well as
-		// honouring the `numRecentEventsPerRoom` value
+		// honouring the timeline limit of the filter
 		{
 			Name: "CompleteSync limited",
 			DoSync: func() (*types.Response, error) {
 				res := types.NewResponse()
 				// limit set to 5
-				return db.CompleteSync(ctx, res, testUserDeviceA, 5)
+				return db.CompleteSync(ctx, res, testUserDeviceA, filterWithTimelineLimit(5))
 			},
 			// want the last 5 events
 			WantTimeline: events[len(events)-5:],
@@ -200,12 +202,12 @@ func TestSyncResponse(t *testing.T) {
 			WantState: state,
 		},
 		// The purpose of this test is to check that CompleteSync can return everything with a high enough
-		// `numRecentEventsPerRoom`.
+		// timeline limit.
 		{
 			Name: "CompleteSync",
 			DoSync: func() (*types.Response, error) {
 				res := types.NewResponse()
-				return db.CompleteSync(ctx, res, testUserDeviceA, len(events)+1)
+				return db.CompleteSync(ctx, res, testUserDeviceA, filterWithTimelineLimit(len(events)+1))
 			},
 			WantTimeline: events,
 			// We want no state at all as that field in /sync is the delta between the token (beginning of time)
@@ -233,6 +235,80 @@ func TestSyncResponse(t *testing.T) {
 	}
 }
 
+// These tests assert that the room, timeline and state filters are applied to sync responses.
+func TestSyncResponseWithFilters(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	testCases := []struct {
+		Name         string
+		Filter       func(filter *gomatrixserverlib.Filter)
+		WantRoom     bool
+		WantTimeline []gomatrixserverlib.HeaderedEvent
+		WantState    []gomatrixserverlib.HeaderedEvent
+	}{
+		{
+			Name: "timeline not_senders",
+			Filter: func(filter *gomatrixserverlib.Filter) {
+				filter.Room.Timeline.Limit = 3
+				filter.Room.Timeline.NotSenders = []string{testUserIDB}
+				filter.Room.State.NotTypes = []string{"*"}
+			},
+			WantRoom: true,
+			// the last 3 events sent by user A
+			WantTimeline: events[9:12],
+		},
+		{
+			Name: "timeline types with wildcard",
+			Filter: func(filter *gomatrixserverlib.Filter) {
+				filter.Room.Timeline.Types = []string{"m.room.mem*"}
+				filter.Room.State.NotTypes = []string{"*"}
+			},
+			WantRoom:     true,
+			WantTimeline: []gomatrixserverlib.HeaderedEvent{events[1], events[12]},
+		},
+		{
+			Name: "state types",
+			Filter: func(filter *gomatrixserverlib.Filter) {
+				filter.Room.Timeline.Limit = 1
+				filter.Room.State.Types = []string{"m.room.create"}
+			},
+			WantRoom:     true,
+			WantTimeline: events[len(events)-1:],
+			WantState:    events[:1],
+		},
+		{
+			Name: "not_rooms",
+			Filter: func(filter *gomatrixserverlib.Filter) {
+				filter.Room.NotRooms = []string{testRoomID}
+			},
+			WantRoom: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(st *testing.T) {
+			filter := filterWithTimelineLimit(len(events))
+			tc.Filter(filter)
+			res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, filter)
+			if err != nil {
+				st.Fatalf("failed to do sync: %s", err)
+			}
+			roomRes, ok := res.Rooms.Join[testRoomID]
+			if ok != tc.WantRoom {
+				st.Fatalf("CompleteSync response has room %s: got %v want %v", testRoomID, ok, tc.WantRoom)
+			}
+			if !ok {
+				return
+			}
+			assertEventsEqual(st, "state for "+testRoomID, false, roomRes.State.Events, tc.WantState)
+			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, tc.WantTimeline)
+		})
+	}
+}
+
 func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	t.Parallel()
 	db := MustCreateDatabase(t)
@@ -247,7 +323,7 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	)
 
 	res := types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, filterWithTimelineLimit(5), false)
 	if err != nil {
 		t.Fatalf("failed to IncrementalSync with latest token")
 	}
@@ -636,7 +712,7 @@ func TestInviteBehaviour(t *testing.T) {
 	}
 	// both invite events should appear in a new sync
 	beforeRetireRes := types.NewResponse()
-	beforeRetireRes, err = db.IncrementalSync(ctx, beforeRetireRes, testUserDeviceA, types.NewStreamToken(0, 0, nil), latest, 0, false)
+	beforeRetireRes, err = db.IncrementalSync(ctx, beforeRetireRes, testUserDeviceA, types.NewStreamToken(0, 0, nil), latest, filterWithTimelineLimit(0), false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -651,7 +727,7 @@ func TestInviteBehaviour(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	res := types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.NewStreamToken(0, 0, nil), latest, 0, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.NewStreamToken(0, 0, nil), latest, filterWithTimelineLimit(0), false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -663,7 +739,7 @@ func TestInviteBehaviour(t *testing.T) {
 		t.Fatalf("NewStreamTokenFromString cannot parse next batch '%s' : %s", beforeRetireRes.NextBatch, err)
 	}
 	res = types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, beforeRetireTok, latest, 0, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, beforeRetireTok, latest, filterWithTimelineLimit(0), false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -734,6 +810,13 @@ func topologyTokenBefore(t *testing.T, db storage.Database, eventID string) *typ
 	return &tok
 }
 
+func filterWithTimelineLimit(limit int) *gomatrixserverlib.Filter {
+	filter := gomatrixserverlib.Filter{}
+	filter.Room.State = gomatrixserverlib.DefaultStateFilter()
+	filter.Room.Timeline.Limit = limit
+	return &filter
+}
+
 func reversed(in []gomatrixserverlib.HeaderedEvent) []gomatrixserverlib.HeaderedEvent {
 	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
 	for i := 0; i < len(in); i++ {
@@ -741,3 +824,314 @@ func reversed(in []gomatrixserverlib.HeaderedEvent) []gomatrixserverlib.Headered
 	}
 	return out
 }
+
+func TestSearchEvents(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	keys := []string{"content.body"}
+	roomIDs := []string{testRoomID}
+
+	testCases := []struct {
+		Name       string
+		Term       string
+		Senders    []string
+		NotSenders []string
+		WantCount  int
+	}{
+		{Name: "all messages", Term: "message", WantCount: 20},
+		{Name: "all words must match", Term: "message b 3", WantCount: 1},
+		{Name: "no matches", Term: "grub", WantCount: 0},
+		{Name: "senders", Term: "message", Senders: []string{testUserIDB}, WantCount: 10},
+		{Name: "not senders", Term: "message", NotSenders: []string{testUserIDA, testUserIDB}, WantCount: 0},
+	}
+	for _, tc := range testCases {
+		results, count, err := db.SearchEvents(ctx, tc.Term, roomIDs, keys, tc.Senders, tc.NotSenders, true, 50, 0)
+		if err != nil {
+			t.Fatalf("%s: SearchEvents returned error: %s", tc.Name, err)
+		}
+		if count != tc.WantCount || len(results) != tc.WantCount {
+			t.Errorf("%s: got count %d with %d results, want %d", tc.Name, count, len(results), tc.WantCount)
+		}
+	}
+
+	// Results ordered by recency should be paginated newest first.
+	results, count, err := db.SearchEvents(ctx, "message", roomIDs, keys, nil, nil, false, 5, 5)
+	if err != nil {
+		t.Fatalf("SearchEvents returned error: %s", err)
+	}
+	if count != 20 || len(results) != 5 {
+		t.Fatalf("got count %d with %d results, want 20 with 5", count, len(results))
+	}
+	if want := events[len(events)-6].EventID(); results[0].EventID != want {
+		t.Errorf("got first result %s, want %s", results[0].EventID, want)
+	}
+}
+
+func TestPresenceInRange(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	statusMsg := "Gone to the city of tears"
+	posA, err := db.SetPresence(ctx, testUserIDA, "online", &statusMsg, gomatrixserverlib.Timestamp(1))
+	if err != nil {
+		t.Fatalf("SetPresence failed: %s", err)
+	}
+	posB, err := db.SetPresence(ctx, testUserIDB, "unavailable", nil, gomatrixserverlib.Timestamp(2))
+	if err != nil {
+		t.Fatalf("SetPresence failed: %s", err)
+	}
+	userIDs := []string{testUserIDA, testUserIDB}
+
+	// Only presence updated within the range should be returned.
+	presences, err := db.GetPresenceInRange(ctx, userIDs, types.Range{From: posA, To: posB})
+	if err != nil {
+		t.Fatalf("GetPresenceInRange failed: %s", err)
+	}
+	if len(presences) != 1 || presences[0].UserID != testUserIDB || presences[0].Presence != "unavailable" {
+		t.Errorf("got presences %+v, want only %s unavailable", presences, testUserIDB)
+	}
+	presences, err = db.GetPresenceInRange(ctx, userIDs, types.Range{From: 0, To: posB})
+	if err != nil {
+		t.Fatalf("GetPresenceInRange failed: %s", err)
+	}
+	if len(presences) != 2 {
+		t.Errorf("got %d presences, want 2", len(presences))
+	}
+	presences, err = db.GetPresenceInRange(ctx, []string{testUserIDB}, types.Range{From: 0, To: posA})
+	if err != nil {
+		t.Fatalf("GetPresenceInRange failed: %s", err)
+	}
+	if len(presences) != 0 {
+		t.Errorf("got presences %+v, want none", presences)
+	}
+
+	// Updating the presence without a status message moves the presence to
+	// the new position, but keeps the existing status message.
+	posA2, err := db.SetPresence(ctx, testUserIDA, "unavailable", nil, gomatrixserverlib.Timestamp(3))
+	if err != nil {
+		t.Fatalf("SetPresence failed: %s", err)
+	}
+	presences, err = db.GetPresenceInRange(ctx, userIDs, types.Range{From: posB, To: posA2})
+	if err != nil {
+		t.Fatalf("GetPresenceInRange failed: %s", err)
+	}
+	if len(presences) != 1 || presences[0].UserID != testUserIDA {
+		t.Fatalf("got presences %+v, want only %s", presences, testUserIDA)
+	}
+	if presences[0].StatusMsg == nil || *presences[0].StatusMsg != statusMsg {
+		t.Errorf("got status message %v, want %q", presences[0].StatusMsg, statusMsg)
+	}
+}
+
+func TestReceiptsInIncrementalSync(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	readEventID := events[len(events)-1].EventID()
+	pos, err := db.StoreReceipt(ctx, testRoomID, "m.read", testUserIDB, readEventID, gomatrixserverlib.Timestamp(1234))
+	if err != nil {
+		t.Fatalf("StoreReceipt failed: %s", err)
+	}
+	to := types.NewStreamToken(pos, from.EDUPosition(), nil)
+
+	res, err := db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, to, filterWithTimelineLimit(5), false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	jr, ok := res.Rooms.Join[testRoomID]
+	if !ok || len(jr.Ephemeral.Events) != 1 {
+		t.Fatalf("want one ephemeral event for %s, got response %+v", testRoomID, res)
+	}
+	if jr.Ephemeral.Events[0].Type != "m.receipt" {
+		t.Fatalf("got ephemeral event of type %q, want m.receipt", jr.Ephemeral.Events[0].Type)
+	}
+	var content map[string]map[string]map[string]struct {
+		TS gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	if err = json.Unmarshal(jr.Ephemeral.Events[0].Content, &content); err != nil {
+		t.Fatalf("failed to unmarshal receipt content: %s", err)
+	}
+	if ts := content[readEventID]["m.read"][testUserIDB].TS; ts != 1234 {
+		t.Errorf("got receipt timestamp %d for %s, want 1234 (content %+v)", ts, testUserIDB, content)
+	}
+
+	// Syncing again from the receipt's position shouldn't return it again.
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, to, to, filterWithTimelineLimit(5), false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if jr, ok = res.Rooms.Join[testRoomID]; ok && len(jr.Ephemeral.Events) != 0 {
+		t.Errorf("got ephemeral events %+v, want none", jr.Ephemeral.Events)
+	}
+}
+
+func TestUnreadNotificationCountsInRange(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	otherRoomID := fmt.Sprintf("!crossroads:%s", testOrigin)
+	posA, err := db.UpsertRoomUnreadNotificationCounts(ctx, testUserIDA, testRoomID)
+	if err != nil {
+		t.Fatalf("UpsertRoomUnreadNotificationCounts failed: %s", err)
+	}
+	posB, err := db.UpsertRoomUnreadNotificationCounts(ctx, testUserIDA, otherRoomID)
+	if err != nil {
+		t.Fatalf("UpsertRoomUnreadNotificationCounts failed: %s", err)
+	}
+	if _, err = db.UpsertRoomUnreadNotificationCounts(ctx, testUserIDB, testRoomID); err != nil {
+		t.Fatalf("UpsertRoomUnreadNotificationCounts failed: %s", err)
+	}
+	if posB <= posA {
+		t.Fatalf("got position %d after %d, want it to increase", posB, posA)
+	}
+
+	// Only the rooms of the given user which changed within the range are returned.
+	roomIDs, err := db.GetUserUnreadNotificationCountsInRange(ctx, testUserIDA, types.Range{From: posA, To: posB})
+	if err != nil {
+		t.Fatalf("GetUserUnreadNotificationCountsInRange failed: %s", err)
+	}
+	if len(roomIDs) != 1 || roomIDs[0] != otherRoomID {
+		t.Errorf("got rooms %v, want [%s]", roomIDs, otherRoomID)
+	}
+
+	// Changing the counts again moves the room to the new position, which
+	// also moves the sync position along so that /sync is woken up.
+	posA2, err := db.UpsertRoomUnreadNotificationCounts(ctx, testUserIDA, testRoomID)
+	if err != nil {
+		t.Fatalf("UpsertRoomUnreadNotificationCounts failed: %s", err)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("SyncPosition failed: %s", err)
+	}
+	if latest.PDUPosition() != posA2 {
+		t.Errorf("got sync position %d, want %d", latest.PDUPosition(), posA2)
+	}
+	roomIDs, err = db.GetUserUnreadNotificationCountsInRange(ctx, testUserIDA, types.Range{From: posB, To: posA2})
+	if err != nil {
+		t.Fatalf("GetUserUnreadNotificationCountsInRange failed: %s", err)
+	}
+	if len(roomIDs) != 1 || roomIDs[0] != testRoomID {
+		t.Errorf("got rooms %v, want [%s]", roomIDs, testRoomID)
+	}
+}
+
+func TestDeviceListChangesInRange(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	// Write the events up to and including userB joining the room.
+	MustWriteEvents(t, db, events[:13])
+	joinedUsers, err := db.JoinedUsersInRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("JoinedUsersInRoom failed: %s", err)
+	}
+	sort.Strings(joinedUsers)
+	if want := []string{testUserIDA, testUserIDB}; !reflect.DeepEqual(joinedUsers, want) {
+		t.Errorf("got joined users %v, want %v", joinedUsers, want)
+	}
+
+	targetUserID := fmt.Sprintf("@charlie:%s", testOrigin)
+	otherUserID := fmt.Sprintf("@dave:%s", testOrigin)
+	posJoin, err := db.StoreDeviceListChanges(ctx, []string{testUserIDA, testUserIDB}, targetUserID, true)
+	if err != nil {
+		t.Fatalf("StoreDeviceListChanges failed: %s", err)
+	}
+	posLeave, err := db.StoreDeviceListChanges(ctx, []string{testUserIDA}, otherUserID, false)
+	if err != nil {
+		t.Fatalf("StoreDeviceListChanges failed: %s", err)
+	}
+	if posLeave <= posJoin {
+		t.Fatalf("got position %d after %d, want it to increase", posLeave, posJoin)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("SyncPosition failed: %s", err)
+	}
+	if latest.PDUPosition() != posLeave {
+		t.Errorf("got sync position %d, want %d", latest.PDUPosition(), posLeave)
+	}
+
+	// Only the changes for the given user within the range are returned.
+	changed, left, err := db.GetDeviceListChangesInRange(ctx, testUserIDA, types.Range{From: 0, To: posLeave})
+	if err != nil {
+		t.Fatalf("GetDeviceListChangesInRange failed: %s", err)
+	}
+	if !reflect.DeepEqual(changed, []string{targetUserID}) || !reflect.DeepEqual(left, []string{otherUserID}) {
+		t.Errorf("got changed %v and left %v, want [%s] and [%s]", changed, left, targetUserID, otherUserID)
+	}
+	changed, left, err = db.GetDeviceListChangesInRange(ctx, testUserIDA, types.Range{From: posJoin, To: posLeave})
+	if err != nil {
+		t.Fatalf("GetDeviceListChangesInRange failed: %s", err)
+	}
+	if len(changed) != 0 || !reflect.DeepEqual(left, []string{otherUserID}) {
+		t.Errorf("got changed %v and left %v, want [] and [%s]", changed, left, otherUserID)
+	}
+
+	// Only the latest change between two users is kept, at its new position.
+	posLeave2, err := db.StoreDeviceListChanges(ctx, []string{testUserIDB}, targetUserID, false)
+	if err != nil {
+		t.Fatalf("StoreDeviceListChanges failed: %s", err)
+	}
+	changed, left, err = db.GetDeviceListChangesInRange(ctx, testUserIDB, types.Range{From: 0, To: posLeave2})
+	if err != nil {
+		t.Fatalf("GetDeviceListChangesInRange failed: %s", err)
+	}
+	if len(changed) != 0 || !reflect.DeepEqual(left, []string{targetUserID}) {
+		t.Errorf("got changed %v and left %v, want [] and [%s]", changed, left, targetUserID)
+	}
+}
+
+func TestPeeksDeleted(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	otherRoomID := fmt.Sprintf("!crossroads:%s", testOrigin)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	// Write the events up to userB joining the room.
+	MustWriteEvents(t, db, events[:12])
+
+	mustAddPeek := func(roomID, userID, deviceID string) {
+		if _, err := db.AddPeek(ctx, roomID, userID, deviceID); err != nil {
+			t.Fatalf("AddPeek failed: %s", err)
+		}
+	}
+	mustAddPeek(testRoomID, testUserIDB, "device1")
+	mustAddPeek(testRoomID, testUserIDB, "device2")
+	mustAddPeek(otherRoomID, testUserIDB, "device1")
+	mustAddPeek(otherRoomID, testUserIDB, "device2")
+	mustAddPeek(otherRoomID, testUserIDA, "device1")
+
+	peekingDevices := func(roomID string) []types.PeekingDevice {
+		devices, err := db.AllPeekingDevicesInRooms(ctx)
+		if err != nil {
+			t.Fatalf("AllPeekingDevicesInRooms failed: %s", err)
+		}
+		return devices[roomID]
+	}
+
+	// Joining the room stops all of the user's devices peeking into it.
+	MustWriteEvents(t, db, events[12:13])
+	if devices := peekingDevices(testRoomID); len(devices) != 0 {
+		t.Errorf("got devices %+v peeking into %s after joining it, want none", devices, testRoomID)
+	}
+	if devices := peekingDevices(otherRoomID); len(devices) != 3 {
+		t.Fatalf("got devices %+v peeking into %s, want 3", devices, otherRoomID)
+	}
+
+	if err := db.DeletePeek(ctx, otherRoomID, testUserIDA, "device1"); err != nil {
+		t.Fatalf("DeletePeek failed: %s", err)
+	}
+	if err := db.DeletePeeksForDevices(ctx, testUserIDB, []string{"device1"}); err != nil {
+		t.Fatalf("DeletePeeksForDevices failed: %s", err)
+	}
+	want := types.PeekingDevice{UserID: testUserIDB, DeviceID: "device2"}
+	if devices := peekingDevices(otherRoomID); len(devices) != 1 || devices[0] != want {
+		t.Errorf("got devices %+v peeking into %s, want only %+v", devices, otherRoomID, want)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -44,8 +45,9 @@ type Events interface {
 	InsertEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, addState, removeState []string, transactionID *api.TransactionID, excludeFromSync bool) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
 	// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude from sync.
-	// Returns up to `limit` events. Returns `limited=true` if there are more events in this range but we hit the `limit`.
-	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int, chronologicalOrder bool, onlySyncEvents bool) ([]types.StreamEvent, bool, error)
+	// Only returns events which match the filter, up to the filter's `limit`. Returns `limited=true` if there are more events
+	// in this range but we hit the `limit`.
+	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool) ([]types.StreamEvent, bool, error)
 	// SelectEarlyEvents returns the earliest events in the given room.
 	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
@@ -80,6 +82,8 @@ type CurrentRoomState interface {
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
+	// SelectJoinedUsersInRoom returns the IDs of the users who are joined to the room.
+	SelectJoinedUsersInRoom(ctx context.Context, txn *sql.Tx, roomID string) ([]string, error)
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -139,3 +143,95 @@ type Filter interface {
 	SelectFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
 	InsertFilter(ctx context.Context, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
 }
+
+// Receipts keeps track of the latest receipt of each type for each user in
+// each room. Receipts share the stream position sequence with the other
+// tables generated from kafka logs, so that they can be returned in /sync
+// responses in the same way as account data and invites.
+type Receipts interface {
+	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomID, receiptType, userID, eventID string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	// SelectRoomReceiptsInRange returns the receipts in the given rooms which were
+	// updated between the two stream positions.
+	SelectRoomReceiptsInRange(ctx context.Context, txn *sql.Tx, roomIDs []string, r types.Range) ([]eduAPI.OutputReceiptEvent, error)
+	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// Presence keeps track of the latest presence state of each user. Updates share
+// the stream position of the other tables generated from kafka logs.
+type Presence interface {
+	// UpsertPresence stores the new presence of a user. If statusMsg is nil then
+	// any existing status message is left unchanged.
+	UpsertPresence(ctx context.Context, txn *sql.Tx, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	// SelectPresenceForUser returns the presence of the given user, or nil if
+	// no presence is known for that user.
+	SelectPresenceForUser(ctx context.Context, txn *sql.Tx, userID string) (*eduAPI.OutputPresenceEvent, error)
+	// SelectPresenceInRange returns the presence of the given users which was
+	// updated between the two stream positions.
+	SelectPresenceInRange(ctx context.Context, txn *sql.Tx, userIDs []string, r types.Range) ([]eduAPI.OutputPresenceEvent, error)
+	SelectMaxPresenceID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// NotificationData keeps track of when the unread notification counts of each
+// user in each room last changed, so that the new counts can be sent down /sync
+// even if there are no new events in the room. Updates share the stream
+// position of the other tables generated from kafka logs.
+type NotificationData interface {
+	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string) (pos types.StreamPosition, err error)
+	// SelectUserUnreadCountsInRange returns the rooms in which the unread
+	// notification counts of the user changed between the two stream positions.
+	SelectUserUnreadCountsInRange(ctx context.Context, txn *sql.Tx, userID string, r types.Range) ([]string, error)
+	SelectMaxNotificationDataID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// DeviceListChanges keeps track of when each local user started or stopped
+// sharing a room with another user, so that the other user can be sent down
+// /sync in the "changed" or "left" device lists at the position it happened at.
+// Changes share the stream position of the other tables generated from kafka
+// logs, and only the latest change for each pair of users is kept.
+type DeviceListChanges interface {
+	UpsertDeviceListChange(ctx context.Context, txn *sql.Tx, userID, targetUserID string, tracked bool) (pos types.StreamPosition, err error)
+	// SelectDeviceListChangesInRange returns the users who the user started
+	// sharing a room with (changed) and stopped sharing any rooms with (left)
+	// between the two stream positions.
+	SelectDeviceListChangesInRange(ctx context.Context, txn *sql.Tx, userID string, r types.Range) (changed, left []string, err error)
+	SelectMaxDeviceListChangeID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// Peeks keeps track of the rooms which devices are peeking into without being
+// joined to them. Peeks share the stream position of the other tables
+// generated from kafka logs, so that a new peek is sent down /sync at the
+// position it was made at.
+type Peeks interface {
+	// UpsertPeek starts the device peeking into the room. If the device was
+	// already peeking then the existing stream position of the peek is returned.
+	UpsertPeek(ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string) (pos types.StreamPosition, err error)
+	// SelectPeeksForDevice returns the rooms which the device is peeking into.
+	SelectPeeksForDevice(ctx context.Context, txn *sql.Tx, userID, deviceID string) ([]types.Peek, error)
+	// SelectPeekingDevices returns a map of room ID to the devices peeking into it.
+	SelectPeekingDevices(ctx context.Context) (map[string][]types.PeekingDevice, error)
+	// DeletePeek stops the device peeking into the room.
+	DeletePeek(ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string) error
+	// DeletePeeksForUser stops all of the devices of the user peeking into the room.
+	DeletePeeksForUser(ctx context.Context, txn *sql.Tx, roomID, userID string) error
+	// DeletePeeksForDevice stops the device peeking into any room.
+	DeletePeeksForDevice(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+	SelectMaxPeekID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// Search holds a full-text index of the searchable parts of room events, so
+// that they can be found by the /search endpoint. Each event is indexed on a
+// single key, which is one of "content.body", "content.name" or
+// "content.topic".
+type Search interface {
+	InsertSearchEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, key, value string, pos types.StreamPosition) error
+	DeleteSearchEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectSearchResults returns the events in the given rooms which match the
+	// search term on any of the given keys, along with the total number of
+	// matching events. If senders is not empty then only events from those
+	// senders are returned. Events from notSenders are never returned. Results
+	// are ordered by rank if orderByRank is true, or most recent first otherwise.
+	SelectSearchResults(
+		ctx context.Context, txn *sql.Tx, term string, roomIDs, keys, senders, notSenders []string,
+		orderByRank bool, limit, offset int,
+	) (results []types.SearchResult, count int, err error)
+}
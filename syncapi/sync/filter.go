@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// filterResponse applies the parts of the filter which aren't handled by the
+// database to a sync response: the account data, presence and ephemeral
+// filters. The rooms, timeline and state filters are applied by the database
+// when the response is built, and the event_fields of the filter by
+// responseJSON when it is sent.
+func filterResponse(res *types.Response, filter *gomatrixserverlib.Filter) {
+	res.AccountData.Events = filterEvents(res.AccountData.Events, &filter.AccountData)
+	res.Presence.Events = filterEvents(res.Presence.Events, &filter.Presence)
+	for roomID, jr := range res.Rooms.Join {
+		jr.AccountData.Events = filterRoomEvents(roomID, jr.AccountData.Events, &filter.Room.AccountData)
+		jr.Ephemeral.Events = filterRoomEvents(roomID, jr.Ephemeral.Events, &filter.Room.Ephemeral)
+		res.Rooms.Join[roomID] = jr
+	}
+}
+
+// responseJSON returns the sync response to send to the client. If the filter
+// has event_fields, this is the JSON of the response with all but those fields
+// removed from its events, as the events can't be represented as
+// gomatrixserverlib.ClientEvents without gaining the fields which were removed.
+func responseJSON(res *types.Response, filter *gomatrixserverlib.Filter) (interface{}, error) {
+	if len(filter.EventFields) == 0 {
+		return res, nil
+	}
+	fields := filter.EventFields
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{"account_data.events", "presence.events"} {
+		if resJSON, err = filterEventFields(resJSON, path, fields); err != nil {
+			return nil, err
+		}
+	}
+	roomPaths := map[string][]string{
+		"join":  {"state.events", "timeline.events", "ephemeral.events", "account_data.events"},
+		"leave": {"state.events", "timeline.events"},
+		"peek":  {"state.events", "timeline.events"},
+	}
+	for section, paths := range roomPaths {
+		// Room IDs contain dots, so the rooms are filtered one at a time
+		// rather than by a path through the whole response.
+		roomsResult := gjson.GetBytes(resJSON, "rooms."+section)
+		if !roomsResult.IsObject() {
+			continue
+		}
+		rooms := map[string]json.RawMessage{}
+		if err = json.Unmarshal([]byte(roomsResult.Raw), &rooms); err != nil {
+			return nil, err
+		}
+		for roomID, roomJSON := range rooms {
+			for _, path := range paths {
+				if roomJSON, err = filterEventFields(roomJSON, path, fields); err != nil {
+					return nil, err
+				}
+			}
+			rooms[roomID] = roomJSON
+		}
+		roomsJSON, err := json.Marshal(rooms)
+		if err != nil {
+			return nil, err
+		}
+		if resJSON, err = sjson.SetRawBytes(resJSON, "rooms."+section, roomsJSON); err != nil {
+			return nil, err
+		}
+	}
+	return json.RawMessage(resJSON), nil
+}
+
+// filterEvents returns the events which match the senders and types of the
+// filter, up to the filter's limit if one is set.
+func filterEvents(
+	events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.EventFilter,
+) []gomatrixserverlib.ClientEvent {
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(events))
+	for _, ev := range events {
+		if filter.Limit > 0 && len(filtered) == filter.Limit {
+			break
+		}
+		if internal.EventMatchesFilter(ev.Sender, ev.Type, filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
+// filterRoomEvents returns the events in the given room which match the rooms,
+// senders and types of the filter, up to the filter's limit if one is set.
+func filterRoomEvents(
+	roomID string, events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.RoomEventFilter,
+) []gomatrixserverlib.ClientEvent {
+	if !internal.RoomIncluded(roomID, filter.Rooms, filter.NotRooms) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	return filterEvents(events, &gomatrixserverlib.EventFilter{
+		Limit:      filter.Limit,
+		Senders:    filter.Senders,
+		NotSenders: filter.NotSenders,
+		Types:      filter.Types,
+		NotTypes:   filter.NotTypes,
+	})
+}
+
+// filterEventFields removes all but the given fields from the events in the
+// array at the given path of the JSON. Fields are dot-separated paths into the
+// event, e.g. "content.body", where a literal dot in a key is escaped with a
+// backslash. Events always have a content key, which is empty if it wasn't one
+// of the requested fields.
+func filterEventFields(j []byte, path string, fields []string) ([]byte, error) {
+	events := gjson.GetBytes(j, path)
+	if !events.IsArray() {
+		return j, nil
+	}
+	filtered := []byte("[]")
+	for _, event := range events.Array() {
+		var err error
+		eventJSON := []byte("{}")
+		for _, field := range fields {
+			value := event.Get(field)
+			if !value.Exists() {
+				continue
+			}
+			if eventJSON, err = sjson.SetRawBytes(eventJSON, field, []byte(value.Raw)); err != nil {
+				return nil, err
+			}
+		}
+		if !gjson.GetBytes(eventJSON, "content").Exists() {
+			if eventJSON, err = sjson.SetRawBytes(eventJSON, "content", []byte("{}")); err != nil {
+				return nil, err
+			}
+		}
+		if filtered, err = sjson.SetRawBytes(filtered, "-1", eventJSON); err != nil {
+			return nil, err
+		}
+	}
+	return sjson.SetRawBytes(j, path, filtered)
+}
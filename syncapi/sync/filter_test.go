@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestResponseJSONEventFields(t *testing.T) {
+	message := gomatrixserverlib.ClientEvent{
+		Content:        gomatrixserverlib.RawJSON(`{"body":"hello","msgtype":"m.text"}`),
+		EventID:        "$message:localhost",
+		OriginServerTS: 12345,
+		RoomID:         "!room:localhost",
+		Sender:         alice,
+		Type:           "m.room.message",
+	}
+	res := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{message}
+	res.Rooms.Join["!room:localhost"] = *jr
+	lr := types.NewLeaveResponse()
+	lr.Timeline.Events = []gomatrixserverlib.ClientEvent{message}
+	res.Rooms.Leave["!left.room:localhost"] = *lr
+	res.AccountData.Events = []gomatrixserverlib.ClientEvent{
+		{Type: "m.push_rules", Content: gomatrixserverlib.RawJSON(`{"global":{}}`)},
+	}
+
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.EventFields = []string{"type", "content.body"}
+	resJSON, err := responseJSON(res, &filter)
+	if err != nil {
+		t.Fatalf("responseJSON failed: %s", err)
+	}
+
+	var got struct {
+		AccountData struct {
+			Events []map[string]json.RawMessage `json:"events"`
+		} `json:"account_data"`
+		Rooms struct {
+			Join map[string]struct {
+				Timeline struct {
+					Events []map[string]json.RawMessage `json:"events"`
+				} `json:"timeline"`
+			} `json:"join"`
+			Leave map[string]struct {
+				Timeline struct {
+					Events []map[string]json.RawMessage `json:"events"`
+				} `json:"timeline"`
+			} `json:"leave"`
+		} `json:"rooms"`
+	}
+	raw, err := json.Marshal(resJSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if err = json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	events := map[string][]map[string]json.RawMessage{
+		"joined room":  got.Rooms.Join["!room:localhost"].Timeline.Events,
+		"left room":    got.Rooms.Leave["!left.room:localhost"].Timeline.Events,
+		"account data": got.AccountData.Events,
+	}
+	want := map[string]map[string]string{
+		"joined room":  {"type": `"m.room.message"`, "content": `{"body":"hello"}`},
+		"left room":    {"type": `"m.room.message"`, "content": `{"body":"hello"}`},
+		"account data": {"type": `"m.push_rules"`, "content": `{}`},
+	}
+	for name, evs := range events {
+		if len(evs) != 1 {
+			t.Errorf("%s: got %d events, want 1", name, len(evs))
+			continue
+		}
+		// the fields which weren't requested must be missing, rather than
+		// present with empty values
+		if len(evs[0]) != len(want[name]) {
+			t.Errorf("%s: got fields %v, want only %v", name, evs[0], want[name])
+		}
+		for field, value := range want[name] {
+			if string(evs[0][field]) != value {
+				t.Errorf("%s: got %s %s, want %s", name, field, evs[0][field], value)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// lazyLoadCacheTimeout is how long the lazy-loaded members of a device are
+// remembered after it last synced. A device which syncs again after this will
+// be sent the membership events again, which is wasteful but harmless.
+const lazyLoadCacheTimeout = 30 * time.Minute
+
+// lazyLoadCache keeps track of the membership events which have been sent to
+// each device by lazy-loading syncs, so that they don't need to be sent again
+// in later incremental syncs unless they change. Members only count as sent
+// once the device syncs from the position of the response they were sent in,
+// as the response may never have reached the device.
+type lazyLoadCache struct {
+	mu      sync.Mutex
+	devices map[lazyLoadDevice]*lazyLoadedMembers
+}
+
+type lazyLoadDevice struct {
+	userID   string
+	deviceID string
+}
+
+// lazyLoadRooms maps room ID -> user ID -> membership event ID
+type lazyLoadRooms map[string]map[string]string
+
+func (r lazyLoadRooms) add(roomID, memberID, eventID string) {
+	if r[roomID] == nil {
+		r[roomID] = make(map[string]string)
+	}
+	r[roomID][memberID] = eventID
+}
+
+type lazyLoadedMembers struct {
+	// The members which the device is known to have received.
+	rooms lazyLoadRooms
+	// The members sent in responses which the device hasn't synced from yet,
+	// keyed by the position of the response.
+	pending     map[types.StreamPosition]lazyLoadRooms
+	expiryTimer *time.Timer
+}
+
+func newLazyLoadCache() *lazyLoadCache {
+	return &lazyLoadCache{
+		devices: make(map[lazyLoadDevice]*lazyLoadedMembers),
+	}
+}
+
+// reset forgets all of the members which have been sent to the device, e.g.
+// because it is doing an initial sync.
+func (c *lazyLoadCache) reset(userID, deviceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := lazyLoadDevice{userID, deviceID}
+	if members, ok := c.devices[key]; ok {
+		members.expiryTimer.Stop()
+		delete(c.devices, key)
+	}
+}
+
+// acknowledge records that the device received the members which were sent
+// in the response at the given position. Members sent in any other response
+// are forgotten, as the device has moved on without them.
+func (c *lazyLoadCache) acknowledge(userID, deviceID string, pos types.StreamPosition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members, ok := c.devices[lazyLoadDevice{userID, deviceID}]
+	if !ok {
+		return
+	}
+	for roomID, sent := range members.pending[pos] {
+		for memberID, eventID := range sent {
+			members.rooms.add(roomID, memberID, eventID)
+		}
+	}
+	members.pending = make(map[types.StreamPosition]lazyLoadRooms)
+}
+
+// isSent returns true if the device is known to have received the given
+// membership event.
+func (c *lazyLoadCache) isSent(userID, deviceID, roomID, memberID, eventID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members, ok := c.devices[lazyLoadDevice{userID, deviceID}]
+	if !ok {
+		return false
+	}
+	return members.rooms[roomID][memberID] == eventID
+}
+
+// markSent remembers that the given membership event is being sent to the
+// device in the response at the given position. It isn't treated as sent until
+// the device acknowledges the response by syncing from that position.
+func (c *lazyLoadCache) markSent(userID, deviceID string, pos types.StreamPosition, roomID, memberID, eventID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := lazyLoadDevice{userID, deviceID}
+	members, ok := c.devices[key]
+	if !ok {
+		members = &lazyLoadedMembers{
+			rooms:   make(lazyLoadRooms),
+			pending: make(map[types.StreamPosition]lazyLoadRooms),
+		}
+		members.expiryTimer = time.AfterFunc(lazyLoadCacheTimeout, func() {
+			c.expire(key, members)
+		})
+		c.devices[key] = members
+	} else {
+		members.expiryTimer.Reset(lazyLoadCacheTimeout)
+	}
+	if members.pending[pos] == nil {
+		members.pending[pos] = make(lazyLoadRooms)
+	}
+	members.pending[pos].add(roomID, memberID, eventID)
+}
+
+func (c *lazyLoadCache) expire(key lazyLoadDevice, members *lazyLoadedMembers) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The entry might have been reset and replaced since the timer fired.
+	if c.devices[key] == members {
+		delete(c.devices, key)
+	}
+}
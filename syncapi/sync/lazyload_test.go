@@ -0,0 +1,91 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestLazyLoadCacheAcknowledge(t *testing.T) {
+	c := newLazyLoadCache()
+	c.markSent(alice, aliceDev, 12, roomID, bob, "$bob_join")
+	if c.isSent(alice, aliceDev, roomID, bob, "$bob_join") {
+		t.Fatalf("member was treated as sent before the response was acknowledged")
+	}
+
+	// Syncing from an older position, e.g. retrying a request whose response
+	// was lost, doesn't acknowledge the response.
+	c.acknowledge(alice, aliceDev, 11)
+	if c.isSent(alice, aliceDev, roomID, bob, "$bob_join") {
+		t.Fatalf("member was treated as sent after syncing from an older position")
+	}
+
+	c.markSent(alice, aliceDev, 12, roomID, bob, "$bob_join")
+	c.acknowledge(alice, aliceDev, 12)
+	if !c.isSent(alice, aliceDev, roomID, bob, "$bob_join") {
+		t.Fatalf("member wasn't treated as sent after the response was acknowledged")
+	}
+	if c.isSent(alice, aliceDev, roomID, bob, "$bob_rejoin") || c.isSent(bob, bobDev, roomID, bob, "$bob_join") {
+		t.Errorf("a different membership event or device was treated as sent")
+	}
+
+	c.reset(alice, aliceDev)
+	if c.isSent(alice, aliceDev, roomID, bob, "$bob_join") {
+		t.Errorf("member was treated as sent after the cache was reset")
+	}
+}
+
+func TestAppendLazyLoadedMembers(t *testing.T) {
+	rp := &RequestPool{lazyLoad: newLazyLoadCache()}
+	bobStateKey := bob
+
+	doSync := func(since, next types.StreamingToken) []gomatrixserverlib.ClientEvent {
+		t.Helper()
+		req := newTestSyncRequest(alice, aliceDev, since)
+		req.filter.Room.State.LazyLoadMembers = true
+		data := types.NewResponse()
+		data.NextBatch = next.String()
+		jr := types.NewJoinResponse()
+		jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+			{EventID: "$message", Type: "m.room.message", Sender: bob},
+		}
+		jr.State.Events = []gomatrixserverlib.ClientEvent{
+			{EventID: "$bob_join", Type: gomatrixserverlib.MRoomMember, Sender: bob, StateKey: &bobStateKey},
+		}
+		data.Rooms.Join[roomID] = *jr
+		res, err := rp.appendLazyLoadedMembers(data, req)
+		if err != nil {
+			t.Fatalf("appendLazyLoadedMembers returned error: %s", err)
+		}
+		return res.Rooms.Join[roomID].State.Events
+	}
+
+	if state := doSync(syncPositionBefore, syncPositionAfter); len(state) != 1 {
+		t.Fatalf("got state %+v, want bob's membership", state)
+	}
+	// The client retries from the same position as it didn't get the
+	// response, so the membership must be sent again.
+	if state := doSync(syncPositionBefore, syncPositionAfter); len(state) != 1 {
+		t.Fatalf("got state %+v after retrying, want bob's membership again", state)
+	}
+	// Syncing from the next batch acknowledges the membership, so it isn't
+	// sent again.
+	if state := doSync(syncPositionAfter, syncPositionAfter2); len(state) != 0 {
+		t.Fatalf("got state %+v after acknowledging, want none", state)
+	}
+}
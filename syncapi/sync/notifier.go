@@ -33,6 +33,8 @@ import (
 type Notifier struct {
 	// A map of RoomID => Set<UserID> : Must only be accessed by the OnNewEvent goroutine
 	roomIDToJoinedUsers map[string]userIDSet
+	// A map of RoomID => Set<PeekingDevice> : Must only be accessed with streamLock held
+	roomIDToPeekingDevices map[string]peekingDeviceSet
 	// Protects currPos and userStreams.
 	streamLock *sync.Mutex
 	// The latest sync position
@@ -48,11 +50,12 @@ type Notifier struct {
 // the joined users within each of them by calling Notifier.Load(*storage.SyncServerDatabase).
 func NewNotifier(pos types.StreamingToken) *Notifier {
 	return &Notifier{
-		currPos:             pos,
-		roomIDToJoinedUsers: make(map[string]userIDSet),
-		userDeviceStreams:   make(map[string]map[string]*UserDeviceStream),
-		streamLock:          &sync.Mutex{},
-		lastCleanUpTime:     time.Now(),
+		currPos:                pos,
+		roomIDToJoinedUsers:    make(map[string]userIDSet),
+		roomIDToPeekingDevices: make(map[string]peekingDeviceSet),
+		userDeviceStreams:      make(map[string]map[string]*UserDeviceStream),
+		streamLock:             &sync.Mutex{},
+		lastCleanUpTime:        time.Now(),
 	}
 }
 
@@ -100,6 +103,8 @@ func (n *Notifier) OnNewEvent(
 					// along all members in the room
 					usersToNotify = append(usersToNotify, targetUserID)
 					n.addJoinedUser(ev.RoomID(), targetUserID)
+					// The user's devices stop peeking once they've joined.
+					n.removePeekingUser(ev.RoomID(), targetUserID)
 				case gomatrixserverlib.Leave:
 					fallthrough
 				case gomatrixserverlib.Ban:
@@ -109,8 +114,10 @@ func (n *Notifier) OnNewEvent(
 		}
 
 		n.wakeupUsers(usersToNotify, latestPos)
+		n.wakeupPeekingDevices(ev.RoomID(), latestPos)
 	} else if roomID != "" {
 		n.wakeupUsers(n.joinedUsers(roomID), latestPos)
+		n.wakeupPeekingDevices(roomID, latestPos)
 	} else if len(userIDs) > 0 {
 		n.wakeupUsers(userIDs, latestPos)
 	} else {
@@ -120,6 +127,44 @@ func (n *Notifier) OnNewEvent(
 	}
 }
 
+// OnNewPeek is called when a device starts peeking into a room, so that new
+// events in the room wake up the /sync requests of the device.
+func (n *Notifier) OnNewPeek(
+	roomID, userID, deviceID string,
+	posUpdate types.StreamingToken,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	// The device may already have been peeking into the room, in which case
+	// the position of the peek is older than the current position.
+	if posUpdate.IsAfter(n.currPos) {
+		n.currPos = n.currPos.WithUpdates(posUpdate)
+	}
+
+	n.addPeekingDevice(roomID, userID, deviceID)
+	n.wakeupUserDevice(userID, []string{deviceID}, n.currPos)
+}
+
+// OnRetirePeek is called when a device stops peeking into a room, so that new
+// events in the room no longer wake up the /sync requests of the device.
+func (n *Notifier) OnRetirePeek(roomID, userID, deviceID string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	n.removePeekingDevice(roomID, userID, deviceID)
+}
+
+// OnDeletedDevices is called when devices of a user are logged out, so that
+// they are no longer woken up for the rooms which they were peeking into.
+func (n *Notifier) OnDeletedDevices(userID string, deviceIDs []string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	for roomID := range n.roomIDToPeekingDevices {
+		for _, deviceID := range deviceIDs {
+			n.removePeekingDevice(roomID, userID, deviceID)
+		}
+	}
+}
+
 func (n *Notifier) OnNewSendToDevice(
 	userID string, deviceIDs []string,
 	posUpdate types.StreamingToken,
@@ -151,9 +196,6 @@ func (n *Notifier) GetListener(req syncRequest) UserDeviceStreamListener {
 	// - Incoming events wake requests for a matching room ID
 	// - Incoming events wake requests for a matching user ID (needed for invites)
 
-	// TODO: v1 /events 'peeking' has an 'explicit room ID' which is also tracked,
-	//       but given we don't do /events, let's pretend it doesn't exist.
-
 	n.streamLock.Lock()
 	defer n.streamLock.Unlock()
 
@@ -169,6 +211,12 @@ func (n *Notifier) Load(ctx context.Context, db storage.Database) error {
 		return err
 	}
 	n.setUsersJoinedToRooms(roomToUsers)
+
+	roomToPeekingDevices, err := db.AllPeekingDevicesInRooms(ctx)
+	if err != nil {
+		return err
+	}
+	n.setPeekingDevices(roomToPeekingDevices)
 	return nil
 }
 
@@ -195,6 +243,18 @@ func (n *Notifier) setUsersJoinedToRooms(roomIDToUserIDs map[string][]string) {
 	}
 }
 
+// setPeekingDevices marks the given devices as peeking into the given rooms, such that new events from
+// these rooms will wake the given devices /sync requests. This should be called prior to ANY calls to
+// OnNewEvent (eg on startup) to prevent racing.
+func (n *Notifier) setPeekingDevices(roomIDToPeekingDevices map[string][]types.PeekingDevice) {
+	// This is just the bulk form of addPeekingDevice
+	for roomID, devices := range roomIDToPeekingDevices {
+		for _, device := range devices {
+			n.addPeekingDevice(roomID, device.UserID, device.DeviceID)
+		}
+	}
+}
+
 // wakeupUsers will wake up the sync strems for all of the devices for all of the
 // specified user IDs.
 func (n *Notifier) wakeupUsers(userIDs []string, newPos types.StreamingToken) {
@@ -208,9 +268,16 @@ func (n *Notifier) wakeupUsers(userIDs []string, newPos types.StreamingToken) {
 	}
 }
 
+// wakeupPeekingDevices will wake up the sync streams of all of the devices
+// which are peeking into the given room.
+func (n *Notifier) wakeupPeekingDevices(roomID string, newPos types.StreamingToken) {
+	for device := range n.roomIDToPeekingDevices[roomID] {
+		n.wakeupUserDevice(device.UserID, []string{device.DeviceID}, newPos)
+	}
+}
+
 // wakeupUserDevice will wake up the sync stream for a specific user device. Other
 // device streams will be left alone.
-// nolint:unused
 func (n *Notifier) wakeupUserDevice(userID string, deviceIDs []string, newPos types.StreamingToken) {
 	for _, deviceID := range deviceIDs {
 		if stream := n.fetchUserDeviceStream(userID, deviceID, false); stream != nil {
@@ -276,6 +343,35 @@ func (n *Notifier) removeJoinedUser(roomID, userID string) {
 	n.roomIDToJoinedUsers[roomID].remove(userID)
 }
 
+// NB: Callers should have locked the mutex before calling this function.
+func (n *Notifier) addPeekingDevice(roomID, userID, deviceID string) {
+	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
+		n.roomIDToPeekingDevices[roomID] = make(peekingDeviceSet)
+	}
+	n.roomIDToPeekingDevices[roomID][types.PeekingDevice{UserID: userID, DeviceID: deviceID}] = true
+}
+
+// NB: Callers should have locked the mutex before calling this function.
+func (n *Notifier) removePeekingDevice(roomID, userID, deviceID string) {
+	devices, ok := n.roomIDToPeekingDevices[roomID]
+	if !ok {
+		return
+	}
+	delete(devices, types.PeekingDevice{UserID: userID, DeviceID: deviceID})
+	if len(devices) == 0 {
+		delete(n.roomIDToPeekingDevices, roomID)
+	}
+}
+
+// NB: Callers should have locked the mutex before calling this function.
+func (n *Notifier) removePeekingUser(roomID, userID string) {
+	for device := range n.roomIDToPeekingDevices[roomID] {
+		if device.UserID == userID {
+			n.removePeekingDevice(roomID, userID, device.DeviceID)
+		}
+	}
+}
+
 // Not thread-safe: must be called on the OnNewEvent goroutine only
 func (n *Notifier) joinedUsers(roomID string) (userIDs []string) {
 	if _, ok := n.roomIDToJoinedUsers[roomID]; !ok {
@@ -329,3 +425,6 @@ func (s userIDSet) values() (vals []string) {
 	}
 	return
 }
+
+// A set of devices which are peeking into a room.
+type peekingDeviceSet map[types.PeekingDevice]bool
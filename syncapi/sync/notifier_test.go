@@ -230,6 +230,56 @@ func TestEDUWakeup(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that a receipt in a room wakes up the users joined to the room.
+func TestReceiptWakeup(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice, bob},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestReceiptWakeup error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(stream, 1)
+
+	n.OnNewEvent(nil, roomID, nil, syncPositionAfter)
+
+	wg.Wait()
+}
+
+// Test that a presence update wakes up the users who share a room with the
+// user, as given by the presence consumer.
+func TestPresenceWakeup(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestPresenceWakeup error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(stream, 1)
+
+	n.OnNewEvent(nil, "", []string{alice, bob}, syncPositionAfter)
+
+	wg.Wait()
+}
+
 // Test that all blocked requests get woken up on a new event.
 func TestMultipleRequestWakeup(t *testing.T) {
 	n := NewNotifier(syncPositionBefore)
@@ -322,6 +372,58 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	time.Sleep(1 * time.Millisecond)
 }
 
+// Test that devices stop being woken up for a room once they stop peeking into
+// it, whether that's by unpeeking, joining the room or being logged out.
+func TestPeekingDevicesRemoved(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	otherRoomID := "!other:localhost"
+	bobDev2 := "bobdev2"
+	n.OnNewPeek(roomID, alice, aliceDev, syncPositionBefore)
+	n.OnNewPeek(roomID, bob, bobDev, syncPositionBefore)
+	n.OnNewPeek(roomID, bob, bobDev2, syncPositionBefore)
+	n.OnNewPeek(otherRoomID, bob, bobDev, syncPositionBefore)
+
+	peeking := func(roomID, userID, deviceID string) bool {
+		n.streamLock.Lock()
+		defer n.streamLock.Unlock()
+		return n.roomIDToPeekingDevices[roomID][types.PeekingDevice{UserID: userID, DeviceID: deviceID}]
+	}
+
+	n.OnRetirePeek(roomID, alice, aliceDev)
+	if peeking(roomID, alice, aliceDev) {
+		t.Errorf("%s is still peeking into %s after unpeeking", aliceDev, roomID)
+	}
+
+	var bobJoinEvent gomatrixserverlib.HeaderedEvent
+	if err := json.Unmarshal([]byte(`{
+		"_room_version": "1",
+		"type": "m.room.member",
+		"state_key": "`+bob+`",
+		"content": {
+			"membership": "join"
+		},
+		"sender": "`+bob+`",
+		"room_id": "`+roomID+`",
+		"origin": "localhost",
+		"origin_server_ts": 12345,
+		"event_id": "$bobJoinEvent:localhost"
+	}`), &bobJoinEvent); err != nil {
+		t.Fatalf("failed to unmarshal join event: %s", err)
+	}
+	n.OnNewEvent(&bobJoinEvent, "", nil, syncPositionAfter)
+	if peeking(roomID, bob, bobDev) || peeking(roomID, bob, bobDev2) {
+		t.Errorf("%s's devices are still peeking into %s after joining it", bob, roomID)
+	}
+	if !peeking(otherRoomID, bob, bobDev) {
+		t.Errorf("%s stopped peeking into %s after joining a different room", bobDev, otherRoomID)
+	}
+
+	n.OnDeletedDevices(bob, []string{bobDev})
+	if peeking(otherRoomID, bob, bobDev) {
+		t.Errorf("%s is still peeking into %s after being logged out", bobDev, otherRoomID)
+	}
+}
+
 func waitForEvents(n *Notifier, req syncRequest) (types.StreamingToken, error) {
 	listener := n.GetListener(req)
 	defer listener.Close()
@@ -363,7 +465,6 @@ func newTestSyncRequest(userID, deviceID string, since types.StreamingToken) syn
 		timeout:       1 * time.Minute,
 		since:         &since,
 		wantFullState: false,
-		limit:         DefaultTimelineLimit,
 		log:           util.GetLogger(context.TODO()),
 		ctx:           context.TODO(),
 	}
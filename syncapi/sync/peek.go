@@ -0,0 +1,291 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The maximum number of events returned by /events and /rooms/{roomID}/initialSync.
+const defaultPeekLimit = 20
+
+type eventsResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+type roomInitialSyncResponse struct {
+	RoomID      string                          `json:"room_id"`
+	Membership  string                          `json:"membership,omitempty"`
+	Messages    eventsResponse                  `json:"messages"`
+	State       []gomatrixserverlib.ClientEvent `json:"state"`
+	Presence    []gomatrixserverlib.ClientEvent `json:"presence"`
+	Receipts    []gomatrixserverlib.ClientEvent `json:"receipts"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+// OnIncomingEventsRequest implements GET /events. Only peeking into a single
+// room with ?room_id= is supported: the device starts peeking into the room,
+// which must be world readable if the user isn't joined to it, and the request
+// blocks until there are new events in the room or it times out.
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-events
+func (rp *RequestPool) OnIncomingEventsRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	ctx := req.Context()
+	roomID := req.URL.Query().Get("room_id")
+	currPos := rp.notifier.CurrentPosition()
+	fromPos := currPos
+	if from := req.URL.Query().Get("from"); from != "" {
+		var err error
+		fromPos, err = types.NewStreamTokenFromString(from)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err.Error()),
+			}
+		}
+	}
+
+	if roomID == "" {
+		// Streaming the events of all joined rooms has been superseded by
+		// /sync, so we don't send anything down here.
+		if device.AccountType == userapi.AccountTypeGuest {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guests can only peek into rooms with /events?room_id="),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: eventsResponse{
+				Chunk: []gomatrixserverlib.ClientEvent{},
+				Start: fromPos.String(),
+				End:   fromPos.String(),
+			},
+		}
+	}
+
+	if resErr := rp.peekIntoRoom(ctx, roomID, device); resErr != nil {
+		return *resErr
+	}
+
+	timer := time.NewTimer(getTimeout(req.URL.Query().Get("timeout")))
+	defer timer.Stop()
+
+	userStreamListener := rp.notifier.GetListener(syncRequest{ctx: ctx, device: *device})
+	defer userStreamListener.Close()
+
+	// As with /sync, loop until there are events to send down or the request
+	// times out, as the listener may be woken up by other kinds of updates.
+	var hasTimedOut bool
+	sincePos := fromPos
+	for {
+		currPos = rp.notifier.CurrentPosition()
+		streamEvents, err := rp.db.GetEventsInStreamingRange(ctx, &fromPos, &currPos, roomID, defaultPeekLimit, false)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.db.GetEventsInStreamingRange failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(streamEvents) > 0 || hasTimedOut {
+			endPos := currPos
+			if len(streamEvents) > 0 {
+				// If the limit was reached, the next request should pick up
+				// from the last event that we sent down.
+				endPos = types.NewStreamToken(
+					streamEvents[len(streamEvents)-1].StreamPosition, currPos.EDUPosition(), nil,
+				)
+			}
+			events := rp.db.StreamEventsToEvents(device, streamEvents)
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: eventsResponse{
+					Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+					Start: fromPos.String(),
+					End:   endPos.String(),
+				},
+			}
+		}
+
+		select {
+		// Wait for notifier to wake us up
+		case <-userStreamListener.GetNotifyChannel(sincePos):
+			sincePos = userStreamListener.GetSyncPosition()
+		// Or for timeout to expire
+		case <-timer.C:
+			hasTimedOut = true
+		// Or for the request to be cancelled
+		case <-ctx.Done():
+			return jsonerror.InternalServerError()
+		}
+	}
+}
+
+// OnIncomingRoomInitialSyncRequest implements GET /rooms/{roomID}/initialSync.
+// If the user isn't joined to the room then the room must be world readable,
+// and the device starts peeking into it so that it is sent down /sync.
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-initialsync
+func (rp *RequestPool) OnIncomingRoomInitialSyncRequest(
+	req *http.Request, device *userapi.Device, roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	if resErr := rp.peekIntoRoom(ctx, roomID, device); resErr != nil {
+		return *resErr
+	}
+
+	currPos := rp.notifier.CurrentPosition()
+	zeroPos := types.NewStreamToken(0, 0, nil)
+	streamEvents, err := rp.db.GetEventsInStreamingRange(ctx, &currPos, &zeroPos, roomID, defaultPeekLimit, true)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.GetEventsInStreamingRange failed")
+		return jsonerror.InternalServerError()
+	}
+	// The events come back most recent first, but are sent down in
+	// chronological order.
+	for i, j := 0, len(streamEvents)-1; i < j; i, j = i+1, j-1 {
+		streamEvents[i], streamEvents[j] = streamEvents[j], streamEvents[i]
+	}
+	recentEvents := rp.db.StreamEventsToEvents(device, streamEvents)
+
+	// The start token points to just before the oldest event, so that it can
+	// be used to paginate backwards with /messages.
+	start := currPos.String()
+	if len(recentEvents) > 0 {
+		var startPos types.TopologyToken
+		startPos, err = rp.db.EventPositionInTopology(ctx, recentEvents[0].EventID())
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.db.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+		startPos.Decrement()
+		start = startPos.String()
+	}
+
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateEvents, err := rp.db.GetStateEventsForRoom(ctx, roomID, &stateFilter)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.GetStateEventsForRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomInitialSyncResponse{
+		RoomID: roomID,
+		Messages: eventsResponse{
+			Chunk: gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatAll),
+			Start: start,
+			End:   currPos.String(),
+		},
+		State:       gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll),
+		Presence:    []gomatrixserverlib.ClientEvent{},
+		Receipts:    []gomatrixserverlib.ClientEvent{},
+		AccountData: []gomatrixserverlib.ClientEvent{},
+	}
+	for _, ev := range stateEvents {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(device.UserID) {
+			res.Membership, _ = ev.Membership()
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// OnIncomingUnpeekRequest implements POST /rooms/{roomID}/unpeek, which stops
+// the device peeking into the room so that it is no longer sent down /sync.
+// https://github.com/matrix-org/matrix-doc/pull/2753
+func (rp *RequestPool) OnIncomingUnpeekRequest(
+	req *http.Request, device *userapi.Device, roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	if err := rp.db.DeletePeek(ctx, roomID, device.UserID, device.ID); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.DeletePeek failed")
+		return jsonerror.InternalServerError()
+	}
+	rp.notifier.OnRetirePeek(roomID, device.UserID, device.ID)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// peekIntoRoom checks that the user is allowed to see the events in the room,
+// i.e. that they are joined to it or that it is world readable. If the user
+// isn't joined then the device starts peeking into the room.
+func (rp *RequestPool) peekIntoRoom(
+	ctx context.Context, roomID string, device *userapi.Device,
+) *util.JSONResponse {
+	memberEv, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.GetStateEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if memberEv != nil {
+		if membership, _ := memberEv.Membership(); membership == gomatrixserverlib.Join {
+			return nil
+		}
+	}
+
+	historyEv, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.GetStateEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var content eventutil.HistoryVisibilityContent
+	if historyEv != nil {
+		_ = json.Unmarshal(historyEv.Content(), &content)
+	}
+	if content.HistoryVisibility != "world_readable" {
+		// TODO: Peek into rooms on other servers over federation.
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to peek into room " + roomID),
+		}
+	}
+	if device.AccountType == userapi.AccountTypeGuest {
+		allowed, gerr := rp.guestAccessAllowed(ctx, roomID)
+		if gerr != nil {
+			util.GetLogger(ctx).WithError(gerr).Error("rp.guestAccessAllowed failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		if !allowed {
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guest access is not enabled in room " + roomID),
+			}
+		}
+	}
+
+	pos, err := rp.db.AddPeek(ctx, roomID, device.UserID, device.ID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.AddPeek failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	rp.notifier.OnNewPeek(roomID, device.UserID, device.ID, types.NewStreamToken(pos, 0, nil))
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// presenceIdleTimeout is how long a user can go without syncing before they
+// are marked as unavailable.
+const presenceIdleTimeout = 5 * time.Minute
+
+// presenceTracker keeps track of the presence of users who are syncing, so that
+// they can be marked as online when they sync and as unavailable when they stop.
+type presenceTracker struct {
+	eduAPI eduAPI.EDUServerInputAPI
+	mu     sync.Mutex
+	users  map[string]*syncingUser
+}
+
+type syncingUser struct {
+	presence   string
+	lastActive time.Time
+	idleTimer  *time.Timer
+}
+
+func newPresenceTracker(eduAPI eduAPI.EDUServerInputAPI) *presenceTracker {
+	return &presenceTracker{
+		eduAPI: eduAPI,
+		users:  make(map[string]*syncingUser),
+	}
+}
+
+// onSync is called whenever a user makes a /sync request with the given
+// set_presence value. The presence of the user is only updated if it has
+// changed, but the idle timeout is restarted on every request.
+func (t *presenceTracker) onSync(userID, setPresence string) {
+	if setPresence == "" {
+		setPresence = eduAPI.PresenceOnline
+	}
+	// A client syncing with set_presence=offline doesn't want to affect
+	// the presence of the user at all.
+	if setPresence == eduAPI.PresenceOffline {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	user, ok := t.users[userID]
+	if !ok {
+		user = &syncingUser{}
+		user.idleTimer = time.AfterFunc(presenceIdleTimeout, func() {
+			t.onIdle(userID)
+		})
+		t.users[userID] = user
+	} else {
+		user.idleTimer.Reset(presenceIdleTimeout)
+	}
+	user.lastActive = now
+	changed := user.presence != setPresence
+	user.presence = setPresence
+	t.mu.Unlock()
+
+	if changed {
+		t.setPresence(userID, setPresence, now)
+	}
+}
+
+// onIdle is called when a user hasn't synced for presenceIdleTimeout.
+func (t *presenceTracker) onIdle(userID string) {
+	t.mu.Lock()
+	user, ok := t.users[userID]
+	if ok {
+		delete(t.users, userID)
+	}
+	t.mu.Unlock()
+
+	if ok && user.presence == eduAPI.PresenceOnline {
+		t.setPresence(userID, eduAPI.PresenceUnavailable, user.lastActive)
+	}
+}
+
+func (t *presenceTracker) setPresence(userID, presence string, lastActive time.Time) {
+	err := eduAPI.SetPresence(
+		context.Background(), t.eduAPI, userID, presence, nil,
+		gomatrixserverlib.AsTimestamp(lastActive),
+	)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to set presence")
+	}
+}
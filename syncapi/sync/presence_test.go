@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+)
+
+// mockEDUAPI records the presence updates sent to it, and panics if anything
+// other than presence is sent.
+type mockEDUAPI struct {
+	eduAPI.EDUServerInputAPI
+	mu        sync.Mutex
+	presences []eduAPI.InputPresenceEvent
+}
+
+func (e *mockEDUAPI) InputPresenceEvent(
+	ctx context.Context, req *eduAPI.InputPresenceEventRequest, res *eduAPI.InputPresenceEventResponse,
+) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.presences = append(e.presences, req.InputPresenceEvent)
+	return nil
+}
+
+func (e *mockEDUAPI) sent() []eduAPI.InputPresenceEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]eduAPI.InputPresenceEvent{}, e.presences...)
+}
+
+func TestPresenceTrackerOnSync(t *testing.T) {
+	edu := &mockEDUAPI{}
+	tracker := newPresenceTracker(edu)
+
+	// The first sync marks the user as online, but syncing again with the
+	// same presence doesn't send another update.
+	tracker.onSync(alice, "")
+	tracker.onSync(alice, eduAPI.PresenceOnline)
+	// Syncing with set_presence=offline doesn't affect the presence at all.
+	tracker.onSync(bob, eduAPI.PresenceOffline)
+	tracker.onSync(alice, eduAPI.PresenceUnavailable)
+
+	sent := edu.sent()
+	if len(sent) != 2 {
+		t.Fatalf("got %d presence updates, want 2: %+v", len(sent), sent)
+	}
+	if sent[0].UserID != alice || sent[0].Presence != eduAPI.PresenceOnline {
+		t.Errorf("got first update %+v, want %s online", sent[0], alice)
+	}
+	if sent[1].UserID != alice || sent[1].Presence != eduAPI.PresenceUnavailable {
+		t.Errorf("got second update %+v, want %s unavailable", sent[1], alice)
+	}
+}
+
+func TestPresenceTrackerOnIdle(t *testing.T) {
+	edu := &mockEDUAPI{}
+	tracker := newPresenceTracker(edu)
+
+	tracker.onSync(alice, eduAPI.PresenceOnline)
+	tracker.onSync(bob, eduAPI.PresenceUnavailable)
+	tracker.onIdle(alice)
+	tracker.onIdle(bob)
+
+	// Only online users are marked as unavailable when they go idle, with the
+	// time of their last sync as the last active time.
+	sent := edu.sent()
+	if len(sent) != 3 {
+		t.Fatalf("got %d presence updates, want 3: %+v", len(sent), sent)
+	}
+	if sent[2].UserID != alice || sent[2].Presence != eduAPI.PresenceUnavailable {
+		t.Errorf("got idle update %+v, want %s unavailable", sent[2], alice)
+	}
+	if sent[2].LastActiveTS != sent[0].LastActiveTS {
+		t.Errorf("got last active %d when idle, want %d", sent[2].LastActiveTS, sent[0].LastActiveTS)
+	}
+
+	// Syncing again after going idle marks the user as online again.
+	tracker.onSync(alice, eduAPI.PresenceOnline)
+	if sent = edu.sent(); len(sent) != 4 || sent[3].Presence != eduAPI.PresenceOnline {
+		t.Errorf("want %s online after syncing again, got %+v", alice, sent)
+	}
+}
@@ -17,37 +17,33 @@ package sync
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 const defaultSyncTimeout = time.Duration(0)
 const DefaultTimelineLimit = 20
 
-type filter struct {
-	Room struct {
-		Timeline struct {
-			Limit *int `json:"limit"`
-		} `json:"timeline"`
-	} `json:"room"`
-}
-
 // syncRequest represents a /sync request, with sensible defaults/sanity checks applied.
 type syncRequest struct {
 	ctx           context.Context
 	device        userapi.Device
-	limit         int
+	filter        gomatrixserverlib.Filter
 	timeout       time.Duration
 	since         *types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
+	setPresence   string
 	log           *log.Entry
 }
 
@@ -68,16 +64,20 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		tok := types.NewStreamToken(0, 0, nil)
 		since = &tok
 	}
-	timelineLimit := DefaultTimelineLimit
-	// TODO: read from stored filters too
+	filter := gomatrixserverlib.Filter{}
+	filter.Room.Timeline.Limit = DefaultTimelineLimit
 	filterQuery := req.URL.Query().Get("filter")
 	if filterQuery != "" {
 		if filterQuery[0] == '{' {
-			// attempt to parse the timeline limit at least
-			var f filter
-			err := json.Unmarshal([]byte(filterQuery), &f)
-			if err == nil && f.Room.Timeline.Limit != nil {
-				timelineLimit = *f.Room.Timeline.Limit
+			// the filter is given inline in the request
+			filter = gomatrixserverlib.Filter{}
+			if err := json.Unmarshal([]byte(filterQuery), &filter); err != nil {
+				return nil, fmt.Errorf("invalid filter: %w", err)
+			}
+			// the timeline limit defaults to 0 if it is not set, so use the default limit
+			// instead in the same way as when a filter is uploaded
+			if !gjson.Get(filterQuery, "room.timeline.limit").Exists() {
+				filter.Room.Timeline.Limit = DefaultTimelineLimit
 			}
 		} else {
 			// attempt to load the filter ID
@@ -88,18 +88,29 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			}
 			f, err := syncDB.GetFilter(req.Context(), localpart, filterQuery)
 			if err == nil {
-				timelineLimit = f.Room.Timeline.Limit
+				filter = *f
 			}
 		}
 	}
-	// TODO: Additional query params: set_presence, filter
+	// The state filter is passed to the database as-is, which limits the number of state
+	// events returned for each room, so don't let an unset limit hide the room state.
+	if filter.Room.State.Limit == 0 {
+		filter.Room.State.Limit = gomatrixserverlib.DefaultStateFilter().Limit
+	}
+	setPresence := req.URL.Query().Get("set_presence")
+	switch setPresence {
+	case "", eduAPI.PresenceOnline, eduAPI.PresenceUnavailable, eduAPI.PresenceOffline:
+	default:
+		return nil, fmt.Errorf("invalid set_presence value %q", setPresence)
+	}
 	return &syncRequest{
 		ctx:           req.Context(),
 		device:        device,
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         timelineLimit,
+		setPresence:   setPresence,
+		filter:        filter,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
@@ -18,12 +18,17 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -40,14 +45,18 @@ type RequestPool struct {
 	notifier *Notifier
 	keyAPI   keyapi.KeyInternalAPI
 	stateAPI currentstateAPI.CurrentStateInternalAPI
+	rsAPI    roomserverAPI.RoomserverInternalAPI
+	presence *presenceTracker
+	lazyLoad *lazyLoadCache
 }
 
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(
 	db storage.Database, n *Notifier, userAPI userapi.UserInternalAPI, keyAPI keyapi.KeyInternalAPI,
-	stateAPI currentstateAPI.CurrentStateInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	eduAPI eduAPI.EDUServerInputAPI,
 ) *RequestPool {
-	return &RequestPool{db, userAPI, n, keyAPI, stateAPI}
+	return &RequestPool{db, userAPI, n, keyAPI, stateAPI, rsAPI, newPresenceTracker(eduAPI), newLazyLoadCache()}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -65,12 +74,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 		}
 	}
 
+	rp.presence.onSync(device.UserID, syncReq.setPresence)
+
 	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
 		"user_id":   device.UserID,
 		"device_id": device.ID,
 		"since":     syncReq.since,
 		"timeout":   syncReq.timeout,
-		"limit":     syncReq.limit,
+		"limit":     syncReq.filter.Room.Timeline.Limit,
 	})
 
 	currPos := rp.notifier.CurrentPosition()
@@ -82,9 +93,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			return jsonerror.InternalServerError()
 		}
 		logger.WithField("next", syncData.NextBatch).Info("Responding immediately")
+		resJSON, err := responseJSON(syncData, &syncReq.filter)
+		if err != nil {
+			logger.WithError(err).Error("responseJSON failed")
+			return jsonerror.InternalServerError()
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: syncData,
+			JSON: resJSON,
 		}
 	}
 
@@ -135,9 +151,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 
 		if !syncData.IsEmpty() || hasTimedOut {
 			logger.WithField("next", syncData.NextBatch).WithField("timed_out", hasTimedOut).Info("Responding")
+			resJSON, err := responseJSON(syncData, &syncReq.filter)
+			if err != nil {
+				logger.WithError(err).Error("responseJSON failed")
+				return jsonerror.InternalServerError()
+			}
 			return util.JSONResponse{
 				Code: http.StatusOK,
-				JSON: syncData,
+				JSON: resJSON,
 			}
 		}
 	}
@@ -167,8 +188,11 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 		}
 	}
 	// work out room joins/leaves
+	filter := gomatrixserverlib.Filter{}
+	filter.Room.Timeline.Limit = 10
+	filter.Room.State = gomatrixserverlib.DefaultStateFilter()
 	res, err := rp.db.IncrementalSync(
-		req.Context(), types.NewResponse(), *device, fromToken, toToken, 10, false,
+		req.Context(), types.NewResponse(), *device, fromToken, toToken, &filter, false,
 	)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("Failed to IncrementalSync")
@@ -209,15 +233,45 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 
 	// TODO: handle ignored users
 	if req.since == nil {
-		res, err = rp.db.CompleteSync(req.ctx, res, req.device, req.limit)
+		res, err = rp.db.CompleteSync(req.ctx, res, req.device, &req.filter)
 	} else {
-		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, *req.since, latestPos, req.limit, req.wantFullState)
+		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, *req.since, latestPos, &req.filter, req.wantFullState)
 	}
 	if err != nil {
 		return res, err
 	}
 
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
+	if req.device.AccountType == userapi.AccountTypeGuest {
+		res, err = rp.filterGuestAccess(res, req)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// Remove the timeline events which the user isn't allowed to see before
+	// lazy-loading, so that we don't load the members of their senders.
+	res, err = rp.filterHistoryVisibility(res, req)
+	if err != nil {
+		return res, err
+	}
+
+	if req.since == nil && req.filter.Room.IncludeLeave {
+		res, err = rp.appendLeftRoomState(res, req)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if req.filter.Room.State.LazyLoadMembers {
+		res, err = rp.appendLazyLoadedMembers(res, req)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// The account data filters from the request are applied by filterResponse, as
+	// global and room account data are filtered separately.
+	accountDataFilter := gomatrixserverlib.DefaultEventFilter()
 	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition(), &accountDataFilter)
 	if err != nil {
 		return res, err
@@ -226,10 +280,19 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 	if err != nil {
 		return res, err
 	}
+	res, err = rp.appendPresence(req.ctx, res, req.device.UserID, since, latestPos)
+	if err != nil {
+		return res, err
+	}
+	res, err = rp.appendUnreadNotifications(req.ctx, res, req.device.UserID, since, latestPos)
+	if err != nil {
+		return res, err
+	}
 	err = internal.DeviceOTKCounts(req.ctx, rp.keyAPI, req.device.UserID, req.device.ID, res)
 	if err != nil {
 		return res, err
 	}
+	filterResponse(res, &req.filter)
 
 	// Before we return the sync response, make sure that we take action on
 	// any send-to-device database updates or deletions that we need to do.
@@ -261,11 +324,379 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 func (rp *RequestPool) appendDeviceLists(
 	data *types.Response, userID string, since, to types.StreamingToken,
 ) (*types.Response, error) {
-	_, err := internal.DeviceListCatchup(context.Background(), rp.keyAPI, rp.stateAPI, userID, data, since, to)
+	_, err := internal.DeviceListCatchup(context.Background(), rp.db, rp.keyAPI, rp.stateAPI, userID, data, since, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// appendPresence adds the presence of the user and of all of the users who
+// share a room with them, where it has changed since the given position.
+func (rp *RequestPool) appendPresence(
+	ctx context.Context, data *types.Response, userID string, since, to types.StreamingToken,
+) (*types.Response, error) {
+	r := types.Range{
+		From: since.PDUPosition(),
+		To:   to.PDUPosition(),
+	}
+	if r.From == r.To {
+		return data, nil
+	}
+
+	var queryRes currentstateAPI.QuerySharedUsersResponse
+	err := rp.stateAPI.QuerySharedUsers(ctx, &currentstateAPI.QuerySharedUsersRequest{
+		UserID: userID,
+	}, &queryRes)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := []string{userID}
+	for sharedUserID := range queryRes.UserIDsToCount {
+		if sharedUserID != userID {
+			userIDs = append(userIDs, sharedUserID)
+		}
+	}
+
+	presences, err := rp.db.GetPresenceInRange(ctx, userIDs, r)
+	if err != nil {
+		return nil, err
+	}
+	for _, presence := range presences {
+		ev := gomatrixserverlib.ClientEvent{
+			Type:   "m.presence",
+			Sender: presence.UserID,
+		}
+		ev.Content, err = json.Marshal(presence.ToPresenceContent())
+		if err != nil {
+			return nil, err
+		}
+		data.Presence.Events = append(data.Presence.Events, ev)
+	}
+
+	return data, nil
+}
+
+// filterGuestAccess removes the joined and peeked rooms from the response which
+// don't allow guest access, so that guests stop receiving events from rooms
+// when guest access is turned off.
+func (rp *RequestPool) filterGuestAccess(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	for _, rooms := range []map[string]types.JoinResponse{data.Rooms.Join, data.Rooms.Peek} {
+		for roomID := range rooms {
+			allowed, err := rp.guestAccessAllowed(req.ctx, roomID)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				delete(rooms, roomID)
+			}
+		}
+	}
+	return data, nil
+}
+
+// guestAccessAllowed returns whether guests are allowed to access the room.
+// Rooms without a valid guest access event don't allow guests.
+func (rp *RequestPool) guestAccessAllowed(ctx context.Context, roomID string) (bool, error) {
+	ev, err := rp.db.GetStateEvent(ctx, roomID, "m.room.guest_access", "")
+	if err != nil {
+		return false, err
+	}
+	var content eventutil.GuestAccessContent
+	if ev != nil {
+		_ = json.Unmarshal(ev.Content(), &content)
+	}
+	return content.GuestAccess == "can_join", nil
+}
+
+// filterHistoryVisibility removes the timeline events from the response which
+// the user isn't allowed to see according to the history visibility of the
+// room, e.g. events in a room which they have been invited to or which were
+// sent before they joined.
+func (rp *RequestPool) filterHistoryVisibility(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	var eventIDs []string
+	for _, jr := range data.Rooms.Join {
+		for _, ev := range jr.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	for _, pr := range data.Rooms.Peek {
+		for _, ev := range pr.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	for _, lr := range data.Rooms.Leave {
+		for _, ev := range lr.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	if len(eventIDs) == 0 {
+		return data, nil
+	}
+
+	var queryRes roomserverAPI.QueryUserAllowedToSeeEventsResponse
+	err := rp.rsAPI.QueryUserAllowedToSeeEvents(req.ctx, &roomserverAPI.QueryUserAllowedToSeeEventsRequest{
+		UserID:   req.device.UserID,
+		EventIDs: eventIDs,
+	}, &queryRes)
+	if err != nil {
+		return nil, err
+	}
+	allowed := func(events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+		filtered := make([]gomatrixserverlib.ClientEvent, 0, len(events))
+		for _, ev := range events {
+			if queryRes.AllowedToSeeEvents[ev.EventID] {
+				filtered = append(filtered, ev)
+			}
+		}
+		return filtered
+	}
+	for roomID, jr := range data.Rooms.Join {
+		jr.Timeline.Events = allowed(jr.Timeline.Events)
+		data.Rooms.Join[roomID] = jr
+	}
+	for roomID, pr := range data.Rooms.Peek {
+		pr.Timeline.Events = allowed(pr.Timeline.Events)
+		data.Rooms.Peek[roomID] = pr
+	}
+	for roomID, lr := range data.Rooms.Leave {
+		lr.Timeline.Events = allowed(lr.Timeline.Events)
+		data.Rooms.Leave[roomID] = lr
+	}
+	return data, nil
+}
+
+// appendLeftRoomState adds the state of each left room in a complete sync
+// response as it was when the user left the room. The sync API only keeps the
+// current state of rooms, so this is asked of the roomserver. State events
+// which are already in the timeline aren't repeated.
+func (rp *RequestPool) appendLeftRoomState(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	stateFilter := &req.filter.Room.State
+	for roomID, lr := range data.Rooms.Leave {
+		if !internal.RoomIncluded(roomID, stateFilter.Rooms, stateFilter.NotRooms) {
+			continue
+		}
+		membershipEvent, err := rp.db.GetStateEvent(req.ctx, roomID, gomatrixserverlib.MRoomMember, req.device.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if membershipEvent == nil {
+			continue
+		}
+		var queryRes roomserverAPI.QueryStateAfterEventsResponse
+		err = rp.rsAPI.QueryStateAfterEvents(req.ctx, &roomserverAPI.QueryStateAfterEventsRequest{
+			RoomID:       roomID,
+			PrevEventIDs: []string{membershipEvent.EventID()},
+		}, &queryRes)
+		if err != nil {
+			return nil, err
+		}
+		inTimeline := make(map[string]bool, len(lr.Timeline.Events))
+		for _, ev := range lr.Timeline.Events {
+			inTimeline[ev.EventID] = true
+		}
+		state := make([]gomatrixserverlib.ClientEvent, 0, len(queryRes.StateEvents))
+		for _, ev := range gomatrixserverlib.HeaderedToClientEvents(queryRes.StateEvents, gomatrixserverlib.FormatSync) {
+			if stateFilter.Limit > 0 && len(state) == stateFilter.Limit {
+				break
+			}
+			if inTimeline[ev.EventID] ||
+				!internal.EventMatchesFilter(ev.Sender, ev.Type, stateFilter.Senders, stateFilter.NotSenders, stateFilter.Types, stateFilter.NotTypes) {
+				continue
+			}
+			state = append(state, ev)
+		}
+		lr.State.Events = state
+		data.Rooms.Leave[roomID] = lr
+	}
+	return data, nil
+}
+
+// appendLazyLoadedMembers replaces the membership events in the state of each
+// room in the response with the membership events of the senders of the
+// timeline events, which are all that a client needs to display the timeline.
+// Unless the filter asks for redundant members, membership events which have
+// already been sent to the device are left out.
+func (rp *RequestPool) appendLazyLoadedMembers(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	if req.since.PDUPosition() == 0 || req.wantFullState {
+		// The client is starting again, so it doesn't have any members yet.
+		rp.lazyLoad.reset(req.device.UserID, req.device.ID)
+	} else {
+		// Syncing from a position means that the client received the response
+		// at that position, along with the members in it.
+		rp.lazyLoad.acknowledge(req.device.UserID, req.device.ID, req.since.PDUPosition())
+	}
+	// The members in this response are acknowledged when the client syncs
+	// from its next_batch.
+	nextBatch, err := types.NewStreamTokenFromString(data.NextBatch)
 	if err != nil {
 		return nil, err
 	}
+	pos := nextBatch.PDUPosition()
+	for roomID, jr := range data.Rooms.Join {
+		jr.State.Events, err = rp.lazyLoadMembers(req, pos, roomID, jr.State.Events, jr.Timeline.Events)
+		if err != nil {
+			return nil, err
+		}
+		data.Rooms.Join[roomID] = jr
+	}
+	for roomID, pr := range data.Rooms.Peek {
+		pr.State.Events, err = rp.lazyLoadMembers(req, pos, roomID, pr.State.Events, pr.Timeline.Events)
+		if err != nil {
+			return nil, err
+		}
+		data.Rooms.Peek[roomID] = pr
+	}
+	for roomID, lr := range data.Rooms.Leave {
+		lr.State.Events, err = rp.lazyLoadMembers(req, pos, roomID, lr.State.Events, lr.Timeline.Events)
+		if err != nil {
+			return nil, err
+		}
+		data.Rooms.Leave[roomID] = lr
+	}
+	return data, nil
+}
+
+func (rp *RequestPool) lazyLoadMembers(
+	req syncRequest, pos types.StreamPosition, roomID string, state, timeline []gomatrixserverlib.ClientEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	userID, deviceID := req.device.UserID, req.device.ID
+	includeRedundant := req.filter.Room.State.IncludeRedundantMembers
+	isMembership := func(ev *gomatrixserverlib.ClientEvent) bool {
+		return ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil
+	}
 
+	// Work out which members are needed. Senders whose membership events are
+	// in the timeline don't need them in the state as well.
+	needed := make(map[string]bool)
+	for _, ev := range timeline {
+		needed[ev.Sender] = true
+	}
+	for i := range timeline {
+		if isMembership(&timeline[i]) {
+			delete(needed, *timeline[i].StateKey)
+			rp.lazyLoad.markSent(userID, deviceID, pos, roomID, *timeline[i].StateKey, timeline[i].EventID)
+		}
+	}
+
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(state))
+	stateFilter := &req.filter.Room.State
+	add := func(ev gomatrixserverlib.ClientEvent) {
+		if !internal.EventMatchesFilter(ev.Sender, ev.Type, stateFilter.Senders, stateFilter.NotSenders, stateFilter.Types, stateFilter.NotTypes) {
+			return
+		}
+		if !includeRedundant && rp.lazyLoad.isSent(userID, deviceID, roomID, *ev.StateKey, ev.EventID) {
+			return
+		}
+		rp.lazyLoad.markSent(userID, deviceID, pos, roomID, *ev.StateKey, ev.EventID)
+		filtered = append(filtered, ev)
+	}
+	for i := range state {
+		if !isMembership(&state[i]) {
+			filtered = append(filtered, state[i])
+			continue
+		}
+		memberID := *state[i].StateKey
+		if needed[memberID] {
+			delete(needed, memberID)
+			add(state[i])
+		}
+	}
+
+	// Any members which are still needed weren't in the state that the database
+	// returned, e.g. because their membership hasn't changed since the last sync,
+	// so look up their current membership.
+	memberIDs := make([]string, 0, len(needed))
+	for memberID := range needed {
+		memberIDs = append(memberIDs, memberID)
+	}
+	sort.Strings(memberIDs)
+	for _, memberID := range memberIDs {
+		ev, err := rp.db.GetStateEvent(req.ctx, roomID, gomatrixserverlib.MRoomMember, memberID)
+		if err != nil {
+			return nil, err
+		}
+		if ev != nil {
+			add(gomatrixserverlib.HeaderedToClientEvent(*ev, gomatrixserverlib.FormatSync))
+		}
+	}
+	return filtered, nil
+}
+
+// appendUnreadNotifications adds the unread notification counts of the user
+// to each of the joined rooms in the response. Joined rooms whose counts have
+// changed since the given position are added to the response if they aren't
+// already in it, so that clients see counts go down when they are read from
+// another device.
+func (rp *RequestPool) appendUnreadNotifications(
+	ctx context.Context, data *types.Response, userID string, since, to types.StreamingToken,
+) (*types.Response, error) {
+	r := types.Range{
+		From: since.PDUPosition(),
+		To:   to.PDUPosition(),
+	}
+	var changedRoomIDs []string
+	if r.From != r.To {
+		roomIDs, err := rp.db.GetUserUnreadNotificationCountsInRange(ctx, userID, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, roomID := range roomIDs {
+			if _, ok := data.Rooms.Join[roomID]; !ok {
+				changedRoomIDs = append(changedRoomIDs, roomID)
+			}
+		}
+	}
+	if len(changedRoomIDs) > 0 {
+		// Only add the rooms which the user is still joined to.
+		var roomsRes currentstateAPI.QueryRoomsForUserResponse
+		err := rp.stateAPI.QueryRoomsForUser(ctx, &currentstateAPI.QueryRoomsForUserRequest{
+			UserID:         userID,
+			WantMembership: "join",
+		}, &roomsRes)
+		if err != nil {
+			return nil, err
+		}
+		joined := make(map[string]bool, len(roomsRes.RoomIDs))
+		for _, roomID := range roomsRes.RoomIDs {
+			joined[roomID] = true
+		}
+		for _, roomID := range changedRoomIDs {
+			if joined[roomID] {
+				data.Rooms.Join[roomID] = *types.NewJoinResponse()
+			}
+		}
+	}
+	if len(data.Rooms.Join) == 0 {
+		return data, nil
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	var queryRes userapi.QueryNotificationCountsResponse
+	err = rp.userAPI.QueryNotificationCounts(ctx, &userapi.QueryNotificationCountsRequest{
+		Localpart: localpart,
+	}, &queryRes)
+	if err != nil {
+		return nil, err
+	}
+	for roomID, jr := range data.Rooms.Join {
+		counts := queryRes.RoomCounts[roomID]
+		jr.UnreadNotifications.NotificationCount = counts.NotificationCount
+		jr.UnreadNotifications.HighlightCount = counts.HighlightCount
+		data.Rooms.Join[roomID] = jr
+	}
 	return data, nil
 }
 
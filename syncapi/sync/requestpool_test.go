@@ -0,0 +1,425 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type ctxKey string
+
+// mockSyncDatabase implements the parts of storage.Database used by the
+// tests, and panics if anything else is called.
+type mockSyncDatabase struct {
+	storage.Database
+	presences       map[string]eduAPI.OutputPresenceEvent
+	presenceUserIDs []string
+	presenceCtx     context.Context
+	unreadRoomIDs   []string
+	guestAccess     map[string]string
+	// leaveEventIDs maps room ID -> the event ID of the user's leave event
+	leaveEventIDs map[string]string
+}
+
+func (d *mockSyncDatabase) GetStateEvent(
+	ctx context.Context, roomID, evType, stateKey string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType == gomatrixserverlib.MRoomMember {
+		eventID, ok := d.leaveEventIDs[roomID]
+		if !ok {
+			return nil, nil
+		}
+		return newTestStateEvent(roomID, eventID, evType, stateKey, stateKey, `{"membership":"leave"}`)
+	}
+	guestAccess, ok := d.guestAccess[roomID]
+	if evType != "m.room.guest_access" || !ok {
+		return nil, nil
+	}
+	return newTestStateEvent(roomID, "$guest_access:localhost", evType, "", alice, `{"guest_access": "`+guestAccess+`"}`)
+}
+
+func newTestStateEvent(roomID, eventID, evType, stateKey, sender, content string) (*gomatrixserverlib.HeaderedEvent, error) {
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"type": "`+evType+`",
+		"state_key": "`+stateKey+`",
+		"content": `+content+`,
+		"sender": "`+sender+`",
+		"room_id": "`+roomID+`",
+		"event_id": "`+eventID+`",
+		"depth": 1,
+		"origin_server_ts": 12345,
+		"prev_events": [],
+		"auth_events": []
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		return nil, err
+	}
+	h := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	return &h, nil
+}
+
+func (d *mockSyncDatabase) GetPresenceInRange(
+	ctx context.Context, userIDs []string, r types.Range,
+) ([]eduAPI.OutputPresenceEvent, error) {
+	d.presenceCtx = ctx
+	d.presenceUserIDs = append([]string{}, userIDs...)
+	var res []eduAPI.OutputPresenceEvent
+	for _, userID := range userIDs {
+		if presence, ok := d.presences[userID]; ok {
+			res = append(res, presence)
+		}
+	}
+	return res, nil
+}
+
+func (d *mockSyncDatabase) GetUserUnreadNotificationCountsInRange(
+	ctx context.Context, userID string, r types.Range,
+) ([]string, error) {
+	return d.unreadRoomIDs, nil
+}
+
+// mockStateAPI implements the parts of CurrentStateInternalAPI used by the
+// tests, and panics if anything else is called.
+type mockStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+	sharedUsers map[string]map[string]int
+	queried     bool
+	queryCtx    context.Context
+	joinedRooms []string
+}
+
+func (s *mockStateAPI) QuerySharedUsers(
+	ctx context.Context, req *currentstateAPI.QuerySharedUsersRequest, res *currentstateAPI.QuerySharedUsersResponse,
+) error {
+	s.queried = true
+	s.queryCtx = ctx
+	res.UserIDsToCount = s.sharedUsers[req.UserID]
+	return nil
+}
+
+func (s *mockStateAPI) QueryRoomsForUser(
+	ctx context.Context, req *currentstateAPI.QueryRoomsForUserRequest, res *currentstateAPI.QueryRoomsForUserResponse,
+) error {
+	if req.WantMembership == "join" {
+		res.RoomIDs = s.joinedRooms
+	}
+	return nil
+}
+
+// mockRoomserverAPI lets the user see the given events, has the given state
+// after events, and panics if anything else is called.
+type mockRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	allowedEventIDs map[string]bool
+	// stateAfterEvents maps event ID -> the state after the event
+	stateAfterEvents map[string][]gomatrixserverlib.HeaderedEvent
+}
+
+func (r *mockRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *roomserverAPI.QueryStateAfterEventsRequest, res *roomserverAPI.QueryStateAfterEventsResponse,
+) error {
+	if len(req.PrevEventIDs) != 1 {
+		return fmt.Errorf("got %d prev events, want 1", len(req.PrevEventIDs))
+	}
+	res.StateEvents, res.PrevEventsExist = r.stateAfterEvents[req.PrevEventIDs[0]]
+	res.RoomExists = res.PrevEventsExist
+	return nil
+}
+
+func (r *mockRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context, req *roomserverAPI.QueryUserAllowedToSeeEventsRequest, res *roomserverAPI.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedToSeeEvents = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.AllowedToSeeEvents[eventID] = r.allowedEventIDs[eventID]
+	}
+	return nil
+}
+
+// mockUserAPI implements the parts of UserInternalAPI used by the tests, and
+// panics if anything else is called.
+type mockUserAPI struct {
+	userapi.UserInternalAPI
+	counts map[string]userapi.NotificationCounts
+}
+
+func (u *mockUserAPI) QueryNotificationCounts(
+	ctx context.Context, req *userapi.QueryNotificationCountsRequest, res *userapi.QueryNotificationCountsResponse,
+) error {
+	res.RoomCounts = u.counts
+	return nil
+}
+
+func TestAppendPresence(t *testing.T) {
+	charlie := "@charlie:localhost"
+	db := &mockSyncDatabase{
+		presences: map[string]eduAPI.OutputPresenceEvent{
+			alice: {
+				UserID:   alice,
+				Presence: eduAPI.PresenceOnline,
+			},
+			bob: {
+				UserID:   bob,
+				Presence: eduAPI.PresenceUnavailable,
+			},
+			// charlie doesn't share a room with alice, so shouldn't be sent
+			charlie: {
+				UserID:   charlie,
+				Presence: eduAPI.PresenceOnline,
+			},
+		},
+	}
+	stateAPI := &mockStateAPI{
+		sharedUsers: map[string]map[string]int{
+			alice: {alice: 1, bob: 1},
+		},
+	}
+	rp := &RequestPool{db: db, stateAPI: stateAPI}
+
+	ctx := context.WithValue(context.Background(), ctxKey("request"), "sync")
+	res, err := rp.appendPresence(ctx, types.NewResponse(), alice, syncPositionBefore, syncPositionAfter)
+	if err != nil {
+		t.Fatalf("appendPresence returned error: %s", err)
+	}
+	if stateAPI.queryCtx != ctx || db.presenceCtx != ctx {
+		t.Errorf("appendPresence didn't use the request context")
+	}
+	sort.Strings(db.presenceUserIDs)
+	if len(db.presenceUserIDs) != 2 || db.presenceUserIDs[0] != alice || db.presenceUserIDs[1] != bob {
+		t.Errorf("appendPresence queried presence of %v, want [%s %s]", db.presenceUserIDs, alice, bob)
+	}
+
+	got := make(map[string]eduAPI.PresenceContent)
+	for _, ev := range res.Presence.Events {
+		if ev.Type != "m.presence" {
+			t.Errorf("presence event has type %q, want m.presence", ev.Type)
+		}
+		var content eduAPI.PresenceContent
+		if err = json.Unmarshal(ev.Content, &content); err != nil {
+			t.Fatalf("failed to unmarshal presence content: %s", err)
+		}
+		got[ev.Sender] = content
+	}
+	if len(got) != 2 {
+		t.Fatalf("got presence for %d users, want 2: %v", len(got), got)
+	}
+	if c := got[alice]; c.Presence != eduAPI.PresenceOnline || !c.CurrentlyActive {
+		t.Errorf("got presence %+v for %s, want online and currently active", c, alice)
+	}
+	if c := got[bob]; c.Presence != eduAPI.PresenceUnavailable || c.CurrentlyActive {
+		t.Errorf("got presence %+v for %s, want unavailable and not currently active", c, bob)
+	}
+}
+
+func TestAppendPresenceNoChange(t *testing.T) {
+	db := &mockSyncDatabase{}
+	stateAPI := &mockStateAPI{}
+	rp := &RequestPool{db: db, stateAPI: stateAPI}
+
+	res, err := rp.appendPresence(context.Background(), types.NewResponse(), alice, syncPositionAfter, syncPositionAfter)
+	if err != nil {
+		t.Fatalf("appendPresence returned error: %s", err)
+	}
+	if stateAPI.queried || db.presenceCtx != nil {
+		t.Errorf("appendPresence queried presence when the position hadn't moved")
+	}
+	if len(res.Presence.Events) != 0 {
+		t.Errorf("got %d presence events, want none", len(res.Presence.Events))
+	}
+}
+
+func TestAppendUnreadNotifications(t *testing.T) {
+	joinedRoomID := "!joined:localhost"
+	leftRoomID := "!left:localhost"
+	db := &mockSyncDatabase{
+		// The counts changed in roomID, which has events in the response, and
+		// in two rooms which don't.
+		unreadRoomIDs: []string{roomID, joinedRoomID, leftRoomID},
+	}
+	stateAPI := &mockStateAPI{
+		joinedRooms: []string{roomID, joinedRoomID},
+	}
+	userAPI := &mockUserAPI{
+		counts: map[string]userapi.NotificationCounts{
+			roomID:     {NotificationCount: 3, HighlightCount: 1},
+			leftRoomID: {NotificationCount: 2},
+		},
+	}
+	rp := &RequestPool{db: db, stateAPI: stateAPI, userAPI: userAPI}
+
+	data := types.NewResponse()
+	data.Rooms.Join[roomID] = *types.NewJoinResponse()
+	res, err := rp.appendUnreadNotifications(context.Background(), data, alice, syncPositionBefore, syncPositionAfter)
+	if err != nil {
+		t.Fatalf("appendUnreadNotifications returned error: %s", err)
+	}
+	if len(res.Rooms.Join) != 2 {
+		t.Fatalf("got %d joined rooms, want 2: %+v", len(res.Rooms.Join), res.Rooms.Join)
+	}
+	jr := res.Rooms.Join[roomID]
+	if jr.UnreadNotifications.NotificationCount != 3 || jr.UnreadNotifications.HighlightCount != 1 {
+		t.Errorf("got counts %+v in %s, want 3 notifications and 1 highlight", jr.UnreadNotifications, roomID)
+	}
+	// The counts in joinedRoomID were all read, so it must be sent with zero
+	// counts even though there are no new events in it.
+	jr, ok := res.Rooms.Join[joinedRoomID]
+	if !ok {
+		t.Fatalf("room %s with changed counts is missing from the response", joinedRoomID)
+	}
+	if jr.UnreadNotifications.NotificationCount != 0 || jr.UnreadNotifications.HighlightCount != 0 {
+		t.Errorf("got counts %+v in %s, want zero", jr.UnreadNotifications, joinedRoomID)
+	}
+	if _, ok = res.Rooms.Join[leftRoomID]; ok {
+		t.Errorf("room %s which the user left was added to the response", leftRoomID)
+	}
+}
+
+func TestAppendUnreadNotificationsNoChange(t *testing.T) {
+	// Rooms with changed counts are only looked up if the position has moved.
+	db := &mockSyncDatabase{unreadRoomIDs: []string{roomID}}
+	stateAPI := &mockStateAPI{joinedRooms: []string{roomID}}
+	rp := &RequestPool{db: db, stateAPI: stateAPI, userAPI: &mockUserAPI{}}
+
+	res, err := rp.appendUnreadNotifications(context.Background(), types.NewResponse(), alice, syncPositionAfter, syncPositionAfter)
+	if err != nil {
+		t.Fatalf("appendUnreadNotifications returned error: %s", err)
+	}
+	if len(res.Rooms.Join) != 0 {
+		t.Errorf("got %d joined rooms, want none", len(res.Rooms.Join))
+	}
+}
+
+func TestPeekedRoomsFiltered(t *testing.T) {
+	peekedRoomID := "!peeked:localhost"
+	noGuestsRoomID := "!noguests:localhost"
+	db := &mockSyncDatabase{
+		guestAccess: map[string]string{
+			peekedRoomID:   "can_join",
+			noGuestsRoomID: "forbidden",
+		},
+	}
+	rsAPI := &mockRoomserverAPI{
+		allowedEventIDs: map[string]bool{"$visible": true},
+	}
+	rp := &RequestPool{db: db, rsAPI: rsAPI, lazyLoad: newLazyLoadCache()}
+
+	bobStateKey := bob
+	req := newTestSyncRequest(alice, aliceDev, syncPositionBefore)
+	req.device.AccountType = userapi.AccountTypeGuest
+	req.filter.Room.State.LazyLoadMembers = true
+	data := types.NewResponse()
+	data.NextBatch = syncPositionAfter.String()
+	for _, peekRoomID := range []string{peekedRoomID, noGuestsRoomID} {
+		pr := types.NewJoinResponse()
+		pr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+			{EventID: "$visible", Type: "m.room.message", Sender: alice},
+			{EventID: "$hidden", Type: "m.room.message", Sender: bob},
+		}
+		pr.State.Events = []gomatrixserverlib.ClientEvent{
+			{EventID: "$bob_join", Type: gomatrixserverlib.MRoomMember, Sender: bob, StateKey: &bobStateKey},
+		}
+		data.Rooms.Peek[peekRoomID] = *pr
+	}
+
+	res, err := rp.filterGuestAccess(data, req)
+	if err != nil {
+		t.Fatalf("filterGuestAccess returned error: %s", err)
+	}
+	if _, ok := res.Rooms.Peek[noGuestsRoomID]; ok {
+		t.Errorf("guest is peeking into %s which doesn't allow guests", noGuestsRoomID)
+	}
+	if res, err = rp.filterHistoryVisibility(res, req); err != nil {
+		t.Fatalf("filterHistoryVisibility returned error: %s", err)
+	}
+	// The hidden event is removed from the timeline, so the membership of its
+	// sender isn't lazy-loaded.
+	if res, err = rp.appendLazyLoadedMembers(res, req); err != nil {
+		t.Fatalf("appendLazyLoadedMembers returned error: %s", err)
+	}
+	pr, ok := res.Rooms.Peek[peekedRoomID]
+	if !ok {
+		t.Fatalf("room %s is missing from the response", peekedRoomID)
+	}
+	if len(pr.Timeline.Events) != 1 || pr.Timeline.Events[0].EventID != "$visible" {
+		t.Errorf("got timeline %+v, want only $visible", pr.Timeline.Events)
+	}
+	if len(pr.State.Events) != 0 {
+		t.Errorf("got state %+v, want no lazy-loaded members", pr.State.Events)
+	}
+}
+
+func TestAppendLeftRoomState(t *testing.T) {
+	leftRoomID := "!left:localhost"
+	var state []gomatrixserverlib.HeaderedEvent
+	for _, ev := range []struct{ eventID, evType, stateKey, sender, content string }{
+		{"$create", "m.room.create", "", bob, `{"creator":"` + bob + `"}`},
+		{"$name", "m.room.name", "", bob, `{"name":"Left room"}`},
+		{"$topic", "m.room.topic", "", bob, `{"topic":"Not wanted"}`},
+		{"$alice_leave", gomatrixserverlib.MRoomMember, alice, alice, `{"membership":"leave"}`},
+	} {
+		h, err := newTestStateEvent(leftRoomID, ev.eventID, ev.evType, ev.stateKey, ev.sender, ev.content)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		state = append(state, *h)
+	}
+	db := &mockSyncDatabase{
+		leaveEventIDs: map[string]string{leftRoomID: "$alice_leave"},
+	}
+	rsAPI := &mockRoomserverAPI{
+		stateAfterEvents: map[string][]gomatrixserverlib.HeaderedEvent{"$alice_leave": state},
+	}
+	rp := &RequestPool{db: db, rsAPI: rsAPI}
+
+	req := newTestSyncRequest(alice, aliceDev, syncPositionBefore)
+	req.filter.Room.IncludeLeave = true
+	req.filter.Room.State.NotTypes = []string{"m.room.topic"}
+	data := types.NewResponse()
+	lr := types.NewLeaveResponse()
+	aliceStateKey := alice
+	lr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{EventID: "$alice_leave", Type: gomatrixserverlib.MRoomMember, Sender: alice, StateKey: &aliceStateKey},
+	}
+	data.Rooms.Leave[leftRoomID] = *lr
+
+	res, err := rp.appendLeftRoomState(data, req)
+	if err != nil {
+		t.Fatalf("appendLeftRoomState returned error: %s", err)
+	}
+	// The topic is filtered out, and the leave event is already in the
+	// timeline.
+	var got []string
+	for _, ev := range res.Rooms.Leave[leftRoomID].State.Events {
+		got = append(got, ev.EventID)
+	}
+	sort.Strings(got)
+	want := []string{"$create", "$name"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got state %v, want %v", got, want)
+	}
+}
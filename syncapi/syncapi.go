@@ -22,6 +22,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	currentstateapi "github.com/matrix-org/dendrite/currentstateserver/api"
+	eduapi "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -43,6 +44,7 @@ func AddPublicRoutes(
 	rsAPI api.RoomserverInternalAPI,
 	keyAPI keyapi.KeyInternalAPI,
 	currentStateAPI currentstateapi.CurrentStateInternalAPI,
+	eduAPI eduapi.EDUServerInputAPI,
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.Dendrite,
 ) {
@@ -62,7 +64,7 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, notifier, userAPI, keyAPI, currentStateAPI)
+	requestPool := sync.NewRequestPool(syncDB, notifier, userAPI, keyAPI, currentStateAPI, rsAPI, eduAPI)
 
 	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
 		cfg.Matrix.ServerName, string(cfg.Kafka.Topics.OutputKeyChangeEvent),
@@ -93,6 +95,34 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start typing consumer")
 	}
 
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		cfg, consumer, notifier, syncDB,
+	)
+	if err = receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start receipts consumer")
+	}
+
+	presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+		cfg, consumer, notifier, syncDB, currentStateAPI,
+	)
+	if err = presenceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start presence consumer")
+	}
+
+	notificationDataConsumer := consumers.NewOutputNotificationDataConsumer(
+		cfg, consumer, notifier, syncDB,
+	)
+	if err = notificationDataConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start notification data consumer")
+	}
+
+	devicesDeletedConsumer := consumers.NewOutputDevicesDeletedConsumer(
+		cfg, consumer, notifier, syncDB,
+	)
+	if err = devicesDeletedConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start devices deleted consumer")
+	}
+
 	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
 		cfg, consumer, notifier, syncDB,
 	)
@@ -65,6 +65,14 @@ type StreamEvent struct {
 	ExcludeFromSync bool
 }
 
+// SearchResult is a single match from the full-text search index.
+type SearchResult struct {
+	EventID string
+	RoomID  string
+	// Rank is the relevance of the match. Higher ranks are better matches.
+	Rank float64
+}
+
 // Range represents a range between two stream positions.
 type Range struct {
 	// From is the position the client has already received.
@@ -385,6 +393,9 @@ type Response struct {
 		Join   map[string]JoinResponse   `json:"join"`
 		Invite map[string]InviteResponse `json:"invite"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
+		// Peek contains the rooms which the device is peeking into without
+		// being joined to them.
+		Peek map[string]JoinResponse `json:"peek"`
 	} `json:"rooms"`
 	ToDevice struct {
 		Events []gomatrixserverlib.SendToDeviceEvent `json:"events"`
@@ -394,6 +405,8 @@ type Response struct {
 		Left    []string `json:"left,omitempty"`
 	} `json:"device_lists,omitempty"`
 	DeviceListsOTKCount map[string]int `json:"device_one_time_keys_count"`
+	// The algorithms of the device's fallback keys which haven't been claimed
+	DeviceUnusedFallbackKeyTypes []string `json:"device_unused_fallback_key_types"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -404,6 +417,7 @@ func NewResponse() *Response {
 	res.Rooms.Join = make(map[string]JoinResponse)
 	res.Rooms.Invite = make(map[string]InviteResponse)
 	res.Rooms.Leave = make(map[string]LeaveResponse)
+	res.Rooms.Peek = make(map[string]JoinResponse)
 
 	// Also pre-intialise empty slices or else we'll insert 'null' instead of '[]' for the value.
 	// TODO: We really shouldn't have to do all this to coerce encoding/json to Do The Right Thing. We should
@@ -413,6 +427,7 @@ func NewResponse() *Response {
 	res.Presence.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	res.ToDevice.Events = make([]gomatrixserverlib.SendToDeviceEvent, 0)
 	res.DeviceListsOTKCount = make(map[string]int)
+	res.DeviceUnusedFallbackKeyTypes = make([]string, 0)
 
 	return &res
 }
@@ -423,6 +438,7 @@ func (r *Response) IsEmpty() bool {
 	return len(r.Rooms.Join) == 0 &&
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
+		len(r.Rooms.Peek) == 0 &&
 		len(r.AccountData.Events) == 0 &&
 		len(r.Presence.Events) == 0 &&
 		len(r.ToDevice.Events) == 0
@@ -444,6 +460,10 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications struct {
+		HighlightCount    int `json:"highlight_count"`
+		NotificationCount int `json:"notification_count"`
+	} `json:"unread_notifications"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -502,3 +522,16 @@ type SendToDeviceEvent struct {
 	DeviceID    string
 	SentByToken *StreamingToken
 }
+
+// Peek is a room which a device is peeking into without being joined to it.
+type Peek struct {
+	RoomID string
+	// The stream position at which the device started peeking.
+	StreamPosition StreamPosition
+}
+
+// PeekingDevice is a device which is peeking into a room.
+type PeekingDevice struct {
+	UserID   string
+	DeviceID string
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -28,13 +29,26 @@ type UserInternalAPI interface {
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
+	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
+	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
+	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *PerformPusherSetResponse) error
+	PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *PerformPusherDeletionResponse) error
+	PerformNotificationsRead(ctx context.Context, req *PerformNotificationsReadRequest, res *PerformNotificationsReadResponse) error
+	PerformThreePIDSessionCreation(ctx context.Context, req *PerformThreePIDSessionCreationRequest, res *PerformThreePIDSessionCreationResponse) error
+	PerformThreePIDSessionValidation(ctx context.Context, req *PerformThreePIDSessionValidationRequest, res *PerformThreePIDSessionValidationResponse) error
+	PerformThreePIDSessionDeletion(ctx context.Context, req *PerformThreePIDSessionDeletionRequest, res *PerformThreePIDSessionDeletionResponse) error
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 	QuerySearchProfiles(ctx context.Context, req *QuerySearchProfilesRequest, res *QuerySearchProfilesResponse) error
+	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	QueryNotifications(ctx context.Context, req *QueryNotificationsRequest, res *QueryNotificationsResponse) error
+	QueryNotificationCounts(ctx context.Context, req *QueryNotificationCountsRequest, res *QueryNotificationCountsResponse) error
+	QueryThreePIDSession(ctx context.Context, req *QueryThreePIDSessionRequest, res *QueryThreePIDSessionResponse) error
 }
 
 // InputAccountDataRequest is the request for InputAccountData
@@ -87,12 +101,19 @@ type QueryAccessTokenRequest struct {
 	// optional user ID, valid only if the token is an appservice.
 	// https://matrix.org/docs/spec/application_service/r0.1.2#using-sync-and-events
 	AppServiceUserID string
+	// optional: the IP address and user agent of the request, which are
+	// recorded as the last seen information of the device.
+	IPAddr    string
+	UserAgent string
 }
 
 // QueryAccessTokenResponse is the response for QueryAccessToken
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    error // e.g ErrorForbidden
+	// True if the access token belongs to a device but has expired, in which
+	// case Device is nil.
+	Expired bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -151,12 +172,16 @@ type QuerySearchProfilesResponse struct {
 
 // PerformAccountCreationRequest is the request for PerformAccountCreation
 type PerformAccountCreationRequest struct {
-	AccountType AccountType // Required: whether this is a guest or user account
+	AccountType AccountType // Required: whether this is a guest, user or admin account
 	Localpart   string      // Required: The localpart for this account. Ignored if account type is guest.
 
 	AppServiceID string // optional: the application service ID (not user ID) creating this account, if any.
 	Password     string // optional: if missing then this account will be a passwordless account
 	OnConflict   Conflict
+	// optional: if true then the existing guest account with the localpart is
+	// upgraded to a user account with the password, rather than a new account
+	// being created.
+	UpgradeGuest bool
 }
 
 // PerformAccountCreationResponse is the response for PerformAccountCreation
@@ -165,6 +190,34 @@ type PerformAccountCreationResponse struct {
 	Account        *Account
 }
 
+// PerformPasswordUpdateRequest is the request for PerformPasswordUpdate
+type PerformPasswordUpdateRequest struct {
+	Localpart string // required: the localpart of the account to update
+	Password  string // required: the new password
+	// optional: if true then all of the devices of the account are logged out,
+	// except for the device with ID DeviceID if it is set.
+	LogoutDevices bool
+	DeviceID      string
+}
+
+// PerformPasswordUpdateResponse is the response for PerformPasswordUpdate
+type PerformPasswordUpdateResponse struct {
+	PasswordUpdated bool
+}
+
+// PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
+type PerformAccountDeactivationRequest struct {
+	Localpart string // required: the localpart of the account to deactivate
+	// optional: if true then the display name and avatar URL of the account
+	// are removed.
+	EraseProfile bool
+}
+
+// PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
+type PerformAccountDeactivationResponse struct {
+	AccountDeactivated bool
+}
+
 // PerformDeviceCreationRequest is the request for PerformDeviceCreation
 type PerformDeviceCreationRequest struct {
 	Localpart   string
@@ -174,6 +227,10 @@ type PerformDeviceCreationRequest struct {
 	DeviceID *string
 	// optional: if nil no display name will be associated with this device.
 	DeviceDisplayName *string
+	// optional: if set, the tokens of the device can be replaced with PerformTokenRefresh.
+	RefreshToken string
+	// optional: if 0 the access token never expires.
+	AccessTokenLifetimeMS int64
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
@@ -182,6 +239,227 @@ type PerformDeviceCreationResponse struct {
 	Device        *Device
 }
 
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	RefreshToken    string // required: the refresh token of the device
+	NewAccessToken  string // required: the access token which replaces the current one
+	NewRefreshToken string // required: the refresh token which replaces the current one
+	// optional: if 0 the new access token never expires.
+	AccessTokenLifetimeMS int64
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// The device with the new access token, or nil if no device has the refresh token.
+	Device *Device
+}
+
+// PerformPusherSetRequest is the request for PerformPusherSet
+type PerformPusherSetRequest struct {
+	Localpart string
+	Pusher    Pusher
+	// If false, other pushers with the same app ID and pushkey are removed
+	// from all users.
+	Append bool
+}
+
+// PerformPusherSetResponse is the response for PerformPusherSet
+type PerformPusherSetResponse struct {
+}
+
+// PerformPusherDeletionRequest is the request for PerformPusherDeletion
+type PerformPusherDeletionRequest struct {
+	Localpart string
+	AppID     string
+	PushKey   string
+}
+
+// PerformPusherDeletionResponse is the response for PerformPusherDeletion
+type PerformPusherDeletionResponse struct {
+}
+
+// QueryPushersRequest is the request for QueryPushers
+type QueryPushersRequest struct {
+	Localpart string
+}
+
+// QueryPushersResponse is the response for QueryPushers
+type QueryPushersResponse struct {
+	Pushers []Pusher `json:"pushers"`
+}
+
+// Pusher represents a push notification subscriber
+type Pusher struct {
+	PushKey string `json:"pushkey"`
+	// When the pushkey was last updated, in milliseconds since the epoch.
+	PushKeyTS         gomatrixserverlib.Timestamp `json:"pushkey_ts"`
+	Kind              PusherKind                  `json:"kind"`
+	AppID             string                      `json:"app_id"`
+	AppDisplayName    string                      `json:"app_display_name"`
+	DeviceDisplayName string                      `json:"device_display_name"`
+	ProfileTag        string                      `json:"profile_tag"`
+	Language          string                      `json:"lang"`
+	Data              map[string]interface{}      `json:"data"`
+}
+
+// PusherKind is the kind of a pusher, which determines how notifications
+// are delivered
+type PusherKind string
+
+const (
+	// EmailKind pushers send notifications by email
+	EmailKind PusherKind = "email"
+	// HTTPKind pushers send notifications to a push gateway
+	HTTPKind PusherKind = "http"
+)
+
+// PerformNotificationsReadRequest is the request for PerformNotificationsRead
+type PerformNotificationsReadRequest struct {
+	Localpart string
+	RoomID    string
+}
+
+// PerformNotificationsReadResponse is the response for PerformNotificationsRead
+type PerformNotificationsReadResponse struct {
+}
+
+// QueryNotificationsRequest is the request for QueryNotifications
+type QueryNotificationsRequest struct {
+	Localpart string
+	// The pagination token returned by a previous request, if any.
+	From  string
+	Limit int
+	// If true, only notifications which were highlighted are returned.
+	OnlyHighlight bool
+}
+
+// QueryNotificationsResponse is the response for QueryNotifications
+type QueryNotificationsResponse struct {
+	Notifications []*Notification `json:"notifications"`
+	// The token to pass as From to get the next page of notifications, or
+	// empty if there are no more.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// QueryNotificationCountsRequest is the request for QueryNotificationCounts
+type QueryNotificationCountsRequest struct {
+	Localpart string
+}
+
+// QueryNotificationCountsResponse is the response for QueryNotificationCounts
+type QueryNotificationCountsResponse struct {
+	// The unread notification counts of each room which has any.
+	RoomCounts map[string]NotificationCounts
+}
+
+// Notification is a notification that was generated for a user by their
+// push rules
+type Notification struct {
+	Actions    []*pushrules.Action           `json:"actions"`
+	Event      gomatrixserverlib.ClientEvent `json:"event"`
+	ProfileTag string                        `json:"profile_tag"`
+	Read       bool                          `json:"read"`
+	RoomID     string                        `json:"room_id"`
+	TS         gomatrixserverlib.Timestamp   `json:"ts"`
+}
+
+// OutputNotificationData is sent to the sync API server whenever the unread
+// notification counts of a user in a room change, so that the new counts are
+// sent down /sync even if there are no new events in the room.
+type OutputNotificationData struct {
+	UserID string `json:"user_id"`
+	RoomID string `json:"room_id"`
+}
+
+// OutputDevicesDeleted is sent to the sync API server whenever devices of a
+// user are logged out, so that it can forget about them.
+type OutputDevicesDeleted struct {
+	UserID    string   `json:"user_id"`
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// NotificationCounts are the unread notification counts of a room
+type NotificationCounts struct {
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+}
+
+// PerformThreePIDSessionCreationRequest is the request for PerformThreePIDSessionCreation
+type PerformThreePIDSessionCreationRequest struct {
+	ClientSecret string
+	Medium       string
+	Address      string
+	// optional: where to send the user after they validate the session
+	NextLink string
+	// Requests with the same client secret and address but a send attempt
+	// which isn't higher than the last one return the same session without
+	// a token, so that clients can retry without sending more messages.
+	SendAttempt int
+	// required: how long the session can be validated for
+	LifetimeMS int64
+}
+
+// PerformThreePIDSessionCreationResponse is the response for PerformThreePIDSessionCreation
+type PerformThreePIDSessionCreationResponse struct {
+	SID string
+	// The token to send to the address, or empty if nothing should be sent.
+	Token string
+}
+
+// PerformThreePIDSessionValidationRequest is the request for PerformThreePIDSessionValidation
+type PerformThreePIDSessionValidationRequest struct {
+	SID          string
+	ClientSecret string
+	Token        string
+}
+
+// PerformThreePIDSessionValidationResponse is the response for PerformThreePIDSessionValidation
+type PerformThreePIDSessionValidationResponse struct {
+	// The session that was validated, or nil if the session doesn't exist,
+	// has expired or the token is incorrect.
+	Session *ThreePIDSession
+}
+
+// PerformThreePIDSessionDeletionRequest is the request for PerformThreePIDSessionDeletion
+type PerformThreePIDSessionDeletionRequest struct {
+	SID          string
+	ClientSecret string
+}
+
+// PerformThreePIDSessionDeletionResponse is the response for PerformThreePIDSessionDeletion
+type PerformThreePIDSessionDeletionResponse struct{}
+
+// QueryThreePIDSessionRequest is the request for QueryThreePIDSession
+type QueryThreePIDSessionRequest struct {
+	SID          string
+	ClientSecret string
+}
+
+// QueryThreePIDSessionResponse is the response for QueryThreePIDSession
+type QueryThreePIDSessionResponse struct {
+	// The session, or nil if it doesn't exist or has expired.
+	Session *ThreePIDSession
+}
+
+// ThreePIDSession is an attempt to verify that a user owns a third party
+// identifier, by sending a token to it
+type ThreePIDSession struct {
+	SID          string
+	ClientSecret string
+	Medium       string
+	Address      string
+	NextLink     string
+	SendAttempt  int
+	// When the session was validated, or 0 if it hasn't been.
+	ValidatedTS gomatrixserverlib.Timestamp
+	ExpiresTS   gomatrixserverlib.Timestamp
+}
+
+// Validated returns whether the user has proven that they own the address.
+func (s *ThreePIDSession) Validated() bool {
+	return s.ValidatedTS != 0
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -195,6 +473,16 @@ type Device struct {
 	SessionID int64
 	// TODO: display name, last used timestamp, keys, etc
 	DisplayName string
+	// The type of the account which owns the device, so that guest devices
+	// can be restricted.
+	AccountType AccountType
+	// When the access token expires, or 0 if it never expires.
+	AccessTokenExpiresTS gomatrixserverlib.Timestamp
+	// When the device was last used, or 0 if it hasn't been used since it
+	// was created, and the IP address and user agent it was last used from.
+	LastSeenTS gomatrixserverlib.Timestamp
+	LastSeenIP string
+	UserAgent  string
 }
 
 // Account represents a Matrix account on this home server.
@@ -203,7 +491,9 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	AccountType  AccountType
+	// Deactivated accounts can't log in or have devices created for them.
+	Deactivated bool
 	// TODO: Associations (e.g. with application services)
 }
 
@@ -241,4 +531,7 @@ const (
 	AccountTypeUser AccountType = 1
 	// AccountTypeGuest indicates this is a guest account
 	AccountTypeGuest AccountType = 2
+	// AccountTypeAdmin indicates this is a user account which is also a
+	// server admin
+	AccountTypeAdmin AccountType = 3
 )
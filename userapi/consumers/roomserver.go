@@ -0,0 +1,445 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/producers"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server,
+// evaluates the push rules of the local users in the room against them and
+// sends notifications to the pushers of the users who should be notified.
+type OutputRoomEventConsumer struct {
+	rsConsumer   *internal.ContinualConsumer
+	db           accounts.Database
+	rsAPI        api.RoomserverInternalAPI
+	pgClient     pushgateway.Client
+	syncProducer *producers.SyncAPI
+	serverName   gomatrixserverlib.ServerName
+}
+
+const (
+	// notifyMaxAttempts is the number of times that sending a notification
+	// to a push gateway is attempted before giving up.
+	notifyMaxAttempts = 8
+	// notifyInitialBackoff is how long to wait before the first retry. The
+	// wait doubles after each failed attempt.
+	notifyInitialBackoff = 2 * time.Second
+)
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+	pgClient pushgateway.Client,
+	syncProducer *producers.SyncAPI,
+) *OutputRoomEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputRoomEventConsumer{
+		rsConsumer:   &consumer,
+		db:           store,
+		rsAPI:        rsAPI,
+		pgClient:     pgClient,
+		syncProducer: syncProducer,
+		serverName:   cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	return s.rsConsumer.Start()
+}
+
+func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+
+	event := output.NewRoomEvent.Event.Event
+	if err := s.processEvent(context.TODO(), event); err != nil {
+		// Failing to evaluate push rules shouldn't stop us from processing
+		// the rest of the stream.
+		log.WithFields(log.Fields{
+			"event_id":   event.EventID(),
+			log.ErrorKey: err,
+		}).Error("userapi: failed to evaluate push rules")
+	}
+	return nil
+}
+
+// processEvent evaluates the push rules of every local user who should be
+// notified about the event, and sends notifications to their pushers.
+func (s *OutputRoomEventConsumer) processEvent(ctx context.Context, event gomatrixserverlib.Event) error {
+	members, err := s.roomMembers(ctx, &event)
+	if err != nil {
+		return fmt.Errorf("s.roomMembers: %w", err)
+	}
+	if len(members.local) == 0 {
+		return nil
+	}
+
+	ec := &ruleSetEvalContext{
+		ctx:         ctx,
+		rsAPI:       s.rsAPI,
+		roomID:      event.RoomID(),
+		memberCount: members.joinedCount,
+	}
+	for _, member := range members.local {
+		if member.userID == event.Sender() {
+			// Users are never notified about their own events.
+			continue
+		}
+		ec.displayName = members.displayNames[member.userID]
+		actions, err := s.evaluatePushRules(ctx, ec, member.localpart, &event)
+		if err != nil {
+			return fmt.Errorf("s.evaluatePushRules: %w", err)
+		}
+		notify, tweaks := pushrules.ActionsToTweaks(actions)
+		if !notify {
+			continue
+		}
+		if err = s.storeNotification(ctx, member, &event, actions, tweaks); err != nil {
+			return fmt.Errorf("s.storeNotification: %w", err)
+		}
+		if err = s.syncProducer.SendNotificationData(member.userID, event.RoomID()); err != nil {
+			return fmt.Errorf("s.syncProducer.SendNotificationData: %w", err)
+		}
+		if err = s.notifyPushers(ctx, member, &event, tweaks, members.displayNames[event.Sender()]); err != nil {
+			return fmt.Errorf("s.notifyPushers: %w", err)
+		}
+	}
+	return nil
+}
+
+// storeNotification stores the notification about the event, which counts
+// towards the unread notifications of the user until they read the room.
+func (s *OutputRoomEventConsumer) storeNotification(
+	ctx context.Context, member *localMember, event *gomatrixserverlib.Event,
+	actions []*pushrules.Action, tweaks map[string]interface{},
+) error {
+	highlight, _ := tweaks[string(pushrules.HighlightTweak)].(bool)
+	n := &userapi.Notification{
+		Actions: actions,
+		Event:   gomatrixserverlib.ToClientEvent(*event, gomatrixserverlib.FormatAll),
+		RoomID:  event.RoomID(),
+		TS:      gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	return s.db.InsertNotification(ctx, member.localpart, event.EventID(), highlight, n)
+}
+
+// evaluatePushRules returns the actions of the first push rule of the user
+// that matches the event, or nil if no rule matches.
+func (s *OutputRoomEventConsumer) evaluatePushRules(
+	ctx context.Context, ec pushrules.EvaluationContext, localpart string, event *gomatrixserverlib.Event,
+) ([]*pushrules.Action, error) {
+	data, err := s.db.GetAccountDataByType(ctx, localpart, "", pushrules.AccountDataType)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.GetAccountDataByType: %w", err)
+	}
+	var ruleSets *pushrules.AccountRuleSets
+	if data == nil {
+		ruleSets = pushrules.DefaultAccountRuleSets(localpart, s.serverName)
+	} else {
+		ruleSets = &pushrules.AccountRuleSets{}
+		if err = json.Unmarshal(data, ruleSets); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+
+	rule, err := pushrules.NewRuleSetEvaluator(ec, &ruleSets.Global).MatchEvent(event)
+	if err != nil || rule == nil {
+		return nil, err
+	}
+	return rule.Actions, nil
+}
+
+// notifyPushers sends a notification about the event to each of the HTTP
+// pushers of the user. Notifications are sent in the background so that a
+// slow or unavailable push gateway doesn't hold up the stream.
+func (s *OutputRoomEventConsumer) notifyPushers(
+	ctx context.Context, member *localMember, event *gomatrixserverlib.Event,
+	tweaks map[string]interface{}, senderDisplayName string,
+) error {
+	pushers, err := s.db.GetPushers(ctx, member.localpart)
+	if err != nil {
+		return fmt.Errorf("s.db.GetPushers: %w", err)
+	}
+	if len(pushers) == 0 {
+		return nil
+	}
+	roomCounts, err := s.db.GetRoomNotificationCounts(ctx, member.localpart)
+	if err != nil {
+		return fmt.Errorf("s.db.GetRoomNotificationCounts: %w", err)
+	}
+	var unread int
+	for _, counts := range roomCounts {
+		unread += counts.NotificationCount
+	}
+	for i := range pushers {
+		pusher := &pushers[i]
+		if pusher.Kind != userapi.HTTPKind {
+			continue
+		}
+		url, ok := pusher.Data["url"].(string)
+		if !ok || url == "" {
+			continue
+		}
+		req := &pushgateway.NotifyRequest{
+			Notification: buildNotification(member, event, pusher, tweaks, senderDisplayName, unread),
+		}
+		go s.sendNotification(member.localpart, url, pusher, req)
+	}
+	return nil
+}
+
+// sendNotification sends the notification to the push gateway, retrying with
+// exponential backoff if the push gateway can't be reached. Pushers whose
+// pushkeys are rejected by the push gateway are removed.
+func (s *OutputRoomEventConsumer) sendNotification(
+	localpart, url string, pusher *userapi.Pusher, req *pushgateway.NotifyRequest,
+) {
+	ctx := context.Background()
+	logger := log.WithFields(log.Fields{
+		"localpart": localpart,
+		"app_id":    pusher.AppID,
+		"event_id":  req.Notification.EventID,
+	})
+	backoff := notifyInitialBackoff
+	for attempt := 1; ; attempt++ {
+		var res pushgateway.NotifyResponse
+		err := s.pgClient.Notify(ctx, url, req, &res)
+		if err == nil {
+			for _, pushKey := range res.Rejected {
+				logger.WithField("pushkey", pushKey).Info("userapi: push gateway rejected pushkey, removing pusher")
+				if err = s.db.RemovePusher(ctx, pusher.AppID, pushKey, localpart); err != nil {
+					logger.WithError(err).Error("userapi: failed to remove rejected pusher")
+				}
+			}
+			return
+		}
+		var statusErr *pushgateway.StatusError
+		if errors.As(err, &statusErr) && !statusErr.Temporary() {
+			logger.WithError(err).Error("userapi: push gateway refused notification")
+			return
+		}
+		if attempt >= notifyMaxAttempts {
+			logger.WithError(err).Errorf("userapi: giving up on notification after %d attempts", attempt)
+			return
+		}
+		logger.WithError(err).Warnf("userapi: failed to send notification, retrying in %s", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// buildNotification builds the notification that is sent to the push
+// gateway for a single pusher.
+func buildNotification(
+	member *localMember, event *gomatrixserverlib.Event, pusher *userapi.Pusher,
+	tweaks map[string]interface{}, senderDisplayName string, unread int,
+) pushgateway.Notification {
+	// The push gateway URL isn't passed on to the push gateway.
+	data := make(map[string]interface{}, len(pusher.Data))
+	for k, v := range pusher.Data {
+		if k != "url" {
+			data[k] = v
+		}
+	}
+	n := pushgateway.Notification{
+		EventID: event.EventID(),
+		RoomID:  event.RoomID(),
+		Counts:  &pushgateway.Counts{Unread: unread},
+		Devices: []*pushgateway.Device{{
+			AppID:     pusher.AppID,
+			Data:      data,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+			Tweaks:    tweaks,
+		}},
+		Prio: pushgateway.LowPrio,
+	}
+	if format, _ := pusher.Data["format"].(string); format == "event_id_only" {
+		return n
+	}
+
+	n.Type = event.Type()
+	n.Sender = event.Sender()
+	n.SenderDisplayName = senderDisplayName
+	n.Content = event.Content()
+	switch event.Type() {
+	case "m.room.message", "m.room.encrypted", "m.call.invite":
+		n.Prio = pushgateway.HighPrio
+	case gomatrixserverlib.MRoomMember:
+		if membership, err := event.Membership(); err == nil {
+			n.Membership = membership
+		}
+		n.UserIsTarget = event.StateKey() != nil && *event.StateKey() == member.userID
+		if n.UserIsTarget && n.Membership == gomatrixserverlib.Invite {
+			n.Prio = pushgateway.HighPrio
+		}
+	}
+	return n
+}
+
+type localMember struct {
+	userID    string
+	localpart string
+}
+
+type roomMembers struct {
+	// The number of users who are joined to the room.
+	joinedCount int
+	// The display names of the users who are joined to the room.
+	displayNames map[string]string
+	// The local users who should be notified about the event.
+	local []*localMember
+}
+
+// roomMembers returns the users who are joined to the room that the event
+// was sent to. The local members also include the target of the event if it
+// invites a local user to the room.
+func (s *OutputRoomEventConsumer) roomMembers(
+	ctx context.Context, event *gomatrixserverlib.Event,
+) (*roomMembers, error) {
+	req := api.QueryMembershipsForRoomRequest{
+		JoinedOnly: true,
+		RoomID:     event.RoomID(),
+		Sender:     event.Sender(),
+	}
+	var res api.QueryMembershipsForRoomResponse
+	if err := s.rsAPI.QueryMembershipsForRoom(ctx, &req, &res); err != nil {
+		return nil, fmt.Errorf("s.rsAPI.QueryMembershipsForRoom: %w", err)
+	}
+
+	members := &roomMembers{
+		displayNames: make(map[string]string, len(res.JoinEvents)),
+	}
+	for _, ev := range res.JoinEvents {
+		if ev.StateKey == nil {
+			continue
+		}
+		members.joinedCount++
+		var content struct {
+			DisplayName string `json:"displayname"`
+		}
+		if err := json.Unmarshal(ev.Content, &content); err == nil {
+			members.displayNames[*ev.StateKey] = content.DisplayName
+		}
+		if member := s.newLocalMember(*ev.StateKey); member != nil {
+			members.local = append(members.local, member)
+		}
+	}
+
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKey() != nil {
+		if membership, err := event.Membership(); err == nil && membership == gomatrixserverlib.Invite {
+			if member := s.newLocalMember(*event.StateKey()); member != nil {
+				members.local = append(members.local, member)
+			}
+		}
+	}
+	return members, nil
+}
+
+func (s *OutputRoomEventConsumer) newLocalMember(userID string) *localMember {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != s.serverName {
+		return nil
+	}
+	return &localMember{
+		userID:    userID,
+		localpart: localpart,
+	}
+}
+
+// ruleSetEvalContext implements pushrules.EvaluationContext for a single
+// event in a room.
+type ruleSetEvalContext struct {
+	ctx         context.Context
+	rsAPI       api.RoomserverInternalAPI
+	roomID      string
+	memberCount int
+	displayName string
+}
+
+func (rse *ruleSetEvalContext) UserDisplayName() string { return rse.displayName }
+
+func (rse *ruleSetEvalContext) RoomMemberCount() (int, error) { return rse.memberCount, nil }
+
+func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID: rse.roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
+			EventType: gomatrixserverlib.MRoomPowerLevels,
+			StateKey:  "",
+		}},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := rse.rsAPI.QueryLatestEventsAndState(rse.ctx, &req, &res); err != nil {
+		return false, fmt.Errorf("rse.rsAPI.QueryLatestEventsAndState: %w", err)
+	}
+	if len(res.StateEvents) == 0 {
+		return false, nil
+	}
+	plEvent := res.StateEvents[0].Event
+	pl, err := gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent)
+	if err != nil {
+		return false, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+	}
+	var content struct {
+		Notifications map[string]int64 `json:"notifications"`
+	}
+	if err = json.Unmarshal(plEvent.Content(), &content); err != nil {
+		return false, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	// The spec defines a default of 50 for the only notification type
+	// that currently exists, which is "room".
+	required, ok := content.Notifications[levelKey]
+	if !ok {
+		required = 50
+	}
+	return pl.UserLevel(userID) >= required, nil
+}
@@ -16,17 +16,25 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -40,6 +48,19 @@ type UserInternalAPI struct {
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
 	KeyAPI      keyapi.KeyInternalAPI
+	// LastSeen records when devices were last used, if set.
+	LastSeen *LastSeenUpdater
+	// SyncProducer tells the sync API when unread notification counts change
+	// and when devices are logged out.
+	SyncProducer *producers.SyncAPI
+}
+
+// Stop writes out the last seen information of devices which is still held
+// in memory. It should be called when the process is shutting down.
+func (a *UserInternalAPI) Stop() {
+	if a.LastSeen != nil {
+		a.LastSeen.Stop()
+	}
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -57,35 +78,58 @@ func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAc
 }
 
 func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
+	if req.UpgradeGuest {
+		if err := a.AccountDB.UpgradeGuestAccount(ctx, req.Localpart, req.Password); err != nil {
+			if err == sql.ErrNoRows {
+				return &api.ErrorForbidden{
+					Message: "account is not a guest account",
+				}
+			}
+			return err
+		}
+		// The guest's existing devices are no longer restricted.
+		if err := a.DeviceDB.UpdateDevicesAccountType(ctx, req.Localpart, api.AccountTypeUser); err != nil {
+			return err
+		}
+		acc, err := a.AccountDB.GetAccountByLocalpart(ctx, req.Localpart)
+		if err != nil {
+			return err
+		}
+		res.AccountCreated = true
+		res.Account = acc
+		return nil
+	}
 	if req.AccountType == api.AccountTypeGuest {
 		acc, err := a.AccountDB.CreateGuestAccount(ctx)
 		if err != nil {
 			return err
 		}
+		if err = a.storeDefaultPushRules(ctx, acc.Localpart); err != nil {
+			return err
+		}
 		res.AccountCreated = true
 		res.Account = acc
 		return nil
 	}
-	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID)
+	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID, req.AccountType)
 	if err != nil {
-		if errors.Is(err, sqlutil.ErrUserExists) { // This account already exists
-			switch req.OnConflict {
-			case api.ConflictUpdate:
-				break
-			case api.ConflictAbort:
-				return &api.ErrorConflict{
-					Message: err.Error(),
-				}
+		if !errors.Is(err, sqlutil.ErrUserExists) {
+			return err
+		}
+		// This account already exists
+		if req.OnConflict == api.ConflictAbort {
+			return &api.ErrorConflict{
+				Message: err.Error(),
 			}
 		}
-		// account already exists
-		res.AccountCreated = false
-		res.Account = &api.Account{
-			AppServiceID: req.AppServiceID,
-			Localpart:    req.Localpart,
-			ServerName:   a.ServerName,
-			UserID:       fmt.Sprintf("@%s:%s", req.Localpart, a.ServerName),
+		// Return the account as it is, including whether it has been
+		// deactivated, so that callers don't treat it as a new account.
+		existing, err := a.AccountDB.GetAccountByLocalpart(ctx, req.Localpart)
+		if err != nil {
+			return err
 		}
+		res.AccountCreated = false
+		res.Account = existing
 		return nil
 	}
 
@@ -93,12 +137,125 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		return err
 	}
 
+	if err = a.storeDefaultPushRules(ctx, req.Localpart); err != nil {
+		return err
+	}
+
 	res.AccountCreated = true
 	res.Account = acc
 	return nil
 }
+
+// storeDefaultPushRules stores the server default push rules in the account
+// data of a newly created account.
+func (a *UserInternalAPI) storeDefaultPushRules(ctx context.Context, localpart string) error {
+	data, err := json.Marshal(pushrules.DefaultAccountRuleSets(localpart, a.ServerName))
+	if err != nil {
+		return err
+	}
+	return a.AccountDB.SaveAccountData(ctx, localpart, "", pushrules.AccountDataType, data)
+}
+func (a *UserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
+	if err := a.AccountDB.SetPassword(ctx, req.Localpart, req.Password); err != nil {
+		return err
+	}
+	res.PasswordUpdated = true
+	if !req.LogoutDevices {
+		return nil
+	}
+
+	devs, err := a.DeviceDB.GetDevicesByLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	if err = a.DeviceDB.RemoveAllDevices(ctx, req.Localpart, req.DeviceID); err != nil {
+		return err
+	}
+	var deviceIDs []string
+	for _, dev := range devs {
+		if dev.ID != req.DeviceID {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	return a.devicesDeleted(userutil.MakeUserID(req.Localpart, a.ServerName), deviceIDs)
+}
+
+// PerformAccountDeactivation deactivates the account so that it can no longer
+// log in, and removes its devices, their keys, its pushers and its 3PID
+// associations. Leaving the rooms that the user is in and unbinding their 3PIDs
+// from identity servers is up to the caller.
+func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
+	util.GetLogger(ctx).WithField("localpart", req.Localpart).Info("PerformAccountDeactivation")
+	if err := a.AccountDB.DeactivateAccount(ctx, req.Localpart); err != nil {
+		return err
+	}
+	res.AccountDeactivated = true
+
+	threepids, err := a.AccountDB.GetThreePIDsForLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	for _, threepid := range threepids {
+		if err = a.AccountDB.RemoveThreePIDAssociation(ctx, threepid.Address, threepid.Medium); err != nil {
+			return err
+		}
+	}
+
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	for _, pusher := range pushers {
+		if err = a.AccountDB.RemovePusher(ctx, pusher.AppID, pusher.PushKey, req.Localpart); err != nil {
+			return err
+		}
+	}
+
+	if req.EraseProfile {
+		if err = a.AccountDB.SetDisplayName(ctx, req.Localpart, ""); err != nil {
+			return err
+		}
+		if err = a.AccountDB.SetAvatarURL(ctx, req.Localpart, ""); err != nil {
+			return err
+		}
+	}
+
+	devs, err := a.DeviceDB.GetDevicesByLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	if err = a.DeviceDB.RemoveAllDevices(ctx, req.Localpart, ""); err != nil {
+		return err
+	}
+	if len(devs) == 0 {
+		return nil
+	}
+	deviceIDs := make([]string, len(devs))
+	for i := range devs {
+		deviceIDs[i] = devs[i].ID
+	}
+	return a.devicesDeleted(userutil.MakeUserID(req.Localpart, a.ServerName), deviceIDs)
+}
+
 func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.PerformDeviceCreationRequest, res *api.PerformDeviceCreationResponse) error {
-	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName)
+	// The account type is stored with the device so that QueryAccessToken
+	// doesn't need to look up the account for every request.
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	if acc.Deactivated {
+		return &api.ErrorForbidden{
+			Message: "account is deactivated",
+		}
+	}
+	dev, err := a.DeviceDB.CreateDevice(
+		ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName,
+		req.RefreshToken, accessTokenExpiresTS(req.AccessTokenLifetimeMS), acc.AccountType,
+	)
 	if err != nil {
 		return err
 	}
@@ -108,6 +265,30 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID})
 }
 
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	dev, err := a.DeviceDB.RefreshDevice(
+		ctx, req.RefreshToken, req.NewAccessToken, req.NewRefreshToken,
+		accessTokenExpiresTS(req.AccessTokenLifetimeMS),
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	res.Device = dev
+	return nil
+}
+
+// accessTokenExpiresTS returns when an access token with the given lifetime
+// which is created now expires, or 0 if the lifetime is 0.
+func accessTokenExpiresTS(lifetimeMS int64) gomatrixserverlib.Timestamp {
+	if lifetimeMS == 0 {
+		return 0
+	}
+	return gomatrixserverlib.AsTimestamp(time.Now().Add(time.Duration(lifetimeMS) * time.Millisecond))
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -121,8 +302,20 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	if err != nil {
 		return err
 	}
+	return a.devicesDeleted(req.UserID, req.DeviceIDs)
+}
+
+// devicesDeleted tells the key server and the sync API that the devices of the
+// user have been logged out.
+func (a *UserInternalAPI) devicesDeleted(userID string, deviceIDs []string) error {
 	// create empty device keys and upload them to delete what was once there and trigger device list changes
-	return a.deviceListUpdate(req.UserID, req.DeviceIDs)
+	if err := a.deviceListUpdate(userID, deviceIDs); err != nil {
+		return err
+	}
+	if a.SyncProducer == nil {
+		return nil
+	}
+	return a.SyncProducer.SendDevicesDeleted(userID, deviceIDs)
 }
 
 func (a *UserInternalAPI) deviceListUpdate(userID string, deviceIDs []string) error {
@@ -177,6 +370,173 @@ func (a *UserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.Perf
 	return nil
 }
 
+func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	if !req.Append {
+		if err := a.AccountDB.RemovePushersByAppIDAndPushKey(ctx, req.Pusher.AppID, req.Pusher.PushKey); err != nil {
+			return err
+		}
+	}
+	return a.AccountDB.UpsertPusher(ctx, req.Localpart, &req.Pusher)
+}
+
+func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	return a.AccountDB.RemovePusher(ctx, req.AppID, req.PushKey, req.Localpart)
+}
+
+func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	res.Pushers = pushers
+	return nil
+}
+
+func (a *UserInternalAPI) PerformNotificationsRead(ctx context.Context, req *api.PerformNotificationsReadRequest, res *api.PerformNotificationsReadResponse) error {
+	if err := a.AccountDB.SetNotificationsRead(ctx, req.Localpart, req.RoomID); err != nil {
+		return err
+	}
+	if a.SyncProducer == nil {
+		return nil
+	}
+	userID := userutil.MakeUserID(req.Localpart, a.ServerName)
+	return a.SyncProducer.SendNotificationData(userID, req.RoomID)
+}
+
+func (a *UserInternalAPI) QueryNotifications(ctx context.Context, req *api.QueryNotificationsRequest, res *api.QueryNotificationsResponse) error {
+	fromID := int64(math.MaxInt64)
+	if req.From != "" {
+		var err error
+		if fromID, err = strconv.ParseInt(req.From, 10, 64); err != nil {
+			return fmt.Errorf("invalid pagination token %q: %w", req.From, err)
+		}
+	}
+	notifications, lastID, err := a.AccountDB.GetNotifications(ctx, req.Localpart, fromID, req.Limit, req.OnlyHighlight)
+	if err != nil {
+		return err
+	}
+	res.Notifications = notifications
+	if len(notifications) == req.Limit {
+		res.NextToken = strconv.FormatInt(lastID, 10)
+	}
+	return nil
+}
+
+func (a *UserInternalAPI) QueryNotificationCounts(ctx context.Context, req *api.QueryNotificationCountsRequest, res *api.QueryNotificationCountsResponse) error {
+	counts, err := a.AccountDB.GetRoomNotificationCounts(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	res.RoomCounts = counts
+	return nil
+}
+
+func (a *UserInternalAPI) PerformThreePIDSessionCreation(ctx context.Context, req *api.PerformThreePIDSessionCreationRequest, res *api.PerformThreePIDSessionCreationResponse) error {
+	now := time.Now()
+	session, token, err := a.AccountDB.GetThreePIDSessionByAddress(ctx, req.ClientSecret, req.Medium, req.Address)
+	if err != nil {
+		return err
+	}
+	if session != nil && now.Before(session.ExpiresTS.Time()) {
+		// The client is retrying a request that it has already made, so only
+		// send the token again if it has asked for that.
+		res.SID = session.SID
+		if req.SendAttempt > session.SendAttempt {
+			if err = a.AccountDB.UpdateThreePIDSessionSendAttempt(ctx, session.SID, req.SendAttempt); err != nil {
+				return err
+			}
+			res.Token = token
+		}
+		return nil
+	}
+
+	session = &api.ThreePIDSession{
+		ClientSecret: req.ClientSecret,
+		Medium:       req.Medium,
+		Address:      req.Address,
+		NextLink:     req.NextLink,
+		SendAttempt:  req.SendAttempt,
+		ExpiresTS:    gomatrixserverlib.AsTimestamp(now.Add(time.Duration(req.LifetimeMS) * time.Millisecond)),
+	}
+	if session.SID, err = generateThreePIDSecret(); err != nil {
+		return err
+	}
+	if token, err = generateThreePIDSecret(); err != nil {
+		return err
+	}
+	if err = a.AccountDB.InsertThreePIDSession(ctx, session, token); err != nil {
+		return err
+	}
+	res.SID = session.SID
+	res.Token = token
+	return nil
+}
+
+func (a *UserInternalAPI) PerformThreePIDSessionValidation(ctx context.Context, req *api.PerformThreePIDSessionValidationRequest, res *api.PerformThreePIDSessionValidationResponse) error {
+	session, token, err := a.getThreePIDSession(ctx, req.SID, req.ClientSecret)
+	if err != nil || session == nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(req.Token)) != 1 {
+		return nil
+	}
+	if !session.Validated() {
+		session.ValidatedTS = gomatrixserverlib.AsTimestamp(time.Now())
+		if err = a.AccountDB.ValidateThreePIDSession(ctx, session.SID, session.ValidatedTS); err != nil {
+			return err
+		}
+	}
+	res.Session = session
+	return nil
+}
+
+// PerformThreePIDSessionDeletion removes the 3PID session once it has been
+// used, so that it can't be used again. Sessions which don't exist or were
+// created with a different client secret are left alone.
+func (a *UserInternalAPI) PerformThreePIDSessionDeletion(ctx context.Context, req *api.PerformThreePIDSessionDeletionRequest, res *api.PerformThreePIDSessionDeletionResponse) error {
+	session, _, err := a.getThreePIDSession(ctx, req.SID, req.ClientSecret)
+	if err != nil || session == nil {
+		return err
+	}
+	return a.AccountDB.DeleteThreePIDSession(ctx, session.SID)
+}
+
+func (a *UserInternalAPI) QueryThreePIDSession(ctx context.Context, req *api.QueryThreePIDSessionRequest, res *api.QueryThreePIDSessionResponse) error {
+	session, _, err := a.getThreePIDSession(ctx, req.SID, req.ClientSecret)
+	if err != nil {
+		return err
+	}
+	res.Session = session
+	return nil
+}
+
+// getThreePIDSession returns the 3PID session and its token, or nil if the
+// session doesn't exist, has expired or was created with a different client
+// secret.
+func (a *UserInternalAPI) getThreePIDSession(ctx context.Context, sid, clientSecret string) (*api.ThreePIDSession, string, error) {
+	session, token, err := a.AccountDB.GetThreePIDSession(ctx, sid)
+	if err != nil || session == nil {
+		return nil, "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(session.ClientSecret), []byte(clientSecret)) != 1 {
+		return nil, "", nil
+	}
+	if !time.Now().Before(session.ExpiresTS.Time()) {
+		return nil, "", nil
+	}
+	return session, token, nil
+}
+
+// generateThreePIDSecret returns a random string which is used as the ID or
+// token of a 3PID session.
+func generateThreePIDSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func (a *UserInternalAPI) QueryProfile(ctx context.Context, req *api.QueryProfileRequest, res *api.QueryProfileResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -295,6 +655,17 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	if device.AccessTokenExpiresTS != 0 && device.AccessTokenExpiresTS.Time().Before(time.Now()) {
+		res.Expired = true
+		return nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return err
+	}
+	if a.LastSeen != nil {
+		a.LastSeen.record(localpart, device.ID, req.IPAddr, req.UserAgent)
+	}
 	res.Device = device
 	return nil
 }
@@ -320,6 +691,7 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 		ID: types.AppServiceDeviceID,
 		// AS dummy device has AS's token.
 		AccessToken: token,
+		AccountType: api.AccountTypeUser,
 	}
 
 	localpart, err := userutil.ParseUsernameParam(appServiceUserID, &a.ServerName)
@@ -0,0 +1,131 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// lastSeenFlushInterval is how often the last seen information of devices is
+// written to the database. A device which is used many times during an
+// interval is only written once.
+const lastSeenFlushInterval = time.Minute
+
+// lastSeenFlushTimeout is how long a single flush may spend writing to the
+// database before the remaining updates are given up on.
+const lastSeenFlushTimeout = 30 * time.Second
+
+type lastSeenKey struct {
+	localpart string
+	deviceID  string
+}
+
+type lastSeenInfo struct {
+	ipAddr    string
+	userAgent string
+	ts        gomatrixserverlib.Timestamp
+}
+
+// LastSeenUpdater batches up the last seen information of devices, so that
+// the device database isn't written to on every authenticated request.
+type LastSeenUpdater struct {
+	db       devices.Database
+	mu       sync.Mutex
+	pending  map[lastSeenKey]lastSeenInfo
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewLastSeenUpdater creates a LastSeenUpdater which writes to the given
+// database once every lastSeenFlushInterval until it is stopped.
+func NewLastSeenUpdater(db devices.Database) *LastSeenUpdater {
+	return newLastSeenUpdater(db, lastSeenFlushInterval)
+}
+
+func newLastSeenUpdater(db devices.Database, interval time.Duration) *LastSeenUpdater {
+	u := &LastSeenUpdater{
+		db:      db,
+		pending: make(map[lastSeenKey]lastSeenInfo),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go u.run(interval)
+	return u
+}
+
+func (u *LastSeenUpdater) run(interval time.Duration) {
+	defer close(u.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.flush()
+		case <-u.stop:
+			u.flush()
+			return
+		}
+	}
+}
+
+// Stop writes out any pending last seen information and stops the periodic
+// flushes. It blocks until the pending information has been written. Devices
+// used after Stop has been called are not recorded.
+func (u *LastSeenUpdater) Stop() {
+	u.stopOnce.Do(func() {
+		close(u.stop)
+	})
+	<-u.stopped
+}
+
+// record notes that the device was used just now. Only the latest use of each
+// device is kept until the next flush.
+func (u *LastSeenUpdater) record(localpart, deviceID, ipAddr, userAgent string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending[lastSeenKey{localpart, deviceID}] = lastSeenInfo{
+		ipAddr:    ipAddr,
+		userAgent: userAgent,
+		ts:        gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+}
+
+// flush writes all of the pending last seen information to the database.
+func (u *LastSeenUpdater) flush() {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[lastSeenKey]lastSeenInfo)
+	u.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lastSeenFlushTimeout)
+	defer cancel()
+	for key, info := range pending {
+		if err := u.db.UpdateDeviceLastSeen(
+			ctx, key.localpart, key.deviceID, info.ipAddr, info.userAgent, info.ts,
+		); err != nil {
+			logrus.WithError(err).WithField("device_id", key.deviceID).Error("Failed to update device last seen")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type lastSeenUpdate struct {
+	localpart string
+	deviceID  string
+	ipAddr    string
+	userAgent string
+}
+
+// lastSeenDatabase records the last seen updates written to it, and panics if
+// anything else is called.
+type lastSeenDatabase struct {
+	devices.Database
+	mu      sync.Mutex
+	updates []lastSeenUpdate
+}
+
+func (d *lastSeenDatabase) UpdateDeviceLastSeen(
+	ctx context.Context, localpart, deviceID, ipAddr, userAgent string, lastSeenTS gomatrixserverlib.Timestamp,
+) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.updates = append(d.updates, lastSeenUpdate{localpart, deviceID, ipAddr, userAgent})
+	return nil
+}
+
+func (d *lastSeenDatabase) written() []lastSeenUpdate {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]lastSeenUpdate{}, d.updates...)
+}
+
+func TestLastSeenUpdaterBatches(t *testing.T) {
+	db := &lastSeenDatabase{}
+	// Use an interval long enough that only the explicit flushes write.
+	u := newLastSeenUpdater(db, time.Hour)
+	defer u.Stop()
+
+	// Using a device many times between flushes only writes the latest use.
+	u.record("alice", "device", "10.0.0.1", "first")
+	u.record("alice", "device", "10.0.0.2", "second")
+	u.record("alice", "device", "10.0.0.3", "third")
+	u.flush()
+
+	updates := db.written()
+	if len(updates) != 1 {
+		t.Fatalf("got %d updates, want 1: %+v", len(updates), updates)
+	}
+	want := lastSeenUpdate{"alice", "device", "10.0.0.3", "third"}
+	if updates[0] != want {
+		t.Errorf("got update %+v, want %+v", updates[0], want)
+	}
+
+	// Nothing is written again if the device isn't used until the next flush.
+	u.flush()
+	if updates = db.written(); len(updates) != 1 {
+		t.Errorf("got %d updates after flushing with nothing pending, want 1: %+v", len(updates), updates)
+	}
+}
+
+func TestLastSeenUpdaterFlushesPeriodically(t *testing.T) {
+	db := &lastSeenDatabase{}
+	u := newLastSeenUpdater(db, 10*time.Millisecond)
+	defer u.Stop()
+
+	u.record("alice", "device", "10.0.0.1", "agent")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(db.written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("last seen information was never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLastSeenUpdaterStopFlushes(t *testing.T) {
+	db := &lastSeenDatabase{}
+	u := newLastSeenUpdater(db, time.Hour)
+
+	u.record("alice", "device1", "10.0.0.1", "agent")
+	u.record("bob", "device2", "10.0.0.2", "agent")
+	u.Stop()
+
+	// The pending updates must be written by the time Stop returns, rather
+	// than being dropped.
+	if updates := db.written(); len(updates) != 2 {
+		t.Fatalf("got %d updates after stopping, want 2: %+v", len(updates), updates)
+	}
+	// Stopping again must not block or panic.
+	u.Stop()
+}
@@ -28,17 +28,30 @@ import (
 const (
 	InputAccountDataPath = "/userapi/inputAccountData"
 
-	PerformDeviceCreationPath  = "/userapi/performDeviceCreation"
-	PerformAccountCreationPath = "/userapi/performAccountCreation"
-	PerformDeviceDeletionPath  = "/userapi/performDeviceDeletion"
-	PerformDeviceUpdatePath    = "/userapi/performDeviceUpdate"
-
-	QueryProfilePath        = "/userapi/queryProfile"
-	QueryAccessTokenPath    = "/userapi/queryAccessToken"
-	QueryDevicesPath        = "/userapi/queryDevices"
-	QueryAccountDataPath    = "/userapi/queryAccountData"
-	QueryDeviceInfosPath    = "/userapi/queryDeviceInfos"
-	QuerySearchProfilesPath = "/userapi/querySearchProfiles"
+	PerformDeviceCreationPath            = "/userapi/performDeviceCreation"
+	PerformAccountCreationPath           = "/userapi/performAccountCreation"
+	PerformDeviceDeletionPath            = "/userapi/performDeviceDeletion"
+	PerformTokenRefreshPath              = "/userapi/performTokenRefresh"
+	PerformDeviceUpdatePath              = "/userapi/performDeviceUpdate"
+	PerformPasswordUpdatePath            = "/userapi/performPasswordUpdate"
+	PerformAccountDeactivationPath       = "/userapi/performAccountDeactivation"
+	PerformPusherSetPath                 = "/userapi/performPusherSet"
+	PerformPusherDeletionPath            = "/userapi/performPusherDeletion"
+	PerformNotificationsReadPath         = "/userapi/performNotificationsRead"
+	PerformThreePIDSessionCreationPath   = "/userapi/performThreePIDSessionCreation"
+	PerformThreePIDSessionValidationPath = "/userapi/performThreePIDSessionValidation"
+	PerformThreePIDSessionDeletionPath   = "/userapi/performThreePIDSessionDeletion"
+
+	QueryProfilePath            = "/userapi/queryProfile"
+	QueryAccessTokenPath        = "/userapi/queryAccessToken"
+	QueryDevicesPath            = "/userapi/queryDevices"
+	QueryAccountDataPath        = "/userapi/queryAccountData"
+	QueryDeviceInfosPath        = "/userapi/queryDeviceInfos"
+	QuerySearchProfilesPath     = "/userapi/querySearchProfiles"
+	QueryPushersPath            = "/userapi/queryPushers"
+	QueryNotificationsPath      = "/userapi/queryNotifications"
+	QueryNotificationCountsPath = "/userapi/queryNotificationCounts"
+	QueryThreePIDSessionPath    = "/userapi/queryThreePIDSession"
 )
 
 // NewUserAPIClient creates a UserInternalAPI implemented by talking to a HTTP POST API.
@@ -93,6 +106,18 @@ func (h *httpUserInternalAPI) PerformDeviceCreation(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpUserInternalAPI) PerformTokenRefresh(
+	ctx context.Context,
+	request *api.PerformTokenRefreshRequest,
+	response *api.PerformTokenRefreshResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformTokenRefresh")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformTokenRefreshPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpUserInternalAPI) PerformDeviceDeletion(
 	ctx context.Context,
 	request *api.PerformDeviceDeletionRequest,
@@ -105,6 +130,30 @@ func (h *httpUserInternalAPI) PerformDeviceDeletion(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpUserInternalAPI) PerformPasswordUpdate(
+	ctx context.Context,
+	request *api.PerformPasswordUpdateRequest,
+	response *api.PerformPasswordUpdateResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPasswordUpdate")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPasswordUpdatePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformAccountDeactivation(
+	ctx context.Context,
+	request *api.PerformAccountDeactivationRequest,
+	response *api.PerformAccountDeactivationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAccountDeactivation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformAccountDeactivationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpUserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.PerformDeviceUpdateRequest, res *api.PerformDeviceUpdateResponse) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceUpdate")
 	defer span.Finish()
@@ -172,3 +221,83 @@ func (h *httpUserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.
 	apiURL := h.apiURL + QuerySearchProfilesPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
+
+func (h *httpUserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherSet")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherSetPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPushers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPushersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformNotificationsRead(ctx context.Context, req *api.PerformNotificationsReadRequest, res *api.PerformNotificationsReadResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformNotificationsRead")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformNotificationsReadPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryNotifications(ctx context.Context, req *api.QueryNotificationsRequest, res *api.QueryNotificationsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryNotifications")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryNotificationsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryNotificationCounts(ctx context.Context, req *api.QueryNotificationCountsRequest, res *api.QueryNotificationCountsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryNotificationCounts")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryNotificationCountsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformThreePIDSessionCreation(ctx context.Context, req *api.PerformThreePIDSessionCreationRequest, res *api.PerformThreePIDSessionCreationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformThreePIDSessionCreation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformThreePIDSessionCreationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformThreePIDSessionValidation(ctx context.Context, req *api.PerformThreePIDSessionValidationRequest, res *api.PerformThreePIDSessionValidationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformThreePIDSessionValidation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformThreePIDSessionValidationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformThreePIDSessionDeletion(ctx context.Context, req *api.PerformThreePIDSessionDeletionRequest, res *api.PerformThreePIDSessionDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformThreePIDSessionDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformThreePIDSessionDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryThreePIDSession(ctx context.Context, req *api.QueryThreePIDSessionRequest, res *api.QueryThreePIDSessionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryThreePIDSession")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryThreePIDSessionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
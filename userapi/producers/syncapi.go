@@ -0,0 +1,80 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/userapi/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncAPI produces messages for the sync API server to consume
+type SyncAPI struct {
+	Topic               string
+	DevicesDeletedTopic string
+	Producer            sarama.SyncProducer
+}
+
+// SendNotificationData tells the sync API server that the unread notification
+// counts of the user in the room have changed.
+func (p *SyncAPI) SendNotificationData(userID, roomID string) error {
+	value, err := json.Marshal(api.OutputNotificationData{
+		UserID: userID,
+		RoomID: roomID,
+	})
+	if err != nil {
+		return err
+	}
+
+	var m sarama.ProducerMessage
+	m.Topic = p.Topic
+	m.Key = sarama.StringEncoder(userID)
+	m.Value = sarama.ByteEncoder(value)
+
+	log.WithFields(log.Fields{
+		"user_id": userID,
+		"room_id": roomID,
+	}).Debugf("Producing to topic '%s'", p.Topic)
+
+	_, _, err = p.Producer.SendMessage(&m)
+	return err
+}
+
+// SendDevicesDeleted tells the sync API server that the devices of the user
+// have been logged out.
+func (p *SyncAPI) SendDevicesDeleted(userID string, deviceIDs []string) error {
+	value, err := json.Marshal(api.OutputDevicesDeleted{
+		UserID:    userID,
+		DeviceIDs: deviceIDs,
+	})
+	if err != nil {
+		return err
+	}
+
+	var m sarama.ProducerMessage
+	m.Topic = p.DevicesDeletedTopic
+	m.Key = sarama.StringEncoder(userID)
+	m.Value = sarama.ByteEncoder(value)
+
+	log.WithFields(log.Fields{
+		"user_id":    userID,
+		"device_ids": deviceIDs,
+	}).Debugf("Producing to topic '%s'", p.DevicesDeletedTopic)
+
+	_, _, err = p.Producer.SendMessage(&m)
+	return err
+}
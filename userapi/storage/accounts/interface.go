@@ -22,18 +22,28 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
 	internal.PartitionStorer
 	GetAccountByPassword(ctx context.Context, localpart, plaintextPassword string) (*api.Account, error)
+	// SetPassword hashes the given plaintext password and sets it as the
+	// password of the account. Returns sql.ErrNoRows if there is no account.
+	SetPassword(ctx context.Context, localpart, plaintextPassword string) error
+	// UpgradeGuestAccount turns a guest account into a full user account
+	// with the given password.
+	UpgradeGuestAccount(ctx context.Context, localpart, plaintextPassword string) error
+	// DeactivateAccount marks the account as deactivated, after which
+	// GetAccountByPassword will no longer return it.
+	DeactivateAccount(ctx context.Context, localpart string) (err error)
 	GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error)
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
 	// CreateAccount makes a new account with the given login name and password, and creates an empty profile
 	// for this account. If no password is supplied, the account will be a passwordless account. If the
 	// account already exists, it will return nil, ErrUserExists.
-	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string) (*api.Account, error)
+	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string, accountType api.AccountType) (*api.Account, error)
 	CreateGuestAccount(ctx context.Context) (*api.Account, error)
 	SaveAccountData(ctx context.Context, localpart, roomID, dataType string, content json.RawMessage) error
 	GetAccountData(ctx context.Context, localpart string) (global map[string]json.RawMessage, rooms map[string]map[string]json.RawMessage, err error)
@@ -47,9 +57,58 @@ type Database interface {
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
 	GetLocalpartForThreePID(ctx context.Context, threepid string, medium string) (localpart string, err error)
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
+	// SaveSSOAssociation associates the user with the given subject at the
+	// single sign-on provider with the given issuer with the local account.
+	// Returns an error if they are already associated with an account.
+	SaveSSOAssociation(ctx context.Context, issuer, subject, localpart string) error
+	// GetLocalpartForSSOID returns the localpart of the account that the single
+	// sign-on user is associated with, or "" if there isn't one.
+	GetLocalpartForSSOID(ctx context.Context, issuer, subject string) (string, error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
+	// UpsertPusher creates or updates the pusher of the given user, which
+	// is identified by its app ID and pushkey.
+	UpsertPusher(ctx context.Context, localpart string, pusher *api.Pusher) error
+	// GetPushers returns all of the pushers of the given user.
+	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
+	// RemovePusher removes the pusher with the given app ID and pushkey
+	// from the given user.
+	RemovePusher(ctx context.Context, appID, pushKey, localpart string) error
+	// RemovePushersByAppIDAndPushKey removes the pushers with the given app
+	// ID and pushkey from all users.
+	RemovePushersByAppIDAndPushKey(ctx context.Context, appID, pushKey string) error
+	// InsertNotification stores a notification about an event for the given
+	// user. Storing a second notification for the same event does nothing.
+	InsertNotification(ctx context.Context, localpart, eventID string, highlight bool, n *api.Notification) error
+	// GetNotifications returns up to limit of the most recent notifications
+	// of the user that are older than fromID, along with the ID of the last
+	// notification returned.
+	GetNotifications(ctx context.Context, localpart string, fromID int64, limit int, onlyHighlight bool) ([]*api.Notification, int64, error)
+	// GetRoomNotificationCounts returns the number of unread notifications
+	// of the user in each room that has any.
+	GetRoomNotificationCounts(ctx context.Context, localpart string) (map[string]api.NotificationCounts, error)
+	// SetNotificationsRead marks all of the notifications of the user in the
+	// given room as read.
+	SetNotificationsRead(ctx context.Context, localpart, roomID string) error
+	// InsertThreePIDSession stores a new 3PID session along with the token
+	// which validates it.
+	InsertThreePIDSession(ctx context.Context, session *api.ThreePIDSession, token string) error
+	// GetThreePIDSession returns the 3PID session with the given ID and its
+	// token, or nil if there is no such session.
+	GetThreePIDSession(ctx context.Context, sid string) (*api.ThreePIDSession, string, error)
+	// GetThreePIDSessionByAddress returns the latest 3PID session which was
+	// created with the given client secret for the given 3PID and its token,
+	// or nil if there is no such session.
+	GetThreePIDSessionByAddress(ctx context.Context, clientSecret, medium, address string) (*api.ThreePIDSession, string, error)
+	// UpdateThreePIDSessionSendAttempt records the latest send attempt of the
+	// 3PID session.
+	UpdateThreePIDSessionSendAttempt(ctx context.Context, sid string, sendAttempt int) error
+	// ValidateThreePIDSession marks the 3PID session as validated.
+	ValidateThreePIDSession(ctx context.Context, sid string, validatedTS gomatrixserverlib.Timestamp) error
+	// DeleteThreePIDSession removes the 3PID session, so that it can't be
+	// used again.
+	DeleteThreePIDSession(ctx context.Context, sid string) error
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
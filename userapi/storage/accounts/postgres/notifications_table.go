@@ -0,0 +1,161 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const notificationsSchema = `
+-- Stores the notifications that were generated for a user by their push rules
+CREATE TABLE IF NOT EXISTS account_notifications (
+	-- An incrementing ID which is used to paginate through notifications
+	id BIGSERIAL PRIMARY KEY,
+	-- The Matrix user ID localpart for the user who was notified
+	localpart TEXT NOT NULL,
+	-- The room and event that the user was notified about
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- Whether the notification should be highlighted, e.g. for mentions
+	highlight BOOLEAN NOT NULL,
+	-- Whether the user has read the room since they were notified
+	read BOOLEAN NOT NULL DEFAULT FALSE,
+	-- The JSON encoded notification
+	notification_json TEXT NOT NULL,
+
+	CONSTRAINT account_notifications_unique UNIQUE (localpart, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS account_notifications_localpart_room_id ON account_notifications(localpart, room_id);
+`
+
+const insertNotificationSQL = "" +
+	"INSERT INTO account_notifications (localpart, room_id, event_id, highlight, notification_json)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT account_notifications_unique DO NOTHING"
+
+const selectNotificationsSQL = "" +
+	"SELECT id, read, notification_json FROM account_notifications" +
+	" WHERE localpart = $1 AND id < $2 AND (highlight OR NOT $3)" +
+	" ORDER BY id DESC LIMIT $4"
+
+const selectRoomNotificationCountsSQL = "" +
+	"SELECT room_id, COUNT(*), COALESCE(SUM(CASE WHEN highlight THEN 1 ELSE 0 END), 0)" +
+	" FROM account_notifications WHERE localpart = $1 AND NOT read" +
+	" GROUP BY room_id"
+
+const updateNotificationsReadSQL = "" +
+	"UPDATE account_notifications SET read = TRUE" +
+	" WHERE localpart = $1 AND room_id = $2 AND NOT read"
+
+type notificationsStatements struct {
+	insertNotificationStmt           *sql.Stmt
+	selectNotificationsStmt          *sql.Stmt
+	selectRoomNotificationCountsStmt *sql.Stmt
+	updateNotificationsReadStmt      *sql.Stmt
+}
+
+func (s *notificationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(notificationsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertNotificationStmt, err = db.Prepare(insertNotificationSQL); err != nil {
+		return
+	}
+	if s.selectNotificationsStmt, err = db.Prepare(selectNotificationsSQL); err != nil {
+		return
+	}
+	if s.selectRoomNotificationCountsStmt, err = db.Prepare(selectRoomNotificationCountsSQL); err != nil {
+		return
+	}
+	if s.updateNotificationsReadStmt, err = db.Prepare(updateNotificationsReadSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *notificationsStatements) insertNotification(
+	ctx context.Context, txn *sql.Tx, localpart, eventID string, highlight bool, n *api.Notification,
+) error {
+	notificationJSON, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertNotificationStmt)
+	_, err = stmt.ExecContext(ctx, localpart, n.RoomID, eventID, highlight, string(notificationJSON))
+	return err
+}
+
+func (s *notificationsStatements) selectNotifications(
+	ctx context.Context, localpart string, fromID int64, limit int, onlyHighlight bool,
+) (notifications []*api.Notification, lastID int64, err error) {
+	rows, err := s.selectNotificationsStmt.QueryContext(ctx, localpart, fromID, onlyHighlight, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectNotifications: rows.close() failed")
+
+	notifications = []*api.Notification{}
+	for rows.Next() {
+		var read bool
+		var notificationJSON string
+		if err = rows.Scan(&lastID, &read, &notificationJSON); err != nil {
+			return nil, 0, err
+		}
+		var n api.Notification
+		if err = json.Unmarshal([]byte(notificationJSON), &n); err != nil {
+			return nil, 0, err
+		}
+		n.Read = read
+		notifications = append(notifications, &n)
+	}
+	return notifications, lastID, rows.Err()
+}
+
+func (s *notificationsStatements) selectRoomNotificationCounts(
+	ctx context.Context, localpart string,
+) (map[string]api.NotificationCounts, error) {
+	rows, err := s.selectRoomNotificationCountsStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomNotificationCounts: rows.close() failed")
+
+	counts := make(map[string]api.NotificationCounts)
+	for rows.Next() {
+		var roomID string
+		var c api.NotificationCounts
+		if err = rows.Scan(&roomID, &c.NotificationCount, &c.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts[roomID] = c
+	}
+	return counts, rows.Err()
+}
+
+func (s *notificationsStatements) updateNotificationsRead(
+	ctx context.Context, txn *sql.Tx, localpart, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateNotificationsReadStmt)
+	_, err := stmt.ExecContext(ctx, localpart, roomID)
+	return err
+}
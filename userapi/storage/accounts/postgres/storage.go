@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -35,11 +36,15 @@ import (
 type Database struct {
 	db *sql.DB
 	sqlutil.PartitionOffsetStatements
-	accounts     accountsStatements
-	profiles     profilesStatements
-	accountDatas accountDataStatements
-	threepids    threepidStatements
-	serverName   gomatrixserverlib.ServerName
+	accounts      accountsStatements
+	profiles      profilesStatements
+	accountDatas  accountDataStatements
+	threepids     threepidStatements
+	pushers       pushersStatements
+	notifications notificationsStatements
+	sessions      threepidSessionsStatements
+	ssoIDs        ssoIDsStatements
+	serverName    gomatrixserverlib.ServerName
 }
 
 // NewDatabase creates a new accounts and profiles database
@@ -69,7 +74,23 @@ func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, serve
 	if err = t.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, ac, t, serverName}, nil
+	ps := pushersStatements{}
+	if err = ps.prepare(db); err != nil {
+		return nil, err
+	}
+	n := notificationsStatements{}
+	if err = n.prepare(db); err != nil {
+		return nil, err
+	}
+	ts := threepidSessionsStatements{}
+	if err = ts.prepare(db); err != nil {
+		return nil, err
+	}
+	sso := ssoIDsStatements{}
+	if err = sso.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, a, p, ac, t, ps, n, ts, sso, serverName}, nil
 }
 
 // GetAccountByPassword returns the account associated with the given localpart and password.
@@ -87,6 +108,35 @@ func (d *Database) GetAccountByPassword(
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
+// SetPassword hashes the given plaintext password and sets it as the account
+// password. Returns sql.ErrNoRows if there is no account with the localpart.
+func (d *Database) SetPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.updatePassword(ctx, localpart, hash)
+}
+
+// UpgradeGuestAccount turns the guest account into a full user account with
+// the given password. Returns sql.ErrNoRows if the account isn't a guest.
+func (d *Database) UpgradeGuestAccount(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.upgradeGuestAccount(ctx, localpart, hash)
+}
+
+// DeactivateAccount deactivates the user's account, removing all ability for the user to login again.
+func (d *Database) DeactivateAccount(ctx context.Context, localpart string) (err error) {
+	return d.accounts.deactivateAccount(ctx, localpart)
+}
+
 // GetProfileByLocalpart returns the profile associated with the given localpart.
 // Returns sql.ErrNoRows if no profile exists which matches the given localpart.
 func (d *Database) GetProfileByLocalpart(
@@ -121,7 +171,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", api.AccountTypeGuest)
 		return err
 	})
 	return acc, err
@@ -131,17 +181,17 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 // for this account. If no password is supplied, the account will be a passwordless account. If the
 // account already exists, it will return nil, sqlutil.ErrUserExists.
 func (d *Database) CreateAccount(
-	ctx context.Context, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (acc *api.Account, err error) {
 	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, accountType)
 		return err
 	})
 	return
 }
 
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	var err error
 
@@ -171,7 +221,7 @@ func (d *Database) createAccount(
 	}`)); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, accountType)
 }
 
 // SaveAccountData saves new account data for a given user and a given room.
@@ -280,6 +330,37 @@ func (d *Database) GetThreePIDsForLocalpart(
 	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart)
 }
 
+// ErrSSOIDInUse is the error returned when trying to associate a single sign-on
+// user with an account when they are already associated with one.
+var ErrSSOIDInUse = errors.New("This single sign-on user is already associated with an account")
+
+// SaveSSOAssociation associates the user with the given subject at the single
+// sign-on provider with the given issuer with the local account. If the user
+// is already associated with an account, returns ErrSSOIDInUse.
+func (d *Database) SaveSSOAssociation(
+	ctx context.Context, issuer, subject, localpart string,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		existing, err := d.ssoIDs.selectLocalpartForSSOID(ctx, txn, issuer, subject)
+		if err != nil {
+			return err
+		}
+		if existing != "" {
+			return ErrSSOIDInUse
+		}
+		return d.ssoIDs.insertSSOID(ctx, txn, issuer, subject, localpart)
+	})
+}
+
+// GetLocalpartForSSOID returns the localpart of the account that the user with
+// the given subject at the single sign-on provider with the given issuer is
+// associated with, or an empty string if they aren't associated with one.
+func (d *Database) GetLocalpartForSSOID(
+	ctx context.Context, issuer, subject string,
+) (string, error) {
+	return d.ssoIDs.selectLocalpartForSSOID(ctx, nil, issuer, subject)
+}
+
 // CheckAccountAvailability checks if the username/localpart is already present
 // in the database.
 // If the DB returns sql.ErrNoRows the Localpart isn't taken.
@@ -305,3 +386,118 @@ func (d *Database) SearchProfiles(ctx context.Context, searchString string, limi
 ) ([]authtypes.Profile, error) {
 	return d.profiles.selectProfilesBySearch(ctx, searchString, limit)
 }
+
+// UpsertPusher creates or updates the pusher of the given user, which is
+// identified by its app ID and pushkey.
+func (d *Database) UpsertPusher(
+	ctx context.Context, localpart string, pusher *api.Pusher,
+) error {
+	return d.pushers.upsertPusher(ctx, nil, localpart, pusher)
+}
+
+// GetPushers returns all of the pushers of the given user.
+func (d *Database) GetPushers(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	return d.pushers.selectPushersByLocalpart(ctx, localpart)
+}
+
+// RemovePusher removes the pusher with the given app ID and pushkey from
+// the given user. If the pusher doesn't exist, returns nothing.
+func (d *Database) RemovePusher(
+	ctx context.Context, appID, pushKey, localpart string,
+) error {
+	return d.pushers.deletePusher(ctx, nil, appID, pushKey, localpart)
+}
+
+// RemovePushersByAppIDAndPushKey removes the pushers with the given app ID
+// and pushkey from all users.
+func (d *Database) RemovePushersByAppIDAndPushKey(
+	ctx context.Context, appID, pushKey string,
+) error {
+	return d.pushers.deletePushersByAppIDAndPushKey(ctx, nil, appID, pushKey)
+}
+
+// InsertNotification stores a notification about an event for the given
+// user. Storing a second notification for the same event does nothing.
+func (d *Database) InsertNotification(
+	ctx context.Context, localpart, eventID string, highlight bool, n *api.Notification,
+) error {
+	return d.notifications.insertNotification(ctx, nil, localpart, eventID, highlight, n)
+}
+
+// GetNotifications returns up to limit of the most recent notifications of
+// the user that are older than fromID, along with the ID of the last
+// notification returned.
+func (d *Database) GetNotifications(
+	ctx context.Context, localpart string, fromID int64, limit int, onlyHighlight bool,
+) ([]*api.Notification, int64, error) {
+	return d.notifications.selectNotifications(ctx, localpart, fromID, limit, onlyHighlight)
+}
+
+// GetRoomNotificationCounts returns the number of unread notifications of
+// the user in each room that has any.
+func (d *Database) GetRoomNotificationCounts(
+	ctx context.Context, localpart string,
+) (map[string]api.NotificationCounts, error) {
+	return d.notifications.selectRoomNotificationCounts(ctx, localpart)
+}
+
+// SetNotificationsRead marks all of the notifications of the user in the
+// given room as read.
+func (d *Database) SetNotificationsRead(
+	ctx context.Context, localpart, roomID string,
+) error {
+	return d.notifications.updateNotificationsRead(ctx, nil, localpart, roomID)
+}
+
+// InsertThreePIDSession stores a new 3PID session along with the token which
+// validates it, removing any sessions which have expired.
+func (d *Database) InsertThreePIDSession(
+	ctx context.Context, session *api.ThreePIDSession, token string,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.sessions.deleteExpiredThreePIDSessions(ctx, txn, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		return d.sessions.insertThreePIDSession(ctx, txn, session, token)
+	})
+}
+
+// GetThreePIDSession returns the 3PID session with the given ID and its token,
+// or nil if there is no such session.
+func (d *Database) GetThreePIDSession(
+	ctx context.Context, sid string,
+) (*api.ThreePIDSession, string, error) {
+	return d.sessions.selectThreePIDSession(ctx, sid)
+}
+
+// GetThreePIDSessionByAddress returns the latest 3PID session which was
+// created with the given client secret for the given 3PID and its token, or
+// nil if there is no such session.
+func (d *Database) GetThreePIDSessionByAddress(
+	ctx context.Context, clientSecret, medium, address string,
+) (*api.ThreePIDSession, string, error) {
+	return d.sessions.selectThreePIDSessionByAddress(ctx, clientSecret, medium, address)
+}
+
+// UpdateThreePIDSessionSendAttempt records the latest send attempt of the
+// 3PID session.
+func (d *Database) UpdateThreePIDSessionSendAttempt(
+	ctx context.Context, sid string, sendAttempt int,
+) error {
+	return d.sessions.updateThreePIDSessionSendAttempt(ctx, nil, sid, sendAttempt)
+}
+
+// ValidateThreePIDSession marks the 3PID session as validated.
+func (d *Database) ValidateThreePIDSession(
+	ctx context.Context, sid string, validatedTS gomatrixserverlib.Timestamp,
+) error {
+	return d.sessions.updateThreePIDSessionValidated(ctx, nil, sid, validatedTS)
+}
+
+// DeleteThreePIDSession removes the 3PID session, so that it can't be used
+// again.
+func (d *Database) DeleteThreePIDSession(ctx context.Context, sid string) error {
+	return d.sessions.deleteThreePIDSession(ctx, nil, sid)
+}
@@ -37,32 +37,46 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- The password hash for this account. Can be NULL if this is a passwordless account.
     password_hash TEXT,
     -- Identifies which application service this account belongs to, if any.
-    appservice_id TEXT
+    appservice_id TEXT,
+    -- Whether the account has been deactivated, in which case it can no longer log in
+    is_deactivated BOOLEAN DEFAULT FALSE,
+    -- The type of the account: 1 for users and 2 for guests, see api.AccountType.
+    account_type SMALLINT NOT NULL
     -- TODO:
-    -- is_guest, is_admin, upgraded_ts, devices, any email reset stuff?
+    -- is_admin, upgraded_ts, devices, any email reset stuff?
 );
 `
 
 const insertAccountSQL = "" +
-	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4)"
+	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id, account_type) VALUES ($1, $2, $3, $4, $5)"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, appservice_id, account_type, is_deactivated FROM account_accounts WHERE localpart = $1"
 
 const selectPasswordHashSQL = "" +
-	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
+	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND is_deactivated = FALSE"
+
+const updatePasswordSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2"
+
+const upgradeGuestAccountSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1, account_type = $2 WHERE localpart = $3 AND account_type = $4"
+
+const deactivateAccountSQL = "" +
+	"UPDATE account_accounts SET is_deactivated = TRUE WHERE localpart = $1"
 
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COUNT(localpart) FROM account_accounts"
 
-// TODO: Update password
-
 type accountsStatements struct {
 	db                            *sql.DB
 	writer                        *sqlutil.TransactionWriter
 	insertAccountStmt             *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
+	updatePasswordStmt            *sql.Stmt
+	deactivateAccountStmt         *sql.Stmt
+	upgradeGuestAccountStmt       *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
 }
@@ -74,6 +88,14 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if err != nil {
 		return
 	}
+	// Add the columns which didn't exist when the table was first created.
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "account_accounts", "is_deactivated", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return
+	}
+	// Accounts created before there were guests are all user accounts.
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "account_accounts", "account_type", "SMALLINT NOT NULL DEFAULT 1"); err != nil {
+		return
+	}
 	if s.insertAccountStmt, err = db.Prepare(insertAccountSQL); err != nil {
 		return
 	}
@@ -83,6 +105,15 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectPasswordHashStmt, err = db.Prepare(selectPasswordHashSQL); err != nil {
 		return
 	}
+	if s.updatePasswordStmt, err = db.Prepare(updatePasswordSQL); err != nil {
+		return
+	}
+	if s.deactivateAccountStmt, err = db.Prepare(deactivateAccountSQL); err != nil {
+		return
+	}
+	if s.upgradeGuestAccountStmt, err = db.Prepare(upgradeGuestAccountSQL); err != nil {
+		return
+	}
 	if s.selectNewNumericLocalpartStmt, err = db.Prepare(selectNewNumericLocalpartSQL); err != nil {
 		return
 	}
@@ -94,7 +125,7 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 // this account will be passwordless. Returns an error if this account already exists. Returns the account
 // on success.
 func (s *accountsStatements) insertAccount(
-	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	stmt := s.insertAccountStmt
@@ -102,9 +133,9 @@ func (s *accountsStatements) insertAccount(
 	err := s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
 		var err error
 		if appserviceID == "" {
-			_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, nil)
+			_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, nil, accountType)
 		} else {
-			_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID)
+			_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID, accountType)
 		}
 		return err
 	})
@@ -117,6 +148,7 @@ func (s *accountsStatements) insertAccount(
 		UserID:       userutil.MakeUserID(localpart, s.serverName),
 		ServerName:   s.serverName,
 		AppServiceID: appserviceID,
+		AccountType:  accountType,
 	}, nil
 }
 
@@ -127,14 +159,63 @@ func (s *accountsStatements) selectPasswordHash(
 	return
 }
 
+// updatePassword sets the password hash of the account. Returns sql.ErrNoRows
+// if there is no account with the localpart.
+func (s *accountsStatements) updatePassword(
+	ctx context.Context, localpart, passwordHash string,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		res, err := txn.Stmt(s.updatePasswordStmt).ExecContext(ctx, passwordHash, localpart)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// upgradeGuestAccount turns a guest account into a user account with the given
+// password hash. Returns sql.ErrNoRows if there is no guest account with the
+// localpart.
+func (s *accountsStatements) upgradeGuestAccount(
+	ctx context.Context, localpart, passwordHash string,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		res, err := txn.Stmt(s.upgradeGuestAccountStmt).ExecContext(ctx, passwordHash, api.AccountTypeUser, localpart, api.AccountTypeGuest)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+func (s *accountsStatements) deactivateAccount(
+	ctx context.Context, localpart string,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		_, err := txn.Stmt(s.deactivateAccountStmt).ExecContext(ctx, localpart)
+		return err
+	})
+}
+
 func (s *accountsStatements) selectAccountByLocalpart(
 	ctx context.Context, localpart string,
 ) (*api.Account, error) {
 	var appserviceIDPtr sql.NullString
+	var deactivated sql.NullBool
 	var acc api.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr)
+	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr, &acc.AccountType, &deactivated)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
@@ -144,6 +225,7 @@ func (s *accountsStatements) selectAccountByLocalpart(
 	if appserviceIDPtr.Valid {
 		acc.AppServiceID = appserviceIDPtr.String
 	}
+	acc.Deactivated = deactivated.Bool
 
 	acc.UserID = userutil.MakeUserID(localpart, s.serverName)
 	acc.ServerName = s.serverName
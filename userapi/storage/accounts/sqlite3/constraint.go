@@ -23,5 +23,11 @@ import (
 )
 
 func isConstraintError(err error) bool {
+	// The driver returns sqlite3.Error values, which don't match the bare
+	// error code with errors.Is, so compare the code itself.
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrConstraint
+	}
 	return errors.Is(err, sqlite3.ErrConstraint)
 }
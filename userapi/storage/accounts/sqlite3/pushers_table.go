@@ -0,0 +1,165 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const pushersSchema = `
+-- Stores the pushers that deliver notifications to a user's devices
+CREATE TABLE IF NOT EXISTS account_pushers (
+	-- The Matrix user ID localpart for the user who owns this pusher
+	localpart TEXT NOT NULL,
+	-- The pushkey which identifies the device to the push gateway
+	pushkey TEXT NOT NULL,
+	-- When the pushkey was last updated, in milliseconds since the epoch
+	pushkey_ts_ms BIGINT NOT NULL,
+	-- The kind of pusher, e.g. http
+	kind TEXT NOT NULL,
+	-- The reverse-DNS style identifier of the application
+	app_id TEXT NOT NULL,
+	-- Human readable names of the application and device
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	-- The profile tag, which selects the device-specific push rules
+	profile_tag TEXT NOT NULL,
+	-- The preferred language for notifications
+	lang TEXT NOT NULL,
+	-- The JSON encoded pusher data, which includes the push gateway URL
+	data TEXT NOT NULL,
+
+	UNIQUE (app_id, pushkey, localpart)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_localpart ON account_pushers(localpart);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (app_id, pushkey, localpart)" +
+	" DO UPDATE SET pushkey_ts_ms = $3, kind = $4, app_display_name = $6, device_display_name = $7, profile_tag = $8, lang = $9, data = $10"
+
+const selectPushersByLocalpartSQL = "" +
+	"SELECT pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = $1"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart = $3"
+
+const deletePushersByAppIDAndPushKeySQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2"
+
+type pushersStatements struct {
+	db                                 *sql.DB
+	writer                             *sqlutil.TransactionWriter
+	upsertPusherStmt                   *sql.Stmt
+	selectPushersByLocalpartStmt       *sql.Stmt
+	deletePusherStmt                   *sql.Stmt
+	deletePushersByAppIDAndPushKeyStmt *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+	s.writer = sqlutil.NewTransactionWriter()
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.selectPushersByLocalpartStmt, err = db.Prepare(selectPushersByLocalpartSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deletePushersByAppIDAndPushKeyStmt, err = db.Prepare(deletePushersByAppIDAndPushKeySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart string, pusher *api.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.upsertPusherStmt)
+		_, err := stmt.ExecContext(
+			ctx, localpart, pusher.PushKey, pusher.PushKeyTS, pusher.Kind, pusher.AppID,
+			pusher.AppDisplayName, pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Language, string(data),
+		)
+		return err
+	})
+}
+
+func (s *pushersStatements) selectPushersByLocalpart(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	rows, err := s.selectPushersByLocalpartStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPushersByLocalpart: rows.close() failed")
+
+	pushers := []api.Pusher{}
+	for rows.Next() {
+		var pusher api.Pusher
+		var data string
+		if err = rows.Scan(
+			&pusher.PushKey, &pusher.PushKeyTS, &pusher.Kind, &pusher.AppID, &pusher.AppDisplayName,
+			&pusher.DeviceDisplayName, &pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, appID, pushKey, localpart string,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deletePusherStmt)
+		_, err := stmt.ExecContext(ctx, appID, pushKey, localpart)
+		return err
+	})
+}
+
+func (s *pushersStatements) deletePushersByAppIDAndPushKey(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deletePushersByAppIDAndPushKeyStmt)
+		_, err := stmt.ExecContext(ctx, appID, pushKey)
+		return err
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const ssoIDsSchema = `
+-- Stores which account each user of a single sign-on provider logs in as
+CREATE TABLE IF NOT EXISTS account_sso_ids (
+	-- The issuer of the provider
+	issuer TEXT NOT NULL,
+	-- The provider's stable identifier for the user, i.e. the "sub" claim
+	subject TEXT NOT NULL,
+	-- The localpart of the Matrix user ID that the user logs in as
+	localpart TEXT NOT NULL,
+
+	PRIMARY KEY(issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS account_sso_ids_localpart ON account_sso_ids(localpart);
+`
+
+const selectLocalpartForSSOIDSQL = "" +
+	"SELECT localpart FROM account_sso_ids WHERE issuer = $1 AND subject = $2"
+
+const insertSSOIDSQL = "" +
+	"INSERT INTO account_sso_ids (issuer, subject, localpart) VALUES ($1, $2, $3)"
+
+type ssoIDsStatements struct {
+	db                          *sql.DB
+	writer                      *sqlutil.TransactionWriter
+	selectLocalpartForSSOIDStmt *sql.Stmt
+	insertSSOIDStmt             *sql.Stmt
+}
+
+func (s *ssoIDsStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+	s.writer = sqlutil.NewTransactionWriter()
+	_, err = db.Exec(ssoIDsSchema)
+	if err != nil {
+		return
+	}
+	if s.selectLocalpartForSSOIDStmt, err = db.Prepare(selectLocalpartForSSOIDSQL); err != nil {
+		return
+	}
+	if s.insertSSOIDStmt, err = db.Prepare(insertSSOIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *ssoIDsStatements) selectLocalpartForSSOID(
+	ctx context.Context, txn *sql.Tx, issuer, subject string,
+) (localpart string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLocalpartForSSOIDStmt)
+	err = stmt.QueryRowContext(ctx, issuer, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+func (s *ssoIDsStatements) insertSSOID(
+	ctx context.Context, txn *sql.Tx, issuer, subject, localpart string,
+) (err error) {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.insertSSOIDStmt)
+		_, err := stmt.ExecContext(ctx, issuer, subject, localpart)
+		return err
+	})
+}
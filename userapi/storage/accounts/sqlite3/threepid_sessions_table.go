@@ -0,0 +1,204 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const threepidSessionsSchema = `
+-- Stores attempts to verify that users own third party identifiers
+CREATE TABLE IF NOT EXISTS account_threepid_sessions (
+	-- The ID of the session
+	sid TEXT NOT NULL PRIMARY KEY,
+	-- The secret that the client created the session with
+	client_secret TEXT NOT NULL,
+	-- The 3PID medium and address
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	-- The token which was sent to the address to validate the session
+	token TEXT NOT NULL,
+	-- Where to send the user after they validate the session
+	next_link TEXT NOT NULL,
+	-- The highest send attempt the client has made
+	send_attempt INTEGER NOT NULL,
+	-- When the session was validated, in milliseconds since the epoch,
+	-- or 0 if it hasn't been
+	validated_ts BIGINT NOT NULL DEFAULT 0,
+	-- When the session expires, in milliseconds since the epoch
+	expires_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_threepid_sessions_address ON account_threepid_sessions(client_secret, medium, address);
+`
+
+const insertThreePIDSessionSQL = "" +
+	"INSERT INTO account_threepid_sessions (sid, client_secret, medium, address, token, next_link, send_attempt, expires_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const selectThreePIDSessionSQL = "" +
+	"SELECT sid, client_secret, medium, address, token, next_link, send_attempt, validated_ts, expires_ts" +
+	" FROM account_threepid_sessions WHERE sid = $1"
+
+const selectThreePIDSessionByAddressSQL = "" +
+	"SELECT sid, client_secret, medium, address, token, next_link, send_attempt, validated_ts, expires_ts" +
+	" FROM account_threepid_sessions WHERE client_secret = $1 AND medium = $2 AND address = $3" +
+	" ORDER BY expires_ts DESC LIMIT 1"
+
+const updateThreePIDSessionSendAttemptSQL = "" +
+	"UPDATE account_threepid_sessions SET send_attempt = $1 WHERE sid = $2"
+
+const updateThreePIDSessionValidatedSQL = "" +
+	"UPDATE account_threepid_sessions SET validated_ts = $1 WHERE sid = $2"
+
+const deleteThreePIDSessionSQL = "" +
+	"DELETE FROM account_threepid_sessions WHERE sid = $1"
+
+const deleteExpiredThreePIDSessionsSQL = "" +
+	"DELETE FROM account_threepid_sessions WHERE expires_ts <= $1"
+
+type threepidSessionsStatements struct {
+	db                                   *sql.DB
+	writer                               *sqlutil.TransactionWriter
+	insertThreePIDSessionStmt            *sql.Stmt
+	selectThreePIDSessionStmt            *sql.Stmt
+	selectThreePIDSessionByAddressStmt   *sql.Stmt
+	updateThreePIDSessionSendAttemptStmt *sql.Stmt
+	updateThreePIDSessionValidatedStmt   *sql.Stmt
+	deleteThreePIDSessionStmt            *sql.Stmt
+	deleteExpiredThreePIDSessionsStmt    *sql.Stmt
+}
+
+func (s *threepidSessionsStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+	s.writer = sqlutil.NewTransactionWriter()
+	_, err = db.Exec(threepidSessionsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertThreePIDSessionStmt, err = db.Prepare(insertThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDSessionStmt, err = db.Prepare(selectThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDSessionByAddressStmt, err = db.Prepare(selectThreePIDSessionByAddressSQL); err != nil {
+		return
+	}
+	if s.updateThreePIDSessionSendAttemptStmt, err = db.Prepare(updateThreePIDSessionSendAttemptSQL); err != nil {
+		return
+	}
+	if s.updateThreePIDSessionValidatedStmt, err = db.Prepare(updateThreePIDSessionValidatedSQL); err != nil {
+		return
+	}
+	if s.deleteThreePIDSessionStmt, err = db.Prepare(deleteThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredThreePIDSessionsStmt, err = db.Prepare(deleteExpiredThreePIDSessionsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *threepidSessionsStatements) insertThreePIDSession(
+	ctx context.Context, txn *sql.Tx, session *api.ThreePIDSession, token string,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.insertThreePIDSessionStmt)
+		_, err := stmt.ExecContext(
+			ctx, session.SID, session.ClientSecret, session.Medium, session.Address,
+			token, session.NextLink, session.SendAttempt, session.ExpiresTS,
+		)
+		return err
+	})
+}
+
+// selectThreePIDSession returns the session with the given ID and its token,
+// or nil if there is no such session.
+func (s *threepidSessionsStatements) selectThreePIDSession(
+	ctx context.Context, sid string,
+) (*api.ThreePIDSession, string, error) {
+	return scanThreePIDSession(s.selectThreePIDSessionStmt.QueryRowContext(ctx, sid))
+}
+
+// selectThreePIDSessionByAddress returns the latest session which was created
+// with the given client secret for the given 3PID and its token, or nil if
+// there is no such session.
+func (s *threepidSessionsStatements) selectThreePIDSessionByAddress(
+	ctx context.Context, clientSecret, medium, address string,
+) (*api.ThreePIDSession, string, error) {
+	return scanThreePIDSession(s.selectThreePIDSessionByAddressStmt.QueryRowContext(ctx, clientSecret, medium, address))
+}
+
+func scanThreePIDSession(row *sql.Row) (*api.ThreePIDSession, string, error) {
+	var session api.ThreePIDSession
+	var token string
+	err := row.Scan(
+		&session.SID, &session.ClientSecret, &session.Medium, &session.Address, &token,
+		&session.NextLink, &session.SendAttempt, &session.ValidatedTS, &session.ExpiresTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &session, token, nil
+}
+
+func (s *threepidSessionsStatements) updateThreePIDSessionSendAttempt(
+	ctx context.Context, txn *sql.Tx, sid string, sendAttempt int,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.updateThreePIDSessionSendAttemptStmt)
+		_, err := stmt.ExecContext(ctx, sendAttempt, sid)
+		return err
+	})
+}
+
+func (s *threepidSessionsStatements) updateThreePIDSessionValidated(
+	ctx context.Context, txn *sql.Tx, sid string, validatedTS gomatrixserverlib.Timestamp,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.updateThreePIDSessionValidatedStmt)
+		_, err := stmt.ExecContext(ctx, validatedTS, sid)
+		return err
+	})
+}
+
+func (s *threepidSessionsStatements) deleteThreePIDSession(
+	ctx context.Context, txn *sql.Tx, sid string,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deleteThreePIDSessionStmt)
+		_, err := stmt.ExecContext(ctx, sid)
+		return err
+	})
+}
+
+func (s *threepidSessionsStatements) deleteExpiredThreePIDSessions(
+	ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deleteExpiredThreePIDSessionsStmt)
+		_, err := stmt.ExecContext(ctx, now)
+		return err
+	})
+}
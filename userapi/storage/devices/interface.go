@@ -18,6 +18,7 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
@@ -30,10 +31,24 @@ type Database interface {
 	// and replaced with the given accessToken. If the given accessToken is already in use for another device,
 	// an error will be returned.
 	// If no device ID is given one is generated.
+	// If a refresh token is given then it can be used to replace the access token with RefreshDevice.
+	// If accessTokenExpiresTS is 0 then the access token never expires.
+	// The account type is stored with the device so that it doesn't need to be
+	// looked up for every request.
 	// Returns the device on success.
-	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string) (dev *api.Device, returnErr error)
+	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string, refreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp, accountType api.AccountType) (dev *api.Device, returnErr error)
+	// RefreshDevice replaces the access token and the refresh token of the device with the given refresh token.
+	// Returns sql.ErrNoRows if no device has the given refresh token.
+	RefreshDevice(ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp) (*api.Device, error)
 	UpdateDevice(ctx context.Context, localpart, deviceID string, displayName *string) error
+	// UpdateDevicesAccountType sets the account type of all of the devices of
+	// the user, e.g. when a guest account is upgraded.
+	UpdateDevicesAccountType(ctx context.Context, localpart string, accountType api.AccountType) error
+	// UpdateDeviceLastSeen records when the device was last used, and the IP address and user agent it was used from.
+	UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID, ipAddr, userAgent string, lastSeenTS gomatrixserverlib.Timestamp) error
 	RemoveDevice(ctx context.Context, deviceID, localpart string) error
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
-	RemoveAllDevices(ctx context.Context, localpart string) error
+	// RemoveAllDevices removes all of the devices of the user, except for
+	// the given device if one is given.
+	RemoveAllDevices(ctx context.Context, localpart, exceptDeviceID string) error
 }
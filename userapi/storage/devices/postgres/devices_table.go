@@ -51,41 +51,74 @@ CREATE TABLE IF NOT EXISTS device_devices (
     -- When this devices was first recognised on the network, as a unix timestamp (ms resolution).
     created_ts BIGINT NOT NULL,
     -- The display name, human friendlier than device_id and updatable
-    display_name TEXT
-    -- TODO: device keys, device display names, last used ts and IP address?, token restrictions (if 3rd-party OAuth app)
+    display_name TEXT,
+    -- The refresh token which can be used to get a new access token for this device, if any.
+    refresh_token TEXT,
+    -- When the access token expires, as a unix timestamp (ms resolution), or 0 if it never expires.
+    access_token_expires_ts BIGINT NOT NULL DEFAULT 0,
+    -- When this device was last used, as a unix timestamp (ms resolution), and the
+    -- IP address and user agent which it was last used from.
+    last_seen_ts BIGINT,
+    ip TEXT,
+    user_agent TEXT,
+    -- The type of the account which owns the device, see api.AccountType.
+    account_type SMALLINT NOT NULL DEFAULT 1
+    -- TODO: device keys, token restrictions (if 3rd-party OAuth app)
 );
 
+-- Add the columns which didn't exist when the table was first created.
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS last_seen_ts BIGINT;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS ip TEXT;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS user_agent TEXT;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS refresh_token TEXT;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS access_token_expires_ts BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS account_type SMALLINT NOT NULL DEFAULT 1;
+
 -- Device IDs must be unique for a given user.
 CREATE UNIQUE INDEX IF NOT EXISTS device_localpart_id_idx ON device_devices(localpart, device_id);
+-- Refresh tokens must be unique so that they identify a single device.
+CREATE UNIQUE INDEX IF NOT EXISTS device_refresh_token_idx ON device_devices(refresh_token);
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts, display_name) VALUES ($1, $2, $3, $4, $5)" +
+	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts, display_name, refresh_token, access_token_expires_ts, account_type)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, access_token_expires_ts, account_type FROM device_devices WHERE access_token = $1"
+
+const updateDeviceTokensSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, access_token_expires_ts = $3" +
+	" WHERE refresh_token = $4" +
+	" RETURNING session_id, device_id, localpart, account_type"
 
 const selectDeviceByIDSQL = "" +
-	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
+	"SELECT display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE localpart = $1 and device_id = $2"
 
 const selectDevicesByLocalpartSQL = "" +
-	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1"
+	"SELECT device_id, display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE localpart = $1"
 
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
+const updateDevicesAccountTypeSQL = "" +
+	"UPDATE device_devices SET account_type = $1 WHERE localpart = $2"
+
+const updateDeviceLastSeenSQL = "" +
+	"UPDATE device_devices SET last_seen_ts = $1, ip = $2, user_agent = $3 WHERE localpart = $4 AND device_id = $5"
+
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
 const deleteDevicesByLocalpartSQL = "" +
-	"DELETE FROM device_devices WHERE localpart = $1"
+	"DELETE FROM device_devices WHERE localpart = $1 AND device_id != $2"
 
 const deleteDevicesSQL = "" +
 	"DELETE FROM device_devices WHERE localpart = $1 AND device_id = ANY($2)"
 
 const selectDevicesByIDSQL = "" +
-	"SELECT device_id, localpart, display_name FROM device_devices WHERE device_id = ANY($1)"
+	"SELECT device_id, localpart, display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE device_id = ANY($1)"
 
 type devicesStatements struct {
 	insertDeviceStmt             *sql.Stmt
@@ -97,6 +130,9 @@ type devicesStatements struct {
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
+	updateDeviceTokensStmt       *sql.Stmt
+	updateDeviceLastSeenStmt     *sql.Stmt
+	updateDevicesAccountTypeStmt *sql.Stmt
 	serverName                   gomatrixserverlib.ServerName
 }
 
@@ -132,6 +168,15 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.selectDevicesByIDStmt, err = db.Prepare(selectDevicesByIDSQL); err != nil {
 		return
 	}
+	if s.updateDeviceTokensStmt, err = db.Prepare(updateDeviceTokensSQL); err != nil {
+		return
+	}
+	if s.updateDeviceLastSeenStmt, err = db.Prepare(updateDeviceLastSeenSQL); err != nil {
+		return
+	}
+	if s.updateDevicesAccountTypeStmt, err = db.Prepare(updateDevicesAccountTypeSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -141,22 +186,51 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 // Returns the device on success.
 func (s *devicesStatements) insertDevice(
 	ctx context.Context, txn *sql.Tx, id, localpart, accessToken string,
-	displayName *string,
+	displayName *string, refreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp,
+	accountType api.AccountType,
 ) (*api.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
+	// Devices without a refresh token store NULL, as refresh tokens must be unique.
+	nullableRefreshToken := sql.NullString{String: refreshToken, Valid: refreshToken != ""}
 	stmt := sqlutil.TxStmt(txn, s.insertDeviceStmt)
-	if err := stmt.QueryRowContext(ctx, id, localpart, accessToken, createdTimeMS, displayName).Scan(&sessionID); err != nil {
+	if err := stmt.QueryRowContext(
+		ctx, id, localpart, accessToken, createdTimeMS, displayName, nullableRefreshToken, accessTokenExpiresTS, accountType,
+	).Scan(&sessionID); err != nil {
 		return nil, err
 	}
 	return &api.Device{
-		ID:          id,
-		UserID:      userutil.MakeUserID(localpart, s.serverName),
-		AccessToken: accessToken,
-		SessionID:   sessionID,
+		ID:                   id,
+		UserID:               userutil.MakeUserID(localpart, s.serverName),
+		AccessToken:          accessToken,
+		SessionID:            sessionID,
+		AccessTokenExpiresTS: accessTokenExpiresTS,
+		AccountType:          accountType,
 	}, nil
 }
 
+// updateDeviceTokens replaces the access token and the refresh token of the
+// device with the given refresh token. Returns sql.ErrNoRows if there is no
+// device with the given refresh token.
+func (s *devicesStatements) updateDeviceTokens(
+	ctx context.Context, txn *sql.Tx, refreshToken, newAccessToken, newRefreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) (*api.Device, error) {
+	var dev api.Device
+	var localpart string
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceTokensStmt)
+	err := stmt.QueryRowContext(
+		ctx, newAccessToken, newRefreshToken, accessTokenExpiresTS, refreshToken,
+	).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccountType)
+	if err != nil {
+		return nil, err
+	}
+	dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+	dev.AccessToken = newAccessToken
+	dev.AccessTokenExpiresTS = accessTokenExpiresTS
+	return &dev, nil
+}
+
 // deleteDevice removes a single device by id and user localpart.
 func (s *devicesStatements) deleteDevice(
 	ctx context.Context, txn *sql.Tx, id, localpart string,
@@ -179,10 +253,10 @@ func (s *devicesStatements) deleteDevices(
 // deleteDevicesByLocalpart removes all devices for the
 // given user localpart.
 func (s *devicesStatements) deleteDevicesByLocalpart(
-	ctx context.Context, txn *sql.Tx, localpart string,
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
 ) error {
 	stmt := sqlutil.TxStmt(txn, s.deleteDevicesByLocalpartStmt)
-	_, err := stmt.ExecContext(ctx, localpart)
+	_, err := stmt.ExecContext(ctx, localpart, exceptDeviceID)
 	return err
 }
 
@@ -194,13 +268,30 @@ func (s *devicesStatements) updateDeviceName(
 	return err
 }
 
+func (s *devicesStatements) updateDevicesAccountType(
+	ctx context.Context, txn *sql.Tx, localpart string, accountType api.AccountType,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDevicesAccountTypeStmt)
+	_, err := stmt.ExecContext(ctx, accountType, localpart)
+	return err
+}
+
+func (s *devicesStatements) updateDeviceLastSeen(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, ipAddr, userAgent string,
+	lastSeenTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceLastSeenStmt)
+	_, err := stmt.ExecContext(ctx, lastSeenTS, ipAddr, userAgent, localpart, deviceID)
+	return err
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*api.Device, error) {
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccessTokenExpiresTS, &dev.AccountType)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -215,14 +306,16 @@ func (s *devicesStatements) selectDeviceByID(
 ) (*api.Device, error) {
 	var dev api.Device
 	var displayName sql.NullString
+	var seen lastSeen
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName, &seen.ts, &seen.ip, &seen.userAgent)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		if displayName.Valid {
 			dev.DisplayName = displayName.String
 		}
+		seen.apply(&dev)
 	}
 	return &dev, err
 }
@@ -238,12 +331,14 @@ func (s *devicesStatements) selectDevicesByID(ctx context.Context, deviceIDs []s
 		var dev api.Device
 		var localpart string
 		var displayName sql.NullString
-		if err := rows.Scan(&dev.ID, &localpart, &displayName); err != nil {
+		var seen lastSeen
+		if err := rows.Scan(&dev.ID, &localpart, &displayName, &seen.ts, &seen.ip, &seen.userAgent); err != nil {
 			return nil, err
 		}
 		if displayName.Valid {
 			dev.DisplayName = displayName.String
 		}
+		seen.apply(&dev)
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		devices = append(devices, dev)
 	}
@@ -265,10 +360,12 @@ func (s *devicesStatements) selectDevicesByLocalpart(
 	for rows.Next() {
 		var dev api.Device
 		var id, displayname sql.NullString
-		err = rows.Scan(&id, &displayname)
+		var seen lastSeen
+		err = rows.Scan(&id, &displayname, &seen.ts, &seen.ip, &seen.userAgent)
 		if err != nil {
 			return devices, err
 		}
+		seen.apply(&dev)
 		if id.Valid {
 			dev.ID = id.String
 		}
@@ -281,3 +378,18 @@ func (s *devicesStatements) selectDevicesByLocalpart(
 
 	return devices, rows.Err()
 }
+
+// lastSeen holds the nullable last seen columns of a device.
+type lastSeen struct {
+	ts        sql.NullInt64
+	ip        sql.NullString
+	userAgent sql.NullString
+}
+
+// apply copies the last seen information into the device, if the device has
+// been seen since it was created.
+func (l *lastSeen) apply(dev *api.Device) {
+	dev.LastSeenTS = gomatrixserverlib.Timestamp(l.ts.Int64)
+	dev.LastSeenIP = l.ip.String
+	dev.UserAgent = l.userAgent.String
+}
@@ -80,10 +80,15 @@ func (d *Database) GetDevicesByID(ctx context.Context, deviceIDs []string) ([]ap
 // and replaced with the given accessToken. If the given accessToken is already in use for another device,
 // an error will be returned.
 // If no device ID is given one is generated.
+// If a refresh token is given then it can be used to replace the access token with RefreshDevice.
+// If accessTokenExpiresTS is 0 then the access token never expires.
+// The account type is stored with the device so that it doesn't need to be
+// looked up for every request.
 // Returns the device on success.
 func (d *Database) CreateDevice(
 	ctx context.Context, localpart string, deviceID *string, accessToken string,
-	displayName *string,
+	displayName *string, refreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp,
+	accountType api.AccountType,
 ) (dev *api.Device, returnErr error) {
 	if deviceID != nil {
 		returnErr = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
@@ -93,7 +98,7 @@ func (d *Database) CreateDevice(
 				return err
 			}
 
-			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName)
+			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName, refreshToken, accessTokenExpiresTS, accountType)
 			return err
 		})
 	} else {
@@ -108,7 +113,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName)
+				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName, refreshToken, accessTokenExpiresTS, accountType)
 				return err
 			})
 			if returnErr == nil {
@@ -131,6 +136,21 @@ func generateDeviceID() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// RefreshDevice replaces the access token and the refresh token of the device
+// with the given refresh token, so that the old tokens can no longer be used.
+// If accessTokenExpiresTS is 0 then the new access token never expires.
+// Returns sql.ErrNoRows if no device has the given refresh token.
+func (d *Database) RefreshDevice(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) (dev *api.Device, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		dev, err = d.devices.updateDeviceTokens(ctx, txn, refreshToken, newAccessToken, newRefreshToken, accessTokenExpiresTS)
+		return err
+	})
+	return
+}
+
 // UpdateDevice updates the given device with the display name.
 // Returns SQL error if there are problems and nil on success.
 func (d *Database) UpdateDevice(
@@ -141,6 +161,27 @@ func (d *Database) UpdateDevice(
 	})
 }
 
+// UpdateDevicesAccountType sets the account type of all of the devices of the
+// user, e.g. when a guest account is upgraded.
+func (d *Database) UpdateDevicesAccountType(
+	ctx context.Context, localpart string, accountType api.AccountType,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.devices.updateDevicesAccountType(ctx, txn, localpart, accountType)
+	})
+}
+
+// UpdateDeviceLastSeen records when the given device was last used, and the
+// IP address and user agent which it was used from.
+func (d *Database) UpdateDeviceLastSeen(
+	ctx context.Context, localpart, deviceID, ipAddr, userAgent string,
+	lastSeenTS gomatrixserverlib.Timestamp,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.devices.updateDeviceLastSeen(ctx, txn, localpart, deviceID, ipAddr, userAgent, lastSeenTS)
+	})
+}
+
 // RemoveDevice revokes a device by deleting the entry in the database
 // matching with the given device ID and user ID localpart.
 // If the device doesn't exist, it will not return an error
@@ -172,13 +213,14 @@ func (d *Database) RemoveDevices(
 }
 
 // RemoveAllDevices revokes devices by deleting the entry in the
-// database matching the given user ID localpart.
+// database matching the given user ID localpart, except for the
+// device with the given ID if one is given.
 // If something went wrong during the deletion, it will return the SQL error.
 func (d *Database) RemoveAllDevices(
-	ctx context.Context, localpart string,
+	ctx context.Context, localpart, exceptDeviceID string,
 ) error {
 	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID); err != sql.ErrNoRows {
 			return err
 		}
 		return nil
@@ -40,55 +40,86 @@ CREATE TABLE IF NOT EXISTS device_devices (
     localpart TEXT ,
     created_ts BIGINT,
     display_name TEXT,
+    refresh_token TEXT,
+    access_token_expires_ts BIGINT NOT NULL DEFAULT 0,
+    last_seen_ts BIGINT,
+    ip TEXT,
+    user_agent TEXT,
+    account_type SMALLINT NOT NULL DEFAULT 1,
 
 		UNIQUE (localpart, device_id)
 );
 `
 
+// The unique index is created separately from the table, as the refresh_token
+// column has to be added to existing tables first, and SQLite can't add UNIQUE
+// columns.
+const devicesIndexSchema = `
+-- Refresh tokens must be unique so that they identify a single device.
+CREATE UNIQUE INDEX IF NOT EXISTS device_refresh_token_idx ON device_devices(refresh_token);
+`
+
 const insertDeviceSQL = "" +
-	"INSERT INTO device_devices (device_id, localpart, access_token, created_ts, display_name, session_id)" +
-	" VALUES ($1, $2, $3, $4, $5, $6)"
+	"INSERT INTO device_devices (device_id, localpart, access_token, created_ts, display_name, session_id, refresh_token, access_token_expires_ts, account_type)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
 
 const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM device_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, access_token_expires_ts, account_type FROM device_devices WHERE access_token = $1"
+
+const selectDeviceByRefreshTokenSQL = "" +
+	"SELECT session_id, device_id, localpart, account_type FROM device_devices WHERE refresh_token = $1"
+
+const updateDeviceTokensSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, access_token_expires_ts = $3" +
+	" WHERE refresh_token = $4"
 
 const selectDeviceByIDSQL = "" +
-	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
+	"SELECT display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE localpart = $1 and device_id = $2"
 
 const selectDevicesByLocalpartSQL = "" +
-	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1"
+	"SELECT device_id, display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE localpart = $1"
 
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
+const updateDevicesAccountTypeSQL = "" +
+	"UPDATE device_devices SET account_type = $1 WHERE localpart = $2"
+
+const updateDeviceLastSeenSQL = "" +
+	"UPDATE device_devices SET last_seen_ts = $1, ip = $2, user_agent = $3 WHERE localpart = $4 AND device_id = $5"
+
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
 const deleteDevicesByLocalpartSQL = "" +
-	"DELETE FROM device_devices WHERE localpart = $1"
+	"DELETE FROM device_devices WHERE localpart = $1 AND device_id != $2"
 
 const deleteDevicesSQL = "" +
 	"DELETE FROM device_devices WHERE localpart = $1 AND device_id IN ($2)"
 
 const selectDevicesByIDSQL = "" +
-	"SELECT device_id, localpart, display_name FROM device_devices WHERE device_id IN ($1)"
+	"SELECT device_id, localpart, display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE device_id IN ($1)"
 
 type devicesStatements struct {
-	db                           *sql.DB
-	writer                       *sqlutil.TransactionWriter
-	insertDeviceStmt             *sql.Stmt
-	selectDevicesCountStmt       *sql.Stmt
-	selectDeviceByTokenStmt      *sql.Stmt
-	selectDeviceByIDStmt         *sql.Stmt
-	selectDevicesByIDStmt        *sql.Stmt
-	selectDevicesByLocalpartStmt *sql.Stmt
-	updateDeviceNameStmt         *sql.Stmt
-	deleteDeviceStmt             *sql.Stmt
-	deleteDevicesByLocalpartStmt *sql.Stmt
-	serverName                   gomatrixserverlib.ServerName
+	db                             *sql.DB
+	writer                         *sqlutil.TransactionWriter
+	insertDeviceStmt               *sql.Stmt
+	selectDevicesCountStmt         *sql.Stmt
+	selectDeviceByTokenStmt        *sql.Stmt
+	selectDeviceByIDStmt           *sql.Stmt
+	selectDevicesByIDStmt          *sql.Stmt
+	selectDevicesByLocalpartStmt   *sql.Stmt
+	updateDeviceNameStmt           *sql.Stmt
+	deleteDeviceStmt               *sql.Stmt
+	deleteDevicesByLocalpartStmt   *sql.Stmt
+	selectDeviceByRefreshTokenStmt *sql.Stmt
+	updateDeviceTokensStmt         *sql.Stmt
+	updateDeviceLastSeenStmt       *sql.Stmt
+	updateDevicesAccountTypeStmt   *sql.Stmt
+	serverName                     gomatrixserverlib.ServerName
 }
 
 func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerName) (err error) {
@@ -98,6 +129,28 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if err != nil {
 		return
 	}
+	// Add the columns which didn't exist when the table was first created.
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "device_devices", "last_seen_ts", "BIGINT"); err != nil {
+		return
+	}
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "device_devices", "ip", "TEXT"); err != nil {
+		return
+	}
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "device_devices", "user_agent", "TEXT"); err != nil {
+		return
+	}
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "device_devices", "refresh_token", "TEXT"); err != nil {
+		return
+	}
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "device_devices", "access_token_expires_ts", "BIGINT NOT NULL DEFAULT 0"); err != nil {
+		return
+	}
+	if err = sqlutil.SQLiteAddColumnIfNotExists(db, "device_devices", "account_type", "SMALLINT NOT NULL DEFAULT 1"); err != nil {
+		return
+	}
+	if _, err = db.Exec(devicesIndexSchema); err != nil {
+		return
+	}
 	if s.insertDeviceStmt, err = db.Prepare(insertDeviceSQL); err != nil {
 		return
 	}
@@ -125,6 +178,18 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.selectDevicesByIDStmt, err = db.Prepare(selectDevicesByIDSQL); err != nil {
 		return
 	}
+	if s.selectDeviceByRefreshTokenStmt, err = db.Prepare(selectDeviceByRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.updateDeviceTokensStmt, err = db.Prepare(updateDeviceTokensSQL); err != nil {
+		return
+	}
+	if s.updateDeviceLastSeenStmt, err = db.Prepare(updateDeviceLastSeenSQL); err != nil {
+		return
+	}
+	if s.updateDevicesAccountTypeStmt, err = db.Prepare(updateDevicesAccountTypeSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -134,10 +199,13 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 // Returns the device on success.
 func (s *devicesStatements) insertDevice(
 	ctx context.Context, txn *sql.Tx, id, localpart, accessToken string,
-	displayName *string,
+	displayName *string, refreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp,
+	accountType api.AccountType,
 ) (*api.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
+	// Devices without a refresh token store NULL, as refresh tokens must be unique.
+	nullableRefreshToken := sql.NullString{String: refreshToken, Valid: refreshToken != ""}
 	err := s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
 		countStmt := sqlutil.TxStmt(txn, s.selectDevicesCountStmt)
 		insertStmt := sqlutil.TxStmt(txn, s.insertDeviceStmt)
@@ -145,7 +213,9 @@ func (s *devicesStatements) insertDevice(
 			return err
 		}
 		sessionID++
-		if _, err := insertStmt.ExecContext(ctx, id, localpart, accessToken, createdTimeMS, displayName, sessionID); err != nil {
+		if _, err := insertStmt.ExecContext(
+			ctx, id, localpart, accessToken, createdTimeMS, displayName, sessionID, nullableRefreshToken, accessTokenExpiresTS, accountType,
+		); err != nil {
 			return err
 		}
 		return nil
@@ -154,13 +224,42 @@ func (s *devicesStatements) insertDevice(
 		return nil, err
 	}
 	return &api.Device{
-		ID:          id,
-		UserID:      userutil.MakeUserID(localpart, s.serverName),
-		AccessToken: accessToken,
-		SessionID:   sessionID,
+		ID:                   id,
+		UserID:               userutil.MakeUserID(localpart, s.serverName),
+		AccessToken:          accessToken,
+		SessionID:            sessionID,
+		AccessTokenExpiresTS: accessTokenExpiresTS,
+		AccountType:          accountType,
 	}, nil
 }
 
+// updateDeviceTokens replaces the access token and the refresh token of the
+// device with the given refresh token. Returns sql.ErrNoRows if there is no
+// device with the given refresh token.
+func (s *devicesStatements) updateDeviceTokens(
+	ctx context.Context, txn *sql.Tx, refreshToken, newAccessToken, newRefreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) (*api.Device, error) {
+	var dev api.Device
+	var localpart string
+	err := s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		selectStmt := sqlutil.TxStmt(txn, s.selectDeviceByRefreshTokenStmt)
+		updateStmt := sqlutil.TxStmt(txn, s.updateDeviceTokensStmt)
+		if err := selectStmt.QueryRowContext(ctx, refreshToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccountType); err != nil {
+			return err
+		}
+		_, err := updateStmt.ExecContext(ctx, newAccessToken, newRefreshToken, accessTokenExpiresTS, refreshToken)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+	dev.AccessToken = newAccessToken
+	dev.AccessTokenExpiresTS = accessTokenExpiresTS
+	return &dev, nil
+}
+
 func (s *devicesStatements) deleteDevice(
 	ctx context.Context, txn *sql.Tx, id, localpart string,
 ) error {
@@ -192,11 +291,11 @@ func (s *devicesStatements) deleteDevices(
 }
 
 func (s *devicesStatements) deleteDevicesByLocalpart(
-	ctx context.Context, txn *sql.Tx, localpart string,
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
 ) error {
 	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
 		stmt := sqlutil.TxStmt(txn, s.deleteDevicesByLocalpartStmt)
-		_, err := stmt.ExecContext(ctx, localpart)
+		_, err := stmt.ExecContext(ctx, localpart, exceptDeviceID)
 		return err
 	})
 }
@@ -211,13 +310,34 @@ func (s *devicesStatements) updateDeviceName(
 	})
 }
 
+func (s *devicesStatements) updateDevicesAccountType(
+	ctx context.Context, txn *sql.Tx, localpart string, accountType api.AccountType,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.updateDevicesAccountTypeStmt)
+		_, err := stmt.ExecContext(ctx, accountType, localpart)
+		return err
+	})
+}
+
+func (s *devicesStatements) updateDeviceLastSeen(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, ipAddr, userAgent string,
+	lastSeenTS gomatrixserverlib.Timestamp,
+) error {
+	return s.writer.Do(s.db, txn, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.updateDeviceLastSeenStmt)
+		_, err := stmt.ExecContext(ctx, lastSeenTS, ipAddr, userAgent, localpart, deviceID)
+		return err
+	})
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*api.Device, error) {
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccessTokenExpiresTS, &dev.AccountType)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -232,14 +352,16 @@ func (s *devicesStatements) selectDeviceByID(
 ) (*api.Device, error) {
 	var dev api.Device
 	var displayName sql.NullString
+	var seen lastSeen
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName, &seen.ts, &seen.ip, &seen.userAgent)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		if displayName.Valid {
 			dev.DisplayName = displayName.String
 		}
+		seen.apply(&dev)
 	}
 	return &dev, err
 }
@@ -258,10 +380,12 @@ func (s *devicesStatements) selectDevicesByLocalpart(
 	for rows.Next() {
 		var dev api.Device
 		var id, displayname sql.NullString
-		err = rows.Scan(&id, &displayname)
+		var seen lastSeen
+		err = rows.Scan(&id, &displayname, &seen.ts, &seen.ip, &seen.userAgent)
 		if err != nil {
 			return devices, err
 		}
+		seen.apply(&dev)
 		if id.Valid {
 			dev.ID = id.String
 		}
@@ -292,14 +416,31 @@ func (s *devicesStatements) selectDevicesByID(ctx context.Context, deviceIDs []s
 		var dev api.Device
 		var localpart string
 		var displayName sql.NullString
-		if err := rows.Scan(&dev.ID, &localpart, &displayName); err != nil {
+		var seen lastSeen
+		if err := rows.Scan(&dev.ID, &localpart, &displayName, &seen.ts, &seen.ip, &seen.userAgent); err != nil {
 			return nil, err
 		}
 		if displayName.Valid {
 			dev.DisplayName = displayName.String
 		}
+		seen.apply(&dev)
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		devices = append(devices, dev)
 	}
 	return devices, rows.Err()
 }
+
+// lastSeen holds the nullable last seen columns of a device.
+type lastSeen struct {
+	ts        sql.NullInt64
+	ip        sql.NullString
+	userAgent sql.NullString
+}
+
+// apply copies the last seen information into the device, if the device has
+// been seen since it was created.
+func (l *lastSeen) apply(dev *api.Device) {
+	dev.LastSeenTS = gomatrixserverlib.Timestamp(l.ts.Int64)
+	dev.LastSeenIP = l.ip.String
+	dev.UserAgent = l.userAgent.String
+}
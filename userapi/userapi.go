@@ -15,15 +15,23 @@
 package userapi
 
 import (
+	"time"
+
+	"github.com/Shopify/sarama"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/consumers"
 	"github.com/matrix-org/dendrite/userapi/internal"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
+	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // AddInternalRoutes registers HTTP handlers for the internal API. Invokes functions
@@ -32,16 +40,49 @@ func AddInternalRoutes(router *mux.Router, intAPI api.UserInternalAPI) {
 	inthttp.AddRoutes(router, intAPI)
 }
 
+// NewSyncProducer returns a producer which tells the sync API about changes to
+// the unread notification counts of users and about devices being logged out.
+func NewSyncProducer(cfg *config.Dendrite, producer sarama.SyncProducer) *producers.SyncAPI {
+	return &producers.SyncAPI{
+		Topic:               string(cfg.Kafka.Topics.OutputNotificationData),
+		DevicesDeletedTopic: string(cfg.Kafka.Topics.OutputDevicesDeleted),
+		Producer:            producer,
+	}
+}
+
 // NewInternalAPI returns a concerete implementation of the internal API. Callers
 // can call functions directly on the returned API or via an HTTP interface using AddInternalRoutes.
+// If syncProducer is nil then the sync API isn't told when notifications are read.
+// Callers should call Stop on the returned API when shutting down, so that the
+// last seen information of devices isn't lost.
 func NewInternalAPI(accountDB accounts.Database, deviceDB devices.Database,
-	serverName gomatrixserverlib.ServerName, appServices []config.ApplicationService, keyAPI keyapi.KeyInternalAPI) api.UserInternalAPI {
+	serverName gomatrixserverlib.ServerName, appServices []config.ApplicationService, keyAPI keyapi.KeyInternalAPI,
+	syncProducer *producers.SyncAPI) *internal.UserInternalAPI {
 
 	return &internal.UserInternalAPI{
-		AccountDB:   accountDB,
-		DeviceDB:    deviceDB,
-		ServerName:  serverName,
-		AppServices: appServices,
-		KeyAPI:      keyAPI,
+		AccountDB:    accountDB,
+		DeviceDB:     deviceDB,
+		ServerName:   serverName,
+		AppServices:  appServices,
+		KeyAPI:       keyAPI,
+		LastSeen:     internal.NewLastSeenUpdater(deviceDB),
+		SyncProducer: syncProducer,
+	}
+}
+
+// pushGatewayTimeout is how long to wait for a push gateway to respond.
+const pushGatewayTimeout = 30 * time.Second
+
+// StartConsumers starts the consumers which evaluate the push rules of local
+// users against new events from the room server and notify their pushers.
+func StartConsumers(
+	cfg *config.Dendrite, kafkaConsumer sarama.Consumer,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	syncProducer *producers.SyncAPI,
+) {
+	pgClient := pushgateway.NewHTTPClient(pushGatewayTimeout)
+	roomConsumer := consumers.NewOutputRoomEventConsumer(cfg, kafkaConsumer, accountDB, rsAPI, pgClient, syncProducer)
+	if err := roomConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start room server consumer")
 	}
 }
@@ -2,17 +2,27 @@ package userapi_test
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/Shopify/sarama/mocks"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
+	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -32,14 +42,29 @@ func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database,
 		t.Fatalf("failed to create device DB: %s", err)
 	}
 
-	return userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, nil), accountDB, deviceDB
+	return userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, nil, nil), accountDB, deviceDB
+}
+
+// mockKeyAPI records the devices whose keys were deleted, and panics if
+// anything else is called.
+type mockKeyAPI struct {
+	keyapi.KeyInternalAPI
+	deletedDeviceIDs []string
+}
+
+func (k *mockKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+	for _, key := range req.DeviceKeys {
+		if key.KeyJSON == nil {
+			k.deletedDeviceIDs = append(k.deletedDeviceIDs, key.DeviceID)
+		}
+	}
 }
 
 func TestQueryProfile(t *testing.T) {
 	aliceAvatarURL := "mxc://example.com/alice"
 	aliceDisplayName := "Alice"
 	userAPI, accountDB, _ := MustMakeInternalAPI(t)
-	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "")
+	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "", api.AccountTypeUser)
 	if err != nil {
 		t.Fatalf("failed to make account: %s", err)
 	}
@@ -110,3 +135,540 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+func TestPerformPasswordUpdate(t *testing.T) {
+	ctx := context.Background()
+	for _, logoutDevices := range []bool{true, false} {
+		accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+		if err != nil {
+			t.Fatalf("failed to create account DB: %s", err)
+		}
+		deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+		if err != nil {
+			t.Fatalf("failed to create device DB: %s", err)
+		}
+		keyAPI := &mockKeyAPI{}
+		userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, keyAPI, nil)
+
+		if _, err = accountDB.CreateAccount(ctx, "alice", "oldpassword", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+		for _, deviceID := range []string{"current", "other"} {
+			deviceID := deviceID
+			if _, err = deviceDB.CreateDevice(ctx, "alice", &deviceID, "token_"+deviceID, nil, "", 0, api.AccountTypeUser); err != nil {
+				t.Fatalf("failed to make device: %s", err)
+			}
+		}
+
+		var res api.PerformPasswordUpdateResponse
+		err = userAPI.PerformPasswordUpdate(ctx, &api.PerformPasswordUpdateRequest{
+			Localpart:     "alice",
+			Password:      "newpassword",
+			LogoutDevices: logoutDevices,
+			DeviceID:      "current",
+		}, &res)
+		if err != nil {
+			t.Fatalf("logout_devices=%v: PerformPasswordUpdate returned error: %s", logoutDevices, err)
+		}
+		if !res.PasswordUpdated {
+			t.Errorf("logout_devices=%v: password wasn't updated", logoutDevices)
+		}
+		if _, err = accountDB.GetAccountByPassword(ctx, "alice", "newpassword"); err != nil {
+			t.Errorf("logout_devices=%v: can't log in with the new password: %s", logoutDevices, err)
+		}
+		if _, err = accountDB.GetAccountByPassword(ctx, "alice", "oldpassword"); err == nil {
+			t.Errorf("logout_devices=%v: can still log in with the old password", logoutDevices)
+		}
+
+		devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+		if err != nil {
+			t.Fatalf("failed to get devices: %s", err)
+		}
+		var deviceIDs []string
+		for _, dev := range devs {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+		// The device which changed the password is never logged out.
+		wantDeviceIDs := []string{"current", "other"}
+		var wantDeletedDeviceIDs []string
+		if logoutDevices {
+			wantDeviceIDs = []string{"current"}
+			wantDeletedDeviceIDs = []string{"other"}
+		}
+		if !test.UnsortedStringSliceEqual(deviceIDs, wantDeviceIDs) {
+			t.Errorf("logout_devices=%v: got devices %v, want %v", logoutDevices, deviceIDs, wantDeviceIDs)
+		}
+		if !reflect.DeepEqual(keyAPI.deletedDeviceIDs, wantDeletedDeviceIDs) {
+			t.Errorf("logout_devices=%v: got device keys deleted for %v, want %v", logoutDevices, keyAPI.deletedDeviceIDs, wantDeletedDeviceIDs)
+		}
+	}
+}
+
+func TestPerformPasswordUpdateUnknownAccount(t *testing.T) {
+	userAPI, _, _ := MustMakeInternalAPI(t)
+	var res api.PerformPasswordUpdateResponse
+	err := userAPI.PerformPasswordUpdate(context.Background(), &api.PerformPasswordUpdateRequest{
+		Localpart: "nobody",
+		Password:  "newpassword",
+	}, &res)
+	if err == nil || res.PasswordUpdated {
+		t.Errorf("PerformPasswordUpdate succeeded for an account which doesn't exist")
+	}
+}
+
+func TestPerformAccountDeactivation(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	keyAPI := &mockKeyAPI{}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, keyAPI, nil)
+
+	if _, err = accountDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	deviceID := "device"
+	if _, err = deviceDB.CreateDevice(ctx, "alice", &deviceID, "token", nil, "", 0, api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make device: %s", err)
+	}
+	if err = accountDB.SaveThreePIDAssociation(ctx, "alice@example.com", "alice", "email"); err != nil {
+		t.Fatalf("failed to save 3PID: %s", err)
+	}
+
+	var res api.PerformAccountDeactivationResponse
+	if err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart: "alice",
+	}, &res); err != nil {
+		t.Fatalf("PerformAccountDeactivation returned error: %s", err)
+	}
+	if !res.AccountDeactivated {
+		t.Errorf("account wasn't deactivated")
+	}
+	if _, err = accountDB.GetAccountByPassword(ctx, "alice", "password"); err == nil {
+		t.Errorf("deactivated account can still log in")
+	}
+	if devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice"); err != nil || len(devs) != 0 {
+		t.Errorf("got devices %v (error %v), want none", devs, err)
+	}
+	if !reflect.DeepEqual(keyAPI.deletedDeviceIDs, []string{deviceID}) {
+		t.Errorf("got device keys deleted for %v, want [%s]", keyAPI.deletedDeviceIDs, deviceID)
+	}
+	if threePIDs, err := accountDB.GetThreePIDsForLocalpart(ctx, "alice"); err != nil || len(threePIDs) != 0 {
+		t.Errorf("got 3PIDs %v (error %v), want none", threePIDs, err)
+	}
+}
+
+func TestDeletedDevicesSentToSyncAPI(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	syncProducer := mocks.NewSyncProducer(t, nil)
+	defer syncProducer.Close() // nolint: errcheck
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, &mockKeyAPI{}, &producers.SyncAPI{
+		DevicesDeletedTopic: "devices_deleted",
+		Producer:            syncProducer,
+	})
+
+	if _, err = accountDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	deviceID := "device"
+	if _, err = deviceDB.CreateDevice(ctx, "alice", &deviceID, "token", nil, "", 0, api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make device: %s", err)
+	}
+
+	// The sync API is told which devices were logged out, so that they stop
+	// peeking into rooms.
+	syncProducer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(value []byte) error {
+		var output api.OutputDevicesDeleted
+		if err := json.Unmarshal(value, &output); err != nil {
+			return err
+		}
+		if output.UserID != "@alice:example.com" || !reflect.DeepEqual(output.DeviceIDs, []string{deviceID}) {
+			return fmt.Errorf("got deleted devices %+v, want %s of @alice:example.com", output, deviceID)
+		}
+		return nil
+	})
+	var res api.PerformAccountDeactivationResponse
+	if err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart: "alice",
+	}, &res); err != nil {
+		t.Fatalf("PerformAccountDeactivation returned error: %s", err)
+	}
+}
+
+func TestGuestAccountUpgrade(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, &mockKeyAPI{}, nil)
+
+	var accRes api.PerformAccountCreationResponse
+	if err = userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeGuest,
+	}, &accRes); err != nil {
+		t.Fatalf("failed to make guest account: %s", err)
+	}
+	localpart := accRes.Account.Localpart
+	var devRes api.PerformDeviceCreationResponse
+	if err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   localpart,
+		AccessToken: "guest_token",
+	}, &devRes); err != nil {
+		t.Fatalf("failed to make guest device: %s", err)
+	}
+	accountType := func() api.AccountType {
+		var res api.QueryAccessTokenResponse
+		if err = userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "guest_token"}, &res); err != nil {
+			t.Fatalf("QueryAccessToken returned error: %s", err)
+		}
+		if res.Device == nil {
+			t.Fatalf("QueryAccessToken didn't return the device")
+		}
+		return res.Device.AccountType
+	}
+	if got := accountType(); got != api.AccountTypeGuest {
+		t.Fatalf("got account type %d for the guest device, want %d", got, api.AccountTypeGuest)
+	}
+
+	upgrade := func() error {
+		return userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			Localpart:    localpart,
+			Password:     "password",
+			AccountType:  api.AccountTypeUser,
+			UpgradeGuest: true,
+		}, &accRes)
+	}
+	if err = upgrade(); err != nil {
+		t.Fatalf("failed to upgrade guest account: %s", err)
+	}
+	if accRes.Account.AccountType != api.AccountTypeUser {
+		t.Errorf("got account type %d after upgrading, want %d", accRes.Account.AccountType, api.AccountTypeUser)
+	}
+	// The guest's device is no longer restricted once the account is upgraded.
+	if got := accountType(); got != api.AccountTypeUser {
+		t.Errorf("got account type %d for the upgraded device, want %d", got, api.AccountTypeUser)
+	}
+	if _, err = accountDB.GetAccountByPassword(ctx, localpart, "password"); err != nil {
+		t.Errorf("can't log in to the upgraded account with its password: %s", err)
+	}
+	// An account can only be upgraded once.
+	if err = upgrade(); err == nil {
+		t.Errorf("upgrading an account which isn't a guest succeeded")
+	} else if _, ok := err.(*api.ErrorForbidden); !ok {
+		t.Errorf("got error %s upgrading an account which isn't a guest, want ErrorForbidden", err)
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, &mockKeyAPI{}, nil)
+	if _, err = accountDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	queryToken := func(accessToken string) api.QueryAccessTokenResponse {
+		var res api.QueryAccessTokenResponse
+		if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: accessToken}, &res); err != nil {
+			t.Fatalf("QueryAccessToken returned error: %s", err)
+		}
+		return res
+	}
+
+	var createRes api.PerformDeviceCreationResponse
+	if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:             "alice",
+		AccessToken:           "short_lived",
+		RefreshToken:          "refresh",
+		AccessTokenLifetimeMS: 1,
+	}, &createRes); err != nil {
+		t.Fatalf("PerformDeviceCreation returned error: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// Expired tokens are reported separately from unknown tokens, so that the
+	// client can be told to refresh its token rather than being logged out.
+	if res := queryToken("short_lived"); !res.Expired || res.Device != nil {
+		t.Errorf("got %+v for an expired access token, want it expired with no device", res)
+	}
+	if res := queryToken("unknown"); res.Expired || res.Device != nil {
+		t.Errorf("got %+v for an unknown access token, want no device", res)
+	}
+
+	if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   "alice",
+		AccessToken: "long_lived",
+	}, &createRes); err != nil {
+		t.Fatalf("PerformDeviceCreation returned error: %s", err)
+	}
+	if res := queryToken("long_lived"); res.Expired || res.Device == nil {
+		t.Errorf("got %+v for an access token without a lifetime, want a device", res)
+	}
+}
+
+func TestPerformTokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, &mockKeyAPI{}, nil)
+	if _, err = accountDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	deviceID := "device"
+	var createRes api.PerformDeviceCreationResponse
+	if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:             "alice",
+		DeviceID:              &deviceID,
+		AccessToken:           "access1",
+		RefreshToken:          "refresh1",
+		AccessTokenLifetimeMS: 1,
+	}, &createRes); err != nil {
+		t.Fatalf("PerformDeviceCreation returned error: %s", err)
+	}
+	refresh := func(refreshToken, newAccessToken, newRefreshToken string) *api.Device {
+		var res api.PerformTokenRefreshResponse
+		if err := userAPI.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{
+			RefreshToken:          refreshToken,
+			NewAccessToken:        newAccessToken,
+			NewRefreshToken:       newRefreshToken,
+			AccessTokenLifetimeMS: 60 * 1000,
+		}, &res); err != nil {
+			t.Fatalf("PerformTokenRefresh returned error: %s", err)
+		}
+		return res.Device
+	}
+
+	dev := refresh("refresh1", "access2", "refresh2")
+	if dev == nil || dev.ID != deviceID || dev.UserID != "@alice:example.com" || dev.AccessToken != "access2" {
+		t.Fatalf("got device %+v after refreshing, want %s with the new access token", dev, deviceID)
+	}
+	var queryRes api.QueryAccessTokenResponse
+	if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "access2"}, &queryRes); err != nil {
+		t.Fatalf("QueryAccessToken returned error: %s", err)
+	}
+	if queryRes.Expired || queryRes.Device == nil || queryRes.Device.ID != deviceID {
+		t.Errorf("got %+v for the new access token, want %s", queryRes, deviceID)
+	}
+	queryRes = api.QueryAccessTokenResponse{}
+	if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "access1"}, &queryRes); err != nil {
+		t.Fatalf("QueryAccessToken returned error: %s", err)
+	}
+	if queryRes.Device != nil {
+		t.Errorf("old access token still belongs to device %+v after refreshing", queryRes.Device)
+	}
+
+	// Refresh tokens are rotated, so each one can only be used once.
+	if dev = refresh("refresh1", "access3", "refresh3"); dev != nil {
+		t.Errorf("old refresh token was accepted again for device %+v", dev)
+	}
+	if dev = refresh("refresh2", "access3", "refresh3"); dev == nil || dev.ID != deviceID {
+		t.Errorf("got device %+v after refreshing with the new refresh token, want %s", dev, deviceID)
+	}
+}
+
+func TestDevicesMigration(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dendrite-devices")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dataSource := "file:" + filepath.Join(dir, "devices.db")
+
+	// Create the table as it was before last seen information and refresh
+	// tokens were added.
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), dataSource)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	if _, err = db.Exec(`
+		CREATE TABLE device_devices (
+			access_token TEXT PRIMARY KEY,
+			session_id INTEGER,
+			device_id TEXT ,
+			localpart TEXT ,
+			created_ts BIGINT,
+			display_name TEXT,
+			UNIQUE (localpart, device_id)
+		);
+		INSERT INTO device_devices (access_token, session_id, device_id, localpart, created_ts)
+			VALUES ('old_token', 1, 'old_device', 'alice', 0);
+	`); err != nil {
+		t.Fatalf("failed to create old table: %s", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+
+	deviceDB, err := devices.NewDatabase(dataSource, nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to open device DB with an old table: %s", err)
+	}
+	dev, err := deviceDB.GetDeviceByAccessToken(ctx, "old_token")
+	if err != nil {
+		t.Fatalf("GetDeviceByAccessToken returned error: %s", err)
+	}
+	if dev.ID != "old_device" || dev.AccessTokenExpiresTS != 0 || dev.AccountType != api.AccountTypeUser {
+		t.Errorf("got device %+v, want old_device which never expires", dev)
+	}
+	if err = deviceDB.UpdateDeviceLastSeen(ctx, "alice", "old_device", "10.0.0.1", "agent", 1000); err != nil {
+		t.Fatalf("UpdateDeviceLastSeen returned error: %s", err)
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart returned error: %s", err)
+	}
+	if len(devs) != 1 || devs[0].LastSeenTS != 1000 || devs[0].LastSeenIP != "10.0.0.1" {
+		t.Errorf("got devices %+v, want old_device last seen from 10.0.0.1", devs)
+	}
+	deviceID := "new_device"
+	if _, err = deviceDB.CreateDevice(ctx, "alice", &deviceID, "new_token", nil, "refresh", 0, api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make device: %s", err)
+	}
+	// Refresh tokens must still be unique after migrating.
+	otherDeviceID := "other_device"
+	if _, err = deviceDB.CreateDevice(ctx, "alice", &otherDeviceID, "other_token", nil, "refresh", 0, api.AccountTypeUser); err == nil {
+		t.Errorf("made a device with a refresh token which is already in use")
+	}
+}
+
+func TestDeviceCreationDeactivated(t *testing.T) {
+	userAPI, accountDB, _ := MustMakeInternalAPI(t)
+	ctx := context.Background()
+	if _, err := accountDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	var deactivateRes api.PerformAccountDeactivationResponse
+	if err := userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart: "alice",
+	}, &deactivateRes); err != nil {
+		t.Fatalf("PerformAccountDeactivation returned error: %s", err)
+	}
+
+	// Whichever way the user logged in, deactivated accounts mustn't get a
+	// device.
+	var res api.PerformDeviceCreationResponse
+	err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   "alice",
+		AccessToken: "token",
+	}, &res)
+	if _, ok := err.(*api.ErrorForbidden); !ok {
+		t.Fatalf("got error %v making a device for a deactivated account, want ErrorForbidden", err)
+	}
+	if res.DeviceCreated {
+		t.Errorf("a device was made for a deactivated account")
+	}
+}
+
+func TestAccountCreationConflictUpdate(t *testing.T) {
+	userAPI, accountDB, _ := MustMakeInternalAPI(t)
+	ctx := context.Background()
+	if _, err := accountDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if err := accountDB.DeactivateAccount(ctx, "alice"); err != nil {
+		t.Fatalf("failed to deactivate account: %s", err)
+	}
+
+	// The existing account is returned as it is, rather than as if it were
+	// a new active account.
+	var res api.PerformAccountCreationResponse
+	if err := userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeUser,
+		Localpart:   "alice",
+		OnConflict:  api.ConflictUpdate,
+	}, &res); err != nil {
+		t.Fatalf("PerformAccountCreation returned error: %s", err)
+	}
+	if res.AccountCreated {
+		t.Errorf("got AccountCreated for an existing account")
+	}
+	if !res.Account.Deactivated || res.Account.AccountType != api.AccountTypeUser {
+		t.Errorf("got account %+v, want the deactivated user account", res.Account)
+	}
+}
+
+func TestThreePIDSessionDeletion(t *testing.T) {
+	userAPI, _, _ := MustMakeInternalAPI(t)
+	ctx := context.Background()
+	var createRes api.PerformThreePIDSessionCreationResponse
+	if err := userAPI.PerformThreePIDSessionCreation(ctx, &api.PerformThreePIDSessionCreationRequest{
+		ClientSecret: "secret",
+		Medium:       "email",
+		Address:      "alice@example.com",
+		SendAttempt:  1,
+		LifetimeMS:   time.Hour.Milliseconds(),
+	}, &createRes); err != nil {
+		t.Fatalf("PerformThreePIDSessionCreation returned error: %s", err)
+	}
+	var validateRes api.PerformThreePIDSessionValidationResponse
+	if err := userAPI.PerformThreePIDSessionValidation(ctx, &api.PerformThreePIDSessionValidationRequest{
+		SID:          createRes.SID,
+		ClientSecret: "secret",
+		Token:        createRes.Token,
+	}, &validateRes); err != nil || validateRes.Session == nil {
+		t.Fatalf("failed to validate session: %v", err)
+	}
+
+	// query returns whether the session can still be used.
+	query := func() bool {
+		var res api.QueryThreePIDSessionResponse
+		if err := userAPI.QueryThreePIDSession(ctx, &api.QueryThreePIDSessionRequest{
+			SID:          createRes.SID,
+			ClientSecret: "secret",
+		}, &res); err != nil {
+			t.Fatalf("QueryThreePIDSession returned error: %s", err)
+		}
+		return res.Session != nil && res.Session.Validated()
+	}
+	deleteSession := func(clientSecret string) {
+		if err := userAPI.PerformThreePIDSessionDeletion(ctx, &api.PerformThreePIDSessionDeletionRequest{
+			SID:          createRes.SID,
+			ClientSecret: clientSecret,
+		}, &api.PerformThreePIDSessionDeletionResponse{}); err != nil {
+			t.Fatalf("PerformThreePIDSessionDeletion returned error: %s", err)
+		}
+	}
+
+	if !query() {
+		t.Fatalf("a validated session couldn't be used")
+	}
+	// Only the client which made the session can remove it.
+	deleteSession("wrong secret")
+	if !query() {
+		t.Fatalf("a session was removed with the wrong client secret")
+	}
+	deleteSession("secret")
+	if query() {
+		t.Errorf("a session could still be used after it was removed")
+	}
+}